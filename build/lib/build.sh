@@ -43,7 +43,6 @@ function build::get_basic_cni() {
   fi
   tar zxf ${CNI_TGZ} -C ${BIN_DIR}
   # TODO remove these renames
-  mv ${BIN_DIR}/bridge ${BIN_DIR}/${BIN_PREFIX}-bridge
   mv ${BIN_DIR}/flannel ${BIN_DIR}/${BIN_PREFIX}-flannel
 }
 
@@ -56,7 +55,7 @@ function build::galaxy() {
   echo "Building plugins"
 
   # build galaxy cni plugins
-  PLUGINS="${PKG}/cni/k8s-vlan ${PKG}/cni/sdn ${PKG}/cni/veth ${PKG}/cni/k8s-sriov"
+  PLUGINS="${PKG}/cni/k8s-vlan ${PKG}/cni/sdn ${PKG}/cni/veth ${PKG}/cni/k8s-sriov ${PKG}/cni/bridge"
   for d in ${PLUGINS}; do
     plugin=$(basename $d)
     echo "  " ${plugin}
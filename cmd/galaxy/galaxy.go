@@ -18,6 +18,7 @@ package main
 
 import (
 	"math/rand"
+	"os"
 	"time"
 
 	"github.com/spf13/pflag"
@@ -25,6 +26,7 @@ import (
 	"k8s.io/component-base/logs"
 	glog "k8s.io/klog"
 	"tkestack.io/galaxy/pkg/galaxy"
+	"tkestack.io/galaxy/pkg/galaxy/options"
 	"tkestack.io/galaxy/pkg/signal"
 	"tkestack.io/galaxy/pkg/utils/ldflags"
 )
@@ -36,11 +38,23 @@ func main() {
 	// add command line args
 	galaxy.AddFlags(pflag.CommandLine)
 	flag.InitFlags()
+	if err := options.ApplyConfigFile(pflag.CommandLine, galaxy.ConfigFile); err != nil {
+		glog.Fatal(err)
+	}
 	logs.InitLogs()
 	defer logs.FlushLogs()
 
 	// if checking version, print it and exit
 	ldflags.PrintAndExitIfRequested()
+	if galaxy.DumpEffectiveConfig {
+		if err := galaxy.Validate(); err != nil {
+			glog.Fatal(err)
+		}
+		if err := options.DumpEffectiveConfig(pflag.CommandLine, os.Stdout); err != nil {
+			glog.Fatal(err)
+		}
+		os.Exit(0)
+	}
 	if err := galaxy.Start(); err != nil {
 		glog.Fatalf("Error start galaxy: %v", err)
 	}
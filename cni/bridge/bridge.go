@@ -0,0 +1,372 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	t020 "github.com/containernetworking/cni/pkg/types/020"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	"tkestack.io/galaxy/pkg/utils"
+)
+
+const (
+	defaultBridgeName = "cni0"
+	sysfsNet          = "/sys/class/net"
+)
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+type BridgeConf struct {
+	types.NetConf
+	// The bridge to attach veths to, created if not exist, default cni0
+	BrName string `json:"bridge"`
+	// Assigns the gateway address to the bridge
+	IsGW bool `json:"isGateway"`
+	// Adds the default route via the gateway to pods, implies isGateway
+	IsDefaultGW bool `json:"isDefaultGateway"`
+	// Replaces other addresses of the bridge with the gateway address if they conflict
+	ForceAddress bool `json:"forceAddress"`
+	// Masquerades traffic of pods leaving their subnet
+	IPMasq bool `json:"ipMasq"`
+	Mtu    int  `json:"mtu"`
+	// Sets hairpin mode of ports so that pods can reach themselves via services
+	HairpinMode bool `json:"hairpinMode"`
+	PromiscMode bool `json:"promiscMode"`
+	// Pvid of ports if vlan filtering of the bridge is on, default the default_pvid of the bridge
+	Vlan int `json:"vlan"`
+	// Sets isolated flag of ports, isolated ports only forward to ports which are not isolated
+	Isolated bool `json:"isolated"`
+}
+
+func loadConf(bytes []byte) (*BridgeConf, error) {
+	n := &BridgeConf{BrName: defaultBridgeName}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, fmt.Errorf("failed to load bridgeconf: %v", err)
+	}
+	if n.Vlan < 0 || n.Vlan > 4094 {
+		return nil, fmt.Errorf("bad vlan %d", n.Vlan)
+	}
+	if n.IsDefaultGW {
+		n.IsGW = true
+	}
+	return n, nil
+}
+
+func ensureBridge(conf *BridgeConf) (netlink.Link, error) {
+	br, err := netlink.LinkByName(conf.BrName)
+	if err != nil {
+		if !utils.IsLinkNotFound(err) {
+			return nil, fmt.Errorf("failed to lookup bridge %q: %v", conf.BrName, err)
+		}
+		if err := utils.CreateBridgeDevice(conf.BrName, nil); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+		if br, err = netlink.LinkByName(conf.BrName); err != nil {
+			return nil, fmt.Errorf("failed to lookup bridge %q: %v", conf.BrName, err)
+		}
+		if conf.Mtu != 0 {
+			if err := netlink.LinkSetMTU(br, conf.Mtu); err != nil {
+				return nil, fmt.Errorf("failed to set mtu of bridge %q: %v", conf.BrName, err)
+			}
+		}
+	}
+	if _, ok := br.(*netlink.Bridge); !ok {
+		return nil, fmt.Errorf("%q already exists but is not a bridge", conf.BrName)
+	}
+	if conf.PromiscMode {
+		if err := netlink.SetPromiscOn(br); err != nil {
+			return nil, fmt.Errorf("failed to set promisc mode of bridge %q: %v", conf.BrName, err)
+		}
+	}
+	if err := netlink.LinkSetUp(br); err != nil {
+		return nil, fmt.Errorf("failed to set bridge %q up: %v", conf.BrName, err)
+	}
+	return br, nil
+}
+
+func vlanFiltering(bridgeName string) (bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(sysfsNet, bridgeName, "bridge", "vlan_filtering"))
+	if err != nil {
+		return false, fmt.Errorf("failed to read vlan_filtering of bridge %s: %v", bridgeName, err)
+	}
+	return strings.TrimSpace(string(data)) == "1", nil
+}
+
+// setupPort sets flags and the pvid of the port. The kernel adds ports of vlan filtering bridges to the default_pvid
+// of the bridge untagged, which is replaced by the pvid of the conf if set.
+// #lizard forgives
+func setupPort(port netlink.Link, conf *BridgeConf) error {
+	name := port.Attrs().Name
+	if err := netlink.LinkSetHairpin(port, conf.HairpinMode); err != nil {
+		return fmt.Errorf("failed to set hairpin mode of port %s: %v", name, err)
+	}
+	if conf.Isolated {
+		file := filepath.Join(sysfsNet, name, "brport", "isolated")
+		if err := ioutil.WriteFile(file, []byte("1\n"), 0644); err != nil {
+			return fmt.Errorf("failed to set isolated flag of port %s, which requires kernel 4.18+: %v", name, err)
+		}
+	}
+	filtering, err := vlanFiltering(conf.BrName)
+	if err != nil {
+		return err
+	}
+	if !filtering {
+		if conf.Vlan != 0 {
+			return fmt.Errorf("vlan %d requires vlan_filtering of bridge %s", conf.Vlan, conf.BrName)
+		}
+		return nil
+	}
+	if conf.Vlan == 0 {
+		return nil
+	}
+	vlans, err := netlink.BridgeVlanList()
+	if err != nil {
+		return fmt.Errorf("failed to list bridge vlans: %v", err)
+	}
+	for _, vlan := range vlans[int32(port.Attrs().Index)] {
+		if int(vlan.Vid) == conf.Vlan {
+			continue
+		}
+		if err := netlink.BridgeVlanDel(port, vlan.Vid, false, false, false, true); err != nil {
+			return fmt.Errorf("failed to delete vlan %d of port %s: %v", vlan.Vid, name, err)
+		}
+	}
+	if err := netlink.BridgeVlanAdd(port, uint16(conf.Vlan), true, true, false, true); err != nil {
+		return fmt.Errorf("failed to set pvid %d of port %s: %v", conf.Vlan, name, err)
+	}
+	return nil
+}
+
+// ensureGatewayAddr assigns the gateway address to the bridge. Other addresses of the bridge within the same subnet
+// conflict with it, they are replaced if forceAddress is set.
+func ensureGatewayAddr(br netlink.Link, gw *net.IPNet, forceAddress bool) error {
+	addrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of bridge %q: %v", br.Attrs().Name, err)
+	}
+	for i := range addrs {
+		if addrs[i].IPNet.String() == gw.String() {
+			return nil
+		}
+		if !addrs[i].IPNet.Contains(gw.IP) && !gw.Contains(addrs[i].IP) {
+			continue
+		}
+		if !forceAddress {
+			return fmt.Errorf("bridge %q already has address %s which conflicts with %s", br.Attrs().Name,
+				addrs[i].IPNet.String(), gw.String())
+		}
+		if err := netlink.AddrDel(br, &addrs[i]); err != nil {
+			return fmt.Errorf("failed to delete address %s of bridge %q: %v", addrs[i].IPNet.String(),
+				br.Attrs().Name, err)
+		}
+	}
+	if err := netlink.AddrAdd(br, &netlink.Addr{IPNet: gw}); err != nil {
+		return fmt.Errorf("failed to add address %s to bridge %q: %v", gw.String(), br.Attrs().Name, err)
+	}
+	return nil
+}
+
+// #lizard forgives
+func connectsBridgeWithContainer(result *t020.Result, args *skel.CmdArgs, conf *BridgeConf) error {
+	if _, err := ensureBridge(conf); err != nil {
+		return err
+	}
+	host, sbox, err := utils.CreateVeth(args.ContainerID, conf.Mtu, "")
+	if err != nil {
+		return err
+	}
+	// nolint: errcheck
+	defer func() {
+		if err != nil {
+			if host != nil {
+				netlink.LinkDel(host)
+			}
+			if sbox != nil {
+				netlink.LinkDel(sbox)
+			}
+		}
+	}()
+	if err = utils.AddToBridge(host.Attrs().Name, conf.BrName); err != nil {
+		return fmt.Errorf("adding interface %q to bridge %q failed: %v", host.Attrs().Name, conf.BrName, err)
+	}
+	if err = setupPort(host, conf); err != nil {
+		return err
+	}
+	// Up the host interface after finishing all netlink configuration
+	if err = netlink.LinkSetUp(host); err != nil {
+		return fmt.Errorf("could not set link up for host interface %q: %v", host.Attrs().Name, err)
+	}
+	var netns ns.NetNS
+	if netns, err = ns.GetNS(args.Netns); err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close() // nolint: errcheck
+	// move sbox veth device to ns
+	if err = netlink.LinkSetNsFd(sbox, int(netns.Fd())); err != nil {
+		return fmt.Errorf("failed to move sbox device %q to netns: %v", sbox.Attrs().Name, err)
+	}
+	err = netns.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkSetName(sbox, args.IfName); err != nil {
+			return fmt.Errorf("failed to rename sbox device %q to %q: %v", sbox.Attrs().Name, args.IfName, err)
+		}
+		// Add IP and routes to sbox, including default route
+		return cniutil.ConfigureIface(args.IfName, result)
+	})
+	return err
+}
+
+func masqChain(containerID string) string {
+	if len(containerID) > 12 {
+		containerID = containerID[:12]
+	}
+	return "GALAXY-BR-" + containerID
+}
+
+func masqComment(conf *BridgeConf, containerID string) string {
+	return fmt.Sprintf("name: %q id: %q", conf.Name, containerID)
+}
+
+// Usage with flannel plugin
+// {"galaxy-flannel":{"delegate":{"type":"galaxy-bridge","isDefaultGateway":true,"forceAddress":true},
+// "subnetFile":"/run/flannel/subnet.env"}}
+// #lizard forgives
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	// run the IPAM plugin and get back the config to apply
+	generalResult, err := ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
+	if err != nil {
+		return err
+	}
+	result020, err := generalResult.GetAsVersion(t020.ImplementedSpecVersion)
+	if err != nil {
+		return err
+	}
+	result, ok := result020.(*t020.Result)
+	if !ok {
+		return fmt.Errorf("failed to convert result")
+	}
+	if result.IP4 == nil {
+		return fmt.Errorf("IPAM plugin returned missing IPv4 config")
+	}
+	if result.IP4.Gateway == nil && conf.IsGW {
+		result.IP4.Gateway = ip.NextIP(result.IP4.IP.IP.Mask(result.IP4.IP.Mask))
+	}
+	if conf.IsDefaultGW {
+		_, defaultDst, _ := net.ParseCIDR("0.0.0.0/0")
+		result.IP4.Routes = append(result.IP4.Routes, types.Route{Dst: *defaultDst, GW: result.IP4.Gateway})
+	}
+	if err := connectsBridgeWithContainer(result, args, conf); err != nil {
+		return err
+	}
+	if conf.IsGW {
+		br, err := netlink.LinkByName(conf.BrName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup bridge %q: %v", conf.BrName, err)
+		}
+		gw := &net.IPNet{IP: result.IP4.Gateway, Mask: result.IP4.IP.Mask}
+		if err := ensureGatewayAddr(br, gw, conf.ForceAddress); err != nil {
+			return err
+		}
+		if err := ip.EnableIP4Forward(); err != nil {
+			return fmt.Errorf("failed to enable forwarding: %v", err)
+		}
+	}
+	if conf.IPMasq {
+		if err := ip.SetupIPMasq(ip.Network(&result.IP4.IP), masqChain(args.ContainerID),
+			masqComment(conf, args.ContainerID)); err != nil {
+			return err
+		}
+	}
+	result.DNS = conf.DNS
+	return result.Print()
+}
+
+func containerAddr(netnsPath, ifName string) (*net.IPNet, error) {
+	var ipn *net.IPNet
+	err := ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return err
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		if len(addrs) > 0 {
+			ipn = addrs[0].IPNet
+		}
+		return nil
+	})
+	return ipn, err
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.IPMasq && args.Netns != "" {
+		// the netns may be gone if kubelet retries, masquerade rules are left to the chain then
+		if ipn, err := containerAddr(args.Netns, args.IfName); err == nil && ipn != nil {
+			if err := ip.TeardownIPMasq(ip.Network(ipn), masqChain(args.ContainerID),
+				masqComment(conf, args.ContainerID)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := utils.DeleteVeth(args.Netns, args.IfName); err != nil {
+		return err
+	}
+
+	if err := utils.DeleteHostVeth(args.ContainerID); err != nil {
+		return err
+	}
+
+	if err := ipam.ExecDel(conf.IPAM.Type, args.StdinData); err != nil {
+		return err
+	}
+	return nil
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdDel, version.Legacy)
+}
@@ -26,6 +26,7 @@ import (
 	t020 "github.com/containernetworking/cni/pkg/types/020"
 	"github.com/containernetworking/cni/pkg/version"
 	"tkestack.io/galaxy/cni/ipam"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
 	"tkestack.io/galaxy/pkg/network/vlan"
 	"tkestack.io/galaxy/pkg/utils"
 )
@@ -70,35 +71,72 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
-	if err := setupNetwork(result020s, vlanIds, args); err != nil {
+	if err := probeIPs(result020s, vlanIds); err != nil {
 		return err
 	}
-	result020s[0].DNS = conf.DNS
-	return result020s[0].Print()
+	links, err := setupNetwork(result020s, vlanIds, args)
+	if err != nil {
+		return err
+	}
+	result, err := newResult(result020s, links, args.Netns, conf.DNS)
+	if err != nil {
+		return err
+	}
+	return types.PrintResult(result, conf.CNIVersion)
+}
+
+// probeIPs fails the request with ErrCodeIPConflict if any ip is in use on the underlay
+func probeIPs(result020s []*t020.Result, vlanIds []uint16) error {
+	for i := range result020s {
+		if result020s[i].IP4 == nil {
+			continue
+		}
+		if err := d.ProbeIP(result020s[i].IP4.IP.IP, vlanIds[i]); err != nil {
+			if conflict, ok := err.(*vlan.IPConflictError); ok {
+				return &types.Error{Code: galaxyapi.ErrCodeIPConflict, Msg: "ip is in use", Details: conflict.Error()}
+			}
+			return err
+		}
+	}
+	return nil
 }
 
-func setupNetwork(result020s []*t020.Result, vlanIds []uint16, args *skel.CmdArgs) error {
+func setupNetwork(result020s []*t020.Result, vlanIds []uint16, args *skel.CmdArgs) ([]podLink, error) {
+	var links []podLink
 	if d.MacVlanMode() {
 		if err := setupMacvlan(result020s[0], vlanIds[0], args); err != nil {
-			return err
+			return nil, err
 		}
+		links = []podLink{{ifName: args.IfName}}
 	} else if d.IPVlanMode() {
 		if err := setupIPVlan(result020s[0], vlanIds[0], args); err != nil {
-			return err
+			return nil, err
+		}
+		links = []podLink{{ifName: args.IfName}}
+	} else if d.SRIOVMode() {
+		if err := d.SetupVF(vlan.NewVFPool(vlan.VFPoolDir), args.ContainerID, vlanIds[0], args.Netns, args.IfName,
+			result020s[0]); err != nil {
+			return nil, err
 		}
+		_ = utils.SendGratuitousARP(args.IfName, result020s[0].IP4.IP.IP.String(), args.Netns, d.GratuitousArpRequest)
+		links = []podLink{{ifName: args.IfName}}
 	} else {
 		ifName := args.IfName
-		if err := setupVlanDevice(result020s, vlanIds, args); err != nil {
-			return err
+		var err error
+		if links, err = setupVlanDevice(result020s, vlanIds, args); err != nil {
+			return nil, err
 		}
 		args.IfName = ifName
 	}
+	if err := d.SetupPodMulticast(args.Netns, args.IfName); err != nil {
+		return nil, err
+	}
 	//send Gratuitous ARP to let switch knows IP floats onto this node
 	//ignore errors as we can't print logs and we do this as best as we can
 	if d.PureMode() {
 		_ = utils.SendGratuitousARP(d.Device, result020s[0].IP4.IP.IP.String(), "", d.GratuitousArpRequest)
 	}
-	return nil
+	return links, nil
 }
 
 func setupMacvlan(result *t020.Result, vlanId uint16, args *skel.CmdArgs) error {
@@ -123,7 +161,8 @@ func setupIPVlan(result *t020.Result, vlanId uint16, args *skel.CmdArgs) error {
 	return nil
 }
 
-func setupVlanDevice(result020s []*t020.Result, vlanIds []uint16, args *skel.CmdArgs) error {
+func setupVlanDevice(result020s []*t020.Result, vlanIds []uint16, args *skel.CmdArgs) ([]podLink, error) {
+	var links []podLink
 	ifName := args.IfName
 	ifIndex := 0
 	for i := 0; i < len(result020s); i++ {
@@ -131,7 +170,10 @@ func setupVlanDevice(result020s []*t020.Result, vlanIds []uint16, args *skel.Cmd
 		result020 := result020s[i]
 		bridgeName, err := d.CreateBridgeAndVlanDevice(vlanId)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if err := d.SetupBridgeMulticast(bridgeName); err != nil {
+			return nil, err
 		}
 		suffix := ""
 		if i != 0 {
@@ -144,11 +186,18 @@ func setupVlanDevice(result020s []*t020.Result, vlanIds []uint16, args *skel.Cmd
 			}
 		}
 		if err := utils.VethConnectsHostWithContainer(result020, args, bridgeName, suffix); err != nil {
-			return err
+			return nil, err
+		}
+		hostName := utils.HostVethName(args.ContainerID, suffix)
+		if bridgeName == "" && result020.IP6 != nil {
+			if err := d.SetupPureIPv6(hostName, result020.IP6.IP.IP, result020.IP6.Gateway); err != nil {
+				return nil, err
+			}
 		}
+		links = append(links, podLink{hostName: hostName, ifName: args.IfName})
 		_ = utils.SendGratuitousARP(args.IfName, result020s[0].IP4.IP.IP.String(), args.Netns, d.GratuitousArpRequest)
 	}
-	return nil
+	return links, nil
 }
 
 func resultConvert(results []types.Result) ([]*t020.Result, error) {
@@ -175,17 +224,22 @@ func resultConvert(results []types.Result) ([]*t020.Result, error) {
 }
 
 func cmdDel(args *skel.CmdArgs) error {
-	if err := utils.DeleteAllVeth(args.Netns); err != nil {
-		return err
-	}
 	conf, err := d.LoadConf(args.StdinData)
 	if err != nil {
 		return err
 	}
+	if d.SRIOVMode() {
+		// the VF is reusable only after it is back in the host netns
+		if err := d.ReleaseVF(vlan.NewVFPool(vlan.VFPoolDir), args.ContainerID, args.Netns, args.IfName); err != nil {
+			return err
+		}
+	} else if err := utils.DeleteAllVeth(args.Netns); err != nil {
+		return err
+	}
 	return ipam.Release(conf.IPAM.Type, args)
 }
 
 func main() {
 	d = &vlan.VlanDriver{}
-	skel.PluginMain(cmdAdd, cmdDel, version.Legacy)
+	skel.PluginMain(cmdAdd, cmdDel, version.All)
 }
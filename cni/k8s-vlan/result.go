@@ -0,0 +1,103 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/types"
+	t020 "github.com/containernetworking/cni/pkg/types/020"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// podLink is a pod interface set up by the plugin and the host device attached to the bridge or proxying arp for it
+type podLink struct {
+	// hostName is empty for macvlan and ipvlan pods as they have no host side device
+	hostName string
+	ifName   string
+}
+
+// newResult builds a result of interfaces, ips and routes of links, results[i] is the ipam result of links[i]
+func newResult(results []*t020.Result, links []podLink, netnsPath string, dns types.DNS) (*current.Result, error) {
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netns %q: %v", netnsPath, err)
+	}
+	defer netns.Close() // nolint: errcheck
+	result := &current.Result{DNS: dns}
+	for i, link := range links {
+		if link.hostName != "" {
+			host, err := netlink.LinkByName(link.hostName)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get host interface %s: %v", link.hostName, err)
+			}
+			result.Interfaces = append(result.Interfaces, &current.Interface{
+				Name: link.hostName,
+				Mac:  host.Attrs().HardwareAddr.String(),
+			})
+		}
+		var mac string
+		if err := netns.Do(func(_ ns.NetNS) error {
+			sbox, err := netlink.LinkByName(link.ifName)
+			if err != nil {
+				return err
+			}
+			mac = sbox.Attrs().HardwareAddr.String()
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("failed to get container interface %s: %v", link.ifName, err)
+		}
+		result.Interfaces = append(result.Interfaces, &current.Interface{
+			Name:    link.ifName,
+			Mac:     mac,
+			Sandbox: netnsPath,
+		})
+		index := len(result.Interfaces) - 1
+		ip4 := results[i].IP4
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Version:   "4",
+			Interface: &index,
+			Address:   ip4.IP,
+			Gateway:   ip4.Gateway,
+		})
+		appendRoutes(result, ip4)
+		if ip6 := results[i].IP6; ip6 != nil {
+			result.IPs = append(result.IPs, &current.IPConfig{
+				Version:   "6",
+				Interface: &index,
+				Address:   ip6.IP,
+				Gateway:   ip6.Gateway,
+			})
+			appendRoutes(result, ip6)
+		}
+	}
+	return result, nil
+}
+
+func appendRoutes(result *current.Result, ipc *t020.IPConfig) {
+	for j := range ipc.Routes {
+		// routes are installed via the gateway of their interface if they have none, keep it explicit as
+		// routes of all interfaces are merged into one list
+		route := ipc.Routes[j]
+		if route.GW == nil {
+			route.GW = ipc.Gateway
+		}
+		result.Routes = append(result.Routes, &route)
+	}
+}
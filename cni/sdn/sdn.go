@@ -27,16 +27,49 @@ import (
 	"strings"
 
 	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
 	t020 "github.com/containernetworking/cni/pkg/types/020"
 	"github.com/containernetworking/cni/pkg/version"
 	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
 	"tkestack.io/galaxy/pkg/api/galaxy/private"
+	"tkestack.io/galaxy/pkg/utils/endpoint"
 )
 
 type cniPlugin struct {
 	socketPath string
 }
 
+// NetConf is the conf of galaxy-sdn
+type NetConf struct {
+	// TokenFile is the file of the shared token galaxy requires if started with --socket-token-file
+	TokenFile string `json:"tokenFile"`
+	// Socket is the endpoint of galaxy if it is not the default unix socket, e.g. abstract:galaxy or vsock:10000 which
+	// galaxy serves by --extra-listen-addresses
+	Socket string `json:"socket"`
+}
+
+func loadConf(args *skel.CmdArgs) (*NetConf, error) {
+	conf := &NetConf{}
+	if len(args.StdinData) > 0 {
+		if err := json.Unmarshal(args.StdinData, conf); err != nil {
+			return nil, fmt.Errorf("failed to parse conf: %v", err)
+		}
+	}
+	return conf, nil
+}
+
+// readToken returns the shared token of the galaxy socket if the conf specifies one
+func readToken(conf *NetConf) (string, error) {
+	if conf.TokenFile == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(conf.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
 func NewCNIPlugin(socketPath string) *cniPlugin {
 	return &cniPlugin{socketPath: socketPath}
 }
@@ -60,21 +93,41 @@ func newCNIRequest(args *skel.CmdArgs) *galaxyapi.CNIRequest {
 
 // Send a CNI request to the CNI server via JSON + HTTP over a root-owned unix socket,
 // and return the result
-func (p *cniPlugin) doCNI(url string, req *galaxyapi.CNIRequest) ([]byte, error) {
+func (p *cniPlugin) doCNI(url string, req *galaxyapi.CNIRequest, conf *NetConf) ([]byte, error) {
+	token, err := readToken(conf)
+	if err != nil {
+		return nil, err
+	}
 	data, err := json.Marshal(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal CNI request %v: %v", req, err)
 	}
+	socket := p.socketPath
+	if conf.Socket != "" {
+		socket = conf.Socket
+	}
+	e, err := endpoint.Parse(socket)
+	if err != nil {
+		return nil, err
+	}
 
 	client := &http.Client{
 		Transport: &http.Transport{
 			Dial: func(proto, addr string) (net.Conn, error) {
-				return net.Dial("unix", p.socketPath)
+				return e.Dial()
 			},
 		},
 	}
 
-	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CNI request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		httpReq.Header.Set(private.GalaxyTokenHeader, token)
+	}
+	resp, err := client.Do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send CNI request: %v", err)
 	}
@@ -86,6 +139,11 @@ func (p *cniPlugin) doCNI(url string, req *galaxyapi.CNIRequest) ([]byte, error)
 	}
 
 	if resp.StatusCode != 200 {
+		// galaxy responds with a cni error if the runtime needs its code, e.g. the sandbox is gone
+		cniErr := &types.Error{}
+		if json.Unmarshal(body, cniErr) == nil && cniErr.Code != 0 {
+			return nil, cniErr
+		}
 		return nil, fmt.Errorf("galaxy returns: %s", string(body))
 	}
 
@@ -95,19 +153,42 @@ func (p *cniPlugin) doCNI(url string, req *galaxyapi.CNIRequest) ([]byte, error)
 // Send the ADD command environment and config to the CNI server, returning
 // the IPAM result to the caller
 func (p *cniPlugin) CmdAdd(args *skel.CmdArgs) (*t020.Result, error) {
-	body, err := p.doCNI("http://dummy/cni", newCNIRequest(args))
+	conf, err := loadConf(args)
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.doCNI("http://dummy/cni", newCNIRequest(args), conf)
 	if err != nil {
 		return nil, err
 	}
 
-	result := &t020.Result{}
-	if err := json.Unmarshal(body, result); err != nil {
+	result, err := parseResult(body)
+	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal response '%s': %v", string(body), err)
 	}
 
 	return result, nil
 }
 
+// parseResult parses a result of any cni version galaxy responds with, e.g. the merged result of pods of multiple
+// networks, and converts it to a 020 result
+func parseResult(body []byte) (*t020.Result, error) {
+	var v struct {
+		CNIVersion string `json:"cniVersion"`
+	}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+	if v.CNIVersion == "" {
+		v.CNIVersion = t020.ImplementedSpecVersion
+	}
+	result, err := version.NewResult(v.CNIVersion, body)
+	if err != nil {
+		return nil, err
+	}
+	return t020.GetResult(result)
+}
+
 // Send the ADD command environment and config to the CNI server, printing
 // the IPAM result to stdout when called as a CNI plugin
 func (p *cniPlugin) skelCmdAdd(args *skel.CmdArgs) error {
@@ -120,11 +201,64 @@ func (p *cniPlugin) skelCmdAdd(args *skel.CmdArgs) error {
 
 // Send the DEL command environment and config to the CNI server
 func (p *cniPlugin) CmdDel(args *skel.CmdArgs) error {
-	_, err := p.doCNI("http://dummy/cni", newCNIRequest(args))
+	conf, err := loadConf(args)
+	if err != nil {
+		return err
+	}
+	_, err = p.doCNI("http://dummy/cni", newCNIRequest(args), conf)
+	return err
+}
+
+// Send the CHECK command environment and config to the CNI server
+func (p *cniPlugin) CmdCheck(args *skel.CmdArgs) error {
+	conf, err := loadConf(args)
+	if err != nil {
+		return err
+	}
+	_, err = p.doCNI("http://dummy/cni", newCNIRequest(args), conf)
+	return err
+}
+
+// Send the GC command environment and config to the CNI server, the config carries the valid attachments
+func (p *cniPlugin) CmdGC(args *skel.CmdArgs) error {
+	conf, err := loadConf(args)
+	if err != nil {
+		return err
+	}
+	_, err = p.doCNI("http://dummy/cni", newCNIRequest(args), conf)
 	return err
 }
 
+// skelCmd serves CHECK and GC which skel of the vendored cni library doesn't know, args are read from the environment
+// and stdin as skel does
+func (p *cniPlugin) skelCmd(cmd func(*skel.CmdArgs) error) error {
+	stdinData, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("error reading from stdin: %v", err)
+	}
+	return cmd(&skel.CmdArgs{
+		ContainerID: os.Getenv("CNI_CONTAINERID"),
+		Netns:       os.Getenv("CNI_NETNS"),
+		IfName:      os.Getenv("CNI_IFNAME"),
+		Args:        os.Getenv("CNI_ARGS"),
+		Path:        os.Getenv("CNI_PATH"),
+		StdinData:   stdinData,
+	})
+}
+
 func main() {
 	p := NewCNIPlugin(private.GalaxySocketPath)
+	cmds := map[string]func(*skel.CmdArgs) error{"CHECK": p.CmdCheck, "GC": p.CmdGC}
+	if cmd, ok := cmds[os.Getenv("CNI_COMMAND")]; ok {
+		if err := p.skelCmd(cmd); err != nil {
+			cniErr, ok := err.(*types.Error)
+			if !ok {
+				cniErr = &types.Error{Code: 100, Msg: err.Error()}
+			}
+			_ = cniErr.Print()
+			os.Exit(1)
+		}
+		return
+	}
 	skel.PluginMain(p.skelCmdAdd, p.CmdDel, version.Legacy)
 }
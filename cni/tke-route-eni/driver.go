@@ -26,6 +26,7 @@ import (
 	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
+	"tkestack.io/galaxy/pkg/utils"
 )
 
 const (
@@ -338,10 +339,7 @@ func addFromPodRule(addr *net.IPNet, table int) error {
 }
 
 func containsNoSuchRule(err error) bool {
-	if errno, ok := err.(syscall.Errno); ok {
-		return errno == syscall.ENOENT
-	}
-	return false
+	return utils.IsErrno(err, syscall.ENOENT)
 }
 
 func cleanHostRule(saddr string, routeTable int) error {
@@ -381,8 +379,5 @@ func cleanHostRule(saddr string, routeTable int) error {
 }
 
 func containerNoSuchRoute(err error) bool {
-	if errno, ok := err.(syscall.Errno); ok {
-		return errno == syscall.ESRCH
-	}
-	return false
+	return utils.IsErrno(err, syscall.ESRCH)
 }
@@ -113,3 +113,29 @@ func CreateFakeClient() *fake.Clientset {
 
 	return fakeClient
 }
+
+// CreateChurnClient creates a fake client which returns a running pod without network annotations for any pod name,
+// so that any number of pods can be added through galaxy's default networks
+func CreateChurnClient() *fake.Clientset {
+	fakeClient := &fake.Clientset{}
+	fakeClient.AddReactor("list", "pods", func(action core.Action) (handled bool, ret runtime.Object, err error) {
+		return true, &v1.PodList{}, nil
+	})
+	fakeClient.AddReactor("get", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		getAction := action.(core.GetAction)
+		return true, &v1.Pod{
+			Status: v1.PodStatus{
+				Phase: v1.PodRunning,
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: getAction.GetNamespace(),
+				Name:      getAction.GetName(),
+				UID:       types.UID(getAction.GetName()),
+			},
+			Spec: v1.PodSpec{
+				NodeName: "node1",
+			},
+		}, nil
+	})
+	return fakeClient
+}
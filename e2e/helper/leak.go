@@ -0,0 +1,89 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package helper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// IPStoreDir is where host-local ipam stores allocated ips
+var IPStoreDir = "/var/lib/cni/networks"
+
+// Snapshot records host resources which pods may leak: links, iptables rules and allocated ips
+type Snapshot struct {
+	items map[string]bool
+}
+
+// TakeSnapshot takes a snapshot of host resources
+func TakeSnapshot() (*Snapshot, error) {
+	s := &Snapshot{items: map[string]bool{}}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, link := range links {
+		s.items["link "+link.Attrs().Name] = true
+	}
+	out, err := Command("iptables-save").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save iptables: %v, %s", err, string(out))
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// drop policy and counters of chains
+			line = strings.Fields(line)[0]
+		}
+		s.items["rule "+line] = true
+	}
+	if err := filepath.Walk(IPStoreDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), "last_reserved_ip") || info.Name() == "lock" {
+			return nil
+		}
+		s.items["ip "+p] = true
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to walk %s: %v", IPStoreDir, err)
+	}
+	return s, nil
+}
+
+// Leaks returns resources in after but not in s
+func (s *Snapshot) Leaks(after *Snapshot) []string {
+	var leaks []string
+	for item := range after.items {
+		if !s.items[item] {
+			leaks = append(leaks, item)
+		}
+	}
+	sort.Strings(leaks)
+	return leaks
+}
@@ -0,0 +1,67 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package helper
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+
+	"tkestack.io/galaxy/pkg/api/galaxy/private"
+)
+
+// CNIRequest returns a cni request of method which galaxy-sdn sends to galaxy for the pod
+func CNIRequest(method, containerId, nsPath, namespace, podName string) string {
+	return fmt.Sprintf(`{
+    "env": {
+        "CNI_COMMAND": "%s",
+        "CNI_CONTAINERID": "%s",
+        "CNI_NETNS": "%s",
+        "CNI_IFNAME": "eth0",
+        "CNI_PATH": "%s",
+        "CNI_ARGS": "IgnoreUnknown=true;K8S_POD_NAMESPACE=%s;K8S_POD_NAME=%s;K8S_POD_INFRA_CONTAINER_ID=%s"
+    }
+}`, method, containerId, nsPath, path.Join(ProjectDir(), "bin"), namespace, podName, containerId)
+}
+
+var galaxyClient = &http.Client{
+	Transport: &http.Transport{
+		Dial: func(proto, addr string) (net.Conn, error) {
+			return net.Dial("unix", private.GalaxySocketPath)
+		},
+	},
+}
+
+// PostCNIRequest posts req to galaxy, it returns an error if galaxy doesn't respond with 200
+func PostCNIRequest(req string) (string, error) {
+	resp, err := galaxyClient.Post("http://dummy/cni", "application/json", bytes.NewReader([]byte(req)))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d: %s", resp.StatusCode, string(content))
+	}
+	return string(content), nil
+}
@@ -0,0 +1,166 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package soak_test
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/util/wait"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/e2e"
+	"tkestack.io/galaxy/e2e/helper"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	"tkestack.io/galaxy/pkg/api/galaxy/private"
+	"tkestack.io/galaxy/pkg/galaxy"
+)
+
+const (
+	FlannelSubnetFile = "/run/flannel/subnet.env"
+	FlannelSubnetDir  = "/run/flannel"
+)
+
+var (
+	g          *galaxy.Galaxy
+	createFile bool
+	jsonFile   string
+	// SOAK_PODS and SOAK_CONCURRENCY env overwrite them
+	pods        = 1000
+	concurrency = 20
+)
+
+func envInt(name string, def int) int {
+	if v := os.Getenv(name); v != "" {
+		i, err := strconv.Atoi(v)
+		Expect(err).NotTo(HaveOccurred())
+		return i
+	}
+	return def
+}
+
+var _ = BeforeSuite(func() {
+	pods = envInt("SOAK_PODS", pods)
+	concurrency = envInt("SOAK_CONCURRENCY", concurrency)
+	if _, err := os.Stat(FlannelSubnetFile); os.IsNotExist(err) {
+		Expect(os.MkdirAll(FlannelSubnetDir, 0755)).NotTo(HaveOccurred())
+		createFile = true
+		content := `FLANNEL_NETWORK=172.16.0.0/13
+FLANNEL_SUBNET=172.16.59.1/22
+FLANNEL_MTU=1480
+FLANNEL_IPMASQ=true`
+		Expect(ioutil.WriteFile(FlannelSubnetFile, []byte(content), 0644)).NotTo(HaveOccurred())
+	}
+	jsonConfigFile, err := ioutil.TempFile("", "")
+	Expect(err).NotTo(HaveOccurred())
+	jsonFile = jsonConfigFile.Name()
+	Expect(jsonConfigFile.Close()).NotTo(HaveOccurred())
+	err = ioutil.WriteFile(jsonFile, []byte(`{"NetworkConf":[{"type":"galaxy-flannel", "delegate":{"type":"galaxy-bridge","isDefaultGateway":true,"forceAddress":true},"subnetFile":"/run/flannel/subnet.env"}], "DefaultNetworks": ["galaxy-flannel"]}`), 0644)
+	Expect(err).NotTo(HaveOccurred())
+
+	g = galaxy.NewGalaxy()
+	g.JsonConfigPath = jsonFile
+	Expect(g.Init()).NotTo(HaveOccurred())
+	g.SetClient(e2e.CreateChurnClient())
+	go g.StartServer()
+	Expect(wait.PollImmediate(100*time.Millisecond, 10*time.Second, func() (bool, error) {
+		_, err := os.Stat(private.GalaxySocketPath)
+		return err == nil, nil
+	})).NotTo(HaveOccurred())
+})
+
+var _ = AfterSuite(func() {
+	if g != nil {
+		g.Stop()
+	}
+	if createFile {
+		if err := os.Remove(FlannelSubnetFile); err != nil {
+			glog.Errorf("fail to remove %s", FlannelSubnetFile)
+		}
+	}
+	if jsonFile != "" {
+		if err := os.Remove(jsonFile); err != nil {
+			glog.Errorf("fail to remove %s", jsonFile)
+		}
+	}
+})
+
+// churn adds and deletes a pod, it returns the first error
+func churn(i int) error {
+	containerId := helper.NewContainerId()
+	nsPath, err := helper.NewNetNS(containerId)
+	if err != nil {
+		return err
+	}
+	defer helper.DelNetNS(containerId) // nolint: errcheck
+	podName := "churn-" + strconv.Itoa(i)
+	if _, err := helper.PostCNIRequest(helper.CNIRequest(cniutil.COMMAND_ADD, containerId, nsPath, "soak",
+		podName)); err != nil {
+		return err
+	}
+	_, err = helper.PostCNIRequest(helper.CNIRequest(cniutil.COMMAND_DEL, containerId, nsPath, "soak", podName))
+	return err
+}
+
+var _ = Describe("add/del storm", func() {
+	AfterEach(func() {
+		helper.CleanupNetNS()
+	})
+	It("leaks no devices, rules or ips", func() {
+		// warm up so that resources shared by all pods, e.g. bridge and basic rules, are part of the baseline
+		Expect(churn(-1)).NotTo(HaveOccurred())
+		before, err := helper.TakeSnapshot()
+		Expect(err).NotTo(HaveOccurred())
+
+		var (
+			wg       sync.WaitGroup
+			lock     sync.Mutex
+			failures []error
+		)
+		next := make(chan int)
+		for w := 0; w < concurrency; w++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for i := range next {
+					if err := churn(i); err != nil {
+						lock.Lock()
+						failures = append(failures, err)
+						lock.Unlock()
+					}
+				}
+			}()
+		}
+		start := time.Now()
+		for i := 0; i < pods; i++ {
+			next <- i
+		}
+		close(next)
+		wg.Wait()
+		glog.Infof("churned %d pods with concurrency %d in %v", pods, concurrency, time.Since(start))
+		Expect(failures).To(BeEmpty())
+
+		after, err := helper.TakeSnapshot()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(before.Leaks(after)).To(BeEmpty())
+	})
+})
@@ -11,12 +11,14 @@ require (
 	github.com/docker/go-connections v0.4.0 // indirect
 	github.com/emicklei/go-restful v2.10.0+incompatible
 	github.com/emicklei/go-restful-swagger12 v0.0.0-20170926063155-7524189396c6
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/godbus/dbus v4.1.0+incompatible
 	github.com/golang/protobuf v1.3.2
 	github.com/google/uuid v1.1.1
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/onsi/ginkgo v1.10.3
 	github.com/onsi/gomega v1.7.1
+	github.com/osrg/gobgp v0.0.0-20191101114856-a42a1a5f6bf0
 	github.com/spf13/pflag v1.0.5
 	github.com/vishvananda/netlink v1.0.0
 	github.com/vishvananda/netns v0.0.0-20190625233234-7109fa855b0f
@@ -33,6 +35,7 @@ require (
 	k8s.io/klog v1.0.0
 	k8s.io/kubernetes v1.16.0-alpha.0
 	k8s.io/utils v0.0.0-20191114200735-6ca3b61696b6
+	sigs.k8s.io/yaml v1.1.0
 	tkestack.io/tapp v1.0.0
 )
 
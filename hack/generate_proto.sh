@@ -1,2 +1,3 @@
 ROOT=$(cd $(dirname "${BASH_SOURCE}")/.. && pwd -P)
 protoc -I ${ROOT}/pkg/ipam/cloudprovider/rpc ${ROOT}/pkg/ipam/cloudprovider/rpc/*.proto --go_out=plugins=grpc:pkg/ipam/cloudprovider/rpc
+protoc -I ${ROOT}/pkg/api/galaxy/rpc ${ROOT}/pkg/api/galaxy/rpc/*.proto --go_out=plugins=grpc:pkg/api/galaxy/rpc
@@ -32,8 +32,10 @@ import (
 	t020 "github.com/containernetworking/cni/pkg/types/020"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	glog "k8s.io/klog"
 	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/utils/store"
 )
 
 const (
@@ -52,6 +54,10 @@ const (
 
 	COMMAND_ADD = "ADD"
 	COMMAND_DEL = "DEL"
+	// COMMAND_CHECK is sent by CNI 0.4.0 runtimes to check that the network of a container is as it was added
+	COMMAND_CHECK = "CHECK"
+	// COMMAND_GC is sent by CNI 1.1 runtimes with attachments they know to release everything of other attachments
+	COMMAND_GC = "GC"
 )
 
 // BuildCNIArgs builds cni args as string such as key1=val1;key2=val2
@@ -122,7 +128,8 @@ func DelegateDel(netconf map[string]interface{}, args *skel.CmdArgs, ifName stri
 	})
 }
 
-// CmdAdd saves networkInfos to disk and executes each cni binary to setup network
+// CmdAdd saves networkInfos to disk and executes each cni binary to setup network. The result of multiple networks
+// is their merged result, see MergeResults.
 func CmdAdd(cmdArgs *skel.CmdArgs, networkInfos []*NetworkInfo) (types.Result, error) {
 	if len(networkInfos) == 0 {
 		return nil, fmt.Errorf("No network info returned")
@@ -143,13 +150,70 @@ func CmdAdd(cmdArgs *skel.CmdArgs, networkInfos []*NetworkInfo) (types.Result, e
 			glog.Errorf("fail to add network %s: %v, begin to rollback and delete it", networkInfo.Args, err)
 			delErr := CmdDel(cmdArgs, idx)
 			glog.Warningf("fail to delete cni in rollback %v", delErr)
+			if cniErr, ok := err.(*types.Error); ok {
+				// keep codes of errors of the plugin, e.g. ip conflicts, for the runtime
+				return nil, &types.Error{Code: cniErr.Code, Msg: cniErr.Msg,
+					Details: fmt.Sprintf("fail to establish network %s: %s", networkInfo.Args, cniErr.Details)}
+			}
 			return nil, fmt.Errorf("fail to establish network %s:%v", networkInfo.Args, err)
 		}
+		networkInfo.Result = result
+		if networkInfo.PrevResult, err = json.Marshal(result); err != nil {
+			glog.Warningf("failed to marshal result of network %s: %v", networkInfo.NetworkType, err)
+		}
+	}
+	// save results of networks for CHECK requests, the saved infos without them are still good for DEL requests
+	if err := saveNetworkInfo(cmdArgs.ContainerID, networkInfos); err != nil {
+		glog.Warningf("Error save results of network info for %s: %v", cmdArgs.ContainerID, err)
 	}
+	if len(networkInfos) == 1 {
+		return result, nil
+	}
+	merged, err := MergeResults(networkInfos, cmdArgs.Netns)
 	if err != nil {
-		return nil, err
+		glog.Warningf("failed to merge results of networks of %s, returning the primary one: %v", cmdArgs.ContainerID,
+			err)
+		return networkInfos[0].Result, nil
+	}
+	return merged, nil
+}
+
+// DelegateCheck calles delegate cni binary to execute cmdCHECK with the previous result of the network
+func DelegateCheck(netconf map[string]interface{}, prevResult json.RawMessage, args *skel.CmdArgs,
+	ifName string) error {
+	conf := make(map[string]interface{}, len(netconf)+1)
+	for k, v := range netconf {
+		conf[k] = v
+	}
+	if len(prevResult) > 0 {
+		conf["prevResult"] = prevResult
+	}
+	netconfBytes, err := json.Marshal(conf)
+	if err != nil {
+		return fmt.Errorf("error serializing delegate netconf: %v", err)
+	}
+	pluginPath, err := invoke.FindInPath(netconf["type"].(string), strings.Split(args.Path, ":"))
+	if err != nil {
+		return err
 	}
-	return result, nil
+	glog.V(4).Infof("delegate check %s args %s conf %s", args.ContainerID, args.Args, string(netconfBytes))
+	return invoke.ExecPluginWithoutResult(pluginPath, netconfBytes, &invoke.Args{
+		Command:       COMMAND_CHECK,
+		ContainerID:   args.ContainerID,
+		NetNS:         args.Netns,
+		PluginArgsStr: args.Args,
+		IfName:        ifName,
+		Path:          args.Path,
+	})
+}
+
+// SupportsCheck returns if plugins of a network config of cniVersion accept CHECK, which is added by CNI spec 0.4.0
+func SupportsCheck(cniVersion string) bool {
+	var major, minor int
+	if _, err := fmt.Sscanf(cniVersion, "%d.%d", &major, &minor); err != nil {
+		return false
+	}
+	return major > 0 || minor >= 4
 }
 
 // NetworkInfo wraps network infos which are needed for cni plugin to setup network
@@ -158,6 +222,10 @@ type NetworkInfo struct {
 	Args        map[string]string
 	Conf        map[string]interface{}
 	IfName      string
+	// Result is the result of the network once CmdAdd sets it up
+	Result types.Result `json:"-"`
+	// PrevResult is the persisted Result, which CHECK requests pass to the plugin of the network
+	PrevResult json.RawMessage `json:",omitempty"`
 }
 
 // NewNetworkInfo creates a NetworkInfo
@@ -184,9 +252,22 @@ func CmdDel(cmdArgs *skel.CmdArgs, lastIdx int) error {
 	if lastIdx == -1 {
 		lastIdx = len(networkInfos) - 1
 	}
+	fails, err := DelNetworks(cmdArgs, networkInfos[:lastIdx+1])
+	if err != nil {
+		if err := saveNetworkInfo(cmdArgs.ContainerID, fails); err != nil {
+			glog.Warningf("Error save network info %v for %s: %v", fails, cmdArgs.ContainerID, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// DelNetworks deletes networkInfos in reverse order and returns the networks failed to be deleted in their original
+// order
+func DelNetworks(cmdArgs *skel.CmdArgs, networkInfos []*NetworkInfo) ([]*NetworkInfo, error) {
 	var errorSet []string
 	var fails []*NetworkInfo
-	for idx := lastIdx; idx >= 0; idx-- {
+	for idx := len(networkInfos) - 1; idx >= 0; idx-- {
 		networkInfo := networkInfos[idx]
 		//append additional args from network info
 		cmdArgs.Args = strings.TrimRight(fmt.Sprintf("%s;%s", cmdArgs.Args, BuildCNIArgs(networkInfo.Args)), ";")
@@ -199,17 +280,14 @@ func CmdDel(cmdArgs *skel.CmdArgs, lastIdx int) error {
 	}
 	if len(errorSet) > 0 {
 		reverse(fails)
-		if err := saveNetworkInfo(cmdArgs.ContainerID, fails); err != nil {
-			glog.Warningf("Error save network info %v for %s: %v", fails, cmdArgs.ContainerID, err)
-		}
-		return fmt.Errorf(strings.Join(errorSet, " / "))
+		return fails, fmt.Errorf(strings.Join(errorSet, " / "))
 	}
-	return nil
+	return nil, nil
 }
 
 // IPInfoToResult converts IPInfo to Result
 func IPInfoToResult(ipInfo *constant.IPInfo) *t020.Result {
-	return &t020.Result{
+	result := &t020.Result{
 		IP4: &t020.IPConfig{
 			IP:      net.IPNet(*ipInfo.IP),
 			Gateway: ipInfo.Gateway,
@@ -221,6 +299,16 @@ func IPInfoToResult(ipInfo *constant.IPInfo) *t020.Result {
 			}},
 		},
 	}
+	if ipInfo.IPv6 != nil {
+		result.IP6 = &t020.IPConfig{
+			IP:      net.IPNet(*ipInfo.IPv6),
+			Gateway: ipInfo.IPv6Gateway,
+		}
+		if ipInfo.IPv6Gateway != nil {
+			result.IP6.Routes = []types.Route{{Dst: net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}}}
+		}
+	}
+	return result
 }
 
 // ConfigureIface takes the result of IPAM plugin and
@@ -235,21 +323,29 @@ func ConfigureIface(ifName string, res *t020.Result) error {
 		return fmt.Errorf("failed to set %q UP: %v", ifName, err)
 	}
 
-	// TODO(eyakubovich): IPv6
-	addr := &netlink.Addr{IPNet: &res.IP4.IP, Label: ""}
-	if err = netlink.AddrAdd(link, addr); err != nil {
-		return fmt.Errorf("failed to add IP addr to %q: %v", ifName, err)
-	}
-
-	for _, r := range res.IP4.Routes {
-		gw := r.GW
-		if gw == nil {
-			gw = res.IP4.Gateway
+	for _, ipc := range []*t020.IPConfig{res.IP4, res.IP6} {
+		if ipc == nil {
+			continue
+		}
+		addr := &netlink.Addr{IPNet: &ipc.IP, Label: ""}
+		if ipc.IP.IP.To4() == nil {
+			// the address is assigned by ipam, skip duplicate address detection which delays using it
+			addr.Flags = unix.IFA_F_NODAD
 		}
-		if err = ip.AddRoute(&r.Dst, gw, link); err != nil {
-			// we skip over duplicate routes as we assume the first one wins
-			if !os.IsExist(err) {
-				return fmt.Errorf("failed to add route '%v via %v dev %v': %v", r.Dst, gw, ifName, err)
+		if err = netlink.AddrAdd(link, addr); err != nil {
+			return fmt.Errorf("failed to add IP addr %v to %q: %v", ipc.IP, ifName, err)
+		}
+
+		for _, r := range ipc.Routes {
+			gw := r.GW
+			if gw == nil {
+				gw = ipc.Gateway
+			}
+			if err = ip.AddRoute(&r.Dst, gw, link); err != nil {
+				// we skip over duplicate routes as we assume the first one wins
+				if !os.IsExist(err) {
+					return fmt.Errorf("failed to add route '%v via %v dev %v': %v", r.Dst, gw, ifName, err)
+				}
 			}
 		}
 	}
@@ -270,15 +366,18 @@ func saveNetworkInfo(containerID string, infos []*NetworkInfo) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path, data, 0600)
+	return store.WriteFile(path, data, 0600)
 }
 
 func consumeNetworkInfo(containerID string) ([]*NetworkInfo, error) {
-	var infos []*NetworkInfo
-	path := filepath.Join(stateDir, containerID)
-	defer os.Remove(path) // nolint: errcheck
+	defer RemoveNetworkInfo(containerID) // nolint: errcheck
+	return LoadNetworkInfo(containerID)
+}
 
-	data, err := ioutil.ReadFile(path)
+// LoadNetworkInfo reads the saved network infos of the container
+func LoadNetworkInfo(containerID string) ([]*NetworkInfo, error) {
+	var infos []*NetworkInfo
+	data, err := ioutil.ReadFile(filepath.Join(stateDir, containerID))
 	if err != nil {
 		return infos, err
 	}
@@ -288,6 +387,16 @@ func consumeNetworkInfo(containerID string) ([]*NetworkInfo, error) {
 	return infos, nil
 }
 
+// NetworkInfoContainers returns ids of containers having saved network infos
+func NetworkInfoContainers() ([]string, error) {
+	return store.NewFileStore(stateDir).Keys()
+}
+
+// RemoveNetworkInfo removes the saved network infos of the container
+func RemoveNetworkInfo(containerID string) error {
+	return os.Remove(filepath.Join(stateDir, containerID))
+}
+
 func GetNetworkConfig(networkName, confdir string) ([]byte, error) {
 	// In part, adapted from K8s pkg/kubelet/dockershim/network/cni/cni.go#getDefaultCNINetwork
 	// Different from original code, the following search conf files for max dir depth=2
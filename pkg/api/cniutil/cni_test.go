@@ -71,3 +71,11 @@ func TestGetNetworkConfig(t *testing.T) {
 		t.Fatalf("nc %s, err %v", string(nc), err)
 	}
 }
+
+func TestSupportsCheck(t *testing.T) {
+	for v, expect := range map[string]bool{"0.4.0": true, "1.0.0": true, "0.3.1": false, "0.2.0": false, "": false} {
+		if SupportsCheck(v) != expect {
+			t.Errorf("version %q: expect %v", v, expect)
+		}
+	}
+}
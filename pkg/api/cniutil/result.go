@@ -0,0 +1,92 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package cniutil
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+// MergeResults merges results of networkInfos set up by CmdAdd into one result of the current cni version. Each
+// network contributes its sandbox interface, which is named after IfName of the network if its plugin reports none,
+// along with its ips and routes, so the ips of the primary network come first and 020 conversions of the merged
+// result still carry the pod ip. DNS is the first non-empty one.
+func MergeResults(networkInfos []*NetworkInfo, netns string) (*current.Result, error) {
+	merged := &current.Result{CNIVersion: current.ImplementedSpecVersion}
+	for _, info := range networkInfos {
+		if info.Result == nil {
+			return nil, fmt.Errorf("network %s has no result", info.NetworkType)
+		}
+		result, err := current.NewResultFromResult(info.Result)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert result of network %s: %v", info.NetworkType, err)
+		}
+		offset := len(merged.Interfaces)
+		// index of the sandbox interface of the network for ips which don't refer to any interface
+		sandbox := -1
+		for i, iface := range result.Interfaces {
+			copied := *iface
+			merged.Interfaces = append(merged.Interfaces, &copied)
+			if sandbox == -1 && iface.Sandbox != "" && iface.Name == info.IfName {
+				sandbox = offset + i
+			}
+		}
+		if sandbox == -1 {
+			merged.Interfaces = append(merged.Interfaces, &current.Interface{Name: info.IfName, Sandbox: netns})
+			sandbox = len(merged.Interfaces) - 1
+		}
+		for _, ip := range result.IPs {
+			copied := *ip
+			index := sandbox
+			if ip.Interface != nil && *ip.Interface >= 0 && *ip.Interface < len(result.Interfaces) {
+				index = offset + *ip.Interface
+			}
+			copied.Interface = &index
+			merged.IPs = append(merged.IPs, &copied)
+		}
+		for _, route := range result.Routes {
+			copied := *route
+			// routes of all networks are merged into one list, keep the gateway of their network explicit
+			if copied.GW == nil {
+				copied.GW = gatewayOf(result.IPs, route)
+			}
+			merged.Routes = append(merged.Routes, &copied)
+		}
+		if emptyDNS(&merged.DNS) {
+			merged.DNS = result.DNS
+		}
+	}
+	return merged, nil
+}
+
+// gatewayOf returns the gateway of the first ip of the same family as the destination of route
+func gatewayOf(ips []*current.IPConfig, route *types.Route) net.IP {
+	v4 := route.Dst.IP.To4() != nil
+	for _, ip := range ips {
+		if ip.Gateway != nil && (ip.Address.IP.To4() != nil) == v4 {
+			return ip.Gateway
+		}
+	}
+	return nil
+}
+
+func emptyDNS(dns *types.DNS) bool {
+	return len(dns.Nameservers) == 0 && dns.Domain == "" && len(dns.Search) == 0 && len(dns.Options) == 0
+}
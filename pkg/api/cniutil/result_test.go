@@ -0,0 +1,112 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package cniutil
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	t020 "github.com/containernetworking/cni/pkg/types/020"
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+func TestMergeResults(t *testing.T) {
+	ipNet := func(s string) net.IPNet {
+		ip, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.IP = ip
+		return *n
+	}
+	zero := 0
+	one := 1
+	infos := []*NetworkInfo{{
+		NetworkType: "vlan-100",
+		IfName:      "eth0",
+		Result: &t020.Result{
+			CNIVersion: "0.2.0",
+			IP4: &t020.IPConfig{IP: ipNet("10.0.0.2/24"), Gateway: net.ParseIP("10.0.0.1"),
+				Routes: []types.Route{{Dst: ipNet("0.0.0.0/0")}}},
+			DNS: types.DNS{Nameservers: []string{"10.0.0.10"}},
+		},
+	}, {
+		NetworkType: "overlay",
+		IfName:      "net1",
+		Result: &current.Result{
+			CNIVersion: "0.3.1",
+			Interfaces: []*current.Interface{{Name: "veth1"}, {Name: "net1", Sandbox: "/var/run/netns/a"}},
+			IPs: []*current.IPConfig{{Version: "4", Interface: &one, Address: ipNet("172.16.0.2/16"),
+				Gateway: net.ParseIP("172.16.0.1")}},
+			Routes: []*types.Route{{Dst: ipNet("172.17.0.0/16")}},
+			DNS:    types.DNS{Nameservers: []string{"172.16.0.10"}},
+		},
+	}, {
+		NetworkType: "storage",
+		IfName:      "net2",
+		Result: &t020.Result{
+			CNIVersion: "0.2.0",
+			IP4:        &t020.IPConfig{IP: ipNet("192.168.0.2/24")},
+		},
+	}}
+	result, err := MergeResults(infos, "/var/run/netns/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, iface := range result.Interfaces {
+		names = append(names, iface.Name+"@"+iface.Sandbox)
+	}
+	expect := "[eth0@/var/run/netns/a veth1@ net1@/var/run/netns/a net2@/var/run/netns/a]"
+	if expect != fmt.Sprint(names) {
+		t.Fatalf("expect %s, real %v", expect, names)
+	}
+	expectIPs := []struct {
+		addr  string
+		iface int
+	}{{"10.0.0.2/24", zero}, {"172.16.0.2/16", 2}, {"192.168.0.2/24", 3}}
+	if len(result.IPs) != len(expectIPs) {
+		t.Fatalf("expect %d ips, real %d", len(expectIPs), len(result.IPs))
+	}
+	for i, ip := range result.IPs {
+		if ip.Address.String() != expectIPs[i].addr || *ip.Interface != expectIPs[i].iface {
+			t.Errorf("ip %d: expect %s of %d, real %s of %d", i, expectIPs[i].addr, expectIPs[i].iface,
+				ip.Address.String(), *ip.Interface)
+		}
+	}
+	if len(result.Routes) != 2 || !result.Routes[0].GW.Equal(net.ParseIP("10.0.0.1")) ||
+		!result.Routes[1].GW.Equal(net.ParseIP("172.16.0.1")) {
+		t.Fatalf("unexpected routes %v", result.Routes)
+	}
+	if len(result.DNS.Nameservers) != 1 || result.DNS.Nameservers[0] != "10.0.0.10" {
+		t.Fatalf("unexpected dns %v", result.DNS)
+	}
+	// the merged result still carries the ip of the primary network in 020
+	result020, err := t020.GetResult(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result020.IP4 == nil || result020.IP4.IP.String() != "10.0.0.2/24" {
+		t.Fatalf("unexpected 020 result %v", result020)
+	}
+	// the current result of the overlay network is left as is
+	if *infos[1].Result.(*current.Result).IPs[0].Interface != one {
+		t.Fatal("result of network is modified")
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"strings"
 
 	"tkestack.io/galaxy/pkg/utils/nets"
 )
@@ -30,6 +31,11 @@ const (
 
 	MultusCNIAnnotation = "k8s.v1.cni.cncf.io/networks"
 
+	// NetworksAnnotation is galaxy's own annotation of networks of a pod in the same format as MultusCNIAnnotation,
+	// e.g. "vlan-100,overlay". Interfaces of its networks other than the primary one are named net<index> by
+	// default rather than eth<index>. MultusCNIAnnotation takes precedence if a pod has both.
+	NetworksAnnotation = "galaxy.k8s.io/networks"
+
 	CommonCNIArgsKey = "common"
 )
 
@@ -44,13 +50,62 @@ func ParseExtendedCNIArgs(args string) (map[string]map[string]json.RawMessage, e
 
 const (
 	IPInfosKey = "ipinfos"
+	// IPsAnnotation has ips of a pod allocated by galaxy-ipam joined by commas in the order of its ipinfos, e.g.
+	// "10.0.0.2,10.1.0.2". It is set on binding, so that applications may read it via downward api and tools may
+	// build endpoints of selector-less services
+	IPsAnnotation = "k8s.v1.cni.galaxy.io/ips"
+	// NodeIPsAnnotation has ips of a node joined by commas which galaxy-ipam prefers to status addresses of the node
+	// when selecting its node subnet, galaxy sets it to ips of --node-ip-interface
+	NodeIPsAnnotation = "k8s.v1.cni.galaxy.io/node-ips"
+	// NodeFeaturesAnnotation is the json of NodeFeatures which galaxy of a node supports, config authors check it
+	// before adding RequiredFeatures to configs during staggered upgrades
+	NodeFeaturesAnnotation = "k8s.v1.cni.galaxy.io/features"
+	// NodeConfigStatusAnnotation is "accepted" or "rejected: " followed by the reason galaxy of a node refuses its
+	// config
+	NodeConfigStatusAnnotation = "k8s.v1.cni.galaxy.io/config-status"
 )
 
+// NodeFeatures are the version and config features of galaxy of a node
+type NodeFeatures struct {
+	GitCommit string   `json:"gitCommit"`
+	Features  []string `json:"features"`
+}
+
+const (
+	// AgentLeaseNamespace is the namespace of leases which galaxy of each node renews as its heartbeat
+	AgentLeaseNamespace = "kube-node-lease"
+	// AgentLeasePrefix is the prefix of names of agent leases, followed by node names
+	AgentLeasePrefix = "galaxy-"
+	// AgentRegistrationAnnotation of an agent lease is the json of AgentRegistration of the node
+	AgentRegistrationAnnotation = "k8s.v1.cni.galaxy.io/registration"
+)
+
+// AgentLeaseName returns the name of the agent lease of a node
+func AgentLeaseName(nodeName string) string {
+	return AgentLeasePrefix + nodeName
+}
+
+// AgentRegistration is what galaxy of a node registers to galaxy-ipam along with its heartbeats
+type AgentRegistration struct {
+	NodeFeatures
+	// Networks maps names of networks galaxy of the node is configured with to their types
+	Networks map[string]string `json:"networks,omitempty"`
+	// Subnets are cidrs of global unicast addresses of the node
+	Subnets []string `json:"subnets,omitempty"`
+}
+
+// DebugContainerIDPrefix is the prefix of container ids of debug attachments which galaxy creates without pods. It is
+// not hex so that it never matches docker container ids, gc should leave such ids to galaxy.
+const DebugContainerIDPrefix = "dbg"
+
 // IPInfo is the container ip info
 type IPInfo struct {
 	IP      *nets.IPNet `json:"ip"`
 	Vlan    uint16      `json:"vlan"`
 	Gateway net.IP      `json:"gateway"`
+	// IPv6 and IPv6Gateway are set for dual-stack pods
+	IPv6        *nets.IPNet `json:"ipv6,omitempty"`
+	IPv6Gateway net.IP      `json:"ipv6Gateway,omitempty"`
 }
 
 // FormatIPInfo formats ipInfos as extended CNI Args annotation value
@@ -64,6 +119,17 @@ func FormatIPInfo(ipInfos []IPInfo) (string, error) {
 	return string(str), err
 }
 
+// FormatIPs formats ips of ipInfos as IPsAnnotation value
+func FormatIPs(ipInfos []IPInfo) string {
+	ips := make([]string, 0, len(ipInfos))
+	for i := range ipInfos {
+		if ipInfos[i].IP != nil {
+			ips = append(ips, ipInfos[i].IP.IP.String())
+		}
+	}
+	return strings.Join(ips, ",")
+}
+
 // ParseIPInfo pareses ipInfo from annotation
 func ParseIPInfo(str string) ([]IPInfo, error) {
 	m := map[string]map[string]*json.RawMessage{}
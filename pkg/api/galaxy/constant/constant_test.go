@@ -48,4 +48,7 @@ func TestFormatParseIPInfo(t *testing.T) {
 	if !reflect.DeepEqual(parsed, testCase) {
 		t.Fatalf("real: %v, expect: %v", parsed, testCase)
 	}
+	if ips := FormatIPs(testCase); ips != "192.168.0.2,192.168.0.3" {
+		t.Fatalf("real: %s, expect: 192.168.0.2,192.168.0.3", ips)
+	}
 }
@@ -21,9 +21,11 @@ import (
 	"fmt"
 
 	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
 	glog "k8s.io/klog"
 	"tkestack.io/galaxy/pkg/api/cniutil"
 	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/network/netns"
 )
 
 // Request sent to the Galaxy by the Galaxy SDN CNI plugin
@@ -51,6 +53,13 @@ type PodRequest struct {
 	*skel.CmdArgs
 	// specific CNI plugin args, key: cni type, inner key: args name, value: args value
 	ExtendedCNIArgs map[string]map[string]json.RawMessage
+	// CNIArgs are parsed from CmdArgs.Args
+	CNIArgs *CNIArgs
+	// RuntimeConfig is parsed from runtimeConfig of CmdArgs.StdinData
+	RuntimeConfig *RuntimeConfig
+	// NetnsID is the identity of the netns when the request came, nil if the netns was gone. A pid reused by another
+	// process after the sandbox is gone makes a /proc/<pid>/ns/net path refer to another netns.
+	NetnsID *netns.ID
 }
 
 // Result of a PodRequest sent through the PodRequest's Result channel.
@@ -61,16 +70,108 @@ type PodResult struct {
 	Err error
 }
 
-// #lizard forgives
+// ErrCodeSandboxGone is the code of the cni error of an ADD request whose netns is deleted before or while galaxy
+// sets it up. Retrying the request is useless, the runtime has to create a new sandbox.
+const ErrCodeSandboxGone uint = 120
+
+// SandboxGoneError is the error of a request whose netns is gone, galaxy has rolled back what it set up for it
+type SandboxGoneError struct {
+	Netns string
+	Err   error
+}
+
+func (e *SandboxGoneError) Error() string {
+	return fmt.Sprintf("sandbox netns %s is gone: %v", e.Netns, e.Err)
+}
+
+// CNIError returns the cni error of e
+func (e *SandboxGoneError) CNIError() *types.Error {
+	return &types.Error{Code: ErrCodeSandboxGone, Msg: "sandbox netns is gone", Details: e.Error()}
+}
+
+// ErrCodeMaintenance is the code of the cni error of an ADD request rejected because the node network is in
+// maintenance. The pod should be scheduled to another node.
+const ErrCodeMaintenance uint = 121
+
+// ErrCodeIPConflict is the code of the cni error of an ADD request whose ip is found in use on the underlay by a probe
+// of the network plugin before it is set up, e.g. galaxy-k8s-vlan with conflict_probe. The ip is assigned twice.
+const ErrCodeIPConflict uint = 122
+
+// MaintenanceError is the error of an ADD request which comes while the node network is in maintenance
+type MaintenanceError struct {
+	Reason string
+}
+
+func (e *MaintenanceError) Error() string {
+	return fmt.Sprintf("node network is in maintenance: %s", e.Reason)
+}
+
+// CNIError returns the cni error of e
+func (e *MaintenanceError) CNIError() *types.Error {
+	return &types.Error{Code: ErrCodeMaintenance, Msg: "node network is in maintenance", Details: e.Error()}
+}
+
 func CniRequestToPodRequest(data []byte) (*PodRequest, error) {
+	cr, err := ParseCNIRequest(data)
+	if err != nil {
+		return nil, err
+	}
+	return cr.PodRequest()
+}
+
+// ParseCNIRequest parses the json of a CNIRequest
+func ParseCNIRequest(data []byte) (*CNIRequest, error) {
 	var cr CNIRequest
 	if err := json.Unmarshal(data, &cr); err != nil {
-		return nil, fmt.Errorf("JSON unmarshal error: %v", err)
+		return nil, &RequestError{Code: ErrCodeInvalidEnvironmentVariables, Key: "request", Msg: err.Error()}
+	}
+	return &cr, nil
+}
+
+// Command returns the cni command of cr
+func (cr *CNIRequest) Command() string {
+	return cr.Env[cniutil.CNI_COMMAND]
+}
+
+// Attachment is an attachment of a container the runtime knows, see GCRequest
+type Attachment struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifname"`
+}
+
+// GCRequest asks to release everything of attachments other than ValidAttachments, see GC of CNI spec 1.1
+type GCRequest struct {
+	ValidAttachments []Attachment
+}
+
+// GCRequest parses the GC request of cr. A config without cni.dev/valid-attachments is refused rather than taken as
+// no attachment is valid.
+func (cr *CNIRequest) GCRequest() (*GCRequest, error) {
+	var conf struct {
+		ValidAttachments *[]Attachment `json:"cni.dev/valid-attachments"`
+	}
+	if err := json.Unmarshal(cr.Config, &conf); err != nil {
+		return nil, &RequestError{Code: ErrCodeInvalidNetworkConfig, Key: "config", Msg: err.Error()}
+	}
+	if conf.ValidAttachments == nil {
+		return nil, &RequestError{Code: ErrCodeInvalidNetworkConfig, Key: "config",
+			Msg: "cni.dev/valid-attachments is missing"}
+	}
+	for _, a := range *conf.ValidAttachments {
+		if a.ContainerID == "" {
+			return nil, &RequestError{Code: ErrCodeInvalidNetworkConfig, Key: "config",
+				Msg: "valid attachment without containerID"}
+		}
 	}
+	return &GCRequest{ValidAttachments: *conf.ValidAttachments}, nil
+}
 
+// PodRequest validates cr and builds the PodRequest of it
+// #lizard forgives
+func (cr *CNIRequest) PodRequest() (*PodRequest, error) {
 	cmd, ok := cr.Env[cniutil.CNI_COMMAND]
 	if !ok {
-		return nil, fmt.Errorf("Unexpected or missing %s", cniutil.CNI_COMMAND)
+		return nil, envError(cniutil.CNI_COMMAND, "missing")
 	}
 
 	req := &PodRequest{
@@ -83,38 +184,47 @@ func CniRequestToPodRequest(data []byte) (*PodRequest, error) {
 
 	req.ContainerID, ok = cr.Env[cniutil.CNI_CONTAINERID]
 	if !ok {
-		return nil, fmt.Errorf("missing %s", cniutil.CNI_CONTAINERID)
+		return nil, envError(cniutil.CNI_CONTAINERID, "missing")
 	}
 	req.Netns, ok = cr.Env[cniutil.CNI_NETNS]
 	if !ok {
-		return nil, fmt.Errorf("missing %s", cniutil.CNI_NETNS)
+		return nil, envError(cniutil.CNI_NETNS, "missing")
 	}
+	// runtimes pass either paths bind mounted under /var/run/netns or /proc/<pid>/ns/net
+	req.Netns = netns.Normalize(req.Netns)
 	req.IfName, ok = cr.Env[cniutil.CNI_IFNAME]
 	if !ok {
-		return nil, fmt.Errorf("missing %s", cniutil.CNI_IFNAME)
+		return nil, envError(cniutil.CNI_IFNAME, "missing")
 	}
 	req.Path, ok = cr.Env[cniutil.CNI_PATH]
 	if !ok {
-		return nil, fmt.Errorf("missing %s", cniutil.CNI_PATH)
+		return nil, envError(cniutil.CNI_PATH, "missing")
 	}
 	req.Args, ok = cr.Env[cniutil.CNI_ARGS]
 	if !ok {
-		return nil, fmt.Errorf("missing %s", cniutil.CNI_ARGS)
+		return nil, envError(cniutil.CNI_ARGS, "missing")
 	}
 
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	if req.Netns != "" {
+		req.NetnsID, _ = netns.Identify(req.Netns)
+	}
 	cniArgs, err := cniutil.ParseCNIArgs(req.Args)
 	if err != nil {
-		return nil, err
+		return nil, envError(cniutil.CNI_ARGS, "%v", err)
 	}
-
-	req.PodNamespace, ok = cniArgs[k8s.K8S_POD_NAMESPACE]
-	if !ok {
-		return nil, fmt.Errorf("missing %s", k8s.K8S_POD_NAMESPACE)
+	if _, ok := cniArgs[k8s.K8S_POD_NAMESPACE]; !ok {
+		return nil, envError(k8s.K8S_POD_NAMESPACE, "missing")
 	}
-
-	req.PodName, ok = cniArgs[k8s.K8S_POD_NAME]
-	if !ok {
-		return nil, fmt.Errorf("missing %s", k8s.K8S_POD_NAME)
+	if _, ok := cniArgs[k8s.K8S_POD_NAME]; !ok {
+		return nil, envError(k8s.K8S_POD_NAME, "missing")
+	}
+	req.CNIArgs = newCNIArgs(cniArgs)
+	req.PodNamespace, req.PodName = req.CNIArgs.PodNamespace, req.CNIArgs.PodName
+	if req.RuntimeConfig, err = parseRuntimeConfig(cr.Config); err != nil {
+		return nil, &RequestError{Code: ErrCodeInvalidNetworkConfig, Key: "config", Msg: err.Error()}
 	}
 	glog.V(4).Infof("req.Args %s req.StdinData %s", req.Args, cr.Config)
 
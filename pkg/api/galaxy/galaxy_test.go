@@ -17,23 +17,131 @@
 package galaxy
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
 	"testing"
 )
 
+// #lizard forgives
 func TestCniRequestToPodRequest(t *testing.T) {
 	// config, err := json.Marshal(CNIRequest{Config: []byte("{\"capabilities\":{\"portMappings\":true},\"cniVersion\":\"\",\"name\":\"\",\"runtimeConfig\":{\"portMappings\":[{\"hostPort\":30001,\"containerPort\":80,\"protocol\":\"tcp\",\"hostIP\":\"\"}]}}")})
-	_, err := CniRequestToPodRequest([]byte(`{
+	req, err := CniRequestToPodRequest([]byte(`{
     "env": {
         "CNI_COMMAND": "ADD",
         "CNI_CONTAINERID": "ctn1",
         "CNI_NETNS": "/var/run/netns/ctn",
         "CNI_IFNAME": "eth0",
         "CNI_PATH": "/opt/cni/bin",
-        "CNI_ARGS": "K8S_POD_NAMESPACE=demo;K8S_POD_NAME=app;K8S_POD_INFRA_CONTAINER_ID=ctn1"
+        "CNI_ARGS": "IgnoreUnknown=1;K8S_POD_NAMESPACE=demo;K8S_POD_NAME=app;K8S_POD_INFRA_CONTAINER_ID=ctn1;foo=bar"
     },
     "config":"eyJjYXBhYmlsaXRpZXMiOnsicG9ydE1hcHBpbmdzIjp0cnVlfSwiY25pVmVyc2lvbiI6IiIsIm5hbWUiOiIiLCJydW50aW1lQ29uZmlnIjp7InBvcnRNYXBwaW5ncyI6W3siaG9zdFBvcnQiOjMwMDAxLCJjb250YWluZXJQb3J0Ijo4MCwicHJvdG9jb2wiOiJ0Y3AiLCJob3N0SVAiOiIifV19fQ=="
 }`))
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	expectArgs := &CNIArgs{IgnoreUnknown: true, PodNamespace: "demo", PodName: "app", PodInfraContainerID: "ctn1",
+		Others: map[string]string{"foo": "bar"}}
+	if !reflect.DeepEqual(req.CNIArgs, expectArgs) {
+		t.Fatalf("expect %+v, real %+v", expectArgs, req.CNIArgs)
+	}
+	if req.PodNamespace != "demo" || req.PodName != "app" {
+		t.Fatalf("expect demo_app, real %s_%s", req.PodNamespace, req.PodName)
+	}
+	expectPorts := []PortMapping{{HostPort: 30001, ContainerPort: 80, Protocol: "tcp"}}
+	if !reflect.DeepEqual(req.RuntimeConfig.PortMappings, expectPorts) {
+		t.Fatalf("expect %+v, real %+v", expectPorts, req.RuntimeConfig.PortMappings)
+	}
+}
+
+func TestCniRequestToPodRequestProcNetns(t *testing.T) {
+	pid := os.Getpid()
+	data, err := json.Marshal(&CNIRequest{Env: map[string]string{"CNI_COMMAND": "ADD", "CNI_CONTAINERID": "ctn1",
+		"CNI_NETNS": fmt.Sprintf("/proc/%d/task/%d/ns/net", pid, pid), "CNI_IFNAME": "eth0",
+		"CNI_PATH": "/opt/cni/bin", "CNI_ARGS": "K8S_POD_NAMESPACE=demo;K8S_POD_NAME=app"}, Config: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := CniRequestToPodRequest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := fmt.Sprintf("/proc/%d/ns/net", pid); req.Netns != expect {
+		t.Fatalf("expect netns %s, real %s", expect, req.Netns)
+	}
+	if req.NetnsID == nil {
+		t.Fatal("expect identity of the netns")
+	}
+}
+
+func TestGCRequest(t *testing.T) {
+	cr, err := ParseCNIRequest([]byte(`{"env": {"CNI_COMMAND": "GC", "CNI_PATH": "/opt/cni/bin"}, "config": "` +
+		base64.StdEncoding.EncodeToString([]byte(`{"cniVersion": "1.1.0", "name": "galaxy-sdn", `+
+			`"cni.dev/valid-attachments": [{"containerID": "ctn1", "ifname": "eth0"}]}`)) + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Command() != "GC" {
+		t.Fatalf("expect GC, real %s", cr.Command())
+	}
+	req, err := cr.GCRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []Attachment{{ContainerID: "ctn1", IfName: "eth0"}}
+	if !reflect.DeepEqual(req.ValidAttachments, expect) {
+		t.Fatalf("expect %+v, real %+v", expect, req.ValidAttachments)
+	}
+	for _, config := range []string{`{"name": "galaxy-sdn"}`, `{"cni.dev/valid-attachments": [{"ifname": "eth0"}]}`} {
+		cr := &CNIRequest{Env: map[string]string{"CNI_COMMAND": "GC"}, Config: []byte(config)}
+		if _, err := cr.GCRequest(); err == nil {
+			t.Fatalf("expect an error of %s", config)
+		}
+	}
+	cr = &CNIRequest{Config: []byte(`{"cni.dev/valid-attachments": []}`)}
+	if req, err := cr.GCRequest(); err != nil || len(req.ValidAttachments) != 0 {
+		t.Fatalf("expect no valid attachment, real %v, %v", req, err)
+	}
+}
+
+func TestRuntimeConfigForCapabilities(t *testing.T) {
+	rc, err := parseRuntimeConfig([]byte(`{"runtimeConfig":{"portMappings":[{"hostPort":30001,"containerPort":80,` +
+		`"protocol":"tcp"}],"bandwidth":{"ingressRate":1000,"ingressBurst":100},"mac":"00:11:22:33:44:55"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc.Bandwidth == nil || rc.Bandwidth.IngressRate != 1000 || rc.Bandwidth.IngressBurst != 100 {
+		t.Fatalf("bad bandwidth %+v", rc.Bandwidth)
+	}
+	for i, c := range []struct {
+		conf   string
+		expect []string
+	}{
+		{conf: `{"type":"galaxy-k8s-vlan"}`},
+		{conf: `{"capabilities":{"bandwidth":false}}`},
+		{conf: `{"capabilities":{"bandwidth":true,"ipRanges":true}}`, expect: []string{"bandwidth"}},
+		{conf: `{"capabilities":{"mac":true,"portMappings":true}}`, expect: []string{"mac", "portMappings"}},
+	} {
+		var conf map[string]interface{}
+		if err := json.Unmarshal([]byte(c.conf), &conf); err != nil {
+			t.Fatal(err)
+		}
+		filtered := rc.ForCapabilities(conf)
+		if len(filtered) != len(c.expect) {
+			t.Fatalf("case %d: expect %v, real %v", i, c.expect, filtered)
+		}
+		for _, k := range c.expect {
+			if string(filtered[k]) != string(rc.Raw[k]) {
+				t.Fatalf("case %d: expect %s of %s, real %s", i, rc.Raw[k], k, filtered[k])
+			}
+		}
+	}
+	if rc, err := parseRuntimeConfig([]byte(`{"name":"a"}`)); err != nil || rc.Raw != nil {
+		t.Fatalf("expect empty runtimeConfig, real %+v, err %v", rc, err)
+	}
+	if _, err := parseRuntimeConfig([]byte(`{"runtimeConfig":{"bandwidth":"x"}}`)); err == nil {
+		t.Fatal("expect bad runtimeConfig error")
 	}
 }
@@ -19,6 +19,12 @@ package private
 const (
 	GalaxySocketPath = "/var/run/galaxy/galaxy.sock"
 	GalaxySocketDir  = "/var/run/galaxy"
+	// GalaxyTokenHeader carries the shared token of galaxy socket requests if galaxy requires one
+	GalaxyTokenHeader = "X-Galaxy-Token"
+	// GalaxyGRPCSocketPath serves the Galaxy gRPC service
+	GalaxyGRPCSocketPath = "/var/run/galaxy/galaxy-grpc.sock"
+	// GalaxyTokenMetadata carries the shared token of gRPC calls if galaxy requires one
+	GalaxyTokenMetadata = "x-galaxy-token"
 )
 
 var (
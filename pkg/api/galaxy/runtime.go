@@ -0,0 +1,136 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"tkestack.io/galaxy/pkg/api/k8s"
+)
+
+// CNIArgs are CNI_ARGS of a request, well known ones set by kubelet are parsed into fields
+type CNIArgs struct {
+	IgnoreUnknown       bool
+	PodNamespace        string
+	PodName             string
+	PodInfraContainerID string
+	// PodUID is empty if the runtime doesn't send it
+	PodUID string
+	// Others are the rest args
+	Others map[string]string
+}
+
+func newCNIArgs(args map[string]string) *CNIArgs {
+	c := &CNIArgs{Others: map[string]string{}}
+	for k, v := range args {
+		switch k {
+		case "IgnoreUnknown":
+			c.IgnoreUnknown = v == "1" || strings.ToLower(v) == "true"
+		case k8s.K8S_POD_NAMESPACE:
+			c.PodNamespace = v
+		case k8s.K8S_POD_NAME:
+			c.PodName = v
+		case k8s.K8S_POD_INFRA_CONTAINER_ID:
+			c.PodInfraContainerID = v
+		case k8s.K8S_POD_UID:
+			c.PodUID = v
+		default:
+			c.Others[k] = v
+		}
+	}
+	return c
+}
+
+// RuntimeConfig is runtimeConfig the runtime passes in the network config for capabilities of plugins, see
+// https://github.com/containernetworking/cni/blob/master/CONVENTIONS.md
+type RuntimeConfig struct {
+	PortMappings []PortMapping `json:"portMappings,omitempty"`
+	Bandwidth    *Bandwidth    `json:"bandwidth,omitempty"`
+	IPRanges     [][]IPRange   `json:"ipRanges,omitempty"`
+	// Raw has all keys of runtimeConfig including those not parsed into fields, it is passed to plugins as is
+	Raw map[string]json.RawMessage `json:"-"`
+}
+
+// PortMapping is an entry of the portMappings capability
+type PortMapping struct {
+	HostPort      int32  `json:"hostPort"`
+	ContainerPort int32  `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// Bandwidth is the bandwidth capability, rates are in bits per second and bursts in bits
+type Bandwidth struct {
+	IngressRate  int `json:"ingressRate,omitempty"`
+	IngressBurst int `json:"ingressBurst,omitempty"`
+	EgressRate   int `json:"egressRate,omitempty"`
+	EgressBurst  int `json:"egressBurst,omitempty"`
+}
+
+// IPRange is an entry of the ipRanges capability
+type IPRange struct {
+	Subnet     string `json:"subnet"`
+	RangeStart net.IP `json:"rangeStart,omitempty"`
+	RangeEnd   net.IP `json:"rangeEnd,omitempty"`
+	Gateway    net.IP `json:"gateway,omitempty"`
+}
+
+// parseRuntimeConfig parses runtimeConfig of the network config, it returns an empty RuntimeConfig if there is none
+func parseRuntimeConfig(config []byte) (*RuntimeConfig, error) {
+	rc := &RuntimeConfig{}
+	if len(config) == 0 {
+		return rc, nil
+	}
+	var conf struct {
+		RuntimeConfig map[string]json.RawMessage `json:"runtimeConfig"`
+	}
+	if err := json.Unmarshal(config, &conf); err != nil {
+		return nil, fmt.Errorf("bad network config: %v", err)
+	}
+	if len(conf.RuntimeConfig) == 0 {
+		return rc, nil
+	}
+	data, err := json.Marshal(conf.RuntimeConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, rc); err != nil {
+		return nil, fmt.Errorf("bad runtimeConfig %s: %v", string(data), err)
+	}
+	rc.Raw = conf.RuntimeConfig
+	return rc, nil
+}
+
+// ForCapabilities returns keys of runtimeConfig which are capabilities enabled by conf, a network config, or nil if
+// there is none. Runtimes only pass runtimeConfig of capabilities plugins declare, so must galaxy.
+func (rc *RuntimeConfig) ForCapabilities(conf map[string]interface{}) map[string]json.RawMessage {
+	capabilities, _ := conf["capabilities"].(map[string]interface{})
+	var filtered map[string]json.RawMessage
+	for k, v := range rc.Raw {
+		if enabled, _ := capabilities[k].(bool); !enabled {
+			continue
+		}
+		if filtered == nil {
+			filtered = map[string]json.RawMessage{}
+		}
+		filtered[k] = v
+	}
+	return filtered
+}
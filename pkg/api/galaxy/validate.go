@@ -0,0 +1,120 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"golang.org/x/sys/unix"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+)
+
+// Codes of cni errors reserved by the spec, see
+// https://github.com/containernetworking/cni/blob/master/SPEC.md#well-known-error-codes
+const (
+	ErrCodeInvalidEnvironmentVariables uint = 4
+	ErrCodeInvalidNetworkConfig        uint = 7
+)
+
+const (
+	// nsfsMagic and procSuperMagic are statfs types of netns files, the latter is of kernels before 3.19
+	nsfsMagic      = 0x6e736673
+	procSuperMagic = 0x9fa0
+	maxIfNameLen   = 15
+)
+
+// containerIDRegexp is what the spec allows of container ids
+var containerIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.\-]*$`)
+
+// RequestError is the error of a malformed request, galaxy rejects it before setting up anything for it
+type RequestError struct {
+	Code uint
+	Key  string
+	Msg  string
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("bad %s: %s", e.Key, e.Msg)
+}
+
+// CNIError returns the cni error of e
+func (e *RequestError) CNIError() *types.Error {
+	return &types.Error{Code: e.Code, Msg: "bad request", Details: e.Error()}
+}
+
+func envError(key, format string, a ...interface{}) *RequestError {
+	return &RequestError{Code: ErrCodeInvalidEnvironmentVariables, Key: key, Msg: fmt.Sprintf(format, a...)}
+}
+
+// validate checks fields of req according to its command. A netns which doesn't exist is left for the handler of
+// the command, for an ADD request it means that the sandbox is gone and what was set up for it must be rolled back.
+func (req *PodRequest) validate() error {
+	switch req.Command {
+	case cniutil.COMMAND_ADD, cniutil.COMMAND_DEL, cniutil.COMMAND_CHECK:
+	default:
+		return envError(cniutil.CNI_COMMAND, "unsupported command %q", req.Command)
+	}
+	if !containerIDRegexp.MatchString(req.ContainerID) {
+		return envError(cniutil.CNI_CONTAINERID, "%q is not a valid container id", req.ContainerID)
+	}
+	if err := validateIfName(req.IfName); err != nil {
+		return envError(cniutil.CNI_IFNAME, "%v", err)
+	}
+	// runtimes may send DEL requests without netns as the sandbox is gone
+	if req.Netns == "" && req.Command == cniutil.COMMAND_DEL {
+		return nil
+	}
+	if err := validateNetns(req.Netns); err != nil {
+		return envError(cniutil.CNI_NETNS, "%v", err)
+	}
+	return nil
+}
+
+func validateIfName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty")
+	}
+	if len(name) > maxIfNameLen {
+		return fmt.Errorf("%q is longer than %d", name, maxIfNameLen)
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, "/: \t\n") {
+		return fmt.Errorf("%q is not a valid interface name", name)
+	}
+	return nil
+}
+
+func validateNetns(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%q is not an absolute path", path)
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to statfs %s: %v", path, err)
+	}
+	if st.Type != nsfsMagic && st.Type != procSuperMagic {
+		return fmt.Errorf("%s is not a netns", path)
+	}
+	return nil
+}
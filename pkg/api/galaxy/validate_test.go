@@ -0,0 +1,74 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+// #lizard forgives
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range []struct {
+		command, containerID, netns, ifName string
+		expectKey                           string
+	}{
+		{command: "ADD", containerID: "ctn1", netns: "/proc/self/ns/net", ifName: "eth0"},
+		// a gone netns is handled by the command
+		{command: "ADD", containerID: "ctn1", netns: filepath.Join(dir, "gone"), ifName: "eth0"},
+		{command: "DEL", containerID: "ctn1", ifName: "eth0"},
+		{command: "CHECK", containerID: "a_b.c-d", netns: "/proc/self/ns/net", ifName: "eth0"},
+		{command: "VERSION", containerID: "ctn1", netns: "/proc/self/ns/net", ifName: "eth0", expectKey: "CNI_COMMAND"},
+		{command: "ADD", containerID: "", netns: "/proc/self/ns/net", ifName: "eth0", expectKey: "CNI_CONTAINERID"},
+		{command: "ADD", containerID: "-ctn", netns: "/proc/self/ns/net", ifName: "eth0", expectKey: "CNI_CONTAINERID"},
+		{command: "ADD", containerID: "ctn/1", netns: "/proc/self/ns/net", ifName: "eth0", expectKey: "CNI_CONTAINERID"},
+		{command: "ADD", containerID: "ctn1", netns: "", ifName: "eth0", expectKey: "CNI_NETNS"},
+		{command: "ADD", containerID: "ctn1", netns: "proc/self/ns/net", ifName: "eth0", expectKey: "CNI_NETNS"},
+		{command: "DEL", containerID: "ctn1", netns: file, ifName: "eth0", expectKey: "CNI_NETNS"},
+		{command: "ADD", containerID: "ctn1", netns: "/proc/self/ns/net", ifName: "", expectKey: "CNI_IFNAME"},
+		{command: "ADD", containerID: "ctn1", netns: "/proc/self/ns/net", ifName: "eth0123456789012",
+			expectKey: "CNI_IFNAME"},
+		{command: "ADD", containerID: "ctn1", netns: "/proc/self/ns/net", ifName: "eth/0", expectKey: "CNI_IFNAME"},
+	} {
+		req := &PodRequest{Command: c.command, CmdArgs: &skel.CmdArgs{ContainerID: c.containerID, Netns: c.netns,
+			IfName: c.ifName}}
+		err := req.validate()
+		if c.expectKey == "" {
+			if err != nil {
+				t.Fatalf("case %d: %v", i, err)
+			}
+			continue
+		}
+		bad, ok := err.(*RequestError)
+		if !ok || bad.Key != c.expectKey || bad.Code != ErrCodeInvalidEnvironmentVariables {
+			t.Fatalf("case %d: expect bad %s, real %v", i, c.expectKey, err)
+		}
+	}
+}
@@ -20,13 +20,13 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strings"
 
+	corev1 "k8s.io/api/core/v1"
 	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/utils/store"
 )
 
 /*
@@ -42,9 +42,36 @@ const (
 	K8S_POD_NAMESPACE          = "K8S_POD_NAMESPACE"
 	K8S_POD_NAME               = "K8S_POD_NAME"
 	K8S_POD_INFRA_CONTAINER_ID = "K8S_POD_INFRA_CONTAINER_ID"
+	// K8S_POD_UID is sent by some runtimes, e.g. containerd, but not dockershim
+	K8S_POD_UID = "K8S_POD_UID"
 
-	stateDir                   = "/var/lib/cni/galaxy/port"
+	// PortStateDir is where ports of containers are stored by default, see SetPortStore
+	PortStateDir               = "/var/lib/cni/galaxy/port"
 	PortMappingPortsAnnotation = "tkestack.io/portmapping"
+	// PortMappingReadyCondition is set on pods having a readiness gate of it once their port mapping is set up
+	PortMappingReadyCondition = "tkestack.io/portmapping-ready"
+	// QueueTuningAnnotation is a json of kernel.QueueTuning which is applied to the pod's interface
+	QueueTuningAnnotation = "tkestack.io/queue-tuning"
+	// DSRPortsAnnotation is a json list of ports, each of which has containerPort, protocol and vip, whose packets
+	// are delivered direct server return style: routed to the pod without DNAT, the pod must have the vip on its
+	// loopback. It's for L4 load balancers in front of hostPort pods to preserve client ips
+	DSRPortsAnnotation = "tkestack.io/portmapping-dsr"
+	// ConnectionLimitAnnotation is a json of connlimit.Limit which caps connections originated from the pod
+	ConnectionLimitAnnotation = "tkestack.io/connection-limit"
+	// MTUAnnotation is a json of mtu.Override which sets mtu of the pod's interface and optionally clamps tcp mss
+	MTUAnnotation = "tkestack.io/mtu"
+	// EgressGatewayAnnotation is vlan or overlay, which selects the gateway default traffic of a pod having both vlan
+	// and overlay interfaces goes via
+	EgressGatewayAnnotation = "tkestack.io/egress-gateway"
+	// IngressBandwidthAnnotation and EgressBandwidthAnnotation are the kubernetes annotations limiting bandwidth of
+	// traffic to and from the pod, e.g. 10M
+	IngressBandwidthAnnotation = "kubernetes.io/ingress-bandwidth"
+	EgressBandwidthAnnotation  = "kubernetes.io/egress-bandwidth"
+	// QuarantineAnnotation quarantines the pod if present, its value is a comma separated allow list of cidrs or ips
+	// the pod may still talk to besides --quarantine-allowed-cidrs of galaxy, see package quarantine
+	QuarantineAnnotation = "tkestack.io/quarantine"
+	// RoutesAnnotation is a json list of staticroute.Route which are added to the pod's netns
+	RoutesAnnotation = "galaxy.k8s.io/routes"
 )
 
 type Port struct {
@@ -56,28 +83,82 @@ type Port struct {
 	// Required: Supports "TCP" and "UDP".
 	Protocol string `json:"protocol"`
 
+	// Name is the name of the container port. Ports in annotations may reference container ports by name instead
+	// of containerPort, see ResolveNamedPorts
+	Name string `json:"name,omitempty"`
+
 	HostIP string `json:"hostIP,omitempty"`
 
 	PodName string `json:"podName"`
 
 	PodIP string `json:"podIP"`
+
+	// VIP is the virtual ip of a load balancer which delivers packets of the port to the node without rewriting
+	// their destination. If set, packets to VIP:HostPort are routed to the pod as they are, see DSRPortsAnnotation
+	VIP string `json:"vip,omitempty"`
+
+	// HostInterface is the host interface packets to PodIP go out of, e.g. the flannel bridge, a vlan bridge or the
+	// host veth of the pod. Localhost access to hostports is SNATed out of it.
+	HostInterface string `json:"hostInterface,omitempty"`
 }
 
-func SavePort(containerID string, data []byte) error {
-	if err := os.MkdirAll(stateDir, 0700); err != nil {
-		return err
+// ResolveNamedPorts fills containerPort and protocol of ports which reference container ports of the pod by name.
+// Names of container ports are unique within a pod.
+func ResolveNamedPorts(spec *corev1.PodSpec, ports []Port) error {
+	for i := range ports {
+		if ports[i].Name == "" {
+			continue
+		}
+		containerPort := findNamedPort(spec, ports[i].Name)
+		if containerPort == nil {
+			return fmt.Errorf("no container port named %q", ports[i].Name)
+		}
+		if ports[i].ContainerPort != 0 && ports[i].ContainerPort != containerPort.ContainerPort {
+			return fmt.Errorf("port %q is %d rather than %d", ports[i].Name, containerPort.ContainerPort,
+				ports[i].ContainerPort)
+		}
+		ports[i].ContainerPort = containerPort.ContainerPort
+		if ports[i].Protocol == "" {
+			ports[i].Protocol = string(containerPort.Protocol)
+		}
 	}
-	path := filepath.Join(stateDir, containerID)
-	return ioutil.WriteFile(path, data, 0600)
+	return nil
+}
+
+func findNamedPort(spec *corev1.PodSpec, name string) *corev1.ContainerPort {
+	for i := range spec.Containers {
+		for j := range spec.Containers[i].Ports {
+			if spec.Containers[i].Ports[j].Name == name {
+				return &spec.Containers[i].Ports[j]
+			}
+		}
+	}
+	return nil
+}
+
+// portStore stores ports of containers keyed by container ids, see SetPortStore
+var portStore store.Store = store.NewFileStore(PortStateDir)
+
+// SetPortStore replaces the store of ports of containers, which defaults to files in PortStateDir
+func SetPortStore(s store.Store) {
+	portStore = s
+}
+
+func SavePort(containerID string, data []byte) error {
+	return portStore.Put(containerID, data)
 }
 
 func RemovePortFile(containerID string) error {
-	return os.Remove(filepath.Join(stateDir, containerID))
+	return portStore.Delete(containerID)
+}
+
+// PortFileContainers returns ids of containers having a port file
+func PortFileContainers() ([]string, error) {
+	return portStore.Keys()
 }
 
 func ConsumePort(containerID string) ([]Port, error) {
-	path := filepath.Join(stateDir, containerID)
-	data, err := ioutil.ReadFile(path)
+	data, err := portStore.Get(containerID)
 	if err != nil {
 		return nil, err
 	}
@@ -115,12 +196,6 @@ func GetHostname() string {
 	return strings.ToLower(strings.TrimSpace(hostname))
 }
 
-type PortMapConf struct {
-	RuntimeConfig struct {
-		PortMaps []Port `json:"portMappings,omitempty"`
-	} `json:"runtimeConfig,omitempty"`
-}
-
 //such as struct NetworkSelectionElement, function ParsePodNetworkAnnotation &  parsePodNetworkObjectName all written
 // in compatible with multus-cni
 //reference to https://github.com/intel/multus-cni/blob/master/k8sclient/k8sclient.go
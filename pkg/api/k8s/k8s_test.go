@@ -17,7 +17,10 @@
 package k8s
 
 import (
+	"reflect"
 	"testing"
+
+	corev1 "k8s.io/api/core/v1"
 )
 
 // #lizard forgives
@@ -52,3 +55,24 @@ func TestParsePodNetworkAnnotation(t *testing.T) {
 		t.Errorf("case3 parse failed")
 	}
 }
+
+func TestResolveNamedPorts(t *testing.T) {
+	spec := &corev1.PodSpec{Containers: []corev1.Container{
+		{Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080, Protocol: corev1.ProtocolTCP}}},
+		{Ports: []corev1.ContainerPort{{Name: "dns", ContainerPort: 53, Protocol: corev1.ProtocolUDP}}},
+	}}
+	ports := []Port{{Name: "http", VIP: "10.0.0.100"}, {Name: "dns"}, {ContainerPort: 80, Protocol: "TCP"}}
+	if err := ResolveNamedPorts(spec, ports); err != nil {
+		t.Fatal(err)
+	}
+	expect := []Port{{Name: "http", ContainerPort: 8080, Protocol: "TCP", VIP: "10.0.0.100"},
+		{Name: "dns", ContainerPort: 53, Protocol: "UDP"}, {ContainerPort: 80, Protocol: "TCP"}}
+	if !reflect.DeepEqual(ports, expect) {
+		t.Fatalf("expect %+v, real %+v", expect, ports)
+	}
+	for _, bad := range [][]Port{{{Name: "metrics"}}, {{Name: "http", ContainerPort: 80}}} {
+		if err := ResolveNamedPorts(spec, bad); err == nil {
+			t.Errorf("expect an error for %+v", bad)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package client is a typed client of the admin api galaxy serves on its socket and the api of galaxy-ipam, so that
+// tools don't build requests against them by hand. Requests take contexts and idempotent ones are retried.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetries = 3
+	defaultBackoff = 200 * time.Millisecond
+	defaultTimeout = time.Minute
+)
+
+// Options are options of clients, zero values are replaced by defaults
+type Options struct {
+	// Retries is how many times idempotent requests are retried on connection errors and 5xx responses, 3 by
+	// default, negative to disable retries
+	Retries int
+	// Backoff is the delay before the first retry which doubles for each next one, 200ms by default
+	Backoff time.Duration
+	// Timeout is the timeout of each attempt, 1 minute by default. Contexts of requests bound all attempts.
+	Timeout time.Duration
+}
+
+func (o *Options) complete() Options {
+	ret := Options{Retries: defaultRetries, Backoff: defaultBackoff, Timeout: defaultTimeout}
+	if o == nil {
+		return ret
+	}
+	if o.Retries != 0 {
+		ret.Retries = o.Retries
+	}
+	if ret.Retries < 0 {
+		ret.Retries = 0
+	}
+	if o.Backoff > 0 {
+		ret.Backoff = o.Backoff
+	}
+	if o.Timeout > 0 {
+		ret.Timeout = o.Timeout
+	}
+	return ret
+}
+
+// StatusError is the error of a response of an unexpected status code
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Code, http.StatusText(e.Code), e.Message)
+}
+
+// IsNotFound returns if err is a 404 response
+func IsNotFound(err error) bool {
+	e, ok := err.(*StatusError)
+	return ok && e.Code == http.StatusNotFound
+}
+
+// request is a request of an api
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   interface{}
+	// idempotent requests are retried on connection errors and 5xx responses
+	idempotent bool
+	// accepted are status codes besides 2xx whose bodies are results rather than errors, e.g. 503 of /readyz
+	accepted []int
+}
+
+// restClient sends requests to a base url with retries
+type restClient struct {
+	client  *http.Client
+	base    string
+	header  http.Header
+	options Options
+}
+
+func newRESTClient(transport http.RoundTripper, base string, header http.Header, opts *Options) *restClient {
+	options := opts.complete()
+	return &restClient{
+		client:  &http.Client{Transport: transport, Timeout: options.Timeout},
+		base:    strings.TrimSuffix(base, "/"),
+		header:  header,
+		options: options,
+	}
+}
+
+// do sends r and decodes the response body into out if it is not nil. It returns the status code of the last
+// response, which is also set if the response is an error.
+func (c *restClient) do(ctx context.Context, r *request, out interface{}) (int, error) {
+	var body []byte
+	if r.body != nil {
+		var err error
+		if body, err = json.Marshal(r.body); err != nil {
+			return 0, fmt.Errorf("failed to marshal request: %v", err)
+		}
+	}
+	u := c.base + r.path
+	if len(r.query) > 0 {
+		u += "?" + r.query.Encode()
+	}
+	backoff := c.options.Backoff
+	for attempt := 0; ; attempt++ {
+		code, data, err := c.send(ctx, r.method, u, body)
+		if err == nil && (code < 300 || acceptedCode(r.accepted, code)) {
+			if out != nil && len(data) > 0 {
+				if err := json.Unmarshal(data, out); err != nil {
+					return code, fmt.Errorf("failed to unmarshal response %s: %v", string(data), err)
+				}
+			}
+			return code, nil
+		}
+		if err == nil {
+			err = &StatusError{Code: code, Message: errorMessage(data)}
+		}
+		if !r.idempotent || attempt >= c.options.Retries || (code != 0 && code < 500) {
+			return code, err
+		}
+		select {
+		case <-ctx.Done():
+			return code, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// send sends a request and returns the status code and body of the response, the code is 0 if there is none
+func (c *restClient) send(ctx context.Context, method, u string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	return resp.StatusCode, data, nil
+}
+
+func acceptedCode(accepted []int, code int) bool {
+	for _, c := range accepted {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// errorMessage returns the message of an error response, galaxy-ipam responds with a json of code and message while
+// galaxy responds with plain text
+func errorMessage(data []byte) string {
+	var resp struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(data, &resp) == nil && resp.Message != "" {
+		return resp.Message
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,111 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRESTClientRetries(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("X-Token") != "token" {
+			http.Error(w, "no token", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"path":%q}`, r.URL.Path)
+	}))
+	defer server.Close()
+	c := newRESTClient(http.DefaultTransport, server.URL+"/", http.Header{"X-Token": []string{"token"}},
+		&Options{Backoff: time.Millisecond})
+	var out struct{ Path string }
+	code, err := c.do(context.Background(), &request{method: http.MethodGet, path: "/a", idempotent: true}, &out)
+	if err != nil || code != http.StatusOK || out.Path != "/a" || calls != 3 {
+		t.Fatalf("code %d, err %v, out %v, calls %d", code, err, out, calls)
+	}
+	// requests which are not idempotent are not retried
+	atomic.StoreInt32(&calls, 0)
+	code, err = c.do(context.Background(), &request{method: http.MethodPost, path: "/a", body: 1}, nil)
+	if e, ok := err.(*StatusError); !ok || e.Code != http.StatusServiceUnavailable || e.Message != "busy" ||
+		calls != 1 {
+		t.Fatalf("code %d, err %v, calls %d", code, err, calls)
+	}
+	// nor are 4xx responses
+	atomic.StoreInt32(&calls, 10)
+	c.header = nil
+	if _, err := c.do(context.Background(), &request{method: http.MethodGet, path: "/a", idempotent: true},
+		nil); err == nil || calls != 11 {
+		t.Fatalf("err %v, calls %d", err, calls)
+	}
+}
+
+func TestRESTClientAccepted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("q") != "1" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"code":400,"message":"bad request: no q"}`)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"ready":false}`)
+	}))
+	defer server.Close()
+	c := newRESTClient(http.DefaultTransport, server.URL, nil, &Options{Retries: -1})
+	var out struct{ Ready bool }
+	out.Ready = true
+	code, err := c.do(context.Background(), &request{method: http.MethodGet, path: "/readyz",
+		query: map[string][]string{"q": {"1"}}, accepted: []int{http.StatusServiceUnavailable}}, &out)
+	if err != nil || code != http.StatusServiceUnavailable || out.Ready {
+		t.Fatalf("code %d, err %v, out %v", code, err, out)
+	}
+	_, err = c.do(context.Background(), &request{method: http.MethodGet, path: "/readyz"}, &out)
+	if e, ok := err.(*StatusError); !ok || e.Message != "bad request: no q" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestRESTClientContext(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "failed", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	c := newRESTClient(http.DefaultTransport, server.URL, nil, &Options{Retries: 10, Backoff: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.do(ctx, &request{method: http.MethodGet, path: "/", idempotent: true}, nil); err == nil {
+		t.Fatal("expect an error")
+	}
+	if time.Since(start) > 10*time.Second || calls != 1 {
+		t.Fatalf("retries are not bound by the context, calls %d", calls)
+	}
+	if !IsNotFound(&StatusError{Code: http.StatusNotFound}) || IsNotFound(fmt.Errorf("404")) {
+		t.Fatal("IsNotFound")
+	}
+}
@@ -0,0 +1,219 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"tkestack.io/galaxy/pkg/api/galaxy/private"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/galaxy"
+	"tkestack.io/galaxy/pkg/utils/endpoint"
+)
+
+// GalaxyClient is a client of the api galaxy serves on its socket
+type GalaxyClient struct {
+	rest *restClient
+}
+
+// PodState is the state galaxy keeps of a container it set up
+type PodState struct {
+	PodName      string
+	PodNamespace string
+	Netns        string
+	IfName       string
+	// Result is the cni result of the container
+	Result json.RawMessage
+	Ports  []k8s.Port
+}
+
+// ContainerOwner is the container and pod of the node owning an ip
+type ContainerOwner struct {
+	ContainerID  string
+	PodName      string
+	PodNamespace string
+	PodUID       string
+}
+
+// NewGalaxyClient creates a client of galaxy listening on socket, which is a unix socket path or an endpoint of
+// --extra-listen-addresses, e.g. abstract:galaxy, and is private.GalaxySocketPath if empty. The token is read from
+// tokenFile if galaxy is started with --socket-token-file.
+func NewGalaxyClient(socket, tokenFile string, opts *Options) (*GalaxyClient, error) {
+	if socket == "" {
+		socket = private.GalaxySocketPath
+	}
+	e, err := endpoint.Parse(socket)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	if tokenFile != "" {
+		data, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token: %v", err)
+		}
+		header.Set(private.GalaxyTokenHeader, strings.TrimSpace(string(data)))
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return e.Dial()
+		},
+	}
+	return &GalaxyClient{rest: newRESTClient(transport, "http://galaxy", header, opts)}, nil
+}
+
+// Readyz returns the readiness of the node, which is returned along with no error if the node is not ready
+func (c *GalaxyClient) Readyz(ctx context.Context) (*galaxy.Readiness, error) {
+	var readiness galaxy.Readiness
+	if _, err := c.rest.do(ctx, &request{method: http.MethodGet, path: "/readyz", idempotent: true,
+		accepted: []int{http.StatusServiceUnavailable}}, &readiness); err != nil {
+		return nil, err
+	}
+	return &readiness, nil
+}
+
+// Teardown tears down networks of all pods of the node by concurrency workers, 0 for the default of galaxy
+func (c *GalaxyClient) Teardown(ctx context.Context, concurrency int) (*galaxy.TeardownResult, error) {
+	query := url.Values{}
+	if concurrency > 0 {
+		query.Set("concurrency", strconv.Itoa(concurrency))
+	}
+	var result galaxy.TeardownResult
+	if _, err := c.rest.do(ctx, &request{method: http.MethodPost, path: "/admin/teardown", query: query},
+		&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// SyncFirewall runs all firewall loops of galaxy immediately
+func (c *GalaxyClient) SyncFirewall(ctx context.Context) (*galaxy.FirewallSyncResult, error) {
+	var result galaxy.FirewallSyncResult
+	if _, err := c.rest.do(ctx, &request{method: http.MethodPost, path: "/admin/firewall/sync", idempotent: true},
+		&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Reload reloads the json config of galaxy, a refused config is a *StatusError of 422
+func (c *GalaxyClient) Reload(ctx context.Context) (*galaxy.ReloadResult, error) {
+	var result galaxy.ReloadResult
+	if _, err := c.rest.do(ctx, &request{method: http.MethodPost, path: "/admin/reload", idempotent: true},
+		&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Maintenance returns the maintenance mode of the node network, nil if it is not in maintenance
+func (c *GalaxyClient) Maintenance(ctx context.Context) (*galaxy.Maintenance, error) {
+	var m galaxy.Maintenance
+	if _, err := c.rest.do(ctx, &request{method: http.MethodGet, path: "/admin/maintenance", idempotent: true},
+		&m); err != nil {
+		if IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &m, nil
+}
+
+// EnterMaintenance puts the node network into maintenance for reason, or updates the reason if it is in maintenance
+func (c *GalaxyClient) EnterMaintenance(ctx context.Context, reason string) (*galaxy.Maintenance, error) {
+	var m galaxy.Maintenance
+	if _, err := c.rest.do(ctx, &request{method: http.MethodPost, path: "/admin/maintenance",
+		query: url.Values{"reason": []string{reason}}, idempotent: true}, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// LeaveMaintenance takes the node network out of maintenance
+func (c *GalaxyClient) LeaveMaintenance(ctx context.Context) error {
+	_, err := c.rest.do(ctx, &request{method: http.MethodDelete, path: "/admin/maintenance", idempotent: true}, nil)
+	return err
+}
+
+// PodState returns the state of a container, the error is a 404 StatusError if galaxy has none
+func (c *GalaxyClient) PodState(ctx context.Context, containerID string) (*PodState, error) {
+	var state PodState
+	if _, err := c.rest.do(ctx, &request{method: http.MethodGet, path: "/state/" + url.PathEscape(containerID),
+		idempotent: true}, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// EffectiveConfig returns what galaxy did for a container, the error is a 404 StatusError if galaxy has no record
+func (c *GalaxyClient) EffectiveConfig(ctx context.Context, containerID string) (*galaxy.EffectiveConfig, error) {
+	var config galaxy.EffectiveConfig
+	if _, err := c.rest.do(ctx, &request{method: http.MethodGet,
+		path: "/state/" + url.PathEscape(containerID) + "/config", idempotent: true}, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// IPOwner returns the container owning ip on the node, nil if there is none
+func (c *GalaxyClient) IPOwner(ctx context.Context, ip net.IP) (*ContainerOwner, error) {
+	var owner ContainerOwner
+	if _, err := c.rest.do(ctx, &request{method: http.MethodGet, path: "/owner/" + ip.String(), idempotent: true},
+		&owner); err != nil {
+		if IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &owner, nil
+}
+
+// CreateDebugAttachment attaches a new netns to a network for connectivity tests
+func (c *GalaxyClient) CreateDebugAttachment(ctx context.Context,
+	req *galaxy.DebugAttachmentRequest) (*galaxy.DebugAttachment, error) {
+	var attachment galaxy.DebugAttachment
+	if _, err := c.rest.do(ctx, &request{method: http.MethodPost, path: "/admin/debug-attachments", body: req},
+		&attachment); err != nil {
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+// ListDebugAttachments lists debug attachments which are not released yet
+func (c *GalaxyClient) ListDebugAttachments(ctx context.Context) ([]*galaxy.DebugAttachment, error) {
+	var attachments []*galaxy.DebugAttachment
+	if _, err := c.rest.do(ctx, &request{method: http.MethodGet, path: "/admin/debug-attachments",
+		idempotent: true}, &attachments); err != nil {
+		return nil, err
+	}
+	return attachments, nil
+}
+
+// DeleteDebugAttachment releases the debug attachment of id
+func (c *GalaxyClient) DeleteDebugAttachment(ctx context.Context, id string) error {
+	_, err := c.rest.do(ctx, &request{method: http.MethodDelete, path: "/admin/debug-attachments/" +
+		url.PathEscape(id), idempotent: true}, nil)
+	return err
+}
@@ -0,0 +1,194 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"tkestack.io/galaxy/pkg/ipam/api"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin"
+)
+
+// IPAMClient is a client of the api of galaxy-ipam
+type IPAMClient struct {
+	rest *restClient
+}
+
+// ListIPsOptions are filters of listing ips. Keyword fuzzy matches ips and names and excludes other filters.
+type ListIPsOptions struct {
+	Keyword   string
+	PoolName  string
+	AppName   string
+	PodName   string
+	Namespace string
+	// AppType is deployment, statefulset or tapp
+	AppType string
+	// Page starts from 0, Size is 10 by default
+	Page int
+	Size int
+	// Sort is the field and order, e.g. "ip asc"
+	Sort string
+}
+
+func (o *ListIPsOptions) query() url.Values {
+	query := url.Values{}
+	for k, v := range map[string]string{"keyword": o.Keyword, "poolName": o.PoolName, "appName": o.AppName,
+		"podName": o.PodName, "namespace": o.Namespace, "appType": o.AppType, "sort": o.Sort} {
+		if v != "" {
+			query.Set(k, v)
+		}
+	}
+	if o.Page > 0 {
+		query.Set("page", strconv.Itoa(o.Page))
+	}
+	if o.Size > 0 {
+		query.Set("size", strconv.Itoa(o.Size))
+	}
+	return query
+}
+
+// NewIPAMClient creates a client of galaxy-ipam serving its api on address, e.g. http://galaxy-ipam:9041. The
+// token is sent as a bearer token if it is not empty, which galaxy-ipam requires unless --api-auth=false.
+// Transport is http.DefaultTransport if nil.
+func NewIPAMClient(address, token string, transport http.RoundTripper, opts *Options) *IPAMClient {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return &IPAMClient{rest: newRESTClient(transport, address+"/v1", header, opts)}
+}
+
+// ListIPs lists a page of floating ips
+func (c *IPAMClient) ListIPs(ctx context.Context, opts *ListIPsOptions) (*api.ListIPResp, error) {
+	var resp api.ListIPResp
+	if _, err := c.rest.do(ctx, &request{method: http.MethodGet, path: "/ip", query: opts.query(),
+		idempotent: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ReleaseIPs releases ips and returns ones which are not released, i.e. released or allocated to other pods already
+// or not within valid ranges
+func (c *IPAMClient) ReleaseIPs(ctx context.Context, ips []api.FloatingIP) ([]string, error) {
+	var resp api.ReleaseIPResp
+	if _, err := c.rest.do(ctx, &request{method: http.MethodPost, path: "/ip", body: &api.ReleaseIPReq{IPs: ips}},
+		&resp); err != nil {
+		return nil, err
+	}
+	return resp.Unreleased, nil
+}
+
+// GetPool returns the pool of name, the error is a 404 StatusError if there is none
+func (c *IPAMClient) GetPool(ctx context.Context, name string) (*api.Pool, error) {
+	var resp api.GetPoolResp
+	if _, err := c.rest.do(ctx, &request{method: http.MethodGet, path: "/pool/" + url.PathEscape(name),
+		idempotent: true}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Pool, nil
+}
+
+// CreateOrUpdatePool creates or updates a pool and returns its real size, which is less than its size if there are
+// not enough ips
+func (c *IPAMClient) CreateOrUpdatePool(ctx context.Context, pool *api.Pool) (int, error) {
+	var resp api.UpdatePoolResp
+	if _, err := c.rest.do(ctx, &request{method: http.MethodPost, path: "/pool", body: pool, idempotent: true},
+		&resp); err != nil {
+		return 0, err
+	}
+	return resp.RealPoolSize, nil
+}
+
+// DeletePool deletes the pool of name
+func (c *IPAMClient) DeletePool(ctx context.Context, name string) error {
+	_, err := c.rest.do(ctx, &request{method: http.MethodDelete, path: "/pool/" + url.PathEscape(name),
+		idempotent: true}, nil)
+	return err
+}
+
+// ExportSnapshot exports pools, allocations and reservations of ipams as a snapshot
+func (c *IPAMClient) ExportSnapshot(ctx context.Context) (*api.Snapshot, error) {
+	var snapshot api.Snapshot
+	if _, err := c.rest.do(ctx, &request{method: http.MethodGet, path: "/snapshot", idempotent: true},
+		&snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// RestoreSnapshot restores allocations and pools of snapshot, conflict is api.ConflictSkip, api.ConflictOverwrite
+// or api.ConflictAbort. The response is also returned along with a 409 StatusError if it is aborted by conflicts.
+func (c *IPAMClient) RestoreSnapshot(ctx context.Context, snapshot *api.Snapshot, conflict string,
+	dryRun bool) (*api.RestoreSnapshotResp, error) {
+	query := url.Values{}
+	if conflict != "" {
+		query.Set("conflict", conflict)
+	}
+	if dryRun {
+		query.Set("dryRun", "true")
+	}
+	var resp api.RestoreSnapshotResp
+	code, err := c.rest.do(ctx, &request{method: http.MethodPost, path: "/snapshot", query: query, body: snapshot,
+		accepted: []int{http.StatusConflict}}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if code == http.StatusConflict {
+		return &resp, &StatusError{Code: code, Message: resp.Message}
+	}
+	return &resp, nil
+}
+
+// ListAgents lists liveness of galaxy of nodes
+func (c *IPAMClient) ListAgents(ctx context.Context) ([]*schedulerplugin.AgentLiveness, error) {
+	var resp api.ListAgentsResp
+	if _, err := c.rest.do(ctx, &request{method: http.MethodGet, path: "/agent", idempotent: true},
+		&resp); err != nil {
+		return nil, err
+	}
+	return resp.Agents, nil
+}
+
+// Owner returns the pod owning ip, nil if there is none
+func (c *IPAMClient) Owner(ctx context.Context, ip string) (*api.IPOwner, error) {
+	var owner api.IPOwner
+	if _, err := c.rest.do(ctx, &request{method: http.MethodGet, path: "/owner/" + url.PathEscape(ip),
+		idempotent: true}, &owner); err != nil {
+		if IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &owner, nil
+}
+
+// Owners returns pods owning ips, ips having no owner are left out
+func (c *IPAMClient) Owners(ctx context.Context, ips []string) ([]*api.IPOwner, error) {
+	var resp api.OwnersResp
+	if _, err := c.rest.do(ctx, &request{method: http.MethodPost, path: "/owner", body: &api.OwnersReq{IPs: ips},
+		idempotent: true}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Owners, nil
+}
@@ -0,0 +1,85 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tkestack.io/galaxy/pkg/ipam/api"
+)
+
+func TestIPAMClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/ip", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodGet {
+			fmt.Fprintf(w, `{"code":200,"content":[{"ip":"10.0.0.2","poolName":%q}]}`, r.URL.Query().Get("poolName"))
+			return
+		}
+		var req api.ReleaseIPReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.IPs) != 2 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"code":202,"unreleased":[%q]}`, req.IPs[1].IP)
+	})
+	mux.HandleFunc("/v1/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"code":409,"message":"conflicts","dryRun":%v,"conflicts":[{"reason":"taken"}]}`,
+			r.URL.Query().Get("dryRun") == "true")
+	})
+	mux.HandleFunc("/v1/owner/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"code":404,"message":"not found: ip has no owner"}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	c := NewIPAMClient(server.URL, "token", nil, nil)
+	ctx := context.Background()
+
+	ips, err := c.ListIPs(ctx, &ListIPsOptions{PoolName: "pool1"})
+	if err != nil || len(ips.Content) != 1 || ips.Content[0].PoolName != "pool1" {
+		t.Fatalf("ips %v, err %v", ips, err)
+	}
+	unreleased, err := c.ReleaseIPs(ctx, []api.FloatingIP{{IP: "10.0.0.2"}, {IP: "10.0.0.3"}})
+	if err != nil || len(unreleased) != 1 || unreleased[0] != "10.0.0.3" {
+		t.Fatalf("unreleased %v, err %v", unreleased, err)
+	}
+	resp, err := c.RestoreSnapshot(ctx, &api.Snapshot{Version: api.SnapshotVersion}, api.ConflictAbort, true)
+	if e, ok := err.(*StatusError); !ok || e.Code != http.StatusConflict {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if resp == nil || !resp.DryRun || len(resp.Conflicts) != 1 || resp.Conflicts[0].Reason != "taken" {
+		t.Fatalf("unexpected response %v", resp)
+	}
+	owner, err := c.Owner(ctx, "10.0.0.4")
+	if err != nil || owner != nil {
+		t.Fatalf("owner %v, err %v", owner, err)
+	}
+	if _, err := NewIPAMClient(server.URL, "", nil, nil).ListIPs(ctx, &ListIPsOptions{}); err == nil {
+		t.Fatal("expect an unauthorized error")
+	}
+}
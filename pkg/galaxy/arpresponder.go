@@ -0,0 +1,65 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/network/arpresponder"
+	"tkestack.io/galaxy/pkg/network/vlan"
+)
+
+// startARPResponders answers arp requests of uplinks of pure mode networks having arp_responder for ips of pure mode
+// pods, whose vlan plugin leaves proxy arp of the uplinks off
+func (g *Galaxy) startARPResponders() {
+	devices := map[string]bool{}
+	for _, d := range g.vlanNetConfs() {
+		if !d.PureMode() || !d.ARPResponder || devices[d.Device] {
+			continue
+		}
+		devices[d.Device] = true
+		r := arpresponder.New(d.Device)
+		g.arpResponders = append(g.arpResponders, r)
+		go wait.Until(func() {
+			if err := r.Run(g.quitChan); err != nil {
+				glog.Warningf("arp responder of %s failed, restarting: %v", r.Device, err)
+			}
+		}, 10*time.Second, g.quitChan)
+	}
+	if len(g.arpResponders) == 0 {
+		return
+	}
+	go wait.Until(g.syncARPResponders, 30*time.Second, g.quitChan)
+}
+
+// syncARPResponders makes arp responders answer for ips of current pure mode pods. ADD and DEL requests sync them
+// as well, so that new pods are reachable at once.
+func (g *Galaxy) syncARPResponders() {
+	if len(g.arpResponders) == 0 {
+		return
+	}
+	ips, err := vlan.PurePodIPs()
+	if err != nil {
+		glog.Warningf("failed to list ips of pure mode pods: %v", err)
+		return
+	}
+	for _, r := range g.arpResponders {
+		r.Sync(ips)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/galaxy/options"
+	"tkestack.io/galaxy/pkg/network/arpwatch"
+)
+
+// ipConflictReason is the reason of events of pods whose ips are claimed by other macs
+const ipConflictReason = "IPConflict"
+
+// startARPWatch watches arp and neighbor advertisements on bridges of local pods, bindings of pods set up before
+// restarting are rebuilt from the result cache
+func (g *Galaxy) startARPWatch() {
+	g.arpWatcher = arpwatch.New(g.IPv6Mode != options.IPv6Disable, func(c arpwatch.Conflict) {
+		glog.Warningf("%s %s of pod %s (container %s) on %s is claimed by %s, expect %s", c.Protocol, c.IP, c.Pod,
+			c.Owner, c.Bridge, c.MAC, c.ExpectedMAC)
+		parts := strings.SplitN(c.Pod, "/", 2)
+		if len(parts) != 2 {
+			return
+		}
+		g.recorder.Eventf(&corev1.ObjectReference{Kind: "Pod", Namespace: parts[0], Name: parts[1]},
+			corev1.EventTypeWarning, ipConflictReason, "%s %s is claimed by %s on %s, expect %s, the ip may be "+
+				"allocated twice or spoofed", c.Protocol, c.IP, c.MAC, c.Bridge, c.ExpectedMAC)
+	})
+	keys, err := g.results.Keys()
+	if err != nil {
+		glog.Warningf("failed to list cached results: %v", err)
+	}
+	for _, containerID := range keys {
+		data, err := g.results.Get(containerID)
+		if err != nil {
+			continue
+		}
+		var cached cachedResult
+		if err := json.Unmarshal(data, &cached); err != nil {
+			continue
+		}
+		if nns := cached.netnsInEffect(); nns != "" {
+			g.bindARP(containerID, nns, cached.PodNamespace+"/"+cached.PodName)
+		}
+	}
+	go func() {
+		<-g.quitChan
+		g.arpWatcher.Stop()
+	}()
+}
+
+// bindARP records ips and macs of veths of the netns which are attached to bridges
+func (g *Galaxy) bindARP(containerID, nns, pod string) {
+	if g.arpWatcher == nil {
+		return
+	}
+	bindings, err := podBindings(nns, pod)
+	if err != nil {
+		// monitoring doesn't fail requests
+		glog.Warningf("failed to get ips and macs of %s: %v", containerID, err)
+		return
+	}
+	g.arpWatcher.Bind(containerID, bindings)
+}
+
+func (g *Galaxy) unbindARP(containerID string) {
+	if g.arpWatcher != nil {
+		g.arpWatcher.Unbind(containerID)
+	}
+}
+
+// podBindings returns global unicast ips of veths of the netns, the macs of the veths and bridges of their peers
+func podBindings(nns, pod string) ([]arpwatch.Binding, error) {
+	type veth struct {
+		mac string
+		ips []net.IP
+	}
+	veths := map[int]*veth{}
+	if err := ns.WithNetNSPath(nns, func(_ ns.NetNS) error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			// the parent index of a veth is the index of its peer
+			if _, ok := link.(*netlink.Veth); !ok || link.Attrs().ParentIndex == 0 {
+				continue
+			}
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+			if err != nil {
+				return err
+			}
+			v := &veth{mac: link.Attrs().HardwareAddr.String()}
+			for _, addr := range addrs {
+				if addr.IP.IsGlobalUnicast() {
+					v.ips = append(v.ips, addr.IP)
+				}
+			}
+			veths[link.Attrs().ParentIndex] = v
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	var bindings []arpwatch.Binding
+	for index, v := range veths {
+		peer, err := netlink.LinkByIndex(index)
+		if err != nil {
+			return nil, err
+		}
+		if peer.Attrs().MasterIndex == 0 {
+			continue
+		}
+		bridge, err := netlink.LinkByIndex(peer.Attrs().MasterIndex)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range v.ips {
+			bindings = append(bindings, arpwatch.Binding{IP: ip.String(), MAC: v.mac, Bridge: bridge.Attrs().Name,
+				Pod: pod})
+		}
+	}
+	return bindings, nil
+}
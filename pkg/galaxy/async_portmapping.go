@@ -0,0 +1,150 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"fmt"
+	"time"
+
+	t020 "github.com/containernetworking/cni/pkg/types/020"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	glog "k8s.io/klog"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	k8sutil "tkestack.io/galaxy/pkg/api/k8s/utils"
+	"tkestack.io/galaxy/pkg/network/kernel"
+)
+
+// portMappingTask is the port mapping setup of a container which runs after responding to its ADD request
+type portMappingTask struct {
+	done chan struct{}
+	err  error
+}
+
+// asyncSetupPortMapping sets up port mapping of the pod in background. Its result is reported by CHECK requests
+// and by the PortMappingReadyCondition of the pod if the pod has such a readiness gate.
+func (g *Galaxy) asyncSetupPortMapping(req *galaxyapi.PodRequest, result *t020.Result, pod *corev1.Pod,
+	data []byte, tuning *kernel.AppliedQueueTuning) {
+	task := &portMappingTask{done: make(chan struct{})}
+	g.portMappingLock.Lock()
+	g.portMappingTasks[req.ContainerID] = task
+	g.portMappingLock.Unlock()
+	go func() {
+		start := time.Now()
+		task.err = g.setupPortMapping(req, req.ContainerID, result, pod)
+		if task.err != nil {
+			glog.Errorf("failed to setup port mapping of %s: %v", req.ContainerID, task.err)
+			if err := g.cleanupPortMapping(req, nil); err != nil {
+				glog.Warningf("failed to cleanup port mapping of %s: %v", req.ContainerID, err)
+			}
+		} else {
+			g.cacheResult(req, data, tuning)
+		}
+		glog.V(4).Infof("port mapping of %s done in %v", req.ContainerID, time.Since(start))
+		close(task.done)
+		if task.err == nil {
+			// nothing to report any more
+			g.forgetPortMapping(req.ContainerID)
+		}
+		if err := g.setPortMappingReady(pod, task.err); err != nil {
+			glog.Warningf("failed to set pod %s condition %s: %v", k8s.GetPodFullName(pod.Name, pod.Namespace),
+				k8s.PortMappingReadyCondition, err)
+		}
+	}()
+}
+
+func (g *Galaxy) portMappingTask(containerID string) *portMappingTask {
+	g.portMappingLock.Lock()
+	defer g.portMappingLock.Unlock()
+	return g.portMappingTasks[containerID]
+}
+
+// portMappingErr returns an error if port mapping of containerID is still in progress or has failed
+func (g *Galaxy) portMappingErr(containerID string) error {
+	task := g.portMappingTask(containerID)
+	if task == nil {
+		return nil
+	}
+	select {
+	case <-task.done:
+		if task.err != nil {
+			return fmt.Errorf("failed to setup port mapping: %v", task.err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("port mapping is in progress")
+	}
+}
+
+// waitPortMapping waits until port mapping of containerID finishes if it's in progress
+func (g *Galaxy) waitPortMapping(containerID string) {
+	if task := g.portMappingTask(containerID); task != nil {
+		<-task.done
+	}
+}
+
+func (g *Galaxy) forgetPortMapping(containerID string) {
+	g.portMappingLock.Lock()
+	defer g.portMappingLock.Unlock()
+	delete(g.portMappingTasks, containerID)
+}
+
+// setPortMappingReady sets PortMappingReadyCondition of the pod if it has a readiness gate of the condition
+func (g *Galaxy) setPortMappingReady(pod *corev1.Pod, setupErr error) error {
+	var gated bool
+	for _, gate := range pod.Spec.ReadinessGates {
+		if gate.ConditionType == k8s.PortMappingReadyCondition {
+			gated = true
+		}
+	}
+	if !gated {
+		return nil
+	}
+	condition := corev1.PodCondition{Type: k8s.PortMappingReadyCondition, Status: corev1.ConditionTrue,
+		LastTransitionTime: v1.Now()}
+	if setupErr != nil {
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "SetupFailed"
+		condition.Message = setupErr.Error()
+	}
+	return wait.Poll(10*time.Millisecond, 1*time.Minute, func() (bool, error) {
+		pod, err := g.client.CoreV1().Pods(pod.Namespace).Get(pod.Name, v1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		var found bool
+		for i := range pod.Status.Conditions {
+			if pod.Status.Conditions[i].Type == condition.Type {
+				pod.Status.Conditions[i] = condition
+				found = true
+			}
+		}
+		if !found {
+			pod.Status.Conditions = append(pod.Status.Conditions, condition)
+		}
+		_, err = g.client.CoreV1().Pods(pod.Namespace).UpdateStatus(pod)
+		if err == nil {
+			return true, nil
+		}
+		if k8sutil.ShouldRetry(err) {
+			return false, nil
+		}
+		return false, err
+	})
+}
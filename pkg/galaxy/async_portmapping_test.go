@@ -0,0 +1,182 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	t020 "github.com/containernetworking/cni/pkg/types/020"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/network/connlimit"
+	"tkestack.io/galaxy/pkg/network/mtu"
+	"tkestack.io/galaxy/pkg/network/ndguard"
+	"tkestack.io/galaxy/pkg/network/portmapping"
+	galaxytesting "tkestack.io/galaxy/pkg/testing"
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+	iptablesTest "tkestack.io/galaxy/pkg/utils/iptables/testing"
+	"tkestack.io/galaxy/pkg/utils/store"
+)
+
+// #lizard forgives
+func TestCheckPortMapping(t *testing.T) {
+	master := galaxytesting.NewFakeMaster()
+	defer master.Close()
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"},
+		Spec: corev1.PodSpec{ReadinessGates: []corev1.PodReadinessGate{
+			{ConditionType: k8s.PortMappingReadyCondition}}}}
+	if err := master.AddPod(pod); err != nil {
+		t.Fatal(err)
+	}
+	g := &Galaxy{client: kubernetes.NewForConfigOrDie(&rest.Config{Host: master.URL}),
+		portMappingTasks: map[string]*portMappingTask{}}
+	task := &portMappingTask{done: make(chan struct{})}
+	g.portMappingTasks["c1"] = task
+	req := &galaxyapi.PodRequest{Command: cniutil.COMMAND_CHECK, PodName: "pod1", PodNamespace: "default",
+		CmdArgs: &skel.CmdArgs{ContainerID: "c1"}}
+	if _, err := g.requestFunc(req); err == nil || err.Error() != "port mapping is in progress" {
+		t.Fatalf("expect port mapping in progress, real %v", err)
+	}
+	task.err = fmt.Errorf("port 80 is in use")
+	close(task.done)
+	if _, err := g.requestFunc(req); err == nil || err.Error() != "failed to setup port mapping: port 80 is in use" {
+		t.Fatalf("expect port mapping failed, real %v", err)
+	}
+	if err := g.setPortMappingReady(pod, task.err); err != nil {
+		t.Fatal(err)
+	}
+	pod, err := master.Pod("default", "pod1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pod.Status.Conditions) != 1 || pod.Status.Conditions[0].Status != corev1.ConditionFalse ||
+		pod.Status.Conditions[0].Message != "port 80 is in use" {
+		t.Fatalf("expect a false %s condition, real %+v", k8s.PortMappingReadyCondition, pod.Status.Conditions)
+	}
+}
+
+func TestWaitPortMapping(t *testing.T) {
+	g := &Galaxy{portMappingTasks: map[string]*portMappingTask{}}
+	task := &portMappingTask{done: make(chan struct{})}
+	g.portMappingTasks["c1"] = task
+	// DEL waits for the in-flight port mapping so that it doesn't leak rules set up after the cleanup
+	deleted := make(chan struct{})
+	go func() {
+		g.waitPortMapping("c1")
+		g.forgetPortMapping("c1")
+		close(deleted)
+	}()
+	select {
+	case <-deleted:
+		t.Fatal("expect DEL waiting for the in-flight port mapping")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(task.done)
+	select {
+	case <-deleted:
+	case <-time.After(time.Second):
+		t.Fatal("expect DEL done after the port mapping")
+	}
+	if g.portMappingTask("c1") != nil || g.portMappingErr("c1") != nil {
+		t.Fatal("expect the port mapping forgotten")
+	}
+	// no port mapping in progress
+	g.waitPortMapping("c2")
+}
+
+// failingRules fails to set up hostport rules
+type failingRules struct {
+	portmapping.RuleManager
+}
+
+func (failingRules) SetupPortMapping(ports []k8s.Port) error {
+	return fmt.Errorf("iptables-restore failed")
+}
+
+func (failingRules) CleanPortMapping(ports []k8s.Port) error {
+	return nil
+}
+
+// #lizard forgives
+func TestAsyncPortMappingFailureKeepsPodRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-portmapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	k8s.SetPortStore(store.NewFileStore(filepath.Join(dir, "port")))
+	defer k8s.SetPortStore(store.NewFileStore(k8s.PortStateDir))
+	fake := iptablesTest.NewFakeIPTables()
+	g := &Galaxy{portMappingTasks: map[string]*portMappingTask{}, connLimit: connlimit.New(filepath.Join(dir, "cl")),
+		mssClamp: mtu.New(filepath.Join(dir, "mss")), ndGuard: ndguard.New(filepath.Join(dir, "nd"))}
+	g.connLimit.Interface, g.mssClamp.Interface = fake, fake
+	g.pmhandler = portmapping.New("", 0)
+	g.pmhandler.Interface = fake
+	g.portRules = failingRules{}
+	if err := g.connLimit.Setup("c1", "uid1", "10.0.0.2", &connlimit.Limit{MaxConnections: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.mssClamp.Setup("c1", "uid1", "10.0.0.2", &mtu.Override{MTU: 1400, ClampMSS: true}); err != nil {
+		t.Fatal(err)
+	}
+	save := func() string {
+		buf := bytes.NewBuffer(nil)
+		for _, table := range []utiliptables.Table{utiliptables.TableFilter, utiliptables.TableMangle} {
+			if err := fake.SaveInto(table, buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return buf.String()
+	}
+	expect := save()
+	// hostport 0 asks the kernel for an unused port
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default",
+		Annotations: map[string]string{k8s.PortMappingPortsAnnotation: ""}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Ports: []corev1.ContainerPort{
+			{ContainerPort: 80, Protocol: corev1.ProtocolTCP}}}}}}
+	req := &galaxyapi.PodRequest{PodName: "pod1", PodNamespace: "default", CmdArgs: &skel.CmdArgs{ContainerID: "c1"}}
+	result := &t020.Result{IP4: &t020.IPConfig{IP: net.IPNet{IP: net.ParseIP("10.0.0.2"),
+		Mask: net.CIDRMask(24, 32)}}}
+	g.asyncSetupPortMapping(req, result, pod, nil, nil)
+	g.waitPortMapping("c1")
+	if err := g.portMappingErr("c1"); err == nil {
+		t.Fatal("expect port mapping failed")
+	}
+	if real := save(); real != expect {
+		t.Fatalf("expect rules of the pod kept after port mapping failed: %s, real: %s", expect, real)
+	}
+	// DEL removes them
+	if err := g.cleanupPodRules("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if real := save(); real == expect {
+		t.Fatalf("expect rules of the pod removed, real: %s", real)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/galaxy/private"
+	"tkestack.io/galaxy/pkg/utils/peercred"
+)
+
+// loadSocketToken reads the shared token requests to the galaxy socket must carry
+func (g *Galaxy) loadSocketToken() error {
+	if g.SocketTokenFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(g.SocketTokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read socket token: %v", err)
+	}
+	g.socketToken = strings.TrimSpace(string(data))
+	if g.socketToken == "" {
+		return fmt.Errorf("socket token file %s is empty", g.SocketTokenFile)
+	}
+	return nil
+}
+
+// socketListener restricts peers of l to the allowed uids and binaries, it identifies peers for the access log even
+// if any peer is allowed
+func (g *Galaxy) socketListener(l net.Listener) net.Listener {
+	policy := &peercred.Policy{Binaries: g.SocketAllowedBinaries}
+	for _, uid := range g.SocketAllowedUIDs {
+		policy.UIDs = append(policy.UIDs, uint32(uid))
+	}
+	return peercred.NewListener(l, policy)
+}
+
+// accessLog logs each request with the process which sent it. Requests polled periodically, e.g. metrics scrapes, are
+// logged at V(4).
+func (g *Galaxy) accessLog(r *restful.Request, w *restful.Response, chain *restful.FilterChain) {
+	start := time.Now()
+	chain.ProcessFilter(r, w)
+	peer := "unknown peer"
+	if cred := peercred.FromContext(r.Request.Context()); cred != nil {
+		peer = cred.String()
+	}
+	path := r.Request.URL.Path
+	if r.Request.Method == http.MethodGet && (path == "/metrics" || path == "/readyz") {
+		glog.V(4).Infof("access %s %s from %s: %d, %v", r.Request.Method, path, peer, w.StatusCode(),
+			time.Since(start))
+		return
+	}
+	glog.Infof("access %s %s from %s: %d, %v", r.Request.Method, r.Request.URL.RequestURI(), peer, w.StatusCode(),
+		time.Since(start))
+}
+
+// authenticate rejects requests without the socket token
+func (g *Galaxy) authenticate(r *restful.Request, w *restful.Response, chain *restful.FilterChain) {
+	token := r.HeaderParameter(private.GalaxyTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(g.socketToken)) != 1 {
+		glog.Warningf("rejected %s %s: bad token", r.Request.Method, r.Request.URL.Path)
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return
+	}
+	chain.ProcessFilter(r, w)
+}
@@ -0,0 +1,56 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	glog "k8s.io/klog"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/network/tc"
+)
+
+// shapeBandwidth limits bandwidth of the interface of the pod by its bandwidth annotations whatever network it is
+// on. Like the mtu annotation it fails the request, limits are often what the pod is admitted on.
+func shapeBandwidth(req *galaxyapi.PodRequest, pod *corev1.Pod) error {
+	l, err := tc.ParseLimits(pod.Annotations[k8s.IngressBandwidthAnnotation],
+		pod.Annotations[k8s.EgressBandwidthAnnotation])
+	if err != nil {
+		return fmt.Errorf("bad bandwidth annotations: %v", err)
+	}
+	if l == nil {
+		return nil
+	}
+	if err := tc.Shape(req.Netns, req.IfName, l); err != nil {
+		return err
+	}
+	glog.V(4).Infof("shaped bandwidth of pod %s to %+v", k8s.GetPodFullName(pod.Name, pod.Namespace), *l)
+	return nil
+}
+
+// unshapeBandwidth removes bandwidth limits of the interface of the container before plugins delete it, the ifb
+// device would stay in the netns of the pod otherwise until the netns is gone
+func unshapeBandwidth(req *galaxyapi.PodRequest) {
+	if req.Netns == "" {
+		return
+	}
+	if err := tc.Unshape(req.Netns, req.IfName); err != nil {
+		glog.Warningf("failed to remove bandwidth limits of %s: %v", req.ContainerID, err)
+	}
+}
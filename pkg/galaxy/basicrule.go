@@ -0,0 +1,77 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/metrics"
+)
+
+const (
+	// basicRuleAlertFailures is the number of consecutive failures of ensuring basic rules after which galaxy records
+	// a warning event of the node, and again every this number of failures as long as they persist
+	basicRuleAlertFailures = 5
+	basicRuleFailingReason = "BasicRuleFailing"
+)
+
+var basicRuleFailures = metrics.NewGaugeVec("galaxy_basic_rule_consecutive_failures", "Number of consecutive "+
+	"failures of periodically ensuring basic iptables rules", "rules")
+
+// basicRuleEnsurer ensures basic rules periodically and alerts if it keeps failing, so that broken rules, e.g.
+// deleted by other programs, don't go unnoticed behind warning logs
+type basicRuleEnsurer struct {
+	// name of rules in logs, metrics and events
+	name     string
+	ensure   func() error
+	alert    func(failures int, err error)
+	failures int
+}
+
+func (g *Galaxy) newBasicRuleEnsurer(name string, ensure func() error) *basicRuleEnsurer {
+	return &basicRuleEnsurer{name: name, ensure: ensure, alert: func(failures int, err error) {
+		if g.recorder == nil {
+			return
+		}
+		hostname := k8s.GetHostname()
+		g.recorder.Eventf(&corev1.ObjectReference{Kind: "Node", Name: hostname, UID: types.UID(hostname)},
+			corev1.EventTypeWarning, basicRuleFailingReason, "failed to ensure %s rules %d times in a row: %v",
+			name, failures, err)
+	}}
+}
+
+// run ensures rules once, the error tells the number of consecutive failures
+func (e *basicRuleEnsurer) run() error {
+	if err := e.ensure(); err != nil {
+		e.failures++
+		basicRuleFailures.WithLabelValues(e.name).Set(float64(e.failures))
+		if e.failures%basicRuleAlertFailures == 0 {
+			e.alert(e.failures, err)
+		}
+		return fmt.Errorf("%v, %d consecutive failures", err, e.failures)
+	}
+	if e.failures >= basicRuleAlertFailures {
+		glog.Infof("ensured %s rules after %d consecutive failures", e.name, e.failures)
+	}
+	e.failures = 0
+	basicRuleFailures.WithLabelValues(e.name).Set(0)
+	return nil
+}
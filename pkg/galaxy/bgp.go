@@ -0,0 +1,97 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/metrics"
+	"tkestack.io/galaxy/pkg/network/bgp"
+)
+
+// bgpAdvertiseInterval is the interval of advertising routes if no pod is added or deleted in between
+const bgpAdvertiseInterval = 30 * time.Second
+
+var bgpAdvertisedRoutes = metrics.NewGaugeVec("galaxy_bgp_advertised_routes", "Number of prefixes the bgp speaker "+
+	"advertises to peers")
+
+// setupBGP starts the bgp speaker if BGP is set, and advertises routes of pods periodically and once pods are added
+// or deleted
+func (g *Galaxy) setupBGP() error {
+	if g.BGP == nil {
+		return nil
+	}
+	speaker, err := bgp.New(g.BGP)
+	if err != nil {
+		return fmt.Errorf("bad bgp config: %v", err)
+	}
+	ips, err := interfaceIPs(g.BGP.Interface)
+	if err != nil {
+		return err
+	}
+	routerID := net.ParseIP(strings.Split(ips, ",")[0])
+	if routerID.To4() == nil {
+		return fmt.Errorf("%s has no ipv4 address of the router id", g.BGP.Interface)
+	}
+	if err := speaker.Start(routerID); err != nil {
+		return err
+	}
+	g.bgpSpeaker = speaker
+	g.bgpTrigger = make(chan struct{}, 1)
+	go func() {
+		defer speaker.Stop()
+		for {
+			g.advertiseRoutes()
+			select {
+			case <-g.quitChan:
+				return
+			case <-g.bgpTrigger:
+			case <-time.After(bgpAdvertiseInterval):
+			}
+		}
+	}()
+	return nil
+}
+
+func (g *Galaxy) advertiseRoutes() {
+	var prefixes []*net.IPNet
+	if g.BGP.PodRoutes {
+		for _, ip := range g.purePodIPs() {
+			prefixes = append(prefixes, &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)})
+		}
+	}
+	n, err := g.bgpSpeaker.Advertise(prefixes)
+	if err != nil {
+		glog.Warningf("failed to advertise routes: %v", err)
+	}
+	bgpAdvertisedRoutes.WithLabelValues().Set(float64(n))
+}
+
+// triggerAdvertiseRoutes advertises routes of pods without waiting for the next interval, e.g. after adding a pod
+func (g *Galaxy) triggerAdvertiseRoutes() {
+	if g.bgpSpeaker == nil || !g.BGP.PodRoutes {
+		return
+	}
+	select {
+	case g.bgpTrigger <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/apimachinery/pkg/util/wait"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/metrics"
+	"tkestack.io/galaxy/pkg/network/vlan"
+)
+
+const bridgeStatsInterval = 30 * time.Second
+
+var (
+	bridgePortCount = metrics.NewGaugeVec("galaxy_bridge_ports", "Number of ports attached to vlan bridges",
+		"bridge")
+	bridgeFDBEntries = metrics.NewGaugeVec("galaxy_bridge_fdb_entries", "Number of mac addresses in forwarding "+
+		"databases of vlan bridges", "bridge")
+	bridgeMulticastPPS = metrics.NewGaugeVec("galaxy_bridge_multicast_pps", "Multicast packets per second "+
+		"received by ports of vlan bridges in the last interval", "bridge")
+)
+
+// bridgeCounter is the multicast counter of a bridge read at some time
+type bridgeCounter struct {
+	multicast uint64
+	at        time.Time
+}
+
+// vlanNetConfs returns drivers of vlan networks
+func (g *Galaxy) vlanNetConfs() []*vlan.VlanDriver {
+	var drivers []*vlan.VlanDriver
+	for name, conf := range g.networkConfs() {
+		if conf["type"] != "galaxy-k8s-vlan" {
+			continue
+		}
+		data, err := json.Marshal(conf)
+		if err != nil {
+			continue
+		}
+		d := &vlan.VlanDriver{}
+		if _, err := d.LoadConf(data); err != nil {
+			glog.Warningf("bad vlan network %s: %v", name, err)
+			continue
+		}
+		drivers = append(drivers, d)
+	}
+	return drivers
+}
+
+// vlanBridgeConfs returns confs of vlan networks which attach pods to bridges
+func (g *Galaxy) vlanBridgeConfs() []*vlan.NetConf {
+	var confs []*vlan.NetConf
+	for _, d := range g.vlanNetConfs() {
+		if d.MacVlanMode() || d.IPVlanMode() || d.PureMode() || d.SRIOVMode() {
+			continue
+		}
+		confs = append(confs, d.NetConf)
+	}
+	return confs
+}
+
+// startBridgeStats exports statistics of broadcast domains of vlan bridges periodically, so that vlans
+// approaching mac table or broadcast limits of switches are spotted before outages
+func (g *Galaxy) startBridgeStats() {
+	confs := g.vlanBridgeConfs()
+	if len(confs) == 0 {
+		return
+	}
+	last := map[string]bridgeCounter{}
+	go wait.Until(func() {
+		g.collectBridgeStats(confs, last)
+	}, bridgeStatsInterval, g.quitChan)
+}
+
+func (g *Galaxy) collectBridgeStats(confs []*vlan.NetConf, last map[string]bridgeCounter) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		glog.Warningf("failed to list links: %v", err)
+		return
+	}
+	seen := map[string]bool{}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if link.Type() != "bridge" || !isVlanBridge(confs, name) {
+			continue
+		}
+		stats, err := vlan.ReadBridgeStats(name)
+		if err != nil {
+			glog.Warningf("failed to read statistics of bridge %s: %v", name, err)
+			continue
+		}
+		seen[name] = true
+		now := time.Now()
+		bridgePortCount.WithLabelValues(name).Set(float64(stats.Ports))
+		bridgeFDBEntries.WithLabelValues(name).Set(float64(stats.FDBEntries))
+		// ports come and go, the sum of their counters may decrease
+		if prev, ok := last[name]; ok && stats.RxMulticast >= prev.multicast && now.After(prev.at) {
+			bridgeMulticastPPS.WithLabelValues(name).Set(float64(stats.RxMulticast-prev.multicast) /
+				now.Sub(prev.at).Seconds())
+		}
+		last[name] = bridgeCounter{multicast: stats.RxMulticast, at: now}
+	}
+	for name := range last {
+		if !seen[name] {
+			delete(last, name)
+			bridgePortCount.DeleteLabelValues(name)
+			bridgeFDBEntries.DeleteLabelValues(name)
+			bridgeMulticastPPS.DeleteLabelValues(name)
+		}
+	}
+}
+
+func isVlanBridge(confs []*vlan.NetConf, name string) bool {
+	for _, conf := range confs {
+		if conf.IsBridgeName(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"fmt"
+	"strings"
+
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/galaxy/options"
+	"tkestack.io/galaxy/pkg/utils/capability"
+)
+
+// capabilityRequirement is a capability galaxy needs and what for
+type capabilityRequirement struct {
+	cap   capability.Cap
+	usage string
+	// optional capabilities are only needed in some setups, galaxy starts without them
+	optional bool
+}
+
+// requiredCapabilities returns capabilities the options of galaxy need. Galaxy doesn't need full root: it never loads
+// kernel modules and only writes sysctls which are writable, so that it runs with these capabilities and a read only
+// /proc/sys if the host sets sysctls in advance.
+func (g *Galaxy) requiredCapabilities() []capabilityRequirement {
+	reqs := []capabilityRequirement{
+		{cap: capability.NetAdmin, usage: "configure links, addresses, routes and iptables rules"},
+		{cap: capability.NetRaw, usage: "send gratuitous arp and run iptables"},
+		{cap: capability.SysAdmin, usage: "enter network namespaces of pods"},
+		{cap: capability.SysPtrace, usage: "open network namespaces of pods by /proc/<pid>/ns/net if containers " +
+			"run as other users", optional: true},
+	}
+	if g.IPv6Mode == options.IPv6Harden {
+		reqs[0].usage += " and ebtables rules"
+	}
+	return reqs
+}
+
+// checkCapabilities returns an error listing required capabilities galaxy lacks. It remembers missing optional ones to
+// explain permission errors of requests.
+func (g *Galaxy) checkCapabilities() error {
+	effective, err := capability.Effective()
+	if err != nil {
+		// don't block starting on kernels without CapEff
+		glog.Warningf("failed to read capabilities: %v", err)
+		return nil
+	}
+	var missing []string
+	for _, r := range g.requiredCapabilities() {
+		if effective.Has(r.cap) {
+			continue
+		}
+		if r.optional {
+			glog.Warningf("galaxy runs without %s which is required to %s", r.cap, r.usage)
+			g.missingCapabilities = append(g.missingCapabilities, r.cap)
+			continue
+		}
+		missing = append(missing, fmt.Sprintf("%s to %s", r.cap, r.usage))
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("galaxy lacks capabilities: %s. Add them to securityContext.capabilities.add of galaxy "+
+		"container or run it privileged", strings.Join(missing, "; "))
+}
+
+// explainPermissionError tells which missing optional capability may cause a permission error of a request
+func (g *Galaxy) explainPermissionError(err error) error {
+	if err == nil || len(g.missingCapabilities) == 0 {
+		return err
+	}
+	msg := err.Error()
+	// errors of netlink and netns are often formatted rather than wrapped, match their messages
+	if !strings.Contains(msg, "operation not permitted") && !strings.Contains(msg, "permission denied") {
+		return err
+	}
+	return fmt.Errorf("%v, galaxy runs without %v which may be required", err, g.missingCapabilities)
+}
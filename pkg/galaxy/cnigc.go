@@ -0,0 +1,130 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/api/k8s"
+)
+
+// serveGC serves a GC request. Unlike other requests, GC isn't of a container and has no result.
+func (g *Galaxy) serveGC(w *restful.Response, req *galaxyapi.GCRequest) {
+	if err := g.cniGC(req); err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// cniGC deletes networks and host side state of containers galaxy knows but the runtime doesn't, as if DEL requests
+// of them came. Galaxy keeps state per container, so ifnames of valid attachments don't matter. Containers being
+// added are never collected since the runtime may list attachments before their ADDs complete, and nor are debug
+// attachments which aren't of the runtime.
+func (g *Galaxy) cniGC(req *galaxyapi.GCRequest) (err error) {
+	start := time.Now()
+	defer func() {
+		cniRequests.WithLabelValues(cniutil.COMMAND_GC, resultLabel(err)).Inc()
+		cniRequestDuration.WithLabelValues(cniutil.COMMAND_GC).Observe(time.Since(start).Seconds())
+	}()
+	valid := map[string]bool{}
+	for _, a := range req.ValidAttachments {
+		valid[a.ContainerID] = true
+	}
+	orphans, err := g.gcOrphans(valid)
+	if err != nil {
+		return err
+	}
+	glog.Infof("GC of %d valid attachments, deleting %d orphan containers %v", len(req.ValidAttachments),
+		len(orphans), orphans)
+	var failed []string
+	for _, containerID := range orphans {
+		args, podName, podNamespace := g.delArgs(containerID)
+		del := &galaxyapi.PodRequest{Command: cniutil.COMMAND_DEL, PodName: podName, PodNamespace: podNamespace,
+			CmdArgs: &args}
+		// cmdDel defers whatever fails to be released, the next GC won't find it again
+		if err := g.cmdDel(del); err != nil {
+			glog.Warningf("GC: failed to delete %v: %v", del, err)
+			failed = append(failed, containerID)
+		}
+	}
+	if len(orphans) > 0 {
+		g.triggerAdvertiseRoutes()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to delete %s, retrying in background", strings.Join(failed, ","))
+	}
+	return nil
+}
+
+// gcOrphans returns ids of containers having any state galaxy keeps but not in valid
+func (g *Galaxy) gcOrphans(valid map[string]bool) ([]string, error) {
+	known := map[string]bool{}
+	for _, list := range []struct {
+		name string
+		keys func() ([]string, error)
+	}{
+		{name: "network infos", keys: cniutil.NetworkInfoContainers},
+		{name: "cached results", keys: g.results.Keys},
+		{name: "owners", keys: g.owners.Keys},
+		{name: "effective configs", keys: g.effectiveConfigs.Keys},
+		{name: "port files", keys: k8s.PortFileContainers},
+	} {
+		ids, err := list.keys()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %v", list.name, err)
+		}
+		for _, id := range ids {
+			known[id] = true
+		}
+	}
+	g.addLock.Lock()
+	defer g.addLock.Unlock()
+	var orphans []string
+	for id := range known {
+		if valid[id] || g.addsInFlight[id] > 0 || strings.HasPrefix(id, constant.DebugContainerIDPrefix) {
+			continue
+		}
+		orphans = append(orphans, id)
+	}
+	sort.Strings(orphans)
+	return orphans, nil
+}
+
+// beginAdd marks an ADD request of containerID in flight, call endAdd once it's served
+func (g *Galaxy) beginAdd(containerID string) {
+	g.addLock.Lock()
+	defer g.addLock.Unlock()
+	g.addsInFlight[containerID]++
+}
+
+func (g *Galaxy) endAdd(containerID string) {
+	g.addLock.Lock()
+	defer g.addLock.Unlock()
+	if g.addsInFlight[containerID]--; g.addsInFlight[containerID] <= 0 {
+		delete(g.addsInFlight, containerID)
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"fmt"
+
+	t020 "github.com/containernetworking/cni/pkg/types/020"
+	corev1 "k8s.io/api/core/v1"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/network/connlimit"
+)
+
+// connLimitDir stores pod ips and connection limits of containers to clean up their rules, gc cleans up files of
+// dead containers
+const connLimitDir = "/var/lib/cni/galaxy/connlimit"
+
+// setupConnLimit applies the connection limit annotation of the pod. Unlike queue tuning it fails the request, a pod
+// left unlimited is what the annotation protects against.
+func (g *Galaxy) setupConnLimit(req *galaxyapi.PodRequest, pod *corev1.Pod, result *t020.Result) error {
+	v := pod.Annotations[k8s.ConnectionLimitAnnotation]
+	if v == "" {
+		return nil
+	}
+	limit, err := connlimit.ParseLimit(v)
+	if err != nil {
+		return fmt.Errorf("bad %s annotation: %v", k8s.ConnectionLimitAnnotation, err)
+	}
+	if result.IP4 == nil {
+		return fmt.Errorf("no ipv4 address to limit connections of")
+	}
+	if err := g.connLimit.Setup(req.ContainerID, string(pod.UID), result.IP4.IP.IP.String(), limit); err != nil {
+		if err1 := g.connLimit.Cleanup(req.ContainerID); err1 != nil {
+			return fmt.Errorf("%v, and failed to clean up: %v", err, err1)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"net"
+	"os"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/metrics"
+	"tkestack.io/galaxy/pkg/network/kernel"
+)
+
+const (
+	conntrackStatsInterval = 15 * time.Second
+	// conntrackAlertInterval is the min interval of events of a conntrack table staying full
+	conntrackAlertInterval = 10 * time.Minute
+	conntrackFullReason    = "ConntrackTableFull"
+)
+
+var (
+	conntrackEntries = metrics.NewGaugeVec("galaxy_conntrack_entries", "Number of entries of the conntrack table")
+	conntrackMax     = metrics.NewGaugeVec("galaxy_conntrack_max", "Size of the conntrack table, i.e. "+
+		"nf_conntrack_max")
+	conntrackUtilization = metrics.NewGaugeVec("galaxy_conntrack_utilization", "Ratio of entries to the size of "+
+		"the conntrack table")
+	conntrackDrops = metrics.NewCounterVec("galaxy_conntrack_drops_total", "Number of connections affected by a "+
+		"full conntrack table by reason, drop for new connections dropped, early_drop for entries evicted and "+
+		"insert_failed for entries failed to be inserted", "reason")
+)
+
+// conntrackMonitor exports usage of the conntrack table and alerts once it is nearly full
+type conntrackMonitor struct {
+	ct *kernel.Conntrack
+	// last are the kernel counters of the last read
+	last *kernel.ConntrackStats
+	// alertedAt is when the last event is recorded, zero if the table is not full since then
+	alertedAt time.Time
+}
+
+// setupConntrack raises nf_conntrack_max according to the memory of the node and monitors the table periodically.
+// Nodes of many hostport or NATed connections exhaust default sized tables, after which the kernel silently drops
+// new connections. Locked down hosts may size the table in advance, failing to raise it is not fatal.
+func (g *Galaxy) setupConntrack() {
+	ct := kernel.NewConntrack()
+	if g.ConntrackMaxPerGB > 0 {
+		if mem, err := ct.MemTotal(); err != nil {
+			glog.Warningf("failed to read memory of the node: %v", err)
+		} else if max, err := ct.EnsureMax(kernel.ConntrackMax(mem, g.ConntrackMaxPerGB, g.ConntrackMin)); err != nil {
+			glog.Warningf("failed to size the conntrack table: %v", err)
+		} else {
+			glog.Infof("nf_conntrack_max is %d", max)
+		}
+	}
+	m := &conntrackMonitor{ct: ct}
+	go wait.Until(func() {
+		g.collectConntrackStats(m)
+	}, conntrackStatsInterval, g.quitChan)
+}
+
+func (g *Galaxy) collectConntrackStats(m *conntrackMonitor) {
+	// nf_conntrack is loaded on demand by the first conntrack rule, the table doesn't exist till then
+	stats, err := m.ct.Stats()
+	if err != nil {
+		glog.V(4).Infof("failed to read conntrack stats: %v", err)
+		return
+	}
+	conntrackEntries.WithLabelValues().Set(float64(stats.Entries))
+	conntrackMax.WithLabelValues().Set(float64(stats.Max))
+	var utilization float64
+	if stats.Max > 0 {
+		utilization = float64(stats.Entries) / float64(stats.Max)
+	}
+	conntrackUtilization.WithLabelValues().Set(utilization)
+	var last kernel.ConntrackStats
+	if m.last != nil {
+		last = *m.last
+	}
+	for _, c := range []struct {
+		reason    string
+		cur, prev uint64
+	}{{"drop", stats.Drops, last.Drops}, {"early_drop", stats.EarlyDrops, last.EarlyDrops},
+		{"insert_failed", stats.InsertFailed, last.InsertFailed}} {
+		// per cpu counters of offline cpus are gone from the sum
+		if c.cur >= c.prev {
+			conntrackDrops.WithLabelValues(c.reason).Add(float64(c.cur - c.prev))
+		}
+	}
+	dropped := m.last != nil && stats.Drops > last.Drops
+	m.last = stats
+	if g.ConntrackAlertRatio == 0 || (utilization < g.ConntrackAlertRatio && !dropped) {
+		m.alertedAt = time.Time{}
+		return
+	}
+	if time.Since(m.alertedAt) < conntrackAlertInterval {
+		return
+	}
+	m.alertedAt = time.Now()
+	glog.Warningf("conntrack table has %d of %d entries, %d new connections dropped since boot", stats.Entries,
+		stats.Max, stats.Drops)
+	g.recordNodeEvent(corev1.EventTypeWarning, conntrackFullReason, "conntrack table has %d of %d entries, "+
+		"%d new connections dropped since boot, raise --conntrack-max-per-gb", stats.Entries, stats.Max, stats.Drops)
+}
+
+// conntrackPorts returns host ports of the container
+func conntrackPorts(containerID string) []kernel.ConntrackPort {
+	ports, err := k8s.ConsumePort(containerID)
+	if err != nil && !os.IsNotExist(err) {
+		glog.Warningf("failed to read ports of %s: %v", containerID, err)
+	}
+	var ret []kernel.ConntrackPort
+	for _, port := range ports {
+		if port.HostPort <= 0 {
+			continue
+		}
+		ret = append(ret, kernel.ConntrackPort{Protocol: port.Protocol, Port: uint16(port.HostPort),
+			IP: net.ParseIP(port.HostIP)})
+	}
+	return ret
+}
+
+// flushConntrack deletes conntrack entries of ips and host ports of the container, so that the next pod getting the
+// ip or the host ports is not blackholed by entries directing packets to the deleted pod. Entries expire anyway,
+// failing to delete them doesn't fail the cleanup.
+func flushConntrack(containerID string, ips []net.IP, ports []kernel.ConntrackPort) {
+	n, err := kernel.FlushConntrack(ips, ports)
+	if err != nil {
+		glog.Warningf("failed to flush conntrack entries of %s: %v", containerID, err)
+		return
+	}
+	if n > 0 {
+		glog.V(4).Infof("flushed %d conntrack entries of %s ips %v", n, containerID, ips)
+	}
+}
@@ -0,0 +1,339 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/emicklei/go-restful"
+	"k8s.io/apimachinery/pkg/util/wait"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/utils/nets"
+)
+
+const (
+	// debugAttachmentDir stores debug attachments keyed by their ids to release them after restarts
+	debugAttachmentDir = "/var/lib/cni/galaxy/debug"
+	defaultDebugTTL    = 10 * time.Minute
+	maxDebugTTL        = time.Hour
+	netnsDir           = "/var/run/netns"
+)
+
+// DebugAttachmentRequest is the request to attach a debug netns to a network
+type DebugAttachmentRequest struct {
+	// Network is the name of the network to attach to
+	Network string `json:"network"`
+	// IP is the temporary ip of the attachment. If nil, the ipam of the network config allocates one
+	IP      *nets.IPNet `json:"ip,omitempty"`
+	Gateway net.IP      `json:"gateway,omitempty"`
+	Vlan    uint16      `json:"vlan,omitempty"`
+	// TTL is how long the attachment lives, e.g. 10m, it defaults to 10 minutes and is at most 1 hour
+	TTL string `json:"ttl,omitempty"`
+}
+
+// DebugAttachment is a netns attached to a network for connectivity tests, it is released after expiring
+type DebugAttachment struct {
+	ID      string `json:"id"`
+	Network string `json:"network"`
+	// Netns is the name of the netns for `ip netns exec`
+	Netns   string          `json:"netns"`
+	Expires time.Time       `json:"expires"`
+	IfName  string          `json:"ifName"`
+	Result  json.RawMessage `json:"result,omitempty"`
+}
+
+// createDebugAttachment attaches a new netns to a network as if it was a pod
+func (g *Galaxy) createDebugAttachment(r *restful.Request, w *restful.Response) {
+	var req DebugAttachmentRequest
+	if err := r.ReadEntity(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+		return
+	}
+	attachment, err := g.attachDebug(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", g.explainPermissionError(err)), http.StatusInternalServerError)
+		return
+	}
+	glog.Infof("attached debug netns %s to network %s until %s", attachment.Netns, attachment.Network,
+		attachment.Expires.Format(time.RFC3339))
+	writeDebugResponse(w, attachment)
+}
+
+func (g *Galaxy) listDebugAttachments(r *restful.Request, w *restful.Response) {
+	attachments, err := g.debugAttachmentList()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	writeDebugResponse(w, attachments)
+}
+
+func (g *Galaxy) deleteDebugAttachment(r *restful.Request, w *restful.Response) {
+	id := r.PathParameter("id")
+	if !strings.HasPrefix(id, constant.DebugContainerIDPrefix) {
+		http.Error(w, fmt.Sprintf("bad debug attachment id %s", id), http.StatusBadRequest)
+		return
+	}
+	g.debugLock.Lock()
+	defer g.debugLock.Unlock()
+	attachment, err := g.getDebugAttachment(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, fmt.Sprintf("no debug attachment %s", id), http.StatusNotFound)
+		} else {
+			http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := g.detachDebug(attachment); err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+	}
+}
+
+func writeDebugResponse(w *restful.Response, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		glog.Warningf("Error writing debug attachment HTTP response: %v", err)
+	}
+}
+
+func (req *DebugAttachmentRequest) ttl() (time.Duration, error) {
+	if req.TTL == "" {
+		return defaultDebugTTL, nil
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil {
+		return 0, fmt.Errorf("bad ttl %s: %v", req.TTL, err)
+	}
+	if ttl <= 0 || ttl > maxDebugTTL {
+		return 0, fmt.Errorf("ttl %s is not in (0, %v]", req.TTL, maxDebugTTL)
+	}
+	return ttl, nil
+}
+
+// #lizard forgives
+func (g *Galaxy) attachDebug(req *DebugAttachmentRequest) (*DebugAttachment, error) {
+	ttl, err := req.ttl()
+	if err != nil {
+		return nil, err
+	}
+	conf := g.getNetworkConf(req.Network)
+	if conf == nil {
+		return nil, fmt.Errorf("unknown network %s", req.Network)
+	}
+	networkInfo := cniutil.NewNetworkInfo(req.Network, conf, "eth0")
+	if req.IP != nil {
+		ipInfos, err := json.Marshal([]constant.IPInfo{{IP: req.IP, Vlan: req.Vlan, Gateway: req.Gateway}})
+		if err != nil {
+			return nil, err
+		}
+		networkInfo.Args[constant.IPInfosKey] = string(ipInfos)
+	}
+	g.debugLock.Lock()
+	defer g.debugLock.Unlock()
+	id, err := g.newDebugID()
+	if err != nil {
+		return nil, err
+	}
+	attachment := &DebugAttachment{ID: id, Network: req.Network, Netns: "galaxy-" + id,
+		Expires: time.Now().Add(ttl), IfName: networkInfo.IfName}
+	// record the attachment before creating anything so that it is released even if galaxy crashes in the middle
+	if err := g.saveDebugAttachment(attachment); err != nil {
+		return nil, err
+	}
+	if out, err := exec.Command("ip", "netns", "add", attachment.Netns).CombinedOutput(); err != nil {
+		g.releaseDebug(attachment)
+		return nil, fmt.Errorf("failed to add netns %s: %v, %s", attachment.Netns, err, string(out))
+	}
+	args := g.debugCmdArgs(attachment)
+	result, err := cniutil.CmdAdd(args, []*cniutil.NetworkInfo{networkInfo})
+	if err != nil {
+		g.releaseDebug(attachment)
+		return nil, err
+	}
+	if attachment.Result, err = json.Marshal(result); err != nil {
+		g.releaseDebug(attachment)
+		return nil, err
+	}
+	if err := g.saveDebugAttachment(attachment); err != nil {
+		glog.Warningf("failed to save result of debug attachment %s: %v", id, err)
+	}
+	return attachment, nil
+}
+
+// newDebugID returns an id whose first 9 chars, which name host side links, are not used by existing attachments
+func (g *Galaxy) newDebugID() (string, error) {
+	ids, err := g.debugAttachments.Keys()
+	if err != nil {
+		return "", err
+	}
+	for {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		id := constant.DebugContainerIDPrefix + hex.EncodeToString(b)
+		taken := false
+		for _, existing := range ids {
+			if len(existing) >= 9 && existing[:9] == id[:9] {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			return id, nil
+		}
+	}
+}
+
+func (g *Galaxy) debugCmdArgs(attachment *DebugAttachment) *skel.CmdArgs {
+	return &skel.CmdArgs{
+		ContainerID: attachment.ID,
+		Netns:       filepath.Join(netnsDir, attachment.Netns),
+		IfName:      attachment.IfName,
+		Args:        cniutil.BuildCNIArgs(map[string]string{"IgnoreUnknown": "true"}),
+		Path:        strings.Join(append([]string{defaultCNIPath}, g.CNIPaths...), ":"),
+	}
+}
+
+func (g *Galaxy) saveDebugAttachment(attachment *DebugAttachment) error {
+	data, err := json.Marshal(attachment)
+	if err != nil {
+		return err
+	}
+	return g.debugAttachments.Put(attachment.ID, data)
+}
+
+// releaseDebug detaches an attachment which failed to be created, the attachment is retried by the reaper if it
+// fails
+func (g *Galaxy) releaseDebug(attachment *DebugAttachment) {
+	if err := g.detachDebug(attachment); err != nil {
+		glog.Warningf("failed to release debug attachment %s: %v", attachment.ID, err)
+	}
+}
+
+func (g *Galaxy) getDebugAttachment(id string) (*DebugAttachment, error) {
+	data, err := g.debugAttachments.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	var attachment DebugAttachment
+	if err := json.Unmarshal(data, &attachment); err != nil {
+		glog.Warningf("bad debug attachment %s: %v", string(data), err)
+		return orphanDebugAttachment(id), nil
+	}
+	return &attachment, nil
+}
+
+// orphanDebugAttachment returns the attachment of which only the id is known
+func orphanDebugAttachment(id string) *DebugAttachment {
+	return &DebugAttachment{ID: id, Netns: "galaxy-" + id, IfName: "eth0"}
+}
+
+// detachDebug deletes networks and the netns of the attachment. It must be called with debugLock held.
+func (g *Galaxy) detachDebug(attachment *DebugAttachment) error {
+	if err := cniutil.CmdDel(g.debugCmdArgs(attachment), -1); err != nil {
+		return fmt.Errorf("failed to delete networks: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(netnsDir, attachment.Netns)); err == nil {
+		if out, err := exec.Command("ip", "netns", "del", attachment.Netns).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to delete netns %s: %v, %s", attachment.Netns, err, string(out))
+		}
+	}
+	if err := g.debugAttachments.Delete(attachment.ID); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	glog.Infof("released debug attachment %s", attachment.ID)
+	return nil
+}
+
+func (g *Galaxy) debugAttachmentList() ([]*DebugAttachment, error) {
+	ids, err := g.debugAttachments.Keys()
+	if err != nil {
+		return nil, err
+	}
+	attachments := []*DebugAttachment{}
+	for _, id := range ids {
+		data, err := g.debugAttachments.Get(id)
+		if err != nil {
+			continue
+		}
+		var attachment DebugAttachment
+		if err := json.Unmarshal(data, &attachment); err != nil {
+			glog.Warningf("bad debug attachment %s: %v", string(data), err)
+			continue
+		}
+		attachments = append(attachments, &attachment)
+	}
+	return attachments, nil
+}
+
+// startDebugReaper releases expired debug attachments periodically, including those of previous galaxy processes.
+// GC skips debug attachments as docker knows nothing about them, so the reaper also deletes networks saved for
+// debug ids that have no attachment, e.g. galaxy crashed right after saving them.
+func (g *Galaxy) startDebugReaper() {
+	go wait.Until(func() {
+		g.debugLock.Lock()
+		defer g.debugLock.Unlock()
+		attachments, err := g.debugAttachmentList()
+		if err != nil {
+			glog.Warningf("failed to list debug attachments: %v", err)
+			return
+		}
+		known := map[string]bool{}
+		for _, attachment := range attachments {
+			known[attachment.ID] = true
+			if time.Now().Before(attachment.Expires) {
+				continue
+			}
+			if err := g.detachDebug(attachment); err != nil {
+				glog.Warningf("failed to release expired debug attachment %s: %v", attachment.ID, err)
+			}
+		}
+		containers, err := cniutil.NetworkInfoContainers()
+		if err != nil {
+			glog.Warningf("failed to list containers: %v", err)
+			return
+		}
+		for _, containerID := range containers {
+			if !strings.HasPrefix(containerID, constant.DebugContainerIDPrefix) || known[containerID] {
+				continue
+			}
+			if err := g.detachDebug(orphanDebugAttachment(containerID)); err != nil {
+				glog.Warningf("failed to release debug attachment %s: %v", containerID, err)
+			}
+		}
+	}, 10*time.Second, g.quitChan)
+}
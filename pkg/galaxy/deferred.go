@@ -0,0 +1,123 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/utils/queue"
+)
+
+const (
+	// deferredDir stores cleanup operations of failed DEL requests. It's a sub dir of the gc dir of network infos
+	// which gc skips.
+	deferredDir     = "/var/lib/cni/galaxy/retry"
+	deferredDelKind = "del"
+)
+
+// deferredDel holds whatever a failed DEL request left to be released. It owns the state of the container, i.e.
+// the saved network infos and ports are moved into it, so that gc won't drop them before they are released.
+type deferredDel struct {
+	CmdArgs      skel.CmdArgs
+	PodName      string
+	PodNamespace string
+	Networks     []*cniutil.NetworkInfo
+	Ports        []k8s.Port
+	// PodRules is true if rules of the container besides port mappings are left, see cleanupPodRules
+	PodRules bool
+}
+
+func (g *Galaxy) initDeferredQueue() {
+	g.deferred = queue.New(deferredDir, time.Second, 5*time.Minute)
+	g.deferred.RegisterHandler(deferredDelKind, g.handleDeferredDel)
+	g.deferred.Run(5*time.Second, g.quitChan)
+}
+
+// deferDel moves the remaining state of a failed DEL request into the retry queue. args are the cni args of the
+// request before they are modified by cniutil.CmdDel. podRules is true if the pod rules failed to be cleaned up.
+func (g *Galaxy) deferDel(req *galaxyapi.PodRequest, args skel.CmdArgs, podRules bool) error {
+	infos, err := cniutil.LoadNetworkInfo(req.ContainerID)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read network info: %v", err)
+	}
+	ports, err := k8s.ConsumePort(req.ContainerID)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read ports: %v", err)
+	}
+	if len(infos) == 0 && len(ports) == 0 && !podRules {
+		return nil
+	}
+	item := &deferredDel{CmdArgs: args, PodName: req.PodName, PodNamespace: req.PodNamespace, Networks: infos,
+		Ports: ports, PodRules: podRules}
+	if err := g.deferred.Add(deferredDelKind, req.ContainerID, item); err != nil {
+		return err
+	}
+	if err := cniutil.RemoveNetworkInfo(req.ContainerID); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("failed to remove network info of %s: %v", req.ContainerID, err)
+	}
+	if err := k8s.RemovePortFile(req.ContainerID); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("failed to remove port file of %s: %v", req.ContainerID, err)
+	}
+	glog.Infof("deferred cleanup of %s: %d networks, %d ports", req.ContainerID, len(infos), len(ports))
+	return nil
+}
+
+func (g *Galaxy) handleDeferredDel(item *queue.Item) error {
+	var del deferredDel
+	if err := json.Unmarshal(item.Data, &del); err != nil {
+		// never succeeds, drop it
+		glog.Errorf("bad deferred del %s: %v", item.ID, err)
+		return nil
+	}
+	save := func() {
+		item.Data, _ = json.Marshal(&del)
+	}
+	if len(del.Networks) != 0 {
+		args := del.CmdArgs
+		fails, err := cniutil.DelNetworks(&args, del.Networks)
+		del.Networks = fails
+		if err != nil {
+			save()
+			return err
+		}
+	}
+	if del.PodRules {
+		if err := g.cleanupPodRules(del.CmdArgs.ContainerID); err != nil {
+			save()
+			return err
+		}
+		del.PodRules = false
+	}
+	if len(del.Ports) != 0 {
+		pmhandler := g.portMapping()
+		pmhandler.CloseHostportsOf(del.Ports)
+		if err := g.hostportRules().CleanPortMapping(del.Ports); err != nil {
+			save()
+			return err
+		}
+		del.Ports = nil
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/network/dhcp"
+	"tkestack.io/galaxy/pkg/network/vlan"
+)
+
+const dhcpLeaseDir = "/var/lib/cni/galaxy/dhcp"
+
+// setupDHCP restores dhcp leases of pods and renews them in background. Leases of containers deleted while galaxy
+// was down are released.
+func (g *Galaxy) setupDHCP() error {
+	if err := g.dhcp.Restore(); err != nil {
+		return fmt.Errorf("failed to restore dhcp leases: %v", err)
+	}
+	containers, err := cniutil.NetworkInfoContainers()
+	if err != nil {
+		return err
+	}
+	alive := map[string]bool{}
+	for _, containerID := range containers {
+		alive[containerID] = true
+	}
+	for _, containerID := range g.dhcp.Containers() {
+		if !alive[containerID] {
+			g.releaseDHCPLeases(containerID)
+		}
+	}
+	g.dhcp.Run(g.quitChan)
+	return nil
+}
+
+// #lizard forgives
+// acquireDHCPLeases acquires leases of networks of dhcp ipam for the container on vlans of the networks. Ips of the
+// leases are passed to plugins by ipinfos args, and the ipam config is removed from the config of the networks so
+// that plugins neither look for the ipam plugin on ADD nor on DEL.
+func (g *Galaxy) acquireDHCPLeases(req *galaxyapi.PodRequest, pod *corev1.Pod,
+	networkInfos []*cniutil.NetworkInfo) error {
+	for _, info := range networkInfos {
+		ipam, _ := info.Conf["ipam"].(map[string]interface{})
+		if ipam == nil || ipam["type"] != dhcp.IPAMType {
+			continue
+		}
+		if info.Conf["type"] != "galaxy-k8s-vlan" {
+			return fmt.Errorf("ipam %s of network %s requires a galaxy-k8s-vlan network", dhcp.IPAMType,
+				info.NetworkType)
+		}
+		var ipamConf dhcp.Conf
+		if err := remarshal(ipam, &ipamConf); err != nil {
+			return fmt.Errorf("bad ipam of network %s: %v", info.NetworkType, err)
+		}
+		data, err := json.Marshal(info.Conf)
+		if err != nil {
+			return err
+		}
+		d := &vlan.VlanDriver{}
+		if _, err := d.LoadConf(data); err != nil {
+			return err
+		}
+		device, err := d.EnsureVlanDevice(ipamConf.Vlan)
+		if err != nil {
+			return err
+		}
+		lease, err := g.dhcp.Acquire(req.ContainerID, &dhcp.Request{Device: device, Vlan: ipamConf.Vlan,
+			ClientID: fmt.Sprintf("%s/%s/%s", pod.Namespace, pod.Name, info.NetworkType), Hostname: pod.Name})
+		if err != nil {
+			ipamRequestErrors.WithLabelValues("dhcp").Inc()
+			return fmt.Errorf("failed to acquire dhcp lease of network %s: %v", info.NetworkType, err)
+		}
+		ipInfos, err := json.Marshal([]constant.IPInfo{{IP: lease.IP, Vlan: lease.Vlan, Gateway: lease.Gateway}})
+		if err != nil {
+			return err
+		}
+		info.Args[constant.IPInfosKey] = string(ipInfos)
+		// the config is shared by all pods of the network
+		conf := make(map[string]interface{}, len(info.Conf))
+		for k, v := range info.Conf {
+			if k != "ipam" {
+				conf[k] = v
+			}
+		}
+		info.Conf = conf
+	}
+	return nil
+}
+
+// releaseDHCPLeases releases dhcp leases of the container, servers reclaim leases failed to release once they expire
+func (g *Galaxy) releaseDHCPLeases(containerID string) {
+	if err := g.dhcp.Release(containerID); err != nil {
+		glog.Warningf("failed to release dhcp leases of %s: %v", containerID, err)
+	}
+}
+
+func remarshal(in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,171 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	t020 "github.com/containernetworking/cni/pkg/types/020"
+	"github.com/containernetworking/cni/pkg/types/current"
+	corev1 "k8s.io/api/core/v1"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/utils/confcheck"
+)
+
+// networkDNS is the dns section of a network config. Besides fields of the cni spec, ResolvConf tells galaxy to
+// write them into resolv.conf of pods as plugins never do and kubelet ignores dns of cni results.
+type networkDNS struct {
+	types.DNS
+	ResolvConf bool `json:"resolvConf,omitempty"`
+}
+
+var dnsSchema = confcheck.Schema{
+	"nameservers": {Kind: confcheck.Array, Check: eachString(func(s string) error {
+		if net.ParseIP(s) == nil {
+			return fmt.Errorf("bad ip %q", s)
+		}
+		return nil
+	})},
+	"domain":     {Kind: confcheck.String},
+	"search":     {Kind: confcheck.Array, Check: eachString(nil)},
+	"options":    {Kind: confcheck.Array, Check: eachString(nil)},
+	"resolvConf": {Kind: confcheck.Bool},
+}
+
+// eachString returns a Check accepting arrays of strings each of which passes check, check may be nil
+func eachString(check func(s string) error) func(v interface{}) error {
+	return func(v interface{}) error {
+		items, _ := v.([]interface{})
+		for _, item := range items {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("%v is not a string", item)
+			}
+			if check != nil {
+				if err := check(s); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+func validateDNS(v interface{}) error {
+	obj, _ := v.(map[string]interface{})
+	return dnsSchema.Validate(obj)
+}
+
+// parseNetworkDNS returns the dns section of conf, nil if it has none
+func parseNetworkDNS(conf map[string]interface{}) (*networkDNS, error) {
+	v, ok := conf["dns"]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var dns networkDNS
+	if err := json.Unmarshal(data, &dns); err != nil {
+		return nil, fmt.Errorf("bad dns %s: %v", string(data), err)
+	}
+	return &dns, nil
+}
+
+func emptyDNS(dns *types.DNS) bool {
+	return len(dns.Nameservers) == 0 && dns.Domain == "" && len(dns.Search) == 0 && len(dns.Options) == 0
+}
+
+// setupDNS fills the dns of result by the dns of the network of the pod's interface if the plugin returns none, and
+// writes it into resolv.conf of the pod if the network asks. Pods of dnsPolicy None keep their own resolv.conf.
+func (g *Galaxy) setupDNS(req *galaxyapi.PodRequest, pod *corev1.Pod, networkInfos []*cniutil.NetworkInfo,
+	result types.Result) error {
+	var dns *networkDNS
+	for _, networkInfo := range networkInfos {
+		if networkInfo.IfName != req.IfName {
+			continue
+		}
+		var err error
+		if dns, err = parseNetworkDNS(networkInfo.Conf); err != nil {
+			return err
+		}
+		break
+	}
+	if dns == nil || emptyDNS(&dns.DNS) {
+		return nil
+	}
+	switch r := result.(type) {
+	case *t020.Result:
+		if emptyDNS(&r.DNS) {
+			r.DNS = dns.DNS
+		}
+	case *current.Result:
+		if emptyDNS(&r.DNS) {
+			r.DNS = dns.DNS
+		}
+	}
+	if !dns.ResolvConf || pod.Spec.DNSPolicy == corev1.DNSNone {
+		return nil
+	}
+	return g.writeResolvConf(req.ContainerID, &dns.DNS)
+}
+
+// writeResolvConf replaces resolv.conf of the sandbox which containers of the pod share. It writes through the root
+// of the sandbox process as galaxy runs with hostPID, kubelet has written resolv.conf before setting up networks.
+func (g *Galaxy) writeResolvConf(containerID string, dns *types.DNS) error {
+	c, err := g.dockerCli.InspectContainer(containerID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect sandbox %s: %v", containerID, err)
+	}
+	if c.State == nil || c.State.Pid == 0 {
+		return fmt.Errorf("sandbox %s is not running", containerID)
+	}
+	path := filepath.Join("/proc", strconv.Itoa(c.State.Pid), "root", "etc", "resolv.conf")
+	// the file is bind mounted into containers, write it in place
+	if err := ioutil.WriteFile(path, formatResolvConf(dns), 0644); err != nil {
+		return fmt.Errorf("failed to write resolv.conf of sandbox %s: %v", containerID, err)
+	}
+	glog.V(4).Infof("wrote resolv.conf of sandbox %s: %v", containerID, dns)
+	return nil
+}
+
+func formatResolvConf(dns *types.DNS) []byte {
+	buf := bytes.NewBuffer(nil)
+	for _, nameserver := range dns.Nameservers {
+		fmt.Fprintf(buf, "nameserver %s\n", nameserver)
+	}
+	if len(dns.Search) > 0 {
+		fmt.Fprintf(buf, "search %s\n", strings.Join(dns.Search, " "))
+	} else if dns.Domain != "" {
+		fmt.Fprintf(buf, "domain %s\n", dns.Domain)
+	}
+	if len(dns.Options) > 0 {
+		fmt.Fprintf(buf, "options %s\n", strings.Join(dns.Options, " "))
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,181 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	t020 "github.com/containernetworking/cni/pkg/types/020"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	glog "k8s.io/klog"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/galaxy/options"
+)
+
+// assignedIPDir stores the container each ip of results of the node is assigned to, one file per ip. Delegates and
+// the master may assign the same ip to different pods in hybrid mode, the registry catches it before the result is
+// returned.
+const assignedIPDir = "/var/lib/cni/galaxy/ips"
+
+// duplicateIPReason is the reason of events of pods getting ips assigned to other pods of the node
+const duplicateIPReason = "DuplicateIP"
+
+// assignedIP is the container and pod an ip is assigned to
+type assignedIP struct {
+	ContainerID  string
+	PodName      string
+	PodNamespace string
+	PodUID       string
+}
+
+func (a *assignedIP) String() string {
+	return fmt.Sprintf("%s_%s(%s) container %s", a.PodName, a.PodNamespace, a.PodUID, a.ContainerID)
+}
+
+func (g *Galaxy) loadAssignedIP(ip string) (*assignedIP, error) {
+	data, err := g.assignedIPs.Get(ip)
+	if err != nil {
+		return nil, err
+	}
+	var a assignedIP
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// inUse returns true if the container of a is still owned by the pod of a. Owners are dropped on DEL and by gc, so
+// an ip whose container is gone without a DEL is not a duplicate.
+func (g *Galaxy) inUse(a *assignedIP) bool {
+	owner, err := g.loadOwner(a.ContainerID)
+	if err != nil {
+		return false
+	}
+	return owner.PodName == a.PodName && owner.PodNamespace == a.PodNamespace && owner.PodUID == a.PodUID
+}
+
+// assignIP registers the ip of the result to the container of req. If the ip is in use by another container, the
+// request fails if DuplicateIPPolicy is reject, otherwise the ip stays registered to the previous container.
+func (g *Galaxy) assignIP(req *galaxyapi.PodRequest, pod *corev1.Pod, result *t020.Result) error {
+	if result.IP4 == nil {
+		return nil
+	}
+	ip := result.IP4.IP.IP.String()
+	a := &assignedIP{ContainerID: req.ContainerID, PodName: pod.Name, PodNamespace: pod.Namespace,
+		PodUID: string(pod.UID)}
+	old, err := g.loadAssignedIP(ip)
+	if err != nil && !os.IsNotExist(err) {
+		glog.Warningf("bad assigned ip %s: %v", ip, err)
+	}
+	if old != nil && old.ContainerID != req.ContainerID && g.inUse(old) {
+		glog.Warningf("ip %s of %s is already assigned to %s", ip, a, old)
+		g.recordDuplicateIP(a, old, ip)
+		if g.DuplicateIPPolicy == options.DuplicateIPReject {
+			return fmt.Errorf("ip %s is already assigned to pod %s_%s container %s", ip, old.PodName,
+				old.PodNamespace, old.ContainerID)
+		}
+		return nil
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return g.assignedIPs.Put(ip, data)
+}
+
+func (g *Galaxy) recordDuplicateIP(a, old *assignedIP, ip string) {
+	if g.recorder == nil {
+		return
+	}
+	for _, pair := range [][2]*assignedIP{{a, old}, {old, a}} {
+		g.recorder.Eventf(&corev1.ObjectReference{Kind: "Pod", Namespace: pair[0].PodNamespace,
+			Name: pair[0].PodName, UID: types.UID(pair[0].PodUID)}, corev1.EventTypeWarning, duplicateIPReason,
+			"ip %s is also assigned to pod %s_%s container %s", ip, pair[1].PodName, pair[1].PodNamespace,
+			pair[1].ContainerID)
+	}
+}
+
+// releaseIPs deregisters ips assigned to containerID and returns them. Ips assigned to other containers as well are
+// left to them.
+func (g *Galaxy) releaseIPs(containerID string) []net.IP {
+	return g.releaseIPsOf(map[string]bool{containerID: true})
+}
+
+// releaseIPsOf deregisters ips assigned to any of containerIDs by a single pass over the registry and returns them
+func (g *Galaxy) releaseIPsOf(containerIDs map[string]bool) []net.IP {
+	ips, err := g.assignedIPs.Keys()
+	if err != nil {
+		glog.Warningf("failed to list assigned ips: %v", err)
+		return nil
+	}
+	var released []net.IP
+	for _, ip := range ips {
+		a, err := g.loadAssignedIP(ip)
+		if err != nil || !containerIDs[a.ContainerID] {
+			continue
+		}
+		if err := g.assignedIPs.Delete(ip); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("failed to release assigned ip %s of %s: %v", ip, a.ContainerID, err)
+		}
+		if parsed := net.ParseIP(ip); parsed != nil {
+			released = append(released, parsed)
+		}
+	}
+	return released
+}
+
+// registerCachedIPs registers ips of cached results which are not registered yet, e.g. results of pods set up
+// before upgrading
+func (g *Galaxy) registerCachedIPs() {
+	containerIDs, err := g.results.Keys()
+	if err != nil {
+		glog.Warningf("failed to list cached results: %v", err)
+		return
+	}
+	for _, containerID := range containerIDs {
+		data, err := g.results.Get(containerID)
+		if err != nil {
+			continue
+		}
+		var cached cachedResult
+		if err := json.Unmarshal(data, &cached); err != nil {
+			continue
+		}
+		result, err := parseResult(cached.Result)
+		if err != nil || result.IP4 == nil {
+			continue
+		}
+		ip := result.IP4.IP.IP.String()
+		if _, err := g.assignedIPs.Get(ip); !os.IsNotExist(err) {
+			continue
+		}
+		a := &assignedIP{ContainerID: containerID, PodName: cached.PodName, PodNamespace: cached.PodNamespace}
+		if owner, err := g.loadOwner(containerID); err == nil {
+			a.PodUID = owner.PodUID
+		}
+		if data, err = json.Marshal(a); err == nil {
+			err = g.assignedIPs.Put(ip, data)
+		}
+		if err != nil {
+			glog.Warningf("failed to register ip %s of %s: %v", ip, containerID, err)
+		}
+	}
+}
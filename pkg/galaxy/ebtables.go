@@ -0,0 +1,96 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/vishvananda/netlink"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/galaxy/options"
+	"tkestack.io/galaxy/pkg/network/ebtables"
+)
+
+// restoreEbtables restores the ebtables rules file rendered with facts of the node, by nft if the firewall backend is
+// nftables. Restoring replaces tables of the file, so nd guard rules of running pods are set up again.
+func (g *Galaxy) restoreEbtables() error {
+	if g.EbtablesRulesFile == "" {
+		return nil
+	}
+	if _, err := os.Stat(g.EbtablesRulesFile); err != nil {
+		if os.IsNotExist(err) {
+			glog.V(4).Infof("ebtables rules file %s doesn't exist", g.EbtablesRulesFile)
+			return nil
+		}
+		return err
+	}
+	facts, err := g.nodeFacts()
+	if err != nil {
+		return fmt.Errorf("failed to get node facts of ebtables rules: %v", err)
+	}
+	restore := ebtables.Restore
+	if g.firewallBackend == options.FirewallBackendNftables {
+		restore = ebtables.RestoreNft
+	}
+	if err := restore(g.EbtablesRulesFile, facts); err != nil {
+		return err
+	}
+	glog.Infof("restored ebtables rules %s with %+v", g.EbtablesRulesFile, facts)
+	if g.hardensIPv6() {
+		return g.ndGuard.Restore()
+	}
+	return nil
+}
+
+func (g *Galaxy) nodeFacts() (*ebtables.Facts, error) {
+	facts := &ebtables.Facts{}
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		if route.Dst != nil || route.LinkIndex == 0 {
+			continue
+		}
+		link, err := netlink.LinkByIndex(route.LinkIndex)
+		if err != nil {
+			return nil, err
+		}
+		facts.Uplink = link.Attrs().Name
+		break
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		if _, ok := link.(*netlink.Bridge); ok {
+			facts.Bridges = append(facts.Bridges, link.Attrs().Name)
+		}
+	}
+	sort.Strings(facts.Bridges)
+	node, err := g.client.CoreV1().Nodes().Get(k8s.GetHostname(), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	facts.PodCIDR = node.Spec.PodCIDR
+	return facts, nil
+}
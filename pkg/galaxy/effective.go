@@ -0,0 +1,149 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	corev1 "k8s.io/api/core/v1"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/network/kernel"
+	"tkestack.io/galaxy/pkg/network/mtu"
+	"tkestack.io/galaxy/pkg/network/staticroute"
+	galaxyutils "tkestack.io/galaxy/pkg/utils"
+)
+
+// effectiveConfigDir stores effective configs of containers, gc cleans up files of dead containers
+const effectiveConfigDir = "/var/lib/cni/galaxy/effective"
+
+// ipv6Sysctls are ipv6 sysctls of each interface which ipv6 modes set
+var ipv6Sysctls = []string{"disable_ipv6", "accept_ra", "accept_redirects"}
+
+// EffectiveConfig is what galaxy did for a container by its ADD request, it is kept until the container is deleted
+type EffectiveConfig struct {
+	ContainerID  string
+	PodName      string
+	PodNamespace string
+	// Time is when the ADD request was served
+	Time time.Time
+	// Networks are the networks of the container with the configs their plugins got, i.e. after defaults and
+	// annotations of the pod are applied
+	Networks []EffectiveNetwork
+	// IPv6Mode is the ipv6 mode of the netns
+	IPv6Mode string
+	// Sysctls are ipv6 sysctls of all, default and the interfaces of the networks in the netns after the ADD request,
+	// keyed by their paths under /proc/sys
+	Sysctls map[string]string `json:",omitempty"`
+	// Routes are routes of the routes annotation added to the netns
+	Routes []staticroute.Route `json:",omitempty"`
+	// MTU is the mtu annotation applied to the interface
+	MTU *mtu.Override `json:",omitempty"`
+	// IngressBandwidth and EgressBandwidth are the bandwidth annotations applied to the interface
+	IngressBandwidth string `json:",omitempty"`
+	EgressBandwidth  string `json:",omitempty"`
+	// Tuning is the queue tuning applied to the interface
+	Tuning *kernel.AppliedQueueTuning `json:",omitempty"`
+	Ports  []k8s.Port                 `json:",omitempty"`
+}
+
+// EffectiveNetwork is a network of EffectiveConfig
+type EffectiveNetwork struct {
+	Type   string
+	IfName string
+	// Conf is the network config passed to the plugin
+	Conf map[string]interface{}
+	// Args are the cni args passed to the plugin besides those of the request
+	Args map[string]string `json:",omitempty"`
+}
+
+// recordEffectiveConfig persists the effective config of a successful ADD request. Failures are only logged, the
+// record is for troubleshooting.
+func (g *Galaxy) recordEffectiveConfig(req *galaxyapi.PodRequest, pod *corev1.Pod,
+	tuning *kernel.AppliedQueueTuning) {
+	c := &EffectiveConfig{ContainerID: req.ContainerID, PodName: req.PodName, PodNamespace: req.PodNamespace,
+		Time: time.Now(), Tuning: tuning, Ports: req.Ports,
+		IngressBandwidth: pod.Annotations[k8s.IngressBandwidthAnnotation],
+		EgressBandwidth:  pod.Annotations[k8s.EgressBandwidthAnnotation]}
+	infos, err := cniutil.LoadNetworkInfo(req.ContainerID)
+	if err != nil {
+		glog.Warningf("failed to read network infos of %s: %v", req.ContainerID, err)
+	}
+	ifNames := []string{"all", "default"}
+	for _, info := range infos {
+		c.Networks = append(c.Networks, EffectiveNetwork{Type: info.NetworkType, IfName: info.IfName,
+			Conf: info.Conf, Args: info.Args})
+		ifNames = append(ifNames, info.IfName)
+	}
+	if c.IPv6Mode, err = g.ipv6Mode(infos); err != nil {
+		glog.Warningf("failed to resolve ipv6 mode of %s: %v", req.ContainerID, err)
+	}
+	var keys []string
+	for _, ifName := range ifNames {
+		for _, key := range ipv6Sysctls {
+			keys = append(keys, fmt.Sprintf("net/ipv6/conf/%s/%s", ifName, key))
+		}
+	}
+	if c.Sysctls, err = galaxyutils.ReadSysctls(req.Netns, keys); err != nil {
+		glog.Warningf("failed to read sysctls of %s: %v", req.ContainerID, err)
+	}
+	if v := pod.Annotations[k8s.RoutesAnnotation]; v != "" {
+		c.Routes, _ = staticroute.Parse(v)
+	}
+	if v := pod.Annotations[k8s.MTUAnnotation]; v != "" {
+		c.MTU, _ = mtu.ParseOverride(v)
+	}
+	data, err := json.Marshal(c)
+	if err == nil {
+		err = g.effectiveConfigs.Put(req.ContainerID, data)
+	}
+	if err != nil {
+		glog.Warningf("failed to record effective config of %s: %v", req.ContainerID, err)
+	}
+}
+
+// dropEffectiveConfig removes the effective config of containerID
+func (g *Galaxy) dropEffectiveConfig(containerID string) {
+	if err := g.effectiveConfigs.Delete(containerID); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("failed to remove effective config of %s: %v", containerID, err)
+	}
+}
+
+// effectiveConfig responds with the EffectiveConfig of a container
+func (g *Galaxy) effectiveConfig(r *restful.Request, w *restful.Response) {
+	containerID := r.PathParameter("containerID")
+	data, err := g.effectiveConfigs.Get(containerID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, fmt.Sprintf("no effective config of %s", containerID), http.StatusNotFound)
+		} else {
+			http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		glog.Warningf("Error writing effective config HTTP response: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"fmt"
+
+	t020 "github.com/containernetworking/cni/pkg/types/020"
+	corev1 "k8s.io/api/core/v1"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/network/egressgw"
+	"tkestack.io/galaxy/pkg/network/staticroute"
+)
+
+// vlanNetworkType is the type of networks whose interfaces are vlan ones for egress gateway selection
+const vlanNetworkType = "galaxy-k8s-vlan"
+
+// egressGateway returns the egress gateway choice of the pod, its annotation overrides egress_gateway of its vlan
+// networks
+func egressGateway(pod *corev1.Pod, networkInfos []*cniutil.NetworkInfo) string {
+	if v := pod.Annotations[k8s.EgressGatewayAnnotation]; v != "" {
+		return v
+	}
+	for _, info := range networkInfos {
+		if info.Conf["type"] != vlanNetworkType {
+			continue
+		}
+		if v, _ := info.Conf["egress_gateway"].(string); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// selectEgressGateway routes default traffic of a pod having both vlan and overlay interfaces via the chosen one,
+// replies of the others leave by them by policy routing. A pod left with the wrong default route would reach
+// destinations from an unexpected source, so failures fail the request.
+func selectEgressGateway(req *galaxyapi.PodRequest, pod *corev1.Pod, networkInfos []*cniutil.NetworkInfo) error {
+	choice := egressGateway(pod, networkInfos)
+	if choice == "" {
+		return nil
+	}
+	var links []egressgw.Link
+	for _, info := range networkInfos {
+		if info.Result == nil {
+			continue
+		}
+		result, err := t020.GetResult(info.Result)
+		if err != nil || result.IP4 == nil {
+			continue
+		}
+		kind := egressgw.Overlay
+		if info.Conf["type"] == vlanNetworkType {
+			kind = egressgw.Vlan
+		}
+		links = append(links, egressgw.Link{IfName: info.IfName, Kind: kind, IP: result.IP4.IP.IP,
+			Gateway: result.IP4.Gateway})
+	}
+	gw, others, err := egressgw.Plan(links, choice)
+	if err != nil {
+		return fmt.Errorf("bad egress gateway of pod %s: %v", k8s.GetPodFullName(pod.Name, pod.Namespace), err)
+	}
+	if gw == nil {
+		glog.V(4).Infof("pod %s has no vlan and overlay interfaces to choose from",
+			k8s.GetPodFullName(pod.Name, pod.Namespace))
+		return nil
+	}
+	if err := egressgw.Apply(req.Netns, gw, others); err != nil {
+		return fmt.Errorf("failed to route default traffic via %s: %v", gw.IfName, err)
+	}
+	glog.V(4).Infof("routed default traffic of pod %s via %s %s", k8s.GetPodFullName(pod.Name, pod.Namespace),
+		choice, gw.IfName)
+	return nil
+}
+
+// addStaticRoutes adds routes of the routes annotation of the pod once all its networks are set up, after the egress
+// gateway which may replace routes. Like the egress gateway, a pod missing them would reach destinations the wrong
+// way, so failures fail the request.
+func addStaticRoutes(req *galaxyapi.PodRequest, pod *corev1.Pod) error {
+	v := pod.Annotations[k8s.RoutesAnnotation]
+	if v == "" {
+		return nil
+	}
+	routes, err := staticroute.Parse(v)
+	if err != nil {
+		return fmt.Errorf("bad %s annotation: %v", k8s.RoutesAnnotation, err)
+	}
+	if err := staticroute.Add(req.Netns, req.IfName, routes); err != nil {
+		return err
+	}
+	glog.V(4).Infof("added %d routes of pod %s", len(routes), k8s.GetPodFullName(pod.Name, pod.Namespace))
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/utils/ldflags"
+)
+
+// supportedFeatures are config features of this galaxy. Configs list features they use in RequiredFeatures, so that
+// galaxy older than a config refuses it with a clear status instead of misreading it during staggered upgrades.
+// Append a feature whenever a config field is added.
+var supportedFeatures = []string{"bgp", "dns", "egress-nat", "interface-names", "link-tuning", "network-marks",
+	"uplink-vlans", "vlan-isolation"}
+
+// maxStatusLen caps the config status annotation, errors of bad configs may quote whole configs
+const maxStatusLen = 1024
+
+// checkRequiredFeatures returns an error if json config data requires features this galaxy doesn't support. It
+// decodes only RequiredFeatures, so it runs before strict decoding fails on fields of unsupported features.
+func checkRequiredFeatures(data []byte) error {
+	var conf struct {
+		RequiredFeatures []string
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		// decoding the whole config reports it
+		return nil
+	}
+	supported := map[string]bool{}
+	for _, feature := range supportedFeatures {
+		supported[feature] = true
+	}
+	var missing []string
+	for _, feature := range conf.RequiredFeatures {
+		if !supported[feature] {
+			missing = append(missing, feature)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("config requires features %s which this galaxy doesn't support, upgrade galaxy of the "+
+			"node", strings.Join(missing, ","))
+	}
+	return nil
+}
+
+// reportConfigStatus annotates the node with supported features and whether galaxy accepts its config, err is the
+// reason galaxy refuses the config if it isn't nil
+func (g *Galaxy) reportConfigStatus(err error) {
+	if g.client == nil {
+		g.initk8sClient()
+	}
+	status := "accepted"
+	if err != nil {
+		status = "rejected: " + err.Error()
+		if len(status) > maxStatusLen {
+			status = status[:maxStatusLen]
+		}
+	}
+	data, _ := json.Marshal(&constant.NodeFeatures{GitCommit: ldflags.GIT_COMMIT, Features: supportedFeatures})
+	if err := g.annotateNode(map[string]string{constant.NodeFeaturesAnnotation: string(data),
+		constant.NodeConfigStatusAnnotation: status}); err != nil {
+		glog.Warningf("failed to annotate node config status %q: %v", status, err)
+	}
+}
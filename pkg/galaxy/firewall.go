@@ -0,0 +1,121 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"k8s.io/apimachinery/pkg/util/wait"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/galaxy/options"
+	"tkestack.io/galaxy/pkg/metrics"
+)
+
+var firewallSyncs = metrics.NewCounterVec("galaxy_firewall_syncs_total", "Number of syncs of firewall rules, e.g. "+
+	"iptables and ebtables rules, by loop and result", "loop", "result")
+
+// resolveFirewallBackend returns the firewall backend of --firewall-backend. auto picks nftables if the host has nft
+// and either has no iptables or has not loaded legacy iptables, e.g. distros dropping it, and iptables otherwise.
+// legacyIptables tells whether tables of legacy iptables exist.
+func resolveFirewallBackend(backend string, lookPath func(file string) (string, error), legacyIptables bool) string {
+	if backend != options.FirewallBackendAuto {
+		return backend
+	}
+	if _, err := lookPath("nft"); err != nil {
+		return options.FirewallBackendIptables
+	}
+	if _, err := lookPath("iptables"); err != nil || !legacyIptables {
+		return options.FirewallBackendNftables
+	}
+	return options.FirewallBackendIptables
+}
+
+// firewallLoop reconciles host firewall rules periodically, it can also be run on demand by /admin/firewall/sync
+type firewallLoop struct {
+	name string
+	// lock serializes periodic and on demand syncs
+	lock sync.Mutex
+	sync func() error
+}
+
+func (l *firewallLoop) run() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	err := l.sync()
+	firewallSyncs.WithLabelValues(l.name, resultLabel(err)).Inc()
+	return err
+}
+
+// addFirewallLoop registers sync as a firewall loop and runs it every period until galaxy quits. A period of 0 only
+// runs it on demand. The loop may also be run by its owner, e.g. on events.
+func (g *Galaxy) addFirewallLoop(name string, period time.Duration, sync func() error) *firewallLoop {
+	l := &firewallLoop{name: name, sync: sync}
+	g.firewallLock.Lock()
+	g.firewallLoops = append(g.firewallLoops, l)
+	g.firewallLock.Unlock()
+	if period == 0 {
+		return l
+	}
+	go wait.Until(func() {
+		if err := l.run(); err != nil {
+			glog.Warningf("failed to sync %s rules: %v", name, err)
+		}
+	}, period, g.quitChan)
+	return l
+}
+
+// FirewallSyncResult is the response of /admin/firewall/sync
+type FirewallSyncResult struct {
+	// Synced are names of firewall loops which succeeded
+	Synced []string
+	// Failed maps names of firewall loops which failed to the errors
+	Failed map[string]string `json:",omitempty"`
+}
+
+// syncFirewall runs all firewall loops immediately rather than waiting for their periods, e.g. after configuration
+// management changes firewall baselines of the host
+func (g *Galaxy) syncFirewall(r *restful.Request, w *restful.Response) {
+	g.firewallLock.Lock()
+	loops := append([]*firewallLoop{}, g.firewallLoops...)
+	g.firewallLock.Unlock()
+	result := &FirewallSyncResult{Failed: map[string]string{}}
+	start := time.Now()
+	for _, l := range loops {
+		if err := l.run(); err != nil {
+			glog.Warningf("failed to sync %s rules on demand: %v", l.name, err)
+			result.Failed[l.name] = err.Error()
+			continue
+		}
+		result.Synced = append(result.Synced, l.name)
+	}
+	glog.Infof("synced %d firewall loops on demand, %d failed, %v", len(result.Synced), len(result.Failed),
+		time.Since(start))
+	data, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		glog.Warningf("Error writing firewall sync HTTP response: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	"tkestack.io/galaxy/pkg/utils/filewait"
+)
+
+const (
+	flannelNetworkType       = "galaxy-flannel"
+	defaultFlannelSubnetFile = "/run/flannel/subnet.env"
+)
+
+// waitFlannel blocks ADDs of flannel networks until flanneld writes the subnet file, so that ADDs racing with
+// flanneld on node start are delayed instead of failed
+func (g *Galaxy) waitFlannel(networkInfos []*cniutil.NetworkInfo) error {
+	for _, info := range networkInfos {
+		if t, _ := info.Conf["type"].(string); t != flannelNetworkType {
+			continue
+		}
+		path, _ := info.Conf["subnetFile"].(string)
+		if path == "" {
+			path = defaultFlannelSubnetFile
+		}
+		if err := g.fileWaiter(path).Wait(g.FlannelWaitTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *Galaxy) fileWaiter(path string) *filewait.Waiter {
+	g.waiterLock.Lock()
+	defer g.waiterLock.Unlock()
+	w, ok := g.fileWaiters[path]
+	if !ok {
+		w = filewait.NewWaiter(path, g.FlannelMaxPending)
+		g.fileWaiters[path] = w
+	}
+	return w
+}
+
+// pendingAdds returns the number of ADDs waiting for files
+func (g *Galaxy) pendingAdds() int {
+	g.waiterLock.Lock()
+	defer g.waiterLock.Unlock()
+	var pending int
+	for _, w := range g.fileWaiters {
+		pending += w.Pending()
+	}
+	return pending
+}
@@ -17,23 +17,48 @@
 package galaxy
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"text/template"
 	"time"
 
-	"k8s.io/apimachinery/pkg/util/wait"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	glog "k8s.io/klog"
 	"tkestack.io/galaxy/pkg/api/docker"
+	"tkestack.io/galaxy/pkg/api/k8s"
 	"tkestack.io/galaxy/pkg/galaxy/options"
 	"tkestack.io/galaxy/pkg/gc"
+	"tkestack.io/galaxy/pkg/network/arpresponder"
+	"tkestack.io/galaxy/pkg/network/arpwatch"
+	"tkestack.io/galaxy/pkg/network/bgp"
+	"tkestack.io/galaxy/pkg/network/connlimit"
+	"tkestack.io/galaxy/pkg/network/dhcp"
+	"tkestack.io/galaxy/pkg/network/egress"
 	"tkestack.io/galaxy/pkg/network/kernel"
+	"tkestack.io/galaxy/pkg/network/lldp"
+	"tkestack.io/galaxy/pkg/network/mtu"
+	"tkestack.io/galaxy/pkg/network/ndguard"
+	"tkestack.io/galaxy/pkg/network/netmark"
 	"tkestack.io/galaxy/pkg/network/portmapping"
+	"tkestack.io/galaxy/pkg/network/vlanisolation"
 	"tkestack.io/galaxy/pkg/policy"
 	"tkestack.io/galaxy/pkg/tke/eni"
+	"tkestack.io/galaxy/pkg/utils/budget"
+	"tkestack.io/galaxy/pkg/utils/capability"
+	"tkestack.io/galaxy/pkg/utils/confcheck"
+	"tkestack.io/galaxy/pkg/utils/credential"
+	"tkestack.io/galaxy/pkg/utils/filewait"
+	"tkestack.io/galaxy/pkg/utils/queue"
+	"tkestack.io/galaxy/pkg/utils/store"
 )
 
 type Galaxy struct {
@@ -41,10 +66,86 @@ type Galaxy struct {
 	*options.ServerRunOptions
 	quitChan  chan struct{}
 	dockerCli *docker.DockerInterface
-	netConf   map[string]map[string]interface{}
+	// confLock guards netConf, ifNameTemplates and the networks of JsonConf, which reloadConfig replaces. Use the
+	// accessors of them, e.g. networkConfs, after Start.
+	confLock sync.RWMutex
+	netConf  map[string]map[string]interface{}
+	// ifNameTemplates are parsed InterfaceNames
+	ifNameTemplates map[string]*template.Template
+	// pmhandler is initialized lazily if no pod uses ports on start, use portMapping() to get it
+	pmLock    sync.Mutex
 	pmhandler *portmapping.PortMappingHandler
 	client    kubernetes.Interface
 	pm        *policy.PolicyManager
+	// portRules set up rules of hostports by firewallBackend, they are initialized along with pmhandler
+	portRules portmapping.RuleManager
+	// firewallBackend is the resolved FirewallBackend, iptables or nftables
+	firewallBackend string
+	// restConfig is the config client is created of
+	restConfig *rest.Config
+	// recorder records events of pods and the node
+	recorder record.EventRecorder
+	// deferred retries cleanup of failed DEL requests
+	deferred *queue.Queue
+	// results caches results of ADD requests to serve re-ADDs and CHECKs after kubelet restarts
+	results *store.FileStore
+	// owners are pods owning state of containers, see containerOwner
+	owners *store.FileStore
+	// effectiveConfigs are what galaxy did for containers, see EffectiveConfig
+	effectiveConfigs *store.FileStore
+	// assignedIPs are containers which ips of results are assigned to, keyed by the ips, see assignedIP
+	assignedIPs store.Store
+	// remoteStores keep state of containers keyed by container ids off the node if StateStore isn't file, gc sweeps
+	// them besides gc dirs
+	remoteStores []store.Store
+	// portMappingTasks are port mapping setups running after responding to ADD requests, keyed by container id
+	portMappingLock  sync.Mutex
+	portMappingTasks map[string]*portMappingTask
+	// parkedPorts are port mappings of deleted containers kept for ReuseWindow, keyed by pod full name
+	parkLock    sync.Mutex
+	parkedPorts map[string]*parkedPorts
+	// fileWaiters are keyed by path of files ADD requests wait for, e.g. flannel subnet files
+	waiterLock  sync.Mutex
+	fileWaiters map[string]*filewait.Waiter
+	// connLimit sets up connection limits of pods having the connection limit annotation
+	connLimit *connlimit.Handler
+	// mssClamp clamps tcp mss of pods having the mtu annotation which asks for it
+	mssClamp *mtu.Handler
+	// ndGuard drops rogue ipv6 neighbor discovery packets of pods if IPv6Mode is harden
+	ndGuard *ndguard.Guard
+	// missingCapabilities are optional capabilities galaxy started without
+	missingCapabilities []capability.Cap
+	// arpWatcher alerts on other macs claiming ips of pods if ARPWatch is true
+	arpWatcher *arpwatch.Watcher
+	// arpResponders answer arps of uplinks of pure mode networks having arp_responder for ips of pure mode pods
+	arpResponders []*arpresponder.Responder
+	// vlanIsolation drops traffic between vlans if VlanIsolation is set
+	vlanIsolation *vlanisolation.Handler
+	// netMark marks traffic of pods by their networks if NetworkMarks is set
+	netMark *netmark.Handler
+	// debugAttachments are netns attached to networks for connectivity tests, keyed by their ids
+	debugLock        sync.Mutex
+	debugAttachments *store.FileStore
+	// socketToken is the shared token requests to the galaxy socket must carry if not empty
+	socketToken string
+	// warmedUp are ips announced of pods which are yet to start, keyed by namespace/name of the pods
+	warmUpLock sync.Mutex
+	warmedUp   map[string]string
+	// firewallLoops reconcile host firewall rules periodically and on demand
+	firewallLock  sync.Mutex
+	firewallLoops []*firewallLoop
+	// bgpSpeaker advertises routes of pods to upstream routers if BGP is set, bgpTrigger asks it to advertise them
+	// immediately
+	bgpSpeaker *bgp.Speaker
+	bgpTrigger chan struct{}
+	// uplinkNeighbors are switch ports of uplinks by LLDP if UplinkVlans is set, keyed by the uplinks
+	uplinkLock      sync.Mutex
+	uplinkNeighbors map[string]*uplinkNeighbor
+	// dhcp keeps dhcp leases acquired on behalf of pods of networks of dhcp ipam
+	dhcp *dhcp.Manager
+	// addsInFlight counts ADD requests being served of each container id, GC requests never collect them
+	addLock      sync.Mutex
+	addsInFlight map[string]int
 }
 
 type JsonConf struct {
@@ -53,58 +154,129 @@ type JsonConf struct {
 	// If not empty, set pod's default network to `ENIIPNetwork` regardless of `DefaultNetworks` if pod wants eni ip
 	// and has no networks annotation
 	ENIIPNetwork string
+	// SNAT rules of underlay pods reaching specific destinations, see egress.Rule
+	EgressNAT []egress.Rule
+	// If set, traffic the node routes between vlans of pure mode vlan networks is dropped except allowed pairs
+	VlanIsolation *vlanisolation.Config
+	// Marks of traffic of pods by their networks and route tables of the marks, see netmark.Mark
+	NetworkMarks []netmark.Mark
+	// If set, a bgp speaker advertises routes of pods to upstream routers, see bgp.Config
+	BGP *bgp.Config
+	// If set, vlans switch ports of uplinks of vlan networks carry are validated by LLDP, see lldp.Config
+	UplinkVlans *lldp.Config
+	// Interface name templates of attachments of pods keyed by network names, e.g. net{{.Index}}-vlan{{.Vlan}}, see
+	// ifNameData
+	InterfaceNames map[string]string
+	// Features the config uses, galaxy refuses the config if it doesn't support any of them
+	RequiredFeatures []string
 }
 
 func NewGalaxy() *Galaxy {
 	g := &Galaxy{
 		ServerRunOptions: options.NewServerRunOptions(),
 		quitChan:         make(chan struct{}),
-		netConf:          map[string]map[string]interface{}{},
+		results:          store.NewFileStore(resultCacheDir),
+		owners:           store.NewFileStore(ownerDir),
+		effectiveConfigs: store.NewFileStore(effectiveConfigDir),
+		assignedIPs:      store.NewFileStore(assignedIPDir),
+		connLimit:        connlimit.New(connLimitDir),
+		mssClamp:         mtu.New(mssClampDir),
+		ndGuard:          ndguard.New(ndGuardDir),
+		debugAttachments: store.NewFileStore(debugAttachmentDir),
+		dhcp:             dhcp.NewManager(dhcpLeaseDir),
+		portMappingTasks: map[string]*portMappingTask{},
+		parkedPorts:      map[string]*parkedPorts{},
+		fileWaiters:      map[string]*filewait.Waiter{},
+		warmedUp:         map[string]string{},
+		addsInFlight:     map[string]int{},
 	}
 	return g
 }
 
 func (g *Galaxy) Init() error {
+	if err := g.loadConfig(); err != nil {
+		g.reportConfigStatus(err)
+		return err
+	}
+	dockerClient, err := docker.NewDockerInterface()
+	if err != nil {
+		return err
+	}
+	g.dockerCli = dockerClient
+	return nil
+}
+
+// loadConfig reads, verifies and validates the json config
+func (g *Galaxy) loadConfig() error {
+	conf, err := g.readConfig()
+	if err != nil {
+		return err
+	}
+	g.JsonConf, g.netConf, g.ifNameTemplates = conf.JsonConf, conf.netConf, conf.ifNameTemplates
+	return g.ServerRunOptions.Validate()
+}
+
+// parsedConfig is the json config along with its parsed networks and interface name templates
+type parsedConfig struct {
+	JsonConf
+	netConf         map[string]map[string]interface{}
+	ifNameTemplates map[string]*template.Template
+}
+
+// readConfig reads, verifies and parses the json config
+func (g *Galaxy) readConfig() (*parsedConfig, error) {
 	if g.JsonConfigPath == "" {
-		return fmt.Errorf("json config is required")
+		return nil, fmt.Errorf("json config is required")
 	}
 	data, err := ioutil.ReadFile(g.JsonConfigPath)
 	if err != nil {
-		return fmt.Errorf("read json config: %v", err)
+		return nil, fmt.Errorf("read json config: %v", err)
 	}
-	if err := json.Unmarshal(data, &g.JsonConf); err != nil {
-		return fmt.Errorf("bad config %s: %v", string(data), err)
+	if g.ConfigPublicKeyFile != "" {
+		verifier, err := confcheck.NewVerifier(g.ConfigPublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifier.Verify(data, g.JsonConfigPath+confcheck.SignatureSuffix); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkRequiredFeatures(data); err != nil {
+		return nil, err
+	}
+	conf := &parsedConfig{}
+	if err := confcheck.DecodeStrict(data, &conf.JsonConf); err != nil {
+		return nil, fmt.Errorf("bad config %s: %v", string(data), err)
 	}
 	glog.Infof("Json Config: %s", string(data))
-	if err := g.checkNetworkConf(); err != nil {
-		return err
+	if conf.netConf, err = parseNetworkConf(conf.NetworkConf); err != nil {
+		return nil, err
 	}
-	dockerClient, err := docker.NewDockerInterface()
-	if err != nil {
-		return err
+	if conf.ifNameTemplates, err = parseInterfaceNames(conf.InterfaceNames); err != nil {
+		return nil, err
 	}
-	g.dockerCli = dockerClient
-	g.pmhandler = portmapping.New("")
-	return nil
+	return conf, nil
 }
 
-func (g *Galaxy) checkNetworkConf() error {
-	for i := range g.NetworkConf {
-		netConf := g.NetworkConf[i]
+// parseNetworkConf keys network configs by their names, which are their types if they have none
+func parseNetworkConf(confs []map[string]interface{}) (map[string]map[string]interface{}, error) {
+	ret := map[string]map[string]interface{}{}
+	for i := range confs {
+		netConf := confs[i]
 		// check if type is set and valid first
 		typeVal, ok := netConf["type"]
 		if !ok {
-			return fmt.Errorf("bad network config %v, type is missing", netConf)
+			return nil, fmt.Errorf("bad network config %v, type is missing", netConf)
 		}
 		netType, ok := typeVal.(string)
 		if !ok {
-			return fmt.Errorf("bad network config %v, type is not string", netConf)
+			return nil, fmt.Errorf("bad network config %v, type is not string", netConf)
 		}
 		var key string
 		// using name as key
 		if val, ok := netConf["name"]; ok {
 			if name, ok := val.(string); !ok {
-				return fmt.Errorf("bad network config %v, name is not string", netConf)
+				return nil, fmt.Errorf("bad network config %v, name is not string", netConf)
 			} else {
 				key = name
 			}
@@ -112,36 +284,143 @@ func (g *Galaxy) checkNetworkConf() error {
 			// name empty, assume type name is network name
 			key = netType
 		}
-		if _, ok := g.netConf[key]; ok {
-			return fmt.Errorf("multiple network configuration with name %s", key)
+		if _, ok := ret[key]; ok {
+			return nil, fmt.Errorf("multiple network configuration with name %s", key)
+		}
+		if err := validateNetworkConf(netConf); err != nil {
+			return nil, fmt.Errorf("bad network config %s: %v", key, err)
 		}
-		g.netConf[key] = g.NetworkConf[i]
+		ret[key] = confs[i]
 	}
-	return nil
+	return ret, nil
+}
+
+// networkConfs returns configs of networks keyed by their names. The map is replaced rather than modified by
+// reloads, so callers may range over it without holding confLock.
+func (g *Galaxy) networkConfs() map[string]map[string]interface{} {
+	g.confLock.RLock()
+	defer g.confLock.RUnlock()
+	return g.netConf
+}
+
+// defaultNetworks returns DefaultNetworks and ENIIPNetwork
+func (g *Galaxy) defaultNetworks() ([]string, string) {
+	g.confLock.RLock()
+	defer g.confLock.RUnlock()
+	return g.DefaultNetworks, g.ENIIPNetwork
+}
+
+// ifNameTemplate returns the interface name template of the network
+func (g *Galaxy) ifNameTemplate(network string) (*template.Template, bool) {
+	g.confLock.RLock()
+	defer g.confLock.RUnlock()
+	t, ok := g.ifNameTemplates[network]
+	return t, ok
 }
 
 func (g *Galaxy) Start() error {
 	if err := g.Init(); err != nil {
 		return err
 	}
+	if err := g.checkCapabilities(); err != nil {
+		return err
+	}
+	// before galaxy runs iptables which loads legacy tables
+	_, err := os.Stat("/proc/net/ip_tables_names")
+	g.firewallBackend = resolveFirewallBackend(g.FirewallBackend, exec.LookPath, err == nil)
+	glog.Infof("firewall backend %s", g.firewallBackend)
 	g.initk8sClient()
-	gc.NewFlannelGC(g.dockerCli, g.quitChan, g.cleanIPtables).Run()
-	kernel.BridgeNFCallIptables(g.quitChan, g.BridgeNFCallIptables)
-	kernel.IPForward(g.quitChan, g.IPForward)
+	g.reportConfigStatus(nil)
+	if err := g.setupStateStore(); err != nil {
+		return err
+	}
+	gc.NewFlannelGC(g.dockerCli, g.quitChan, g.gcContainer, g.remoteStores...).Run()
+	g.initDeferredQueue()
+	g.registerCachedIPs()
+	// keep sysctls set only if they are writable, locked down hosts may set them in advance
+	kernelReqs := g.probeKernel()
+	logKernelRequirements(kernelReqs)
+	if sysctlWritable(kernelReqs, bridgeNFSysctl) {
+		kernel.BridgeNFCallIptables(g.quitChan, g.BridgeNFCallIptables)
+	}
+	if sysctlWritable(kernelReqs, ipForwardSysctl) {
+		kernel.IPForward(g.quitChan, g.IPForward)
+	}
 	if err := g.setupIPtables(); err != nil {
 		return err
 	}
+	// after rules of galaxy which load nf_conntrack
+	g.setupConntrack()
+	if err := g.restoreEbtables(); err != nil {
+		return err
+	}
+	// the rules file is restored again only on demand as restoring replaces whole tables
+	g.addFirewallLoop("ebtables", 0, g.restoreEbtables)
+	if err := g.setupEgressNAT(); err != nil {
+		return err
+	}
+	if err := g.setupNetworkMarks(); err != nil {
+		return err
+	}
+	if err := g.setupVlanIsolation(); err != nil {
+		return err
+	}
+	if err := g.setupQuarantine(); err != nil {
+		return err
+	}
+	if err := g.setupBGP(); err != nil {
+		return err
+	}
+	if err := g.setupDHCP(); err != nil {
+		return err
+	}
+	g.initVlanNetworks()
 	if g.NetworkPolicy {
-		g.pm = policy.New(g.client, g.quitChan)
-		go wait.Until(g.pm.Run, 3*time.Minute, g.quitChan)
+		g.pm = policy.New(g.client, g.quitChan, budget.New(g.ResyncRulesPerSecond, g.ResyncBurst,
+			g.ResyncErrorRatio, g.ResyncPause))
+		g.addFirewallLoop("network policy", 3*time.Minute, func() error {
+			g.pm.Run()
+			return nil
+		})
+	}
+	if g.ARPWatch {
+		g.startARPWatch()
 	}
 	if g.RouteENI {
-		kernel.DisableRPFilter(g.quitChan)
+		if sysctlWritable(kernelReqs, rpFilterSysctl) {
+			kernel.DisableRPFilter(g.quitChan)
+		}
 		eni.SetupENIs(g.quitChan)
 	}
+	g.startPureRouteCheck()
+	g.startARPResponders()
+	g.startBridgeStats()
+	g.startStaleVlanCleanup()
+	g.startUplinkValidation()
+	g.startNodeIPAnnotation()
+	g.startHeartbeat()
+	g.startARPWarmUp()
+	g.startDebugReaper()
+	g.startReloadOnSIGHUP()
 	return g.StartServer()
 }
 
+// setupEgressNAT syncs egress nat rules periodically, it removes rules left by previous configs if there is none
+func (g *Galaxy) setupEgressNAT() error {
+	h, err := egress.New(g.EgressNAT)
+	if err != nil {
+		return err
+	}
+	if err := h.Sync(); err != nil {
+		return err
+	}
+	if len(g.EgressNAT) == 0 {
+		return nil
+	}
+	g.addFirewallLoop("egress nat", time.Minute, h.Sync)
+	return nil
+}
+
 func (g *Galaxy) Stop() error {
 	close(g.quitChan)
 	g.quitChan = make(chan struct{})
@@ -151,7 +430,17 @@ func (g *Galaxy) Stop() error {
 func (g *Galaxy) initk8sClient() {
 	var clientConfig *rest.Config
 	var err error
-	if g.Master != "" || g.KubeConf != "" {
+	if g.MasterCredentialsDir != "" {
+		source, err := credential.NewSource(g.MasterCredentialsDir)
+		if err != nil {
+			glog.Fatalf("Invalid master credentials: %v", err)
+		}
+		if clientConfig, err = source.ClientConfig(); err != nil {
+			glog.Fatalf("Invalid client config: %v", err)
+		}
+		source.ExitOnEndpointChange()
+		go source.Run(credential.ReloadInterval, g.quitChan)
+	} else if g.Master != "" || g.KubeConf != "" {
 		clientConfig, err = clientcmd.BuildConfigFromFlags(g.Master, g.KubeConf)
 		if err != nil {
 			glog.Fatalf("Invalid client config: %v", err)
@@ -171,8 +460,17 @@ func (g *Galaxy) initk8sClient() {
 		glog.Fatalf("Can not generate client from config: error(%v)", err)
 	}
 	glog.Infof("apiserver address %s", clientConfig.Host)
+	g.restConfig = clientConfig
+	g.recorder = newEventRecorder(g.client)
 }
 
 func (g *Galaxy) SetClient(cli kubernetes.Interface) {
 	g.client = cli
+	g.recorder = newEventRecorder(cli)
+}
+
+func newEventRecorder(client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "galaxy", Host: k8s.GetHostname()})
 }
@@ -0,0 +1,198 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/galaxy/private"
+	"tkestack.io/galaxy/pkg/api/galaxy/rpc"
+	"tkestack.io/galaxy/pkg/utils/peercred"
+)
+
+// serveGRPC serves the Galaxy gRPC service on GalaxyGRPCSocketPath, whose peers are restricted and authenticated the
+// same as those of the galaxy socket
+func (g *Galaxy) serveGRPC() error {
+	l, err := listenSocket(private.GalaxyGRPCSocketPath)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer(grpc.Creds(peerCreds{}), grpc.UnaryInterceptor(g.interceptCall))
+	rpc.RegisterGalaxyServer(server, &galaxyServer{g: g})
+	go func() {
+		glog.Fatal(server.Serve(g.socketListener(l)))
+	}()
+	return nil
+}
+
+// galaxyServer handles calls as /cni handles requests of the same command
+type galaxyServer struct {
+	g *Galaxy
+}
+
+func (s *galaxyServer) AddNetwork(ctx context.Context, in *rpc.NetworkRequest) (*rpc.NetworkReply, error) {
+	return s.g.serveNetwork(ctx, cniutil.COMMAND_ADD, in)
+}
+
+func (s *galaxyServer) DelNetwork(ctx context.Context, in *rpc.NetworkRequest) (*rpc.NetworkReply, error) {
+	return s.g.serveNetwork(ctx, cniutil.COMMAND_DEL, in)
+}
+
+func (s *galaxyServer) CheckNetwork(ctx context.Context, in *rpc.NetworkRequest) (*rpc.NetworkReply, error) {
+	return s.g.serveNetwork(ctx, cniutil.COMMAND_CHECK, in)
+}
+
+// serveNetwork runs in as a cni request of command. Calls whose deadlines have passed are rejected, but a started
+// request runs to the end whatever the deadline is as a /cni request does after its client goes away, since setting
+// up or tearing down a network halfway leaves it in a state neither ADD nor DEL expects.
+func (g *Galaxy) serveNetwork(ctx context.Context, command string, in *rpc.NetworkRequest) (*rpc.NetworkReply,
+	error) {
+	if err := ctx.Err(); err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	cr := &galaxyapi.CNIRequest{
+		Env: map[string]string{
+			cniutil.CNI_COMMAND:     command,
+			cniutil.CNI_CONTAINERID: in.ContainerId,
+			cniutil.CNI_NETNS:       in.Netns,
+			cniutil.CNI_IFNAME:      in.IfName,
+			cniutil.CNI_ARGS:        in.Args,
+			cniutil.CNI_PATH:        in.Path,
+		},
+		Config: in.Config,
+	}
+	req, err := cr.PodRequest()
+	if err != nil {
+		glog.Warningf("bad request %v", err)
+		return nil, g.callError(err)
+	}
+	req.Path = g.cniPath(req.Path)
+	result, err := g.requestFunc(req)
+	if err != nil {
+		return nil, g.callError(err)
+	}
+	return &rpc.NetworkReply{Result: result}, nil
+}
+
+// callError converts an error of a cni request to the status of the call. Cni errors, which /cni writes in bodies,
+// are attached as details.
+func (g *Galaxy) callError(err error) error {
+	var (
+		code   codes.Code
+		cniErr *types.Error
+	)
+	switch e := err.(type) {
+	case *galaxyapi.RequestError:
+		code, cniErr = codes.InvalidArgument, e.CNIError()
+	case *galaxyapi.SandboxGoneError:
+		code, cniErr = codes.NotFound, e.CNIError()
+	case *galaxyapi.MaintenanceError:
+		code, cniErr = codes.Unavailable, e.CNIError()
+	case *types.Error:
+		if e.Code != galaxyapi.ErrCodeIPConflict {
+			return status.Error(codes.Internal, g.explainPermissionError(err).Error())
+		}
+		code, cniErr = codes.AlreadyExists, e
+	default:
+		return status.Error(codes.Internal, g.explainPermissionError(err).Error())
+	}
+	st, detailErr := status.New(code, err.Error()).WithDetails(&rpc.Error{Code: uint32(cniErr.Code), Msg: cniErr.Msg,
+		Details: cniErr.Details})
+	if detailErr != nil {
+		return status.Error(code, err.Error())
+	}
+	return st.Err()
+}
+
+// interceptCall authenticates and logs calls as authenticate and accessLog do for requests of the galaxy socket
+func (g *Galaxy) interceptCall(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (resp interface{}, err error) {
+	start := time.Now()
+	defer func() {
+		glog.Infof("access %s from %s: %s, %v", info.FullMethod, callPeer(ctx), status.Code(err), time.Since(start))
+	}()
+	if g.socketToken != "" {
+		var token string
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(private.GalaxyTokenMetadata)) > 0 {
+			token = md.Get(private.GalaxyTokenMetadata)[0]
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(g.socketToken)) != 1 {
+			return nil, status.Error(codes.Unauthenticated, "bad token")
+		}
+	}
+	return handler(ctx, req)
+}
+
+// callPeer returns the process which made the call
+func callPeer(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(peerAuthInfo); ok && info.cred != nil {
+			return info.cred.String()
+		}
+	}
+	return "unknown peer"
+}
+
+// peerCreds hands credentials of peers identified by peercred listeners to calls as their auth infos. It changes
+// nothing on the wire, clients dial without transport security.
+type peerCreds struct{}
+
+type peerAuthInfo struct {
+	cred *peercred.Cred
+}
+
+func (peerAuthInfo) AuthType() string {
+	return "peercred"
+}
+
+func (peerCreds) ClientHandshake(_ context.Context, _ string, conn net.Conn) (net.Conn, credentials.AuthInfo,
+	error) {
+	return conn, peerAuthInfo{}, nil
+}
+
+func (peerCreds) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	var info peerAuthInfo
+	if c, ok := conn.(*peercred.Conn); ok {
+		info.cred = c.Cred
+	}
+	return conn, info, nil
+}
+
+func (peerCreds) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "peercred"}
+}
+
+func (peerCreds) Clone() credentials.TransportCredentials {
+	return peerCreds{}
+}
+
+func (peerCreds) OverrideServerName(string) error {
+	return nil
+}
@@ -0,0 +1,196 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	t020 "github.com/containernetworking/cni/pkg/types/020"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/metrics"
+)
+
+var checkRepairs = metrics.NewCounterVec("galaxy_check_repairs_total", "Number of dataplane drifts of pods "+
+	"repaired by CHECK requests", "drift")
+
+// checkResult serves CHECK requests. Unlike loadResult, it repairs the drift of the dataplane from the cached
+// result in place, e.g. a link set down, a missing address or route and a flushed DNAT rule, instead of failing
+// and making kubelet recreate the pod. It fails if the drift can't be repaired, e.g. the interface is gone.
+func (g *Galaxy) checkResult(req *galaxyapi.PodRequest) error {
+	data, err := g.results.Get(req.ContainerID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no cached result of %s", req.ContainerID)
+		}
+		return err
+	}
+	var c cachedResult
+	if err := json.Unmarshal(data, &c); err != nil {
+		g.dropResult(req.ContainerID)
+		return fmt.Errorf("bad cached result: %v", err)
+	}
+	if !c.matches(req) {
+		g.dropResult(req.ContainerID)
+		return fmt.Errorf("cached result is for pod %s_%s netns %s ifname %s", c.PodName, c.PodNamespace,
+			c.Netns, c.IfName)
+	}
+	if !g.ownsContainer(req) {
+		g.dropResult(req.ContainerID)
+		return fmt.Errorf("cached result is for another pod of the same name")
+	}
+	result, err := parseResult(c.Result)
+	if err != nil {
+		return err
+	}
+	if result.IP4 == nil {
+		return fmt.Errorf("no ipv4 in result")
+	}
+	if err := repairIface(&c, result); err != nil {
+		g.dropResult(req.ContainerID)
+		return fmt.Errorf("cached result diverges from dataplane: %v", err)
+	}
+	if err := g.repairPortMapping(req, &c); err != nil {
+		return err
+	}
+	return checkDelegates(req)
+}
+
+// checkDelegates passes CHECK requests with results of ADD requests to plugins of networks of the container other
+// than galaxy's, whose configs are of CNI 0.4.0 or later. Galaxy's plugins don't know CHECK, repairIface checks what
+// they set up instead.
+func checkDelegates(req *galaxyapi.PodRequest) error {
+	infos, err := cniutil.LoadNetworkInfo(req.ContainerID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no network info of %s", req.ContainerID)
+		}
+		return err
+	}
+	args := *req.CmdArgs
+	for _, info := range infos {
+		args.Args = strings.TrimRight(fmt.Sprintf("%s;%s", args.Args, cniutil.BuildCNIArgs(info.Args)), ";")
+		t, _ := info.Conf["type"].(string)
+		v, _ := info.Conf["cniVersion"].(string)
+		// infos saved by previous versions have no results to check against
+		if _, builtin := networkSchemas[t]; builtin || !cniutil.SupportsCheck(v) || len(info.PrevResult) == 0 {
+			continue
+		}
+		if err := cniutil.DelegateCheck(info.Conf, info.PrevResult, &args, info.IfName); err != nil {
+			return fmt.Errorf("network %s fails check: %v", info.NetworkType, err)
+		}
+	}
+	return nil
+}
+
+// repairIface makes the interface of the netns up, having the ip and routes of result
+func repairIface(c *cachedResult, result *t020.Result) error {
+	netns, err := ns.GetNS(c.Netns)
+	if err != nil {
+		return err
+	}
+	defer netns.Close() // nolint: errcheck
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(c.IfName)
+		if err != nil {
+			return err
+		}
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			if err := netlink.LinkSetUp(link); err != nil {
+				return fmt.Errorf("failed to set %s up: %v", c.IfName, err)
+			}
+			glog.Warningf("repaired %s of %s which was down", c.IfName, c.Netns)
+			checkRepairs.WithLabelValues("link_down").Inc()
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		if !hasAddr(addrs, result.IP4.IP.IP) {
+			if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: &result.IP4.IP}); err != nil {
+				return fmt.Errorf("failed to add ip %s to %s: %v", result.IP4.IP.String(), c.IfName, err)
+			}
+			glog.Warningf("repaired missing ip %s of %s in %s", result.IP4.IP.String(), c.IfName, c.Netns)
+			checkRepairs.WithLabelValues("address").Inc()
+		}
+		for _, r := range result.IP4.Routes {
+			gw := r.GW
+			if gw == nil {
+				gw = result.IP4.Gateway
+			}
+			if err := ip.AddRoute(&r.Dst, gw, link); err != nil {
+				if os.IsExist(err) {
+					continue
+				}
+				return fmt.Errorf("failed to add route '%v via %v dev %v': %v", r.Dst, gw, c.IfName, err)
+			}
+			glog.Warningf("repaired missing route %v via %v of %s in %s", r.Dst, gw, c.IfName, c.Netns)
+			checkRepairs.WithLabelValues("route").Inc()
+		}
+		return nil
+	})
+}
+
+func hasAddr(addrs []netlink.Addr, ip net.IP) bool {
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// repairPortMapping restores the port file and the hostport and DNAT rules of the cached result
+func (g *Galaxy) repairPortMapping(req *galaxyapi.PodRequest, c *cachedResult) error {
+	if len(c.Ports) == 0 {
+		return nil
+	}
+	if ports, err := k8s.ConsumePort(req.ContainerID); err != nil || len(ports) != len(c.Ports) {
+		data, err := json.Marshal(c.Ports)
+		if err != nil {
+			return fmt.Errorf("failed to marshal ports: %v", err)
+		}
+		if err := k8s.SavePort(req.ContainerID, data); err != nil {
+			return fmt.Errorf("failed to save ports %v", err)
+		}
+		glog.Warningf("%v: repaired missing port file", req)
+		checkRepairs.WithLabelValues("port_file").Inc()
+	}
+	rules := g.hostportRules()
+	missing, err := rules.MissingPortMappings(c.Ports)
+	if err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if err := rules.SetupPortMapping(missing); err != nil {
+		return fmt.Errorf("failed to setup port mapping %v: %v", missing, err)
+	}
+	glog.Warningf("%v: repaired missing port mapping %v", req, missing)
+	checkRepairs.WithLabelValues("dnat").Add(float64(len(missing)))
+	return nil
+}
@@ -0,0 +1,171 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/utils/ldflags"
+)
+
+const (
+	// agentLeaseDurationFactor is the lease duration in heartbeat intervals, a few renewals may fail in a row
+	// before the lease expires
+	agentLeaseDurationFactor = 4
+	// heartbeatRetryDelay is the delay of the first retry after a failed renewal, it doubles on each failure in a
+	// row up to the lease duration, so that nodes don't hammer an overloaded apiserver
+	heartbeatRetryDelay = time.Second
+)
+
+// startHeartbeat registers galaxy of the node to galaxy-ipam and renews the registration periodically by an agent
+// lease, galaxy-ipam stops allocating ips to nodes whose leases are not renewed in time
+func (g *Galaxy) startHeartbeat() {
+	if g.HeartbeatInterval == 0 {
+		return
+	}
+	leaseDuration := agentLeaseDurationFactor * g.HeartbeatInterval
+	go func() {
+		var lease *coordinationv1.Lease
+		var failures int
+		for {
+			var err error
+			lease, err = g.renewAgentLease(lease, leaseDuration)
+			delay := g.HeartbeatInterval
+			if err != nil {
+				delay = heartbeatDelay(failures, leaseDuration)
+				failures++
+				glog.Warningf("failed to renew agent lease %d times in a row, retrying in %v: %v", failures, delay,
+					err)
+			} else if failures != 0 {
+				glog.Infof("renewed agent lease after %d failures", failures)
+				failures = 0
+			}
+			select {
+			case <-g.quitChan:
+				return
+			case <-time.After(wait.Jitter(delay, 0.1)):
+			}
+		}
+	}()
+}
+
+// heartbeatDelay returns the delay of the next renewal after failures renewals failed in a row
+func heartbeatDelay(failures int, max time.Duration) time.Duration {
+	delay := heartbeatRetryDelay
+	for i := 0; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// renewAgentLease creates or renews the agent lease of the node with the registration of galaxy. lease is the
+// lease renewed last time, it is updated without getting it again. It returns the renewed lease, or nil on errors
+// so that the next renewal gets the latest one.
+func (g *Galaxy) renewAgentLease(lease *coordinationv1.Lease, leaseDuration time.Duration) (*coordinationv1.Lease,
+	error) {
+	nodeName := k8s.GetHostname()
+	leases := g.client.CoordinationV1().Leases(constant.AgentLeaseNamespace)
+	registration, err := json.Marshal(g.agentRegistration())
+	if err != nil {
+		return nil, err
+	}
+	if lease == nil {
+		lease, err = leases.Get(constant.AgentLeaseName(nodeName), metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			lease = g.newAgentLease(nodeName)
+			setAgentLease(lease, nodeName, string(registration), leaseDuration)
+			return leases.Create(lease)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	lease = lease.DeepCopy()
+	setAgentLease(lease, nodeName, string(registration), leaseDuration)
+	return leases.Update(lease)
+}
+
+// newAgentLease returns an agent lease owned by the node, so that it is deleted along with the node
+func (g *Galaxy) newAgentLease(nodeName string) *coordinationv1.Lease {
+	lease := &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Name: constant.AgentLeaseName(nodeName),
+		Namespace: constant.AgentLeaseNamespace}}
+	node, err := g.client.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if err != nil {
+		glog.Warningf("failed to get node %s, creating agent lease without owner: %v", nodeName, err)
+		return lease
+	}
+	lease.OwnerReferences = []metav1.OwnerReference{{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "Node",
+		Name: nodeName, UID: node.UID}}
+	return lease
+}
+
+func setAgentLease(lease *coordinationv1.Lease, nodeName, registration string, leaseDuration time.Duration) {
+	if lease.Annotations == nil {
+		lease.Annotations = map[string]string{}
+	}
+	lease.Annotations[constant.AgentRegistrationAnnotation] = registration
+	seconds := int32(leaseDuration / time.Second)
+	now := metav1.NewMicroTime(time.Now())
+	lease.Spec.HolderIdentity = &nodeName
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.RenewTime = &now
+}
+
+// agentRegistration returns the version, features, networks and subnets of galaxy of the node
+func (g *Galaxy) agentRegistration() *constant.AgentRegistration {
+	r := &constant.AgentRegistration{
+		NodeFeatures: constant.NodeFeatures{GitCommit: ldflags.GIT_COMMIT, Features: supportedFeatures},
+		Networks:     map[string]string{},
+	}
+	for name, conf := range g.networkConfs() {
+		typ, _ := conf["type"].(string)
+		r.Networks[name] = typ
+	}
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		glog.Warningf("failed to list addresses: %v", err)
+		return r
+	}
+	subnets := map[string]bool{}
+	for _, addr := range addrs {
+		if !addr.IP.IsGlobalUnicast() {
+			continue
+		}
+		subnet := net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}
+		subnets[subnet.String()] = true
+	}
+	for subnet := range subnets {
+		r.Subnets = append(r.Subnets, subnet)
+	}
+	sort.Strings(r.Subnets)
+	return r
+}
@@ -0,0 +1,119 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+)
+
+// maxIfNameLen is IFNAMSIZ minus the trailing null
+const maxIfNameLen = 15
+
+// ifNameData are fields of interface name templates of InterfaceNames
+type ifNameData struct {
+	// Index is the position of the attachment, 0 is the primary one
+	Index int
+	// Network is the network name of the attachment
+	Network string
+	// Vlan is the vlan of the first ip galaxy-ipam binds to the pod for the network, 0 if none
+	Vlan uint16
+}
+
+// parseInterfaceNames parses interface name templates of InterfaceNames keyed by network names
+func parseInterfaceNames(names map[string]string) (map[string]*template.Template, error) {
+	templates := map[string]*template.Template{}
+	for network, name := range names {
+		t, err := template.New(network).Option("missingkey=error").Parse(name)
+		if err != nil {
+			return nil, fmt.Errorf("bad interface name of network %s: %v", network, err)
+		}
+		templates[network] = t
+	}
+	return templates, nil
+}
+
+// nameInterfaces sets interface names of attachments of a pod. The primary attachment is named ifName of the
+// request, e.g. eth0, as kubelet reads the pod ip from it. Others are named by requested names of the networks
+// annotation, InterfaceNames templates of their networks or format of their index, e.g. eth<index>, in order, so
+// that they are stable across restarts of the pod as long as its annotations are.
+func (g *Galaxy) nameInterfaces(networkInfos []*cniutil.NetworkInfo, requested []string, ifName,
+	format string) error {
+	seen := map[string]int{}
+	for i, info := range networkInfos {
+		name, err := g.interfaceName(info, i, requested[i], ifName, format)
+		if err != nil {
+			return err
+		}
+		if err := validateIfName(name); err != nil {
+			return fmt.Errorf("bad interface name of network %s: %v", info.NetworkType, err)
+		}
+		if j, ok := seen[name]; ok {
+			return fmt.Errorf("networks %s and %s have the same interface name %s", networkInfos[j].NetworkType,
+				info.NetworkType, name)
+		}
+		seen[name] = i
+		info.IfName = name
+	}
+	return nil
+}
+
+func (g *Galaxy) interfaceName(info *cniutil.NetworkInfo, idx int, requested, ifName, format string) (string,
+	error) {
+	if idx == 0 {
+		return ifName, nil
+	}
+	if requested != "" {
+		return requested, nil
+	}
+	t, ok := g.ifNameTemplate(info.NetworkType)
+	if !ok {
+		return fmt.Sprintf(format, idx), nil
+	}
+	data := ifNameData{Index: idx, Network: info.NetworkType}
+	if ipInfos := info.Args[constant.IPInfosKey]; ipInfos != "" {
+		var infos []constant.IPInfo
+		if err := json.Unmarshal([]byte(ipInfos), &infos); err == nil && len(infos) > 0 {
+			data.Vlan = infos[0].Vlan
+		}
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to name interface of network %s: %v", info.NetworkType, err)
+	}
+	return buf.String(), nil
+}
+
+// validateIfName checks name is a valid linux interface name
+func validateIfName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid interface name %q", name)
+	}
+	if len(name) > maxIfNameLen {
+		return fmt.Errorf("interface name %s is longer than %d", name, maxIfNameLen)
+	}
+	if strings.ContainsAny(name, "/: \t\n") {
+		return fmt.Errorf("invalid interface name %q", name)
+	}
+	return nil
+}
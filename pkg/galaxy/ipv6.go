@@ -0,0 +1,153 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/galaxy/options"
+	"tkestack.io/galaxy/pkg/network/ndguard"
+	galaxyutils "tkestack.io/galaxy/pkg/utils"
+)
+
+// ndGuardDir stores bridge ports of containers to clean up their ebtables rules, gc cleans up files of dead
+// containers
+const ndGuardDir = "/var/lib/cni/galaxy/ndguard"
+
+// ipv6Mode returns the ipv6 mode of a pod of networkInfos, ipv6_mode of its networks overrides IPv6Mode. Networks
+// share the netns of the pod, so those setting it must agree.
+func (g *Galaxy) ipv6Mode(networkInfos []*cniutil.NetworkInfo) (string, error) {
+	mode, from := "", ""
+	for _, info := range networkInfos {
+		m, _ := info.Conf["ipv6_mode"].(string)
+		if m == "" {
+			continue
+		}
+		if mode != "" && m != mode {
+			return "", fmt.Errorf("network %s requires ipv6 mode %s while network %s requires %s", info.NetworkType,
+				m, from, mode)
+		}
+		mode, from = m, info.NetworkType
+	}
+	if mode == "" {
+		return g.IPv6Mode, nil
+	}
+	return mode, nil
+}
+
+// hardensIPv6 returns if ipv6 of any pod may be hardened
+func (g *Galaxy) hardensIPv6() bool {
+	if g.IPv6Mode == options.IPv6Harden {
+		return true
+	}
+	for _, conf := range g.networkConfs() {
+		if conf["ipv6_mode"] == options.IPv6Harden {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareIPv6 applies the ipv6 mode to the netns before setting up its networks
+func (g *Galaxy) prepareIPv6(req *galaxyapi.PodRequest, mode string) {
+	switch mode {
+	case options.IPv6Keep:
+	case options.IPv6Harden:
+		// interfaces moved into the netns later inherit default
+		if err := galaxyutils.HardenIPv6(req.Netns); err != nil {
+			glog.Warningf("Error harden ipv6 %v", err)
+		}
+	default:
+		if err := disableIPv6(req.Netns); err != nil {
+			glog.Warningf("Error disable ipv6 %v", err)
+		}
+	}
+}
+
+// guardIPv6 hardens interfaces of the netns once its networks are set up and drops rogue neighbor discovery packets
+// on their bridge ports
+func (g *Galaxy) guardIPv6(req *galaxyapi.PodRequest, pod *corev1.Pod) error {
+	networkInfos, err := g.resolveNetworks(req, pod)
+	if err != nil {
+		return err
+	}
+	if mode, err := g.ipv6Mode(networkInfos); err != nil || mode != options.IPv6Harden {
+		return err
+	}
+	ports, ifNames, err := bridgePorts(req.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to find bridge ports: %v", err)
+	}
+	if err := galaxyutils.HardenIPv6(req.Netns, ifNames...); err != nil {
+		return fmt.Errorf("failed to harden ipv6: %v", err)
+	}
+	if len(ports) == 0 {
+		// e.g. macvlan, ipvlan or sriov interfaces which have no port guardable by ebtables
+		glog.V(4).Infof("%s has no bridge port to guard", req.ContainerID)
+		return nil
+	}
+	if err := g.ndGuard.Setup(req.ContainerID, ports); err != nil {
+		if err1 := g.ndGuard.Cleanup(req.ContainerID); err1 != nil {
+			return fmt.Errorf("%v, and failed to clean up: %v", err, err1)
+		}
+		return err
+	}
+	return nil
+}
+
+// bridgePorts returns host side peers of veths of the netns which are attached to bridges, and names of all non
+// loopback interfaces of the netns
+func bridgePorts(nns string) ([]ndguard.Port, []string, error) {
+	peers := map[int]string{}
+	var ifNames []string
+	if err := ns.WithNetNSPath(nns, func(_ ns.NetNS) error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			if link.Attrs().Name == "lo" {
+				continue
+			}
+			ifNames = append(ifNames, link.Attrs().Name)
+			// the parent index of a veth is the index of its peer
+			if _, ok := link.(*netlink.Veth); ok && link.Attrs().ParentIndex != 0 {
+				peers[link.Attrs().ParentIndex] = link.Attrs().HardwareAddr.String()
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	var ports []ndguard.Port
+	for index, mac := range peers {
+		peer, err := netlink.LinkByIndex(index)
+		if err != nil {
+			return nil, nil, err
+		}
+		if peer.Attrs().MasterIndex != 0 {
+			ports = append(ports, ndguard.Port{Name: peer.Attrs().Name, MAC: mac})
+		}
+	}
+	return ports, ifNames, nil
+}
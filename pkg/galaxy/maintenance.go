@@ -0,0 +1,166 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/metrics"
+	"tkestack.io/galaxy/pkg/utils/store"
+)
+
+const (
+	// maintenancePath persists the maintenance mode of the node network across galaxy restarts
+	maintenancePath       = "/var/lib/cni/galaxy/maintenance/node"
+	maintenanceReason     = "NetworkMaintenance"
+	maintenanceDoneReason = "NetworkMaintenanceDone"
+)
+
+var inMaintenance = metrics.NewGaugeVec("galaxy_network_maintenance", "1 if the node network is in maintenance "+
+	"and ADD requests are rejected, 0 otherwise")
+
+// Maintenance is the maintenance mode of the node network, the response of /admin/maintenance
+type Maintenance struct {
+	// Reason is why the node network is in maintenance, e.g. an uplink maintenance window
+	Reason string
+	// Since is when the node network entered maintenance
+	Since time.Time
+}
+
+// loadMaintenance returns the maintenance mode of the node network, nil if it is not in maintenance
+func loadMaintenance() (*Maintenance, error) {
+	data, err := ioutil.ReadFile(maintenancePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var m Maintenance
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("bad maintenance state %s: %v", string(data), err)
+	}
+	return &m, nil
+}
+
+// maintenance returns the maintenance mode of the node network, nil if it is not in maintenance. The node is
+// considered in maintenance if its state can't be read, ADD requests are retried by kubelet anyway.
+func (g *Galaxy) maintenance() *Maintenance {
+	m, err := loadMaintenance()
+	if err != nil {
+		glog.Warningf("failed to load maintenance state: %v", err)
+		return &Maintenance{Reason: err.Error()}
+	}
+	if m != nil {
+		inMaintenance.WithLabelValues().Set(1)
+	} else {
+		inMaintenance.WithLabelValues().Set(0)
+	}
+	return m
+}
+
+// getMaintenance responds with the maintenance mode of the node network, 404 if it is not in maintenance
+func (g *Galaxy) getMaintenance(r *restful.Request, w *restful.Response) {
+	m, err := loadMaintenance()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	if m == nil {
+		http.Error(w, "node network is not in maintenance", http.StatusNotFound)
+		return
+	}
+	writeMaintenance(w, m)
+}
+
+// enterMaintenance puts the node network into maintenance with the reason query parameter. ADD requests of new
+// pods are rejected and /readyz fails until maintenance is left, while DEL and CHECK requests and background repairs
+// proceed. Entering maintenance again only updates the reason.
+func (g *Galaxy) enterMaintenance(r *restful.Request, w *restful.Response) {
+	reason := r.QueryParameter("reason")
+	if reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+	m, err := loadMaintenance()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	if m == nil {
+		m = &Maintenance{Since: time.Now()}
+	}
+	m.Reason = reason
+	data, err := json.Marshal(m)
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(maintenancePath), 0700); err == nil {
+			err = store.WriteFile(maintenancePath, data, 0600)
+		}
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to save maintenance state: %v", err), http.StatusInternalServerError)
+		return
+	}
+	inMaintenance.WithLabelValues().Set(1)
+	glog.Infof("node network entered maintenance: %s", reason)
+	g.recordNodeEvent(corev1.EventTypeNormal, maintenanceReason, "node network entered maintenance, new pods are "+
+		"rejected: %s", reason)
+	writeMaintenance(w, m)
+}
+
+// leaveMaintenance takes the node network out of maintenance
+func (g *Galaxy) leaveMaintenance(r *restful.Request, w *restful.Response) {
+	if err := os.Remove(maintenancePath); err != nil && !os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("failed to remove maintenance state: %v", err), http.StatusInternalServerError)
+		return
+	}
+	inMaintenance.WithLabelValues().Set(0)
+	glog.Infof("node network left maintenance")
+	g.recordNodeEvent(corev1.EventTypeNormal, maintenanceDoneReason, "node network left maintenance")
+}
+
+func (g *Galaxy) recordNodeEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	if g.recorder == nil {
+		return
+	}
+	hostname := k8s.GetHostname()
+	g.recorder.Eventf(&corev1.ObjectReference{Kind: "Node", Name: hostname, UID: types.UID(hostname)},
+		eventType, reason, messageFmt, args...)
+}
+
+func writeMaintenance(w *restful.Response, m *Maintenance) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		glog.Warningf("Error writing maintenance HTTP response: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"fmt"
+
+	t020 "github.com/containernetworking/cni/pkg/types/020"
+	corev1 "k8s.io/api/core/v1"
+	glog "k8s.io/klog"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/network/mtu"
+)
+
+// mssClampDir stores pod ips and mss of containers to clean up their rules, gc cleans up files of dead containers
+const mssClampDir = "/var/lib/cni/galaxy/mss"
+
+// setupMTU applies the mtu annotation of the pod to its interface whatever network it is on. Like connection limits
+// it fails the request, a pod left with the default mtu would hang on large packets across the lower mtu path.
+func (g *Galaxy) setupMTU(req *galaxyapi.PodRequest, pod *corev1.Pod, result *t020.Result) error {
+	v := pod.Annotations[k8s.MTUAnnotation]
+	if v == "" {
+		return nil
+	}
+	o, err := mtu.ParseOverride(v)
+	if err != nil {
+		return fmt.Errorf("bad %s annotation: %v", k8s.MTUAnnotation, err)
+	}
+	if err := mtu.SetMTU(req.Netns, req.IfName, o.MTU); err != nil {
+		return err
+	}
+	glog.V(4).Infof("set mtu of pod %s to %d", k8s.GetPodFullName(pod.Name, pod.Namespace), o.MTU)
+	if !o.ClampMSS {
+		return nil
+	}
+	if result.IP4 == nil {
+		return fmt.Errorf("no ipv4 address to clamp mss of")
+	}
+	if err := g.mssClamp.Setup(req.ContainerID, string(pod.UID), result.IP4.IP.IP.String(), o); err != nil {
+		if err1 := g.mssClamp.Cleanup(req.ContainerID); err1 != nil {
+			return fmt.Errorf("%v, and failed to clean up: %v", err, err1)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"math"
+
+	"tkestack.io/galaxy/pkg/utils/confcheck"
+)
+
+// cniSchema has fields of all cni network configs
+var cniSchema = confcheck.Schema{
+	"cniVersion":    {Kind: confcheck.String},
+	"name":          {Kind: confcheck.String},
+	"type":          {Kind: confcheck.String, Required: true, Check: confcheck.NonEmpty},
+	"ipam":          {Kind: confcheck.Object},
+	"dns":           {Kind: confcheck.Object, Check: validateDNS},
+	"linkTuning":    {Kind: confcheck.Object, Check: validateLinkTuning},
+	"capabilities":  {Kind: confcheck.Object},
+	"runtimeConfig": {Kind: confcheck.Object},
+	"args":          {Kind: confcheck.Object},
+	"prevResult":    {Kind: confcheck.Object},
+}
+
+var vethSchema = cniSchema.Extend(confcheck.Schema{
+	"routeSrc": {Kind: confcheck.String},
+	"mtu":      {Kind: confcheck.Number, Check: confcheck.IntRange(0, math.MaxUint16)},
+})
+
+// networkSchemas are schemas of galaxy's network types, configs of other types are passed to their plugins as is
+var networkSchemas = map[string]confcheck.Schema{
+	flannelNetworkType: cniSchema.Extend(confcheck.Schema{
+		"delegate":   {Kind: confcheck.Object, Check: validateDelegate},
+		"subnetFile": {Kind: confcheck.String},
+		"dataDir":    {Kind: confcheck.String},
+	}),
+	"galaxy-veth": vethSchema,
+	"galaxy-k8s-vlan": cniSchema.Extend(confcheck.Schema{
+		"device":                 {Kind: confcheck.String, Required: true, Check: confcheck.NonEmpty},
+		"switch":                 {Kind: confcheck.String, Check: confcheck.OneOf("", "bridge", "macvlan", "ipvlan", "pure", "sriov")},
+		"vf_num":                 {Kind: confcheck.Number, Check: confcheck.IntRange(0, math.MaxUint16)},
+		"disable_default_bridge": {Kind: confcheck.Bool},
+		"default_bridge_name":    {Kind: confcheck.String},
+		"bridge_name_prefix":     {Kind: confcheck.String},
+		"vlan_name_prefix":       {Kind: confcheck.String},
+		"gratuitous_arp_request": {Kind: confcheck.Bool},
+		"nonlocal_bind":          {Kind: confcheck.String, Check: confcheck.OneOf("", "host", "none")},
+		"multicast":              {Kind: confcheck.Object, Check: validateMulticast},
+		"migrate_route_tables":   {Kind: confcheck.Array, Check: eachInt(1, math.MaxUint32)},
+		"address_labels":         {Kind: confcheck.String, Check: confcheck.OneOf("", "clear", "remap")},
+		"address_label_map":      {Kind: confcheck.Object},
+		"exclude_addresses":      {Kind: confcheck.Array, Check: eachString(nil)},
+		"ipv6_mode":              {Kind: confcheck.String, Check: confcheck.OneOf("", "disable", "harden", "keep")},
+		"egress_gateway":         {Kind: confcheck.String, Check: confcheck.OneOf("", "vlan", "overlay")},
+	}).Extend(bridgeSchema),
+	"galaxy-k8s-sriov": cniSchema.Extend(confcheck.Schema{
+		"device": {Kind: confcheck.String, Required: true, Check: confcheck.NonEmpty},
+		"vf_num": {Kind: confcheck.Number, Required: true, Check: confcheck.IntRange(1, math.MaxUint16)},
+	}),
+	"tke-route-eni": cniSchema.Extend(confcheck.Schema{
+		"eni":        {Kind: confcheck.String},
+		"routeTable": {Kind: confcheck.Number, Check: confcheck.IntRange(1, math.MaxUint32)},
+	}),
+}
+
+// bridgeSchema has fields tuning bridges of vlan networks
+var bridgeSchema = confcheck.Schema{
+	"bridge_stp":               {Kind: confcheck.Bool},
+	"bridge_forward_delay":     {Kind: confcheck.Number, Check: confcheck.IntRange(0, 30)},
+	"bridge_ageing_time":       {Kind: confcheck.Number, Check: confcheck.IntRange(0, math.MaxInt32)},
+	"bridge_vlan_default_pvid": {Kind: confcheck.Number, Check: confcheck.IntRange(0, 4094)},
+}
+
+var multicastSchema = confcheck.Schema{
+	"snooping":     {Kind: confcheck.Bool},
+	"querier":      {Kind: confcheck.Bool},
+	"igmp_version": {Kind: confcheck.Number, Check: confcheck.IntRange(0, 3)},
+	"routes":       {Kind: confcheck.Array, Check: eachString(nil)},
+}
+
+func validateMulticast(v interface{}) error {
+	obj, _ := v.(map[string]interface{})
+	return multicastSchema.Validate(obj)
+}
+
+// eachInt returns a Check accepting arrays of integer numbers within [min, max]
+func eachInt(min, max int64) func(v interface{}) error {
+	check := confcheck.IntRange(min, max)
+	return func(v interface{}) error {
+		items, _ := v.([]interface{})
+		for _, item := range items {
+			if err := check(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// validateDelegate validates the delegate of flannel networks which is galaxy-veth usually
+func validateDelegate(v interface{}) error {
+	delegate, _ := v.(map[string]interface{})
+	if delegate["type"] != "galaxy-veth" {
+		return nil
+	}
+	return vethSchema.Validate(delegate)
+}
+
+// validateNetworkConf rejects unknown fields, fields of wrong types and invalid values of configs of galaxy's networks
+func validateNetworkConf(conf map[string]interface{}) error {
+	netType, _ := conf["type"].(string)
+	schema, ok := networkSchemas[netType]
+	if !ok {
+		return nil
+	}
+	return schema.Validate(conf)
+}
@@ -0,0 +1,94 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"time"
+
+	t020 "github.com/containernetworking/cni/pkg/types/020"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/network/netmark"
+)
+
+// setupNetworkMarks syncs marks of pod traffic periodically, it removes rules left by previous configs if there is
+// none
+func (g *Galaxy) setupNetworkMarks() error {
+	h, err := netmark.New(g.NetworkMarks)
+	if err != nil {
+		return err
+	}
+	syncMarks := func() error {
+		return h.Sync(g.networkMarkPods())
+	}
+	if err := syncMarks(); err != nil {
+		return err
+	}
+	if len(g.NetworkMarks) == 0 {
+		return nil
+	}
+	g.netMark = h
+	g.addFirewallLoop("network marks", time.Minute, syncMarks)
+	return nil
+}
+
+// resultNetwork returns the network of the result of an ADD request, which is the last network of the pod
+func resultNetwork(containerID string) string {
+	infos, err := cniutil.LoadNetworkInfo(containerID)
+	if err != nil || len(infos) == 0 {
+		return ""
+	}
+	return infos[len(infos)-1].NetworkType
+}
+
+// networkMarkPods returns ips and networks of pods having cached results
+func (g *Galaxy) networkMarkPods() []netmark.Pod {
+	containerIDs, err := g.results.Keys()
+	if err != nil {
+		glog.Warningf("failed to list cached results: %v", err)
+		return nil
+	}
+	var pods []netmark.Pod
+	for _, containerID := range containerIDs {
+		data, err := g.results.Get(containerID)
+		if err != nil {
+			continue
+		}
+		var cached cachedResult
+		if err := json.Unmarshal(data, &cached); err != nil {
+			continue
+		}
+		result, err := parseResult(cached.Result)
+		if err != nil || result.IP4 == nil {
+			continue
+		}
+		pods = append(pods, netmark.Pod{Name: cached.PodNamespace + "/" + cached.PodName,
+			Network: resultNetwork(containerID), IP: result.IP4.IP.IP})
+	}
+	return pods
+}
+
+// markNetwork marks traffic of the pod of an ADD request before it starts
+func (g *Galaxy) markNetwork(req *galaxyapi.PodRequest, result *t020.Result) error {
+	if g.netMark == nil || result.IP4 == nil {
+		return nil
+	}
+	return g.netMark.Add(netmark.Pod{Name: req.PodNamespace + "/" + req.PodName,
+		Network: resultNetwork(req.ContainerID), IP: result.IP4.IP.IP})
+}
@@ -0,0 +1,116 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	k8sutil "tkestack.io/galaxy/pkg/api/k8s/utils"
+)
+
+// startNodeIPAnnotation keeps constant.NodeIPsAnnotation of the node in sync with ips of NodeIPInterface, so that
+// galaxy-ipam selects the node subnet of multi-homed nodes by them instead of status addresses of the node
+func (g *Galaxy) startNodeIPAnnotation() {
+	if g.NodeIPInterface == "" {
+		return
+	}
+	var annotated string
+	go wait.Until(func() {
+		ips, err := interfaceIPs(g.NodeIPInterface)
+		if err != nil {
+			glog.Warningf("failed to get node ips: %v", err)
+			return
+		}
+		if ips == annotated {
+			return
+		}
+		if err := g.annotateNodeIPs(ips); err != nil {
+			glog.Warningf("failed to annotate node ips %s: %v", ips, err)
+			return
+		}
+		glog.Infof("annotated node ips %s of %s", ips, g.NodeIPInterface)
+		annotated = ips
+	}, time.Minute, g.quitChan)
+}
+
+// interfaceIPs returns global unicast ips of the interface joined by commas, ipv4 ones first
+func interfaceIPs(name string) (string, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return "", err
+	}
+	var ips []string
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		addrs, err := netlink.AddrList(link, family)
+		if err != nil {
+			return "", err
+		}
+		for _, addr := range addrs {
+			if addr.IP.IsGlobalUnicast() {
+				ips = append(ips, addr.IP.String())
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("%s has no global unicast ip", name)
+	}
+	return strings.Join(ips, ","), nil
+}
+
+func (g *Galaxy) annotateNodeIPs(ips string) error {
+	return g.annotateNode(map[string]string{constant.NodeIPsAnnotation: ips})
+}
+
+// annotateNode sets annotations of the node, it doesn't update the node if they are set already
+func (g *Galaxy) annotateNode(annotations map[string]string) error {
+	return wait.PollImmediate(100*time.Millisecond, 10*time.Second, func() (bool, error) {
+		node, err := g.client.CoreV1().Nodes().Get(k8s.GetHostname(), metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		changed := false
+		for k, v := range annotations {
+			if node.Annotations[k] == v {
+				continue
+			}
+			if node.Annotations == nil {
+				node.Annotations = map[string]string{}
+			}
+			node.Annotations[k] = v
+			changed = true
+		}
+		if !changed {
+			return true, nil
+		}
+		_, err = g.client.CoreV1().Nodes().Update(node)
+		if err == nil {
+			return true, nil
+		}
+		if k8sutil.ShouldRetry(err) {
+			return false, nil
+		}
+		return false, err
+	})
+}
@@ -0,0 +1,200 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package options
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+	"tkestack.io/galaxy/pkg/network/quarantine"
+	"tkestack.io/galaxy/pkg/utils/endpoint"
+)
+
+const (
+	configFlag              = "config"
+	dumpEffectiveConfigFlag = "dump-effective-config"
+)
+
+// ApplyConfigFile sets flags of fs from the yaml or json file at path. Keys of the file are flag names, values are
+// scalars or lists of them for slice flags, e.g. `network-policy: true` or `socket-allowed-uids: [0]`.
+// Flags set on the command line override the file, flags set in neither keep their defaults. Unknown keys and bad
+// values are errors.
+// #lizard forgives
+func ApplyConfigFile(fs *pflag.FlagSet, path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("bad config file %s: %v", path, err)
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []string
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil {
+			errs = append(errs, fmt.Sprintf("unknown flag %s", name))
+			continue
+		}
+		if name == configFlag || name == dumpEffectiveConfigFlag {
+			errs = append(errs, fmt.Sprintf("%s is only a command line flag", name))
+			continue
+		}
+		if f.Changed {
+			continue
+		}
+		value, err := flagValue(values[name])
+		if err == nil {
+			err = fs.Set(name, value)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("bad %s: %v", name, err))
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("bad config file %s: %s", path, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// flagValue converts a value of the config file to the flag syntax, lists are joined by commas as slice flags take
+// them
+func flagValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i := range v {
+			item, err := flagValue(v[i])
+			if err != nil {
+				return "", err
+			}
+			if _, ok := v[i].([]interface{}); ok {
+				return "", fmt.Errorf("nested list")
+			}
+			items[i] = item
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+// DumpEffectiveConfig writes values of all flags of fs as a config file which ApplyConfigFile accepts
+func DumpEffectiveConfig(fs *pflag.FlagSet, w io.Writer) error {
+	values := map[string]interface{}{}
+	fs.VisitAll(func(f *pflag.Flag) {
+		if f.Name == configFlag || f.Name == dumpEffectiveConfigFlag {
+			return
+		}
+		values[f.Name] = effectiveValue(f)
+	})
+	data, err := yaml.Marshal(values)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func effectiveValue(f *pflag.Flag) interface{} {
+	value := f.Value.String()
+	typ := f.Value.Type()
+	switch {
+	case strings.HasSuffix(typ, "Slice"):
+		value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+		items := []string{}
+		if value != "" {
+			items = strings.Split(value, ",")
+		}
+		return items
+	case typ == "bool":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	case strings.HasPrefix(typ, "int") || strings.HasPrefix(typ, "uint") || strings.HasPrefix(typ, "float"):
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			return n
+		}
+	}
+	return value
+}
+
+// Validate checks values of options which flags can't
+func (s *ServerRunOptions) Validate() error {
+	switch s.IPv6Mode {
+	case IPv6Disable, IPv6Harden, IPv6Keep:
+	default:
+		return fmt.Errorf("unknown ipv6 mode %q", s.IPv6Mode)
+	}
+	switch s.DuplicateIPPolicy {
+	case DuplicateIPReject, DuplicateIPReport:
+	default:
+		return fmt.Errorf("unknown duplicate ip policy %q", s.DuplicateIPPolicy)
+	}
+	for _, addr := range s.ExtraListenAddresses {
+		if _, err := endpoint.Parse(addr); err != nil {
+			return err
+		}
+	}
+	if s.HeartbeatInterval < 0 {
+		return fmt.Errorf("negative heartbeat interval %v", s.HeartbeatInterval)
+	}
+	if s.ConntrackMaxPerGB < 0 || s.ConntrackMin < 0 {
+		return fmt.Errorf("negative conntrack max per gb %d or min %d", s.ConntrackMaxPerGB, s.ConntrackMin)
+	}
+	if s.ConntrackAlertRatio < 0 || s.ConntrackAlertRatio > 1 {
+		return fmt.Errorf("conntrack alert ratio %v is not within [0, 1]", s.ConntrackAlertRatio)
+	}
+	switch s.StateStore {
+	case StateStoreFile, StateStoreCRD:
+	case StateStoreEtcd:
+		if len(s.StateStoreEtcdEndpoints) == 0 {
+			return fmt.Errorf("etcd state store requires state-store-etcd-endpoints")
+		}
+	default:
+		return fmt.Errorf("unknown state store %q", s.StateStore)
+	}
+	switch s.FirewallBackend {
+	case FirewallBackendAuto, FirewallBackendIptables, FirewallBackendNftables:
+	default:
+		return fmt.Errorf("unknown firewall backend %q", s.FirewallBackend)
+	}
+	if _, err := quarantine.ParseAllowList(strings.Join(s.QuarantineAllowedCIDRs, ",")); err != nil {
+		return fmt.Errorf("bad quarantine allowed cidrs: %v", err)
+	}
+	return nil
+}
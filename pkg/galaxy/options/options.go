@@ -17,9 +17,40 @@
 package options
 
 import (
+	"time"
+
 	"github.com/spf13/pflag"
 )
 
+const (
+	// IPv6Disable disables ipv6 of pods
+	IPv6Disable = "disable"
+	// IPv6Harden keeps ipv6 of pods but ignores router advertisements and redirects in pods and drops rogue ones
+	// sent by pods on their bridge ports
+	IPv6Harden = "harden"
+	// IPv6Keep leaves ipv6 of pods as is
+	IPv6Keep = "keep"
+
+	// DuplicateIPReject fails ADD requests whose ips are assigned to other pods of the node
+	DuplicateIPReject = "reject"
+	// DuplicateIPReport only records events of pods whose ips are assigned to other pods of the node
+	DuplicateIPReport = "report"
+
+	// StateStoreFile keeps ports and assigned ips of containers in files of the node
+	StateStoreFile = "file"
+	// StateStoreEtcd keeps them in etcd under StateStoreEtcdPrefix/<node>
+	StateStoreEtcd = "etcd"
+	// StateStoreCRD keeps them in NodeState objects of the apiserver
+	StateStoreCRD = "crd"
+
+	// FirewallBackendAuto picks nftables if the host has nft but no iptables, iptables otherwise
+	FirewallBackendAuto = "auto"
+	// FirewallBackendIptables sets up hostport rules by iptables and restores EbtablesRulesFile by ebtables-restore
+	FirewallBackendIptables = "iptables"
+	// FirewallBackendNftables sets up hostport rules by nftables and restores EbtablesRulesFile by nft
+	FirewallBackendNftables = "nftables"
+)
+
 // ServerRunOptions contains the options while running a server
 type ServerRunOptions struct {
 	Master               string
@@ -34,6 +65,75 @@ type ServerRunOptions struct {
 	// To support dynamic changing network config or node specific network config
 	NetworkConfDir string
 	CNIPaths       []string
+	// IPv6Mode is one of IPv6Disable, IPv6Harden and IPv6Keep
+	IPv6Mode string
+	// If set, master and its credentials are read from this dir, e.g. a mounted secret, instead of Master and KubeConf
+	MasterCredentialsDir string
+	// The number of chains hostport rules are sharded into by destination ports, 0 means no sharding
+	HostportShards int
+	// If true, port mapping is set up after responding to ADD requests. CHECK requests and the
+	// tkestack.io/portmapping-ready readiness gate of pods reflect its completion.
+	AsyncPortMapping bool
+	// ADD requests of flannel networks wait up to FlannelWaitTimeout for flanneld to write the subnet file, at most
+	// FlannelMaxPending of them wait at the same time
+	FlannelWaitTimeout time.Duration
+	FlannelMaxPending  int
+	// Impact budget of periodic resyncs: the number of iptables rules restored (or pods synced) per second and the
+	// burst of it, 0 means unlimited. Resyncs pause for ResyncPause once ResyncErrorRatio of recent operations fail.
+	ResyncRulesPerSecond float64
+	ResyncBurst          int
+	ResyncErrorRatio     float64
+	ResyncPause          time.Duration
+	// Peers of the galaxy socket must run as one of SocketAllowedUIDs and be one of SocketAllowedBinaries, empty
+	// lists allow any. If SocketTokenFile is set, requests must carry its content in the X-Galaxy-Token header.
+	SocketAllowedUIDs     []uint
+	SocketAllowedBinaries []string
+	SocketTokenFile       string
+	// If set, every cni request received is appended to this file which can be replayed by tools/bench
+	RequestTraceFile string
+	// If set, the json config must be signed by the private key of this ed25519 public key, see confcheck.Verifier
+	ConfigPublicKeyFile string
+	// If true, galaxy watches arp and neighbor advertisements on bridges and alerts if other macs claim pod ips
+	ARPWatch bool
+	// Ebtables rules template restored on start if the file exists, see package ebtables
+	EbtablesRulesFile string
+	// Port mappings of a deleted container are kept for ReuseWindow for the next container of the same pod with the
+	// same ip and ports, e.g. a restarted statefulset pod, 0 removes them on DEL
+	ReuseWindow time.Duration
+	// If set, ips of this interface are annotated on the node for galaxy-ipam to select the node subnet by
+	NodeIPInterface string
+	// If set, ips galaxy-ipam binds to pods of the node are announced from this device before the pods start
+	ARPWarmUpDevice string
+	// DuplicateIPPolicy is DuplicateIPReject or DuplicateIPReport
+	DuplicateIPPolicy string
+	// If set, flags not set on the command line are read from this yaml or json file, see ApplyConfigFile
+	ConfigFile string
+	// If true, galaxy prints values of all flags as a config file and exits
+	DumpEffectiveConfig bool
+	// Endpoints galaxy serves its api on besides the unix socket of its socket dir, see endpoint.Parse
+	ExtraListenAddresses []string
+	// How often galaxy renews its agent lease as the heartbeat of the node, 0 disables registration and heartbeats
+	HeartbeatInterval time.Duration
+	// nf_conntrack_max is raised to ConntrackMaxPerGB entries per GiB of memory but at least ConntrackMin on start, 0
+	// leaves it as is. Galaxy alerts once the table is ConntrackAlertRatio full.
+	ConntrackMaxPerGB   int
+	ConntrackMin        int
+	ConntrackAlertRatio float64
+	// If set, /metrics is served on this tcp address besides the galaxy socket
+	MetricsBindAddress string
+	// StateStore is StateStoreFile, StateStoreEtcd or StateStoreCRD, etcd is reached by StateStoreEtcd* options
+	StateStore              string
+	StateStoreEtcdEndpoints []string
+	StateStoreEtcdCAFile    string
+	StateStoreEtcdCertFile  string
+	StateStoreEtcdKeyFile   string
+	StateStoreEtcdPrefix    string
+	// FirewallBackend is FirewallBackendAuto, FirewallBackendIptables or FirewallBackendNftables
+	FirewallBackend string
+	// If true, pods of the node having the tkestack.io/quarantine annotation are isolated from all but
+	// QuarantineAllowedCIDRs and cidrs of the annotation, see package quarantine
+	Quarantine             bool
+	QuarantineAllowedCIDRs []string
 }
 
 func NewServerRunOptions() *ServerRunOptions {
@@ -45,6 +145,21 @@ func NewServerRunOptions() *ServerRunOptions {
 		NetworkPolicy:        false,
 		NetworkConfDir:       "/etc/cni/net.d/",
 		CNIPaths:             []string{"/opt/cni/galaxy/bin"},
+		IPv6Mode:             IPv6Disable,
+		FlannelWaitTimeout:   time.Minute,
+		FlannelMaxPending:    256,
+		ResyncBurst:          1000,
+		ResyncErrorRatio:     0.5,
+		ResyncPause:          time.Minute,
+		EbtablesRulesFile:    "/etc/sysconfig/galaxy-ebtable-filter",
+		DuplicateIPPolicy:    DuplicateIPReject,
+		HeartbeatInterval:    10 * time.Second,
+		ConntrackMaxPerGB:    32768,
+		ConntrackMin:         131072,
+		ConntrackAlertRatio:  0.9,
+		StateStore:           StateStoreFile,
+		StateStoreEtcdPrefix: "/galaxy",
+		FirewallBackend:      FirewallBackendAuto,
 	}
 	return opt
 }
@@ -55,6 +170,9 @@ func (s *ServerRunOptions) AddFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&s.Master, "master", s.Master, "The address and port of the Kubernetes API server")
 	fs.StringVar(&s.KubeConf, "kubeconfig", s.KubeConf, "The kube config file location of APISwitch, used to "+
 		"support TLS")
+	fs.StringVar(&s.MasterCredentialsDir, "master-credentials-dir", s.MasterCredentialsDir, "The dir, e.g. a "+
+		"mounted secret, of master, token, ca.crt, tls.crt and tls.key files to connect to the Kubernetes API server. "+
+		"Token changes are reloaded, changes of others restart galaxy. Overrides --master and --kubeconfig")
 	fs.BoolVar(&s.BridgeNFCallIptables, "bridge-nf-call-iptables", s.BridgeNFCallIptables, "Ensure "+
 		"bridge-nf-call-iptables is set/unset")
 	fs.BoolVar(&s.IPForward, "ip-forward", s.IPForward, "Ensure ip-forward is set/unset")
@@ -65,4 +183,87 @@ func (s *ServerRunOptions) AddFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&s.NetworkConfDir, "network-conf-dir", s.NetworkConfDir,
 		"Directory to additional network configs apart from those in json config")
 	fs.StringSliceVar(&s.CNIPaths, "cni-paths", s.CNIPaths, "Additional cni paths apart from those received from kubelet")
+	fs.StringVar(&s.IPv6Mode, "ipv6-mode", s.IPv6Mode, "IPv6 of pods: disable, harden or keep. harden keeps ipv6 "+
+		"but ignores router advertisements and redirects and drops rogue ones sent by pods on bridge ports via ebtables")
+	fs.IntVar(&s.HostportShards, "hostport-shards", s.HostportShards, "Shard hostport rules into this number of "+
+		"chains by destination ports to keep the number of rules a packet traverses low, 0 disables sharding")
+	fs.BoolVar(&s.AsyncPortMapping, "async-port-mapping", s.AsyncPortMapping, "Set up port mapping after "+
+		"responding to ADD requests, pods may use a tkestack.io/portmapping-ready readiness gate to wait for it")
+	fs.DurationVar(&s.FlannelWaitTimeout, "flannel-wait-timeout", s.FlannelWaitTimeout, "How long ADD requests "+
+		"of flannel networks wait for flanneld to write the subnet file")
+	fs.IntVar(&s.FlannelMaxPending, "flannel-max-pending", s.FlannelMaxPending, "Max number of ADD requests "+
+		"waiting for the flannel subnet file, more requests fail immediately")
+	fs.Float64Var(&s.ResyncRulesPerSecond, "resync-rules-per-second", s.ResyncRulesPerSecond, "Max number of "+
+		"iptables rules changed or pods synced per second by periodic resyncs, 0 means unlimited")
+	fs.IntVar(&s.ResyncBurst, "resync-burst", s.ResyncBurst, "Max burst of resync-rules-per-second")
+	fs.Float64Var(&s.ResyncErrorRatio, "resync-error-ratio", s.ResyncErrorRatio, "Pause periodic resyncs if "+
+		"this ratio of recent resync operations failed, 0 means never pause")
+	fs.DurationVar(&s.ResyncPause, "resync-pause", s.ResyncPause, "How long periodic resyncs pause once "+
+		"resync-error-ratio is reached")
+	fs.UintSliceVar(&s.SocketAllowedUIDs, "socket-allowed-uids", s.SocketAllowedUIDs, "Uids allowed to connect "+
+		"to the galaxy socket, empty allows any")
+	fs.StringSliceVar(&s.SocketAllowedBinaries, "socket-allowed-binaries", s.SocketAllowedBinaries, "Binaries "+
+		"allowed to connect to the galaxy socket, e.g. /opt/cni/bin/galaxy-sdn, empty allows any")
+	fs.StringVar(&s.SocketTokenFile, "socket-token-file", s.SocketTokenFile, "If set, requests to the galaxy "+
+		"socket must carry the content of this file as a token, galaxy-sdn reads it from tokenFile of its conf")
+	fs.StringVar(&s.RequestTraceFile, "request-trace-file", s.RequestTraceFile, "If set, record cni requests into "+
+		"this file which can be replayed by tools/bench")
+	fs.StringVar(&s.ConfigPublicKeyFile, "config-public-key-file", s.ConfigPublicKeyFile, "If set, the json "+
+		"config must have a signature file of the same path plus .sig verified by the base64 ed25519 public key of "+
+		"this file, galaxy refuses to start otherwise")
+	fs.BoolVar(&s.ARPWatch, "arp-watch", s.ARPWatch, "Watch arp and neighbor advertisements on bridges of pods, "+
+		"count galaxy_ip_conflict_packets_total and record IPConflict events of pods if other macs claim their ips")
+	fs.StringVar(&s.EbtablesRulesFile, "ebtables-rules-file", s.EbtablesRulesFile, "Ebtables rules in the "+
+		"format of ebtables-save restored on start if the file exists. It is a go template of node facts .Uplink, "+
+		".PodCIDR and .Bridges")
+	fs.DurationVar(&s.ReuseWindow, "reuse-window", s.ReuseWindow, "How long port mappings and hostports of a "+
+		"deleted container are kept for the next container of the same pod, which takes them over instead of "+
+		"setting them up if it gets the same ip and ports, 0 removes them on DEL")
+	fs.StringVar(&s.NodeIPInterface, "node-ip-interface", s.NodeIPInterface, "If set, annotate the node with "+
+		"global unicast ips of this interface as k8s.v1.cni.galaxy.io/node-ips, galaxy-ipam prefers them to status "+
+		"addresses of the node when selecting its node subnet")
+	fs.StringVar(&s.ARPWarmUpDevice, "arp-warmup-device", s.ARPWarmUpDevice, "If set, send gratuitous arps of ips "+
+		"galaxy-ipam binds to pods of the node from this device with its mac before the pods start, tagged with "+
+		"vlans of the ips, to warm up arp caches and mac tables of upstream devices")
+	fs.StringVar(&s.DuplicateIPPolicy, "duplicate-ip-policy", s.DuplicateIPPolicy, "What to do if an ADD request "+
+		"gets an ip assigned to another pod of the node: reject fails the request, report records DuplicateIP "+
+		"events of both pods")
+	fs.StringVar(&s.ConfigFile, configFlag, s.ConfigFile, "If set, read flags from this yaml or json file whose keys "+
+		"are flag names, flags on the command line override the file")
+	fs.BoolVar(&s.DumpEffectiveConfig, dumpEffectiveConfigFlag, s.DumpEffectiveConfig, "Print values of all "+
+		"flags, merged from the config file, the command line and defaults, as a config file and exit")
+	fs.StringSliceVar(&s.ExtraListenAddresses, "extra-listen-addresses", s.ExtraListenAddresses, "Endpoints to serve "+
+		"the cni and admin api on besides /var/run/galaxy/galaxy.sock for cni shims not sharing /run with galaxy, "+
+		"e.g. abstract:galaxy for an abstract unix socket, vsock:10000 for a vsock port of any cid")
+	fs.DurationVar(&s.HeartbeatInterval, "heartbeat-interval", s.HeartbeatInterval, "How often galaxy renews "+
+		"the galaxy-<node> lease in kube-node-lease with its version, features, networks and subnets, galaxy-ipam "+
+		"stops allocating ips to nodes whose leases are not renewed in time. 0 disables heartbeats")
+	fs.IntVar(&s.ConntrackMaxPerGB, "conntrack-max-per-gb", s.ConntrackMaxPerGB, "Raise nf_conntrack_max to this "+
+		"number of entries per GiB of memory on start, larger tables are left as they are. 0 leaves it as is")
+	fs.IntVar(&s.ConntrackMin, "conntrack-min", s.ConntrackMin, "Min nf_conntrack_max set by conntrack-max-per-gb")
+	fs.Float64Var(&s.ConntrackAlertRatio, "conntrack-alert-ratio", s.ConntrackAlertRatio, "Record a "+
+		"ConntrackTableFull event of the node once the conntrack table is this ratio full, 0 disables alerts")
+	fs.StringVar(&s.MetricsBindAddress, "metrics-bind-address", s.MetricsBindAddress, "If set, serve prometheus "+
+		"metrics on /metrics of this address, e.g. 127.0.0.1:9099, besides the galaxy socket")
+	fs.StringVar(&s.StateStore, "state-store", s.StateStore, "Where ports and assigned ips of containers are kept: "+
+		"file keeps them on the node, etcd and crd keep them in etcd or NodeState objects so that they survive "+
+		"reprovisioning of the node. State in files of the node is moved to etcd or crd on start")
+	fs.StringSliceVar(&s.StateStoreEtcdEndpoints, "state-store-etcd-endpoints", s.StateStoreEtcdEndpoints,
+		"Urls of etcd members of v3.4 or later of the etcd state store, e.g. https://10.0.0.1:2379")
+	fs.StringVar(&s.StateStoreEtcdCAFile, "state-store-etcd-ca-file", s.StateStoreEtcdCAFile, "CA file verifying "+
+		"certificates of etcd members of the etcd state store")
+	fs.StringVar(&s.StateStoreEtcdCertFile, "state-store-etcd-cert-file", s.StateStoreEtcdCertFile, "Client "+
+		"certificate file of the etcd state store")
+	fs.StringVar(&s.StateStoreEtcdKeyFile, "state-store-etcd-key-file", s.StateStoreEtcdKeyFile, "Client key file "+
+		"of the etcd state store")
+	fs.StringVar(&s.StateStoreEtcdPrefix, "state-store-etcd-prefix", s.StateStoreEtcdPrefix, "Keys of the etcd "+
+		"state store are under <prefix>/<node>/")
+	fs.StringVar(&s.FirewallBackend, "firewall-backend", s.FirewallBackend, "Backend of hostport DNAT and SNAT "+
+		"rules and the ebtables rules file: iptables, nftables or auto, which picks nftables if the host has nft and "+
+		"either no iptables or no legacy iptables tables")
+	fs.BoolVar(&s.Quarantine, "quarantine", s.Quarantine, "Watch pods of the node and drop all ipv4 traffic of "+
+		"pods having the tkestack.io/quarantine annotation, forwarded or with the node, except that with "+
+		"quarantine-allowed-cidrs and cidrs of the annotation. If false, rules of quarantined pods are removed")
+	fs.StringSliceVar(&s.QuarantineAllowedCIDRs, "quarantine-allowed-cidrs", s.QuarantineAllowedCIDRs, "Cidrs or "+
+		"ips all quarantined pods may still talk to, e.g. forensics hosts")
 }
@@ -0,0 +1,145 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/emicklei/go-restful"
+	corev1 "k8s.io/api/core/v1"
+	glog "k8s.io/klog"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+)
+
+// ownerDir stores the pod owning the state of each container. Runtimes may reuse sandbox ids after crashes, the
+// owner tells state of the previous pod from state of the current one.
+const ownerDir = "/var/lib/cni/galaxy/owner"
+
+// containerOwner is the pod an ADD request of a container was served for
+type containerOwner struct {
+	PodName      string
+	PodNamespace string
+	PodUID       string
+}
+
+func (o *containerOwner) String() string {
+	return o.PodName + "_" + o.PodNamespace + "(" + o.PodUID + ")"
+}
+
+// owns returns false if req is not for o. Uids are compared only if both know it since DEL requests of dockershim
+// don't carry it.
+func (o *containerOwner) owns(req *galaxyapi.PodRequest) bool {
+	if o.PodName != req.PodName || o.PodNamespace != req.PodNamespace {
+		return false
+	}
+	uid := ""
+	if req.CNIArgs != nil {
+		uid = req.CNIArgs.PodUID
+	}
+	return uid == "" || o.PodUID == "" || uid == o.PodUID
+}
+
+func (g *Galaxy) loadOwner(containerID string) (*containerOwner, error) {
+	data, err := g.owners.Get(containerID)
+	if err != nil {
+		return nil, err
+	}
+	var o containerOwner
+	if err := json.Unmarshal(data, &o); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// claimContainer records pod as the owner of the container of req. If the container id was used by another pod,
+// whatever is left of it is released first as if a DEL request of the previous pod came.
+func (g *Galaxy) claimContainer(req *galaxyapi.PodRequest, pod *corev1.Pod) error {
+	owner := &containerOwner{PodName: pod.Name, PodNamespace: pod.Namespace, PodUID: string(pod.UID)}
+	old, err := g.loadOwner(req.ContainerID)
+	if err != nil && !os.IsNotExist(err) {
+		glog.Warningf("bad owner of %s: %v", req.ContainerID, err)
+	}
+	if old != nil && (old.PodName != owner.PodName || old.PodNamespace != owner.PodNamespace ||
+		old.PodUID != owner.PodUID) {
+		glog.Warningf("container id %s of %s was used by %s, releasing its state", req.ContainerID, owner, old)
+		stale := *req
+		args := *req.CmdArgs
+		stale.CmdArgs = &args
+		stale.PodName, stale.PodNamespace = old.PodName, old.PodNamespace
+		stale.CNIArgs = nil
+		if err := g.cmdDel(&stale); err != nil {
+			glog.Warningf("failed to release state of %s, retrying in background: %v", old, err)
+		}
+	}
+	data, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	return g.owners.Put(req.ContainerID, data)
+}
+
+// ownsContainer returns false if the state of the container of req is owned by another pod, i.e. the DEL request is
+// of a previous pod of the container id whose state was released when the container id was reused
+func (g *Galaxy) ownsContainer(req *galaxyapi.PodRequest) bool {
+	owner, err := g.loadOwner(req.ContainerID)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("bad owner of %s: %v", req.ContainerID, err)
+		}
+		return true
+	}
+	return owner.owns(req)
+}
+
+// dropOwner removes the owner of containerID
+func (g *Galaxy) dropOwner(containerID string) {
+	if err := g.owners.Delete(containerID); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("failed to remove owner of %s: %v", containerID, err)
+	}
+}
+
+// ipOwner responds with the container and pod of the node owning an ip by the registry of assigned ips. Ips whose
+// containers are gone without a DEL are not owned, which is what gc would find later.
+func (g *Galaxy) ipOwner(r *restful.Request, w *restful.Response) {
+	ip := net.ParseIP(r.PathParameter("ip"))
+	if ip == nil {
+		http.Error(w, fmt.Sprintf("bad ip %q", r.PathParameter("ip")), http.StatusBadRequest)
+		return
+	}
+	a, err := g.loadAssignedIP(ip.String())
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	if a == nil || !g.inUse(a) {
+		http.Error(w, fmt.Sprintf("no owner of %s", ip), http.StatusNotFound)
+		return
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		glog.Warningf("Error writing owner HTTP response: %v", err)
+	}
+}
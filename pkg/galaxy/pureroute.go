@@ -0,0 +1,103 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/apimachinery/pkg/util/wait"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/metrics"
+	"tkestack.io/galaxy/pkg/network/vlan"
+	"tkestack.io/galaxy/pkg/utils"
+)
+
+var (
+	podRoutesMissing = metrics.NewGaugeVec("galaxy_pure_pod_routes_missing", "Number of pure mode pods whose /32 "+
+		"route or proxy arp was missing in the last check", "kind")
+	podRouteRepairs = metrics.NewCounterVec("galaxy_pure_pod_route_repairs_total", "Number of /32 routes and proxy "+
+		"arp of pure mode pods repaired", "kind")
+)
+
+// startPureRouteCheck verifies /32 routes and proxy arp of pure mode pods periodically if any vlan network is in
+// pure mode, and repairs them
+func (g *Galaxy) startPureRouteCheck() {
+	if len(g.pureVlanBridgePrefixes()) == 0 {
+		return
+	}
+	go wait.Until(g.checkPureRoutes, 30*time.Second, g.quitChan)
+}
+
+func (g *Galaxy) checkPureRoutes() {
+	var routes, proxyARPs int
+	for hostVeth, ip := range g.purePodIPs() {
+		repair, err := vlan.EnsurePodRoute(hostVeth, ip)
+		if err != nil {
+			glog.Warningf("failed to ensure route of %s via %s: %v", ip, hostVeth, err)
+			continue
+		}
+		if repair.Route {
+			routes++
+			glog.Warningf("repaired missing route of %s via %s", ip, hostVeth)
+		}
+		if repair.ProxyARP {
+			proxyARPs++
+			glog.Warningf("repaired proxy arp of %s", hostVeth)
+		}
+	}
+	podRoutesMissing.WithLabelValues("route").Set(float64(routes))
+	podRoutesMissing.WithLabelValues("proxy_arp").Set(float64(proxyARPs))
+	podRouteRepairs.WithLabelValues("route").Add(float64(routes))
+	podRouteRepairs.WithLabelValues("proxy_arp").Add(float64(proxyARPs))
+}
+
+// purePodIPs returns ipv4 addresses of pods whose host veths are not attached to bridges, i.e. pods of pure mode
+// routed by /32 routes, keyed by the host veths
+func (g *Galaxy) purePodIPs() map[string]net.IP {
+	ips := map[string]net.IP{}
+	containerIDs, err := g.results.Keys()
+	if err != nil {
+		glog.Warningf("failed to list cached results: %v", err)
+		return ips
+	}
+	for _, containerID := range containerIDs {
+		// only the veth of the first vlan interface of a pod is checked
+		hostVeth := utils.HostVethName(containerID, "")
+		link, err := netlink.LinkByName(hostVeth)
+		if err != nil || link.Attrs().MasterIndex != 0 {
+			// not set up by the vlan plugin or attached to a bridge
+			continue
+		}
+		data, err := g.results.Get(containerID)
+		if err != nil {
+			continue
+		}
+		var cached cachedResult
+		if err := json.Unmarshal(data, &cached); err != nil {
+			continue
+		}
+		result, err := parseResult(cached.Result)
+		if err != nil || result.IP4 == nil {
+			continue
+		}
+		ips[hostVeth] = result.IP4.IP.IP
+	}
+	return ips
+}
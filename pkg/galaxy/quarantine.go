@@ -0,0 +1,190 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/metrics"
+	"tkestack.io/galaxy/pkg/network/quarantine"
+)
+
+const (
+	quarantinedReason       = "Quarantined"
+	quarantineReleaseReason = "QuarantineReleased"
+)
+
+var quarantinedPods = metrics.NewGaugeVec("galaxy_quarantined_pods", "Number of pods of the node quarantined by "+
+	"the tkestack.io/quarantine annotation")
+
+// setupQuarantine watches pods of the node and isolates ones having the quarantine annotation if Quarantine is set,
+// it removes rules left by a previous run otherwise. Rules are first synced once pods are listed, so that restarts
+// of galaxy don't release quarantined pods in between.
+func (g *Galaxy) setupQuarantine() error {
+	h := quarantine.New()
+	if !g.Quarantine {
+		return h.Remove()
+	}
+	// validated by options
+	allowed, _ := quarantine.ParseAllowList(strings.Join(g.QuarantineAllowedCIDRs, ","))
+	factory := informers.NewFilteredSharedInformerFactory(g.client, time.Minute, metav1.NamespaceAll,
+		func(listOptions *metav1.ListOptions) {
+			listOptions.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", k8s.GetHostname()).String()
+		})
+	informer := factory.Core().V1().Pods()
+	trigger := make(chan struct{}, 1)
+	notify := func(objs ...interface{}) {
+		for _, obj := range objs {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pod, ok := obj.(*corev1.Pod); ok {
+				if _, ok := pod.Annotations[k8s.QuarantineAnnotation]; ok {
+					select {
+					case trigger <- struct{}{}:
+					default:
+					}
+					return
+				}
+			}
+		}
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) { notify(obj) },
+		UpdateFunc: func(old, obj interface{}) {
+			notify(old, obj)
+		},
+		DeleteFunc: func(obj interface{}) { notify(obj) },
+	})
+	go factory.Start(g.quitChan)
+	// pods quarantined by the last sync, keyed by namespace/name
+	quarantined := map[string]bool{}
+	sync := func() error {
+		pods, err := informer.Lister().List(labels.Everything())
+		if err != nil {
+			return err
+		}
+		return g.syncQuarantine(h, allowed, pods, quarantined)
+	}
+	go func() {
+		if !cache.WaitForCacheSync(g.quitChan, informer.Informer().HasSynced) {
+			return
+		}
+		l := g.addFirewallLoop("quarantine", time.Minute, sync)
+		for {
+			select {
+			case <-trigger:
+				if err := l.run(); err != nil {
+					glog.Warningf("failed to sync quarantine rules: %v", err)
+				}
+			case <-g.quitChan:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// syncQuarantine isolates pods having the quarantine annotation and records events of pods quarantined or released
+// since the last sync
+func (g *Galaxy) syncQuarantine(h *quarantine.Handler, allowed []*net.IPNet, pods []*corev1.Pod,
+	quarantined map[string]bool) error {
+	var qpods []*quarantine.Pod
+	current := map[string]*corev1.Pod{}
+	for _, pod := range pods {
+		v, ok := pod.Annotations[k8s.QuarantineAnnotation]
+		if !ok || pod.Spec.HostNetwork {
+			continue
+		}
+		key := pod.Namespace + "/" + pod.Name
+		qpod := &quarantine.Pod{Key: key, IPs: podIPs(pod), Allowed: allowed}
+		if len(qpod.IPs) == 0 {
+			// isolated once it gets ips
+			continue
+		}
+		extra, err := quarantine.ParseAllowList(v)
+		if err != nil {
+			// fail closed, the pod is isolated from all but the allow list of galaxy
+			glog.Warningf("bad %s annotation of pod %s: %v", k8s.QuarantineAnnotation, key, err)
+		}
+		qpod.Allowed = append(append([]*net.IPNet{}, allowed...), extra...)
+		qpods = append(qpods, qpod)
+		current[key] = pod
+	}
+	if err := h.Sync(qpods); err != nil {
+		return err
+	}
+	quarantinedPods.WithLabelValues().Set(float64(len(qpods)))
+	for key, pod := range current {
+		if !quarantined[key] {
+			glog.Infof("quarantined pod %s", key)
+			g.recordPodEvent(pod, corev1.EventTypeWarning, quarantinedReason, "pod is quarantined, all its "+
+				"traffic is dropped except that with its allow list")
+		}
+		quarantined[key] = true
+	}
+	for _, pod := range pods {
+		key := pod.Namespace + "/" + pod.Name
+		if quarantined[key] && current[key] == nil {
+			glog.Infof("released pod %s from quarantine", key)
+			g.recordPodEvent(pod, corev1.EventTypeNormal, quarantineReleaseReason, "pod is released from quarantine")
+		}
+	}
+	for key := range quarantined {
+		if current[key] == nil {
+			delete(quarantined, key)
+		}
+	}
+	return nil
+}
+
+// podIPs returns ips of the pod by its status and the ips annotation galaxy-ipam sets on binding
+func podIPs(pod *corev1.Pod) []net.IP {
+	var ips []net.IP
+	seen := map[string]bool{}
+	add := func(s string) {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil || seen[ip.String()] {
+			return
+		}
+		seen[ip.String()] = true
+		ips = append(ips, ip)
+	}
+	add(pod.Status.PodIP)
+	for _, s := range strings.Split(pod.Annotations[constant.IPsAnnotation], ",") {
+		add(s)
+	}
+	return ips
+}
+
+func (g *Galaxy) recordPodEvent(pod *corev1.Pod, eventType, reason, message string) {
+	if g.recorder == nil {
+		return
+	}
+	g.recorder.Event(pod, eventType, reason, message)
+}
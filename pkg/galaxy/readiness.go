@@ -0,0 +1,149 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/emicklei/go-restful"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/galaxy/options"
+	"tkestack.io/galaxy/pkg/network/kernel"
+)
+
+const (
+	ipForwardSysctl    = "net/ipv4/ip_forward"
+	bridgeNFSysctl     = "net/bridge/bridge-nf-call-iptables"
+	rpFilterSysctl     = "net/ipv4/conf/all/rp_filter"
+	eth0RPFilterSysctl = "net/ipv4/conf/eth0/rp_filter"
+)
+
+// kernelRequirement is a kernel requirement of the options and networks of galaxy
+type kernelRequirement struct {
+	kernel.Requirement
+	// Expect is the value a sysctl should have
+	Expect string `json:"expect,omitempty"`
+	// Optional requirements are reported without affecting readiness
+	Optional  bool `json:"optional,omitempty"`
+	Satisfied bool `json:"satisfied"`
+}
+
+// Readiness is the response of /readyz
+type Readiness struct {
+	Ready        bool                `json:"ready"`
+	Requirements []kernelRequirement `json:"requirements"`
+	// Maintenance is set if the node network is in maintenance, the node is not ready during it
+	Maintenance *Maintenance `json:"maintenance,omitempty"`
+	// Uplinks are statuses of uplinks validated by LLDP, the node is not ready if any misses vlans
+	Uplinks []UplinkStatus `json:"uplinks,omitempty"`
+}
+
+func boolSysctl(set bool) string {
+	if set {
+		return "1"
+	}
+	return "0"
+}
+
+// probeKernel checks kernel modules and sysctls galaxy relies on. Locked down hosts may forbid loading modules or
+// writing sysctls, galaxy never loads modules itself.
+func (g *Galaxy) probeKernel() []kernelRequirement {
+	p := kernel.NewProber()
+	var reqs []kernelRequirement
+	add := func(r kernel.Requirement, expect string, optional bool) {
+		reqs = append(reqs, kernelRequirement{Requirement: r, Expect: expect, Optional: optional,
+			Satisfied: r.Satisfied(expect)})
+	}
+	add(p.Sysctl(ipForwardSysctl, "--ip-forward"), boolSysctl(g.IPForward), false)
+	if g.BridgeNFCallIptables {
+		add(p.Module("br_netfilter", "--bridge-nf-call-iptables"), "", false)
+	}
+	bridgeNF := p.Sysctl(bridgeNFSysctl, "--bridge-nf-call-iptables")
+	// the sysctl is absent without br_netfilter which means bridged traffic skips iptables anyway
+	add(bridgeNF, boolSysctl(g.BridgeNFCallIptables), !g.BridgeNFCallIptables)
+	if g.RouteENI {
+		add(p.Sysctl(rpFilterSysctl, "--route-eni"), "0", false)
+		add(p.Sysctl(eth0RPFilterSysctl, "--route-eni"), "0", false)
+	}
+	for name, conf := range g.networkConfs() {
+		if conf["type"] == "galaxy-k8s-vlan" {
+			add(p.Module("8021q", "vlan network "+name), "", false)
+		}
+	}
+	add(p.Module("ebtables", "--ipv6-mode=harden"), "", g.IPv6Mode != options.IPv6Harden)
+	return reqs
+}
+
+// logKernelRequirements logs requirements which are not satisfied
+func logKernelRequirements(reqs []kernelRequirement) {
+	for _, r := range reqs {
+		if r.Satisfied {
+			continue
+		}
+		if r.Optional {
+			glog.Infof("optional %s %s of %s is unavailable: %s", r.Kind, r.Name, r.Feature, r.Error)
+		} else if r.Expect != "" {
+			glog.Warningf("%s %s of %s must be %s but it is %q and can't be written: %s", r.Kind, r.Name, r.Feature,
+				r.Expect, r.Value, r.Error)
+		} else {
+			glog.Warningf("%s %s of %s is required: %s", r.Kind, r.Name, r.Feature, r.Error)
+		}
+	}
+}
+
+// sysctlWritable returns true if the sysctl of reqs is writable, galaxy only keeps writable sysctls set
+func sysctlWritable(reqs []kernelRequirement, name string) bool {
+	for _, r := range reqs {
+		if r.Kind == kernel.KindSysctl && r.Name == name {
+			return r.Available
+		}
+	}
+	return false
+}
+
+// readyz responds 200 if all required kernel modules and sysctls are satisfied, the node network is not in
+// maintenance and switch ports of uplinks carry vlans of the node, 503 otherwise, the body lists all requirements
+func (g *Galaxy) readyz(r *restful.Request, w *restful.Response) {
+	readiness := &Readiness{Ready: true, Requirements: g.probeKernel(), Maintenance: g.maintenance(),
+		Uplinks: g.uplinkStatuses()}
+	if readiness.Maintenance != nil {
+		readiness.Ready = false
+	}
+	for _, uplink := range readiness.Uplinks {
+		if len(uplink.Missing) > 0 {
+			readiness.Ready = false
+		}
+	}
+	for _, req := range readiness.Requirements {
+		if !req.Satisfied && !req.Optional {
+			readiness.Ready = false
+		}
+	}
+	data, err := json.Marshal(readiness)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !readiness.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if _, err := w.Write(data); err != nil {
+		glog.Warningf("Error writing readyz HTTP response: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"syscall"
+
+	"github.com/emicklei/go-restful"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/metrics"
+)
+
+var configReloads = metrics.NewCounterVec("galaxy_config_reloads_total", "Number of reloads of the json config by "+
+	"result", "result")
+
+// ReloadResult is the response of /admin/reload
+type ReloadResult struct {
+	// Networks are names of networks of the reloaded config
+	Networks []string
+}
+
+// fixedSections returns sections of conf which are set up on start, a reload changing any of them is refused
+func fixedSections(conf *JsonConf) map[string]interface{} {
+	return map[string]interface{}{
+		"EgressNAT":     conf.EgressNAT,
+		"VlanIsolation": conf.VlanIsolation,
+		"NetworkMarks":  conf.NetworkMarks,
+		"BGP":           conf.BGP,
+		"UplinkVlans":   conf.UplinkVlans,
+	}
+}
+
+// reloadConfig reads the json config again and replaces networks, default networks and interface names by those of
+// it. New pods get the new networks, while running pods are untouched since DEL and CHECK requests use configs of
+// networks saved on ADD. The config is refused as a whole if it fails validation or changes other sections.
+func (g *Galaxy) reloadConfig() (result *ReloadResult, err error) {
+	defer func() {
+		configReloads.WithLabelValues(resultLabel(err)).Inc()
+		g.reportConfigStatus(err)
+	}()
+	conf, err := g.readConfig()
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	current := fixedSections(&g.JsonConf)
+	for name, section := range fixedSections(&conf.JsonConf) {
+		if !reflect.DeepEqual(section, current[name]) {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		return nil, fmt.Errorf("sections %v changed, restart galaxy to apply them", changed)
+	}
+	g.confLock.Lock()
+	g.NetworkConf, g.DefaultNetworks, g.ENIIPNetwork = conf.NetworkConf, conf.DefaultNetworks, conf.ENIIPNetwork
+	g.InterfaceNames, g.RequiredFeatures = conf.InterfaceNames, conf.RequiredFeatures
+	g.netConf, g.ifNameTemplates = conf.netConf, conf.ifNameTemplates
+	g.confLock.Unlock()
+	result = &ReloadResult{}
+	for name := range conf.netConf {
+		result.Networks = append(result.Networks, name)
+	}
+	sort.Strings(result.Networks)
+	glog.Infof("reloaded config, networks %v", result.Networks)
+	return result, nil
+}
+
+// startReloadOnSIGHUP reloads the json config whenever galaxy receives SIGHUP
+func (g *Galaxy) startReloadOnSIGHUP() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-c:
+				if _, err := g.reloadConfig(); err != nil {
+					glog.Warningf("refused to reload config: %v", err)
+				}
+			case <-g.quitChan:
+				signal.Stop(c)
+				return
+			}
+		}
+	}()
+}
+
+// reload reloads the json config on demand, e.g. after configuration management rolls out a new one
+func (g *Galaxy) reload(r *restful.Request, w *restful.Response) {
+	result, err := g.reloadConfig()
+	if err != nil {
+		glog.Warningf("refused to reload config: %v", err)
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusUnprocessableEntity)
+		return
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		glog.Warningf("Error writing reload HTTP response: %v", err)
+	}
+}
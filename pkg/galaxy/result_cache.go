@@ -0,0 +1,209 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	t020 "github.com/containernetworking/cni/pkg/types/020"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/emicklei/go-restful"
+	"github.com/vishvananda/netlink"
+	glog "k8s.io/klog"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/network/kernel"
+	galaxyns "tkestack.io/galaxy/pkg/network/netns"
+)
+
+// resultCacheDir stores results of successful ADD requests, one file per container. gc cleans up files of
+// containers which no longer exist.
+const resultCacheDir = "/var/lib/cni/galaxy/result"
+
+// cachedResult is the result of an ADD request and what it was requested for
+type cachedResult struct {
+	PodName      string
+	PodNamespace string
+	Netns        string
+	IfName       string
+	Result       json.RawMessage
+	Ports        []k8s.Port
+	// Tuning is the queue tuning applied to the interface
+	Tuning *kernel.AppliedQueueTuning `json:",omitempty"`
+	// NetnsID tells whether a /proc/<pid>/ns/net path still refers to the netns after the pid is reused
+	NetnsID *galaxyns.ID `json:",omitempty"`
+}
+
+func (c *cachedResult) matches(req *galaxyapi.PodRequest) bool {
+	return c.PodName == req.PodName && c.PodNamespace == req.PodNamespace &&
+		galaxyns.Normalize(c.Netns) == req.Netns && c.IfName == req.IfName &&
+		(c.NetnsID == nil || req.NetnsID != nil && *c.NetnsID == *req.NetnsID)
+}
+
+// netnsInEffect returns the netns of the cached result if it still refers to the netns which the result was added
+// for, otherwise empty as if the netns was gone
+func (c *cachedResult) netnsInEffect() string {
+	if c.Netns == "" || galaxyns.Verify(c.Netns, c.NetnsID) != nil {
+		return ""
+	}
+	return c.Netns
+}
+
+// cacheResult persists the result of a successful ADD request
+func (g *Galaxy) cacheResult(req *galaxyapi.PodRequest, data []byte, tuning *kernel.AppliedQueueTuning) {
+	c := &cachedResult{PodName: req.PodName, PodNamespace: req.PodNamespace, Netns: req.Netns,
+		NetnsID: req.NetnsID, IfName: req.IfName, Result: data, Ports: req.Ports, Tuning: tuning}
+	data, err := json.Marshal(c)
+	if err == nil {
+		err = g.results.Put(req.ContainerID, data)
+	}
+	if err != nil {
+		glog.Warningf("failed to cache result of %s: %v", req.ContainerID, err)
+	}
+}
+
+// dropResult removes the cached result of containerID
+func (g *Galaxy) dropResult(containerID string) {
+	if err := g.results.Delete(containerID); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("failed to remove cached result of %s: %v", containerID, err)
+	}
+}
+
+// loadResult returns the cached result for req which is still in effect in the dataplane. It drops the cache entry
+// on divergence, so that the caller falls back to the full backend work.
+func (g *Galaxy) loadResult(req *galaxyapi.PodRequest) (*cachedResult, error) {
+	data, err := g.results.Get(req.ContainerID)
+	if err != nil {
+		return nil, err
+	}
+	var c cachedResult
+	if err := json.Unmarshal(data, &c); err != nil {
+		g.dropResult(req.ContainerID)
+		return nil, fmt.Errorf("bad cached result: %v", err)
+	}
+	if !c.matches(req) {
+		g.dropResult(req.ContainerID)
+		return nil, fmt.Errorf("cached result is for pod %s_%s netns %s ifname %s", c.PodName, c.PodNamespace,
+			c.Netns, c.IfName)
+	}
+	if !g.ownsContainer(req) {
+		g.dropResult(req.ContainerID)
+		return nil, fmt.Errorf("cached result is for another pod of the same name")
+	}
+	if err := g.verifyResult(&c, req.ContainerID); err != nil {
+		g.dropResult(req.ContainerID)
+		return nil, fmt.Errorf("cached result diverges from dataplane: %v", err)
+	}
+	return &c, nil
+}
+
+// verifyResult checks that the interface of the netns still has the ips of the cached result and that the port
+// mapping is still in place
+func (g *Galaxy) verifyResult(c *cachedResult, containerID string) error {
+	result, err := parseResult(c.Result)
+	if err != nil {
+		return err
+	}
+	var ips []net.IP
+	if result.IP4 != nil {
+		ips = append(ips, result.IP4.IP.IP)
+	}
+	if result.IP6 != nil {
+		ips = append(ips, result.IP6.IP.IP)
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("no ip in result")
+	}
+	if len(c.Ports) != 0 {
+		ports, err := k8s.ConsumePort(containerID)
+		if err != nil || len(ports) != len(c.Ports) {
+			return fmt.Errorf("port mapping is gone: %v", err)
+		}
+		missing, err := g.hostportRules().MissingPortMappings(c.Ports)
+		if err != nil {
+			return err
+		}
+		if len(missing) != 0 {
+			return fmt.Errorf("rules of port mapping %v are gone", missing)
+		}
+	}
+	netns, err := ns.GetNS(c.Netns)
+	if err != nil {
+		return err
+	}
+	defer netns.Close() // nolint: errcheck
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(c.IfName)
+		if err != nil {
+			return err
+		}
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			return fmt.Errorf("%s is down", c.IfName)
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return err
+		}
+		for _, ip := range ips {
+			if !hasAddr(addrs, ip) {
+				return fmt.Errorf("%s has no ip %s", c.IfName, ip)
+			}
+		}
+		return nil
+	})
+}
+
+// parseResult parses a result of any cni version and converts it to a 020 result
+func parseResult(data []byte) (*t020.Result, error) {
+	var v struct {
+		CNIVersion string `json:"cniVersion"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	if v.CNIVersion == "" {
+		v.CNIVersion = t020.ImplementedSpecVersion
+	}
+	result, err := version.NewResult(v.CNIVersion, data)
+	if err != nil {
+		return nil, err
+	}
+	return t020.GetResult(result)
+}
+
+// podState responds with the cached result of a container, including what is applied to it besides the cni result
+func (g *Galaxy) podState(r *restful.Request, w *restful.Response) {
+	containerID := r.PathParameter("containerID")
+	data, err := g.results.Get(containerID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, fmt.Sprintf("no state of %s", containerID), http.StatusNotFound)
+		} else {
+			http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		glog.Warningf("Error writing state HTTP response: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/network/portmapping"
+	iptablesTest "tkestack.io/galaxy/pkg/utils/iptables/testing"
+	"tkestack.io/galaxy/pkg/utils/store"
+)
+
+func newCacheTestGalaxy(t *testing.T) (*Galaxy, func()) {
+	dir, err := ioutil.TempDir("", "galaxy-result")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Galaxy{results: store.NewFileStore(filepath.Join(dir, "result")),
+		owners: store.NewFileStore(filepath.Join(dir, "owner"))}
+	return g, func() { os.RemoveAll(dir) } // nolint: errcheck
+}
+
+// cacheTestRequest returns a request of the netns of the test itself whose loopback is the interface of the pod
+func cacheTestRequest() *galaxyapi.PodRequest {
+	return &galaxyapi.PodRequest{PodName: "pod1", PodNamespace: "default", CmdArgs: &skel.CmdArgs{ContainerID: "c1",
+		Netns: fmt.Sprintf("/proc/%d/ns/net", os.Getpid()), IfName: "lo"}}
+}
+
+func TestLoadResult(t *testing.T) {
+	g, cleanup := newCacheTestGalaxy(t)
+	defer cleanup()
+	req := cacheTestRequest()
+	if _, err := g.loadResult(req); !os.IsNotExist(err) {
+		t.Fatalf("expect not exist error without cached result, real %v", err)
+	}
+	data := []byte(`{"cniVersion":"0.2.0","ip4":{"ip":"127.0.0.1/8"}}`)
+	g.cacheResult(req, data, nil)
+	cached, err := g.loadResult(req)
+	if err != nil {
+		t.Fatalf("expect cache hit, real %v", err)
+	}
+	if string(cached.Result) != string(data) {
+		t.Fatalf("expect result %s, real %s", string(data), string(cached.Result))
+	}
+	// requests of another netns don't hit the cache of the previous one, and drop it
+	another := cacheTestRequest()
+	another.Netns = "/var/run/netns/another"
+	if _, err := g.loadResult(another); err == nil {
+		t.Fatal("expect cache miss of another netns")
+	}
+	if _, err := g.results.Get(req.ContainerID); !os.IsNotExist(err) {
+		t.Fatalf("expect cached result dropped, real %v", err)
+	}
+}
+
+func TestLoadResultDiverged(t *testing.T) {
+	g, cleanup := newCacheTestGalaxy(t)
+	defer cleanup()
+	req := cacheTestRequest()
+	// the ip is not on the interface any more
+	g.cacheResult(req, []byte(`{"cniVersion":"0.2.0","ip4":{"ip":"127.0.0.2/8"}}`), nil)
+	if _, err := g.loadResult(req); err == nil {
+		t.Fatal("expect cache miss after the dataplane diverged")
+	}
+	if _, err := g.results.Get(req.ContainerID); !os.IsNotExist(err) {
+		t.Fatalf("expect cached result dropped, real %v", err)
+	}
+	// the container id is owned by another pod of the same name
+	g.cacheResult(req, []byte(`{"cniVersion":"0.2.0","ip4":{"ip":"127.0.0.1/8"}}`), nil)
+	owner, err := json.Marshal(&containerOwner{PodName: "pod1", PodNamespace: "default", PodUID: "uid2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.owners.Put(req.ContainerID, owner); err != nil {
+		t.Fatal(err)
+	}
+	req.CNIArgs = &galaxyapi.CNIArgs{PodUID: "uid1"}
+	if _, err := g.loadResult(req); err == nil {
+		t.Fatal("expect cache miss of another pod")
+	}
+}
+
+func TestLoadResultIPv6Only(t *testing.T) {
+	g, cleanup := newCacheTestGalaxy(t)
+	defer cleanup()
+	req := cacheTestRequest()
+	g.cacheResult(req, []byte(`{"cniVersion":"0.2.0","ip6":{"ip":"::1/128"}}`), nil)
+	if _, err := g.loadResult(req); err != nil {
+		t.Fatalf("expect cache hit of ipv6 only result, real %v", err)
+	}
+	g.cacheResult(req, []byte(`{"cniVersion":"0.2.0","ip6":{"ip":"fd00::1/128"}}`), nil)
+	if _, err := g.loadResult(req); err == nil {
+		t.Fatal("expect cache miss without the ipv6 address on the interface")
+	}
+}
+
+func TestLoadResultPortMappingGone(t *testing.T) {
+	g, cleanup := newCacheTestGalaxy(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "galaxy-port")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	k8s.SetPortStore(store.NewFileStore(dir))
+	defer k8s.SetPortStore(store.NewFileStore(k8s.PortStateDir))
+	h := portmapping.New("", 0)
+	h.Interface = iptablesTest.NewFakeIPTables()
+	g.pmhandler, g.portRules = h, h
+	req := cacheTestRequest()
+	req.Ports = []k8s.Port{{HostPort: 30001, ContainerPort: 80, Protocol: "TCP", PodName: "pod1",
+		PodIP: "127.0.0.1"}}
+	data, err := json.Marshal(req.Ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k8s.SavePort(req.ContainerID, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetupPortMapping(req.Ports); err != nil {
+		t.Fatal(err)
+	}
+	result := []byte(`{"cniVersion":"0.2.0","ip4":{"ip":"127.0.0.1/8"}}`)
+	g.cacheResult(req, result, nil)
+	if _, err := g.loadResult(req); err != nil {
+		t.Fatalf("expect cache hit with port mapping in place, real %v", err)
+	}
+	// the port file is still there but the rules are gone
+	if err := h.CleanPortMapping(req.Ports); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.loadResult(req); err == nil {
+		t.Fatal("expect cache miss after the rules of port mapping are gone")
+	}
+}
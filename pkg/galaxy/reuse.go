@@ -0,0 +1,142 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"os"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	glog "k8s.io/klog"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/k8s"
+)
+
+// parkedPorts are port mappings and hostports of a deleted container which are kept for the next container of the
+// same pod. They are in memory only, a restarted galaxy syncs port mappings of saved ports only which drops them.
+type parkedPorts struct {
+	containerID string
+	ports       []k8s.Port
+	timer       *time.Timer
+}
+
+// parkPorts takes the saved ports of the container of req and keeps its port mappings and hostports for ReuseWindow
+// instead of removing them. It returns false if ReuseWindow is 0 or the container has no ports.
+func (g *Galaxy) parkPorts(req *galaxyapi.PodRequest) bool {
+	if g.ReuseWindow <= 0 {
+		return false
+	}
+	ports, err := k8s.ConsumePort(req.ContainerID)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("failed to read ports of %s: %v", req.ContainerID, err)
+		}
+		return false
+	}
+	if len(ports) == 0 {
+		return false
+	}
+	// parked owns the ports from now on, otherwise cleanup of the container would remove them
+	if err := k8s.RemovePortFile(req.ContainerID); err != nil {
+		glog.Warningf("failed to remove port file of %s: %v", req.ContainerID, err)
+		return false
+	}
+	podFullName := k8s.GetPodFullName(req.PodName, req.PodNamespace)
+	parked := &parkedPorts{containerID: req.ContainerID, ports: ports}
+	g.parkLock.Lock()
+	old := g.parkedPorts[podFullName]
+	if old != nil {
+		old.timer.Stop()
+	}
+	parked.timer = time.AfterFunc(g.ReuseWindow, func() {
+		g.expireParkedPorts(podFullName, parked)
+	})
+	g.parkedPorts[podFullName] = parked
+	g.parkLock.Unlock()
+	if old != nil {
+		g.releaseParkedPorts(old)
+	}
+	glog.Infof("parked %d ports of %s for %v", len(ports), req.ContainerID, g.ReuseWindow)
+	return true
+}
+
+func (g *Galaxy) expireParkedPorts(podFullName string, parked *parkedPorts) {
+	g.parkLock.Lock()
+	if g.parkedPorts[podFullName] != parked {
+		// taken over or replaced
+		g.parkLock.Unlock()
+		return
+	}
+	delete(g.parkedPorts, podFullName)
+	g.parkLock.Unlock()
+	glog.Infof("no container of %s took over ports of %s in %v", podFullName, parked.containerID, g.ReuseWindow)
+	g.releaseParkedPorts(parked)
+}
+
+// releaseParkedPorts removes port mappings and hostports of parked, failures are retried by the deferred queue
+func (g *Galaxy) releaseParkedPorts(parked *parkedPorts) {
+	pmhandler := g.portMapping()
+	pmhandler.CloseHostportsOf(parked.ports)
+	if err := g.hostportRules().CleanPortMapping(parked.ports); err != nil {
+		glog.Warningf("failed to clean parked ports of %s, retrying in background: %v", parked.containerID, err)
+		item := &deferredDel{CmdArgs: skel.CmdArgs{ContainerID: parked.containerID}, Ports: parked.ports}
+		if err := g.deferred.Add(deferredDelKind, parked.containerID, item); err != nil {
+			glog.Errorf("failed to defer cleanup of %s: %v", parked.containerID, err)
+		}
+	}
+}
+
+// takeOverPorts takes over parked ports of the pod if they are ports, i.e. the new container got the same ip and
+// the same ports. Random hostports of ports are filled with the parked ones. Parked ports of the pod which are not
+// taken over are removed before the new ones are set up.
+func (g *Galaxy) takeOverPorts(podFullName string, ports []k8s.Port) bool {
+	g.parkLock.Lock()
+	parked := g.parkedPorts[podFullName]
+	if parked != nil {
+		parked.timer.Stop()
+		delete(g.parkedPorts, podFullName)
+	}
+	g.parkLock.Unlock()
+	if parked == nil {
+		return false
+	}
+	if !samePorts(parked.ports, ports) {
+		glog.Infof("ports of %s changed, releasing parked ports of %s", podFullName, parked.containerID)
+		g.releaseParkedPorts(parked)
+		return false
+	}
+	copy(ports, parked.ports)
+	glog.Infof("%s took over parked ports of %s", podFullName, parked.containerID)
+	return true
+}
+
+// samePorts returns true if ports are the same as parked except for random hostports, i.e. 0, of ports
+func samePorts(parked, ports []k8s.Port) bool {
+	if len(parked) != len(ports) {
+		return false
+	}
+	for i := range ports {
+		port := ports[i]
+		if port.HostPort == 0 {
+			port.HostPort = parked[i].HostPort
+		}
+		if port != parked[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/emicklei/go-restful"
+	glog "k8s.io/klog"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	galaxyns "tkestack.io/galaxy/pkg/network/netns"
+)
+
+// sandboxGone returns true if the netns of a request doesn't exist, e.g. the runtime deleted the sandbox while galaxy
+// was setting it up, or if a /proc/<pid>/ns/net path of it refers to another netns as the pid is reused
+func sandboxGone(req *galaxyapi.PodRequest) bool {
+	if req.Netns == "" {
+		return false
+	}
+	return galaxyns.Gone(req.Netns, req.NetnsID)
+}
+
+// rollbackAdd releases what a failed ADD request set up on the host as if a DEL request came, because nobody would
+// use or delete the networks of a gone sandbox otherwise. args are the cni args of the request before they are
+// modified by cniutil.CmdAdd. It returns a SandboxGoneError of err.
+func (g *Galaxy) rollbackAdd(req *galaxyapi.PodRequest, args skel.CmdArgs, err error) error {
+	glog.Warningf("%v: netns is gone, rolling back: %v", req, err)
+	*req.CmdArgs = args
+	netns := req.Netns
+	if _, ok := galaxyns.Verify(netns, req.NetnsID).(*galaxyns.MismatchError); ok {
+		// don't delete interfaces of whichever netns the reused pid refers to
+		req.Netns = ""
+	}
+	if err := g.cmdDel(req); err != nil {
+		glog.Warningf("%v: failed to roll back, retrying in background: %v", req, err)
+	}
+	return &galaxyapi.SandboxGoneError{Netns: netns, Err: err}
+}
+
+// dropReusedNetns clears the netns of a DEL request if it is the path of a pid which another process reuses since the
+// ADD request, so that networks are deleted as if the netns was gone instead of deleting interfaces of another netns
+func (g *Galaxy) dropReusedNetns(req *galaxyapi.PodRequest) {
+	if !galaxyns.IsProcPath(req.Netns) {
+		return
+	}
+	data, err := g.results.Get(req.ContainerID)
+	if err != nil {
+		return
+	}
+	var c cachedResult
+	if err := json.Unmarshal(data, &c); err != nil || c.NetnsID == nil || galaxyns.Normalize(c.Netns) != req.Netns {
+		return
+	}
+	if req.NetnsID == nil || *req.NetnsID != *c.NetnsID {
+		glog.Warningf("%v: %s no longer refers to the netns of the sandbox, deleting without netns", req, req.Netns)
+		req.Netns = ""
+	}
+}
+
+// writeCNIError responds with e and status so that the cni plugin returns it to the runtime as is
+func writeCNIError(w *restful.Response, status int, e *types.Error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(data); err != nil {
+		glog.Warningf("Error writing cni error HTTP response: %v", err)
+	}
+}
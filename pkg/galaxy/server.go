@@ -31,6 +31,7 @@ import (
 	"github.com/containernetworking/cni/pkg/types"
 	t020 "github.com/containernetworking/cni/pkg/types/020"
 	"github.com/emicklei/go-restful"
+	"github.com/vishvananda/netlink"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -44,8 +45,39 @@ import (
 	"tkestack.io/galaxy/pkg/api/galaxy/private"
 	"tkestack.io/galaxy/pkg/api/k8s"
 	k8sutil "tkestack.io/galaxy/pkg/api/k8s/utils"
+	"tkestack.io/galaxy/pkg/galaxy/options"
+	"tkestack.io/galaxy/pkg/metrics"
+	"tkestack.io/galaxy/pkg/network/portmapping"
+	galaxyutils "tkestack.io/galaxy/pkg/utils"
+	"tkestack.io/galaxy/pkg/utils/endpoint"
+	"tkestack.io/galaxy/pkg/utils/peercred"
 )
 
+var (
+	hostportPods     = metrics.NewGaugeVec("galaxy_hostport_pods", "Number of pods holding hostport sockets")
+	deferredCleanups = metrics.NewGaugeVec("galaxy_deferred_cleanups", "Number of failed DEL requests waiting for "+
+		"retry")
+	pendingAdds = metrics.NewGaugeVec("galaxy_pending_adds", "Number of ADD requests waiting for files, e.g. "+
+		"flannel subnet files")
+	cniRequests = metrics.NewCounterVec("galaxy_cni_requests_total", "Number of cni requests by command and "+
+		"result", "command", "result")
+	cniRequestDuration = metrics.NewHistogramVec("galaxy_cni_request_duration_seconds", "Latencies of cni "+
+		"requests by command", metrics.LatencyBuckets, "command")
+	portMappingFailures = metrics.NewCounterVec("galaxy_port_mapping_failures_total", "Number of failed port "+
+		"mapping setups of pods")
+	ipamRequestErrors = metrics.NewCounterVec("galaxy_ipam_request_errors_total", "Number of failed requests "+
+		"for ips of pods by source, apiserver for pods whose ips galaxy-ipam binds and dhcp for dhcp leases",
+		"source")
+)
+
+// resultLabel is the result label of metrics of operations
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
 // StartServer will start galaxy server.
 func (g *Galaxy) StartServer() error {
 	if g.PProf {
@@ -53,35 +85,127 @@ func (g *Galaxy) StartServer() error {
 			http.ListenAndServe("127.0.0.1:0", nil)
 		}()
 	}
+	if err := g.loadSocketToken(); err != nil {
+		return err
+	}
 	g.installHandlers()
+	if err := g.serveMetrics(); err != nil {
+		return err
+	}
 	if err := os.MkdirAll(private.GalaxySocketDir, 0755); err != nil {
 		return fmt.Errorf("failed to create %s: %v", private.GalaxySocketDir, err)
 	}
-	if err := os.Remove(private.GalaxySocketPath); err != nil {
+	if err := g.serveGRPC(); err != nil {
+		return err
+	}
+	l, err := listenSocket(private.GalaxySocketPath)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{ConnContext: peercred.ConnContext}
+	for _, addr := range g.ExtraListenAddresses {
+		e, err := endpoint.Parse(addr)
+		if err != nil {
+			_ = l.Close()
+			return err
+		}
+		extra, err := e.Listen()
+		if err != nil {
+			_ = l.Close()
+			return fmt.Errorf("failed to listen on %s: %v", e, err)
+		}
+		glog.Infof("serving on %s", e)
+		go func() {
+			glog.Fatal(server.Serve(g.socketListener(extra)))
+		}()
+	}
+	glog.Fatal(server.Serve(g.socketListener(l)))
+	return nil
+}
+
+// listenSocket listens on the unix socket path which only root can connect to
+func listenSocket(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil {
 		if !os.IsNotExist(err) {
-			return fmt.Errorf("failed to remove %s: %v", private.GalaxySocketPath, err)
+			return nil, fmt.Errorf("failed to remove %s: %v", path, err)
 		}
 	}
-	l, err := net.Listen("unix", private.GalaxySocketPath)
+	l, err := net.Listen("unix", path)
 	if err != nil {
-		return fmt.Errorf("failed to listen on pod info socket: %v", err)
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
 	}
-	if err := os.Chmod(private.GalaxySocketPath, 0600); err != nil {
+	if err := os.Chmod(path, 0600); err != nil {
 		_ = l.Close()
-		return fmt.Errorf("failed to set pod info socket mode: %v", err)
+		return nil, fmt.Errorf("failed to set mode of %s: %v", path, err)
 	}
-
-	glog.Fatal(http.Serve(l, nil))
-	return nil
+	return l, nil
 }
 
 func (g *Galaxy) installHandlers() {
 	ws := new(restful.WebService)
+	ws.Filter(g.accessLog)
+	if g.socketToken != "" {
+		ws.Filter(g.authenticate)
+	}
 	ws.Route(ws.GET("/cni").To(g.cni))
 	ws.Route(ws.POST("/cni").To(g.cni))
+	ws.Route(ws.GET("/metrics").To(g.metrics))
+	ws.Route(ws.GET("/readyz").To(g.readyz))
+	ws.Route(ws.POST("/admin/teardown").To(g.teardown))
+	ws.Route(ws.POST("/admin/firewall/sync").To(g.syncFirewall))
+	ws.Route(ws.POST("/admin/reload").To(g.reload))
+	ws.Route(ws.GET("/admin/maintenance").To(g.getMaintenance))
+	ws.Route(ws.POST("/admin/maintenance").To(g.enterMaintenance))
+	ws.Route(ws.DELETE("/admin/maintenance").To(g.leaveMaintenance))
+	ws.Route(ws.GET("/state/{containerID}").To(g.podState))
+	ws.Route(ws.GET("/state/{containerID}/config").To(g.effectiveConfig))
+	ws.Route(ws.GET("/owner/{ip}").To(g.ipOwner))
+	ws.Route(ws.POST("/admin/debug-attachments").To(g.createDebugAttachment))
+	ws.Route(ws.GET("/admin/debug-attachments").To(g.listDebugAttachments))
+	ws.Route(ws.DELETE("/admin/debug-attachments/{id}").To(g.deleteDebugAttachment))
 	restful.Add(ws)
 }
 
+func (g *Galaxy) metrics(r *restful.Request, w *restful.Response) {
+	g.updateMetrics()
+	metrics.Handler().ServeHTTP(w, r.Request)
+}
+
+// updateMetrics updates gauges which are read on demand
+func (g *Galaxy) updateMetrics() {
+	g.pmLock.Lock()
+	if g.pmhandler != nil {
+		hostportPods.WithLabelValues().Set(float64(g.pmhandler.HostportPods()))
+	}
+	g.pmLock.Unlock()
+	if g.deferred != nil {
+		deferredCleanups.WithLabelValues().Set(float64(g.deferred.Len()))
+	}
+	pendingAdds.WithLabelValues().Set(float64(g.pendingAdds()))
+}
+
+// serveMetrics serves /metrics on MetricsBindAddress for prometheus which can't reach the unix socket
+func (g *Galaxy) serveMetrics() error {
+	if g.MetricsBindAddress == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		g.updateMetrics()
+		metrics.Handler().ServeHTTP(w, r)
+	})
+	l, err := net.Listen("tcp", g.MetricsBindAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", g.MetricsBindAddress, err)
+	}
+	glog.Infof("serving metrics on %s", g.MetricsBindAddress)
+	go func() {
+		glog.Fatal(http.Serve(l, mux))
+	}()
+	return nil
+}
+
 func (g *Galaxy) cni(r *restful.Request, w *restful.Response) {
 	data, err := ioutil.ReadAll(r.Request.Body)
 	if err != nil {
@@ -90,15 +214,38 @@ func (g *Galaxy) cni(r *restful.Request, w *restful.Response) {
 		return
 	}
 	defer r.Request.Body.Close() // nolint: errcheck
-	req, err := galaxyapi.CniRequestToPodRequest(data)
+	g.traceRequest(data)
+	cr, err := galaxyapi.ParseCNIRequest(data)
+	var req *galaxyapi.PodRequest
+	var gcReq *galaxyapi.GCRequest
+	if err == nil && cr.Command() == cniutil.COMMAND_GC {
+		gcReq, err = cr.GCRequest()
+	} else if err == nil {
+		req, err = cr.PodRequest()
+	}
 	if err != nil {
 		glog.Warningf("bad request %v", err)
-		http.Error(w, fmt.Sprintf("%v", err), http.StatusBadRequest)
+		if bad, ok := err.(*galaxyapi.RequestError); ok {
+			writeCNIError(w, http.StatusBadRequest, bad.CNIError())
+		} else {
+			http.Error(w, fmt.Sprintf("%v", err), http.StatusBadRequest)
+		}
+		return
+	}
+	if gcReq != nil {
+		g.serveGC(w, gcReq)
 		return
 	}
-	req.Path = strings.TrimRight(fmt.Sprintf("%s:%s", req.Path, strings.Join(g.CNIPaths, ":")), ":")
+	req.Path = g.cniPath(req.Path)
 	result, err := g.requestFunc(req)
-	if err != nil {
+	if gone, ok := err.(*galaxyapi.SandboxGoneError); ok {
+		writeCNIError(w, http.StatusGone, gone.CNIError())
+	} else if m, ok := err.(*galaxyapi.MaintenanceError); ok {
+		writeCNIError(w, http.StatusServiceUnavailable, m.CNIError())
+	} else if conflict, ok := err.(*types.Error); ok && conflict.Code == galaxyapi.ErrCodeIPConflict {
+		writeCNIError(w, http.StatusConflict, conflict)
+	} else if err != nil {
+		err = g.explainPermissionError(err)
 		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
 	} else {
 		// Empty response JSON means success with no body
@@ -109,19 +256,59 @@ func (g *Galaxy) cni(r *restful.Request, w *restful.Response) {
 	}
 }
 
+// cniPath appends --cni-paths of galaxy to the CNI_PATH of a request
+func (g *Galaxy) cniPath(path string) string {
+	return strings.TrimRight(fmt.Sprintf("%s:%s", path, strings.Join(g.CNIPaths, ":")), ":")
+}
+
 // #lizard forgives
 func (g *Galaxy) requestFunc(req *galaxyapi.PodRequest) (data []byte, err error) {
 	start := time.Now()
 	glog.Infof("%v, %s+", req, start.Format(time.StampMicro))
+	defer func() {
+		cniRequests.WithLabelValues(req.Command, resultLabel(err)).Inc()
+		cniRequestDuration.WithLabelValues(req.Command).Observe(time.Since(start).Seconds())
+	}()
 	if req.Command == cniutil.COMMAND_ADD {
 		defer func() {
 			glog.Infof("%v, data %s, err %v, %s-", req, string(data), err, start.Format(time.StampMicro))
 		}()
+		args := *req.CmdArgs
+		g.beginAdd(req.ContainerID)
+		defer g.endAdd(req.ContainerID)
+		defer func() {
+			if err != nil && sandboxGone(req) {
+				err = g.rollbackAdd(req, args, err)
+			}
+		}()
+		// port mapping of a previous ADD may still be in progress
+		g.waitPortMapping(req.ContainerID)
+		// kubelet re-adds all pods after restarting, serve them without touching apiserver or the dataplane
+		cached, err1 := g.loadResult(req)
+		if err1 == nil {
+			glog.Infof("%v served from result cache", req)
+			data = cached.Result
+			return
+		}
+		if !os.IsNotExist(err1) {
+			glog.Infof("%v: %v", req, err1)
+		}
+		if m := g.maintenance(); m != nil {
+			err = &galaxyapi.MaintenanceError{Reason: m.Reason}
+			return
+		}
+		if sandboxGone(req) {
+			err = fmt.Errorf("netns doesn't exist")
+			return
+		}
 		var pod *corev1.Pod
 		pod, err = g.getPod(req.PodName, req.PodNamespace)
 		if err != nil {
 			return
 		}
+		if err = g.claimContainer(req, pod); err != nil {
+			return
+		}
 		result, err1 := g.cmdAdd(req, pod)
 		if err1 != nil {
 			err = err1
@@ -131,15 +318,43 @@ func (g *Galaxy) requestFunc(req *galaxyapi.PodRequest) (data []byte, err error)
 			if err2 != nil {
 				err = err2
 			} else {
+				if err = g.assignIP(req, pod, result020); err != nil {
+					return
+				}
 				data, err = json.Marshal(result)
 				if err != nil {
 					return
 				}
-				err = g.setupPortMapping(req, req.ContainerID, result020, pod)
-				if err != nil {
-					g.cleanupPortMapping(req)
+				tuning := tuneQueues(req, pod)
+				if err = g.setupConnLimit(req, pod, result020); err != nil {
+					return
+				}
+				if err = g.setupMTU(req, pod, result020); err != nil {
+					return
+				}
+				if err = shapeBandwidth(req, pod); err != nil {
+					return
+				}
+				if err = g.guardIPv6(req, pod); err != nil {
+					return
+				}
+				if err = g.isolateVlans(); err != nil {
+					return
+				}
+				if err = g.markNetwork(req, result020); err != nil {
 					return
 				}
+				g.bindARP(req.ContainerID, req.Netns, req.PodNamespace+"/"+req.PodName)
+				g.syncARPResponders()
+				if g.AsyncPortMapping {
+					g.asyncSetupPortMapping(req, result020, pod, data, tuning)
+				} else {
+					err = g.setupPortMapping(req, req.ContainerID, result020, pod)
+					if err != nil {
+						g.cleanupPortMapping(req, nil)
+						return
+					}
+				}
 				pod.Status.PodIP = result020.IP4.IP.IP.String()
 				if g.pm != nil {
 					if err := g.pm.SyncPodChains(pod); err != nil {
@@ -147,22 +362,85 @@ func (g *Galaxy) requestFunc(req *galaxyapi.PodRequest) (data []byte, err error)
 					}
 					g.pm.SyncPodIPInIPSet(pod, true)
 				}
+				if !g.AsyncPortMapping {
+					g.cacheResult(req, data, tuning)
+				}
+				g.triggerAdvertiseRoutes()
+				g.recordEffectiveConfig(req, pod, tuning)
 			}
 		}
 	} else if req.Command == cniutil.COMMAND_DEL {
 		defer glog.Infof("%v err %v, %s-", req, err, start.Format(time.StampMicro))
-		err = cniutil.CmdDel(req.CmdArgs, -1)
-		if err == nil {
-			err = g.cleanupPortMapping(req)
+		if !g.ownsContainer(req) {
+			glog.Warningf("%v: state of the container id is owned by another pod, skipping", req)
+			return
 		}
+		err = g.cmdDel(req)
+		g.triggerAdvertiseRoutes()
+	} else if req.Command == cniutil.COMMAND_CHECK {
+		defer func() {
+			glog.Infof("%v err %v, %s-", req, err, start.Format(time.StampMicro))
+		}()
+		if err = g.portMappingErr(req.ContainerID); err != nil {
+			return
+		}
+		err = g.checkResult(req)
 	} else {
 		err = fmt.Errorf("unknown command %s", req.Command)
 	}
 	return
 }
 
+// cmdDel releases networks and host side state of the container, whatever fails to be released is retried in
+// background
+func (g *Galaxy) cmdDel(req *galaxyapi.PodRequest) error {
+	g.dropReusedNetns(req)
+	args := *req.CmdArgs
+	g.waitPortMapping(req.ContainerID)
+	g.forgetPortMapping(req.ContainerID)
+	released := g.releaseIPs(req.ContainerID)
+	parked := g.parkPorts(req)
+	err, rulesErr := g.delContainer(req)
+	g.syncARPResponders()
+	if err == nil {
+		if parked {
+			// host ports are parked for the next sandbox of the pod, only entries of the released ips are flushed
+			if err = g.cleanIPtables(req.ContainerID); err == nil {
+				flushConntrack(req.ContainerID, released, nil)
+			}
+		} else {
+			err = g.cleanupPortMapping(req, released)
+		}
+	}
+	if err != nil || rulesErr != nil {
+		// kubelet may never retry DEL once the pod is gone, make sure the remaining resources get released
+		if err1 := g.deferDel(req, args, rulesErr != nil); err1 != nil {
+			glog.Errorf("failed to defer cleanup of %s: %v", req.ContainerID, err1)
+		}
+	}
+	if err == nil {
+		err = rulesErr
+	}
+	return err
+}
+
+// delContainer drops state of the container, deletes its networks and cleans up rules of it besides port mappings.
+// DEL and teardown share it, ips, port mappings and arp responders are left to them to release in their own way. It
+// returns the error of deleting networks and that of cleaning up the rules.
+func (g *Galaxy) delContainer(req *galaxyapi.PodRequest) (error, error) {
+	g.dropResult(req.ContainerID)
+	g.dropOwner(req.ContainerID)
+	g.dropEffectiveConfig(req.ContainerID)
+	g.unbindARP(req.ContainerID)
+	unshapeBandwidth(req)
+	err := cniutil.CmdDel(req.CmdArgs, -1)
+	g.releaseDHCPLeases(req.ContainerID)
+	return err, g.cleanupPodRules(req.ContainerID)
+}
+
 func parsePorts(pod *corev1.Pod) []k8s.Port {
 	_, portMappingOn := pod.Annotations[k8s.PortMappingPortsAnnotation]
+	vips := parseDSRVIPs(pod)
 	var ports []k8s.Port
 	for _, container := range pod.Spec.Containers {
 		for _, port := range container.Ports {
@@ -171,9 +449,11 @@ func parsePorts(pod *corev1.Pod) []k8s.Port {
 					HostPort:      port.HostPort,
 					ContainerPort: port.ContainerPort,
 					Protocol:      string(port.Protocol),
+					Name:          port.Name,
 					PodName:       pod.Name,
 					HostIP:        port.HostIP,
 					PodIP:         pod.Status.PodIP,
+					VIP:           vips[dsrKey(port.ContainerPort, string(port.Protocol))],
 				}
 				ports = append(ports, tmp)
 			}
@@ -182,36 +462,73 @@ func parsePorts(pod *corev1.Pod) []k8s.Port {
 	return ports
 }
 
+func dsrKey(containerPort int32, protocol string) string {
+	if protocol == "" {
+		protocol = string(corev1.ProtocolTCP)
+	}
+	return fmt.Sprintf("%d/%s", containerPort, strings.ToUpper(protocol))
+}
+
+// parseDSRVIPs returns vips of DSR ports keyed by dsrKey from the dsr annotation of pod
+func parseDSRVIPs(pod *corev1.Pod) map[string]string {
+	annotation := pod.Annotations[k8s.DSRPortsAnnotation]
+	if annotation == "" {
+		return nil
+	}
+	var dsrPorts []k8s.Port
+	if err := json.Unmarshal([]byte(annotation), &dsrPorts); err != nil {
+		glog.Warningf("failed to unmarshal %s_%s annotation %s: %v", pod.Name, pod.Namespace,
+			k8s.DSRPortsAnnotation, err)
+		return nil
+	}
+	if err := k8s.ResolveNamedPorts(&pod.Spec, dsrPorts); err != nil {
+		glog.Warningf("bad %s_%s annotation %s: %v", pod.Name, pod.Namespace, k8s.DSRPortsAnnotation, err)
+		return nil
+	}
+	vips := map[string]string{}
+	for _, port := range dsrPorts {
+		vips[dsrKey(port.ContainerPort, port.Protocol)] = port.VIP
+	}
+	return vips
+}
+
 // #lizard forgives
 func (g *Galaxy) resolveNetworks(req *galaxyapi.PodRequest, pod *corev1.Pod) ([]*cniutil.NetworkInfo, error) {
 	var networkInfos []*cniutil.NetworkInfo
-	if pod.Annotations == nil || pod.Annotations[constant.MultusCNIAnnotation] == "" {
-		if utils.WantENIIP(&pod.Spec) && g.ENIIPNetwork != "" {
-			networkInfos = append(networkInfos, cniutil.NewNetworkInfo(g.ENIIPNetwork, g.getNetworkConf(g.ENIIPNetwork),
+	// requested are interface names the networks annotation requests
+	var requested []string
+	// ifNameFormat names interfaces of networks other than the primary one if nothing else does
+	ifNameFormat := "eth%d"
+	annotation, v := networksAnnotation(pod)
+	if annotation == constant.NetworksAnnotation {
+		ifNameFormat = "net%d"
+	}
+	if v == "" {
+		defaultNetworks, eniIPNetwork := g.defaultNetworks()
+		if utils.WantENIIP(&pod.Spec) && eniIPNetwork != "" {
+			networkInfos = append(networkInfos, cniutil.NewNetworkInfo(eniIPNetwork, g.getNetworkConf(eniIPNetwork),
 				req.IfName))
 		} else {
-			for i, netName := range g.DefaultNetworks {
-				networkInfos = append(networkInfos, cniutil.NewNetworkInfo(netName, g.getNetworkConf(netName),
-					setNetInterface("", i, req.IfName)))
+			for _, netName := range defaultNetworks {
+				networkInfos = append(networkInfos, cniutil.NewNetworkInfo(netName, g.getNetworkConf(netName), ""))
 			}
 		}
+		requested = make([]string, len(networkInfos))
 	} else {
-		v := pod.Annotations[constant.MultusCNIAnnotation]
-		glog.V(4).Infof("pod %s_%s network annotation is %s", pod.Name, pod.Namespace, v)
+		glog.V(4).Infof("pod %s_%s network annotation %s is %s", pod.Name, pod.Namespace, annotation, v)
 		networks, err := k8s.ParsePodNetworkAnnotation(v)
 		if err != nil {
 			return nil, err
 		}
 		//init networkInfo
-		for idx, network := range networks {
+		for _, network := range networks {
 			netConf := g.getNetworkConf(network.Name)
 			if netConf == nil {
 				return nil, fmt.Errorf("pod %s_%s requires network %s which is not configured", pod.Name,
 					pod.Namespace, network.Name)
 			}
-			networkInfo := cniutil.NewNetworkInfo(network.Name, netConf,
-				setNetInterface(network.InterfaceRequest, idx, req.CmdArgs.IfName))
-			networkInfos = append(networkInfos, networkInfo)
+			networkInfos = append(networkInfos, cniutil.NewNetworkInfo(network.Name, netConf, ""))
+			requested = append(requested, network.InterfaceRequest)
 		}
 	}
 	extendedCNIArgs, err := parseExtendedCNIArgs(pod)
@@ -225,12 +542,48 @@ func (g *Galaxy) resolveNetworks(req *galaxyapi.PodRequest, pod *corev1.Pod) ([]
 			}
 		}
 	}
+	// templates of interface names may refer to vlans of ips of the args
+	if err := g.nameInterfaces(networkInfos, requested, req.IfName, ifNameFormat); err != nil {
+		return nil, err
+	}
+	setRuntimeConfig(req, networkInfos)
 	glog.V(4).Infof("pod %s_%s networkInfo %v", pod.Name, pod.Namespace, networkInfos)
 	return networkInfos, nil
 }
 
+// networksAnnotation returns the annotation of networks of pod and its value, MultusCNIAnnotation takes precedence
+// over NetworksAnnotation
+func networksAnnotation(pod *corev1.Pod) (string, string) {
+	for _, annotation := range []string{constant.MultusCNIAnnotation, constant.NetworksAnnotation} {
+		if v := pod.Annotations[annotation]; v != "" {
+			return annotation, v
+		}
+	}
+	return "", ""
+}
+
+// setRuntimeConfig passes runtimeConfig of req to each network whose config declares the capabilities as a runtime
+// does. The config is copied since it is shared by all pods of the network.
+func setRuntimeConfig(req *galaxyapi.PodRequest, networkInfos []*cniutil.NetworkInfo) {
+	if req.RuntimeConfig == nil {
+		return
+	}
+	for i := range networkInfos {
+		runtimeConfig := req.RuntimeConfig.ForCapabilities(networkInfos[i].Conf)
+		if runtimeConfig == nil {
+			continue
+		}
+		conf := make(map[string]interface{}, len(networkInfos[i].Conf)+1)
+		for k, v := range networkInfos[i].Conf {
+			conf[k] = v
+		}
+		conf["runtimeConfig"] = runtimeConfig
+		networkInfos[i].Conf = conf
+	}
+}
+
 func (g *Galaxy) getNetworkConf(networkName string) map[string]interface{} {
-	if netConf, ok := g.netConf[networkName]; ok {
+	if netConf, ok := g.networkConfs()[networkName]; ok {
 		return netConf
 	}
 	// In the absence of existing network config from json
@@ -256,14 +609,40 @@ func (g *Galaxy) getNetworkConf(networkName string) map[string]interface{} {
 }
 
 func (g *Galaxy) cmdAdd(req *galaxyapi.PodRequest, pod *corev1.Pod) (types.Result, error) {
-	if err := disableIPv6(req.Netns); err != nil {
-		glog.Warningf("Error disable ipv6 %v", err)
-	}
 	networkInfos, err := g.resolveNetworks(req, pod)
 	if err != nil {
 		return nil, err
 	}
-	return cniutil.CmdAdd(req.CmdArgs, networkInfos)
+	ipv6Mode, err := g.ipv6Mode(networkInfos)
+	if err != nil {
+		return nil, err
+	}
+	g.prepareIPv6(req, ipv6Mode)
+	if err := g.waitFlannel(networkInfos); err != nil {
+		return nil, err
+	}
+	if err := g.acquireDHCPLeases(req, pod, networkInfos); err != nil {
+		g.releaseDHCPLeases(req.ContainerID)
+		return nil, err
+	}
+	result, err := cniutil.CmdAdd(req.CmdArgs, networkInfos)
+	if err != nil {
+		g.releaseDHCPLeases(req.ContainerID)
+		return nil, err
+	}
+	if err := g.setupDNS(req, pod, networkInfos, result); err != nil {
+		return nil, err
+	}
+	if err := tuneLinks(req, networkInfos); err != nil {
+		return nil, err
+	}
+	if err := selectEgressGateway(req, pod, networkInfos); err != nil {
+		return nil, err
+	}
+	if err := addStaticRoutes(req, pod); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 // parseExtendedCNIArgs parses extended cni args from pod's annotation
@@ -289,7 +668,7 @@ func (g *Galaxy) setupIPtables() error {
 	if err != nil {
 		return fmt.Errorf("failed to get pods on node: %v", err)
 	}
-	var allPorts []k8s.Port
+	podPorts := map[string][]k8s.Port{}
 	for i := range pods.Items {
 		pod := &pods.Items[i]
 		if pod.Status.Phase != corev1.PodRunning || pod.Spec.HostNetwork {
@@ -302,11 +681,63 @@ func (g *Galaxy) setupIPtables() error {
 					k8s.PortMappingPortsAnnotation, err)
 				continue
 			}
+			if err := k8s.ResolveNamedPorts(&pod.Spec, ports); err != nil {
+				glog.Warningf("bad %s_%s annotation %s: %v", pod.Name, pod.Namespace,
+					k8s.PortMappingPortsAnnotation, err)
+				continue
+			}
 		} else {
 			ports = parsePorts(pod)
 		}
+		if len(ports) != 0 {
+			podPorts[k8s.GetPodFullName(pod.Name, pod.Namespace)] = ports
+		}
+	}
+	// Most nodes, e.g. flannel only nodes, have no pod using ports. Skip port mapping entirely until a pod needs it
+	// unless rules of previous pods may be left.
+	if containers, err := k8s.PortFileContainers(); err == nil && len(containers) == 0 && len(podPorts) == 0 {
+		glog.Infof("no pod uses ports, port mapping will be initialized on first use")
+		return nil
+	}
+	g.pmLock.Lock()
+	defer g.pmLock.Unlock()
+	return g.initPortMapping(podPorts)
+}
+
+// portMapping returns the port mapping handler, it initializes port mapping on first use
+func (g *Galaxy) portMapping() *portmapping.PortMappingHandler {
+	g.pmLock.Lock()
+	defer g.pmLock.Unlock()
+	if g.pmhandler == nil {
+		if err := g.initPortMapping(nil); err != nil {
+			glog.Warning(err)
+		}
+	}
+	return g.pmhandler
+}
+
+// hostportRules returns the rule manager of hostports of the firewall backend
+func (g *Galaxy) hostportRules() portmapping.RuleManager {
+	g.portMapping()
+	g.pmLock.Lock()
+	defer g.pmLock.Unlock()
+	return g.portRules
+}
+
+// initPortMapping opens hostports of podPorts, syncs iptables or nftables rules of them and starts ensuring basic
+// rules. It must be called with pmLock held.
+func (g *Galaxy) initPortMapping(podPorts map[string][]k8s.Port) error {
+	g.pmhandler = portmapping.New("", g.HostportShards)
+	g.portRules = g.pmhandler
+	if g.firewallBackend == options.FirewallBackendNftables {
+		g.portRules = portmapping.NewNftRules()
+	} else if err := portmapping.RemoveNftTable(); err != nil {
+		glog.Warningf("failed to remove nftables rules of hostports: %v", err)
+	}
+	var allPorts []k8s.Port
+	for podFullName, ports := range podPorts {
 		// open ports on start
-		if err := g.pmhandler.OpenHostports(k8s.GetPodFullName(pod.Name, pod.Namespace), false, ports); err != nil {
+		if err := g.pmhandler.OpenHostports(podFullName, false, ports); err != nil {
 			// port maybe taken by other process during restart, but we can do nothing about that
 			// we should still setting up iptables for it.
 			glog.Warning(err)
@@ -314,33 +745,46 @@ func (g *Galaxy) setupIPtables() error {
 		allPorts = append(allPorts, ports...)
 	}
 	// sync all iptables on start
-	if err := g.pmhandler.SetupPortMappingForAllPods(allPorts); err != nil {
-		return fmt.Errorf("failed to setup portmappings for all pods, ports %+v: %v", allPorts, err)
-	}
-	go wait.Until(func() {
+	err := g.portRules.SetupPortMappingForAllPods(allPorts)
+	ensurer := g.newBasicRuleEnsurer("portmapping", g.portRules.EnsureBasicRule)
+	g.addFirewallLoop("portmapping", time.Minute, func() error {
 		glog.V(4).Infof("starting to ensure iptables rules")
 		defer glog.V(4).Infof("ensure iptables rules complete")
-		if err := g.pmhandler.EnsureBasicRule(); err != nil {
-			glog.Warningf("failed to ensure iptables rules")
-		}
-	}, 1*time.Minute, make(chan struct{}))
+		return ensurer.run()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to setup portmappings for all pods, ports %+v: %v", allPorts, err)
+	}
 	return nil
 }
 
 func (g *Galaxy) setupPortMapping(req *galaxyapi.PodRequest, containerID string, result *t020.Result,
-	pod *corev1.Pod) error {
+	pod *corev1.Pod) (err error) {
+	defer func() {
+		if err != nil {
+			portMappingFailures.WithLabelValues().Inc()
+		}
+	}()
 	_, portMappingOn := pod.Annotations[k8s.PortMappingPortsAnnotation]
+	podFullName := k8s.GetPodFullName(req.PodName, req.PodNamespace)
 	req.Ports = parsePorts(pod)
 	if len(req.Ports) == 0 {
+		g.takeOverPorts(podFullName, nil)
 		return nil
 	}
+	hostInterface := hostInterfaceOf(result.IP4.IP.IP)
 	for i := range req.Ports {
 		req.Ports[i].PodIP = result.IP4.IP.IP.To4().String()
 		req.Ports[i].PodName = req.PodName
+		req.Ports[i].HostInterface = hostInterface
 	}
-	if err := g.pmhandler.OpenHostports(k8s.GetPodFullName(req.PodName, req.PodNamespace), portMappingOn,
-		req.Ports); err != nil {
-		return err
+	// port mappings and hostports of the previous container of the pod are still there if it is taken over
+	tookOver := g.takeOverPorts(podFullName, req.Ports)
+	pmhandler := g.portMapping()
+	if !tookOver {
+		if err := pmhandler.OpenHostports(podFullName, portMappingOn, req.Ports); err != nil {
+			return err
+		}
 	}
 	data, err := json.Marshal(req.Ports)
 	if err != nil {
@@ -349,8 +793,10 @@ func (g *Galaxy) setupPortMapping(req *galaxyapi.PodRequest, containerID string,
 	if err := k8s.SavePort(containerID, data); err != nil {
 		return fmt.Errorf("failed to save ports %v", err)
 	}
-	if err := g.pmhandler.SetupPortMapping(req.Ports); err != nil {
-		return fmt.Errorf("failed to setup port mapping %v: %v", req.Ports, err)
+	if !tookOver {
+		if err := g.hostportRules().SetupPortMapping(req.Ports); err != nil {
+			return fmt.Errorf("failed to setup port mapping %v: %v", req.Ports, err)
+		}
 	}
 	if portMappingOn {
 		if err := g.updatePortMappingAnnotation(req, data); err != nil {
@@ -361,6 +807,25 @@ func (g *Galaxy) setupPortMapping(req *galaxyapi.PodRequest, containerID string,
 	return nil
 }
 
+// hostInterfaceOf returns the host interface which is directly connected to ip, e.g. the flannel bridge, a vlan
+// bridge or a host veth. It returns "" if ip is reached via a gateway, e.g. pods of macvlan or eni networks.
+func hostInterfaceOf(ip net.IP) string {
+	routes, err := netlink.RouteGet(ip)
+	if err != nil || len(routes) == 0 {
+		glog.Warningf("failed to get route to %s: %v", ip, err)
+		return ""
+	}
+	if routes[0].Gw != nil {
+		return ""
+	}
+	link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+	if err != nil {
+		glog.Warningf("failed to get link of route to %s: %v", ip, err)
+		return ""
+	}
+	return link.Attrs().Name
+}
+
 func (g *Galaxy) updatePortMappingAnnotation(req *galaxyapi.PodRequest, data []byte) error {
 	return wait.Poll(10*time.Millisecond, 1*time.Minute, func() (bool, error) {
 		pod, err := g.client.CoreV1().Pods(req.PodNamespace).Get(req.PodName, v1.GetOptions{})
@@ -383,11 +848,46 @@ func (g *Galaxy) updatePortMappingAnnotation(req *galaxyapi.PodRequest, data []b
 	})
 }
 
-func (g *Galaxy) cleanupPortMapping(req *galaxyapi.PodRequest) error {
-	g.pmhandler.CloseHostports(k8s.GetPodFullName(req.PodName, req.PodNamespace))
-	return g.cleanIPtables(req.ContainerID)
+// cleanupPortMapping removes port mappings of the container and conntrack entries of them and of releasedIPs, the
+// ips of the container released by DEL
+func (g *Galaxy) cleanupPortMapping(req *galaxyapi.PodRequest, releasedIPs []net.IP) error {
+	g.pmLock.Lock()
+	pmhandler := g.pmhandler
+	g.pmLock.Unlock()
+	if pmhandler != nil {
+		pmhandler.CloseHostports(k8s.GetPodFullName(req.PodName, req.PodNamespace))
+	}
+	// the port file is gone after cleaning up iptables, entries are flushed once no rule recreates them
+	ports := conntrackPorts(req.ContainerID)
+	if err := g.cleanIPtables(req.ContainerID); err != nil {
+		return err
+	}
+	flushConntrack(req.ContainerID, releasedIPs, ports)
+	return nil
 }
 
+// cleanupPodRules removes rules of the container besides port mappings, i.e. connection limits, mss clamping and
+// neighbor discovery guards. They live as long as the container, so only DEL, deferred DEL and gc remove them.
+func (g *Galaxy) cleanupPodRules(containerID string) error {
+	if err := g.connLimit.Cleanup(containerID); err != nil {
+		return err
+	}
+	if err := g.mssClamp.Cleanup(containerID); err != nil {
+		return err
+	}
+	return g.ndGuard.Cleanup(containerID)
+}
+
+// gcContainer releases host side state of a container which is gone without a successful DEL
+func (g *Galaxy) gcContainer(containerID string) error {
+	g.unbindARP(containerID)
+	if err := g.cleanupPodRules(containerID); err != nil {
+		return err
+	}
+	return g.cleanIPtables(containerID)
+}
+
+// cleanIPtables removes hostports, hostport rules and the port file of the container
 func (g *Galaxy) cleanIPtables(containerID string) error {
 	ports, err := k8s.ConsumePort(containerID)
 	if err != nil {
@@ -397,7 +897,9 @@ func (g *Galaxy) cleanIPtables(containerID string) error {
 		return fmt.Errorf("failed to read ports %v", err)
 	}
 	if len(ports) != 0 {
-		if err := g.pmhandler.CleanPortMapping(ports); err != nil {
+		pmhandler := g.portMapping()
+		pmhandler.CloseHostportsOf(ports)
+		if err := g.hostportRules().CleanPortMapping(ports); err != nil {
 			return err
 		}
 		if err := k8s.RemovePortFile(containerID); err != nil && !os.IsNotExist(err) {
@@ -407,12 +909,27 @@ func (g *Galaxy) cleanIPtables(containerID string) error {
 	return nil
 }
 
+// disableIPv6 disables ipv6 of the netns path, it falls back to execute disable-ipv6 if it fails to write sysctl.
+// disable-ipv6 enters the netns by an fd galaxy holds, a /proc/<pid>/ns/net path may refer to another netns by the
+// time it opens the path if the pid exits and is reused.
 func disableIPv6(path string) error {
+	err := galaxyutils.DisableIPv6(path)
+	if err == nil {
+		return nil
+	}
+	glog.V(4).Infof("failed to disable ipv6 of %s natively, falling back to disable-ipv6: %v", path, err)
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %s: %v", path, err)
+	}
+	defer f.Close() // nolint: errcheck
 	cmd := &exec.Cmd{
-		Path:   "/opt/cni/bin/disable-ipv6",
-		Args:   append([]string{"set-ipv6"}, path),
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+		Path: "/opt/cni/bin/disable-ipv6",
+		// ExtraFiles start from fd 3 of the child
+		Args:       []string{"set-ipv6", "/proc/self/fd/3"},
+		ExtraFiles: []*os.File{f},
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
 	}
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("reexec to set IPv6 failed: %v", err)
@@ -426,6 +943,7 @@ func (g *Galaxy) getPod(name, namespace string) (*corev1.Pod, error) {
 	if err := wait.PollImmediate(time.Millisecond*500, 5*time.Second, func() (done bool, err error) {
 		pod, err = g.client.CoreV1().Pods(namespace).Get(name, v1.GetOptions{})
 		if err != nil {
+			ipamRequestErrors.WithLabelValues("apiserver").Inc()
 			if errors.IsNotFound(err) {
 				if printOnce == false {
 					printOnce = true
@@ -446,9 +964,10 @@ func convertResult(result types.Result) (*t020.Result, error) {
 	if result == nil {
 		return nil, fmt.Errorf("result is nil")
 	}
-	result020, ok := result.(*t020.Result)
-	if !ok {
-		return nil, fmt.Errorf("faild to convert result to 020 result")
+	// plugins returning results of 0.3.0 or later have their first ipv4 address converted to IP4
+	result020, err := t020.GetResult(result)
+	if err != nil {
+		return nil, fmt.Errorf("faild to convert result to 020 result: %v", err)
 	}
 	if result020.IP4 == nil {
 		return nil, fmt.Errorf("CNI plugin reported no IPv4 address")
@@ -459,13 +978,3 @@ func convertResult(result types.Result) (*t020.Result, error) {
 	}
 	return result020, nil
 }
-
-func setNetInterface(netIf string, idx int, argIf string) string {
-	if idx == 0 {
-		return argIf
-	}
-	if netIf != "" {
-		return netIf
-	}
-	return fmt.Sprintf("eth%d", idx)
-}
@@ -0,0 +1,142 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/network/vlan"
+	"tkestack.io/galaxy/pkg/utils/store"
+)
+
+const (
+	// vlanDevicesPath records devices of vlan networks galaxy has run with, so that devices of networks removed from
+	// network-conf are known after restarts
+	vlanDevicesPath      = "/var/lib/cni/galaxy/vlan/devices"
+	staleVlanInterval    = time.Minute
+	staleVlanCleanReason = "StaleVlanDevicesDeleted"
+)
+
+// vlanDevices returns devices of vlan networks of network-conf, sriov networks create none
+func (g *Galaxy) vlanDevices() []vlan.Devices {
+	var devs []vlan.Devices
+	for _, d := range g.vlanNetConfs() {
+		if !d.SRIOVMode() {
+			devs = append(devs, d.Devices())
+		}
+	}
+	return devs
+}
+
+func loadVlanDevices() ([]vlan.Devices, error) {
+	data, err := ioutil.ReadFile(vlanDevicesPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var devs []vlan.Devices
+	if err := json.Unmarshal(data, &devs); err != nil {
+		return nil, err
+	}
+	return devs, nil
+}
+
+func saveVlanDevices(devs []vlan.Devices) error {
+	data, err := json.Marshal(devs)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(vlanDevicesPath), 0700); err != nil {
+		return err
+	}
+	return store.WriteFile(vlanDevicesPath, data, 0600)
+}
+
+// startStaleVlanCleanup diffs vlan networks of network-conf against those galaxy ran with before. Vlan bridges and
+// vlan devices of networks which are gone are deleted periodically once pods have left them, then the networks are
+// forgotten.
+func (g *Galaxy) startStaleVlanCleanup() {
+	current := g.vlanDevices()
+	recorded, err := loadVlanDevices()
+	if err != nil {
+		glog.Warningf("failed to load %s: %v", vlanDevicesPath, err)
+	}
+	var stale []vlan.Devices
+	for _, devs := range recorded {
+		if !containsDevices(current, devs) && !containsDevices(stale, devs) {
+			stale = append(stale, devs)
+		}
+	}
+	if err := saveVlanDevices(append(current, stale...)); err != nil {
+		glog.Warningf("failed to save %s: %v", vlanDevicesPath, err)
+	}
+	if len(stale) == 0 {
+		return
+	}
+	glog.Infof("vlan networks %+v are removed from network-conf, deleting their devices after pods leave", stale)
+	go func() {
+		for {
+			stale = g.cleanStaleVlans(stale, current)
+			if err := saveVlanDevices(append(current, stale...)); err != nil {
+				glog.Warningf("failed to save %s: %v", vlanDevicesPath, err)
+			}
+			if len(stale) == 0 {
+				return
+			}
+			select {
+			case <-g.quitChan:
+				return
+			case <-time.After(staleVlanInterval):
+			}
+		}
+	}()
+}
+
+// cleanStaleVlans deletes drained devices of stale networks and returns the networks which still have devices
+func (g *Galaxy) cleanStaleVlans(stale, current []vlan.Devices) []vlan.Devices {
+	var left []vlan.Devices
+	for _, devs := range stale {
+		remaining, err := vlan.DeleteDrained(devs, current)
+		if err != nil {
+			glog.Warningf("failed to delete devices of stale vlan network %+v: %v", devs, err)
+		}
+		if err != nil || remaining > 0 {
+			left = append(left, devs)
+			continue
+		}
+		g.recordNodeEvent(corev1.EventTypeNormal, staleVlanCleanReason, "deleted devices of vlan network on "+
+			"%s removed from network-conf", devs.Device)
+	}
+	return left
+}
+
+func containsDevices(list []vlan.Devices, devs vlan.Devices) bool {
+	for i := range list {
+		if list[i] == devs {
+			return true
+		}
+	}
+	return false
+}
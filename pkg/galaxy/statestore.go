@@ -0,0 +1,103 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"fmt"
+	"path"
+
+	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/client-go/dynamic"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/galaxy/options"
+	"tkestack.io/galaxy/pkg/ipam/crd"
+	"tkestack.io/galaxy/pkg/utils/store"
+	"tkestack.io/galaxy/pkg/utils/store/crdstore"
+)
+
+// buckets of the state store
+const (
+	portBucket = "port"
+	ipBucket   = "ips"
+)
+
+// setupStateStore keeps ports and assigned ips of containers in the store of StateStore instead of files of the
+// node, state in the files is moved to the store first. Galaxy refuses to start if it fails, rather than losing
+// track of state.
+func (g *Galaxy) setupStateStore() error {
+	newStore, err := g.stateStoreBuilder()
+	if err != nil || newStore == nil {
+		return err
+	}
+	ports, ips := newStore(portBucket), newStore(ipBucket)
+	for _, m := range []struct {
+		bucket string
+		from   store.Store
+		to     store.Store
+	}{
+		{bucket: portBucket, from: store.NewFileStore(k8s.PortStateDir), to: ports},
+		{bucket: ipBucket, from: store.NewFileStore(assignedIPDir), to: ips},
+	} {
+		moved, err := store.Migrate(m.from, m.to)
+		if err != nil {
+			return fmt.Errorf("failed to move %s state to %s state store: %v", m.bucket, g.StateStore, err)
+		}
+		if moved > 0 {
+			glog.Infof("moved %d keys of %s state to %s state store", moved, m.bucket, g.StateStore)
+		}
+	}
+	k8s.SetPortStore(ports)
+	g.assignedIPs = ips
+	g.remoteStores = []store.Store{ports}
+	return nil
+}
+
+// stateStoreBuilder returns the builder of buckets of the state store of StateStore, nil if it is file
+func (g *Galaxy) stateStoreBuilder() (func(bucket string) store.Store, error) {
+	node := k8s.GetHostname()
+	switch g.StateStore {
+	case options.StateStoreEtcd:
+		client, err := store.NewEtcdClient(&store.EtcdConfig{Endpoints: g.StateStoreEtcdEndpoints,
+			CAFile: g.StateStoreEtcdCAFile, CertFile: g.StateStoreEtcdCertFile, KeyFile: g.StateStoreEtcdKeyFile})
+		if err != nil {
+			return nil, fmt.Errorf("bad etcd state store: %v", err)
+		}
+		return func(bucket string) store.Store {
+			return store.NewEtcdStore(client, path.Join(g.StateStoreEtcdPrefix, node, bucket))
+		}, nil
+	case options.StateStoreCRD:
+		if g.restConfig == nil {
+			return nil, fmt.Errorf("crd state store requires a client of the apiserver")
+		}
+		extensionClient, err := apiextensionsclient.NewForConfig(g.restConfig)
+		if err != nil {
+			return nil, err
+		}
+		if err := crd.EnsureNodeStateCRDCreated(extensionClient); err != nil {
+			return nil, fmt.Errorf("failed to create crd of node state: %v", err)
+		}
+		client, err := dynamic.NewForConfig(g.restConfig)
+		if err != nil {
+			return nil, err
+		}
+		return func(bucket string) store.Store {
+			return crdstore.New(client, node, bucket)
+		}, nil
+	}
+	return nil, nil
+}
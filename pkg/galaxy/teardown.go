@@ -0,0 +1,181 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/emicklei/go-restful"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/network/kernel"
+)
+
+// defaultCNIPath is where kubelet looks for cni binaries, teardown has no request from kubelet to learn it from
+const defaultCNIPath = "/opt/cni/bin"
+
+// TeardownResult is the response of a teardown request
+type TeardownResult struct {
+	// Containers is the number of containers whose networks are torn down
+	Containers int
+	// Failed maps ids of containers failed to be torn down to the errors
+	Failed map[string]string `json:",omitempty"`
+}
+
+// teardown tears down networking of all pods on the node for decommission. Instead of a DEL request per pod, it
+// deletes all hostport rules by a single iptables-restore, releases ips of all pods at once and deletes networks by a
+// pool of workers, the size of which is the concurrency query parameter. Kubelet should be stopped before it.
+func (g *Galaxy) teardown(r *restful.Request, w *restful.Response) {
+	concurrency := 20
+	if c := r.QueryParameter("concurrency"); c != "" {
+		var err error
+		if concurrency, err = strconv.Atoi(c); err != nil || concurrency < 1 {
+			http.Error(w, fmt.Sprintf("bad concurrency %s", c), http.StatusBadRequest)
+			return
+		}
+	}
+	start := time.Now()
+	result, err := g.teardownAll(concurrency)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	glog.Infof("tore down %d containers, %d failed, %v", result.Containers, len(result.Failed), time.Since(start))
+	data, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		glog.Warningf("Error writing teardown HTTP response: %v", err)
+	}
+}
+
+func (g *Galaxy) teardownAll(concurrency int) (*TeardownResult, error) {
+	// hostports first, so that no traffic is forwarded to pods being torn down
+	if err := g.teardownPortMapping(); err != nil {
+		return nil, err
+	}
+	containers, err := cniutil.NetworkInfoContainers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %v", err)
+	}
+	// ips of all containers are released by a single pass over the registry, and their conntrack entries by a
+	// single dump of the conntrack table after networks are deleted
+	ids := map[string]bool{}
+	for _, containerID := range containers {
+		ids[containerID] = true
+	}
+	released := g.releaseIPsOf(ids)
+	result := &TeardownResult{Containers: len(containers), Failed: map[string]string{}}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	ch := make(chan string)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for containerID := range ch {
+				if err := g.teardownNetworks(containerID); err != nil {
+					lock.Lock()
+					result.Failed[containerID] = err.Error()
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, containerID := range containers {
+		ch <- containerID
+	}
+	close(ch)
+	wg.Wait()
+	g.syncARPResponders()
+	if n, err := kernel.FlushConntrack(released, nil); err != nil {
+		glog.Warningf("failed to flush conntrack entries of released ips: %v", err)
+	} else if n > 0 {
+		glog.V(4).Infof("flushed %d conntrack entries of %d released ips", n, len(released))
+	}
+	return result, nil
+}
+
+// teardownPortMapping closes all hostports and deletes all hostport rules at once
+func (g *Galaxy) teardownPortMapping() error {
+	pmhandler := g.portMapping()
+	pmhandler.CloseAllHostports()
+	if err := g.hostportRules().SetupPortMappingForAllPods(nil); err != nil {
+		return fmt.Errorf("failed to delete hostport rules: %v", err)
+	}
+	containers, err := k8s.PortFileContainers()
+	if err != nil {
+		return fmt.Errorf("failed to list port files: %v", err)
+	}
+	for _, containerID := range containers {
+		if err := k8s.RemovePortFile(containerID); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("failed to remove port file of %s: %v", containerID, err)
+		}
+	}
+	return nil
+}
+
+// teardownNetworks deletes networks of the container and releases what is set up for it like DEL does
+func (g *Galaxy) teardownNetworks(containerID string) error {
+	args, podName, podNamespace := g.delArgs(containerID)
+	req := &galaxyapi.PodRequest{PodName: podName, PodNamespace: podNamespace, CmdArgs: &args}
+	err, rulesErr := g.delContainer(req)
+	if err != nil {
+		return err
+	}
+	return rulesErr
+}
+
+// delArgs builds cni args of a DEL request of the container which the runtime doesn't send. The pod and netns it was
+// added for are known from the result cache, without which or if the netns path refers to another netns now the
+// networks are deleted with an empty netns as if the netns was gone. The pod is known from the owner of the container
+// otherwise.
+func (g *Galaxy) delArgs(containerID string) (args skel.CmdArgs, podName, podNamespace string) {
+	args = skel.CmdArgs{ContainerID: containerID, IfName: "eth0",
+		Path: strings.Join(append([]string{defaultCNIPath}, g.CNIPaths...), ":")}
+	if data, err := g.results.Get(containerID); err == nil {
+		var c cachedResult
+		if err := json.Unmarshal(data, &c); err == nil {
+			args.Netns, args.IfName = c.netnsInEffect(), c.IfName
+			podName, podNamespace = c.PodName, c.PodNamespace
+		}
+	}
+	if podName == "" {
+		if o, err := g.loadOwner(containerID); err == nil {
+			podName, podNamespace = o.PodName, o.PodNamespace
+		}
+	}
+	cniArgs := map[string]string{"IgnoreUnknown": "true", k8s.K8S_POD_INFRA_CONTAINER_ID: containerID}
+	if podName != "" {
+		cniArgs[k8s.K8S_POD_NAME], cniArgs[k8s.K8S_POD_NAMESPACE] = podName, podNamespace
+	}
+	args.Args = cniutil.BuildCNIArgs(cniArgs)
+	return
+}
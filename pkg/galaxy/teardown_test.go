@@ -0,0 +1,95 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tkestack.io/galaxy/pkg/galaxy/options"
+	"tkestack.io/galaxy/pkg/network/connlimit"
+	"tkestack.io/galaxy/pkg/network/dhcp"
+	"tkestack.io/galaxy/pkg/network/mtu"
+	"tkestack.io/galaxy/pkg/network/ndguard"
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+	iptablesTest "tkestack.io/galaxy/pkg/utils/iptables/testing"
+	"tkestack.io/galaxy/pkg/utils/store"
+)
+
+// #lizard forgives
+func TestTeardownNetworks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-teardown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	fake := iptablesTest.NewFakeIPTables()
+	g := &Galaxy{
+		ServerRunOptions: options.NewServerRunOptions(),
+		results:          store.NewFileStore(filepath.Join(dir, "result")),
+		owners:           store.NewFileStore(filepath.Join(dir, "owner")),
+		effectiveConfigs: store.NewFileStore(filepath.Join(dir, "effective")),
+		assignedIPs:      store.NewFileStore(filepath.Join(dir, "ip")),
+		connLimit:        connlimit.New(filepath.Join(dir, "cl")),
+		mssClamp:         mtu.New(filepath.Join(dir, "mss")),
+		ndGuard:          ndguard.New(filepath.Join(dir, "nd")),
+		dhcp:             dhcp.NewManager(filepath.Join(dir, "dhcp")),
+	}
+	g.connLimit.Interface, g.mssClamp.Interface = fake, fake
+	// containers of the test have no network infos, deleting their networks does nothing
+	containers := []string{"teardown-c1", "teardown-c2", "teardown-c3"}
+	for i, containerID := range containers {
+		data, err := json.Marshal(&assignedIP{ContainerID: containerID, PodName: "pod", PodNamespace: "default"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.assignedIPs.Put(fmt.Sprintf("10.0.0.%d", i+1), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	released := g.releaseIPsOf(map[string]bool{containers[0]: true, containers[1]: true})
+	if len(released) != 2 {
+		t.Fatalf("expect 2 released ips, real %v", released)
+	}
+	if keys, err := g.assignedIPs.Keys(); err != nil || len(keys) != 1 || keys[0] != "10.0.0.3" {
+		t.Fatalf("expect ip of %s left, real %v, %v", containers[2], keys, err)
+	}
+	if err := g.connLimit.Setup(containers[0], "uid1", "10.0.0.1", &connlimit.Limit{MaxConnections: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.owners.Put(containers[0], []byte(`{"PodName":"pod","PodNamespace":"default"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.teardownNetworks(containers[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.owners.Get(containers[0]); !os.IsNotExist(err) {
+		t.Fatalf("expect owner dropped, real %v", err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := fake.SaveInto(utiliptables.TableFilter, buf); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("GALAXY-CL-")) {
+		t.Fatalf("expect connection limit rules removed, real %s", buf.String())
+	}
+}
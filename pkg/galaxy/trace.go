@@ -0,0 +1,51 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+
+	glog "k8s.io/klog"
+)
+
+var traceLock sync.Mutex
+
+// traceRequest appends the cni request to RequestTraceFile, one request per line
+func (g *Galaxy) traceRequest(data []byte) {
+	if g.RequestTraceFile == "" {
+		return
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := json.Compact(buf, data); err != nil {
+		return
+	}
+	buf.WriteString("\n")
+	traceLock.Lock()
+	defer traceLock.Unlock()
+	f, err := os.OpenFile(g.RequestTraceFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		glog.Warningf("failed to open request trace file: %v", err)
+		return
+	}
+	defer f.Close() // nolint: errcheck
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		glog.Warningf("failed to write request trace file: %v", err)
+	}
+}
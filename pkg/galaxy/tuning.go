@@ -0,0 +1,98 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/network/kernel"
+)
+
+// tuneQueues applies the queue tuning annotation of the pod to its interface. Tuning is an optimization, failures
+// are logged without failing the request. It returns what is applied.
+func tuneQueues(req *galaxyapi.PodRequest, pod *corev1.Pod) *kernel.AppliedQueueTuning {
+	v := pod.Annotations[k8s.QueueTuningAnnotation]
+	if v == "" {
+		return nil
+	}
+	var tuning kernel.QueueTuning
+	if err := json.Unmarshal([]byte(v), &tuning); err != nil {
+		glog.Warningf("bad %s annotation of pod %s: %v", k8s.QueueTuningAnnotation,
+			k8s.GetPodFullName(pod.Name, pod.Namespace), err)
+		return nil
+	}
+	applied, err := kernel.TuneQueues(req.Netns, req.IfName, &tuning)
+	if err != nil {
+		glog.Warningf("failed to tune queues of pod %s: %v", k8s.GetPodFullName(pod.Name, pod.Namespace), err)
+		return nil
+	}
+	glog.V(4).Infof("tuned queues of pod %s: %+v", k8s.GetPodFullName(pod.Name, pod.Namespace), applied)
+	return applied
+}
+
+// parseLinkTuning returns the linkTuning section of a network config, nil if it has none
+func parseLinkTuning(conf map[string]interface{}) (*kernel.LinkTuning, error) {
+	v, ok := conf["linkTuning"]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var tuning kernel.LinkTuning
+	if err := json.Unmarshal(data, &tuning); err != nil {
+		return nil, fmt.Errorf("bad linkTuning %s: %v", string(data), err)
+	}
+	if err := tuning.Validate(); err != nil {
+		return nil, err
+	}
+	return &tuning, nil
+}
+
+func validateLinkTuning(v interface{}) error {
+	obj, _ := v.(map[string]interface{})
+	_, err := parseLinkTuning(map[string]interface{}{"linkTuning": obj})
+	return err
+}
+
+// tuneLinks applies linkTuning of each network to the interface of the pod in it. Unlike queue tuning, offloads are
+// turned off to avoid corrupted packets, failures fail the request.
+func tuneLinks(req *galaxyapi.PodRequest, networkInfos []*cniutil.NetworkInfo) error {
+	for _, networkInfo := range networkInfos {
+		tuning, err := parseLinkTuning(networkInfo.Conf)
+		if err != nil {
+			return err
+		}
+		if tuning == nil {
+			continue
+		}
+		if err := kernel.TuneLink(req.Netns, networkInfo.IfName, tuning); err != nil {
+			return fmt.Errorf("failed to tune link %s of network %s: %v", networkInfo.IfName,
+				networkInfo.NetworkType, err)
+		}
+		glog.V(4).Infof("tuned link %s of pod %s_%s: %+v", networkInfo.IfName, req.PodName, req.PodNamespace,
+			tuning)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/metrics"
+	"tkestack.io/galaxy/pkg/network/lldp"
+)
+
+const (
+	uplinkCheckInterval = 30 * time.Second
+
+	uplinkVlanMismatchReason = "UplinkVlanMismatch"
+	uplinkVlanMatchReason    = "UplinkVlanMatch"
+)
+
+var uplinkMissingVlans = metrics.NewGaugeVec("galaxy_uplink_missing_vlans", "Number of vlans of networks of the "+
+	"node which switch ports of uplinks don't carry by LLDP", "device")
+
+// UplinkStatus is the switch port of an uplink of vlan networks by LLDP and vlans it misses
+type UplinkStatus struct {
+	Device string `json:"device"`
+	// Neighbor is the switch port of the last LLDP frame within its ttl, nil if there is none
+	Neighbor *lldp.Neighbor `json:"neighbor,omitempty"`
+	// Expected are vlans networks of the node use on the uplink
+	Expected []uint16 `json:"expected,omitempty"`
+	// Missing are expected vlans the switch port doesn't carry
+	Missing []uint16 `json:"missing,omitempty"`
+}
+
+type uplinkNeighbor struct {
+	*lldp.Neighbor
+	receivedAt time.Time
+}
+
+// vlanUplinks returns uplinks of vlan networks, i.e. devices of the networks or parents of them if they are vlan
+// devices, and vlans of vlan devices among them
+func (g *Galaxy) vlanUplinks() map[string][]uint16 {
+	uplinks := map[string][]uint16{}
+	for _, conf := range g.networkConfs() {
+		device, _ := conf["device"].(string)
+		if conf["type"] != "galaxy-k8s-vlan" || device == "" {
+			continue
+		}
+		link, err := netlink.LinkByName(device)
+		if err != nil {
+			glog.Warningf("failed to get device %s: %v", device, err)
+			continue
+		}
+		if vlanLink, ok := link.(*netlink.Vlan); ok {
+			parent, err := netlink.LinkByIndex(link.Attrs().ParentIndex)
+			if err != nil {
+				glog.Warningf("failed to get parent of vlan device %s: %v", device, err)
+				continue
+			}
+			uplinks[parent.Attrs().Name] = append(uplinks[parent.Attrs().Name], uint16(vlanLink.VlanId))
+			continue
+		}
+		if _, ok := uplinks[device]; !ok {
+			uplinks[device] = nil
+		}
+	}
+	return uplinks
+}
+
+// startUplinkValidation listens LLDP on uplinks of vlan networks if UplinkVlans is set, and reports vlans of the
+// node which switch ports don't carry by events and readiness, e.g. a vlan missing from a trunk port, before pods
+// are scheduled to the node
+func (g *Galaxy) startUplinkValidation() {
+	if g.UplinkVlans == nil {
+		return
+	}
+	uplinks := g.vlanUplinks()
+	if len(uplinks) == 0 {
+		return
+	}
+	g.uplinkNeighbors = map[string]*uplinkNeighbor{}
+	for device := range uplinks {
+		device := device
+		lldp.Listen(device, g.quitChan, func(n *lldp.Neighbor) {
+			g.uplinkLock.Lock()
+			defer g.uplinkLock.Unlock()
+			if last, ok := g.uplinkNeighbors[device]; !ok || last.String() != n.String() {
+				glog.Infof("uplink %s is connected to %s", device, n)
+			}
+			g.uplinkNeighbors[device] = &uplinkNeighbor{Neighbor: n, receivedAt: time.Now()}
+		})
+	}
+	reported := map[string]string{}
+	go wait.Until(func() {
+		for _, status := range g.uplinkStatuses() {
+			uplinkMissingVlans.WithLabelValues(status.Device).Set(float64(len(status.Missing)))
+			var missing string
+			if len(status.Missing) > 0 {
+				missing = fmt.Sprint(status.Missing)
+			}
+			if missing == reported[status.Device] {
+				continue
+			}
+			if missing != "" {
+				glog.Warningf("switch port %s of uplink %s doesn't carry vlans %v", status.Neighbor,
+					status.Device, status.Missing)
+				g.recordNodeEvent(corev1.EventTypeWarning, uplinkVlanMismatchReason, "switch port %s of uplink %s "+
+					"doesn't carry vlans %v", status.Neighbor, status.Device, status.Missing)
+			} else {
+				glog.Infof("switch port of uplink %s carries all vlans %v", status.Device, status.Expected)
+				g.recordNodeEvent(corev1.EventTypeNormal, uplinkVlanMatchReason, "switch port of uplink %s "+
+					"carries all vlans %v", status.Device, status.Expected)
+			}
+			reported[status.Device] = missing
+		}
+	}, uplinkCheckInterval, g.quitChan)
+}
+
+// uplinkStatuses validates vlans of uplinks by their neighbors, vlans are expected if they are either UplinkVlans or
+// of vlan devices on uplinks. It returns nil if uplinks are not validated.
+func (g *Galaxy) uplinkStatuses() []UplinkStatus {
+	if g.uplinkNeighbors == nil {
+		return nil
+	}
+	vlanLinks := map[int][]uint16{}
+	if links, err := netlink.LinkList(); err != nil {
+		glog.Warningf("failed to list links: %v", err)
+	} else {
+		for _, link := range links {
+			if vlanLink, ok := link.(*netlink.Vlan); ok {
+				vlanLinks[link.Attrs().ParentIndex] = append(vlanLinks[link.Attrs().ParentIndex],
+					uint16(vlanLink.VlanId))
+			}
+		}
+	}
+	now := time.Now()
+	var statuses []UplinkStatus
+	for device, vlans := range g.vlanUplinks() {
+		status := UplinkStatus{Device: device}
+		expected := map[uint16]bool{}
+		for _, id := range append(append(vlans, g.UplinkVlans.Vlans...), uplinkVlanLinks(device, vlanLinks)...) {
+			if !expected[id] {
+				expected[id] = true
+				status.Expected = append(status.Expected, id)
+			}
+		}
+		sort.Slice(status.Expected, func(i, j int) bool {
+			return status.Expected[i] < status.Expected[j]
+		})
+		g.uplinkLock.Lock()
+		if n, ok := g.uplinkNeighbors[device]; ok && now.Sub(n.receivedAt) <= n.TTL {
+			status.Neighbor = n.Neighbor
+			status.Missing = n.Missing(status.Expected)
+		}
+		g.uplinkLock.Unlock()
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Device < statuses[j].Device
+	})
+	return statuses
+}
+
+// uplinkVlanLinks returns vlans of vlan devices whose parent is device
+func uplinkVlanLinks(device string, vlanLinks map[int][]uint16) []uint16 {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return nil
+	}
+	return vlanLinks[link.Attrs().Index]
+}
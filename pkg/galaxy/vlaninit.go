@@ -0,0 +1,65 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"sync"
+
+	glog "k8s.io/klog"
+)
+
+// vlanInitConcurrency is the max number of vlan networks initialized at the same time on startup
+const vlanInitConcurrency = 4
+
+// initVlanNetworks initializes drivers of vlan networks on startup by a pool of workers, so that nodes of many vlan
+// networks don't wait for them one by one. Failures are logged only, ADD requests of the networks report them.
+func (g *Galaxy) initVlanNetworks() {
+	drivers := g.vlanNetConfs()
+	errs := parallelize(len(drivers), vlanInitConcurrency, func(i int) error {
+		return drivers[i].Init()
+	})
+	for i, err := range errs {
+		if err != nil {
+			glog.Warningf("failed to init vlan network of device %s: %v", drivers[i].Device, err)
+		}
+	}
+}
+
+// parallelize calls fn with 0 to n-1 by at most workers goroutines and returns the errors in the order of them
+func parallelize(n, workers int, fn func(i int) error) []error {
+	errs := make([]error, n)
+	if workers > n {
+		workers = n
+	}
+	var wg sync.WaitGroup
+	ch := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,60 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParallelize(t *testing.T) {
+	var running, max int32
+	errs := parallelize(10, 3, func(i int) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		if i%2 == 0 {
+			return fmt.Errorf("network %d", i)
+		}
+		return nil
+	})
+	if max > 3 {
+		t.Fatalf("expect at most 3 networks initialized at the same time, real %d", max)
+	}
+	if max < 2 {
+		t.Fatalf("expect networks initialized in parallel, real %d at most", max)
+	}
+	if len(errs) != 10 {
+		t.Fatalf("expect 10 errors, real %d", len(errs))
+	}
+	for i, err := range errs {
+		if (i%2 == 0) != (err != nil) {
+			t.Errorf("expect error of network %d only if it's even, real %v", i, err)
+		}
+	}
+	if errs := parallelize(0, 3, func(i int) error { return nil }); len(errs) != 0 {
+		t.Fatalf("expect no error without networks, real %v", errs)
+	}
+}
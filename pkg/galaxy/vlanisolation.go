@@ -0,0 +1,70 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"time"
+
+	"tkestack.io/galaxy/pkg/network/vlan"
+	"tkestack.io/galaxy/pkg/network/vlanisolation"
+)
+
+// pureVlanBridgePrefixes returns bridge name prefixes of vlan networks in pure mode which route pods on the node
+func (g *Galaxy) pureVlanBridgePrefixes() []string {
+	var prefixes []string
+	for _, conf := range g.networkConfs() {
+		if conf["type"] != "galaxy-k8s-vlan" || conf["switch"] != "pure" {
+			continue
+		}
+		prefix, _ := conf["bridge_name_prefix"].(string)
+		if prefix == "" {
+			prefix = vlan.BridgePrefix
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// setupVlanIsolation syncs vlan isolation rules periodically, it removes rules left by previous configs if isolation
+// is disabled
+func (g *Galaxy) setupVlanIsolation() error {
+	conf := g.VlanIsolation
+	if conf == nil {
+		conf = &vlanisolation.Config{}
+	}
+	h, err := vlanisolation.New(g.pureVlanBridgePrefixes(), conf)
+	if err != nil {
+		return err
+	}
+	if g.VlanIsolation == nil {
+		return h.Remove()
+	}
+	if err := h.Sync(); err != nil {
+		return err
+	}
+	g.vlanIsolation = h
+	g.addFirewallLoop("vlan isolation", time.Minute, h.Sync)
+	return nil
+}
+
+// isolateVlans isolates bridges of new vlans created by an ADD before its pod starts
+func (g *Galaxy) isolateVlans() error {
+	if g.vlanIsolation == nil {
+		return nil
+	}
+	return g.vlanIsolation.SyncIfChanged()
+}
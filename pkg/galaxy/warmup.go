@@ -0,0 +1,108 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package galaxy
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	"tkestack.io/galaxy/pkg/utils"
+)
+
+// startARPWarmUp announces ips galaxy-ipam binds to pods of the node from ARPWarmUpDevice before the pods start, so
+// that arp caches of upstream routers and mac tables of switches are warm once the pods serve. The mac of the device
+// is a placeholder until the pods announce their own macs on ADD, or the right one in pure mode which proxies arp.
+func (g *Galaxy) startARPWarmUp() {
+	if g.ARPWarmUpDevice == "" {
+		return
+	}
+	factory := informers.NewFilteredSharedInformerFactory(g.client, time.Minute, metav1.NamespaceAll,
+		func(listOptions *metav1.ListOptions) {
+			listOptions.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", k8s.GetHostname()).String()
+		})
+	factory.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: g.warmUpPod,
+		UpdateFunc: func(_, obj interface{}) {
+			g.warmUpPod(obj)
+		},
+		DeleteFunc: g.forgetWarmUp,
+	})
+	go factory.Start(g.quitChan)
+}
+
+// warmUpPod announces ips of the pod once if it is bound but not started yet
+func (g *Galaxy) warmUpPod(obj interface{}) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	key := pod.Namespace + "/" + pod.Name
+	if pod.Status.PodIP != "" {
+		// started pods announce their own macs
+		g.forgetWarmUp(pod)
+		return
+	}
+	if pod.Annotations[constant.ExtendedCNIArgsAnnotation] == "" {
+		return
+	}
+	ipInfos, err := constant.ParseIPInfo(pod.Annotations[constant.ExtendedCNIArgsAnnotation])
+	if err != nil || len(ipInfos) == 0 {
+		return
+	}
+	ips := constant.FormatIPs(ipInfos)
+	g.warmUpLock.Lock()
+	announced := g.warmedUp[key] == ips
+	g.warmedUp[key] = ips
+	g.warmUpLock.Unlock()
+	if announced {
+		return
+	}
+	// announcing sleeps between packets, don't block the informer
+	go func() {
+		for i := range ipInfos {
+			if ipInfos[i].IP == nil {
+				continue
+			}
+			if err := utils.AnnounceIP(g.ARPWarmUpDevice, ipInfos[i].IP.IP, ipInfos[i].Vlan); err != nil {
+				glog.Warningf("failed to announce ip %s of pod %s: %v", ipInfos[i].IP.IP, key, err)
+				continue
+			}
+			glog.V(4).Infof("announced ip %s vlan %d of pod %s", ipInfos[i].IP.IP, ipInfos[i].Vlan, key)
+		}
+	}()
+}
+
+// forgetWarmUp forgets ips announced of the pod
+func (g *Galaxy) forgetWarmUp(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	g.warmUpLock.Lock()
+	delete(g.warmedUp, pod.Namespace+"/"+pod.Name)
+	g.warmUpLock.Unlock()
+}
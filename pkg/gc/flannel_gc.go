@@ -30,6 +30,9 @@ import (
 	"k8s.io/apimachinery/pkg/util/wait"
 	glog "k8s.io/klog"
 	"tkestack.io/galaxy/pkg/api/docker"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/metrics"
+	"tkestack.io/galaxy/pkg/utils/store"
 )
 
 const (
@@ -49,8 +52,24 @@ var (
 	// "type":"galaxy-veth"}
 	// /var/lib/cni/galaxy/port/$containerid stores port infos, it's like [{"hostPort":52701,"containerPort":19998,
 	// "protocol":"tcp","podName":"loader-server-seanyulei-1","podIP":"172.16.24.119"}]
-	flagGCDirs = flag.String("gc_dirs", "/var/lib/cni/flannel,/var/lib/cni/galaxy,/var/lib/cni/galaxy/port", "Comma "+
-		"separated configure storage directory of cni plugin, the file names in this directory are container ids")
+	// /var/lib/cni/galaxy/result/$containerid stores the cached result of the ADD request of the container
+	// /var/lib/cni/galaxy/connlimit/$containerid stores the pod ip and connection limits of the container
+	// /var/lib/cni/galaxy/ndguard/$containerid stores bridge ports of the container guarded by ebtables
+	// /var/lib/cni/galaxy/owner/$containerid stores the pod owning the state of the container
+	// /var/lib/cni/galaxy/mss/$containerid stores the pod ip and clamped mss of the container
+	// /var/lib/cni/galaxy/vf/$containerid stores the sriov vf allocated to the container by galaxy-k8s-vlan
+	// /var/lib/cni/galaxy/effective/$containerid stores what galaxy did for the container
+	flagGCDirs = flag.String("gc_dirs", "/var/lib/cni/flannel,/var/lib/cni/galaxy,/var/lib/cni/galaxy/port,"+
+		"/var/lib/cni/galaxy/result,/var/lib/cni/galaxy/connlimit,/var/lib/cni/galaxy/ndguard,"+
+		"/var/lib/cni/galaxy/owner,/var/lib/cni/galaxy/mss,/var/lib/cni/galaxy/vf,/var/lib/cni/galaxy/effective",
+		"Comma separated configure storage directory of cni plugin, the file names in this directory are container ids")
+	flagGCStateMaxAge = flag.Duration("gc_state_max_age", 0, "Max age of state files in gc_dirs whose container "+
+		"can't be inspected, e.g. container ids docker always fails to inspect. 0 means no limit")
+)
+
+var (
+	stateFiles = metrics.NewGaugeVec("galaxy_state_files", "Number of state files in gc dir", "dir")
+	stateBytes = metrics.NewGaugeVec("galaxy_state_bytes", "Total size in bytes of state files in gc dir", "dir")
 )
 
 type flannelGC struct {
@@ -59,10 +78,13 @@ type flannelGC struct {
 	dockerCli      *docker.DockerInterface
 	quit           <-chan struct{}
 	cleanPortFunc  func(containerID string) error
+	stateMaxAge    time.Duration
+	// stores keep state of containers keyed by container ids out of gcDirs, e.g. in etcd
+	stores []store.Store
 }
 
 func NewFlannelGC(dockerCli *docker.DockerInterface, quit <-chan struct{},
-	cleanPortFunc func(containerID string) error) GC {
+	cleanPortFunc func(containerID string) error, stores ...store.Store) GC {
 	dirs := strings.Split(*flagGCDirs, ",")
 	return &flannelGC{
 		allocatedIPDir: *flagAllocatedIPDir,
@@ -70,6 +92,8 @@ func NewFlannelGC(dockerCli *docker.DockerInterface, quit <-chan struct{},
 		dockerCli:      dockerCli,
 		quit:           quit,
 		cleanPortFunc:  cleanPortFunc,
+		stateMaxAge:    *flagGCStateMaxAge,
+		stores:         stores,
 	}
 }
 
@@ -88,6 +112,7 @@ func (gc *flannelGC) Run() {
 		if err := gc.cleanupGCDirs(); err != nil {
 			glog.Errorf("Error executing cleanup gc_dirs %v", err)
 		}
+		gc.cleanupStores()
 	}, *flagFlannelGCInterval, gc.quit)
 
 	go wait.Until(func() {
@@ -135,18 +160,75 @@ func (gc *flannelGC) cleanupGCDirs() error {
 			glog.Errorf("failed to read dir %s", dir)
 			continue
 		}
+		var files, size int64
 		for _, fi := range fis {
 			if fi.IsDir() {
 				continue
 			}
-			if gc.shouldCleanup(fi.Name()) {
+			if store.IsTmpFile(fi.Name()) {
+				// temp files of writes interrupted by crash
+				if time.Since(fi.ModTime()) > time.Minute {
+					_ = os.Remove(filepath.Join(dir, fi.Name()))
+				}
+				continue
+			}
+			if fi.Size() == 0 && time.Since(fi.ModTime()) > time.Minute {
+				// empty files are left by interrupted writes, they carry no state
 				gc.removeLeakyStateFile(filepath.Join(dir, fi.Name()))
+				continue
 			}
+			if gc.shouldCleanup(fi.Name()) || gc.expired(fi) {
+				gc.removeLeakyStateFile(filepath.Join(dir, fi.Name()))
+				continue
+			}
+			files++
+			size += fi.Size()
 		}
+		stateFiles.WithLabelValues(dir).Set(float64(files))
+		stateBytes.WithLabelValues(dir).Set(float64(size))
 	}
 	return nil
 }
 
+// cleanupStores removes state of containers which are gone from stores
+func (gc *flannelGC) cleanupStores() {
+	for _, s := range gc.stores {
+		keys, err := s.Keys()
+		if err != nil {
+			glog.Warningf("failed to list keys of state store: %v", err)
+			continue
+		}
+		for _, containerID := range keys {
+			if !gc.shouldCleanup(containerID) {
+				continue
+			}
+			if err := gc.cleanPortFunc(containerID); err != nil {
+				glog.Warningf("failed to clean port of container %s: %v", containerID, err)
+			}
+			if err := s.Delete(containerID); err != nil && !os.IsNotExist(err) {
+				glog.Warningf("failed to delete state of container %s: %v", containerID, err)
+			} else if err == nil {
+				glog.Infof("Deleted state of container %s", containerID)
+			}
+		}
+	}
+}
+
+// expired returns true if the state file is older than stateMaxAge and its container is not running. It bounds state
+// files of containers which docker keeps failing to inspect.
+func (gc *flannelGC) expired(fi os.FileInfo) bool {
+	if gc.stateMaxAge <= 0 || time.Since(fi.ModTime()) < gc.stateMaxAge ||
+		strings.HasPrefix(fi.Name(), constant.DebugContainerIDPrefix) {
+		return false
+	}
+	c, err := gc.dockerCli.InspectContainer(fi.Name())
+	if err == nil && c.State != nil && c.State.Running {
+		return false
+	}
+	glog.Infof("state file of container %s expired, inspect error: %v", fi.Name(), err)
+	return true
+}
+
 func (gc *flannelGC) cleanupVeth() error {
 	links, err := netlink.LinkList()
 	if err != nil {
@@ -178,6 +260,10 @@ func (gc *flannelGC) cleanupVeth() error {
 }
 
 func (gc *flannelGC) shouldCleanup(cid string) bool {
+	if strings.HasPrefix(cid, constant.DebugContainerIDPrefix) {
+		// debug attachments are released by galaxy after expiring
+		return false
+	}
 	if c, err := gc.dockerCli.InspectContainer(cid); err != nil {
 		if _, ok := err.(docker.ContainerNotFoundError); ok {
 			glog.Infof("container %s not found", cid)
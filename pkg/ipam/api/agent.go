@@ -0,0 +1,46 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package api
+
+import (
+	"net/http"
+
+	"github.com/emicklei/go-restful"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin"
+	"tkestack.io/galaxy/pkg/utils/httputil"
+)
+
+// AgentController serves liveness of galaxy of nodes
+type AgentController struct {
+	Livenesses func() ([]*schedulerplugin.AgentLiveness, error)
+}
+
+// ListAgentsResp is the response of listing agents
+type ListAgentsResp struct {
+	httputil.Resp
+	Agents []*schedulerplugin.AgentLiveness `json:"agents"`
+}
+
+// List lists liveness of galaxy of nodes by their agent leases
+func (c *AgentController) List(req *restful.Request, resp *restful.Response) {
+	livenesses, err := c.Livenesses()
+	if err != nil {
+		httputil.InternalError(resp, err)
+		return
+	}
+	resp.WriteEntity(ListAgentsResp{Resp: httputil.NewResp(http.StatusOK, ""), Agents: livenesses}) // nolint: errcheck
+}
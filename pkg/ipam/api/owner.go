@@ -0,0 +1,216 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/emicklei/go-restful"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+	"tkestack.io/galaxy/pkg/utils/httputil"
+)
+
+// PodIPIndex is the name of the pod informer index of pod ips
+const PodIPIndex = "podIP"
+
+// maxOwnerIPs is the max number of ips of a batch owner lookup
+const maxOwnerIPs = 1000
+
+// IndexPodIPs indexes pods by their status ip and ips galaxy-ipam allocated to them. Pods of host network share ips
+// of nodes and terminated pods own no ip, they are not indexed.
+func IndexPodIPs(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || pod.Spec.HostNetwork || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return nil, nil
+	}
+	ips := map[string]bool{}
+	if pod.Status.PodIP != "" {
+		ips[pod.Status.PodIP] = true
+	}
+	for _, ip := range strings.Split(pod.Annotations[constant.IPsAnnotation], ",") {
+		if ip != "" {
+			ips[ip] = true
+		}
+	}
+	var keys []string
+	for ip := range ips {
+		keys = append(keys, ip)
+	}
+	return keys, nil
+}
+
+// OwnerController answers which pod owns an ip right now by pods of the informer and allocations of ipams, both of
+// which are in memory and follow watch events
+type OwnerController struct {
+	IPAM, SecondIPAM floatingip.IPAM
+	// PodIndexer is the indexer of the pod informer having PodIPIndex
+	PodIndexer cache.Indexer
+}
+
+// IPOwner is the owner of an ip
+type IPOwner struct {
+	IP        string `json:"ip"`
+	Namespace string `json:"namespace,omitempty"`
+	PodName   string `json:"podName,omitempty"`
+	PodUID    string `json:"podUID,omitempty"`
+	NodeName  string `json:"nodeName,omitempty"`
+	// Phase is the phase of the pod, empty if the ip is allocated to a pod which doesn't exist
+	Phase    string `json:"phase,omitempty"`
+	AppName  string `json:"appName,omitempty"`
+	AppType  string `json:"appType,omitempty"`
+	PoolName string `json:"poolName,omitempty"`
+	// Allocated tells if the ip is allocated by galaxy-ipam, ips of overlay networks are not
+	Allocated bool `json:"allocated"`
+}
+
+// SwaggerDoc is to generate Swagger docs
+func (IPOwner) SwaggerDoc() map[string]string {
+	return map[string]string{
+		"phase":     "phase of the pod, empty if the ip is allocated to a pod which doesn't exist, e.g. a deleted pod of a statefulset keeping its ip",
+		"allocated": "if the ip is allocated by galaxy-ipam, ips of overlay networks are not",
+	}
+}
+
+// OwnersReq is the request of looking up owners of ips in a batch
+type OwnersReq struct {
+	IPs []string `json:"ips"`
+}
+
+// OwnersResp is the response of looking up owners of ips in a batch
+type OwnersResp struct {
+	httputil.Resp
+	// Owners are owners of ips of the request which have one
+	Owners []*IPOwner `json:"owners"`
+}
+
+// Get looks up the owner of an ip
+func (c *OwnerController) Get(req *restful.Request, resp *restful.Response) {
+	ip := net.ParseIP(req.PathParameter("ip"))
+	if ip == nil {
+		httputil.BadRequest(resp, fmt.Errorf("bad ip %q", req.PathParameter("ip")))
+		return
+	}
+	owner, err := c.lookup(ip)
+	if err != nil {
+		httputil.InternalError(resp, err)
+		return
+	}
+	if owner == nil {
+		httputil.ItemNotFound(resp, fmt.Errorf("owner of %s", ip))
+		return
+	}
+	resp.WriteEntity(owner) // nolint: errcheck
+}
+
+// List looks up owners of ips in a batch
+func (c *OwnerController) List(req *restful.Request, resp *restful.Response) {
+	var ownersReq OwnersReq
+	if err := req.ReadEntity(&ownersReq); err != nil {
+		httputil.BadRequest(resp, err)
+		return
+	}
+	if len(ownersReq.IPs) > maxOwnerIPs {
+		httputil.BadRequest(resp, fmt.Errorf("more than %d ips", maxOwnerIPs))
+		return
+	}
+	owners := []*IPOwner{}
+	for _, s := range ownersReq.IPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			httputil.BadRequest(resp, fmt.Errorf("bad ip %q", s))
+			return
+		}
+		owner, err := c.lookup(ip)
+		if err != nil {
+			httputil.InternalError(resp, err)
+			return
+		}
+		if owner != nil {
+			owners = append(owners, owner)
+		}
+	}
+	resp.WriteEntity(OwnersResp{Resp: httputil.NewResp(http.StatusOK, ""), Owners: owners}) // nolint: errcheck
+}
+
+// lookup returns the owner of ip, nil if none. A live pod having the ip owns it, the allocation of galaxy-ipam tells
+// its app and pool. An ip allocated to a pod which doesn't exist is owned by the allocation.
+func (c *OwnerController) lookup(ip net.IP) (*IPOwner, error) {
+	owner := &IPOwner{IP: ip.String()}
+	for _, ipam := range []floatingip.IPAM{c.IPAM, c.SecondIPAM} {
+		if ipam == nil {
+			continue
+		}
+		fip, err := ipam.ByIP(ip)
+		if err != nil {
+			return nil, err
+		}
+		if fip.Key == "" {
+			continue
+		}
+		keyObj := util.ParseKey(fip.Key)
+		owner.Allocated = true
+		owner.Namespace, owner.PodName = keyObj.Namespace, keyObj.PodName
+		owner.AppName, owner.AppType, owner.PoolName = keyObj.AppName, toAppType(keyObj.AppTypePrefix), keyObj.PoolName
+		break
+	}
+	pod, err := c.podOf(owner)
+	if err != nil {
+		return nil, err
+	}
+	if pod != nil {
+		owner.Namespace, owner.PodName = pod.Namespace, pod.Name
+		owner.PodUID, owner.NodeName, owner.Phase = string(pod.UID), pod.Spec.NodeName, string(pod.Status.Phase)
+	}
+	if pod == nil && !owner.Allocated {
+		return nil, nil
+	}
+	return owner, nil
+}
+
+// podOf returns the pod having the ip of owner, the one of its allocation is preferred if several pods have it, e.g.
+// a terminating pod and its replacement
+func (c *OwnerController) podOf(owner *IPOwner) (*corev1.Pod, error) {
+	objs, err := c.PodIndexer.ByIndex(PodIPIndex, owner.IP)
+	if err != nil {
+		return nil, err
+	}
+	var found *corev1.Pod
+	for _, obj := range objs {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			continue
+		}
+		if owner.Allocated && pod.Namespace == owner.Namespace && pod.Name == owner.PodName {
+			return pod, nil
+		}
+		if found == nil || (found.DeletionTimestamp != nil && pod.DeletionTimestamp == nil) {
+			found = pod
+		}
+	}
+	if owner.Allocated && found != nil {
+		// the ip is allocated to another pod, the pod having it in its status is stale
+		return nil, nil
+	}
+	return found, nil
+}
@@ -0,0 +1,98 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package api
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+)
+
+type fakeOwnerIPAM struct {
+	floatingip.IPAM
+	keys map[string]string
+}
+
+func (ipam *fakeOwnerIPAM) ByIP(ip net.IP) (floatingip.FloatingIP, error) {
+	return floatingip.FloatingIP{IP: ip, Key: ipam.keys[ip.String()]}, nil
+}
+
+func ownerPod(namespace, name, podIP, ips string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Namespace: namespace, Name: name,
+			Annotations: map[string]string{constant.IPsAnnotation: ips}},
+		Spec:   corev1.PodSpec{NodeName: "node1"},
+		Status: corev1.PodStatus{PodIP: podIP, Phase: phase},
+	}
+}
+
+// #lizard forgives
+func TestOwnerLookup(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{PodIPIndex: IndexPodIPs})
+	for _, pod := range []*corev1.Pod{
+		ownerPod("ns1", "app-0", "10.0.0.1", "10.0.0.1,10.0.1.1", corev1.PodRunning),
+		// app-1 is gone, its ip is kept for it and taken by a pod which is not restarted since then
+		ownerPod("ns1", "stale", "10.0.0.2", "", corev1.PodRunning),
+		ownerPod("ns1", "overlay", "172.16.0.2", "", corev1.PodRunning),
+		ownerPod("ns1", "done", "172.16.0.3", "", corev1.PodSucceeded),
+	} {
+		if err := indexer.Add(pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &OwnerController{PodIndexer: indexer,
+		IPAM: &fakeOwnerIPAM{keys: map[string]string{"10.0.0.1": "sts_ns1_app_app-0",
+			"10.0.0.2": "sts_ns1_app_app-1"}},
+		SecondIPAM: &fakeOwnerIPAM{keys: map[string]string{"10.0.1.1": "sts_ns1_app_app-0"}}}
+	for i, testCase := range []struct {
+		ip    string
+		owner *IPOwner
+	}{
+		{ip: "10.0.0.1", owner: &IPOwner{IP: "10.0.0.1", Namespace: "ns1", PodName: "app-0", NodeName: "node1",
+			Phase: "Running", AppName: "app", AppType: "statefulset", Allocated: true}},
+		{ip: "10.0.1.1", owner: &IPOwner{IP: "10.0.1.1", Namespace: "ns1", PodName: "app-0", NodeName: "node1",
+			Phase: "Running", AppName: "app", AppType: "statefulset", Allocated: true}},
+		{ip: "10.0.0.2", owner: &IPOwner{IP: "10.0.0.2", Namespace: "ns1", PodName: "app-1", AppName: "app",
+			AppType: "statefulset", Allocated: true}},
+		{ip: "172.16.0.2", owner: &IPOwner{IP: "172.16.0.2", Namespace: "ns1", PodName: "overlay",
+			NodeName: "node1", Phase: "Running"}},
+		{ip: "172.16.0.3"},
+		{ip: "10.0.0.9"},
+	} {
+		owner, err := c.lookup(net.ParseIP(testCase.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(owner, testCase.owner) {
+			t.Errorf("case %d: expect %+v, real %+v", i, testCase.owner, owner)
+		}
+	}
+}
+
+func TestIndexPodIPs(t *testing.T) {
+	pod := ownerPod("ns1", "app-0", "10.0.0.1", "10.0.0.1,10.0.1.1", corev1.PodRunning)
+	pod.Spec.HostNetwork = true
+	if keys, _ := IndexPodIPs(pod); len(keys) != 0 {
+		t.Errorf("expect no ips of host network pods, real %v", keys)
+	}
+}
@@ -0,0 +1,450 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/apis/galaxy/v1alpha1"
+	"tkestack.io/galaxy/pkg/ipam/client/clientset/versioned"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/ipam/schedulerplugin/util"
+	"tkestack.io/galaxy/pkg/utils/httputil"
+	"tkestack.io/galaxy/pkg/utils/keylock"
+	"tkestack.io/galaxy/pkg/utils/nets"
+)
+
+// SnapshotVersion is the version of snapshots this galaxy-ipam exports and restores
+const SnapshotVersion = 1
+
+// Resolutions of entries of snapshots which conflict with the current state
+const (
+	// ConflictSkip keeps the current state of conflicting entries and restores the others
+	ConflictSkip = "skip"
+	// ConflictOverwrite releases current allocations conflicting with snapshots before restoring them
+	ConflictOverwrite = "overwrite"
+	// ConflictAbort restores nothing if any entry conflicts
+	ConflictAbort = "abort"
+)
+
+const (
+	resolutionSkipped     = "skipped"
+	resolutionOverwritten = "overwritten"
+	resolutionAborted     = "aborted"
+)
+
+// Snapshot is the portable state of galaxy-ipam for recovering from loss of floatingip and pool crds
+type Snapshot struct {
+	Version   int            `json:"version"`
+	CreatedAt time.Time      `json:"createdAt"`
+	IPAMs     []IPAMSnapshot `json:"ipams"`
+	Pools     []Pool         `json:"pools,omitempty"`
+}
+
+// IPAMSnapshot is the state of an ipam
+type IPAMSnapshot struct {
+	// Name is the ip type of the ipam, internalIP or externalIP
+	Name string `json:"name"`
+	// FloatingIPPools are the pools configured when the snapshot was taken, they are not restored
+	FloatingIPPools []*floatingip.FloatingIPPool `json:"floatingIPPools,omitempty"`
+	Allocations     []Allocation                 `json:"allocations,omitempty"`
+}
+
+// Allocation is an ip allocated to a pod or reserved for an app or a pool
+type Allocation struct {
+	IP        string    `json:"ip"`
+	Key       string    `json:"key"`
+	Attr      string    `json:"attr,omitempty"`
+	Policy    uint16    `json:"policy"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Reserved is true if the key is not a pod, e.g. ips of deployment pools or of scaled down deployments
+	Reserved bool `json:"reserved,omitempty"`
+}
+
+// Conflict is an entry of a snapshot which conflicts with the current state
+type Conflict struct {
+	IPAM string `json:"ipam,omitempty"`
+	// Allocation is the allocation of the snapshot, Current are current allocations of its ip or of its key
+	Allocation *Allocation  `json:"allocation,omitempty"`
+	Current    []Allocation `json:"current,omitempty"`
+	// Pool is the pool of the snapshot, CurrentPool is the current one
+	Pool        *Pool  `json:"pool,omitempty"`
+	CurrentPool *Pool  `json:"currentPool,omitempty"`
+	Reason      string `json:"reason"`
+	// Resolution is skipped, overwritten or aborted
+	Resolution string `json:"resolution"`
+}
+
+// RestoreSnapshotResp is the response of restoring a snapshot
+type RestoreSnapshotResp struct {
+	httputil.Resp
+	DryRun bool `json:"dryRun,omitempty"`
+	// Restored is the number of allocations and pools restored, Unchanged is the number of those the current state
+	// already has
+	Restored  int        `json:"restored"`
+	Unchanged int        `json:"unchanged"`
+	Conflicts []Conflict `json:"conflicts,omitempty"`
+}
+
+// SwaggerDoc generates swagger doc for restore snapshot response
+func (RestoreSnapshotResp) SwaggerDoc() map[string]string {
+	return map[string]string{
+		"dryRun":    "true if nothing is applied",
+		"restored":  "number of allocations and pools restored or to restore",
+		"unchanged": "number of allocations and pools the current state already has",
+		"conflicts": "entries of the snapshot conflicting with the current state and how they are resolved",
+	}
+}
+
+// SnapshotController exports and restores snapshots
+type SnapshotController struct {
+	Client           versioned.Interface
+	LockPool         *keylock.Keylock
+	IPAM, SecondIPAM floatingip.IPAM
+}
+
+func (c *SnapshotController) ipams() []floatingip.IPAM {
+	ipams := []floatingip.IPAM{c.IPAM}
+	if c.SecondIPAM != nil {
+		ipams = append(ipams, c.SecondIPAM)
+	}
+	return ipams
+}
+
+// Export exports floatingip pools, allocations and reservations of ipams and pools as a snapshot
+func (c *SnapshotController) Export(req *restful.Request, resp *restful.Response) {
+	snapshot := &Snapshot{Version: SnapshotVersion, CreatedAt: time.Now()}
+	for _, ipam := range c.ipams() {
+		s, err := snapshotIPAM(ipam)
+		if err != nil {
+			httputil.InternalError(resp, err)
+			return
+		}
+		snapshot.IPAMs = append(snapshot.IPAMs, s)
+	}
+	pools, err := c.Client.GalaxyV1alpha1().Pools("kube-system").List(v1.ListOptions{})
+	if err != nil {
+		httputil.InternalError(resp, err)
+		return
+	}
+	for _, pool := range pools.Items {
+		snapshot.Pools = append(snapshot.Pools, Pool{Name: pool.Name, Size: pool.Size,
+			PreAllocateIP: pool.PreAllocateIP})
+	}
+	sort.Slice(snapshot.Pools, func(i, j int) bool { return snapshot.Pools[i].Name < snapshot.Pools[j].Name })
+	resp.WriteEntity(snapshot) // nolint: errcheck
+}
+
+func snapshotIPAM(ipam floatingip.IPAM) (IPAMSnapshot, error) {
+	s := IPAMSnapshot{Name: ipam.Name(), FloatingIPPools: ipam.Pools()}
+	fips, err := ipam.ByPrefix("")
+	if err != nil {
+		return s, err
+	}
+	for i := range fips {
+		if fips[i].Key != "" {
+			s.Allocations = append(s.Allocations, newAllocation(&fips[i]))
+		}
+	}
+	sort.Slice(s.Allocations, func(i, j int) bool {
+		return nets.IPToInt(net.ParseIP(s.Allocations[i].IP)) < nets.IPToInt(net.ParseIP(s.Allocations[j].IP))
+	})
+	return s, nil
+}
+
+func newAllocation(fip *floatingip.FloatingIP) Allocation {
+	return Allocation{IP: fip.IP.String(), Key: fip.Key, Attr: fip.Attr, Policy: fip.Policy, UpdatedAt: fip.UpdatedAt,
+		Reserved: util.ParseKey(fip.Key).PodName == ""}
+}
+
+// Restore restores allocations and pools of a snapshot, it resolves entries conflicting with the current state by
+// the conflict parameter. Restoring is idempotent, so a restore failing halfway can be retried.
+func (c *SnapshotController) Restore(req *restful.Request, resp *restful.Response) {
+	var snapshot Snapshot
+	if err := req.ReadEntity(&snapshot); err != nil {
+		httputil.BadRequest(resp, err)
+		return
+	}
+	if snapshot.Version != SnapshotVersion {
+		httputil.BadRequest(resp, fmt.Errorf("unsupported snapshot version %d", snapshot.Version))
+		return
+	}
+	resolution := req.QueryParameter("conflict")
+	if resolution == "" {
+		resolution = ConflictSkip
+	}
+	if resolution != ConflictSkip && resolution != ConflictOverwrite && resolution != ConflictAbort {
+		httputil.BadRequest(resp, fmt.Errorf("unknown conflict resolution %q", resolution))
+		return
+	}
+	dryRun := req.QueryParameter("dryRun") == "true"
+	res, err := c.restore(&snapshot, resolution, dryRun)
+	if err != nil {
+		httputil.InternalError(resp, err)
+		return
+	}
+	res.Resp = httputil.NewResp(http.StatusOK, "")
+	if resolution == ConflictAbort && len(res.Conflicts) > 0 {
+		res.Resp = httputil.NewResp(http.StatusConflict, "snapshot conflicts with the current state, nothing "+
+			"restored")
+	}
+	resp.WriteHeaderAndEntity(res.Code, res) // nolint: errcheck
+}
+
+// restorePlan is what restoring a snapshot of an ipam does
+type restorePlan struct {
+	ipam floatingip.IPAM
+	// allocations are free to restore
+	allocations []Allocation
+	unchanged   int
+	conflicts   []Conflict
+}
+
+// poolPlan is what restoring pools of a snapshot does
+type poolPlan struct {
+	create, update []Pool
+	unchanged      int
+	conflicts      []Conflict
+}
+
+// #lizard forgives
+func (c *SnapshotController) restore(snapshot *Snapshot, resolution string,
+	dryRun bool) (*RestoreSnapshotResp, error) {
+	res := &RestoreSnapshotResp{DryRun: dryRun}
+	ipams := map[string]floatingip.IPAM{}
+	for _, ipam := range c.ipams() {
+		ipams[ipam.Name()] = ipam
+	}
+	var plans []*restorePlan
+	for i := range snapshot.IPAMs {
+		s := &snapshot.IPAMs[i]
+		ipam, ok := ipams[s.Name]
+		if !ok {
+			for j := range s.Allocations {
+				res.Conflicts = append(res.Conflicts, Conflict{IPAM: s.Name, Allocation: &s.Allocations[j],
+					Reason: "ipam is not configured", Resolution: skipOrAbort(resolution)})
+			}
+			continue
+		}
+		plan, err := planRestore(ipam, s, resolution)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, plan)
+		res.Unchanged += plan.unchanged
+		res.Conflicts = append(res.Conflicts, plan.conflicts...)
+		for _, conflict := range plan.conflicts {
+			if conflict.Resolution == resolutionOverwritten {
+				res.Restored++
+			}
+		}
+		res.Restored += len(plan.allocations)
+	}
+	pools, err := c.planPools(snapshot.Pools, resolution)
+	if err != nil {
+		return nil, err
+	}
+	res.Restored += len(pools.create) + len(pools.update)
+	res.Unchanged += pools.unchanged
+	res.Conflicts = append(res.Conflicts, pools.conflicts...)
+	if dryRun || (resolution == ConflictAbort && len(res.Conflicts) > 0) {
+		return res, nil
+	}
+	for _, plan := range plans {
+		if err := c.apply(plan); err != nil {
+			return nil, err
+		}
+	}
+	return res, c.applyPools(pools)
+}
+
+func skipOrAbort(resolution string) string {
+	if resolution == ConflictAbort {
+		return resolutionAborted
+	}
+	return resolutionSkipped
+}
+
+// planRestore compares allocations of s with the current allocations of ipam. An allocation conflicts if its ip is
+// out of pools or allocated to another key, or if its key is a pod which holds another ip.
+// #lizard forgives
+func planRestore(ipam floatingip.IPAM, s *IPAMSnapshot, resolution string) (*restorePlan, error) {
+	// unallocated ips are returned too, so that ips out of pools are told apart
+	fips, err := ipam.ByPrefix("")
+	if err != nil {
+		return nil, err
+	}
+	byIP := map[string]*floatingip.FloatingIP{}
+	byKey := map[string][]Allocation{}
+	for i := range fips {
+		byIP[fips[i].IP.String()] = &fips[i]
+		if fips[i].Key != "" {
+			byKey[fips[i].Key] = append(byKey[fips[i].Key], newAllocation(&fips[i]))
+		}
+	}
+	plan := &restorePlan{ipam: ipam}
+	for i := range s.Allocations {
+		a := &s.Allocations[i]
+		fip, ok := byIP[a.IP]
+		if !ok {
+			plan.conflicts = append(plan.conflicts, Conflict{IPAM: s.Name, Allocation: a,
+				Reason: "ip is not in floatingip pools", Resolution: skipOrAbort(resolution)})
+			continue
+		}
+		if fip.Key == a.Key {
+			plan.unchanged++
+			continue
+		}
+		conflict := Conflict{IPAM: s.Name, Allocation: a}
+		if fip.Key != "" {
+			conflict.Current = append(conflict.Current, newAllocation(fip))
+			conflict.Reason = "ip is allocated to another key"
+		}
+		if !a.Reserved {
+			for _, other := range byKey[a.Key] {
+				if other.IP != a.IP {
+					conflict.Current = append(conflict.Current, other)
+					if conflict.Reason == "" {
+						conflict.Reason = "key holds another ip"
+					}
+				}
+			}
+		}
+		if len(conflict.Current) == 0 {
+			plan.allocations = append(plan.allocations, *a)
+			continue
+		}
+		conflict.Resolution = skipOrAbort(resolution)
+		if resolution == ConflictOverwrite {
+			conflict.Resolution = resolutionOverwritten
+		}
+		plan.conflicts = append(plan.conflicts, conflict)
+	}
+	return plan, nil
+}
+
+// apply releases current allocations of overwritten conflicts and restores allocations of plan
+func (c *SnapshotController) apply(plan *restorePlan) error {
+	allocations := plan.allocations
+	release := map[string]string{}
+	for _, conflict := range plan.conflicts {
+		if conflict.Resolution != resolutionOverwritten {
+			continue
+		}
+		for _, current := range conflict.Current {
+			release[current.IP] = current.Key
+		}
+		allocations = append(allocations, *conflict.Allocation)
+	}
+	if len(release) > 0 {
+		_, unreleased, err := plan.ipam.ReleaseIPs(release)
+		if err != nil {
+			return err
+		}
+		if len(unreleased) > 0 {
+			return fmt.Errorf("failed to release %v which changed during restoring", unreleased)
+		}
+		glog.Infof("[%s] released %v conflicting with the snapshot", plan.ipam.Name(), release)
+	}
+	for _, a := range allocations {
+		if err := c.allocate(plan.ipam, a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *SnapshotController) allocate(ipam floatingip.IPAM, a Allocation) error {
+	ip := net.ParseIP(a.IP)
+	if ip == nil {
+		return fmt.Errorf("%q is not a valid ip", a.IP)
+	}
+	// deployments and pools allocate ips under the lock of their pool prefixes
+	lockIndex := c.LockPool.GetLockIndex([]byte(util.ParseKey(a.Key).PoolPrefix()))
+	c.LockPool.RawLock(lockIndex)
+	defer c.LockPool.RawUnlock(lockIndex)
+	if err := ipam.AllocateSpecificIP(a.Key, ip, constant.ReleasePolicy(a.Policy), a.Attr); err != nil {
+		return fmt.Errorf("failed to restore ip %s of %s: %v", a.IP, a.Key, err)
+	}
+	glog.Infof("[%s] restored ip %s of %s", ipam.Name(), a.IP, a.Key)
+	return nil
+}
+
+func (c *SnapshotController) planPools(pools []Pool, resolution string) (*poolPlan, error) {
+	plan := &poolPlan{}
+	for i := range pools {
+		pool := &pools[i]
+		current, err := c.Client.GalaxyV1alpha1().Pools("kube-system").Get(pool.Name, v1.GetOptions{})
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				return nil, err
+			}
+			plan.create = append(plan.create, *pool)
+			continue
+		}
+		if current.Size == pool.Size && current.PreAllocateIP == pool.PreAllocateIP {
+			plan.unchanged++
+			continue
+		}
+		conflict := Conflict{Pool: pool, CurrentPool: &Pool{Name: current.Name, Size: current.Size,
+			PreAllocateIP: current.PreAllocateIP}, Reason: "pool differs", Resolution: skipOrAbort(resolution)}
+		if resolution == ConflictOverwrite {
+			conflict.Resolution = resolutionOverwritten
+			plan.update = append(plan.update, *pool)
+		}
+		plan.conflicts = append(plan.conflicts, conflict)
+	}
+	return plan, nil
+}
+
+// applyPools creates and updates pools without allocating ips for them, ips of pools are restored as allocations
+func (c *SnapshotController) applyPools(plan *poolPlan) error {
+	client := c.Client.GalaxyV1alpha1().Pools("kube-system")
+	for _, pool := range plan.create {
+		if _, err := client.Create(&v1alpha1.Pool{
+			TypeMeta:      v1.TypeMeta{Kind: "Pool", APIVersion: "v1alpha1"},
+			ObjectMeta:    v1.ObjectMeta{Name: pool.Name},
+			Size:          pool.Size,
+			PreAllocateIP: pool.PreAllocateIP,
+		}); err != nil {
+			return fmt.Errorf("failed to restore pool %s: %v", pool.Name, err)
+		}
+		glog.Infof("restored pool %v", pool)
+	}
+	for _, pool := range plan.update {
+		current, err := client.Get(pool.Name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		current.Size = pool.Size
+		current.PreAllocateIP = pool.PreAllocateIP
+		if _, err := client.Update(current); err != nil {
+			return fmt.Errorf("failed to restore pool %s: %v", pool.Name, err)
+		}
+		glog.Infof("restored pool %v", pool)
+	}
+	return nil
+}
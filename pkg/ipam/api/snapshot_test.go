@@ -0,0 +1,113 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package api
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/ipam/floatingip"
+	"tkestack.io/galaxy/pkg/utils/keylock"
+)
+
+type fakeRestoreIPAM struct {
+	floatingip.IPAM
+	// ips are allocated and unallocated ips of pools, keys of unallocated ones are empty
+	ips       map[string]string
+	allocated map[string]string
+}
+
+func (ipam *fakeRestoreIPAM) Name() string {
+	return "internalIP"
+}
+
+func (ipam *fakeRestoreIPAM) ByPrefix(prefix string) ([]floatingip.FloatingIP, error) {
+	var fips []floatingip.FloatingIP
+	for ip, key := range ipam.ips {
+		fips = append(fips, floatingip.FloatingIP{IP: net.ParseIP(ip), Key: key})
+	}
+	return fips, nil
+}
+
+func (ipam *fakeRestoreIPAM) ReleaseIPs(ipToKey map[string]string) (map[string]string, map[string]string, error) {
+	for ip := range ipToKey {
+		ipam.ips[ip] = ""
+	}
+	return ipToKey, map[string]string{}, nil
+}
+
+func (ipam *fakeRestoreIPAM) AllocateSpecificIP(key string, ip net.IP, policy constant.ReleasePolicy,
+	attr string) error {
+	ipam.ips[ip.String()] = key
+	ipam.allocated[ip.String()] = key
+	return nil
+}
+
+// #lizard forgives
+func TestRestoreIPAM(t *testing.T) {
+	snapshot := &IPAMSnapshot{Name: "internalIP", Allocations: []Allocation{
+		{IP: "10.0.0.1", Key: "sts_ns1_app_app-0"},
+		{IP: "10.0.0.2", Key: "sts_ns1_app_app-1"},
+		{IP: "10.0.0.3", Key: "sts_ns1_app_app-2"},
+		{IP: "10.0.0.4", Key: "pool__pool1_", Reserved: true},
+		{IP: "10.0.1.1", Key: "sts_ns1_app_app-3"},
+	}}
+	for _, c := range []struct {
+		resolution string
+		conflicts  []string
+		allocated  map[string]string
+	}{
+		{resolution: ConflictSkip,
+			conflicts: []string{"10.0.0.2 skipped", "10.0.0.3 skipped", "10.0.1.1 skipped"},
+			allocated: map[string]string{"10.0.0.4": "pool__pool1_"}},
+		{resolution: ConflictOverwrite,
+			conflicts: []string{"10.0.0.2 overwritten", "10.0.0.3 overwritten", "10.0.1.1 skipped"},
+			allocated: map[string]string{"10.0.0.2": "sts_ns1_app_app-1", "10.0.0.3": "sts_ns1_app_app-2",
+				"10.0.0.4": "pool__pool1_"}},
+	} {
+		// 10.0.0.2 is allocated to another pod, app-2 holds another ip and 10.0.1.1 is out of pools
+		ipam := &fakeRestoreIPAM{allocated: map[string]string{}, ips: map[string]string{
+			"10.0.0.1": "sts_ns1_app_app-0", "10.0.0.2": "sts_ns2_app_app-0", "10.0.0.3": "",
+			"10.0.0.4": "", "10.0.0.5": "sts_ns1_app_app-2"}}
+		plan, err := planRestore(ipam, snapshot, c.resolution)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plan.unchanged != 1 {
+			t.Fatalf("%s: expect 1 unchanged, real %d", c.resolution, plan.unchanged)
+		}
+		var conflicts []string
+		for _, conflict := range plan.conflicts {
+			conflicts = append(conflicts, conflict.Allocation.IP+" "+conflict.Resolution)
+		}
+		if !reflect.DeepEqual(c.conflicts, conflicts) {
+			t.Fatalf("%s: expect conflicts %v, real %v", c.resolution, c.conflicts, conflicts)
+		}
+		controller := &SnapshotController{LockPool: keylock.NewKeylock(), IPAM: ipam}
+		if err := controller.apply(plan); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.allocated, ipam.allocated) {
+			t.Fatalf("%s: expect allocated %v, real %v", c.resolution, c.allocated, ipam.allocated)
+		}
+		if c.resolution == ConflictOverwrite && ipam.ips["10.0.0.5"] != "" {
+			t.Fatalf("expect 10.0.0.5 released, real %v", ipam.ips)
+		}
+	}
+}
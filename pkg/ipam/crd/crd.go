@@ -17,6 +17,9 @@
 package crd
 
 import (
+	"fmt"
+	"reflect"
+
 	extensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -43,6 +46,24 @@ var floatingipCrd = &extensionsv1.CustomResourceDefinition{
 			Plural:     "floatingips",
 			ShortNames: []string{"fip"},
 		},
+		Validation: &extensionsv1.CustomResourceValidation{
+			OpenAPIV3Schema: &extensionsv1.JSONSchemaProps{
+				Type: "object",
+				Properties: map[string]extensionsv1.JSONSchemaProps{
+					"spec": {
+						Type:     "object",
+						Required: []string{"key"},
+						Properties: map[string]extensionsv1.JSONSchemaProps{
+							"key":        {Type: "string", MinLength: int64Ptr(1)},
+							"attribute":  {Type: "string"},
+							"policy":     {Type: "integer", Minimum: float64Ptr(0), Maximum: float64Ptr(2)},
+							"subnet":     {Type: "string"},
+							"updateTime": {Type: "string", Format: "date-time"},
+						},
+					},
+				},
+			},
+		},
 	},
 }
 
@@ -63,20 +84,106 @@ var poolCrd = &extensionsv1.CustomResourceDefinition{
 			Kind:   "Pool",
 			Plural: "pools",
 		},
+		Validation: &extensionsv1.CustomResourceValidation{
+			OpenAPIV3Schema: &extensionsv1.JSONSchemaProps{
+				Type: "object",
+				Properties: map[string]extensionsv1.JSONSchemaProps{
+					"size":          {Type: "integer", Minimum: float64Ptr(0)},
+					"preAllocateIP": {Type: "boolean"},
+				},
+			},
+		},
+	},
+}
+
+// nodeStateCrd is the crd format of node state, which keeps state of containers of nodes of galaxy whose state store
+// is crd, see package crdstore
+var nodeStateCrd = &extensionsv1.CustomResourceDefinition{
+	ObjectMeta: metav1.ObjectMeta{
+		Name: "nodestates.galaxy.k8s.io",
+	},
+	TypeMeta: metav1.TypeMeta{
+		Kind:       "CustomResourceDefinition",
+		APIVersion: "apiextensions.k8s.io/v1beta1",
+	},
+	Spec: extensionsv1.CustomResourceDefinitionSpec{
+		Group:   galaxy.GroupName,
+		Version: "v1alpha1",
+		Scope:   extensionsv1.ClusterScoped,
+		Names: extensionsv1.CustomResourceDefinitionNames{
+			Kind:   "NodeState",
+			Plural: "nodestates",
+		},
+		Validation: &extensionsv1.CustomResourceValidation{
+			OpenAPIV3Schema: &extensionsv1.JSONSchemaProps{
+				Type: "object",
+				Properties: map[string]extensionsv1.JSONSchemaProps{
+					"spec": {
+						Type:     "object",
+						Required: []string{"node", "bucket", "key"},
+						Properties: map[string]extensionsv1.JSONSchemaProps{
+							"node":   {Type: "string", MinLength: int64Ptr(1)},
+							"bucket": {Type: "string", MinLength: int64Ptr(1)},
+							"key":    {Type: "string", MinLength: int64Ptr(1)},
+							"data":   {Type: "string", Format: "byte"},
+						},
+					},
+				},
+			},
+		},
 	},
 }
 
-// EnsureCRDCreated ensures floatingip and pool are created in apiserver
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+func float64Ptr(f float64) *float64 {
+	return &f
+}
+
+// EnsureCRDCreated ensures floatingip, pool and nodestate are created in apiserver and validated by their schemas
 func EnsureCRDCreated(client apiextensionsclient.Interface) error {
+	return ensureCRDs(client, floatingipCrd, poolCrd, nodeStateCrd)
+}
+
+// EnsureNodeStateCRDCreated ensures nodestate is created in apiserver, galaxy may start before galaxy-ipam creates it
+func EnsureNodeStateCRDCreated(client apiextensionsclient.Interface) error {
+	return ensureCRDs(client, nodeStateCrd)
+}
+
+func ensureCRDs(client apiextensionsclient.Interface, crds ...*extensionsv1.CustomResourceDefinition) error {
 	crdClient := client.ApiextensionsV1beta1().CustomResourceDefinitions()
-	crds := []*extensionsv1.CustomResourceDefinition{floatingipCrd, poolCrd}
 	for i := range crds {
 		// try to create each crd and ignores already exist error
-		if _, err := crdClient.Create(crds[i]); err != nil && !apierrors.IsAlreadyExists(err) {
-			glog.Errorf("Error creating CRD: %s", crds[i].Spec.Names.Kind)
-			return err
+		if _, err := crdClient.Create(crds[i]); err != nil {
+			if !apierrors.IsAlreadyExists(err) {
+				glog.Errorf("Error creating CRD: %s", crds[i].Spec.Names.Kind)
+				return err
+			}
+			if err := ensureValidation(client, crds[i]); err != nil {
+				return err
+			}
 		}
 		glog.Infof("Create CRD %s successfully.", crds[i].Spec.Names.Kind)
 	}
 	return nil
 }
+
+// ensureValidation adds the schema of crd to an existing one created by a previous version without it
+func ensureValidation(client apiextensionsclient.Interface, crd *extensionsv1.CustomResourceDefinition) error {
+	crdClient := client.ApiextensionsV1beta1().CustomResourceDefinitions()
+	existing, err := crdClient.Get(crd.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(existing.Spec.Validation, crd.Spec.Validation) {
+		return nil
+	}
+	existing.Spec.Validation = crd.Spec.Validation
+	if _, err := crdClient.Update(existing); err != nil {
+		return fmt.Errorf("failed to update validation of CRD %s: %v", crd.Spec.Names.Kind, err)
+	}
+	glog.Infof("Updated validation of CRD %s", crd.Spec.Names.Kind)
+	return nil
+}
@@ -24,6 +24,7 @@ import (
 	"time"
 
 	"k8s.io/apimachinery/pkg/util/sets"
+	"tkestack.io/galaxy/pkg/utils/confcheck"
 	"tkestack.io/galaxy/pkg/utils/nets"
 )
 
@@ -40,10 +41,15 @@ type FloatingIP struct {
 // FloatingIPPool is FloatingIPPool structure.
 type FloatingIPPool struct {
 	NodeSubnets []*net.IPNet // the node subnets
+	// Precedence tells which pool owns ips overlapped by pools, the one of the highest precedence owns them
+	Precedence int
 	nets.SparseSubnet
 	sync.RWMutex
 }
 
+// maxVlanID is the max valid vlan id, 0 means no vlan and 4095 is reserved
+const maxVlanID = 4094
+
 // FloatingIPPoolConf is FloatingIP config structure.
 type FloatingIPPoolConf struct {
 	NodeSubnets []*nets.IPNet `json:"nodeSubnets"` // the node subnets
@@ -53,6 +59,7 @@ type FloatingIPPoolConf struct {
 	Subnet         *nets.IPNet `json:"subnet"` // the vip subnet
 	Gateway        net.IP      `json:"gateway"`
 	Vlan           uint16      `json:"vlan,omitempty"`
+	Precedence     int         `json:"precedence,omitempty"`
 }
 
 // MarshalJSON can marshal FloatingIPPoolConf to byte slice.
@@ -64,6 +71,7 @@ func (fip *FloatingIPPool) MarshalJSON() ([]byte, error) {
 	conf.Subnet = nets.NetsIPNet(fip.IPNet())
 	conf.Gateway = fip.Gateway
 	conf.Vlan = fip.Vlan
+	conf.Precedence = fip.Precedence
 	conf.IPs = make([]string, 0)
 	for _, ipr := range fip.IPRanges {
 		conf.IPs = append(conf.IPs, ipr.String())
@@ -74,9 +82,12 @@ func (fip *FloatingIPPool) MarshalJSON() ([]byte, error) {
 // UnmarshalJSON can unmarshal byte slice to FloatingIPPoolConf
 func (fip *FloatingIPPool) UnmarshalJSON(data []byte) error {
 	var conf FloatingIPPoolConf
-	if err := json.Unmarshal(data, &conf); err != nil {
+	if err := confcheck.DecodeStrict(data, &conf); err != nil {
 		return err
 	}
+	if conf.Vlan > maxVlanID {
+		return fmt.Errorf("vlan %d is out of range [0, %d]", conf.Vlan, maxVlanID)
+	}
 	if conf.RoutableSubnet == nil && len(conf.NodeSubnets) == 0 {
 		return fmt.Errorf("node subnet is empty")
 	}
@@ -106,6 +117,7 @@ func (fip *FloatingIPPool) UnmarshalJSON(data []byte) error {
 		return fmt.Errorf("subnet is empty")
 	}
 	fip.Vlan = conf.Vlan
+	fip.Precedence = conf.Precedence
 	fip.IPRanges = []nets.IPRange{}
 	for _, str := range conf.IPs {
 		ipr := nets.ParseIPRange(str)
@@ -134,6 +146,44 @@ func fipCheck(fip *FloatingIPPool) error {
 	return nil
 }
 
+// CheckOverlap returns an error if ip ranges of pools overlap while their precedences don't tell which pool owns
+// the overlapped ips.
+func CheckOverlap(pools []*FloatingIPPool) error {
+	for i := range pools {
+		for j := i + 1; j < len(pools); j++ {
+			ipr := pools[i].overlap(pools[j])
+			if ipr == nil {
+				continue
+			}
+			if pools[i].Precedence == pools[j].Precedence {
+				return fmt.Errorf("ips %s overlap in pools %s and %s of the same precedence %d, set precedence of "+
+					"them to tell which pool owns the ips", ipr.String(), pools[i].String(), pools[j].String(),
+					pools[i].Precedence)
+			}
+		}
+	}
+	return nil
+}
+
+// overlap returns the first range of ips in both pools, or nil if they don't overlap
+func (fip *FloatingIPPool) overlap(other *FloatingIPPool) *nets.IPRange {
+	for _, a := range fip.IPRanges {
+		for _, b := range other.IPRanges {
+			first, last := a.First, a.Last
+			if nets.IPToInt(b.First) > nets.IPToInt(first) {
+				first = b.First
+			}
+			if nets.IPToInt(b.Last) < nets.IPToInt(last) {
+				last = b.Last
+			}
+			if nets.IPToInt(first) <= nets.IPToInt(last) {
+				return &nets.IPRange{First: first, Last: last}
+			}
+		}
+	}
+	return nil
+}
+
 // String can transform FloatingIP to string.
 func (fip *FloatingIPPool) String() string {
 	data, err := fip.MarshalJSON()
@@ -258,7 +308,10 @@ func (s FloatingIPSlice) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
 
-// Less compares two given ip.
+// Less compares precedences and then gateways of two pools, pools of higher precedences come first.
 func (s FloatingIPSlice) Less(i, j int) bool {
+	if s[i].Precedence != s[j].Precedence {
+		return s[i].Precedence > s[j].Precedence
+	}
 	return nets.IPToInt(s[i].Gateway) < nets.IPToInt(s[j].Gateway)
 }
@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"strings"
 	"testing"
 
 	"tkestack.io/galaxy/pkg/utils/nets"
@@ -95,6 +96,16 @@ func TestUnmarshalFloatingIPPool(t *testing.T) {
 		err.Error() != "ip range 10.173.14.205 and 10.173.14.206~10.173.14.208 can be merge to one or has wrong order" {
 		t.Fatal(err)
 	}
+	for _, invalid := range []string{
+		`{"routableSubnet":"10.173.14.1/24","ips":["10.173.14.203"],"subnet":"10.173.14.0/24","gateway":"10.173.14.1",` +
+			`"vlan":4095}`,
+		`{"routableSubnet":"10.173.14.1/24","ips":["10.173.14.203"],"subnet":"10.173.14.0/24","gateway":"10.173.14.1",` +
+			`"valn":2}`,
+	} {
+		if err := json.Unmarshal([]byte(invalid), &fip); err == nil {
+			t.Fatalf("expect an error of %s", invalid)
+		}
+	}
 }
 
 // #lizard forgives
@@ -155,3 +166,33 @@ func TestInsertRemoveIP(t *testing.T) {
 		t.Fatal(fip.IPRanges)
 	}
 }
+
+func TestCheckOverlap(t *testing.T) {
+	pool := func(ips, subnet, gateway, extra string) string {
+		return fmt.Sprintf(`{"nodeSubnets":["10.0.0.0/24"],"ips":["%s"],"subnet":"%s","gateway":"%s"%s}`, ips, subnet,
+			gateway, extra)
+	}
+	for i, c := range []struct {
+		pools     []string
+		expectErr bool
+	}{
+		// same subnet of disjoint ips
+		{pools: []string{pool("10.0.70.2~10.0.70.10", "10.0.70.0/24", "10.0.70.1", ""),
+			pool("10.0.70.11~10.0.70.20", "10.0.70.0/24", "10.0.70.1", "")}},
+		{pools: []string{pool("10.0.70.2~10.0.70.10", "10.0.70.0/24", "10.0.70.1", ""),
+			pool("10.0.70.10~10.0.70.20", "10.0.70.0/24", "10.0.70.1", "")}, expectErr: true},
+		{pools: []string{pool("10.0.70.2~10.0.70.10", "10.0.70.0/24", "10.0.70.1", ""),
+			pool("10.0.70.10~10.0.70.20", "10.0.70.0/24", "10.0.70.1", `,"precedence":1`)}},
+		// different subnets
+		{pools: []string{pool("10.0.70.2~10.0.70.10", "10.0.70.0/24", "10.0.70.1", `,"precedence":1`),
+			pool("10.0.70.5", "10.0.70.0/28", "10.0.70.14", `,"precedence":1`)}, expectErr: true},
+	} {
+		var pools []*FloatingIPPool
+		if err := json.Unmarshal([]byte("["+strings.Join(c.pools, ",")+"]"), &pools); err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if err := CheckOverlap(pools); (err != nil) != c.expectErr {
+			t.Fatalf("case %d: expect error %v, got %v", i, c.expectErr, err)
+		}
+	}
+}
@@ -33,6 +33,8 @@ var (
 type IPAM interface {
 	// ConfigurePool init floatingIP pool.
 	ConfigurePool([]*FloatingIPPool) error
+	// Pools returns configured floatingIP pools.
+	Pools() []*FloatingIPPool
 	// ReleaseIPs releases given ips as long as their keys match and returned released and unreleased map
 	// released and unreleased map are guaranteed to be none nil even if err is not nil
 	// unreleased map stores ip with its latest key if key changed
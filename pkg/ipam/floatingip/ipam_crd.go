@@ -94,6 +94,13 @@ func (ci *crdIpam) ConfigurePool(floatIPs []*FloatingIPPool) error {
 	return nil
 }
 
+// Pools returns configured floatingIP pools.
+func (ci *crdIpam) Pools() []*FloatingIPPool {
+	ci.caches.cacheLock.RLock()
+	defer ci.caches.cacheLock.RUnlock()
+	return append([]*FloatingIPPool{}, ci.FloatingIPs...)
+}
+
 // AllocateSpecificIP allocate pod a specific IP.
 func (ci *crdIpam) AllocateSpecificIP(key string, ip net.IP, policy constant.ReleasePolicy, attr string) error {
 	ipStr := ip.String()
@@ -353,7 +360,11 @@ func (ci *crdIpam) Name() string {
 // #lizard forgives
 func (ci *crdIpam) freshCache(floatIPs []*FloatingIPPool) error {
 	glog.V(3).Infof("begin to fresh cache")
-	sort.Sort(FloatingIPSlice(floatIPs))
+	if err := CheckOverlap(floatIPs); err != nil {
+		return err
+	}
+	// pools of higher precedences come first, so that overlapped ips are tracked by them only
+	sort.Stable(FloatingIPSlice(floatIPs))
 	ips, err := ci.listFloatingIPs()
 	if err != nil {
 		glog.Errorf("fail to list floatIP %v", err)
@@ -417,6 +428,10 @@ func (ci *crdIpam) freshCache(floatIPs []*FloatingIPPool) error {
 			last := nets.IPToInt(ipr.Last)
 			for ; first <= last; first++ {
 				ipStr := nets.IntToIP(first).String()
+				if _, contain := tmpCacheUnallocated[ipStr]; contain {
+					// owned by a pool of higher precedence
+					continue
+				}
 				if _, contain := ci.caches.allocatedFIPs[ipStr]; !contain {
 					tmpFip := &FloatingIPObj{
 						key:        "",
@@ -434,3 +434,35 @@ func TestAllocateInMultipleSubnet(t *testing.T) {
 		t.Fatalf("expect allocated ip both from %s and %s", node7FIPSubnet, node6FIPSubnet)
 	}
 }
+
+// #lizard forgives
+func TestConfigureOverlappedPools(t *testing.T) {
+	var pools []*FloatingIPPool
+	if err := json.Unmarshal([]byte(`[{"nodeSubnets":["10.0.0.0/24"],"ips":["10.0.70.2~10.0.70.10"],`+
+		`"subnet":"10.0.70.0/24","gateway":"10.0.70.1"},{"nodeSubnets":["10.0.1.0/24"],"ips":["10.0.70.10~10.0.70.12"],`+
+		`"subnet":"10.0.70.0/24","gateway":"10.0.70.1","vlan":3,"precedence":1}]`), &pools); err != nil {
+		t.Fatal(err)
+	}
+	ipam := NewCrdIPAM(fakeGalaxyCli.NewSimpleClientset(), InternalIp).(*crdIpam)
+	if err := ipam.ConfigurePool(pools); err != nil {
+		t.Fatal(err)
+	}
+	if len(ipam.caches.unallocatedFIPs) != 11 {
+		t.Fatal(len(ipam.caches.unallocatedFIPs))
+	}
+	for ip, nodeSubnet := range map[string]string{"10.0.70.9": "10.0.0.0/24", "10.0.70.10": "10.0.1.0/24"} {
+		if fip := ipam.caches.unallocatedFIPs[ip]; fip == nil || !fip.subnetSet.Has(nodeSubnet) || fip.subnetSet.Len() != 1 {
+			t.Fatalf("expect %s of node subnet %s, got %v", ip, nodeSubnet, fip)
+		}
+	}
+	if err := ipam.AllocateSpecificIP("pod1", net.ParseIP("10.0.70.10"), policy, ""); err != nil {
+		t.Fatal(err)
+	}
+	info, err := ipam.First("pod1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.IPInfo.Vlan != 3 {
+		t.Fatalf("expect the ip owned by the pool of higher precedence, got %v", info)
+	}
+}
@@ -61,6 +61,9 @@ type FloatingIPPlugin struct {
 // NewFloatingIPPlugin creates FloatingIPPlugin
 func NewFloatingIPPlugin(conf Conf, args *PluginFactoryArgs) (*FloatingIPPlugin, error) {
 	conf.validate()
+	if err := conf.NodeIP.validate(); err != nil {
+		return nil, err
+	}
 	glog.Infof("floating ip config: %v", conf)
 	plugin := &FloatingIPPlugin{
 		nodeSubnet:        make(map[string]*net.IPNet),
@@ -195,6 +198,10 @@ func (p *FloatingIPPlugin) Filter(pod *corev1.Pod, nodes []corev1.Node) ([]corev
 	}
 	for i := range nodes {
 		nodeName := nodes[i].Name
+		if p.livenessChecked() && !p.agentAlive(nodeName) {
+			failedNodesMap[nodeName] = agentNotAlive
+			continue
+		}
 		subnet, err := p.getNodeSubnet(&nodes[i])
 		if err != nil {
 			failedNodesMap[nodes[i].Name] = err.Error()
@@ -409,6 +416,7 @@ func (p *FloatingIPPlugin) Bind(args *schedulerapi.ExtenderBindingArgs) error {
 		return fmt.Errorf("failed to format ipinfo %v: %v", ipInfos, err)
 	}
 	bindAnnotation[constant.ExtendedCNIArgsAnnotation] = data //TODO don't overlap this annotation
+	bindAnnotation[constant.IPsAnnotation] = constant.FormatIPs(ipInfos)
 	var err1 error
 	if err := wait.PollImmediate(time.Millisecond*500, 3*time.Second, func() (bool, error) {
 		// It's the extender's response to bind pods to nodes since it is a binder
@@ -492,15 +500,6 @@ func (p *FloatingIPPlugin) hasResourceName(spec *corev1.PodSpec) bool {
 	return utils.WantENIIP(spec)
 }
 
-func getNodeIP(node *corev1.Node) net.IP {
-	for i := range node.Status.Addresses {
-		if node.Status.Addresses[i].Type == corev1.NodeInternalIP {
-			return net.ParseIP(node.Status.Addresses[i].Address)
-		}
-	}
-	return nil
-}
-
 func evicted(pod *corev1.Pod) bool {
 	return pod.Status.Phase == corev1.PodFailed && pod.Status.Reason == "Evicted"
 }
@@ -576,7 +576,8 @@ func TestBind(t *testing.T) {
 		ObjectMeta: v1.ObjectMeta{
 			Namespace: pod.Namespace, Name: pod.Name,
 			Annotations: map[string]string{
-				constant.ExtendedCNIArgsAnnotation: str}},
+				constant.ExtendedCNIArgsAnnotation: str,
+				constant.IPsAnnotation:             fipInfo.IPInfo.IP.IP.String()}},
 		Target: corev1.ObjectReference{
 			Kind: "Node",
 			Name: node3,
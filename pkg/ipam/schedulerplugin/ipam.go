@@ -177,7 +177,7 @@ func reserveIP(key, prefixKey string, ipam floatingip.IPAM, reason string) error
 
 // getNodeSubnetfromIPAM gets node subnet from ipam
 func (p *FloatingIPPlugin) getNodeSubnetfromIPAM(node *corev1.Node) (*net.IPNet, error) {
-	nodeIP := getNodeIP(node)
+	nodeIP := p.conf.NodeIP.nodeIP(node)
 	if nodeIP == nil {
 		return nil, errors.New("FloatingIPPlugin:UnknowNode")
 	}
@@ -0,0 +1,96 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+)
+
+const agentNotAlive = "FloatingIPPlugin:AgentNotAlive"
+
+// AgentLiveness is the liveness of galaxy of a node by its agent lease
+type AgentLiveness struct {
+	Node  string `json:"node"`
+	Alive bool   `json:"alive"`
+	// RenewTime is when galaxy of the node renewed its lease last time
+	RenewTime    *time.Time                  `json:"renewTime,omitempty"`
+	Registration *constant.AgentRegistration `json:"registration,omitempty"`
+}
+
+// livenessChecked returns true if nodes are filtered by liveness of their agents
+func (p *FloatingIPPlugin) livenessChecked() bool {
+	return p.conf.AgentLivenessTimeout > 0 && p.LeaseLister != nil
+}
+
+// agentAlive returns true if galaxy of the node renewed its agent lease within AgentLivenessTimeout
+func (p *FloatingIPPlugin) agentAlive(nodeName string) bool {
+	lease, err := p.LeaseLister.Leases(constant.AgentLeaseNamespace).Get(constant.AgentLeaseName(nodeName))
+	if err != nil {
+		return false
+	}
+	return p.agentLiveness(lease, time.Now()).Alive
+}
+
+func (p *FloatingIPPlugin) agentLiveness(lease *coordinationv1.Lease, now time.Time) *AgentLiveness {
+	l := &AgentLiveness{Node: strings.TrimPrefix(lease.Name, constant.AgentLeasePrefix)}
+	if lease.Spec.RenewTime != nil {
+		renewTime := lease.Spec.RenewTime.Time
+		l.RenewTime = &renewTime
+		l.Alive = now.Sub(renewTime) <= time.Duration(p.conf.AgentLivenessTimeout)*time.Second
+	}
+	if data := lease.Annotations[constant.AgentRegistrationAnnotation]; data != "" {
+		var r constant.AgentRegistration
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			glog.Warningf("bad registration of agent lease %s: %v", lease.Name, err)
+		} else {
+			l.Registration = &r
+		}
+	}
+	return l
+}
+
+// AgentLivenesses returns liveness of agents of all nodes having agent leases sorted by node names
+func (p *FloatingIPPlugin) AgentLivenesses() ([]*AgentLiveness, error) {
+	if p.LeaseLister == nil {
+		return nil, nil
+	}
+	leases, err := p.LeaseLister.Leases(constant.AgentLeaseNamespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var livenesses []*AgentLiveness
+	for _, lease := range leases {
+		if !strings.HasPrefix(lease.Name, constant.AgentLeasePrefix) {
+			// leases of kubelet
+			continue
+		}
+		livenesses = append(livenesses, p.agentLiveness(lease, now))
+	}
+	sort.Slice(livenesses, func(i, j int) bool {
+		return livenesses[i].Node < livenesses[j].Node
+	})
+	return livenesses, nil
+}
@@ -0,0 +1,78 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1lister "k8s.io/client-go/listers/coordination/v1"
+	"k8s.io/client-go/tools/cache"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+)
+
+func newLease(name string, renewTime time.Time, annotations map[string]string) *coordinationv1.Lease {
+	return &coordinationv1.Lease{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: constant.AgentLeaseNamespace, Annotations: annotations},
+		Spec:       coordinationv1.LeaseSpec{RenewTime: &v1.MicroTime{Time: renewTime}},
+	}
+}
+
+// #lizard forgives
+func TestAgentLiveness(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	now := time.Now()
+	for _, lease := range []*coordinationv1.Lease{
+		newLease(constant.AgentLeaseName("node2"), now.Add(-time.Minute), nil),
+		newLease(constant.AgentLeaseName("node1"), now, map[string]string{
+			constant.AgentRegistrationAnnotation: `{"gitCommit":"abc","networks":{"galaxy-flannel":"galaxy-flannel"}}`}),
+		// lease of kubelet
+		newLease("node1", now, nil),
+	} {
+		if err := indexer.Add(lease); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := &FloatingIPPlugin{conf: &Conf{AgentLivenessTimeout: 40},
+		PluginFactoryArgs: &PluginFactoryArgs{LeaseLister: coordinationv1lister.NewLeaseLister(indexer)}}
+	if !p.livenessChecked() {
+		t.Fatal("expect liveness checked")
+	}
+	for node, expect := range map[string]bool{"node1": true, "node2": false, "node3": false} {
+		if alive := p.agentAlive(node); alive != expect {
+			t.Errorf("%s: expect alive %v, real %v", node, expect, alive)
+		}
+	}
+	livenesses, err := p.AgentLivenesses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(livenesses) != 2 || livenesses[0].Node != "node1" || livenesses[1].Node != "node2" {
+		t.Fatalf("expect node1 and node2, real %+v", livenesses)
+	}
+	if r := livenesses[0].Registration; r == nil || r.GitCommit != "abc" ||
+		r.Networks["galaxy-flannel"] != "galaxy-flannel" {
+		t.Fatalf("bad registration %+v", r)
+	}
+	p.conf.AgentLivenessTimeout = 0
+	if p.livenessChecked() {
+		t.Fatal("expect liveness not checked")
+	}
+}
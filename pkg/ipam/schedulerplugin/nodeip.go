@@ -0,0 +1,94 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/utils/nets"
+)
+
+const (
+	IPFamilyIPv4 = "ipv4"
+	IPFamilyIPv6 = "ipv6"
+)
+
+// NodeIPConf selects the ip of a node, pods of the node get floating ips of the node subnet containing it.
+// Candidates are ips of the constant.NodeIPsAnnotation of the node followed by status addresses of AddressTypes in
+// order, the first one of IPFamily within CIDRs is selected.
+type NodeIPConf struct {
+	// AddressTypes of node status addresses in order of preference, defaults to InternalIP
+	AddressTypes []corev1.NodeAddressType `json:"addressTypes,omitempty"`
+	// If not empty, only ips within one of CIDRs are selected
+	CIDRs []*nets.IPNet `json:"cidrs,omitempty"`
+	// IPFamily is ipv4, ipv6 or empty for both
+	IPFamily string `json:"ipFamily,omitempty"`
+}
+
+func (c *NodeIPConf) validate() error {
+	if len(c.AddressTypes) == 0 {
+		c.AddressTypes = []corev1.NodeAddressType{corev1.NodeInternalIP}
+	}
+	switch c.IPFamily {
+	case "", IPFamilyIPv4, IPFamilyIPv6:
+	default:
+		return fmt.Errorf("unknown ip family %q of node ip, expect %s or %s", c.IPFamily, IPFamilyIPv4,
+			IPFamilyIPv6)
+	}
+	return nil
+}
+
+// nodeIP returns the selected ip of node or nil if there is none
+func (c *NodeIPConf) nodeIP(node *corev1.Node) net.IP {
+	var candidates []string
+	if ips := node.Annotations[constant.NodeIPsAnnotation]; ips != "" {
+		candidates = strings.Split(ips, ",")
+	}
+	for _, addressType := range c.AddressTypes {
+		for i := range node.Status.Addresses {
+			if node.Status.Addresses[i].Type == addressType {
+				candidates = append(candidates, node.Status.Addresses[i].Address)
+			}
+		}
+	}
+	for _, candidate := range candidates {
+		if ip := net.ParseIP(strings.TrimSpace(candidate)); ip != nil && c.matches(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+func (c *NodeIPConf) matches(ip net.IP) bool {
+	isIPv4 := ip.To4() != nil
+	if (c.IPFamily == IPFamilyIPv4 && !isIPv4) || (c.IPFamily == IPFamilyIPv6 && isIPv4) {
+		return false
+	}
+	if len(c.CIDRs) == 0 {
+		return true
+	}
+	for i := range c.CIDRs {
+		if c.CIDRs[i].ToIPNet().Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package schedulerplugin
+
+import (
+	"net"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
+	"tkestack.io/galaxy/pkg/utils/nets"
+)
+
+// #lizard forgives
+func TestNodeIP(t *testing.T) {
+	node := &corev1.Node{Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{
+		{Type: corev1.NodeHostName, Address: "node1"},
+		{Type: corev1.NodeExternalIP, Address: "1.1.1.1"},
+		{Type: corev1.NodeInternalIP, Address: "192.168.0.2"},
+		{Type: corev1.NodeInternalIP, Address: "10.0.0.2"},
+		{Type: corev1.NodeInternalIP, Address: "fd00::2"},
+	}}}
+	annotated := node.DeepCopy()
+	annotated.ObjectMeta = v1.ObjectMeta{Annotations: map[string]string{
+		constant.NodeIPsAnnotation: "10.1.0.2, fd01::2"}}
+	_, cidr, _ := net.ParseCIDR("10.0.0.0/8")
+	for i, c := range []struct {
+		conf   NodeIPConf
+		node   *corev1.Node
+		expect string
+	}{
+		{node: node, expect: "192.168.0.2"},
+		{conf: NodeIPConf{CIDRs: []*nets.IPNet{nets.NetsIPNet(cidr)}}, node: node, expect: "10.0.0.2"},
+		{conf: NodeIPConf{IPFamily: IPFamilyIPv6}, node: node, expect: "fd00::2"},
+		{conf: NodeIPConf{AddressTypes: []corev1.NodeAddressType{corev1.NodeExternalIP, corev1.NodeInternalIP}},
+			node: node, expect: "1.1.1.1"},
+		{conf: NodeIPConf{AddressTypes: []corev1.NodeAddressType{corev1.NodeExternalDNS}}, node: node},
+		{node: annotated, expect: "10.1.0.2"},
+		{conf: NodeIPConf{IPFamily: IPFamilyIPv6}, node: annotated, expect: "fd01::2"},
+	} {
+		if err := c.conf.validate(); err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		ip := c.conf.nodeIP(c.node)
+		if (c.expect == "" && ip != nil) || (c.expect != "" && !ip.Equal(net.ParseIP(c.expect))) {
+			t.Fatalf("case %d: expect %s, real %v", i, c.expect, ip)
+		}
+	}
+	conf := NodeIPConf{IPFamily: "ipv5"}
+	if err := conf.validate(); err == nil {
+		t.Fatal("expect unknown ip family error")
+	}
+}
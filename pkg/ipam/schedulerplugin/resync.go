@@ -55,6 +55,10 @@ func (p *FloatingIPPlugin) storeReady() bool {
 		glog.V(3).Infof("the pool store has not been synced yet")
 		return false
 	}
+	if p.LeaseSynced != nil && !p.LeaseSynced() {
+		glog.V(3).Infof("the lease store has not been synced yet")
+		return false
+	}
 	return true
 }
 
@@ -20,6 +20,7 @@ import (
 	extensionClient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	"k8s.io/client-go/kubernetes"
 	appv1 "k8s.io/client-go/listers/apps/v1"
+	coordinationv1 "k8s.io/client-go/listers/coordination/v1"
 	corev1lister "k8s.io/client-go/listers/core/v1"
 	crd_clientset "tkestack.io/galaxy/pkg/ipam/client/clientset/versioned"
 	list "tkestack.io/galaxy/pkg/ipam/client/listers/galaxy/v1alpha1"
@@ -43,6 +44,9 @@ type PluginFactoryArgs struct {
 	PoolSynced        func() bool
 	CrdClient         crd_clientset.Interface
 	ExtClient         extensionClient.Interface
+	// LeaseLister lists agent leases of nodes in constant.AgentLeaseNamespace
+	LeaseLister coordinationv1.LeaseLister
+	LeaseSynced func() bool
 }
 
 const (
@@ -61,6 +65,9 @@ type Conf struct {
 	SecondFloatingIPKey   string                       `json:"secondFloatingipKey"` // configmap second floatingip data key
 	CloudProviderGRPCAddr string                       `json:"cloudProviderGrpcAddr"`
 	StorageDriver         string                       `json:"storageDriver"`
+	NodeIP                NodeIPConf                   `json:"nodeIP"`
+	// If not 0, nodes whose galaxy hasn't renewed its agent lease for this many seconds are filtered out
+	AgentLivenessTimeout uint `json:"agentLivenessTimeout"`
 }
 
 func (conf *Conf) validate() {
@@ -32,6 +32,10 @@ type ServerRunOptions struct {
 	KubeConf       string
 	Swagger        bool
 	LeaderElection LeaderElectionConfiguration
+	// If set, master and its credentials are read from this dir, e.g. a mounted secret, instead of Master and KubeConf
+	MasterCredentialsDir string
+	// If true, API requests must carry bearer tokens which RBAC allows to access floatingips or pools
+	APIAuth bool
 }
 
 var (
@@ -50,6 +54,7 @@ func NewServerRunOptions() *ServerRunOptions {
 		Port:           9040,
 		APIPort:        9041,
 		Swagger:        false,
+		APIAuth:        true,
 		LeaderElection: DefaultLeaderElectionConfiguration(),
 	}
 	opt.LeaderElection.LeaderElect = true
@@ -64,6 +69,11 @@ func (s *ServerRunOptions) AddFlags(fs *pflag.FlagSet) {
 	fs.IntVar(&s.APIPort, "api-port", s.APIPort, "The API port on which to serve")
 	fs.StringVar(&s.Master, "master", s.Master, "The address and port of the Kubernetes API server")
 	fs.StringVar(&s.KubeConf, "kubeconfig", s.KubeConf, "The kube config file location of APISwitch, used to support TLS")
+	fs.StringVar(&s.MasterCredentialsDir, "master-credentials-dir", s.MasterCredentialsDir, "The dir, e.g. a "+
+		"mounted secret, of master, token, ca.crt, tls.crt and tls.key files to connect to the Kubernetes API server. "+
+		"Token changes are reloaded, changes of others restart galaxy-ipam. Overrides --master and --kubeconfig")
+	fs.BoolVar(&s.APIAuth, "api-auth", s.APIAuth, "Authenticate API requests by TokenReview and authorize them by "+
+		"SubjectAccessReview on floatingips and pools of galaxy.k8s.io")
 	fs.BoolVar(&s.Swagger, "swagger", s.Swagger, "Enable swagger via API web interface host:api-port/apidocs.json/")
 	BindFlags(&s.LeaderElection, fs)
 }
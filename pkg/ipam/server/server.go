@@ -18,15 +18,17 @@ package server
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/emicklei/go-restful"
 	"github.com/emicklei/go-restful-swagger12"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
 	extensionClient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -36,20 +38,26 @@ import (
 	"k8s.io/client-go/kubernetes/scheme"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/client-go/tools/leaderelection/resourcelock"
 	"k8s.io/client-go/tools/record"
 	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/galaxy/constant"
 	"tkestack.io/galaxy/pkg/api/k8s/eventhandler"
 	"tkestack.io/galaxy/pkg/api/k8s/schedulerapi"
 	"tkestack.io/galaxy/pkg/ipam/api"
+	"tkestack.io/galaxy/pkg/ipam/apis/galaxy"
 	"tkestack.io/galaxy/pkg/ipam/client/clientset/versioned"
 	crdInformer "tkestack.io/galaxy/pkg/ipam/client/informers/externalversions"
 	"tkestack.io/galaxy/pkg/ipam/crd"
 	"tkestack.io/galaxy/pkg/ipam/schedulerplugin"
 	"tkestack.io/galaxy/pkg/ipam/server/options"
+	"tkestack.io/galaxy/pkg/utils/confcheck"
+	"tkestack.io/galaxy/pkg/utils/credential"
 	"tkestack.io/galaxy/pkg/utils/httputil"
+	"tkestack.io/galaxy/pkg/utils/kubeauth"
 	pageutil "tkestack.io/galaxy/pkg/utils/page"
 	"tkestack.io/tapp/pkg/apis/tappcontroller"
 	tappVersioned "tkestack.io/tapp/pkg/client/clientset/versioned"
@@ -65,14 +73,18 @@ const COMPONENT_NAME = "galaxy-ipam"
 type Server struct {
 	JsonConf
 	*options.ServerRunOptions
-	client               kubernetes.Interface
-	crdClient            versioned.Interface
-	tappClient           tappVersioned.Interface
-	extensionClient      extensionClient.Interface
-	plugin               *schedulerplugin.FloatingIPPlugin
-	informerFactory      informers.SharedInformerFactory
-	crdInformerFactory   crdInformer.SharedInformerFactory
-	tappInformerFactory  tappInformers.SharedInformerFactory
+	client              kubernetes.Interface
+	crdClient           versioned.Interface
+	tappClient          tappVersioned.Interface
+	extensionClient     extensionClient.Interface
+	plugin              *schedulerplugin.FloatingIPPlugin
+	informerFactory     informers.SharedInformerFactory
+	crdInformerFactory  crdInformer.SharedInformerFactory
+	tappInformerFactory tappInformers.SharedInformerFactory
+	// leaseInformerFactory watches agent leases of nodes if AgentLivenessTimeout is set
+	leaseInformerFactory informers.SharedInformerFactory
+	// podIndexer indexes pods by their ips for owner lookups
+	podIndexer           cache.Indexer
 	stopChan             chan struct{}
 	leaderElectionConfig *leaderelection.LeaderElectionConfig
 }
@@ -92,7 +104,7 @@ func (s *Server) init() error {
 	if err != nil {
 		return fmt.Errorf("read json config: %v", err)
 	}
-	if err := json.Unmarshal(data, &s.JsonConf); err != nil {
+	if err := confcheck.DecodeStrict(data, &s.JsonConf); err != nil {
 		return fmt.Errorf("bad config %s: %v", string(data), err)
 	}
 	s.initk8sClient()
@@ -123,11 +135,22 @@ func (s *Server) init() error {
 		pluginArgs.TAppLister = tappInformer.Lister()
 		pluginArgs.TAppHasSynced = tappInformer.Informer().HasSynced
 	}
+	if s.SchedulePluginConf.AgentLivenessTimeout > 0 {
+		s.leaseInformerFactory = informers.NewSharedInformerFactoryWithOptions(s.client, time.Minute,
+			informers.WithNamespace(constant.AgentLeaseNamespace))
+		leaseInformer := s.leaseInformerFactory.Coordination().V1().Leases()
+		pluginArgs.LeaseLister = leaseInformer.Lister()
+		pluginArgs.LeaseSynced = leaseInformer.Informer().HasSynced
+	}
 	s.plugin, err = schedulerplugin.NewFloatingIPPlugin(s.SchedulePluginConf, pluginArgs)
 	if err != nil {
 		return err
 	}
 	podInformer.Informer().AddEventHandler(eventhandler.NewPodEventHandler(s.plugin))
+	if err := podInformer.Informer().AddIndexers(cache.Indexers{api.PodIPIndex: api.IndexPodIPs}); err != nil {
+		return err
+	}
+	s.podIndexer = podInformer.Informer().GetIndexer()
 	return nil
 }
 
@@ -148,6 +171,9 @@ func (s *Server) Run() error {
 	if s.tappInformerFactory != nil {
 		go s.tappInformerFactory.Start(s.stopChan)
 	}
+	if s.leaseInformerFactory != nil {
+		go s.leaseInformerFactory.Start(s.stopChan)
+	}
 	if err := crd.EnsureCRDCreated(s.extensionClient); err != nil {
 		return err
 	}
@@ -160,9 +186,26 @@ func (s *Server) Run() error {
 	return nil
 }
 
+func (s *Server) clientConfig() (*restclient.Config, error) {
+	if s.MasterCredentialsDir == "" {
+		return clientcmd.BuildConfigFromFlags(s.Master, s.KubeConf)
+	}
+	source, err := credential.NewSource(s.MasterCredentialsDir)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := source.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	source.ExitOnEndpointChange()
+	go source.Run(credential.ReloadInterval, s.stopChan)
+	return cfg, nil
+}
+
 // #lizard forgives
 func (s *Server) initk8sClient() {
-	cfg, err := clientcmd.BuildConfigFromFlags(s.Master, s.KubeConf)
+	cfg, err := s.clientConfig()
 	if err != nil {
 		glog.Fatalf("Error building kubeconfig: %s", err.Error())
 	}
@@ -189,7 +232,8 @@ func (s *Server) initk8sClient() {
 			glog.Fatalf("Error building tapp clientset: %v", err)
 		}
 	}
-	glog.Infof("connected to apiserver %v", cfg)
+	// cfg holds credentials, don't print it
+	glog.Infof("connected to apiserver %s", cfg.Host)
 
 	// Identity used to distinguish between multiple cloud controller manager instances
 	id, err := os.Hostname()
@@ -276,6 +320,9 @@ func (s *Server) startAPIServer() {
 		Path("/v1").
 		Consumes(restful.MIME_JSON).
 		Produces(restful.MIME_JSON)
+	if s.APIAuth {
+		ws.Filter(kubeauth.New(s.client, apiAttributes).Filter)
+	}
 	c := api.NewController(s.plugin.GetIpam(), s.plugin.GetSecondIpam(), s.plugin.PodLister)
 	ws.Route(ws.GET("/ip").To(c.ListIPs).
 		Doc("List ips by keyword or params").
@@ -344,6 +391,60 @@ func (s *Server) startAPIServer() {
 		Returns(http.StatusOK, "request succeed", httputil.Resp{Code: http.StatusOK}).
 		Writes(httputil.Resp{Code: http.StatusOK}))
 
+	snapshotController := api.SnapshotController{Client: s.crdClient, LockPool: s.plugin.GetLockPool(),
+		IPAM: s.plugin.GetIpam(), SecondIPAM: s.plugin.GetSecondIpam()}
+	ws.Route(ws.GET("/snapshot").To(snapshotController.Export).
+		Doc("Export floatingip pools, allocations and reservations of ipams and pools as a snapshot").
+		Returns(http.StatusInternalServerError, "internal server error", nil).
+		Returns(http.StatusOK, "request succeed", api.Snapshot{Version: api.SnapshotVersion}).
+		Writes(api.Snapshot{}))
+
+	ws.Route(ws.POST("/snapshot").To(snapshotController.Restore).
+		Doc("Restore allocations and pools of a snapshot").
+		Param(ws.QueryParameter("conflict", "how entries conflicting with the current state are resolved, skip, "+
+			"overwrite or abort").DataType("string").DefaultValue(api.ConflictSkip)).
+		Param(ws.QueryParameter("dryRun", "set to true to report what restoring does without applying it").
+			DataType("boolean")).
+		Reads(api.Snapshot{}).
+		Returns(http.StatusBadRequest, "unsupported snapshot version 2", nil).
+		Returns(http.StatusConflict, "snapshot conflicts with the current state, nothing restored",
+			api.RestoreSnapshotResp{}).
+		Returns(http.StatusInternalServerError, "internal server error", nil).
+		Returns(http.StatusOK, "request succeed", api.RestoreSnapshotResp{Resp: httputil.NewResp(http.StatusOK, ""),
+			Restored: 3}).
+		Writes(api.RestoreSnapshotResp{}))
+
+	agentController := api.AgentController{Livenesses: s.plugin.AgentLivenesses}
+	ws.Route(ws.GET("/agent").To(agentController.List).
+		Doc("List liveness of galaxy of nodes by their agent leases, empty if agentLivenessTimeout is not set").
+		Returns(http.StatusInternalServerError, "internal server error", nil).
+		Returns(http.StatusOK, "request succeed", api.ListAgentsResp{Resp: httputil.NewResp(http.StatusOK, ""),
+			Agents: []*schedulerplugin.AgentLiveness{{Node: "node1", Alive: true}}}).
+		Writes(api.ListAgentsResp{}))
+
+	ownerController := api.OwnerController{IPAM: s.plugin.GetIpam(), SecondIPAM: s.plugin.GetSecondIpam(),
+		PodIndexer: s.podIndexer}
+	ws.Route(ws.GET("/owner/{ip}").To(ownerController.Get).
+		Doc("Get the pod owning an ip by pods and allocations galaxy-ipam watches").
+		Param(ws.PathParameter("ip", "ip").DataType("string").Required(true)).
+		Returns(http.StatusNotFound, "ip has no owner", nil).
+		Returns(http.StatusBadRequest, "bad ip", nil).
+		Returns(http.StatusInternalServerError, "internal server error", nil).
+		Returns(http.StatusOK, "request succeed", api.IPOwner{IP: "10.0.70.118", Namespace: "default",
+			PodName: "app-xxx-yyy", NodeName: "node1", Phase: "Running", AppName: "app", AppType: "deployment",
+			PoolName: "sample-pool", Allocated: true}).
+		Writes(api.IPOwner{}))
+
+	ws.Route(ws.POST("/owner").To(ownerController.List).
+		Doc("Get pods owning ips in a batch, ips having no owner are left out").
+		Reads(api.OwnersReq{IPs: []string{"10.0.70.118"}}).
+		Returns(http.StatusBadRequest, "bad ip", nil).
+		Returns(http.StatusInternalServerError, "internal server error", nil).
+		Returns(http.StatusOK, "request succeed", api.OwnersResp{Resp: httputil.NewResp(http.StatusOK, ""),
+			Owners: []*api.IPOwner{{IP: "10.0.70.118", Namespace: "default", PodName: "app-xxx-yyy",
+				NodeName: "node1", Phase: "Running", Allocated: true}}}).
+		Writes(api.OwnersResp{}))
+
 	restful.Add(ws)
 	addSwaggerUISupport(restful.DefaultContainer)
 	if err := http.ListenAndServe(fmt.Sprintf("%s:%d", s.Bind, s.APIPort), nil); err != nil {
@@ -351,6 +452,52 @@ func (s *Server) startAPIServer() {
 	}
 }
 
+// apiAttributes maps API requests to the crds they read or write so that RBAC rules of galaxy.k8s.io apply
+func apiAttributes(r *restful.Request) *authorizationv1.ResourceAttributes {
+	attrs := &authorizationv1.ResourceAttributes{Group: galaxy.GroupName, Resource: "floatingips"}
+	if r.SelectedRoutePath() == "/v1/agent" {
+		return &authorizationv1.ResourceAttributes{Group: coordinationv1.GroupName, Resource: "leases",
+			Namespace: constant.AgentLeaseNamespace, Verb: "list"}
+	}
+	if r.SelectedRoutePath() == "/v1/snapshot" {
+		// restoring creates floatingips, reading pools and writing them are not authorized separately
+		attrs.Verb = "list"
+		if r.Request.Method == http.MethodPost {
+			attrs.Verb = "create"
+		}
+		return attrs
+	}
+	if strings.HasPrefix(r.SelectedRoutePath(), "/v1/owner") {
+		// looking up owners reads floatingips only, even in a POST
+		attrs.Verb = "list"
+		if r.Request.Method == http.MethodGet {
+			attrs.Verb = "get"
+			attrs.Name = r.PathParameter("ip")
+		}
+		return attrs
+	}
+	if r.SelectedRoutePath() != "/v1/ip" {
+		attrs.Resource = "pools"
+		attrs.Name = r.PathParameter("name")
+	}
+	switch r.Request.Method {
+	case http.MethodGet:
+		attrs.Verb = "list"
+		if attrs.Name != "" {
+			attrs.Verb = "get"
+		}
+	case http.MethodDelete:
+		attrs.Verb = "delete"
+	default:
+		// releasing ips deletes floatingips, posting a pool creates or updates it
+		attrs.Verb = "delete"
+		if attrs.Resource == "pools" {
+			attrs.Verb = "create"
+		}
+	}
+	return attrs
+}
+
 func addSwaggerUISupport(container *restful.Container) {
 	config := swagger.Config{
 		WebServices:     restful.RegisteredWebServices(),
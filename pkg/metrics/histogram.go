@@ -0,0 +1,128 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const typeHistogram = "histogram"
+
+// LatencyBuckets are upper bounds in seconds of buckets of latencies of cni requests and alike
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// HistogramVec is a histogram metric family partitioned by labels
+type HistogramVec struct {
+	sync.Mutex
+	metricName string
+	help       string
+	labels     []string
+	buckets    []float64
+	values     map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	sync.Mutex
+	// counts are observations of each bucket, not cumulative
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec creates and registers a HistogramVec of buckets, which are sorted upper bounds
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("buckets of metric %s are not sorted", name))
+	}
+	h := &HistogramVec{metricName: name, help: help, labels: labels, buckets: buckets,
+		values: map[string]*histogramValue{}}
+	register(h)
+	return h
+}
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	buckets []float64
+	v       *histogramValue
+}
+
+func (h *HistogramVec) name() string {
+	return h.metricName
+}
+
+// WithLabelValues returns the histogram for the label values
+func (h *HistogramVec) WithLabelValues(labelValues ...string) Histogram {
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", h.metricName, len(h.labels),
+			len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	h.Lock()
+	defer h.Unlock()
+	val, ok := h.values[key]
+	if !ok {
+		val = &histogramValue{labelValues: append([]string{}, labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.values[key] = val
+	}
+	return Histogram{buckets: h.buckets, v: val}
+}
+
+// Observe adds an observation of value v
+func (h Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.v.Lock()
+	defer h.v.Unlock()
+	if i < len(h.buckets) {
+		h.v.counts[i]++
+	}
+	h.v.sum += v
+	h.v.count++
+}
+
+func (h *HistogramVec) write(buf *bytes.Buffer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(buf, "# HELP %s %s\n", h.metricName, h.help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", h.metricName, typeHistogram)
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		val := h.values[k]
+		val.Lock()
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += val.counts[i]
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.metricName,
+				formatLabels(h.labels, val.labelValues, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", h.metricName, formatLabels(h.labels, val.labelValues, "le", "+Inf"),
+			val.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.metricName, formatLabels(h.labels, val.labelValues, "", ""),
+			formatFloat(val.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.metricName, formatLabels(h.labels, val.labelValues, "", ""),
+			val.count)
+		val.Unlock()
+	}
+}
@@ -0,0 +1,256 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package metrics is a tiny metrics registry which renders metrics in prometheus text exposition format, so that
+// galaxy doesn't need to depend on the prometheus client library.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+)
+
+type metric interface {
+	name() string
+	write(buf *bytes.Buffer)
+}
+
+var (
+	registryLock sync.Mutex
+	registry     = map[string]metric{}
+)
+
+func register(m metric) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[m.name()]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", m.name()))
+	}
+	registry[m.name()] = m
+}
+
+// vec holds values of a metric family keyed by label values
+type vec struct {
+	sync.Mutex
+	metricName string
+	help       string
+	metricType string
+	labels     []string
+	values     map[string]*value
+}
+
+type value struct {
+	labelValues []string
+	sync.Mutex
+	v float64
+}
+
+func newVec(name, help, metricType string, labels []string) *vec {
+	return &vec{metricName: name, help: help, metricType: metricType, labels: labels, values: map[string]*value{}}
+}
+
+func (v *vec) name() string {
+	return v.metricName
+}
+
+func (v *vec) get(labelValues []string) *value {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.metricName, len(v.labels),
+			len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.Lock()
+	defer v.Unlock()
+	val, ok := v.values[key]
+	if !ok {
+		val = &value{labelValues: append([]string{}, labelValues...)}
+		v.values[key] = val
+	}
+	return val
+}
+
+func (v *vec) delete(labelValues []string) {
+	v.Lock()
+	defer v.Unlock()
+	delete(v.values, strings.Join(labelValues, "\xff"))
+}
+
+func (v *vec) write(buf *bytes.Buffer) {
+	v.Lock()
+	defer v.Unlock()
+	fmt.Fprintf(buf, "# HELP %s %s\n", v.metricName, v.help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", v.metricName, v.metricType)
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		val := v.values[k]
+		val.Lock()
+		fmt.Fprintf(buf, "%s%s %s\n", v.metricName, formatLabels(v.labels, val.labelValues, "", ""),
+			formatFloat(val.v))
+		val.Unlock()
+	}
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", names[i], strconv.Quote(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extraName, strconv.Quote(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// CounterVec is a counter metric family partitioned by labels
+type CounterVec struct {
+	*vec
+}
+
+// NewCounterVec creates and registers a CounterVec
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec(name, help, typeCounter, labels)}
+	register(c)
+	return c
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	v *value
+}
+
+// WithLabelValues returns the counter for the label values
+func (c *CounterVec) WithLabelValues(labelValues ...string) Counter {
+	return Counter{v: c.get(labelValues)}
+}
+
+// DeleteLabelValues removes the counter of the label values, e.g. of an ip which is released
+func (c *CounterVec) DeleteLabelValues(labelValues ...string) {
+	c.delete(labelValues)
+}
+
+// Inc increases the counter by 1
+func (c Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increases the counter by delta which must not be negative
+func (c Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.v.Lock()
+	c.v.v += delta
+	c.v.Unlock()
+}
+
+// GaugeVec is a gauge metric family partitioned by labels
+type GaugeVec struct {
+	*vec
+}
+
+// NewGaugeVec creates and registers a GaugeVec
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec: newVec(name, help, typeGauge, labels)}
+	register(g)
+	return g
+}
+
+// Gauge is a value which can go up and down
+type Gauge struct {
+	v *value
+}
+
+// WithLabelValues returns the gauge for the label values
+func (g *GaugeVec) WithLabelValues(labelValues ...string) Gauge {
+	return Gauge{v: g.get(labelValues)}
+}
+
+// DeleteLabelValues removes the gauge of the label values, so that it won't be exported anymore
+func (g *GaugeVec) DeleteLabelValues(labelValues ...string) {
+	g.delete(labelValues)
+}
+
+// Set sets the gauge to v
+func (g Gauge) Set(v float64) {
+	g.v.Lock()
+	g.v.v = v
+	g.v.Unlock()
+}
+
+// Add adds delta to the gauge
+func (g Gauge) Add(delta float64) {
+	g.v.Lock()
+	g.v.v += delta
+	g.v.Unlock()
+}
+
+// Inc increases the gauge by 1
+func (g Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec decreases the gauge by 1
+func (g Gauge) Dec() {
+	g.Add(-1)
+}
+
+// WriteTo writes all registered metrics in prometheus text format to buf
+func WriteTo(buf *bytes.Buffer) {
+	registryLock.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	registryLock.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		registryLock.Lock()
+		m := registry[name]
+		registryLock.Unlock()
+		m.write(buf)
+	}
+}
+
+// Handler returns a http handler serving all registered metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := bytes.NewBuffer(nil)
+		WriteTo(buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write(buf.Bytes())
+	})
+}
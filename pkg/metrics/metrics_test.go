@@ -0,0 +1,68 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	counter := NewCounterVec("test_requests_total", "Total requests", "command")
+	gauge := NewGaugeVec("test_state_files", "State files", "dir")
+	counter.WithLabelValues("ADD").Inc()
+	counter.WithLabelValues("ADD").Add(2)
+	counter.WithLabelValues("DEL").Inc()
+	gauge.WithLabelValues("/var/lib/cni/galaxy").Set(10)
+	gauge.WithLabelValues("/tmp").Set(1)
+	gauge.DeleteLabelValues("/tmp")
+	buf := bytes.NewBuffer(nil)
+	WriteTo(buf)
+	expect := `# HELP test_requests_total Total requests
+# TYPE test_requests_total counter
+test_requests_total{command="ADD"} 3
+test_requests_total{command="DEL"} 1
+# HELP test_state_files State files
+# TYPE test_state_files gauge
+test_state_files{dir="/var/lib/cni/galaxy"} 10
+`
+	if !strings.Contains(buf.String(), expect) {
+		t.Fatalf("expect %s, real %s", expect, buf.String())
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	histogram := NewHistogramVec("test_request_duration_seconds", "Request latencies", []float64{0.1, 1},
+		"command")
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		histogram.WithLabelValues("ADD").Observe(v)
+	}
+	buf := bytes.NewBuffer(nil)
+	WriteTo(buf)
+	expect := `# HELP test_request_duration_seconds Request latencies
+# TYPE test_request_duration_seconds histogram
+test_request_duration_seconds_bucket{command="ADD",le="0.1"} 2
+test_request_duration_seconds_bucket{command="ADD",le="1"} 3
+test_request_duration_seconds_bucket{command="ADD",le="+Inf"} 4
+test_request_duration_seconds_sum{command="ADD"} 3.65
+test_request_duration_seconds_count{command="ADD"} 4
+`
+	if !strings.Contains(buf.String(), expect) {
+		t.Fatalf("expect %s, real %s", expect, buf.String())
+	}
+}
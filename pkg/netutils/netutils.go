@@ -0,0 +1,92 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package netutils exposes device and sysctl helpers of galaxy to companion agents. Unlike other packages of galaxy,
+// exported identifiers of this package are kept backward compatible within a major version: they may be added to,
+// but not removed or changed in signature or behavior.
+//
+// Errors are *Error wrapping the underlying error, so errors.Is and errors.As see through them. Operations check the
+// context before each step, a single kernel call can't be interrupted once it starts.
+package netutils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+
+	"tkestack.io/galaxy/pkg/utils"
+)
+
+// sysctlRoot is where sysctls are, tests replace it
+var sysctlRoot = "/proc/sys"
+
+// Error is the error of an operation on a target, e.g. a device or a sysctl
+type Error struct {
+	Op     string
+	Target string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Target, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// do runs f as op on target unless ctx is done, it wraps the error of either
+func do(ctx context.Context, op, target string, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return &Error{Op: op, Target: target, Err: err}
+	}
+	if err := f(); err != nil {
+		return &Error{Op: op, Target: target, Err: err}
+	}
+	return nil
+}
+
+// CreateBridge creates bridge name with hwAddr, a random mac is used if hwAddr is nil
+func CreateBridge(ctx context.Context, name string, hwAddr net.HardwareAddr) error {
+	return do(ctx, "create bridge", name, func() error {
+		return utils.CreateBridgeDevice(name, hwAddr)
+	})
+}
+
+func writeSysctl(ctx context.Context, op, sysctl, value string) error {
+	return do(ctx, op, sysctl, func() error {
+		return ioutil.WriteFile(filepath.Join(sysctlRoot, sysctl), []byte(value+"\n"), 0644)
+	})
+}
+
+// SetProxyARP enables proxy arp of dev
+func SetProxyARP(ctx context.Context, dev string) error {
+	return writeSysctl(ctx, "set proxy arp", fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", dev), "1")
+}
+
+// UnsetARPIgnore sets arp_ignore of dev to 0, dev replies arp requests of any local address
+func UnsetARPIgnore(ctx context.Context, dev string) error {
+	return writeSysctl(ctx, "unset arp ignore", fmt.Sprintf("net/ipv4/conf/%s/arp_ignore", dev), "0")
+}
+
+// EnableNonlocalBind sets net.ipv4.ip_nonlocal_bind to 1 so that processes of the netns may bind addresses which are
+// not local, e.g. vips of pods routed on the node. The previous value is not recorded.
+func EnableNonlocalBind(ctx context.Context) error {
+	return writeSysctl(ctx, "enable nonlocal bind", "net/ipv4/ip_nonlocal_bind", "1")
+}
@@ -0,0 +1,75 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package netutils
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// #lizard forgives
+func TestSysctls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	oldRoot := sysctlRoot
+	sysctlRoot = dir
+	defer func() { sysctlRoot = oldRoot }()
+	if err := os.MkdirAll(filepath.Join(dir, "net/ipv4/conf/eth0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, c := range []struct {
+		f      func(context.Context) error
+		sysctl string
+		expect string
+	}{
+		{f: func(ctx context.Context) error { return SetProxyARP(ctx, "eth0") },
+			sysctl: "net/ipv4/conf/eth0/proxy_arp", expect: "1\n"},
+		{f: func(ctx context.Context) error { return UnsetARPIgnore(ctx, "eth0") },
+			sysctl: "net/ipv4/conf/eth0/arp_ignore", expect: "0\n"},
+		{f: EnableNonlocalBind, sysctl: "net/ipv4/ip_nonlocal_bind", expect: "1\n"},
+	} {
+		if err := c.f(ctx); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, c.sysctl))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != c.expect {
+			t.Fatalf("%s: expect %q, real %q", c.sysctl, c.expect, string(data))
+		}
+	}
+	// a missing device fails with an error wrapping the cause
+	err = SetProxyARP(ctx, "eth1")
+	var e *Error
+	if !errors.As(err, &e) || e.Target != "net/ipv4/conf/eth1/proxy_arp" || !os.IsNotExist(errors.Unwrap(err)) {
+		t.Fatalf("expect not exist error of eth1, real %v", err)
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := SetProxyARP(canceled, "eth0"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect canceled, real %v", err)
+	}
+}
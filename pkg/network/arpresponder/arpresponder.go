@@ -0,0 +1,129 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package arpresponder answers arp requests on an uplink for ips of local pure mode pods. Unlike proxy arp of the
+// uplink, which makes the kernel answer for every ip routed via another interface, it answers only for the ips it is
+// given, and counts replies of each ip.
+package arpresponder
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"tkestack.io/galaxy/pkg/metrics"
+)
+
+var replies = metrics.NewCounterVec("galaxy_arp_responder_replies_total", "Number of arp replies sent by the arp "+
+	"responder for ips of pure mode pods", "device", "ip")
+
+const (
+	ethHeaderLen = 14
+	arpLen       = 28
+	etherTypeARP = 0x0806
+	arpRequest   = 1
+	arpReply     = 2
+)
+
+// Responder answers arp requests received by Device for its ips with the mac of Device
+type Responder struct {
+	Device string
+	lock   sync.Mutex
+	ips    map[string]bool
+	// serve reads arp packets of the device until quit is closed and sends replies, it is replaceable by tests
+	serve func(device string, quit <-chan struct{}, handle func(frame []byte, mac net.HardwareAddr) []byte) error
+}
+
+// New creates a Responder of device
+func New(device string) *Responder {
+	return &Responder{Device: device, ips: map[string]bool{}, serve: serveDevice}
+}
+
+// Sync replaces the ips to answer for
+func (r *Responder) Sync(ips []net.IP) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	current := map[string]bool{}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			current[ip4.String()] = true
+		}
+	}
+	for ip := range r.ips {
+		if !current[ip] {
+			replies.DeleteLabelValues(r.Device, ip)
+		}
+	}
+	r.ips = current
+}
+
+// Run answers arp requests until quit is closed
+func (r *Responder) Run(quit <-chan struct{}) error {
+	return r.serve(r.Device, quit, r.handle)
+}
+
+// handle returns the reply to frame if it is an arp request for one of the ips, mac is the mac of the device
+func (r *Responder) handle(frame []byte, mac net.HardwareAddr) []byte {
+	senderMAC, senderIP, targetIP, ok := parseRequest(frame)
+	if !ok {
+		return nil
+	}
+	r.lock.Lock()
+	answer := r.ips[targetIP.String()]
+	r.lock.Unlock()
+	if !answer {
+		return nil
+	}
+	replies.WithLabelValues(r.Device, targetIP.String()).Inc()
+	return buildReply(mac, targetIP, senderMAC, senderIP)
+}
+
+// parseRequest returns the sender and the target ip of an arp request of ethernet and ipv4. Gratuitous arps and
+// probes of duplicate address detection, whose sender ip is the target ip or unspecified, are not requests to answer.
+func parseRequest(frame []byte) (net.HardwareAddr, net.IP, net.IP, bool) {
+	if len(frame) < ethHeaderLen+arpLen || binary.BigEndian.Uint16(frame[12:14]) != etherTypeARP {
+		return nil, nil, nil, false
+	}
+	arp := frame[ethHeaderLen:]
+	if binary.BigEndian.Uint16(arp[0:2]) != 1 || binary.BigEndian.Uint16(arp[2:4]) != 0x0800 || arp[4] != 6 ||
+		arp[5] != 4 || binary.BigEndian.Uint16(arp[6:8]) != arpRequest {
+		return nil, nil, nil, false
+	}
+	senderIP, targetIP := net.IP(arp[14:18]), net.IP(arp[24:28])
+	if senderIP.IsUnspecified() || senderIP.Equal(targetIP) {
+		return nil, nil, nil, false
+	}
+	return net.HardwareAddr(append([]byte{}, arp[8:14]...)), net.IP(append([]byte{}, senderIP...)),
+		net.IP(append([]byte{}, targetIP...)), true
+}
+
+// buildReply returns the ethernet frame of an arp reply telling targetMAC that ip is at mac
+func buildReply(mac net.HardwareAddr, ip net.IP, targetMAC net.HardwareAddr, targetIP net.IP) []byte {
+	frame := make([]byte, ethHeaderLen+arpLen)
+	copy(frame[0:6], targetMAC)
+	copy(frame[6:12], mac)
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeARP)
+	arp := frame[ethHeaderLen:]
+	binary.BigEndian.PutUint16(arp[0:2], 1)
+	binary.BigEndian.PutUint16(arp[2:4], 0x0800)
+	arp[4], arp[5] = 6, 4
+	binary.BigEndian.PutUint16(arp[6:8], arpReply)
+	copy(arp[8:14], mac)
+	copy(arp[14:18], ip.To4())
+	copy(arp[18:24], targetMAC)
+	copy(arp[24:28], targetIP.To4())
+	return frame
+}
@@ -0,0 +1,73 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package arpresponder
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// requestFrame builds an arp request of sender asking for target
+func requestFrame(mac net.HardwareAddr, sender, target net.IP) []byte {
+	frame := buildReply(mac, sender, net.HardwareAddr{0, 0, 0, 0, 0, 0}, target)
+	copy(frame[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	frame[ethHeaderLen+7] = arpRequest
+	return frame
+}
+
+func TestParseRequest(t *testing.T) {
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	sender, target := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	senderMAC, senderIP, targetIP, ok := parseRequest(requestFrame(mac, sender, target))
+	if !ok || senderMAC.String() != mac.String() || !senderIP.Equal(sender) || !targetIP.Equal(target) {
+		t.Fatalf("unexpected request %v %v %v %v", senderMAC, senderIP, targetIP, ok)
+	}
+	for i, frame := range [][]byte{
+		// gratuitous arp
+		requestFrame(mac, target, target),
+		// probe of duplicate address detection
+		requestFrame(mac, net.IPv4zero, target),
+		// reply
+		buildReply(mac, sender, mac, target),
+		// truncated
+		requestFrame(mac, sender, target)[:40],
+	} {
+		if _, _, _, ok := parseRequest(frame); ok {
+			t.Errorf("case %d: expect not a request to answer", i)
+		}
+	}
+}
+
+func TestHandle(t *testing.T) {
+	hostMAC, _ := net.ParseMAC("02:00:00:00:00:aa")
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	sender, pod, other := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")
+	r := New("eth1")
+	r.Sync([]net.IP{pod, net.ParseIP("fd00::2")})
+	if reply := r.handle(requestFrame(mac, sender, other), hostMAC); reply != nil {
+		t.Fatalf("expect no reply for ips of others, got %v", reply)
+	}
+	reply := r.handle(requestFrame(mac, sender, pod), hostMAC)
+	if expect := buildReply(hostMAC, pod, mac, sender); !bytes.Equal(reply, expect) {
+		t.Fatalf("expect reply %v, got %v", expect, reply)
+	}
+	r.Sync(nil)
+	if reply := r.handle(requestFrame(mac, sender, pod), hostMAC); reply != nil {
+		t.Fatalf("expect no reply after the ip is removed, got %v", reply)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package arpresponder
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// serveDevice reads arp packets received by device and sends replies handle returns until quit is closed, it returns
+// nil once quit is closed
+func serveDevice(device string, quit <-chan struct{}, handle func(frame []byte, mac net.HardwareAddr) []byte) error {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd) // nolint: errcheck
+	addr := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ARP), Ifindex: iface.Index}
+	if err := unix.Bind(fd, addr); err != nil {
+		return err
+	}
+	// wake up every second to check quit
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1}); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	for {
+		select {
+		case <-quit:
+			return nil
+		default:
+		}
+		n, from, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			return err
+		}
+		// skip what the host sends itself, e.g. replies of its own ips
+		if ll, ok := from.(*unix.SockaddrLinklayer); ok && ll.Pkttype == unix.PACKET_OUTGOING {
+			continue
+		}
+		reply := handle(buf[:n], iface.HardwareAddr)
+		if reply == nil {
+			continue
+		}
+		to := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ARP), Ifindex: iface.Index, Halen: 6}
+		copy(to.Addr[:], reply[0:6])
+		if err := unix.Sendto(fd, reply, 0, to); err != nil {
+			return err
+		}
+	}
+}
+
+func htons(i uint16) uint16 {
+	return (i<<8)&0xff00 | i>>8
+}
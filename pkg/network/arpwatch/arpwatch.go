@@ -0,0 +1,261 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package arpwatch watches arp and neighbor advertisement packets on bridges and reports other macs claiming ips of
+// local pods, i.e. an ip allocated twice or a spoofing neighbor on a shared vlan.
+package arpwatch
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"tkestack.io/galaxy/pkg/metrics"
+)
+
+// reportInterval is how often a conflict of the same ip and mac is reported, a spoofer keeps sending packets
+const reportInterval = 5 * time.Minute
+
+var conflictPackets = metrics.NewCounterVec("galaxy_ip_conflict_packets_total", "Number of arp and neighbor "+
+	"advertisement packets claiming ips of local pods from other macs", "bridge", "protocol")
+
+// Binding is an ip of a local pod and the mac of its interface attached to Bridge
+type Binding struct {
+	IP     string
+	MAC    string
+	Bridge string
+	// Pod is namespace/name of the pod
+	Pod string
+}
+
+// Conflict is a packet claiming an ip of a local pod from another mac
+type Conflict struct {
+	// Owner is who binds the ip, see Watcher.Bind
+	Owner       string
+	Pod         string
+	IP          string
+	ExpectedMAC string
+	MAC         string
+	Bridge      string
+	// Protocol is arp or nd
+	Protocol string
+}
+
+type owned struct {
+	owner string
+	Binding
+}
+
+// Watcher watches bridges of bindings and calls onConflict for conflicts
+type Watcher struct {
+	lock     sync.Mutex
+	ips      map[string]*owned
+	owners   map[string][]Binding
+	bridges  map[string]chan struct{}
+	reported map[string]time.Time
+	now      func() time.Time
+	// ipv6 enables watching neighbor advertisements
+	ipv6       bool
+	onConflict func(Conflict)
+	// watch reads packets of the bridge until quit is closed, it is replaceable by tests
+	watch func(bridge string, ipv6 bool, quit <-chan struct{}, handle func(frame []byte))
+}
+
+// New creates a Watcher, it watches neighbor advertisements too if ipv6 is true
+func New(ipv6 bool, onConflict func(Conflict)) *Watcher {
+	return &Watcher{
+		ips:        map[string]*owned{},
+		owners:     map[string][]Binding{},
+		bridges:    map[string]chan struct{}{},
+		reported:   map[string]time.Time{},
+		now:        time.Now,
+		ipv6:       ipv6,
+		onConflict: onConflict,
+		watch:      watchBridge,
+	}
+}
+
+// Bind records ips of owner, e.g. a container, and starts watching their bridges. It replaces previous bindings of
+// owner.
+func (w *Watcher) Bind(owner string, bindings []Binding) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.unbind(owner)
+	if len(bindings) == 0 {
+		return
+	}
+	w.owners[owner] = bindings
+	for _, b := range bindings {
+		ip := net.ParseIP(b.IP)
+		if ip == nil {
+			continue
+		}
+		w.ips[ip.String()] = &owned{owner: owner, Binding: b}
+	}
+	w.syncBridges()
+}
+
+// Unbind removes ips of owner and stops watching bridges no other owner uses
+func (w *Watcher) Unbind(owner string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.unbind(owner)
+	w.syncBridges()
+}
+
+func (w *Watcher) unbind(owner string) {
+	for _, b := range w.owners[owner] {
+		ip := net.ParseIP(b.IP)
+		if ip == nil {
+			continue
+		}
+		// an ip may have been bound by a newer owner
+		if o, ok := w.ips[ip.String()]; ok && o.owner == owner {
+			delete(w.ips, ip.String())
+		}
+	}
+	delete(w.owners, owner)
+}
+
+// syncBridges starts watching new bridges of bindings and stops watching unused ones
+func (w *Watcher) syncBridges() {
+	used := map[string]bool{}
+	for _, o := range w.ips {
+		if o.Bridge != "" {
+			used[o.Bridge] = true
+		}
+	}
+	for bridge, quit := range w.bridges {
+		if !used[bridge] {
+			close(quit)
+			delete(w.bridges, bridge)
+		}
+	}
+	for bridge := range used {
+		if _, ok := w.bridges[bridge]; ok {
+			continue
+		}
+		quit := make(chan struct{})
+		w.bridges[bridge] = quit
+		go w.watch(bridge, w.ipv6, quit, func(frame []byte) {
+			w.handle(bridge, frame)
+		})
+	}
+}
+
+// Stop stops watching all bridges
+func (w *Watcher) Stop() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for bridge, quit := range w.bridges {
+		close(quit)
+		delete(w.bridges, bridge)
+	}
+}
+
+func (w *Watcher) handle(bridge string, frame []byte) {
+	ip, mac, protocol, ok := parseClaim(frame)
+	if !ok {
+		return
+	}
+	if c, ok := w.check(bridge, ip, mac, protocol); ok {
+		w.onConflict(c)
+	}
+}
+
+// check returns a conflict if mac claims an ip bound to another mac, conflicts of the same ip and mac are returned
+// once every reportInterval
+func (w *Watcher) check(bridge string, ip net.IP, mac net.HardwareAddr, protocol string) (Conflict, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	o, ok := w.ips[ip.String()]
+	if !ok || o.MAC == mac.String() {
+		return Conflict{}, false
+	}
+	c := Conflict{Owner: o.owner, Pod: o.Pod, IP: ip.String(), ExpectedMAC: o.MAC, MAC: mac.String(), Bridge: bridge,
+		Protocol: protocol}
+	conflictPackets.WithLabelValues(bridge, protocol).Inc()
+	key := c.IP + "/" + c.MAC
+	now := w.now()
+	if last, ok := w.reported[key]; ok && now.Sub(last) < reportInterval {
+		return Conflict{}, false
+	}
+	for k, last := range w.reported {
+		if now.Sub(last) >= reportInterval {
+			delete(w.reported, k)
+		}
+	}
+	w.reported[key] = now
+	return c, true
+}
+
+const (
+	ethHeaderLen  = 14
+	ipv6HeaderLen = 40
+	// icmpv6 type of neighbor advertisements and the option type of target link layer address
+	icmpv6NeighborAdvertisement = 136
+	optTargetLinkLayerAddress   = 2
+	protocolICMPv6              = 58
+	etherTypeARP                = 0x0806
+	etherTypeIPv6               = 0x86dd
+)
+
+// parseClaim returns the ip and mac an arp packet or neighbor advertisement claims
+func parseClaim(frame []byte) (net.IP, net.HardwareAddr, string, bool) {
+	if len(frame) < ethHeaderLen {
+		return nil, nil, "", false
+	}
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case etherTypeARP:
+		arp := frame[ethHeaderLen:]
+		// ethernet and ipv4 only, the sender of both requests and replies claims its ip
+		if len(arp) < 28 || binary.BigEndian.Uint16(arp[0:2]) != 1 || binary.BigEndian.Uint16(arp[2:4]) != 0x0800 ||
+			arp[4] != 6 || arp[5] != 4 {
+			return nil, nil, "", false
+		}
+		ip := net.IP(append([]byte{}, arp[14:18]...))
+		if ip.IsUnspecified() {
+			// arp probes of duplicate address detection claim nothing
+			return nil, nil, "", false
+		}
+		return ip, net.HardwareAddr(append([]byte{}, arp[8:14]...)), "arp", true
+	case etherTypeIPv6:
+		packet := frame[ethHeaderLen:]
+		if len(packet) < ipv6HeaderLen+24 || packet[6] != protocolICMPv6 {
+			return nil, nil, "", false
+		}
+		icmp := packet[ipv6HeaderLen:]
+		if icmp[0] != icmpv6NeighborAdvertisement {
+			return nil, nil, "", false
+		}
+		ip := net.IP(append([]byte{}, icmp[8:24]...))
+		// prefer the target link layer address option, fall back to the source mac
+		mac := net.HardwareAddr(append([]byte{}, frame[6:12]...))
+		for opts := icmp[24:]; len(opts) >= 8; {
+			length := int(opts[1]) * 8
+			if length == 0 || length > len(opts) {
+				break
+			}
+			if opts[0] == optTargetLinkLayerAddress && length >= 8 {
+				mac = net.HardwareAddr(append([]byte{}, opts[2:8]...))
+			}
+			opts = opts[length:]
+		}
+		return ip, mac, "nd", true
+	}
+	return nil, nil, "", false
+}
@@ -0,0 +1,136 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package arpwatch
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func arpFrame(mac net.HardwareAddr, ip net.IP) []byte {
+	frame := make([]byte, 42)
+	copy(frame[6:12], mac)
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeARP)
+	binary.BigEndian.PutUint16(frame[14:16], 1)
+	binary.BigEndian.PutUint16(frame[16:18], 0x0800)
+	frame[18], frame[19] = 6, 4
+	binary.BigEndian.PutUint16(frame[20:22], 1)
+	copy(frame[22:28], mac)
+	copy(frame[28:32], ip.To4())
+	copy(frame[38:42], ip.To4())
+	return frame
+}
+
+func naFrame(src, target net.HardwareAddr, ip net.IP) []byte {
+	frame := make([]byte, ethHeaderLen+ipv6HeaderLen+32)
+	copy(frame[6:12], src)
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeIPv6)
+	packet := frame[ethHeaderLen:]
+	packet[6] = protocolICMPv6
+	icmp := packet[ipv6HeaderLen:]
+	icmp[0] = icmpv6NeighborAdvertisement
+	copy(icmp[8:24], ip.To16())
+	icmp[24], icmp[25] = optTargetLinkLayerAddress, 1
+	copy(icmp[26:32], target)
+	return frame
+}
+
+func TestParseClaim(t *testing.T) {
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	mac2, _ := net.ParseMAC("02:00:00:00:00:02")
+	ip, mac1, protocol, ok := parseClaim(arpFrame(mac, net.ParseIP("10.0.0.2")))
+	if !ok || ip.String() != "10.0.0.2" || mac1.String() != mac.String() || protocol != "arp" {
+		t.Fatalf("unexpected claim %v %v %s %v", ip, mac1, protocol, ok)
+	}
+	if _, _, _, ok := parseClaim(arpFrame(mac, net.IPv4zero)); ok {
+		t.Fatal("expect arp probes claim nothing")
+	}
+	ip, mac1, protocol, ok = parseClaim(naFrame(mac, mac2, net.ParseIP("fd00::2")))
+	if !ok || ip.String() != "fd00::2" || mac1.String() != mac2.String() || protocol != "nd" {
+		t.Fatalf("unexpected claim %v %v %s %v", ip, mac1, protocol, ok)
+	}
+	if _, _, _, ok := parseClaim(arpFrame(mac, net.ParseIP("10.0.0.2"))[:30]); ok {
+		t.Fatal("expect truncated frames claim nothing")
+	}
+}
+
+// #lizard forgives
+func TestWatcher(t *testing.T) {
+	var lock sync.Mutex
+	var conflicts []Conflict
+	w := New(false, func(c Conflict) {
+		lock.Lock()
+		conflicts = append(conflicts, c)
+		lock.Unlock()
+	})
+	w.watch = func(bridge string, ipv6 bool, quit <-chan struct{}, handle func(frame []byte)) {}
+	now := time.Now()
+	w.now = func() time.Time { return now }
+	w.Bind("c1", []Binding{{IP: "10.0.0.2", MAC: "02:00:00:00:00:01", Bridge: "br0"}})
+	w.Bind("c2", []Binding{{IP: "10.0.0.3", MAC: "02:00:00:00:00:02", Bridge: "docker"}})
+	if !reflect.DeepEqual(bridges(w), []string{"br0", "docker"}) {
+		t.Fatalf("unexpected bridges %v", bridges(w))
+	}
+	spoofer, _ := net.ParseMAC("02:00:00:00:00:99")
+	owner, _ := net.ParseMAC("02:00:00:00:00:01")
+	w.handle("br0", arpFrame(owner, net.ParseIP("10.0.0.2")))
+	w.handle("br0", arpFrame(spoofer, net.ParseIP("10.0.0.5")))
+	w.handle("br0", arpFrame(spoofer, net.ParseIP("10.0.0.2")))
+	// reported once every reportInterval
+	w.handle("br0", arpFrame(spoofer, net.ParseIP("10.0.0.2")))
+	expect := Conflict{Owner: "c1", IP: "10.0.0.2", ExpectedMAC: "02:00:00:00:00:01", MAC: "02:00:00:00:00:99",
+		Bridge: "br0", Protocol: "arp"}
+	if !reflect.DeepEqual(conflicts, []Conflict{expect}) {
+		t.Fatalf("unexpected conflicts %v", conflicts)
+	}
+	now = now.Add(reportInterval)
+	w.handle("br0", arpFrame(spoofer, net.ParseIP("10.0.0.2")))
+	if len(conflicts) != 2 {
+		t.Fatalf("expect conflict reported again, real %v", conflicts)
+	}
+	w.Unbind("c2")
+	if !reflect.DeepEqual(bridges(w), []string{"br0"}) {
+		t.Fatalf("unexpected bridges %v", bridges(w))
+	}
+	// the ip moved to a new container
+	w.Bind("c3", []Binding{{IP: "10.0.0.2", MAC: "02:00:00:00:00:99", Bridge: "br0"}})
+	w.Unbind("c1")
+	w.handle("br0", arpFrame(spoofer, net.ParseIP("10.0.0.2")))
+	if len(conflicts) != 2 || !reflect.DeepEqual(bridges(w), []string{"br0"}) {
+		t.Fatalf("unexpected conflicts %v, bridges %v", conflicts, bridges(w))
+	}
+	w.Stop()
+	if len(bridges(w)) != 0 {
+		t.Fatalf("unexpected bridges %v", bridges(w))
+	}
+}
+
+func bridges(w *Watcher) []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var names []string
+	for name := range w.bridges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
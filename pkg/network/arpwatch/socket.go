@@ -0,0 +1,92 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package arpwatch
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+	glog "k8s.io/klog"
+)
+
+// retryInterval is how long to wait before watching a bridge again after failing to, e.g. it is being created
+const retryInterval = 10 * time.Second
+
+// watchBridge reads arp packets, and ipv6 packets if ipv6 is true, received by bridge until quit is closed. Bridges
+// receive broadcast and multicast packets of their ports, i.e. gratuitous arps, arp requests and unsolicited neighbor
+// advertisements, but not unicast packets between ports.
+func watchBridge(bridge string, ipv6 bool, quit <-chan struct{}, handle func(frame []byte)) {
+	protocols := []uint16{unix.ETH_P_ARP}
+	if ipv6 {
+		protocols = append(protocols, unix.ETH_P_IPV6)
+	}
+	for _, protocol := range protocols {
+		go func(protocol uint16) {
+			for {
+				if err := readPackets(bridge, protocol, quit, handle); err != nil {
+					glog.Warningf("failed to watch packets of protocol %#x on %s: %v", protocol, bridge, err)
+				}
+				select {
+				case <-quit:
+					return
+				case <-time.After(retryInterval):
+				}
+			}
+		}(protocol)
+	}
+}
+
+// readPackets returns nil once quit is closed
+func readPackets(bridge string, protocol uint16, quit <-chan struct{}, handle func(frame []byte)) error {
+	iface, err := net.InterfaceByName(bridge)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(protocol)))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd) // nolint: errcheck
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(protocol), Ifindex: iface.Index}); err != nil {
+		return err
+	}
+	// wake up every second to check quit
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1}); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	for {
+		select {
+		case <-quit:
+			return nil
+		default:
+		}
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			return err
+		}
+		handle(buf[:n])
+	}
+}
+
+func htons(i uint16) uint16 {
+	return (i<<8)&0xff00 | i>>8
+}
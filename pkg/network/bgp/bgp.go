@@ -0,0 +1,200 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package bgp advertises routes of pods to upstream routers by an embedded gobgp speaker. Routers route pod ips to
+// the node instead of resolving them on their attached subnets, so that pods need no proxy arp of the node's uplink
+// and may get ips of subnets not attached to the node.
+package bgp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	api "github.com/osrg/gobgp/api"
+	gobgp "github.com/osrg/gobgp/pkg/server"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	glog "k8s.io/klog"
+)
+
+// Config configures the bgp speaker of the node
+type Config struct {
+	// AS is the local as number of the node
+	AS uint32 `json:"as"`
+	// Interface is the interface whose first ipv4 address is the router id of the node and the next hop of advertised
+	// routes
+	Interface string `json:"interface"`
+	// Peers are upstream routers to advertise routes to
+	Peers []Peer `json:"peers"`
+	// PodRoutes advertises /32 routes of pure mode pods if true
+	PodRoutes bool `json:"podRoutes,omitempty"`
+	// Prefixes are advertised statically in cidr format, e.g. floating ip blocks of the node
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+// Peer is an upstream router
+type Peer struct {
+	Address string `json:"address"`
+	AS      uint32 `json:"as"`
+	// Password of tcp md5 authentication of the session if not empty
+	Password string `json:"password,omitempty"`
+}
+
+// Speaker advertises prefixes to peers of its config
+type Speaker struct {
+	conf     *Config
+	prefixes []*net.IPNet
+	server   *gobgp.BgpServer
+	nextHop  net.IP
+	lock     sync.Mutex
+	// advertised are paths advertised, keyed by their prefixes in cidr format
+	advertised map[string]*api.Path
+}
+
+// New validates conf and returns a Speaker of it
+func New(conf *Config) (*Speaker, error) {
+	if conf.AS == 0 {
+		return nil, fmt.Errorf("as of the node is required")
+	}
+	if conf.Interface == "" {
+		return nil, fmt.Errorf("interface of the router id is required")
+	}
+	if len(conf.Peers) == 0 {
+		return nil, fmt.Errorf("no peer")
+	}
+	for _, peer := range conf.Peers {
+		if net.ParseIP(peer.Address) == nil {
+			return nil, fmt.Errorf("bad address %q of peer", peer.Address)
+		}
+		if peer.AS == 0 {
+			return nil, fmt.Errorf("as of peer %s is required", peer.Address)
+		}
+	}
+	s := &Speaker{conf: conf, advertised: map[string]*api.Path{}}
+	for _, str := range conf.Prefixes {
+		_, prefix, err := net.ParseCIDR(str)
+		if err != nil || prefix.IP.To4() == nil {
+			return nil, fmt.Errorf("bad prefix %q, expect an ipv4 cidr", str)
+		}
+		s.prefixes = append(s.prefixes, prefix)
+	}
+	return s, nil
+}
+
+// Start starts the speaker of routerID, which is also the next hop of advertised routes, and connects to peers
+func (s *Speaker) Start(routerID net.IP) error {
+	if routerID.To4() == nil {
+		return fmt.Errorf("router id %s is not an ipv4 address", routerID)
+	}
+	s.nextHop = routerID
+	s.server = gobgp.NewBgpServer()
+	go s.server.Serve()
+	// the speaker only connects to peers rather than listening on the bgp port
+	if err := s.server.StartBgp(context.Background(), &api.StartBgpRequest{Global: &api.Global{As: s.conf.AS,
+		RouterId: routerID.String(), ListenPort: -1}}); err != nil {
+		return fmt.Errorf("failed to start bgp speaker: %v", err)
+	}
+	for _, peer := range s.conf.Peers {
+		if err := s.server.AddPeer(context.Background(), &api.AddPeerRequest{Peer: &api.Peer{Conf: &api.PeerConf{
+			NeighborAddress: peer.Address, PeerAs: peer.AS, AuthPassword: peer.Password}}}); err != nil {
+			s.Stop()
+			return fmt.Errorf("failed to add peer %s: %v", peer.Address, err)
+		}
+	}
+	glog.Infof("started bgp speaker of as %d router id %s with %d peers", s.conf.AS, routerID, len(s.conf.Peers))
+	return nil
+}
+
+// Stop stops the speaker, peers withdraw routes of it once sessions are closed
+func (s *Speaker) Stop() {
+	if err := s.server.StopBgp(context.Background(), &api.StopBgpRequest{}); err != nil {
+		glog.Warningf("failed to stop bgp speaker: %v", err)
+	}
+}
+
+// Advertise advertises prefixes and Prefixes of the config, and withdraws those advertised before but not any more.
+// It returns the number of prefixes advertised.
+func (s *Speaker) Advertise(prefixes []*net.IPNet) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	want := map[string]*net.IPNet{}
+	for _, prefix := range append(prefixes, s.prefixes...) {
+		want[prefix.String()] = prefix
+	}
+	var errs []error
+	for key, path := range s.advertised {
+		if _, ok := want[key]; ok {
+			continue
+		}
+		if err := s.server.DeletePath(context.Background(), &api.DeletePathRequest{TableType: api.TableType_GLOBAL,
+			Path: path}); err != nil {
+			errs = append(errs, fmt.Errorf("failed to withdraw %s: %v", key, err))
+			continue
+		}
+		delete(s.advertised, key)
+		glog.Infof("withdrew %s", key)
+	}
+	keys := make([]string, 0, len(want))
+	for key := range want {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, ok := s.advertised[key]; ok {
+			continue
+		}
+		path, err := newPath(want[key], s.nextHop)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := s.server.AddPath(context.Background(), &api.AddPathRequest{TableType: api.TableType_GLOBAL,
+			Path: path}); err != nil {
+			errs = append(errs, fmt.Errorf("failed to advertise %s: %v", key, err))
+			continue
+		}
+		s.advertised[key] = path
+		glog.Infof("advertised %s via %s", key, s.nextHop)
+	}
+	return len(s.advertised), utilerrors.NewAggregate(errs)
+}
+
+// newPath returns the ipv4 unicast path of prefix via nextHop
+func newPath(prefix *net.IPNet, nextHop net.IP) (*api.Path, error) {
+	ones, _ := prefix.Mask.Size()
+	nlri, err := ptypes.MarshalAny(&api.IPAddressPrefix{Prefix: prefix.IP.String(), PrefixLen: uint32(ones)})
+	if err != nil {
+		return nil, err
+	}
+	// origin igp
+	origin, err := ptypes.MarshalAny(&api.OriginAttribute{Origin: 0})
+	if err != nil {
+		return nil, err
+	}
+	nh, err := ptypes.MarshalAny(&api.NextHopAttribute{NextHop: nextHop.String()})
+	if err != nil {
+		return nil, err
+	}
+	return &api.Path{
+		Family: &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST},
+		Nlri:   nlri,
+		Pattrs: []*any.Any{origin, nh},
+	}, nil
+}
@@ -0,0 +1,46 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package bgp
+
+import (
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	peers := []Peer{{Address: "10.0.0.1", AS: 64500}}
+	for i, c := range []struct {
+		conf      Config
+		expectErr bool
+	}{
+		{conf: Config{AS: 64512, Interface: "eth1", Peers: peers, Prefixes: []string{"10.0.70.0/24"}}},
+		{conf: Config{Interface: "eth1", Peers: peers}, expectErr: true},
+		{conf: Config{AS: 64512, Peers: peers}, expectErr: true},
+		{conf: Config{AS: 64512, Interface: "eth1"}, expectErr: true},
+		{conf: Config{AS: 64512, Interface: "eth1", Peers: []Peer{{Address: "router1", AS: 64500}}}, expectErr: true},
+		{conf: Config{AS: 64512, Interface: "eth1", Peers: []Peer{{Address: "10.0.0.1"}}}, expectErr: true},
+		{conf: Config{AS: 64512, Interface: "eth1", Peers: peers, Prefixes: []string{"10.0.70.1"}}, expectErr: true},
+		{conf: Config{AS: 64512, Interface: "eth1", Peers: peers, Prefixes: []string{"fd00::/64"}}, expectErr: true},
+	} {
+		s, err := New(&c.conf)
+		if (err != nil) != c.expectErr {
+			t.Fatalf("case %d: expect error %v, got %v", i, c.expectErr, err)
+		}
+		if err == nil && len(s.prefixes) != len(c.conf.Prefixes) {
+			t.Fatalf("case %d: expect prefixes %v, got %v", i, c.conf.Prefixes, s.prefixes)
+		}
+	}
+}
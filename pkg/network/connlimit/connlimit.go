@@ -0,0 +1,209 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package connlimit caps concurrent connections and the new connection rate of pods by iptables connlimit and
+// hashlimit matches, protecting the shared underlay from pods sending SYN floods.
+package connlimit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+	"tkestack.io/galaxy/pkg/utils/store"
+)
+
+const (
+	// limitChain is jumped to from FORWARD, it jumps to the chain of a pod by its source ip
+	limitChain utiliptables.Chain = "GALAXY-CONNLIMIT"
+	// prefix of pod chains
+	podChainPrefix = "GALAXY-CL-"
+)
+
+// Limit is the value of the connection limit annotation of pods, zero fields are unlimited
+type Limit struct {
+	// MaxConnections caps concurrent connections, i.e. conntrack entries, originated from the pod
+	MaxConnections int `json:"maxConnections,omitempty"`
+	// NewConnectionsPerSecond caps the rate of new connections originated from the pod, Burst defaults to it
+	NewConnectionsPerSecond int `json:"newConnectionsPerSecond,omitempty"`
+	Burst                   int `json:"burst,omitempty"`
+}
+
+// ParseLimit parses the value of the connection limit annotation
+func ParseLimit(v string) (*Limit, error) {
+	limit := &Limit{}
+	if err := json.Unmarshal([]byte(v), limit); err != nil {
+		return nil, err
+	}
+	if limit.MaxConnections < 0 || limit.NewConnectionsPerSecond < 0 || limit.Burst < 0 {
+		return nil, fmt.Errorf("negative limit %+v", limit)
+	}
+	if limit.Burst == 0 {
+		limit.Burst = limit.NewConnectionsPerSecond
+	}
+	return limit, nil
+}
+
+// Empty returns true if l limits nothing
+func (l *Limit) Empty() bool {
+	return l.MaxConnections == 0 && l.NewConnectionsPerSecond == 0
+}
+
+// state is what is set up for a container, it is used to clean up the rules
+type state struct {
+	PodIP string
+	Limit Limit
+	// Tag is the tag of the rules, states without it are of rules commented by the container id
+	Tag string `json:",omitempty"`
+}
+
+// Handler sets up and cleans up connection limits of containers
+type Handler struct {
+	utiliptables.Interface
+	store *store.FileStore
+}
+
+// New creates a Handler which records its state in dir
+func New(dir string) *Handler {
+	return &Handler{Interface: utiliptables.Shared(), store: store.NewFileStore(dir)}
+}
+
+// podChainName returns the chain of the container, hashed to fit the max length of chain names
+func podChainName(containerID string) utiliptables.Chain {
+	hash := sha256.Sum256([]byte(containerID))
+	return utiliptables.Chain(podChainPrefix + base32.StdEncoding.EncodeToString(hash[:])[:16])
+}
+
+// hashlimitName returns the name of the hashlimit table of the container which is at most 15 chars on old kernels
+func hashlimitName(chain utiliptables.Chain) string {
+	return "cl-" + strings.ToLower(strings.TrimPrefix(string(chain), podChainPrefix)[:12])
+}
+
+func jumpArgs() []string {
+	return []string{"-m", "comment", "--comment", "galaxy connection limits", "-j", string(limitChain)}
+}
+
+func podJumpArgs(containerID, podIP string) []string {
+	return []string{"-s", podIP + "/32", "-j", string(podChainName(containerID))}
+}
+
+// legacyPodJumpArgs returns the jump rule of states without tags
+func legacyPodJumpArgs(containerID, podIP string) []string {
+	return append([]string{"-m", "comment", "--comment", containerID}, podJumpArgs(containerID, podIP)...)
+}
+
+// EnsureBasicRule ensures FORWARD jumps to the limit chain
+func (h *Handler) EnsureBasicRule() error {
+	if _, err := h.EnsureChain(utiliptables.TableFilter, limitChain); err != nil {
+		return fmt.Errorf("failed to ensure that %s chain %s exists: %v", utiliptables.TableFilter, limitChain, err)
+	}
+	// limit before any accept rule, e.g. network policies
+	if _, err := h.EnsureRule(utiliptables.Prepend, utiliptables.TableFilter, utiliptables.ChainForward,
+		jumpArgs()...); err != nil {
+		return fmt.Errorf("failed to ensure that %s chain %s jumps to %s: %v", utiliptables.TableFilter,
+			utiliptables.ChainForward, limitChain, err)
+	}
+	return nil
+}
+
+// Setup limits connections originated from podIP of the container of the pod
+func (h *Handler) Setup(containerID, podUID, podIP string, limit *Limit) error {
+	if limit.Empty() {
+		return nil
+	}
+	if err := h.EnsureBasicRule(); err != nil {
+		return err
+	}
+	// record state first so that rules set up partially get cleaned up
+	tag := utiliptables.RuleTag(podUID, containerID, "connlimit")
+	data, err := json.Marshal(&state{PodIP: podIP, Limit: *limit, Tag: tag})
+	if err != nil {
+		return err
+	}
+	if err := h.store.Put(containerID, data); err != nil {
+		return fmt.Errorf("failed to save connection limit state of %s: %v", containerID, err)
+	}
+	chain := podChainName(containerID)
+	chains := bytes.NewBuffer(nil)
+	rules := bytes.NewBuffer(nil)
+	utiliptables.WriteLine(chains, "*filter")
+	utiliptables.WriteLine(chains, utiliptables.MakeChainLine(chain))
+	if limit.MaxConnections > 0 {
+		utiliptables.WriteLine(rules, "-A", string(chain), "-m", "comment", "--comment", tag, "-m", "conntrack",
+			"--ctstate", "NEW", "-m", "connlimit", "--connlimit-above", strconv.Itoa(limit.MaxConnections),
+			"--connlimit-mask", "32", "--connlimit-saddr", "-j", "DROP")
+	}
+	if limit.NewConnectionsPerSecond > 0 {
+		utiliptables.WriteLine(rules, "-A", string(chain), "-m", "comment", "--comment", tag, "-m", "conntrack",
+			"--ctstate", "NEW", "-m", "hashlimit", "--hashlimit-above",
+			fmt.Sprintf("%d/sec", limit.NewConnectionsPerSecond), "--hashlimit-burst", strconv.Itoa(limit.Burst),
+			"--hashlimit-mode", "srcip", "--hashlimit-name", hashlimitName(chain), "-j", "DROP")
+	}
+	utiliptables.WriteLine(rules, "COMMIT")
+	lines := append(chains.Bytes(), rules.Bytes()...)
+	if err := h.RestoreAll(lines, utiliptables.NoFlushTables, utiliptables.RestoreCounters); err != nil {
+		return fmt.Errorf("failed to execute iptables-restore for rules %s: %v", string(lines), err)
+	}
+	if err := utiliptables.ReplaceTagged(h, utiliptables.TableFilter, limitChain, tag,
+		[][]string{podJumpArgs(containerID, podIP)}); err != nil {
+		return fmt.Errorf("failed to add rule of %s: %v", containerID, err)
+	}
+	return nil
+}
+
+// Cleanup removes connection limits of the container, it does nothing if the container has none
+func (h *Handler) Cleanup(containerID string) error {
+	data, err := h.store.Get(containerID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read connection limit state of %s: %v", containerID, err)
+	}
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("bad connection limit state of %s: %v", containerID, err)
+	}
+	if s.Tag != "" {
+		err = utiliptables.DeleteTagged(h, utiliptables.TableFilter, limitChain, s.Tag)
+	} else {
+		err = h.DeleteRule(utiliptables.TableFilter, limitChain, legacyPodJumpArgs(containerID, s.PodIP)...)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete rule of %s: %v", containerID, err)
+	}
+	chain := podChainName(containerID)
+	chains := bytes.NewBuffer(nil)
+	rules := bytes.NewBuffer(nil)
+	utiliptables.WriteLine(chains, "*filter")
+	utiliptables.WriteLine(chains, utiliptables.MakeChainLine(chain))
+	utiliptables.WriteLine(rules, "-X", string(chain))
+	utiliptables.WriteLine(rules, "COMMIT")
+	lines := append(chains.Bytes(), rules.Bytes()...)
+	if err := h.RestoreAll(lines, utiliptables.NoFlushTables, utiliptables.RestoreCounters); err != nil {
+		return fmt.Errorf("failed to execute iptables-restore for rules %s: %v", string(lines), err)
+	}
+	if err := h.store.Delete(containerID); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package connlimit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+	iptablesTest "tkestack.io/galaxy/pkg/utils/iptables/testing"
+	"tkestack.io/galaxy/pkg/utils/store"
+)
+
+func TestParseLimit(t *testing.T) {
+	limit, err := ParseLimit(`{"maxConnections": 1000, "newConnectionsPerSecond": 100}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *limit != (Limit{MaxConnections: 1000, NewConnectionsPerSecond: 100, Burst: 100}) {
+		t.Fatalf("unexpected limit %+v", limit)
+	}
+	if _, err := ParseLimit(`{"maxConnections": -1}`); err == nil {
+		t.Fatal("expect error of negative limit")
+	}
+}
+
+// #lizard forgives
+func TestSetupCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "connlimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	fakeCli := iptablesTest.NewFakeIPTables()
+	h := &Handler{Interface: fakeCli, store: store.NewFileStore(dir)}
+	if err := h.Setup("c1", "uid1", "10.0.0.2", &Limit{MaxConnections: 1000, NewConnectionsPerSecond: 100,
+		Burst: 200}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Setup("c2", "uid2", "10.0.0.3", &Limit{}); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := fakeCli.SaveInto(utiliptables.TableFilter, buf); err != nil {
+		t.Fatal(err)
+	}
+	chain := string(podChainName("c1"))
+	expect := `*filter
+:FORWARD - [0:0]
+:` + chain + ` - [0:0]
+:GALAXY-CONNLIMIT - [0:0]
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+-A FORWARD -m comment --comment "galaxy connection limits" -j GALAXY-CONNLIMIT
+-A ` + chain + ` -m comment --comment galaxy/v1/uid1/c1/connlimit -m conntrack --ctstate NEW -m connlimit ` +
+		`--connlimit-above 1000 --connlimit-mask 32 --connlimit-saddr -j DROP
+-A ` + chain + ` -m comment --comment galaxy/v1/uid1/c1/connlimit -m conntrack --ctstate NEW -m hashlimit ` +
+		`--hashlimit-above 100/sec --hashlimit-burst 200 --hashlimit-mode srcip --hashlimit-name ` +
+		hashlimitName(podChainName("c1")) + ` -j DROP
+-A GALAXY-CONNLIMIT -m comment --comment galaxy/v1/uid1/c1/connlimit -s 10.0.0.2/32 -j ` + chain + `
+COMMIT
+`
+	if buf.String() != expect {
+		t.Fatalf("expect %s, real %s", expect, buf.String())
+	}
+	if len(hashlimitName(podChainName("c1"))) > 15 {
+		t.Fatalf("hashlimit name %s is too long", hashlimitName(podChainName("c1")))
+	}
+	for _, cid := range []string{"c1", "c2"} {
+		if err := h.Cleanup(cid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.Reset()
+	if err := fakeCli.SaveInto(utiliptables.TableFilter, buf); err != nil {
+		t.Fatal(err)
+	}
+	expect = `*filter
+:FORWARD - [0:0]
+:GALAXY-CONNLIMIT - [0:0]
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+-A FORWARD -m comment --comment "galaxy connection limits" -j GALAXY-CONNLIMIT
+COMMIT
+`
+	if buf.String() != expect {
+		t.Fatalf("expect %s, real %s", expect, buf.String())
+	}
+	if keys, err := h.store.Keys(); err != nil || len(keys) != 0 {
+		t.Fatalf("expect no state left, real %v, err %v", keys, err)
+	}
+}
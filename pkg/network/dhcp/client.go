@@ -0,0 +1,290 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package dhcp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"tkestack.io/galaxy/pkg/utils/nets"
+)
+
+const (
+	// exchangeTimeout is how long to wait for a reply before sending a message again
+	exchangeTimeout = 4 * time.Second
+	// exchangeAttempts is how many times a message is sent before giving up
+	exchangeAttempts = 3
+)
+
+var (
+	broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	broadcastIP  = net.IPv4bcast.To4()
+	zeroIP       = net.IPv4zero.To4()
+)
+
+// Request is what a lease is acquired for
+type Request struct {
+	// Device is where the exchange runs, i.e. the device of the vlan of the pod
+	Device string
+	Vlan   uint16
+	// ClientID identifies the lease to servers
+	ClientID string
+	Hostname string
+}
+
+// Lease is a dhcp lease acquired on behalf of a pod
+type Lease struct {
+	Request
+	// MAC is the client hardware address of the exchange, it is derived from ClientID
+	MAC      string
+	IP       *nets.IPNet
+	Gateway  net.IP
+	ServerID net.IP
+	// Obtained is when the lease was acked the last time
+	Obtained time.Time
+	Duration time.Duration
+	// T1 and T2 are the renewal time and the rebinding time since Obtained
+	T1 time.Duration
+	T2 time.Duration
+}
+
+// Expired returns true if the lease expired at now
+func (l *Lease) Expired(now time.Time) bool {
+	return !now.Before(l.Obtained.Add(l.Duration))
+}
+
+// String returns the ip and client id of the lease
+func (l *Lease) String() string {
+	return fmt.Sprintf("%s of %s", l.IP, l.ClientID)
+}
+
+// clientMAC returns a locally administered unicast mac derived from clientID, so that the same client always uses
+// the same mac
+func clientMAC(clientID string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(clientID))
+	return net.HardwareAddr{0x02, sum[0], sum[1], sum[2], sum[3], sum[4]}
+}
+
+// newXID returns a random transaction id
+func newXID() uint32 {
+	var b [4]byte
+	rand.Read(b[:]) // nolint: errcheck
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func newMessage(t byte, xid uint32, r *Request) *message {
+	m := &message{op: opRequest, xid: xid, flags: flagBroadcast, chaddr: clientMAC(r.ClientID),
+		options: map[byte][]byte{
+			optMessageType: {t},
+			// type 0 is a client id which is not a hardware address
+			optClientID: append([]byte{0}, r.ClientID...),
+			optParams:   {optSubnetMask, optRouter, optLeaseTime, optServerID, optRenewalTime, optRebindTime},
+		}}
+	if r.Hostname != "" && t != msgRelease {
+		m.options[optHostname] = []byte(r.Hostname)
+	}
+	return m
+}
+
+// acquire acquires a lease by discovering servers and requesting the offered ip
+func acquire(r *Request) (*Lease, error) {
+	c, err := dial(r.Device)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+	xid := newXID()
+	offer, err := c.exchange(newMessage(msgDiscover, xid, r), zeroIP, broadcastIP, msgOffer)
+	if err != nil {
+		return nil, fmt.Errorf("no offer of %s on %s: %v", r.ClientID, r.Device, err)
+	}
+	request := newMessage(msgRequest, xid, r)
+	request.options[optRequestedIP] = offer.yiaddr.To4()
+	if serverID := offer.ip(optServerID); serverID != nil {
+		request.options[optServerID] = serverID
+	}
+	ack, err := c.exchange(request, zeroIP, broadcastIP, msgAck)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request %s of %s on %s: %v", offer.yiaddr, r.ClientID, r.Device, err)
+	}
+	return newLease(r, ack)
+}
+
+// renew extends lease by a request of its ip. It is broadcast as the host has no route to servers on behalf of the
+// pod, servers reply no matter whether they granted the lease.
+func renew(lease *Lease) (*Lease, error) {
+	c, err := dial(lease.Device)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+	request := newMessage(msgRequest, newXID(), &lease.Request)
+	request.ciaddr = lease.IP.IP.To4()
+	ack, err := c.exchange(request, request.ciaddr, broadcastIP, msgAck)
+	if err != nil {
+		return nil, fmt.Errorf("failed to renew %s: %v", lease, err)
+	}
+	if !ack.yiaddr.Equal(request.ciaddr) {
+		return nil, fmt.Errorf("failed to renew %s: server acked %s instead", lease, ack.yiaddr)
+	}
+	return newLease(&lease.Request, ack)
+}
+
+// release releases lease to its server, servers don't reply releases
+func release(lease *Lease) error {
+	c, err := dial(lease.Device)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	m := newMessage(msgRelease, newXID(), &lease.Request)
+	m.flags = 0
+	m.ciaddr = lease.IP.IP.To4()
+	dst := broadcastIP
+	if lease.ServerID != nil {
+		m.options[optServerID] = lease.ServerID.To4()
+		dst = lease.ServerID.To4()
+	}
+	return c.send(m, m.ciaddr, dst)
+}
+
+func newLease(r *Request, ack *message) (*Lease, error) {
+	mask := ack.ip(optSubnetMask)
+	if mask == nil {
+		return nil, fmt.Errorf("ack of %s has no subnet mask", ack.yiaddr)
+	}
+	gateway := ack.ip(optRouter)
+	if gateway == nil {
+		return nil, fmt.Errorf("ack of %s has no router", ack.yiaddr)
+	}
+	duration := time.Duration(ack.uint32(optLeaseTime)) * time.Second
+	if duration == 0 {
+		return nil, fmt.Errorf("ack of %s has no lease time", ack.yiaddr)
+	}
+	lease := &Lease{Request: *r, MAC: ack.chaddr.String(), IP: &nets.IPNet{IP: ack.yiaddr.To4(),
+		Mask: net.IPMask(mask)}, Gateway: gateway, ServerID: ack.ip(optServerID), Obtained: time.Now(),
+		Duration: duration, T1: time.Duration(ack.uint32(optRenewalTime)) * time.Second,
+		T2: time.Duration(ack.uint32(optRebindTime)) * time.Second}
+	// defaults of RFC 2131
+	if lease.T1 == 0 || lease.T1 >= duration {
+		lease.T1 = duration / 2
+	}
+	if lease.T2 == 0 || lease.T2 >= duration {
+		lease.T2 = duration * 7 / 8
+	}
+	return lease, nil
+}
+
+// conn sends and receives ethernet frames of dhcp on a device
+type conn struct {
+	fd      int
+	ifindex int
+}
+
+func dial(device string) (*conn, error) {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return nil, err
+	}
+	// replies to macs of pods are received too, which ETH_P_IP sockets of bridge ports don't see
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{fd: fd, ifindex: iface.Index}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: iface.Index}); err != nil {
+		c.close()
+		return nil, err
+	}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO,
+		&unix.Timeval{Usec: 200 * 1000}); err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *conn) close() {
+	unix.Close(c.fd) // nolint: errcheck
+}
+
+func (c *conn) send(m *message, src, dst net.IP) error {
+	frame := udpFrame(m.chaddr, broadcastMAC, src, dst, clientPort, serverPort, m.marshal())
+	sa := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_IP), Ifindex: c.ifindex, Halen: 6}
+	copy(sa.Addr[:], broadcastMAC)
+	return unix.Sendto(c.fd, frame, 0, sa)
+}
+
+// exchange sends m until a reply of the expected type or a nak arrives
+func (c *conn) exchange(m *message, src, dst net.IP, expect byte) (*message, error) {
+	for attempt := 0; attempt < exchangeAttempts; attempt++ {
+		if err := c.send(m, src, dst); err != nil {
+			return nil, err
+		}
+		reply, err := c.receive(m.xid, m.chaddr, time.Now().Add(exchangeTimeout<<uint(attempt)))
+		if err != nil {
+			return nil, err
+		}
+		if reply == nil {
+			continue
+		}
+		switch reply.messageType() {
+		case expect:
+			return reply, nil
+		case msgNak:
+			return nil, fmt.Errorf("nak from %s", reply.ip(optServerID))
+		}
+	}
+	return nil, fmt.Errorf("timeout")
+}
+
+// receive returns the reply of xid to chaddr, or nil if there is none before deadline
+func (c *conn) receive(xid uint32, chaddr net.HardwareAddr, deadline time.Time) (*message, error) {
+	buf := make([]byte, 1518)
+	for time.Now().Before(deadline) {
+		n, from, err := unix.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			return nil, err
+		}
+		if sa, ok := from.(*unix.SockaddrLinklayer); ok && sa.Pkttype == unix.PACKET_OUTGOING {
+			continue
+		}
+		payload, ok := parseUDPFrame(buf[:n], clientPort)
+		if !ok {
+			continue
+		}
+		// other nodes may exchange on behalf of their pods on the same segment
+		m, err := parseMessage(payload)
+		if err != nil || m.op != opReply || m.xid != xid || m.chaddr.String() != chaddr.String() {
+			continue
+		}
+		return m, nil
+	}
+	return nil, nil
+}
+
+func htons(i uint16) uint16 {
+	return (i<<8)&0xff00 | i>>8
+}
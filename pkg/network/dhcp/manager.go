@@ -0,0 +1,256 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package dhcp acquires ips of pods from dhcp servers of their segments, e.g. segments managed by existing dhcp
+// servers. Galaxy runs the exchange on behalf of pods on their vlan devices before setting up them, and renews leases
+// in the background as long as the pods live.
+package dhcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/metrics"
+	"tkestack.io/galaxy/pkg/utils/store"
+)
+
+// IPAMType is the ipam type of networks whose pods get ips by dhcp, galaxy handles it instead of an ipam plugin
+const IPAMType = "galaxy-dhcp"
+
+// renewCheckInterval is how often leases are checked for renewal, failed renewals are retried at the next check
+const renewCheckInterval = 30 * time.Second
+
+var (
+	leaseCount    = metrics.NewGaugeVec("galaxy_dhcp_leases", "Number of dhcp leases of pods")
+	renewFailures = metrics.NewCounterVec("galaxy_dhcp_renew_failures_total", "Number of failed renewals of dhcp "+
+		"leases of pods")
+)
+
+// Conf is the ipam config of networks of IPAMType
+type Conf struct {
+	Type string `json:"type"`
+	// Vlan is the vlan of the segment of dhcp servers, pods of the network are of the vlan
+	Vlan uint16 `json:"vlan,omitempty"`
+}
+
+// Manager keeps dhcp leases of containers and renews them
+type Manager struct {
+	store *store.FileStore
+	lock  sync.Mutex
+	// leases are keyed by container ids
+	leases map[string][]*Lease
+	now    func() time.Time
+	// acquire, renew and release exchange with servers, they are replaceable by tests
+	acquire func(*Request) (*Lease, error)
+	renew   func(*Lease) (*Lease, error)
+	release func(*Lease) error
+}
+
+// NewManager returns a Manager persisting leases in dir, one file per container
+func NewManager(dir string) *Manager {
+	return &Manager{store: store.NewFileStore(dir), leases: map[string][]*Lease{}, now: time.Now, acquire: acquire,
+		renew: renew, release: release}
+}
+
+// Restore loads leases persisted by the previous run of galaxy
+func (m *Manager) Restore() error {
+	keys, err := m.store.Keys()
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, containerID := range keys {
+		data, err := m.store.Get(containerID)
+		if err != nil {
+			return err
+		}
+		var leases []*Lease
+		if err := json.Unmarshal(data, &leases); err != nil {
+			glog.Warningf("bad dhcp leases of %s: %v", containerID, err)
+			continue
+		}
+		m.leases[containerID] = leases
+	}
+	m.updateCount()
+	return nil
+}
+
+// Acquire acquires a lease of r for the container. A lease of the same client id the container acquired before,
+// e.g. by a retried ADD, is returned if it doesn't expire.
+func (m *Manager) Acquire(containerID string, r *Request) (*Lease, error) {
+	m.lock.Lock()
+	for _, lease := range m.leases[containerID] {
+		if lease.ClientID == r.ClientID && !lease.Expired(m.now()) {
+			m.lock.Unlock()
+			return lease, nil
+		}
+	}
+	m.lock.Unlock()
+	lease, err := m.acquire(r)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var leases []*Lease
+	for _, l := range m.leases[containerID] {
+		if l.ClientID != r.ClientID {
+			leases = append(leases, l)
+		}
+	}
+	if err := m.save(containerID, append(leases, lease)); err != nil {
+		return nil, err
+	}
+	glog.Infof("acquired dhcp lease %s of %s from %s for %v", lease, containerID, lease.ServerID, lease.Duration)
+	return lease, nil
+}
+
+// Release releases leases of the container. Leases of client ids other containers hold too, e.g. a new sandbox of
+// the same pod, are forgotten without releasing them to servers.
+func (m *Manager) Release(containerID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	leases := m.leases[containerID]
+	if len(leases) == 0 {
+		return nil
+	}
+	held := map[string]bool{}
+	for id, others := range m.leases {
+		if id == containerID {
+			continue
+		}
+		for _, lease := range others {
+			held[lease.ClientID] = true
+		}
+	}
+	for _, lease := range leases {
+		if held[lease.ClientID] || lease.Expired(m.now()) {
+			continue
+		}
+		// servers reclaim leases which are not released once they expire anyway
+		if err := m.release(lease); err != nil {
+			glog.Warningf("failed to release dhcp lease %s: %v", lease, err)
+			continue
+		}
+		glog.Infof("released dhcp lease %s of %s", lease, containerID)
+	}
+	return m.save(containerID, nil)
+}
+
+// Leases returns leases of the container
+func (m *Manager) Leases(containerID string) []*Lease {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]*Lease{}, m.leases[containerID]...)
+}
+
+// Containers returns containers having leases
+func (m *Manager) Containers() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var containers []string
+	for containerID := range m.leases {
+		containers = append(containers, containerID)
+	}
+	return containers
+}
+
+// Run renews leases which reach their renewal time until quit is closed
+func (m *Manager) Run(quit <-chan struct{}) {
+	go wait.Until(m.renewLeases, renewCheckInterval, quit)
+}
+
+func (m *Manager) renewLeases() {
+	type due struct {
+		containerID string
+		lease       *Lease
+	}
+	var dues []due
+	m.lock.Lock()
+	now := m.now()
+	for containerID, leases := range m.leases {
+		for _, lease := range leases {
+			if !now.Before(lease.Obtained.Add(lease.T1)) {
+				dues = append(dues, due{containerID: containerID, lease: lease})
+			}
+		}
+	}
+	m.lock.Unlock()
+	// exchanges run without the lock so that ADDs are not blocked by unresponsive servers
+	for _, d := range dues {
+		renewed, err := m.renew(d.lease)
+		if err != nil {
+			renewFailures.WithLabelValues().Inc()
+			if d.lease.Expired(m.now()) {
+				glog.Errorf("dhcp lease %s of %s expired, the pod keeps using the ip: %v", d.lease, d.containerID,
+					err)
+			} else {
+				glog.Warningf("%v, retrying in %v", err, renewCheckInterval)
+			}
+			continue
+		}
+		m.lock.Lock()
+		leases := append([]*Lease{}, m.leases[d.containerID]...)
+		for i := range leases {
+			// the container may be deleted during the exchange
+			if leases[i] == d.lease {
+				leases[i] = renewed
+				if err := m.save(d.containerID, leases); err != nil {
+					glog.Warningf("failed to save dhcp lease %s: %v", renewed, err)
+				}
+				glog.V(2).Infof("renewed dhcp lease %s of %s for %v", renewed, d.containerID, renewed.Duration)
+				break
+			}
+		}
+		m.lock.Unlock()
+	}
+}
+
+// save persists leases of the container, it removes the container if leases are empty. The lock must be held.
+func (m *Manager) save(containerID string, leases []*Lease) error {
+	if len(leases) == 0 {
+		if err := m.store.Delete(containerID); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove dhcp leases of %s: %v", containerID, err)
+		}
+		delete(m.leases, containerID)
+		m.updateCount()
+		return nil
+	}
+	data, err := json.Marshal(leases)
+	if err != nil {
+		return err
+	}
+	if err := m.store.Put(containerID, data); err != nil {
+		return fmt.Errorf("failed to save dhcp leases of %s: %v", containerID, err)
+	}
+	m.leases[containerID] = leases
+	m.updateCount()
+	return nil
+}
+
+func (m *Manager) updateCount() {
+	var n int
+	for _, leases := range m.leases {
+		n += len(leases)
+	}
+	leaseCount.WithLabelValues().Set(float64(n))
+}
@@ -0,0 +1,124 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package dhcp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"tkestack.io/galaxy/pkg/utils/nets"
+)
+
+type fakeServer struct {
+	now      time.Time
+	next     byte
+	released []string
+	renewErr error
+}
+
+func (s *fakeServer) acquire(r *Request) (*Lease, error) {
+	s.next++
+	return &Lease{Request: *r, IP: &nets.IPNet{IP: net.IPv4(192, 168, 0, s.next), Mask: net.CIDRMask(24, 32)},
+		Gateway: net.IPv4(192, 168, 0, 254), Obtained: s.now, Duration: time.Hour, T1: 30 * time.Minute,
+		T2: 50 * time.Minute}, nil
+}
+
+func (s *fakeServer) renew(lease *Lease) (*Lease, error) {
+	if s.renewErr != nil {
+		return nil, s.renewErr
+	}
+	renewed := *lease
+	renewed.Obtained = s.now
+	return &renewed, nil
+}
+
+func (s *fakeServer) release(lease *Lease) error {
+	s.released = append(s.released, lease.IP.String())
+	return nil
+}
+
+func newTestManager(dir string, s *fakeServer) *Manager {
+	m := NewManager(dir)
+	m.now = func() time.Time { return s.now }
+	m.acquire, m.renew, m.release = s.acquire, s.renew, s.release
+	return m
+}
+
+// #lizard forgives
+func TestManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dhcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	s := &fakeServer{now: time.Now()}
+	m := newTestManager(dir, s)
+	r := &Request{Device: "eth1.2", Vlan: 2, ClientID: "default/pod-1/galaxy-k8s-vlan"}
+	lease, err := m.Acquire("c1", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a retried ADD gets the same lease
+	if again, err := m.Acquire("c1", r); err != nil || again != lease {
+		t.Fatalf("expect lease %s, real %v %v", lease, again, err)
+	}
+	// a new sandbox of the same pod
+	if _, err := m.Acquire("c2", r); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestManager(dir, s)
+	if err := restored.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if leases := restored.Leases("c1"); len(leases) != 1 || leases[0].IP.String() != lease.IP.String() {
+		t.Fatalf("expect restored lease %s, real %v", lease, leases)
+	}
+
+	s.now = s.now.Add(40 * time.Minute)
+	m.renewLeases()
+	if leases := m.Leases("c1"); len(leases) != 1 || !leases[0].Obtained.Equal(s.now) {
+		t.Fatalf("expect renewed lease, real %v", leases)
+	}
+	s.renewErr = fmt.Errorf("no ack")
+	s.now = s.now.Add(40 * time.Minute)
+	m.renewLeases()
+	if leases := m.Leases("c1"); len(leases) != 1 || leases[0].Obtained.Equal(s.now) {
+		t.Fatalf("expect lease not renewed, real %v", leases)
+	}
+
+	// the client id is still held by c2
+	if err := m.Release("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.released) != 0 || len(m.Leases("c1")) != 0 {
+		t.Fatalf("expect c1 forgotten without releasing, real released %v", s.released)
+	}
+	if err := m.Release("c2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.released) != 1 {
+		t.Fatalf("expect one lease released, real %v", s.released)
+	}
+	if keys, err := m.store.Keys(); err != nil || len(keys) != 0 {
+		t.Fatalf("expect no leases persisted, real %v %v", keys, err)
+	}
+}
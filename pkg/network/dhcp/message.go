@@ -0,0 +1,212 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package dhcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	opRequest = 1
+	opReply   = 2
+
+	msgDiscover = 1
+	msgOffer    = 2
+	msgRequest  = 3
+	msgAck      = 5
+	msgNak      = 6
+	msgRelease  = 7
+
+	optPad         = 0
+	optSubnetMask  = 1
+	optRouter      = 3
+	optHostname    = 12
+	optRequestedIP = 50
+	optLeaseTime   = 51
+	optMessageType = 53
+	optServerID    = 54
+	optParams      = 55
+	optRenewalTime = 58
+	optRebindTime  = 59
+	optClientID    = 61
+	optEnd         = 255
+
+	// flagBroadcast asks servers to broadcast replies, as the client has no ip and the host sending on behalf of
+	// the pod doesn't own the address offered
+	flagBroadcast = 0x8000
+
+	serverPort = 67
+	clientPort = 68
+
+	// headerLen is the length of the bootp header before the magic cookie
+	headerLen = 236
+)
+
+var magicCookie = []byte{99, 130, 83, 99}
+
+// message is a dhcp message
+type message struct {
+	op      byte
+	xid     uint32
+	flags   uint16
+	ciaddr  net.IP
+	yiaddr  net.IP
+	chaddr  net.HardwareAddr
+	options map[byte][]byte
+}
+
+func (m *message) messageType() byte {
+	if t := m.options[optMessageType]; len(t) == 1 {
+		return t[0]
+	}
+	return 0
+}
+
+func (m *message) ip(opt byte) net.IP {
+	if v := m.options[opt]; len(v) >= 4 {
+		return net.IP(v[:4])
+	}
+	return nil
+}
+
+func (m *message) uint32(opt byte) uint32 {
+	if v := m.options[opt]; len(v) == 4 {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (m *message) marshal() []byte {
+	data := make([]byte, headerLen, headerLen+64)
+	data[0] = m.op
+	// ethernet, 6 bytes of hardware address
+	data[1] = 1
+	data[2] = 6
+	binary.BigEndian.PutUint32(data[4:8], m.xid)
+	binary.BigEndian.PutUint16(data[10:12], m.flags)
+	if m.ciaddr != nil {
+		copy(data[12:16], m.ciaddr.To4())
+	}
+	if m.yiaddr != nil {
+		copy(data[16:20], m.yiaddr.To4())
+	}
+	copy(data[28:34], m.chaddr)
+	data = append(data, magicCookie...)
+	// the message type goes first as some servers expect
+	data = append(data, optMessageType, 1, m.messageType())
+	for opt := 1; opt < optEnd; opt++ {
+		value, ok := m.options[byte(opt)]
+		if !ok || opt == optMessageType {
+			continue
+		}
+		data = append(data, byte(opt), byte(len(value)))
+		data = append(data, value...)
+	}
+	return append(data, optEnd)
+}
+
+// #lizard forgives
+func parseMessage(data []byte) (*message, error) {
+	if len(data) < headerLen+len(magicCookie) || string(data[headerLen:headerLen+4]) != string(magicCookie) {
+		return nil, fmt.Errorf("not a dhcp message")
+	}
+	m := &message{
+		op:      data[0],
+		xid:     binary.BigEndian.Uint32(data[4:8]),
+		flags:   binary.BigEndian.Uint16(data[10:12]),
+		ciaddr:  net.IP(append([]byte{}, data[12:16]...)),
+		yiaddr:  net.IP(append([]byte{}, data[16:20]...)),
+		chaddr:  net.HardwareAddr(append([]byte{}, data[28:34]...)),
+		options: map[byte][]byte{},
+	}
+	opts := data[headerLen+4:]
+	for len(opts) > 0 {
+		opt := opts[0]
+		if opt == optEnd {
+			break
+		}
+		if opt == optPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("truncated option %d", opt)
+		}
+		// repeated options are concatenated as RFC 3396
+		m.options[opt] = append(m.options[opt], opts[2:2+int(opts[1])]...)
+		opts = opts[2+int(opts[1]):]
+	}
+	return m, nil
+}
+
+// udpFrame returns an ethernet frame of an ipv4 udp packet carrying payload
+func udpFrame(srcMAC, dstMAC net.HardwareAddr, src, dst net.IP, srcPort, dstPort uint16, payload []byte) []byte {
+	frame := make([]byte, 14+20+8+len(payload))
+	copy(frame[0:6], dstMAC)
+	copy(frame[6:12], srcMAC)
+	binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+	ip := frame[14:34]
+	// version 4, 5 words of header
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+8+len(payload)))
+	ip[8] = 64
+	ip[9] = 17
+	copy(ip[12:16], src.To4())
+	copy(ip[16:20], dst.To4())
+	binary.BigEndian.PutUint16(ip[10:12], checksum(ip))
+	udp := frame[34:42]
+	binary.BigEndian.PutUint16(udp[0:2], srcPort)
+	binary.BigEndian.PutUint16(udp[2:4], dstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(payload)))
+	// the udp checksum of ipv4 is optional
+	copy(frame[42:], payload)
+	return frame
+}
+
+// parseUDPFrame returns the payload of an ethernet frame of an ipv4 udp packet to dstPort
+func parseUDPFrame(frame []byte, dstPort uint16) ([]byte, bool) {
+	if len(frame) < 14+20+8 || binary.BigEndian.Uint16(frame[12:14]) != 0x0800 {
+		return nil, false
+	}
+	ip := frame[14:]
+	ihl := int(ip[0]&0x0f) * 4
+	if ip[0]>>4 != 4 || ip[9] != 17 || ihl < 20 || len(ip) < ihl+8 {
+		return nil, false
+	}
+	udp := ip[ihl:]
+	if binary.BigEndian.Uint16(udp[2:4]) != dstPort {
+		return nil, false
+	}
+	length := int(binary.BigEndian.Uint16(udp[4:6]))
+	if length < 8 || length > len(udp) {
+		return nil, false
+	}
+	return udp[8:length], true
+}
+
+func checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,90 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package dhcp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMessage(t *testing.T) {
+	r := &Request{Device: "eth1.2", Vlan: 2, ClientID: "default/pod-1/galaxy-k8s-vlan", Hostname: "pod-1"}
+	m := newMessage(msgRequest, 0x12345678, r)
+	m.options[optRequestedIP] = net.ParseIP("192.168.0.68").To4()
+	parsed, err := parseMessage(m.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.op != opRequest || parsed.xid != 0x12345678 || parsed.flags != flagBroadcast {
+		t.Fatalf("bad header %d %x %x", parsed.op, parsed.xid, parsed.flags)
+	}
+	if parsed.chaddr.String() != clientMAC(r.ClientID).String() {
+		t.Fatalf("expect chaddr %s, real %s", clientMAC(r.ClientID), parsed.chaddr)
+	}
+	if parsed.messageType() != msgRequest {
+		t.Fatalf("expect message type %d, real %d", msgRequest, parsed.messageType())
+	}
+	if ip := parsed.ip(optRequestedIP); !ip.Equal(net.ParseIP("192.168.0.68")) {
+		t.Fatalf("expect requested ip 192.168.0.68, real %v", ip)
+	}
+	if hostname := string(parsed.options[optHostname]); hostname != r.Hostname {
+		t.Fatalf("expect hostname %s, real %s", r.Hostname, hostname)
+	}
+	if _, err := parseMessage(m.marshal()[:headerLen]); err == nil {
+		t.Fatal("expect an error of a message without magic cookie")
+	}
+}
+
+func TestUDPFrame(t *testing.T) {
+	payload := []byte("payload")
+	frame := udpFrame(clientMAC("a"), broadcastMAC, zeroIP, broadcastIP, clientPort, serverPort, payload)
+	if checksum(frame[14:34]) != 0 {
+		t.Fatal("bad ip header checksum")
+	}
+	data, ok := parseUDPFrame(frame, serverPort)
+	if !ok || !bytes.Equal(data, payload) {
+		t.Fatalf("expect payload %q, real %q %v", payload, data, ok)
+	}
+	if _, ok := parseUDPFrame(frame, clientPort); ok {
+		t.Fatal("expect no payload of another port")
+	}
+}
+
+func TestNewLease(t *testing.T) {
+	ack := &message{op: opReply, yiaddr: net.ParseIP("192.168.0.68"), chaddr: clientMAC("a"), options: map[byte][]byte{
+		optMessageType: {msgAck},
+		optSubnetMask:  {255, 255, 255, 192},
+		optRouter:      {192, 168, 0, 65},
+		optLeaseTime:   {0, 0, 0x0e, 0x10},
+	}}
+	lease, err := newLease(&Request{ClientID: "a"}, ack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.IP.String() != "192.168.0.68/26" || !lease.Gateway.Equal(net.ParseIP("192.168.0.65")) {
+		t.Fatalf("bad lease %s gateway %s", lease.IP, lease.Gateway)
+	}
+	if lease.Duration != time.Hour || lease.T1 != 30*time.Minute || lease.T2 != 52*time.Minute+30*time.Second {
+		t.Fatalf("bad lease times %v %v %v", lease.Duration, lease.T1, lease.T2)
+	}
+	delete(ack.options, optRouter)
+	if _, err := newLease(&Request{ClientID: "a"}, ack); err == nil {
+		t.Fatal("expect an error of an ack without router")
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package ebtables restores ebtables rules of nodes. Rules files are in the format of ebtables-save, or nft scripts of
+// the bridge family on hosts without ebtables, and are go templates of Facts so that one file is shared by nodes of
+// different uplinks, pod cidrs and bridges.
+package ebtables
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"text/template"
+)
+
+// Facts are node facts which rules templates refer to, e.g. `-i {{.Uplink}}` or `{{range .Bridges}}...{{end}}`
+type Facts struct {
+	// Uplink is the interface of the default route
+	Uplink string
+	// PodCIDR is the pod cidr of the node, empty if the node has none
+	PodCIDR string
+	// Bridges are names of bridges on the node in order
+	Bridges []string
+}
+
+// Render renders the rules template of path with facts, templates referring to unknown facts fail to render
+func Render(path string, facts *Facts) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(path)).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("bad ebtables rules template %s: %v", path, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, facts); err != nil {
+		return nil, fmt.Errorf("failed to render ebtables rules %s: %v", path, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Restore renders the rules template of path and restores it by ebtables-restore, which replaces tables of the file
+func Restore(path string, facts *Facts) error {
+	rules, err := Render(path, facts)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("ebtables-restore")
+	cmd.Stdin = bytes.NewReader(rules)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to restore ebtables rules %s: %v, %s", path, err, string(out))
+	}
+	return nil
+}
+
+// RestoreNft renders the rules template of path, an nft script, and applies it by nft atomically. Unlike
+// ebtables-restore, nft doesn't replace tables by itself, scripts should delete their tables before declaring them,
+// e.g. `table bridge filter`, `delete table bridge filter` and `table bridge filter { ... }`.
+func RestoreNft(path string, facts *Facts) error {
+	rules, err := Render(path, facts)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = bytes.NewReader(rules)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to restore nft rules %s: %v, %s", path, err, string(out))
+	}
+	return nil
+}
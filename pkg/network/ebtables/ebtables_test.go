@@ -0,0 +1,68 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package ebtables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ebtables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	facts := &Facts{Uplink: "eth1", PodCIDR: "10.0.1.0/24", Bridges: []string{"docker", "docker2"}}
+	for i, c := range []struct {
+		rules  string
+		expect string
+		fail   bool
+	}{
+		{rules: "*filter\n:FORWARD ACCEPT\n", expect: "*filter\n:FORWARD ACCEPT\n"},
+		{
+			rules:  "-A FORWARD -i {{.Uplink}} -p IPv4 --ip-src {{.PodCIDR}} -j DROP\n",
+			expect: "-A FORWARD -i eth1 -p IPv4 --ip-src 10.0.1.0/24 -j DROP\n",
+		},
+		{
+			rules:  "{{range .Bridges}}-A INPUT --logical-in {{.}} -j ACCEPT\n{{end}}",
+			expect: "-A INPUT --logical-in docker -j ACCEPT\n-A INPUT --logical-in docker2 -j ACCEPT\n",
+		},
+		{rules: "-A FORWARD -i {{.Uplink", fail: true},
+		{rules: "-A FORWARD -i {{.Device}}", fail: true},
+	} {
+		path := filepath.Join(dir, "rules")
+		if err := ioutil.WriteFile(path, []byte(c.rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+		data, err := Render(path, facts)
+		if c.fail {
+			if err == nil {
+				t.Errorf("case %d: expect error, real %s", i, string(data))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if string(data) != c.expect {
+			t.Errorf("case %d: expect %q, real %q", i, c.expect, string(data))
+		}
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package egress translates source ips of underlay pods to egress addresses when they reach specific destinations,
+// e.g. corporate networks which only allow a few known addresses. Pods bridged on the host need
+// bridge-nf-call-iptables for their traffic to traverse the node's nat table.
+package egress
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	glog "k8s.io/klog"
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+)
+
+const (
+	// egressChain is jumped to from POSTROUTING, it jumps to a rule chain per matching source and destination
+	egressChain utiliptables.Chain = "GALAXY-EGRESS"
+	// prefix of rule chains, the suffix is the index of the rule
+	ruleChainPrefix = "GALAXY-EGRESS-"
+)
+
+// Rule translates source ips in Sources to ToSource when reaching Destinations but not Except
+type Rule struct {
+	// Sources and Destinations are cidrs or ips
+	Sources      []string `json:"sources"`
+	Destinations []string `json:"destinations"`
+	// Except are cidrs or ips within Destinations which are reached with the original source ips
+	Except []string `json:"except,omitempty"`
+	// ToSource is an ip or an ip range "ip1-ip2" of the SNAT pool. If empty, traffic is masqueraded to the address
+	// of the node's outgoing interface.
+	ToSource string `json:"toSource,omitempty"`
+}
+
+func validCIDR(s string) bool {
+	if _, _, err := net.ParseCIDR(s); err == nil {
+		return true
+	}
+	return net.ParseIP(s) != nil
+}
+
+// Validate returns an error if r is invalid
+func (r *Rule) Validate() error {
+	if len(r.Sources) == 0 || len(r.Destinations) == 0 {
+		return fmt.Errorf("sources and destinations are required")
+	}
+	for _, list := range [][]string{r.Sources, r.Destinations, r.Except} {
+		for _, s := range list {
+			if !validCIDR(s) {
+				return fmt.Errorf("bad cidr %q", s)
+			}
+		}
+	}
+	if r.ToSource != "" {
+		for _, ip := range strings.SplitN(r.ToSource, "-", 2) {
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("bad toSource %q", r.ToSource)
+			}
+		}
+	}
+	return nil
+}
+
+// Handler programs egress nat rules into iptables
+type Handler struct {
+	utiliptables.Interface
+	rules []Rule
+}
+
+// New validates rules and returns a Handler of them
+func New(rules []Rule) (*Handler, error) {
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			return nil, fmt.Errorf("bad egress nat rule %d: %v", i, err)
+		}
+	}
+	return &Handler{Interface: utiliptables.Shared(), rules: rules}, nil
+}
+
+func ruleChainName(i int) utiliptables.Chain {
+	return utiliptables.Chain(fmt.Sprintf("%s%d", ruleChainPrefix, i))
+}
+
+func jumpArgs() []string {
+	return []string{"-m", "comment", "--comment", "galaxy egress nat", "-j", string(egressChain)}
+}
+
+// Sync replaces all egress nat rules with rules of h, it removes all of them if h has no rules
+func (h *Handler) Sync() error {
+	save := bytes.NewBuffer(nil)
+	if err := h.SaveInto(utiliptables.TableNAT, save); err != nil {
+		return fmt.Errorf("failed to save nat table: %v", err)
+	}
+	existing := utiliptables.GetChainLines(utiliptables.TableNAT, save.Bytes())
+	if len(h.rules) == 0 {
+		if _, ok := existing[egressChain]; !ok {
+			return nil
+		}
+		// chains are referenced by the jump until it is deleted
+		if err := h.DeleteRule(utiliptables.TableNAT, utiliptables.ChainPostrouting, jumpArgs()...); err != nil {
+			return fmt.Errorf("failed to delete egress nat jump: %v", err)
+		}
+	}
+	chains := bytes.NewBuffer(nil)
+	rules := bytes.NewBuffer(nil)
+	utiliptables.WriteLine(chains, "*nat")
+	if len(h.rules) > 0 {
+		utiliptables.WriteLine(chains, utiliptables.MakeChainLine(egressChain))
+	}
+	for i := range h.rules {
+		writeRule(chains, rules, i, &h.rules[i])
+	}
+	// remove chains of rules which are deleted from config
+	for chain := range existing {
+		if chain == egressChain && len(h.rules) == 0 || isStaleRuleChain(chain, len(h.rules)) {
+			utiliptables.WriteLine(chains, utiliptables.MakeChainLine(chain))
+			utiliptables.WriteLine(rules, "-X", string(chain))
+		}
+	}
+	utiliptables.WriteLine(rules, "COMMIT")
+	lines := append(chains.Bytes(), rules.Bytes()...)
+	if err := h.RestoreAll(lines, utiliptables.NoFlushTables, utiliptables.RestoreCounters); err != nil {
+		return fmt.Errorf("failed to execute iptables-restore for rules %s: %v", string(lines), err)
+	}
+	if len(h.rules) == 0 {
+		glog.Infof("removed egress nat rules")
+		return nil
+	}
+	// take precedence over masquerade rules of overlay networks
+	if _, err := h.EnsureRule(utiliptables.Prepend, utiliptables.TableNAT, utiliptables.ChainPostrouting,
+		jumpArgs()...); err != nil {
+		return fmt.Errorf("failed to ensure that %s chain %s jumps to %s: %v", utiliptables.TableNAT,
+			utiliptables.ChainPostrouting, egressChain, err)
+	}
+	return nil
+}
+
+func isStaleRuleChain(chain utiliptables.Chain, rules int) bool {
+	if !strings.HasPrefix(string(chain), ruleChainPrefix) {
+		return false
+	}
+	var i int
+	if _, err := fmt.Sscanf(strings.TrimPrefix(string(chain), ruleChainPrefix), "%d", &i); err != nil {
+		return false
+	}
+	return i >= rules
+}
+
+// writeRule writes rules of r which is the ith rule, e.g.
+// -A GALAXY-EGRESS -m comment --comment "egress nat 0" -s 10.0.0.0/16 -d 172.16.0.0/12 -j GALAXY-EGRESS-0
+// -A GALAXY-EGRESS-0 -d 172.16.1.0/24 -j RETURN
+// -A GALAXY-EGRESS-0 -j SNAT --to-source 192.168.1.10-192.168.1.12
+func writeRule(chains, rules *bytes.Buffer, i int, r *Rule) {
+	ruleChain := ruleChainName(i)
+	comment := fmt.Sprintf(`"egress nat %d"`, i)
+	utiliptables.WriteLine(chains, utiliptables.MakeChainLine(ruleChain))
+	for _, src := range r.Sources {
+		for _, dst := range r.Destinations {
+			utiliptables.WriteLine(rules, "-A", string(egressChain), "-m", "comment", "--comment", comment, "-s", src,
+				"-d", dst, "-j", string(ruleChain))
+		}
+	}
+	for _, except := range r.Except {
+		utiliptables.WriteLine(rules, "-A", string(ruleChain), "-m", "comment", "--comment", comment, "-d", except,
+			"-j", "RETURN")
+	}
+	if r.ToSource == "" {
+		utiliptables.WriteLine(rules, "-A", string(ruleChain), "-m", "comment", "--comment", comment, "-j",
+			"MASQUERADE")
+	} else {
+		utiliptables.WriteLine(rules, "-A", string(ruleChain), "-m", "comment", "--comment", comment, "-j", "SNAT",
+			"--to-source", r.ToSource)
+	}
+}
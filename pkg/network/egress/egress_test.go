@@ -0,0 +1,116 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package egress
+
+import (
+	"bytes"
+	"testing"
+
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+	iptablesTest "tkestack.io/galaxy/pkg/utils/iptables/testing"
+)
+
+func TestValidate(t *testing.T) {
+	for i, c := range []struct {
+		rule  Rule
+		valid bool
+	}{
+		{rule: Rule{Sources: []string{"10.0.0.0/16"}, Destinations: []string{"172.16.0.0/12"}}, valid: true},
+		{rule: Rule{Sources: []string{"10.0.0.1"}, Destinations: []string{"172.16.0.0/12"},
+			Except: []string{"172.16.1.0/24"}, ToSource: "192.168.1.10-192.168.1.12"}, valid: true},
+		{rule: Rule{Destinations: []string{"172.16.0.0/12"}}, valid: false},
+		{rule: Rule{Sources: []string{"10.0.0.0/33"}, Destinations: []string{"172.16.0.0/12"}}, valid: false},
+		{rule: Rule{Sources: []string{"10.0.0.0/16"}, Destinations: []string{"172.16.0.0/12"},
+			Except: []string{"a"}}, valid: false},
+		{rule: Rule{Sources: []string{"10.0.0.0/16"}, Destinations: []string{"172.16.0.0/12"},
+			ToSource: "192.168.1.10-"}, valid: false},
+	} {
+		if err := c.rule.Validate(); (err == nil) != c.valid {
+			t.Errorf("case %d: expect valid %v, real err %v", i, c.valid, err)
+		}
+	}
+}
+
+func checkNAT(t *testing.T, fakeCli utiliptables.Interface, expect string) {
+	buf := bytes.NewBuffer(nil)
+	if err := fakeCli.SaveInto(utiliptables.TableNAT, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expect {
+		t.Fatalf("expect %s, real %s", expect, buf.String())
+	}
+}
+
+// #lizard forgives
+func TestSync(t *testing.T) {
+	fakeCli := iptablesTest.NewFakeIPTables()
+	h := &Handler{Interface: fakeCli, rules: []Rule{
+		{Sources: []string{"10.0.0.0/16", "10.1.0.0/16"}, Destinations: []string{"172.16.0.0/12"},
+			Except: []string{"172.16.1.0/24"}, ToSource: "192.168.1.10-192.168.1.12"},
+		{Sources: []string{"10.0.0.0/16"}, Destinations: []string{"192.168.100.0/24"}},
+	}}
+	for i := 0; i < 2; i++ {
+		// syncing again doesn't duplicate rules
+		if err := h.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkNAT(t, fakeCli, `*nat
+:GALAXY-EGRESS - [0:0]
+:GALAXY-EGRESS-0 - [0:0]
+:GALAXY-EGRESS-1 - [0:0]
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+:POSTROUTING - [0:0]
+:PREROUTING - [0:0]
+-A GALAXY-EGRESS -m comment --comment "egress nat 0" -s 10.0.0.0/16 -d 172.16.0.0/12 -j GALAXY-EGRESS-0
+-A GALAXY-EGRESS -m comment --comment "egress nat 0" -s 10.1.0.0/16 -d 172.16.0.0/12 -j GALAXY-EGRESS-0
+-A GALAXY-EGRESS -m comment --comment "egress nat 1" -s 10.0.0.0/16 -d 192.168.100.0/24 -j GALAXY-EGRESS-1
+-A GALAXY-EGRESS-0 -m comment --comment "egress nat 0" -d 172.16.1.0/24 -j RETURN
+-A GALAXY-EGRESS-0 -m comment --comment "egress nat 0" -j SNAT --to-source 192.168.1.10-192.168.1.12
+-A GALAXY-EGRESS-1 -m comment --comment "egress nat 1" -j MASQUERADE
+-A POSTROUTING -m comment --comment "galaxy egress nat" -j GALAXY-EGRESS
+COMMIT
+`)
+	h.rules = h.rules[1:]
+	if err := h.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	checkNAT(t, fakeCli, `*nat
+:GALAXY-EGRESS - [0:0]
+:GALAXY-EGRESS-0 - [0:0]
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+:POSTROUTING - [0:0]
+:PREROUTING - [0:0]
+-A GALAXY-EGRESS -m comment --comment "egress nat 0" -s 10.0.0.0/16 -d 192.168.100.0/24 -j GALAXY-EGRESS-0
+-A GALAXY-EGRESS-0 -m comment --comment "egress nat 0" -j MASQUERADE
+-A POSTROUTING -m comment --comment "galaxy egress nat" -j GALAXY-EGRESS
+COMMIT
+`)
+	h.rules = nil
+	if err := h.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	checkNAT(t, fakeCli, `*nat
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+:POSTROUTING - [0:0]
+:PREROUTING - [0:0]
+COMMIT
+`)
+}
@@ -0,0 +1,171 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package egressgw selects whether the default route of a pod having both vlan and overlay interfaces goes via the
+// vlan gateway or the overlay, and keeps return paths of the other interfaces symmetric by policy routing.
+package egressgw
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Vlan routes default traffic of the pod via the gateway of its vlan interface
+	Vlan = "vlan"
+	// Overlay routes default traffic of the pod via the gateway of its overlay interface
+	Overlay = "overlay"
+
+	// tableBase is the route table of the first interface not taking default traffic, the netns is the pod's own so
+	// any table is free
+	tableBase = 100
+	// rulePriority is the priority of rules looking up tables of interfaces by source addresses, before the main
+	// table of priority 32766
+	rulePriority = 1000
+)
+
+// Link is an interface of a pod
+type Link struct {
+	IfName string
+	// Kind is Vlan or Overlay
+	Kind    string
+	IP      net.IP
+	Gateway net.IP
+}
+
+// Validate checks the egress gateway choice of a network or a pod
+func Validate(choice string) error {
+	if choice != Vlan && choice != Overlay {
+		return fmt.Errorf("unknown egress gateway %q, expect %s or %s", choice, Vlan, Overlay)
+	}
+	return nil
+}
+
+// Plan returns the link default traffic goes via for choice and the others. It returns nil if the pod doesn't have
+// links of both kinds as there is nothing to choose.
+func Plan(links []Link, choice string) (*Link, []Link, error) {
+	if err := Validate(choice); err != nil {
+		return nil, nil, err
+	}
+	var gw *Link
+	var others []Link
+	kinds := map[string]bool{}
+	for i := range links {
+		kinds[links[i].Kind] = true
+		if gw == nil && links[i].Kind == choice {
+			gw = &links[i]
+			continue
+		}
+		others = append(others, links[i])
+	}
+	if !kinds[Vlan] || !kinds[Overlay] {
+		return nil, nil, nil
+	}
+	if gw.Gateway == nil {
+		return nil, nil, fmt.Errorf("%s interface %s has no gateway", choice, gw.IfName)
+	}
+	return gw, others, nil
+}
+
+// Apply replaces the default route of the netns with the one via gw. Each of others having a gateway gets a table
+// of its routes and a default route via its gateway, looked up by its address, so that replies to connections
+// arriving at it leave by it rather than the default route.
+func Apply(netnsPath string, gw *Link, others []Link) error {
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return err
+	}
+	defer netns.Close() // nolint: errcheck
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(gw.IfName)
+		if err != nil {
+			return err
+		}
+		if err := replaceDefault(link, gw.Gateway, unix.RT_TABLE_MAIN); err != nil {
+			return err
+		}
+		for i, other := range others {
+			if other.Gateway == nil || other.IP == nil {
+				continue
+			}
+			if err := policyRoute(&other, tableBase+i, rulePriority+i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// replaceDefault replaces default routes of the table with the one via gateway of link
+func replaceDefault(link netlink.Link, gateway net.IP, table int) error {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table},
+		netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	for i := range routes {
+		if routes[i].Dst != nil || (routes[i].LinkIndex == link.Attrs().Index && routes[i].Gw.Equal(gateway)) {
+			continue
+		}
+		if err := netlink.RouteDel(&routes[i]); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete default route %s: %v", routes[i].String(), err)
+		}
+	}
+	route := &netlink.Route{LinkIndex: link.Attrs().Index, Gw: gateway, Table: table}
+	if err := netlink.RouteReplace(route); err != nil {
+		return fmt.Errorf("failed to route default traffic via %s of %s: %v", gateway, link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// policyRoute makes traffic from the address of l look up the table of its routes
+func policyRoute(l *Link, table, priority int) error {
+	link, err := netlink.LinkByName(l.IfName)
+	if err != nil {
+		return err
+	}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{LinkIndex: link.Attrs().Index,
+		Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	for i := range routes {
+		if routes[i].Dst == nil {
+			continue
+		}
+		r := routes[i]
+		r.Table = table
+		if err := netlink.RouteReplace(&r); err != nil {
+			return fmt.Errorf("failed to add route %s to table %d: %v", r.String(), table, err)
+		}
+	}
+	if err := replaceDefault(link, l.Gateway, table); err != nil {
+		return err
+	}
+	rule := netlink.NewRule()
+	rule.Src = &net.IPNet{IP: l.IP, Mask: net.CIDRMask(32, 32)}
+	rule.Table = table
+	rule.Priority = priority
+	if err := netlink.RuleAdd(rule); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to add rule from %s lookup %d: %v", l.IP, table, err)
+	}
+	return nil
+}
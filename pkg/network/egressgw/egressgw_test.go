@@ -0,0 +1,50 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package egressgw
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	links := []Link{
+		{IfName: "eth0", Kind: Overlay, IP: net.ParseIP("172.16.0.2"), Gateway: net.ParseIP("172.16.0.1")},
+		{IfName: "eth1", Kind: Vlan, IP: net.ParseIP("10.0.0.2"), Gateway: net.ParseIP("10.0.0.1")},
+	}
+	gw, others, err := Plan(links, Vlan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gw == nil || gw.IfName != "eth1" || len(others) != 1 || others[0].IfName != "eth0" {
+		t.Fatalf("expect default via eth1 and eth0 policy routed, real %v %v", gw, others)
+	}
+	if gw, others, err = Plan(links, Overlay); err != nil || gw.IfName != "eth0" || others[0].IfName != "eth1" {
+		t.Fatalf("expect default via eth0, real %v %v %v", gw, others, err)
+	}
+	// nothing to choose for pods of a single kind
+	if gw, _, err = Plan(links[1:], Overlay); err != nil || gw != nil {
+		t.Fatalf("expect no plan, real %v %v", gw, err)
+	}
+	if _, _, err = Plan(links, "eth1"); err == nil {
+		t.Fatal("expect an error of an unknown choice")
+	}
+	links[1].Gateway = nil
+	if _, _, err = Plan(links, Vlan); err == nil {
+		t.Fatal("expect an error of a vlan interface without gateway")
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package kernel
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ConntrackMaxSysctl is the size of the conntrack table
+	ConntrackMaxSysctl = "net/netfilter/nf_conntrack_max"
+	conntrackCount     = "net/netfilter/nf_conntrack_count"
+	// conntrackHashsize is the number of buckets of the conntrack table, the kernel defaults it to a quarter of
+	// nf_conntrack_max on boot but never resizes it along
+	conntrackHashsize = "module/nf_conntrack/parameters/hashsize"
+)
+
+// ConntrackStats are usage of the conntrack table and counters of connections dropped because of it
+type ConntrackStats struct {
+	Entries int
+	Max     int
+	// Drops are new connections dropped as the table is full, EarlyDrops are entries evicted to make room for new
+	// ones and InsertFailed are entries failed to be inserted, all summed over cpus since boot
+	Drops        uint64
+	EarlyDrops   uint64
+	InsertFailed uint64
+}
+
+// Conntrack reads and sizes the conntrack table of the host
+type Conntrack struct {
+	sysfs, procfs string
+}
+
+// NewConntrack returns a Conntrack of the host
+func NewConntrack() *Conntrack {
+	return &Conntrack{sysfs: "/sys", procfs: "/proc"}
+}
+
+// ConntrackMax returns the table size of a node of memBytes memory, perGB entries per GiB but at least min
+func ConntrackMax(memBytes uint64, perGB, min int) int {
+	max := int(memBytes * uint64(perGB) >> 30)
+	if max < min {
+		return min
+	}
+	return max
+}
+
+// MemTotal returns the memory of the host in bytes
+func (c *Conntrack) MemTotal() (uint64, error) {
+	f, err := os.Open(filepath.Join(c.procfs, "meminfo"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close() // nolint: errcheck
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemTotal:       16300544 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "MemTotal:" && fields[2] == "kB" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("bad MemTotal %q: %v", scanner.Text(), err)
+			}
+			return kb << 10, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no MemTotal in meminfo")
+}
+
+// EnsureMax raises nf_conntrack_max to max and hashsize to a quarter of it, which keeps chains of the hash table as
+// short as the kernel default does. Tables larger than max, e.g. sized by administrators or kube-proxy, are left as
+// they are. It returns the size of the table.
+func (c *Conntrack) EnsureMax(max int) (int, error) {
+	current, err := c.readInt(filepath.Join(c.procfs, "sys", ConntrackMaxSysctl))
+	if err != nil {
+		return 0, err
+	}
+	if current >= max {
+		return current, nil
+	}
+	hashsize := filepath.Join(c.sysfs, conntrackHashsize)
+	if buckets, err := c.readInt(hashsize); err == nil && buckets < max/4 {
+		// the table may be resized only by the initial netns, failing it only makes chains longer
+		if err := ioutil.WriteFile(hashsize, []byte(strconv.Itoa(max/4)), 0644); err != nil {
+			return current, fmt.Errorf("failed to set hashsize to %d: %v", max/4, err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(c.procfs, "sys", ConntrackMaxSysctl), []byte(strconv.Itoa(max)),
+		0644); err != nil {
+		return current, fmt.Errorf("failed to set nf_conntrack_max to %d: %v", max, err)
+	}
+	return max, nil
+}
+
+// Stats reads usage and drop counters of the conntrack table, it fails if nf_conntrack is not loaded
+func (c *Conntrack) Stats() (*ConntrackStats, error) {
+	stats := &ConntrackStats{}
+	var err error
+	if stats.Entries, err = c.readInt(filepath.Join(c.procfs, "sys", conntrackCount)); err != nil {
+		return nil, err
+	}
+	if stats.Max, err = c.readInt(filepath.Join(c.procfs, "sys", ConntrackMaxSysctl)); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(c.procfs, "net/stat/nf_conntrack"))
+	if err != nil {
+		return nil, err
+	}
+	if err := parseConntrackCPUStats(string(data), stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// parseConntrackCPUStats sums drop counters of /proc/net/stat/nf_conntrack, which has a header line of column names
+// and a line of hex values per cpu
+func parseConntrackCPUStats(data string, stats *ConntrackStats) error {
+	lines := strings.Split(strings.TrimSpace(data), "\n")
+	if len(lines) < 2 {
+		return fmt.Errorf("no cpu stats of nf_conntrack")
+	}
+	columns := map[string]*uint64{"drop": &stats.Drops, "early_drop": &stats.EarlyDrops,
+		"insert_failed": &stats.InsertFailed}
+	header := strings.Fields(lines[0])
+	for _, line := range lines[1:] {
+		values := strings.Fields(line)
+		if len(values) != len(header) {
+			return fmt.Errorf("bad cpu stats of nf_conntrack %q", line)
+		}
+		for i, name := range header {
+			counter, ok := columns[name]
+			if !ok {
+				continue
+			}
+			v, err := strconv.ParseUint(values[i], 16, 64)
+			if err != nil {
+				return fmt.Errorf("bad %s of nf_conntrack %q: %v", name, values[i], err)
+			}
+			*counter += v
+		}
+	}
+	return nil
+}
+
+func (c *Conntrack) readInt(file string) (int, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("bad %s %q: %v", file, string(data), err)
+	}
+	return v, nil
+}
+
+// ConntrackPort is a destination port of connections, e.g. a host port mapped to a pod. IP limits it to connections
+// to the ip, a nil IP matches connections to any ip.
+type ConntrackPort struct {
+	Protocol string
+	Port     uint16
+	IP       net.IP
+}
+
+// conntrackFilter matches entries of connections from or to ips, either as they are or NATed, and entries of
+// connections to ports
+type conntrackFilter struct {
+	ips   []net.IP
+	ports []ConntrackPort
+}
+
+// MatchConntrackFlow is part of netlink.CustomConntrackFilter
+func (f *conntrackFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	for _, ip := range f.ips {
+		for _, flowIP := range []net.IP{flow.Forward.SrcIP, flow.Forward.DstIP, flow.Reverse.SrcIP,
+			flow.Reverse.DstIP} {
+			if ip.Equal(flowIP) {
+				return true
+			}
+		}
+	}
+	for _, port := range f.ports {
+		if protocolNumber(port.Protocol) == flow.Forward.Protocol && port.Port == flow.Forward.DstPort &&
+			(port.IP == nil || port.IP.IsUnspecified() || port.IP.Equal(flow.Forward.DstIP)) {
+			return true
+		}
+	}
+	return false
+}
+
+func protocolNumber(protocol string) uint8 {
+	switch strings.ToLower(protocol) {
+	case "tcp":
+		return unix.IPPROTO_TCP
+	case "udp":
+		return unix.IPPROTO_UDP
+	case "sctp":
+		return unix.IPPROTO_SCTP
+	}
+	return 0
+}
+
+// FlushConntrack deletes entries of connections from or to ips and entries of connections to ports. Entries
+// outliving a pod keep directing packets to its ip, which blackholes traffic of replies or of host ports till the
+// entries expire, even after the ip or the host ports are taken by another pod. It returns the number of entries
+// deleted.
+func FlushConntrack(ips []net.IP, ports []ConntrackPort) (uint, error) {
+	if len(ips) == 0 && len(ports) == 0 {
+		return 0, nil
+	}
+	filter := &conntrackFilter{ips: ips, ports: ports}
+	var total uint
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		n, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, netlink.InetFamily(family), filter)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("failed to delete conntrack entries: %v", err)
+		}
+	}
+	return total, nil
+}
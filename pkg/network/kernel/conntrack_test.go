@@ -0,0 +1,130 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package kernel
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestConntrackMax(t *testing.T) {
+	for _, c := range []struct {
+		mem    uint64
+		expect int
+	}{{mem: 2 << 30, expect: 131072}, {mem: 16 << 30, expect: 524288}, {mem: 8<<30 + 512<<20, expect: 278528}} {
+		if max := ConntrackMax(c.mem, 32768, 131072); max != c.expect {
+			t.Errorf("memory %d: expect %d, real %d", c.mem, c.expect, max)
+		}
+	}
+}
+
+// #lizard forgives
+func TestConntrack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conntrack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	c := &Conntrack{sysfs: filepath.Join(dir, "sys"), procfs: filepath.Join(dir, "proc")}
+	files := map[string]string{
+		"proc/meminfo":                   "MemTotal:       16300544 kB\nMemFree:         1000 kB\n",
+		"proc/sys/" + ConntrackMaxSysctl: "262144\n",
+		"proc/sys/" + conntrackCount:     "1024\n",
+		"sys/" + conntrackHashsize:       "65536\n",
+		"proc/net/stat/nf_conntrack": "entries  searched found new invalid ignore delete delete_list insert " +
+			"insert_failed drop early_drop icmp_error  expect_new expect_create expect_delete search_restart\n" +
+			"00000400  00000000 00000000 00000000 00000010 00000020 00000000 00000000 00000000 00000001 0000000a " +
+			"00000002 00000000  00000000 00000000 00000000 00000000\n" +
+			"00000400  00000000 00000000 00000000 00000010 00000020 00000000 00000000 00000000 00000000 00000006 " +
+			"00000000 00000000  00000000 00000000 00000000 00000000\n",
+	}
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mem, err := c.MemTotal()
+	if err != nil || mem != 16300544<<10 {
+		t.Fatalf("expect memory %d, real %d %v", 16300544<<10, mem, err)
+	}
+	stats, err := c.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := &ConntrackStats{Entries: 1024, Max: 262144, Drops: 16, EarlyDrops: 2, InsertFailed: 1}
+	if !reflect.DeepEqual(stats, expect) {
+		t.Fatalf("expect %+v, real %+v", expect, stats)
+	}
+	// smaller tables are left as they are
+	if max, err := c.EnsureMax(131072); err != nil || max != 262144 {
+		t.Fatalf("expect 262144, real %d %v", max, err)
+	}
+	if max, err := c.EnsureMax(524288); err != nil || max != 524288 {
+		t.Fatalf("expect 524288, real %d %v", max, err)
+	}
+	for file, expect := range map[string]int{"proc/sys/" + ConntrackMaxSysctl: 524288,
+		"sys/" + conntrackHashsize: 131072} {
+		if v, err := c.readInt(filepath.Join(dir, file)); err != nil || v != expect {
+			t.Errorf("expect %s %d, real %d %v", file, expect, v, err)
+		}
+	}
+}
+
+func TestConntrackFilter(t *testing.T) {
+	filter := &conntrackFilter{ips: []net.IP{net.ParseIP("10.0.0.2")}, ports: []ConntrackPort{
+		{Protocol: "UDP", Port: 53}, {Protocol: "TCP", Port: 8080, IP: net.ParseIP("192.168.0.1")}}}
+	flow := func(proto uint8, src, dst string, dport uint16, rsrc, rdst string) *netlink.ConntrackFlow {
+		f := &netlink.ConntrackFlow{}
+		f.Forward.Protocol, f.Forward.SrcIP, f.Forward.DstIP, f.Forward.DstPort = proto, net.ParseIP(src),
+			net.ParseIP(dst), dport
+		f.Reverse.Protocol, f.Reverse.SrcIP, f.Reverse.DstIP = proto, net.ParseIP(rsrc), net.ParseIP(rdst)
+		return f
+	}
+	for i, c := range []struct {
+		flow   *netlink.ConntrackFlow
+		expect bool
+	}{
+		// originated from the pod and masqueraded
+		{flow(unix.IPPROTO_TCP, "10.0.0.2", "8.8.8.8", 443, "8.8.8.8", "192.168.0.1"), true},
+		// to the pod directly
+		{flow(unix.IPPROTO_TCP, "10.0.0.3", "10.0.0.2", 80, "10.0.0.2", "10.0.0.3"), true},
+		// to a host port DNATed to the pod
+		{flow(unix.IPPROTO_TCP, "10.1.0.1", "192.168.0.1", 30000, "10.0.0.2", "10.1.0.1"), true},
+		// to a host port of any ip, not NATed yet
+		{flow(unix.IPPROTO_UDP, "10.1.0.1", "192.168.0.2", 53, "192.168.0.2", "10.1.0.1"), true},
+		{flow(unix.IPPROTO_TCP, "10.1.0.1", "192.168.0.2", 53, "192.168.0.2", "10.1.0.1"), false},
+		// to a host port bound to an ip, the same port of other ips doesn't match
+		{flow(unix.IPPROTO_TCP, "10.1.0.1", "192.168.0.1", 8080, "192.168.0.1", "10.1.0.1"), true},
+		{flow(unix.IPPROTO_TCP, "10.1.0.1", "192.168.0.2", 8080, "192.168.0.2", "10.1.0.1"), false},
+		{flow(unix.IPPROTO_TCP, "10.0.0.3", "10.0.0.4", 80, "10.0.0.4", "10.0.0.3"), false},
+	} {
+		if match := filter.MatchConntrackFlow(c.flow); match != c.expect {
+			t.Errorf("case %d: expect %v, real %v", i, c.expect, match)
+		}
+	}
+}
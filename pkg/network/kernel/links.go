@@ -0,0 +1,238 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package kernel
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"golang.org/x/sys/unix"
+)
+
+// LinkTuning tunes both ends of the veth of a pod
+type LinkTuning struct {
+	// TxQueueLen is txqueuelen of the interfaces, 0 keeps the default
+	TxQueueLen int `json:"txQueueLen,omitempty"`
+	// Offloads turns offload features on or off, keys are Offloads
+	Offloads map[string]bool `json:"offloads,omitempty"`
+}
+
+// legacy ethtool commands setting a single feature, the kernel translates them to netdev features
+const (
+	siocEthtool     = 0x8946
+	ethtoolGDrvInfo = 0x03
+	ethtoolSRxCsum  = 0x15
+	ethtoolSTxCsum  = 0x17
+	ethtoolSSG      = 0x19
+	ethtoolSTSO     = 0x1f
+	ethtoolSGSO     = 0x24
+	ethtoolSGRO     = 0x2c
+)
+
+// Offloads are offload features LinkTuning supports and their ethtool commands, names are those of ethtool -K
+var Offloads = map[string]uint32{
+	"rx-checksum": ethtoolSRxCsum,
+	"tx-checksum": ethtoolSTxCsum,
+	"sg":          ethtoolSSG,
+	"tso":         ethtoolSTSO,
+	"gso":         ethtoolSGSO,
+	"gro":         ethtoolSGRO,
+}
+
+// Validate checks values of the tuning
+func (t *LinkTuning) Validate() error {
+	if t.TxQueueLen < 0 {
+		return fmt.Errorf("bad txQueueLen %d", t.TxQueueLen)
+	}
+	for name := range t.Offloads {
+		if _, ok := Offloads[name]; !ok {
+			return fmt.Errorf("unknown offload %q", name)
+		}
+	}
+	return nil
+}
+
+// ethtool sets an offload feature of an interface
+type ethtool interface {
+	SetOffload(ifName string, cmd uint32, on bool) error
+}
+
+// TuneLink applies tuning to ifName within the netns and to its host side peer if ifName is a veth. Devices of other
+// types such as macvlan or vfs have their parents on the host which are left untouched.
+func TuneLink(netnsPath, ifName string, tuning *LinkTuning) error {
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return err
+	}
+	defer netns.Close() // nolint: errcheck
+	var peerIndex int
+	if err := netns.Do(func(_ ns.NetNS) error {
+		dir, err := ioutil.TempDir("", "galaxy-sysfs")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(dir) // nolint: errcheck
+		if err := unix.Mount("sysfs", dir, "sysfs", 0, ""); err != nil {
+			return fmt.Errorf("failed to mount sysfs of netns: %v", err)
+		}
+		defer unix.Unmount(dir, unix.MNT_DETACH) // nolint: errcheck
+		et, err := newIoctlEthtool()
+		if err != nil {
+			return err
+		}
+		defer et.Close() // nolint: errcheck
+		if err := tuneLink(dir, ifName, tuning, et); err != nil {
+			return err
+		}
+		driver, err := et.Driver(ifName)
+		if err != nil || driver != "veth" {
+			return err
+		}
+		peerIndex, err = readInt(filepath.Join(dir, "class", "net", ifName, "iflink"))
+		return err
+	}); err != nil {
+		return err
+	}
+	if peerIndex == 0 {
+		return nil
+	}
+	peer, err := net.InterfaceByIndex(peerIndex)
+	if err != nil {
+		return fmt.Errorf("failed to find the peer of %s: %v", ifName, err)
+	}
+	et, err := newIoctlEthtool()
+	if err != nil {
+		return err
+	}
+	defer et.Close() // nolint: errcheck
+	return tuneLink("/sys", peer.Name, tuning, et)
+}
+
+func tuneLink(sysfs, ifName string, tuning *LinkTuning, et ethtool) error {
+	if tuning.TxQueueLen > 0 {
+		file := filepath.Join(sysfs, "class", "net", ifName, "tx_queue_len")
+		if err := ioutil.WriteFile(file, []byte(strconv.Itoa(tuning.TxQueueLen)), 0644); err != nil {
+			return fmt.Errorf("failed to set txqueuelen of %s: %v", ifName, err)
+		}
+	}
+	// keep the order stable, turning off tx-checksum turns off tso as well
+	names := make([]string, 0, len(tuning.Offloads))
+	for name := range tuning.Offloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd, ok := Offloads[name]
+		if !ok {
+			return fmt.Errorf("unknown offload %q", name)
+		}
+		if err := et.SetOffload(ifName, cmd, tuning.Offloads[name]); err != nil {
+			return fmt.Errorf("failed to set %s of %s: %v", name, ifName, err)
+		}
+	}
+	return nil
+}
+
+func readInt(file string) (int, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// ioctlEthtool issues ethtool ioctls on a socket of the netns it is created in
+type ioctlEthtool struct {
+	fd int
+}
+
+func newIoctlEthtool() (*ioctlEthtool, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ethtool socket: %v", err)
+	}
+	return &ioctlEthtool{fd: fd}, nil
+}
+
+func (e *ioctlEthtool) Close() error {
+	return syscall.Close(e.fd)
+}
+
+type ifreq struct {
+	name [syscall.IFNAMSIZ]byte
+	data uintptr
+}
+
+type ethtoolValue struct {
+	cmd  uint32
+	data uint32
+}
+
+type ethtoolDrvInfo struct {
+	cmd         uint32
+	driver      [32]byte
+	version     [32]byte
+	fwVersion   [32]byte
+	busInfo     [32]byte
+	eromVersion [32]byte
+	reserved2   [12]byte
+	nPrivFlags  uint32
+	nStats      uint32
+	testInfoLen uint32
+	eedumpLen   uint32
+	regdumpLen  uint32
+}
+
+func (e *ioctlEthtool) ioctl(ifName string, data unsafe.Pointer) error {
+	if len(ifName) >= syscall.IFNAMSIZ {
+		return fmt.Errorf("bad interface name %q", ifName)
+	}
+	req := ifreq{data: uintptr(data)}
+	copy(req.name[:], ifName)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(e.fd), siocEthtool,
+		uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (e *ioctlEthtool) SetOffload(ifName string, cmd uint32, on bool) error {
+	value := ethtoolValue{cmd: cmd}
+	if on {
+		value.data = 1
+	}
+	return e.ioctl(ifName, unsafe.Pointer(&value))
+}
+
+// Driver returns the driver name of ifName, e.g. veth
+func (e *ioctlEthtool) Driver(ifName string) (string, error) {
+	info := ethtoolDrvInfo{cmd: ethtoolGDrvInfo}
+	if err := e.ioctl(ifName, unsafe.Pointer(&info)); err != nil {
+		return "", fmt.Errorf("failed to get driver of %s: %v", ifName, err)
+	}
+	return string(bytes.TrimRight(info.driver[:], "\x00")), nil
+}
@@ -0,0 +1,74 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package kernel
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type fakeEthtool struct {
+	calls []string
+}
+
+func (f *fakeEthtool) SetOffload(ifName string, cmd uint32, on bool) error {
+	f.calls = append(f.calls, fmt.Sprintf("%s %#x %v", ifName, cmd, on))
+	return nil
+}
+
+func TestTuneLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "links")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	netDir := filepath.Join(dir, "class", "net", "eth0")
+	if err := os.MkdirAll(netDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	et := &fakeEthtool{}
+	tuning := &LinkTuning{TxQueueLen: 5000, Offloads: map[string]bool{"tx-checksum": false, "gro": false, "sg": true}}
+	if err := tuneLink(dir, "eth0", tuning, et); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(netDir, "tx_queue_len")); err != nil || string(data) != "5000" {
+		t.Fatalf("expect txqueuelen 5000, real %s, err %v", string(data), err)
+	}
+	if expect := []string{"eth0 0x2c false", "eth0 0x19 true", "eth0 0x17 false"}; !reflect.DeepEqual(et.calls,
+		expect) {
+		t.Fatalf("expect %v, real %v", expect, et.calls)
+	}
+}
+
+func TestValidateLinkTuning(t *testing.T) {
+	for i, c := range []struct {
+		tuning LinkTuning
+		err    bool
+	}{
+		{tuning: LinkTuning{TxQueueLen: 1000, Offloads: map[string]bool{"tso": false, "rx-checksum": true}}},
+		{tuning: LinkTuning{TxQueueLen: -1}, err: true},
+		{tuning: LinkTuning{Offloads: map[string]bool{"lro": false}}, err: true},
+	} {
+		if err := c.tuning.Validate(); (err != nil) != c.err {
+			t.Errorf("case %d: expect err %v, real %v", i, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package kernel
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// KindModule is a kernel module which must be loaded or built in, galaxy never loads modules itself
+	KindModule = "module"
+	// KindSysctl is a sysctl which must be writable unless it already has the expected value
+	KindSysctl = "sysctl"
+)
+
+// Requirement is a kernel module or sysctl some feature of galaxy relies on
+type Requirement struct {
+	Kind string `json:"kind"`
+	// Name is the module name or the sysctl path relative to /proc/sys, e.g. net/ipv4/ip_forward
+	Name string `json:"name"`
+	// Feature describes what relies on it
+	Feature string `json:"feature"`
+	// Available means a module is loaded or built in, or a sysctl exists and is writable
+	Available bool `json:"available"`
+	// Value is the current value of a sysctl if it is readable
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Prober checks requirements against the running kernel without changing anything
+type Prober struct {
+	sysfs, procfs string
+	// builtin is the modules.builtin of the running kernel
+	builtin string
+}
+
+// NewProber returns a Prober of the host
+func NewProber() *Prober {
+	p := &Prober{sysfs: "/sys", procfs: "/proc"}
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err == nil {
+		var release []byte
+		for _, c := range uts.Release {
+			if c == 0 {
+				break
+			}
+			release = append(release, byte(c))
+		}
+		p.builtin = filepath.Join("/lib/modules", string(release), "modules.builtin")
+	}
+	return p
+}
+
+// Module checks if module is loaded or built in
+func (p *Prober) Module(name, feature string) Requirement {
+	r := Requirement{Kind: KindModule, Name: name, Feature: feature}
+	// built in modules having parameters appear in /sys/module as well
+	if _, err := os.Stat(filepath.Join(p.sysfs, "module", name)); err == nil {
+		r.Available = true
+		return r
+	}
+	builtin, err := p.isBuiltin(name)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.Available = builtin
+	if !r.Available && r.Error == "" {
+		r.Error = fmt.Sprintf("module %s is not loaded", name)
+	}
+	return r
+}
+
+func (p *Prober) isBuiltin(name string) (bool, error) {
+	if p.builtin == "" {
+		return false, nil
+	}
+	f, err := os.Open(p.builtin)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close() // nolint: errcheck
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g. kernel/net/8021q/8021q.ko
+		base := strings.TrimSuffix(filepath.Base(scanner.Text()), ".ko")
+		if strings.Replace(base, "-", "_", -1) == strings.Replace(name, "-", "_", -1) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// Sysctl checks if the sysctl exists and is writable by writing its current value back
+func (p *Prober) Sysctl(name, feature string) Requirement {
+	r := Requirement{Kind: KindSysctl, Name: name, Feature: feature}
+	file := filepath.Join(p.procfs, "sys", name)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.Value = strings.TrimSpace(string(data))
+	if err := ioutil.WriteFile(file, []byte(r.Value), 0644); err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.Available = true
+	return r
+}
+
+// Satisfied returns true if r is available, or it is a sysctl which can't be written but already has value expect
+func (r *Requirement) Satisfied(expect string) bool {
+	return r.Available || r.Kind == KindSysctl && expect != "" && r.Value == expect
+}
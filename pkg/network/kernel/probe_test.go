@@ -0,0 +1,67 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package kernel
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// #lizard forgives
+func TestProber(t *testing.T) {
+	dir, err := ioutil.TempDir("", "probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	p := &Prober{sysfs: filepath.Join(dir, "sys"), procfs: filepath.Join(dir, "proc"),
+		builtin: filepath.Join(dir, "modules.builtin")}
+	for _, d := range []string{"sys/module/br_netfilter", "proc/sys/net/ipv4"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(p.builtin, []byte("kernel/net/8021q/8021q.ko\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name      string
+		available bool
+	}{{"br_netfilter", true}, {"8021q", true}, {"ebtables", false}} {
+		if r := p.Module(c.name, ""); r.Available != c.available {
+			t.Errorf("module %s: expect available %v, real %+v", c.name, c.available, r)
+		}
+	}
+	forward := filepath.Join(dir, "proc/sys/net/ipv4/ip_forward")
+	if err := ioutil.WriteFile(forward, []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if r := p.Sysctl("net/ipv4/ip_forward", ""); !r.Available || r.Value != "1" {
+		t.Fatalf("expect available sysctl of value 1, real %+v", r)
+	}
+	r := p.Sysctl("net/bridge/bridge-nf-call-iptables", "")
+	if r.Available || r.Error == "" || r.Satisfied("1") {
+		t.Fatalf("expect unavailable sysctl, real %+v", r)
+	}
+	// read only but already expected
+	r = Requirement{Kind: KindSysctl, Value: "1"}
+	if !r.Satisfied("1") || r.Satisfied("0") {
+		t.Fatalf("unexpected satisfaction of %+v", r)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package kernel
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"golang.org/x/sys/unix"
+)
+
+// QueueTuning spreads packet processing of an interface over cpus. Each field is a cpu list such as "0-3,8".
+type QueueTuning struct {
+	// RPSCPUs are cpus processing packets received by the interface, i.e. rps_cpus of its rx queues
+	RPSCPUs string `json:"rpsCPUs,omitempty"`
+	// XPSCPUs are cpus allowed to transmit on the tx queues of the interface, i.e. xps_cpus of its tx queues
+	XPSCPUs string `json:"xpsCPUs,omitempty"`
+	// IRQCPUs are the affinity of irqs of the device of the interface, e.g. a VF
+	IRQCPUs string `json:"irqCPUs,omitempty"`
+}
+
+// AppliedQueueTuning reports what is applied by TuneQueues
+type AppliedQueueTuning struct {
+	QueueTuning
+	RxQueues int   `json:"rxQueues"`
+	TxQueues int   `json:"txQueues"`
+	IRQs     []int `json:"irqs,omitempty"`
+}
+
+// CPUMask converts a cpu list such as "0-3,8" to a hex cpu mask in the format of sysfs, i.e. comma separated 32 bit
+// groups such as "00000000,0000010f" for 64 cpus
+func CPUMask(cpus string) (string, error) {
+	var words []uint32
+	for _, part := range strings.Split(cpus, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return "", fmt.Errorf("bad cpu list %q: %v", cpus, err)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return "", fmt.Errorf("bad cpu list %q: %v", cpus, err)
+			}
+		}
+		if first < 0 || last < first {
+			return "", fmt.Errorf("bad cpu range %q", part)
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			for len(words) <= cpu/32 {
+				words = append(words, 0)
+			}
+			words[cpu/32] |= 1 << uint(cpu%32)
+		}
+	}
+	if len(words) == 0 {
+		return "", fmt.Errorf("empty cpu list %q", cpus)
+	}
+	groups := make([]string, len(words))
+	for i := range words {
+		groups[len(words)-1-i] = fmt.Sprintf("%08x", words[i])
+	}
+	return strings.Join(groups, ","), nil
+}
+
+// TuneQueues applies tuning to ifName within the netns. Sysfs of the netns is mounted to a temp dir to find queues
+// and irqs of the interface.
+func TuneQueues(netnsPath, ifName string, tuning *QueueTuning) (*AppliedQueueTuning, error) {
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer netns.Close() // nolint: errcheck
+	var applied *AppliedQueueTuning
+	err = netns.Do(func(_ ns.NetNS) error {
+		dir, err := ioutil.TempDir("", "galaxy-sysfs")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(dir) // nolint: errcheck
+		if err := unix.Mount("sysfs", dir, "sysfs", 0, ""); err != nil {
+			return fmt.Errorf("failed to mount sysfs of netns: %v", err)
+		}
+		defer unix.Unmount(dir, unix.MNT_DETACH) // nolint: errcheck
+		applied, err = tuneQueues(dir, "/proc", ifName, tuning)
+		return err
+	})
+	return applied, err
+}
+
+func tuneQueues(sysfs, procfs, ifName string, tuning *QueueTuning) (*AppliedQueueTuning, error) {
+	applied := &AppliedQueueTuning{QueueTuning: *tuning}
+	netDir := filepath.Join(sysfs, "class", "net", ifName)
+	var err error
+	if applied.RxQueues, err = writeQueues(netDir, "rx-*", "rps_cpus", tuning.RPSCPUs); err != nil {
+		return nil, err
+	}
+	if applied.TxQueues, err = writeQueues(netDir, "tx-*", "xps_cpus", tuning.XPSCPUs); err != nil {
+		return nil, err
+	}
+	if tuning.IRQCPUs == "" {
+		return applied, nil
+	}
+	// veth devices have no irqs
+	fis, err := ioutil.ReadDir(filepath.Join(netDir, "device", "msi_irqs"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range fis {
+		irq, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			continue
+		}
+		file := filepath.Join(procfs, "irq", fi.Name(), "smp_affinity_list")
+		if err := ioutil.WriteFile(file, []byte(tuning.IRQCPUs), 0644); err != nil {
+			return nil, fmt.Errorf("failed to set affinity of irq %d: %v", irq, err)
+		}
+		applied.IRQs = append(applied.IRQs, irq)
+	}
+	sort.Ints(applied.IRQs)
+	return applied, nil
+}
+
+// writeQueues writes the cpu mask of cpus to file of queues matching pattern, it returns the number of queues
+func writeQueues(netDir, pattern, file, cpus string) (int, error) {
+	if cpus == "" {
+		return 0, nil
+	}
+	mask, err := CPUMask(cpus)
+	if err != nil {
+		return 0, err
+	}
+	queues, err := filepath.Glob(filepath.Join(netDir, "queues", pattern))
+	if err != nil {
+		return 0, err
+	}
+	if len(queues) == 0 {
+		return 0, fmt.Errorf("no queues found in %s", netDir)
+	}
+	for _, queue := range queues {
+		if err := ioutil.WriteFile(filepath.Join(queue, file), []byte(mask), 0644); err != nil {
+			return 0, fmt.Errorf("failed to write %s of %s: %v", file, filepath.Base(queue), err)
+		}
+	}
+	return len(queues), nil
+}
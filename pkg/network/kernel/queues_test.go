@@ -0,0 +1,81 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package kernel
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCPUMask(t *testing.T) {
+	for _, c := range []struct {
+		cpus, mask string
+		err        bool
+	}{
+		{cpus: "0", mask: "00000001"},
+		{cpus: "0-3,8", mask: "0000010f"},
+		{cpus: "1, 33", mask: "00000002,00000002"},
+		{cpus: "32-63", mask: "ffffffff,00000000"},
+		{cpus: "", err: true},
+		{cpus: "3-1", err: true},
+		{cpus: "a", err: true},
+	} {
+		mask, err := CPUMask(c.cpus)
+		if (err != nil) != c.err || mask != c.mask {
+			t.Errorf("cpus %q: expect %q err %v, real %q err %v", c.cpus, c.mask, c.err, mask, err)
+		}
+	}
+}
+
+// #lizard forgives
+func TestTuneQueues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queues")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	sysfs, procfs := filepath.Join(dir, "sys"), filepath.Join(dir, "proc")
+	netDir := filepath.Join(sysfs, "class", "net", "eth0")
+	for _, d := range []string{"queues/rx-0", "queues/rx-1", "queues/tx-0", "device/msi_irqs/41"} {
+		if err := os.MkdirAll(filepath.Join(netDir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(procfs, "irq", "41"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := tuneQueues(sysfs, procfs, "eth0", &QueueTuning{RPSCPUs: "0-1", XPSCPUs: "2", IRQCPUs: "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied.RxQueues != 2 || applied.TxQueues != 1 || !reflect.DeepEqual(applied.IRQs, []int{41}) {
+		t.Fatalf("unexpected applied %+v", applied)
+	}
+	for file, expect := range map[string]string{
+		filepath.Join(netDir, "queues/rx-1/rps_cpus"):           "00000003",
+		filepath.Join(netDir, "queues/tx-0/xps_cpus"):           "00000004",
+		filepath.Join(procfs, "irq", "41", "smp_affinity_list"): "3",
+	} {
+		data, err := ioutil.ReadFile(file)
+		if err != nil || string(data) != expect {
+			t.Errorf("%s: expect %s, real %s, err %v", file, expect, string(data), err)
+		}
+	}
+}
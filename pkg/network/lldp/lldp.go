@@ -0,0 +1,171 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package lldp receives LLDP frames of switches on uplinks of the node, so that vlans switch ports carry are
+// validated against vlans of networks of the node before pods are scheduled.
+package lldp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	etherTypeLLDP = 0x88cc
+
+	tlvEnd             = 0
+	tlvChassisID       = 1
+	tlvPortID          = 2
+	tlvTTL             = 3
+	tlvPortDescription = 4
+	tlvSystemName      = 5
+	tlvOrgSpecific     = 127
+
+	// subtypes of chassis id and port id tlvs whose ids are mac addresses
+	chassisSubtypeMAC = 4
+	portSubtypeMAC    = 3
+
+	// subtypes of the IEEE 802.1 organizationally specific tlvs
+	dot1SubtypePVID     = 1
+	dot1SubtypeVlanName = 3
+)
+
+var dot1OUI = []byte{0x00, 0x80, 0xc2}
+
+// Config validates vlans switch ports of uplinks carry by LLDP
+type Config struct {
+	// Vlans are vlan ids the switch port of each uplink must carry besides vlans of vlan devices on it
+	Vlans []uint16 `json:"vlans,omitempty"`
+}
+
+// Neighbor is the switch port of an uplink advertised by LLDP
+type Neighbor struct {
+	ChassisID       string
+	PortID          string
+	PortDescription string `json:",omitempty"`
+	SystemName      string `json:",omitempty"`
+	// TTL is how long the neighbor is valid since it is received
+	TTL time.Duration
+	// PVID is the port vlan id, 0 if not advertised
+	PVID uint16 `json:",omitempty"`
+	// Vlans are sorted ids of vlan name tlvs, i.e. vlans the switch port carries if the switch advertises them
+	Vlans []uint16 `json:",omitempty"`
+}
+
+// Missing returns vlans of expected which the switch port doesn't carry. It returns nil if the switch doesn't
+// advertise vlans of the port, in which case they can't be validated.
+func (n *Neighbor) Missing(expected []uint16) []uint16 {
+	if len(n.Vlans) == 0 {
+		return nil
+	}
+	carried := map[uint16]bool{}
+	for _, id := range n.Vlans {
+		carried[id] = true
+	}
+	var missing []uint16
+	for _, id := range expected {
+		if !carried[id] {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
+
+// String returns the system name and port of the neighbor
+func (n *Neighbor) String() string {
+	system := n.SystemName
+	if system == "" {
+		system = n.ChassisID
+	}
+	return fmt.Sprintf("%s port %s", system, n.PortID)
+}
+
+// #lizard forgives
+// Parse parses an ethernet frame of LLDP
+func Parse(frame []byte) (*Neighbor, error) {
+	if len(frame) < 14 || binary.BigEndian.Uint16(frame[12:14]) != etherTypeLLDP {
+		return nil, fmt.Errorf("not a lldp frame")
+	}
+	data := frame[14:]
+	n := &Neighbor{}
+	var mandatory int
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("truncated tlv header")
+		}
+		header := binary.BigEndian.Uint16(data)
+		typ, length := header>>9, int(header&0x1ff)
+		if len(data) < 2+length {
+			return nil, fmt.Errorf("truncated tlv %d", typ)
+		}
+		value := data[2 : 2+length]
+		data = data[2+length:]
+		switch typ {
+		case tlvEnd:
+			data = nil
+		case tlvChassisID, tlvPortID:
+			if length < 2 {
+				return nil, fmt.Errorf("bad tlv %d of length %d", typ, length)
+			}
+			id := string(value[1:])
+			if (typ == tlvChassisID && value[0] == chassisSubtypeMAC || typ == tlvPortID && value[0] == portSubtypeMAC) &&
+				length == 7 {
+				id = net.HardwareAddr(value[1:]).String()
+			}
+			if typ == tlvChassisID {
+				n.ChassisID = id
+			} else {
+				n.PortID = id
+			}
+			mandatory++
+		case tlvTTL:
+			if length != 2 {
+				return nil, fmt.Errorf("bad ttl tlv of length %d", length)
+			}
+			n.TTL = time.Duration(binary.BigEndian.Uint16(value)) * time.Second
+			mandatory++
+		case tlvPortDescription:
+			n.PortDescription = strings.TrimRight(string(value), "\x00")
+		case tlvSystemName:
+			n.SystemName = strings.TrimRight(string(value), "\x00")
+		case tlvOrgSpecific:
+			if length < 4 || string(value[:3]) != string(dot1OUI) {
+				continue
+			}
+			switch value[3] {
+			case dot1SubtypePVID:
+				if length >= 6 {
+					n.PVID = binary.BigEndian.Uint16(value[4:6])
+				}
+			case dot1SubtypeVlanName:
+				if length >= 6 {
+					n.Vlans = append(n.Vlans, binary.BigEndian.Uint16(value[4:6]))
+				}
+			}
+		}
+	}
+	if mandatory < 3 {
+		return nil, fmt.Errorf("missing chassis id, port id or ttl")
+	}
+	sort.Slice(n.Vlans, func(i, j int) bool {
+		return n.Vlans[i] < n.Vlans[j]
+	})
+	return n, nil
+}
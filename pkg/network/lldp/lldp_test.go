@@ -0,0 +1,81 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package lldp
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func tlv(typ uint16, value ...byte) []byte {
+	data := make([]byte, 2, 2+len(value))
+	binary.BigEndian.PutUint16(data, typ<<9|uint16(len(value)))
+	return append(data, value...)
+}
+
+func frame(tlvs ...[]byte) []byte {
+	data := []byte{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e, 0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x88, 0xcc}
+	for _, t := range tlvs {
+		data = append(data, t...)
+	}
+	return data
+}
+
+func vlanName(id uint16, name string) []byte {
+	return tlv(tlvOrgSpecific, append([]byte{0x00, 0x80, 0xc2, dot1SubtypeVlanName, byte(id >> 8), byte(id),
+		byte(len(name))}, name...)...)
+}
+
+// #lizard forgives
+func TestParse(t *testing.T) {
+	chassis := tlv(tlvChassisID, chassisSubtypeMAC, 0x00, 0x11, 0x22, 0x33, 0x44, 0x55)
+	port := tlv(tlvPortID, 5, 'E', 't', 'h', '1', '/', '2')
+	ttl := tlv(tlvTTL, 0, 120)
+	n, err := Parse(frame(chassis, port, ttl, tlv(tlvSystemName, 's', 'w', '1'),
+		tlv(tlvOrgSpecific, 0x00, 0x80, 0xc2, dot1SubtypePVID, 0, 1), vlanName(20, "vlan20"), vlanName(10, "vlan10"),
+		// unknown organizationally specific tlv
+		tlv(tlvOrgSpecific, 0x00, 0x12, 0x0f, 1, 3), tlv(tlvEnd)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := &Neighbor{ChassisID: "00:11:22:33:44:55", PortID: "Eth1/2", SystemName: "sw1", TTL: 120 * time.Second,
+		PVID: 1, Vlans: []uint16{10, 20}}
+	if !reflect.DeepEqual(n, expect) {
+		t.Fatalf("expect %+v, got %+v", expect, n)
+	}
+	if n.String() != "sw1 port Eth1/2" {
+		t.Fatal(n.String())
+	}
+	if missing := n.Missing([]uint16{10, 30}); !reflect.DeepEqual(missing, []uint16{30}) {
+		t.Fatal(missing)
+	}
+	if missing := (&Neighbor{}).Missing([]uint16{10}); missing != nil {
+		t.Fatalf("expect vlans not validated without vlan tlvs, got %v", missing)
+	}
+	for i, bad := range [][]byte{
+		frame(chassis, port),
+		frame(chassis, port, ttl[:3]),
+		frame(chassis, tlv(tlvPortID), ttl),
+		append(frame(chassis, port, ttl)[:12], 0x08, 0x00),
+	} {
+		if _, err := Parse(bad); err == nil {
+			t.Fatalf("case %d: expect an error", i)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package lldp
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+	glog "k8s.io/klog"
+)
+
+// retryInterval is how long to wait before listening on a device again after failing to
+const retryInterval = 10 * time.Second
+
+// nearestBridge is the multicast address of LLDP frames which switches don't forward
+var nearestBridge = net.HardwareAddr{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}
+
+// Listen calls handle with neighbors of LLDP frames received by device until quit is closed. Frames are received
+// even if device is attached to a bridge, as bridges don't forward them.
+func Listen(device string, quit <-chan struct{}, handle func(*Neighbor)) {
+	go func() {
+		for {
+			if err := readFrames(device, quit, handle); err != nil {
+				glog.Warningf("failed to listen lldp on %s: %v", device, err)
+			}
+			select {
+			case <-quit:
+				return
+			case <-time.After(retryInterval):
+			}
+		}
+	}()
+}
+
+// readFrames returns nil once quit is closed
+func readFrames(device string, quit <-chan struct{}, handle func(*Neighbor)) error {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(etherTypeLLDP)))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd) // nolint: errcheck
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(etherTypeLLDP), Ifindex: iface.Index}); err != nil {
+		return err
+	}
+	mreq := &unix.PacketMreq{Ifindex: int32(iface.Index), Type: unix.PACKET_MR_MULTICAST, Alen: 6}
+	copy(mreq.Address[:], nearestBridge)
+	if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, mreq); err != nil {
+		return err
+	}
+	// wake up every second to check quit
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1}); err != nil {
+		return err
+	}
+	buf := make([]byte, 1518)
+	for {
+		select {
+		case <-quit:
+			return nil
+		default:
+		}
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			return err
+		}
+		neighbor, err := Parse(buf[:n])
+		if err != nil {
+			glog.V(4).Infof("bad lldp frame on %s: %v", device, err)
+			continue
+		}
+		handle(neighbor)
+	}
+}
+
+func htons(i uint16) uint16 {
+	return (i<<8)&0xff00 | i>>8
+}
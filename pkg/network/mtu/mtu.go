@@ -0,0 +1,176 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package mtu overrides mtu of pods' interfaces and clamps tcp mss of their connections by iptables TCPMSS targets,
+// so that pods talking across tunnels or vpns of lower mtu don't rely on path mtu discovery which firewalls often
+// break by dropping icmp.
+package mtu
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+	"tkestack.io/galaxy/pkg/utils/store"
+)
+
+const (
+	// mssChain is jumped to from mangle FORWARD, it clamps mss of SYN packets from and to pods
+	mssChain utiliptables.Chain = "GALAXY-MSS"
+	// minMTU is the min mtu of ipv4 interfaces
+	minMTU = 68
+	maxMTU = 65535
+	// headersLen is the length of ipv4 and tcp headers without options
+	headersLen = 40
+)
+
+// Override is the value of the mtu annotation of pods
+type Override struct {
+	// MTU is the mtu of the pod's interface
+	MTU int `json:"mtu"`
+	// ClampMSS clamps mss of tcp connections from and to the pod to MTU minus headers, in case peers behind the
+	// lower mtu path announce larger mss
+	ClampMSS bool `json:"clampMSS,omitempty"`
+}
+
+// ParseOverride parses the value of the mtu annotation
+func ParseOverride(v string) (*Override, error) {
+	o := &Override{}
+	if err := json.Unmarshal([]byte(v), o); err != nil {
+		return nil, err
+	}
+	if o.MTU < minMTU || o.MTU > maxMTU {
+		return nil, fmt.Errorf("mtu %d is not within %d-%d", o.MTU, minMTU, maxMTU)
+	}
+	return o, nil
+}
+
+// MSS returns the mss of o
+func (o *Override) MSS() int {
+	return o.MTU - headersLen
+}
+
+// state is what is set up for a container, it is used to clean up the rules
+type state struct {
+	PodIP string
+	MSS   int
+	// Tag is the tag of the rules, states without it are of rules commented by the container id
+	Tag string `json:",omitempty"`
+}
+
+// Handler sets up and cleans up mss clamping of containers
+type Handler struct {
+	utiliptables.Interface
+	store *store.FileStore
+}
+
+// New creates a Handler which records its state in dir
+func New(dir string) *Handler {
+	return &Handler{Interface: utiliptables.Shared(), store: store.NewFileStore(dir)}
+}
+
+func jumpArgs() []string {
+	return []string{"-m", "comment", "--comment", "galaxy mss clamping", "-j", string(mssChain)}
+}
+
+// clampArgs returns rules clamping mss of SYN packets from and to podIP of the container, ReplaceTagged adds the tag
+// -A GALAXY-MSS -m comment --comment galaxy/v1/<pod uid>/<container id>/mss -s 10.0.0.2/32 -p tcp -m tcp
+// --tcp-flags SYN,RST SYN -j TCPMSS --set-mss 1360
+func clampArgs(s *state) [][]string {
+	var rules [][]string
+	for _, direction := range []string{"-s", "-d"} {
+		rules = append(rules, []string{direction, s.PodIP + "/32", "-p", "tcp", "-m", "tcp", "--tcp-flags",
+			"SYN,RST", "SYN", "-j", "TCPMSS", "--set-mss", strconv.Itoa(s.MSS)})
+	}
+	return rules
+}
+
+// legacyClampArgs returns rules of states without tags
+func legacyClampArgs(containerID string, s *state) [][]string {
+	var rules [][]string
+	for _, args := range clampArgs(s) {
+		rules = append(rules, append([]string{"-m", "comment", "--comment", containerID}, args...))
+	}
+	return rules
+}
+
+// ensureBasicRule ensures mangle FORWARD jumps to the mss chain
+func (h *Handler) ensureBasicRule() error {
+	if _, err := h.EnsureChain(utiliptables.TableMangle, mssChain); err != nil {
+		return fmt.Errorf("failed to ensure that %s chain %s exists: %v", utiliptables.TableMangle, mssChain, err)
+	}
+	if _, err := h.EnsureRule(utiliptables.Append, utiliptables.TableMangle, utiliptables.ChainForward,
+		jumpArgs()...); err != nil {
+		return fmt.Errorf("failed to ensure that %s chain %s jumps to %s: %v", utiliptables.TableMangle,
+			utiliptables.ChainForward, mssChain, err)
+	}
+	return nil
+}
+
+// Setup clamps mss of tcp connections from and to podIP of the container of the pod
+func (h *Handler) Setup(containerID, podUID, podIP string, o *Override) error {
+	if !o.ClampMSS {
+		return nil
+	}
+	if err := h.ensureBasicRule(); err != nil {
+		return err
+	}
+	// record state first so that rules set up partially get cleaned up
+	s := &state{PodIP: podIP, MSS: o.MSS(), Tag: utiliptables.RuleTag(podUID, containerID, "mss")}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := h.store.Put(containerID, data); err != nil {
+		return fmt.Errorf("failed to save mss clamping state of %s: %v", containerID, err)
+	}
+	if err := utiliptables.ReplaceTagged(h, utiliptables.TableMangle, mssChain, s.Tag, clampArgs(s)); err != nil {
+		return fmt.Errorf("failed to add rules of %s: %v", containerID, err)
+	}
+	return nil
+}
+
+// Cleanup removes mss clamping of the container, it does nothing if the container has none
+func (h *Handler) Cleanup(containerID string) error {
+	data, err := h.store.Get(containerID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read mss clamping state of %s: %v", containerID, err)
+	}
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("bad mss clamping state of %s: %v", containerID, err)
+	}
+	if s.Tag != "" {
+		if err := utiliptables.DeleteTagged(h, utiliptables.TableMangle, mssChain, s.Tag); err != nil {
+			return fmt.Errorf("failed to delete rules of %s: %v", containerID, err)
+		}
+	} else {
+		for _, args := range legacyClampArgs(containerID, &s) {
+			if err := h.DeleteRule(utiliptables.TableMangle, mssChain, args...); err != nil {
+				return fmt.Errorf("failed to delete rule of %s: %v", containerID, err)
+			}
+		}
+	}
+	if err := h.store.Delete(containerID); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package mtu
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+	iptablesTest "tkestack.io/galaxy/pkg/utils/iptables/testing"
+	"tkestack.io/galaxy/pkg/utils/store"
+)
+
+func TestParseOverride(t *testing.T) {
+	o, err := ParseOverride(`{"mtu": 1400, "clampMSS": true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *o != (Override{MTU: 1400, ClampMSS: true}) || o.MSS() != 1360 {
+		t.Fatalf("unexpected override %+v", o)
+	}
+	for _, v := range []string{`{"mtu": 0}`, `{"mtu": 65536}`, `{"mtu": "1400"}`} {
+		if _, err := ParseOverride(v); err == nil {
+			t.Errorf("expect error of %s", v)
+		}
+	}
+}
+
+func checkMangle(t *testing.T, fakeCli utiliptables.Interface, expect string) {
+	buf := bytes.NewBuffer(nil)
+	if err := fakeCli.SaveInto(utiliptables.TableMangle, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expect {
+		t.Fatalf("expect %s, real %s", expect, buf.String())
+	}
+}
+
+// #lizard forgives
+func TestSetupCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	fakeCli := iptablesTest.NewFakeIPTables()
+	h := &Handler{Interface: fakeCli, store: store.NewFileStore(dir)}
+	for _, mtu := range []int{1500, 1400} {
+		// setting up again replaces rules of the container
+		if err := h.Setup("c1", "uid1", "10.0.0.2", &Override{MTU: mtu, ClampMSS: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// mtu alone sets up no rules
+	if err := h.Setup("c2", "uid2", "10.0.0.3", &Override{MTU: 1400}); err != nil {
+		t.Fatal(err)
+	}
+	checkMangle(t, fakeCli, `*mangle
+:FORWARD - [0:0]
+:GALAXY-MSS - [0:0]
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+:POSTROUTING - [0:0]
+:PREROUTING - [0:0]
+-A FORWARD -m comment --comment "galaxy mss clamping" -j GALAXY-MSS
+-A GALAXY-MSS -m comment --comment galaxy/v1/uid1/c1/mss -s 10.0.0.2/32 -p tcp -m tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss 1360
+-A GALAXY-MSS -m comment --comment galaxy/v1/uid1/c1/mss -d 10.0.0.2/32 -p tcp -m tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss 1360
+COMMIT
+`)
+	for _, containerID := range []string{"c1", "c2", "c1"} {
+		// cleaning up twice or containers having no clamping is fine
+		if err := h.Cleanup(containerID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkMangle(t, fakeCli, `*mangle
+:FORWARD - [0:0]
+:GALAXY-MSS - [0:0]
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+:POSTROUTING - [0:0]
+:PREROUTING - [0:0]
+-A FORWARD -m comment --comment "galaxy mss clamping" -j GALAXY-MSS
+COMMIT
+`)
+	if keys, err := h.store.Keys(); err != nil || len(keys) != 0 {
+		t.Fatalf("expect no state, real %v, err %v", keys, err)
+	}
+}
+
+func TestCleanupLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	fakeCli := iptablesTest.NewFakeIPTables()
+	h := &Handler{Interface: fakeCli, store: store.NewFileStore(dir)}
+	// rules set up before tagging are commented by container ids
+	s := &state{PodIP: "10.0.0.2", MSS: 1360}
+	if err := h.store.Put("c1", []byte(`{"PodIP":"10.0.0.2","MSS":1360}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ensureBasicRule(); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range legacyClampArgs("c1", s) {
+		if _, err := fakeCli.EnsureRule(utiliptables.Append, utiliptables.TableMangle, mssChain, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Cleanup("c1"); err != nil {
+		t.Fatal(err)
+	}
+	checkMangle(t, fakeCli, `*mangle
+:FORWARD - [0:0]
+:GALAXY-MSS - [0:0]
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+:POSTROUTING - [0:0]
+:PREROUTING - [0:0]
+-A FORWARD -m comment --comment "galaxy mss clamping" -j GALAXY-MSS
+COMMIT
+`)
+}
@@ -0,0 +1,192 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package ndguard drops rogue ipv6 router advertisements, redirects and spoofed neighbor advertisements sent by pods
+// on their bridge ports via ebtables. Pods keep ipv6 but can't hijack routes of others on shared vlans.
+package ndguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"tkestack.io/galaxy/pkg/utils/store"
+)
+
+// guardChain is jumped to from FORWARD and INPUT of the ebtables filter table
+const guardChain = "GALAXY-ND-GUARD"
+
+// Port is the bridge port of a pod and the mac of the pod's interface
+type Port struct {
+	Name string
+	MAC  string
+}
+
+// Guard sets up and cleans up ebtables rules of pod ports
+type Guard struct {
+	store *store.FileStore
+	// ebtables runs ebtables with args
+	ebtables func(args ...string) ([]byte, error)
+}
+
+// New creates a Guard which records ports of containers in dir
+func New(dir string) *Guard {
+	return &Guard{store: store.NewFileStore(dir), ebtables: func(args ...string) ([]byte, error) {
+		return exec.Command("ebtables", args...).CombinedOutput()
+	}}
+}
+
+func portRules(port *Port) [][]string {
+	icmp := []string{"-p", "IPv6", "--ip6-proto", "ipv6-icmp", "--ip6-icmp-type"}
+	var rules [][]string
+	for _, t := range []string{"router-advertisement", "redirect"} {
+		rules = append(rules, append(append([]string{"-i", port.Name}, icmp...), t, "-j", "DROP"))
+	}
+	// a pod may only advertise its own mac
+	rules = append(rules, append(append([]string{"-i", port.Name, "-s", "!", port.MAC}, icmp...),
+		"neighbour-advertisement", "-j", "DROP"))
+	return rules
+}
+
+func (g *Guard) run(args ...string) error {
+	if out, err := g.ebtables(append([]string{"-t", "filter"}, args...)...); err != nil {
+		return fmt.Errorf("ebtables %s: %v, %s", strings.Join(args, " "), err, string(out))
+	}
+	return nil
+}
+
+// ensureRule appends the rule unless it exists, ebtables of old versions can't check rules so it is deleted first
+func (g *Guard) ensureRule(chain string, rule []string) error {
+	_ = g.run(append([]string{"-D", chain}, rule...)...)
+	return g.run(append([]string{"-A", chain}, rule...)...)
+}
+
+// EnsureBasicRule ensures FORWARD and INPUT jump to the guard chain
+func (g *Guard) EnsureBasicRule() error {
+	if _, err := g.ebtables("-t", "filter", "-L", guardChain); err != nil {
+		if err := g.run("-N", guardChain, "-P", "RETURN"); err != nil {
+			return err
+		}
+	}
+	for _, chain := range []string{"FORWARD", "INPUT"} {
+		if err := g.ensureRule(chain, []string{"-p", "IPv6", "-j", guardChain}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Setup drops rogue neighbor discovery packets from ports of the container
+func (g *Guard) Setup(containerID string, ports []Port) error {
+	if err := g.EnsureBasicRule(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(ports)
+	if err != nil {
+		return err
+	}
+	// record the port first so that rules set up partially get cleaned up
+	if err := g.store.Put(containerID, data); err != nil {
+		return fmt.Errorf("failed to save nd guard ports of %s: %v", containerID, err)
+	}
+	return g.ensurePortRules(ports)
+}
+
+func (g *Guard) ensurePortRules(ports []Port) error {
+	for i := range ports {
+		for _, rule := range portRules(&ports[i]) {
+			if err := g.ensureRule(guardChain, rule); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Restore sets up rules of all recorded containers again, e.g. after the filter table is replaced by a restore
+func (g *Guard) Restore() error {
+	containerIDs, err := g.store.Keys()
+	if err != nil {
+		return fmt.Errorf("failed to list nd guard ports: %v", err)
+	}
+	if len(containerIDs) == 0 {
+		return nil
+	}
+	if err := g.EnsureBasicRule(); err != nil {
+		return err
+	}
+	for _, containerID := range containerIDs {
+		ports, err := g.loadPorts(containerID)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// cleaned up meanwhile
+				continue
+			}
+			return err
+		}
+		if err := g.ensurePortRules(ports); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPorts returns recorded ports of the container, the error satisfies os.IsNotExist if there is none
+func (g *Guard) loadPorts(containerID string) ([]Port, error) {
+	data, err := g.store.Get(containerID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to read nd guard ports of %s: %v", containerID, err)
+	}
+	var ports []Port
+	if err := json.Unmarshal(data, &ports); err != nil {
+		return nil, fmt.Errorf("bad nd guard ports of %s: %v", containerID, err)
+	}
+	return ports, nil
+}
+
+// isNotExist returns true if out is the output of ebtables or ebtables-nft failing to delete an absent rule
+func isNotExist(out []byte) bool {
+	return strings.Contains(string(out), "does not exist") || strings.Contains(string(out), "matching rule exist")
+}
+
+// Cleanup removes rules of the container, it does nothing if the container has none
+func (g *Guard) Cleanup(containerID string) error {
+	ports, err := g.loadPorts(containerID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for i := range ports {
+		for _, rule := range portRules(&ports[i]) {
+			out, err := g.ebtables(append([]string{"-t", "filter", "-D", guardChain}, rule...)...)
+			// ebtables fails to delete absent rules
+			if err != nil && !isNotExist(out) {
+				return fmt.Errorf("failed to delete nd guard rule of %s: %v, %s", containerID, err, string(out))
+			}
+		}
+	}
+	if err := g.store.Delete(containerID); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package ndguard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"tkestack.io/galaxy/pkg/utils/store"
+)
+
+// fakeEbtables keeps rules of chains in order
+type fakeEbtables struct {
+	chains map[string][]string
+}
+
+func (f *fakeEbtables) run(args ...string) ([]byte, error) {
+	// skip -t filter
+	op, chain, rule := args[2], args[3], strings.Join(args[4:], " ")
+	rules, ok := f.chains[chain]
+	switch op {
+	case "-L":
+		if !ok {
+			return []byte("Chain doesn't exist"), fmt.Errorf("exit status 1")
+		}
+	case "-N":
+		f.chains[chain] = nil
+	case "-A":
+		f.chains[chain] = append(rules, rule)
+	case "-D":
+		for i := range rules {
+			if rules[i] == rule {
+				f.chains[chain] = append(rules[:i], rules[i+1:]...)
+				return nil, nil
+			}
+		}
+		return []byte("Sorry, rule does not exist."), fmt.Errorf("exit status 1")
+	}
+	return nil, nil
+}
+
+// #lizard forgives
+func TestGuard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ndguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	fake := &fakeEbtables{chains: map[string][]string{"FORWARD": nil, "INPUT": nil}}
+	g := &Guard{store: store.NewFileStore(dir), ebtables: fake.run}
+	ports := []Port{{Name: "veth1", MAC: "02:00:00:00:00:01"}}
+	for i := 0; i < 2; i++ {
+		// setting up again doesn't duplicate rules
+		if err := g.Setup("c1", ports); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := []string{
+		"-i veth1 -p IPv6 --ip6-proto ipv6-icmp --ip6-icmp-type router-advertisement -j DROP",
+		"-i veth1 -p IPv6 --ip6-proto ipv6-icmp --ip6-icmp-type redirect -j DROP",
+		"-i veth1 -s ! 02:00:00:00:00:01 -p IPv6 --ip6-proto ipv6-icmp --ip6-icmp-type neighbour-advertisement -j DROP",
+	}
+	if strings.Join(fake.chains[guardChain], "\n") != strings.Join(expect, "\n") {
+		t.Fatalf("expect %v, real %v", expect, fake.chains[guardChain])
+	}
+	for _, chain := range []string{"FORWARD", "INPUT"} {
+		if len(fake.chains[chain]) != 1 || fake.chains[chain][0] != "-p IPv6 -j "+guardChain {
+			t.Fatalf("unexpected %s rules %v", chain, fake.chains[chain])
+		}
+	}
+	// rules are set up again once the table is replaced
+	fake.chains = map[string][]string{"FORWARD": nil, "INPUT": nil}
+	if err := g.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(fake.chains[guardChain], "\n") != strings.Join(expect, "\n") || len(fake.chains["INPUT"]) != 1 {
+		t.Fatalf("expect restored rules %v, real %v", expect, fake.chains)
+	}
+	// rules removed by others don't fail cleanup
+	fake.chains[guardChain] = fake.chains[guardChain][1:]
+	if err := g.Cleanup("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.chains[guardChain]) != 0 {
+		t.Fatalf("expect no rules left, real %v", fake.chains[guardChain])
+	}
+	if err := g.Cleanup("c1"); err != nil {
+		t.Fatal(err)
+	}
+}
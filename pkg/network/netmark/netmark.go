@@ -0,0 +1,254 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package netmark marks traffic of pods by their networks and routes marked traffic by route tables of the networks,
+// so that networks can leave the node via different uplinks or be shaped apart by tc filters on the marks. Pods
+// bridged on the host need bridge-nf-call-iptables for their traffic to traverse the node's mangle table.
+package netmark
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/network/portmapping"
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+)
+
+const (
+	// markChain is jumped to from mangle PREROUTING, it marks packets by source ips of pods
+	markChain utiliptables.Chain = "GALAXY-NETMARK"
+	// MarkMask must not overlap with marks of kube-proxy (0x4000, 0x8000) and DSR marks (0xff0000)
+	MarkMask  = 0xff000000
+	markShift = 24
+	maxMark   = MarkMask >> markShift
+	// pendingTTL is how long a pod added by Add is kept marked without being listed to Sync, pods are listed once
+	// their ADD requests succeed
+	pendingTTL = 5 * time.Minute
+)
+
+// Mark marks packets from pods of Network and routes them by Table
+type Mark struct {
+	Network string `json:"network"`
+	// Mark is 1-255, packets carry fwmark Mark<<24 with mask 0xff000000
+	Mark int `json:"mark"`
+	// Table is the route table looked up by packets of the mark if not 0
+	Table int `json:"table,omitempty"`
+	// Gateway and Device are the default route of Table if either is set, otherwise routes of Table are left to
+	// operators
+	Gateway string `json:"gateway,omitempty"`
+	Device  string `json:"device,omitempty"`
+}
+
+// Validate returns an error if m is invalid
+func (m *Mark) Validate() error {
+	if m.Network == "" {
+		return fmt.Errorf("network is required")
+	}
+	if m.Mark < 1 || m.Mark > maxMark {
+		return fmt.Errorf("mark %d is not within 1-%d", m.Mark, maxMark)
+	}
+	if m.Table < 0 || m.Table >= 253 && m.Table <= 255 {
+		// 253-255 are default, main and local tables
+		return fmt.Errorf("bad table %d", m.Table)
+	}
+	if m.Table > portmapping.DSRTableBase && m.Table <= portmapping.DSRTableMax {
+		return fmt.Errorf("table %d is reserved for DSR marks", m.Table)
+	}
+	if m.Gateway != "" {
+		if ip := net.ParseIP(m.Gateway); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("bad gateway %q", m.Gateway)
+		}
+	}
+	if (m.Gateway != "" || m.Device != "") && m.Table == 0 {
+		return fmt.Errorf("table is required by gateway and device")
+	}
+	return nil
+}
+
+// FWMark returns the fwmark and mask of packets of m as iptables and tc filters accept
+func (m *Mark) FWMark() string {
+	return fmt.Sprintf("0x%x/0x%x", m.Mark<<markShift, MarkMask)
+}
+
+// Pod is an ip a pod gets from a network
+type Pod struct {
+	// Name is namespace/name of the pod
+	Name    string
+	Network string
+	IP      net.IP
+}
+
+type pendingPod struct {
+	pod   Pod
+	added time.Time
+}
+
+// router programs ip rules and route tables of marks
+type router interface {
+	// Sync replaces ip rules and default routes of marks and deletes ip rules of other marks
+	Sync(marks []*Mark) error
+}
+
+// Handler programs marks of pod traffic into iptables and policy routing
+type Handler struct {
+	utiliptables.Interface
+	router router
+	// marks are keyed by networks
+	marks map[string]*Mark
+	lock  sync.Mutex
+	// pending are pods added since they were last listed to Sync, keyed by ip
+	pending map[string]pendingPod
+	now     func() time.Time
+}
+
+// New validates marks and returns a Handler of them
+func New(marks []Mark) (*Handler, error) {
+	h := &Handler{Interface: utiliptables.Shared(), router: netlinkRouter{}, marks: map[string]*Mark{},
+		pending: map[string]pendingPod{}, now: time.Now}
+	values := map[int]string{}
+	for i := range marks {
+		m := &marks[i]
+		if err := m.Validate(); err != nil {
+			return nil, fmt.Errorf("bad network mark %d: %v", i, err)
+		}
+		if h.marks[m.Network] != nil {
+			return nil, fmt.Errorf("network %s has more than one mark", m.Network)
+		}
+		if network, ok := values[m.Mark]; ok {
+			return nil, fmt.Errorf("networks %s and %s have the same mark %d", network, m.Network, m.Mark)
+		}
+		h.marks[m.Network] = m
+		values[m.Mark] = m.Network
+	}
+	return h, nil
+}
+
+func jumpArgs() []string {
+	return []string{"-m", "comment", "--comment", "galaxy network marks", "-j", string(markChain)}
+}
+
+// podRule returns the rule of GALAXY-NETMARK chain which marks packets of pod
+// -A GALAXY-NETMARK -m comment --comment "default/pod-1 net1" -s 10.0.0.2/32 -j MARK --set-xmark
+// 0x1000000/0xff000000
+func podRule(pod *Pod, m *Mark, iptablesRestore bool) []string {
+	comment := fmt.Sprintf("%s %s", pod.Name, pod.Network)
+	if iptablesRestore {
+		comment = `"` + comment + `"`
+	}
+	return []string{"-m", "comment", "--comment", comment, "-s", pod.IP.String() + "/32", "-j", "MARK",
+		"--set-xmark", m.FWMark()}
+}
+
+// Add marks packets of pod before its ADD request succeeds, Sync keeps it marked until it is listed or pendingTTL
+// passes
+func (h *Handler) Add(pod Pod) error {
+	m := h.marks[pod.Network]
+	if m == nil || pod.IP == nil {
+		return nil
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.pending[pod.IP.String()] = pendingPod{pod: pod, added: h.now()}
+	if _, err := h.EnsureRule(utiliptables.Append, utiliptables.TableMangle, markChain,
+		podRule(&pod, m, false)...); err != nil {
+		return fmt.Errorf("failed to mark packets of %s: %v", pod.Name, err)
+	}
+	return nil
+}
+
+// Sync replaces all rules of marks with rules marking pods, it removes all of them if h has no marks
+func (h *Handler) Sync(pods []Pod) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	listed := map[string]bool{}
+	for i := range pods {
+		if pods[i].IP != nil {
+			listed[pods[i].IP.String()] = true
+		}
+	}
+	marked := append([]Pod{}, pods...)
+	now := h.now()
+	for ip, p := range h.pending {
+		if listed[ip] || now.Sub(p.added) > pendingTTL {
+			delete(h.pending, ip)
+			continue
+		}
+		marked = append(marked, p.pod)
+	}
+	if err := h.syncRules(marked); err != nil {
+		return err
+	}
+	var marks []*Mark
+	for _, m := range h.marks {
+		marks = append(marks, m)
+	}
+	sort.Slice(marks, func(i, j int) bool { return marks[i].Mark < marks[j].Mark })
+	return h.router.Sync(marks)
+}
+
+func (h *Handler) syncRules(pods []Pod) error {
+	save := bytes.NewBuffer(nil)
+	if err := h.SaveInto(utiliptables.TableMangle, save); err != nil {
+		return fmt.Errorf("failed to save mangle table: %v", err)
+	}
+	existing := utiliptables.GetChainLines(utiliptables.TableMangle, save.Bytes())
+	if len(h.marks) == 0 {
+		if _, ok := existing[markChain]; !ok {
+			return nil
+		}
+		// the chain is referenced by the jump until it is deleted
+		if err := h.DeleteRule(utiliptables.TableMangle, utiliptables.ChainPrerouting, jumpArgs()...); err != nil {
+			return fmt.Errorf("failed to delete network marks jump: %v", err)
+		}
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		if pods[i].Name != pods[j].Name {
+			return pods[i].Name < pods[j].Name
+		}
+		return pods[i].IP.String() < pods[j].IP.String()
+	})
+	buf := bytes.NewBuffer(nil)
+	utiliptables.WriteLine(buf, "*mangle")
+	utiliptables.WriteLine(buf, utiliptables.MakeChainLine(markChain))
+	if len(h.marks) == 0 {
+		utiliptables.WriteLine(buf, "-X", string(markChain))
+	}
+	for i := range pods {
+		if m := h.marks[pods[i].Network]; m != nil && pods[i].IP != nil {
+			utiliptables.WriteLine(buf, append([]string{"-A", string(markChain)}, podRule(&pods[i], m, true)...)...)
+		}
+	}
+	utiliptables.WriteLine(buf, "COMMIT")
+	if err := h.RestoreAll(buf.Bytes(), utiliptables.NoFlushTables, utiliptables.RestoreCounters); err != nil {
+		return fmt.Errorf("failed to execute iptables-restore for rules %s: %v", buf.String(), err)
+	}
+	if len(h.marks) == 0 {
+		glog.Infof("removed network mark rules")
+		return nil
+	}
+	// mark before mangle rules of others which may accept packets early, the mask preserves their marks
+	if _, err := h.EnsureRule(utiliptables.Prepend, utiliptables.TableMangle, utiliptables.ChainPrerouting,
+		jumpArgs()...); err != nil {
+		return fmt.Errorf("failed to ensure that %s chain %s jumps to %s: %v", utiliptables.TableMangle,
+			utiliptables.ChainPrerouting, markChain, err)
+	}
+	return nil
+}
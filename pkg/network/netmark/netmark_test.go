@@ -0,0 +1,147 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package netmark
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"tkestack.io/galaxy/pkg/network/portmapping"
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+	iptablesTest "tkestack.io/galaxy/pkg/utils/iptables/testing"
+)
+
+func TestNew(t *testing.T) {
+	for i, c := range []struct {
+		marks []Mark
+		valid bool
+	}{
+		{marks: []Mark{{Network: "net1", Mark: 1}, {Network: "net2", Mark: 255, Table: 100, Gateway: "10.0.0.1"}},
+			valid: true},
+		{marks: []Mark{{Network: "net1", Mark: 1, Table: 100, Device: "eth1"}}, valid: true},
+		{marks: []Mark{{Mark: 1}}, valid: false},
+		{marks: []Mark{{Network: "net1", Mark: 256}}, valid: false},
+		{marks: []Mark{{Network: "net1", Mark: 1, Table: 254}}, valid: false},
+		{marks: []Mark{{Network: "net1", Mark: 1, Table: portmapping.DSRTableBase + 1}}, valid: false},
+		{marks: []Mark{{Network: "net1", Mark: 1, Table: portmapping.DSRTableMax + 1}}, valid: true},
+		{marks: []Mark{{Network: "net1", Mark: 1, Gateway: "10.0.0.1"}}, valid: false},
+		{marks: []Mark{{Network: "net1", Mark: 1, Table: 100, Gateway: "a"}}, valid: false},
+		{marks: []Mark{{Network: "net1", Mark: 1}, {Network: "net1", Mark: 2}}, valid: false},
+		{marks: []Mark{{Network: "net1", Mark: 1}, {Network: "net2", Mark: 1}}, valid: false},
+	} {
+		if _, err := New(c.marks); (err == nil) != c.valid {
+			t.Errorf("case %d: expect valid %v, real err %v", i, c.valid, err)
+		}
+	}
+}
+
+type fakeRouter struct {
+	marks []*Mark
+}
+
+func (r *fakeRouter) Sync(marks []*Mark) error {
+	r.marks = marks
+	return nil
+}
+
+func checkMangle(t *testing.T, fakeCli utiliptables.Interface, expect string) {
+	buf := bytes.NewBuffer(nil)
+	if err := fakeCli.SaveInto(utiliptables.TableMangle, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expect {
+		t.Fatalf("expect %s, real %s", expect, buf.String())
+	}
+}
+
+// #lizard forgives
+func TestSync(t *testing.T) {
+	fakeCli := iptablesTest.NewFakeIPTables()
+	router := &fakeRouter{}
+	h, err := New([]Mark{{Network: "net2", Mark: 2, Table: 200}, {Network: "net1", Mark: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	h.Interface, h.router, h.now = fakeCli, router, func() time.Time { return now }
+	pods := []Pod{
+		{Name: "default/pod-2", Network: "net2", IP: net.ParseIP("10.1.0.2")},
+		{Name: "default/pod-1", Network: "net1", IP: net.ParseIP("10.0.0.2")},
+		{Name: "default/pod-3", Network: "net3", IP: net.ParseIP("10.2.0.2")},
+	}
+	for i := 0; i < 2; i++ {
+		// syncing again doesn't duplicate rules
+		if err := h.Sync(pods); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(router.marks) != 2 || router.marks[0].Network != "net1" || router.marks[1].Network != "net2" {
+		t.Fatalf("expect marks of net1 and net2, real %v", router.marks)
+	}
+	// a pod whose ADD is in progress isn't listed but stays marked
+	if err := h.Add(Pod{Name: "default/pod-4", Network: "net1", IP: net.ParseIP("10.0.0.4")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Sync(pods[:2]); err != nil {
+		t.Fatal(err)
+	}
+	checkMangle(t, fakeCli, `*mangle
+:FORWARD - [0:0]
+:GALAXY-NETMARK - [0:0]
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+:POSTROUTING - [0:0]
+:PREROUTING - [0:0]
+-A GALAXY-NETMARK -m comment --comment "default/pod-1 net1" -s 10.0.0.2/32 -j MARK --set-xmark 0x1000000/0xff000000
+-A GALAXY-NETMARK -m comment --comment "default/pod-2 net2" -s 10.1.0.2/32 -j MARK --set-xmark 0x2000000/0xff000000
+-A GALAXY-NETMARK -m comment --comment "default/pod-4 net1" -s 10.0.0.4/32 -j MARK --set-xmark 0x1000000/0xff000000
+-A PREROUTING -m comment --comment "galaxy network marks" -j GALAXY-NETMARK
+COMMIT
+`)
+	now = now.Add(pendingTTL + time.Second)
+	if err := h.Sync(pods[1:2]); err != nil {
+		t.Fatal(err)
+	}
+	checkMangle(t, fakeCli, `*mangle
+:FORWARD - [0:0]
+:GALAXY-NETMARK - [0:0]
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+:POSTROUTING - [0:0]
+:PREROUTING - [0:0]
+-A GALAXY-NETMARK -m comment --comment "default/pod-1 net1" -s 10.0.0.2/32 -j MARK --set-xmark 0x1000000/0xff000000
+-A PREROUTING -m comment --comment "galaxy network marks" -j GALAXY-NETMARK
+COMMIT
+`)
+	h.marks = map[string]*Mark{}
+	if err := h.Sync(pods); err != nil {
+		t.Fatal(err)
+	}
+	checkMangle(t, fakeCli, `*mangle
+:FORWARD - [0:0]
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+:POSTROUTING - [0:0]
+:PREROUTING - [0:0]
+COMMIT
+`)
+	if len(router.marks) != 0 {
+		t.Fatalf("expect no marks, real %v", router.marks)
+	}
+}
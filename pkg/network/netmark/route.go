@@ -0,0 +1,108 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package netmark
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"tkestack.io/galaxy/pkg/utils"
+)
+
+// rulePriority is the priority of ip rules of network marks, they are looked up after those of DSR marks and before
+// the main table
+const rulePriority = 1100
+
+// netlinkRouter routes packets of marks by an ip rule per mark
+type netlinkRouter struct{}
+
+func ipRule(m *Mark) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Mark = m.Mark << markShift
+	rule.Mask = MarkMask
+	rule.Table = m.Table
+	rule.Priority = rulePriority
+	return rule
+}
+
+func defaultRoute(m *Mark) (*netlink.Route, error) {
+	route := &netlink.Route{
+		Dst:   &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+		Gw:    net.ParseIP(m.Gateway),
+		Table: m.Table,
+	}
+	if m.Device != "" {
+		link, err := netlink.LinkByName(m.Device)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get device %s: %v", m.Device, err)
+		}
+		route.LinkIndex = link.Attrs().Index
+	}
+	if route.Gw == nil {
+		route.Scope = netlink.SCOPE_LINK
+	}
+	return route, nil
+}
+
+func (netlinkRouter) Sync(marks []*Mark) error {
+	want := map[int]*Mark{}
+	for _, m := range marks {
+		if m.Table == 0 {
+			continue
+		}
+		want[m.Mark<<markShift] = m
+		if m.Gateway != "" || m.Device != "" {
+			route, err := defaultRoute(m)
+			if err != nil {
+				return err
+			}
+			if err := netlink.RouteReplace(route); err != nil {
+				return fmt.Errorf("failed to replace default route of table %d: %v", m.Table, err)
+			}
+		}
+	}
+	rules, err := netlink.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	found := map[int]bool{}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Priority != rulePriority {
+			continue
+		}
+		if m := want[rule.Mark]; m != nil && rule.Mask == MarkMask && rule.Table == m.Table && !found[rule.Mark] {
+			found[rule.Mark] = true
+			continue
+		}
+		// rules of marks deleted from config or whose tables changed, tables themselves are left as they are
+		if err := netlink.RuleDel(rule); err != nil && !utils.IsErrno(err, syscall.ENOENT) {
+			return fmt.Errorf("failed to delete rule %v: %v", rule, err)
+		}
+	}
+	for value, m := range want {
+		if found[value] {
+			continue
+		}
+		if err := netlink.RuleAdd(ipRule(m)); err != nil {
+			return fmt.Errorf("failed to add rule of network %s mark %d: %v", m.Network, m.Mark, err)
+		}
+	}
+	return nil
+}
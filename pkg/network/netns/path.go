@@ -0,0 +1,100 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package netns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"golang.org/x/sys/unix"
+)
+
+// procPathRegexp matches netns paths of processes and threads, e.g. /proc/<pid>/ns/net, which some runtimes pass
+// instead of paths bind mounted under /var/run/netns
+var procPathRegexp = regexp.MustCompile(`^/proc/([0-9]+)(/task/([0-9]+))?/ns/net$`)
+
+// IsProcPath returns true if path is the netns of a process or thread. Unlike a bind mounted path, it is gone once
+// the process exits and may refer to another netns after the pid is reused.
+func IsProcPath(path string) bool {
+	return procPathRegexp.MatchString(path)
+}
+
+// Normalize returns the clean form of the netns path, the netns of the main thread of a process is /proc/<pid>/ns/net
+func Normalize(path string) string {
+	if path == "" {
+		return ""
+	}
+	path = filepath.Clean(path)
+	if m := procPathRegexp.FindStringSubmatch(path); m != nil && m[1] == m[3] {
+		return fmt.Sprintf("/proc/%s/ns/net", m[1])
+	}
+	return path
+}
+
+// ID is the identity of a netns, which stays the same for all paths referring to it
+type ID struct {
+	Dev uint64
+	Ino uint64
+}
+
+func (id *ID) String() string {
+	return fmt.Sprintf("%d:%d", id.Dev, id.Ino)
+}
+
+// Identify returns the identity of the netns which path refers to
+func Identify(path string) (*ID, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	return &ID{Dev: uint64(st.Dev), Ino: st.Ino}, nil
+}
+
+// MismatchError is the error of a netns path which refers to another netns than expected
+type MismatchError struct {
+	Path     string
+	Expected *ID
+	Actual   *ID
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("%s refers to netns %s instead of %s, the pid may be reused", e.Path, e.Actual, e.Expected)
+}
+
+// Verify checks that path still refers to the netns of id, which is not checked if id is nil. The error satisfies
+// os.IsNotExist if path is gone and is a MismatchError if it refers to another netns.
+func Verify(path string, id *ID) error {
+	cur, err := Identify(path)
+	if err != nil {
+		return err
+	}
+	if id != nil && *cur != *id {
+		return &MismatchError{Path: path, Expected: id, Actual: cur}
+	}
+	return nil
+}
+
+// Gone returns true if path doesn't exist or no longer refers to the netns of id
+func Gone(path string, id *ID) bool {
+	err := Verify(path, id)
+	if _, ok := err.(*MismatchError); ok {
+		return true
+	}
+	return os.IsNotExist(err)
+}
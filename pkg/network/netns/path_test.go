@@ -0,0 +1,86 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package netns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	for _, c := range []struct {
+		path, expect string
+		proc         bool
+	}{
+		{path: "", expect: ""},
+		{path: "/var/run/netns/cni-1234", expect: "/var/run/netns/cni-1234"},
+		{path: "/var/run/netns//cni-1234/", expect: "/var/run/netns/cni-1234"},
+		{path: "/proc/1234/ns/net", expect: "/proc/1234/ns/net", proc: true},
+		{path: "/proc//1234/ns/net/", expect: "/proc/1234/ns/net", proc: true},
+		{path: "/proc/1234/task/1234/ns/net", expect: "/proc/1234/ns/net", proc: true},
+		{path: "/proc/1234/task/1235/ns/net", expect: "/proc/1234/task/1235/ns/net", proc: true},
+		{path: "/proc/self/ns/net", expect: "/proc/self/ns/net"},
+		{path: "/proc/1234/ns/mnt", expect: "/proc/1234/ns/mnt"},
+	} {
+		if got := Normalize(c.path); got != c.expect {
+			t.Errorf("Normalize(%q) = %q, expect %q", c.path, got, c.expect)
+		}
+		if got := IsProcPath(Normalize(c.path)); got != c.proc {
+			t.Errorf("IsProcPath(%q) = %v, expect %v", c.path, got, c.proc)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	self := fmt.Sprintf("/proc/%d/ns/net", os.Getpid())
+	id, err := Identify(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(self, id); err != nil {
+		t.Fatal(err)
+	}
+	if Gone(self, id) || Gone(self, nil) {
+		t.Fatal("netns of self is gone")
+	}
+	// a file stands for the netns which the pid refers to after it is reused
+	other := filepath.Join(dir, "other")
+	if err := ioutil.WriteFile(other, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Verify(other, id).(*MismatchError); !ok {
+		t.Fatalf("expect MismatchError, got %v", Verify(other, id))
+	}
+	if !Gone(other, id) {
+		t.Fatal("expect gone as it refers to another netns")
+	}
+	gone := filepath.Join(dir, "gone")
+	if err := Verify(gone, id); !os.IsNotExist(err) {
+		t.Fatalf("expect not exist, got %v", err)
+	}
+	if !Gone(gone, nil) {
+		t.Fatal("expect gone")
+	}
+}
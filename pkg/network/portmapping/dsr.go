@@ -0,0 +1,251 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package portmapping
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+)
+
+// Packets of DSR ports are marked in mangle PREROUTING by destination VIP:HostPort. Each pod having DSR ports owns a
+// mark, which selects a route table whose default route goes via the pod ip, so packets reach the pod with their
+// original destination and the pod replies to clients directly.
+const (
+	dsrChain utiliptables.Chain = "GALAXY-DSR"
+	// dsrMarkMask must not overlap with marks of kube-proxy (0x4000, 0x8000)
+	dsrMarkMask  = 0xff0000
+	dsrMarkShift = 16
+	// maxDSRPods is the max number of pods having DSR ports on a node
+	maxDSRPods = dsrMarkMask >> dsrMarkShift
+	// DSRTableBase is the route table of the first DSR mark, tables of marks are DSRTableBase + id
+	DSRTableBase = 7000
+	// DSRTableMax is the route table of the last DSR mark
+	DSRTableMax = DSRTableBase + maxDSRPods
+)
+
+// dsrRouter routes packets of DSR marks to pods
+type dsrRouter interface {
+	// Route routes packets of the mark id to podIP
+	Route(id int, podIP net.IP) error
+	// Delete deletes the route of the mark id
+	Delete(id int) error
+	// Sync replaces routes of all marks with routes
+	Sync(routes map[int]net.IP) error
+}
+
+// ValidateDSR returns an error if port is DSR and can't be delivered without rewriting its destination
+func ValidateDSR(port *k8s.Port) error {
+	if port.VIP == "" {
+		return nil
+	}
+	if ip := net.ParseIP(port.VIP); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("bad vip %q of port %d", port.VIP, port.ContainerPort)
+	}
+	if port.HostPort != port.ContainerPort {
+		return fmt.Errorf("hostPort %d of dsr port %d must equal containerPort", port.HostPort, port.ContainerPort)
+	}
+	return nil
+}
+
+func dsrMark(id int) string {
+	return fmt.Sprintf("0x%x/0x%x", id<<dsrMarkShift, dsrMarkMask)
+}
+
+// dsrRule returns the rule of GALAXY-DSR chain which marks packets of port
+// -A GALAXY-DSR -m comment --comment "pod-1 dsr 10.0.0.100:80" -d 10.0.0.100/32 -m tcp -p tcp --dport 80 -j MARK
+// --set-xmark 0x10000/0xff0000
+func dsrRule(port *k8s.Port, id int, iptablesRestore bool) []string {
+	comment := fmt.Sprintf("%s dsr %s:%d", port.PodName, port.VIP, port.HostPort)
+	if iptablesRestore {
+		comment = `"` + comment + `"`
+	}
+	protocol := strings.ToLower(port.Protocol)
+	return []string{"-m", "comment", "--comment", comment, "-d", port.VIP + "/32", "-m", protocol, "-p", protocol,
+		"--dport", fmt.Sprintf("%d", port.HostPort), "-j", "MARK", "--set-xmark", dsrMark(id)}
+}
+
+func dsrPorts(ports []k8s.Port) []k8s.Port {
+	var result []k8s.Port
+	for i := range ports {
+		if ports[i].VIP != "" {
+			result = append(result, ports[i])
+		}
+	}
+	return result
+}
+
+// allocDSRID returns the mark id of podIP, it allocates the smallest free one if podIP has none
+func (h *PortMappingHandler) allocDSRID(podIP string) (int, error) {
+	if h.dsrIDs == nil {
+		h.dsrIDs = map[string]int{}
+	}
+	if id, ok := h.dsrIDs[podIP]; ok {
+		return id, nil
+	}
+	used := map[int]bool{}
+	for _, id := range h.dsrIDs {
+		used[id] = true
+	}
+	for id := 1; id <= maxDSRPods; id++ {
+		if !used[id] {
+			h.dsrIDs[podIP] = id
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("no free dsr mark, at most %d pods on a node can have dsr ports", maxDSRPods)
+}
+
+func (h *PortMappingHandler) ensureDSRChain() error {
+	if _, err := h.EnsureChain(utiliptables.TableMangle, dsrChain); err != nil {
+		return fmt.Errorf("failed to ensure %s chain %s: %v", utiliptables.TableMangle, dsrChain, err)
+	}
+	if _, err := h.EnsureRule(utiliptables.Append, utiliptables.TableMangle, utiliptables.ChainPrerouting,
+		"-j", string(dsrChain)); err != nil {
+		return fmt.Errorf("failed to ensure %s chain %s jumps to %s: %v", utiliptables.TableMangle,
+			utiliptables.ChainPrerouting, dsrChain, err)
+	}
+	return nil
+}
+
+func (h *PortMappingHandler) hasDSRChain() bool {
+	buf := bytes.NewBuffer(nil)
+	if err := h.SaveInto(utiliptables.TableMangle, buf); err != nil {
+		glog.Warningf("failed to save %s table: %v", utiliptables.TableMangle, err)
+		return true
+	}
+	_, ok := utiliptables.GetChainLines(utiliptables.TableMangle, buf.Bytes())[dsrChain]
+	return ok
+}
+
+// setupDSR routes DSR ports of a pod to it
+func (h *PortMappingHandler) setupDSR(ports []k8s.Port) error {
+	ports = dsrPorts(ports)
+	if len(ports) == 0 {
+		return nil
+	}
+	for i := range ports {
+		if err := ValidateDSR(&ports[i]); err != nil {
+			return err
+		}
+	}
+	h.dsrLock.Lock()
+	defer h.dsrLock.Unlock()
+	if err := h.ensureDSRChain(); err != nil {
+		return err
+	}
+	for i := range ports {
+		id, err := h.allocDSRID(ports[i].PodIP)
+		if err != nil {
+			return err
+		}
+		if err := h.router.Route(id, net.ParseIP(ports[i].PodIP)); err != nil {
+			return fmt.Errorf("failed to route dsr mark %d to %s: %v", id, ports[i].PodIP, err)
+		}
+		rule := dsrRule(&ports[i], id, false)
+		if err := h.withRetry(func() error {
+			_, err := h.EnsureRule(utiliptables.Append, utiliptables.TableMangle, dsrChain, rule...)
+			return err
+		}); err != nil {
+			return fmt.Errorf("failed to add rule %s: %v", rule, err)
+		}
+	}
+	return nil
+}
+
+// cleanDSR deletes rules and routes of DSR ports of a pod
+func (h *PortMappingHandler) cleanDSR(ports []k8s.Port) error {
+	ports = dsrPorts(ports)
+	if len(ports) == 0 {
+		return nil
+	}
+	h.dsrLock.Lock()
+	defer h.dsrLock.Unlock()
+	for i := range ports {
+		id, ok := h.dsrIDs[ports[i].PodIP]
+		if !ok {
+			continue
+		}
+		rule := dsrRule(&ports[i], id, false)
+		if err := h.withRetry(func() error {
+			return h.DeleteRule(utiliptables.TableMangle, dsrChain, rule...)
+		}); err != nil {
+			return fmt.Errorf("failed to delete rule %s: %v", rule, err)
+		}
+	}
+	for i := range ports {
+		id, ok := h.dsrIDs[ports[i].PodIP]
+		if !ok {
+			continue
+		}
+		if err := h.router.Delete(id); err != nil {
+			return fmt.Errorf("failed to delete route of dsr mark %d: %v", id, err)
+		}
+		delete(h.dsrIDs, ports[i].PodIP)
+	}
+	return nil
+}
+
+// syncAllDSR rewrites GALAXY-DSR chain and routes for DSR ports of all pods, marks are reallocated
+func (h *PortMappingHandler) syncAllDSR(ports []k8s.Port) error {
+	h.dsrLock.Lock()
+	defer h.dsrLock.Unlock()
+	ports = dsrPorts(ports)
+	// allocate marks in order of pod ips so that marks are stable across restarts
+	sort.SliceStable(ports, func(i, j int) bool {
+		return ports[i].PodIP < ports[j].PodIP
+	})
+	h.dsrIDs = map[string]int{}
+	routes := map[int]net.IP{}
+	mangleLines := bytes.NewBuffer(nil)
+	writeLine(mangleLines, "*mangle")
+	writeLine(mangleLines, utiliptables.MakeChainLine(dsrChain))
+	for i := range ports {
+		if err := ValidateDSR(&ports[i]); err != nil {
+			glog.Warningf("skip dsr of pod %s: %v", ports[i].PodName, err)
+			continue
+		}
+		id, err := h.allocDSRID(ports[i].PodIP)
+		if err != nil {
+			glog.Warningf("skip dsr of pod %s: %v", ports[i].PodName, err)
+			continue
+		}
+		routes[id] = net.ParseIP(ports[i].PodIP)
+		writeLine(mangleLines, append([]string{"-A", string(dsrChain)}, dsrRule(&ports[i], id, true)...)...)
+	}
+	writeLine(mangleLines, "COMMIT")
+	if len(routes) == 0 && !h.hasDSRChain() {
+		// most nodes never have dsr ports, leave mangle table and ip rules untouched
+		return nil
+	}
+	if err := h.ensureDSRChain(); err != nil {
+		return err
+	}
+	if err := h.RestoreAll(mangleLines.Bytes(), utiliptables.NoFlushTables, utiliptables.RestoreCounters); err != nil {
+		return fmt.Errorf("failed to execute iptables-restore for rules %s: %v", mangleLines.String(), err)
+	}
+	if err := h.router.Sync(routes); err != nil {
+		return fmt.Errorf("failed to sync dsr routes: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package portmapping
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"tkestack.io/galaxy/pkg/utils"
+)
+
+// dsrRulePriority is the priority of ip rules of DSR marks, they must be looked up before the main table
+const dsrRulePriority = 1000
+
+// netlinkDSRRouter routes packets of DSR marks by an ip rule and a route table per mark
+type netlinkDSRRouter struct{}
+
+func dsrIPRule(id int) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Mark = id << dsrMarkShift
+	rule.Mask = dsrMarkMask
+	rule.Table = DSRTableBase + id
+	rule.Priority = dsrRulePriority
+	return rule
+}
+
+func (netlinkDSRRouter) Route(id int, podIP net.IP) error {
+	if err := netlink.RouteReplace(&netlink.Route{
+		Dst:   &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+		Gw:    podIP,
+		Table: DSRTableBase + id,
+	}); err != nil {
+		return fmt.Errorf("failed to replace default route of table %d: %v", DSRTableBase+id, err)
+	}
+	if err := netlink.RuleDel(dsrIPRule(id)); err != nil && !utils.IsErrno(err, syscall.ENOENT) {
+		return fmt.Errorf("failed to delete old rule of mark %d: %v", id, err)
+	}
+	if err := netlink.RuleAdd(dsrIPRule(id)); err != nil {
+		return fmt.Errorf("failed to add rule of mark %d: %v", id, err)
+	}
+	return nil
+}
+
+func (netlinkDSRRouter) Delete(id int) error {
+	if err := netlink.RuleDel(dsrIPRule(id)); err != nil && !utils.IsErrno(err, syscall.ENOENT) {
+		return fmt.Errorf("failed to delete rule of mark %d: %v", id, err)
+	}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: DSRTableBase + id},
+		netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	for i := range routes {
+		if err := netlink.RouteDel(&routes[i]); err != nil && !utils.IsErrno(err, syscall.ESRCH) {
+			return fmt.Errorf("failed to delete route %v: %v", routes[i], err)
+		}
+	}
+	return nil
+}
+
+// Sync routes marks of routes and deletes rules and routes of other marks, e.g. those left by pods deleted while
+// galaxy was down
+func (r netlinkDSRRouter) Sync(routes map[int]net.IP) error {
+	for id, podIP := range routes {
+		if err := r.Route(id, podIP); err != nil {
+			return err
+		}
+	}
+	rules, err := netlink.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		id := rule.Table - DSRTableBase
+		if rule.Priority != dsrRulePriority || id < 1 || id > maxDSRPods || routes[id] != nil {
+			continue
+		}
+		if err := r.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
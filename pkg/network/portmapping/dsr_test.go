@@ -0,0 +1,148 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package portmapping
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"tkestack.io/galaxy/pkg/api/k8s"
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+	iptablesTest "tkestack.io/galaxy/pkg/utils/iptables/testing"
+)
+
+type fakeDSRRouter struct {
+	routes map[int]string
+}
+
+func (r *fakeDSRRouter) Route(id int, podIP net.IP) error {
+	r.routes[id] = podIP.String()
+	return nil
+}
+
+func (r *fakeDSRRouter) Delete(id int) error {
+	delete(r.routes, id)
+	return nil
+}
+
+func (r *fakeDSRRouter) Sync(routes map[int]net.IP) error {
+	r.routes = map[int]string{}
+	for id, ip := range routes {
+		r.routes[id] = ip.String()
+	}
+	return nil
+}
+
+func TestValidateDSR(t *testing.T) {
+	for i, c := range []struct {
+		port  k8s.Port
+		valid bool
+	}{
+		{port: k8s.Port{HostPort: 80, ContainerPort: 8080}, valid: true},
+		{port: k8s.Port{HostPort: 80, ContainerPort: 80, VIP: "10.0.0.100"}, valid: true},
+		{port: k8s.Port{HostPort: 80, ContainerPort: 8080, VIP: "10.0.0.100"}, valid: false},
+		{port: k8s.Port{HostPort: 80, ContainerPort: 80, VIP: "fe80::1"}, valid: false},
+		{port: k8s.Port{HostPort: 80, ContainerPort: 80, VIP: "vip"}, valid: false},
+	} {
+		if err := ValidateDSR(&c.port); (err == nil) != c.valid {
+			t.Errorf("case %d: expect valid %v, real err %v", i, c.valid, err)
+		}
+	}
+}
+
+func mangleRules(t *testing.T, fakeCli utiliptables.Interface) string {
+	buf := bytes.NewBuffer(nil)
+	if err := fakeCli.SaveInto(utiliptables.TableMangle, buf); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "-A") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// #lizard forgives
+func TestDSR(t *testing.T) {
+	fakeCli := iptablesTest.NewFakeIPTables()
+	router := &fakeDSRRouter{routes: map[int]string{}}
+	h := &PortMappingHandler{Interface: fakeCli, podPortMap: make(map[string]map[hostport]closeable), router: router}
+	pod1 := []k8s.Port{
+		{HostPort: 80, ContainerPort: 80, Protocol: "TCP", PodName: "pod-1", PodIP: "192.168.0.2", VIP: "10.0.0.100"},
+		{HostPort: 9090, ContainerPort: 9090, Protocol: "TCP", PodName: "pod-1", PodIP: "192.168.0.2"},
+	}
+	pod2 := []k8s.Port{
+		{HostPort: 53, ContainerPort: 53, Protocol: "UDP", PodName: "pod-2", PodIP: "192.168.0.3", VIP: "10.0.0.100"},
+	}
+	// no dsr port leaves mangle table untouched
+	if err := h.SetupPortMappingForAllPods(nil); err != nil {
+		t.Fatal(err)
+	}
+	if rules := mangleRules(t, fakeCli); rules != "" {
+		t.Fatalf("expect no mangle rules, real %s", rules)
+	}
+	if err := h.SetupPortMapping(pod1); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetupPortMapping(pod2); err != nil {
+		t.Fatal(err)
+	}
+	expect := `-A GALAXY-DSR -m comment --comment "pod-1 dsr 10.0.0.100:80" -d 10.0.0.100/32 -m tcp -p tcp --dport 80 -j MARK --set-xmark 0x10000/0xff0000
+-A GALAXY-DSR -m comment --comment "pod-2 dsr 10.0.0.100:53" -d 10.0.0.100/32 -m udp -p udp --dport 53 -j MARK --set-xmark 0x20000/0xff0000
+-A PREROUTING -j GALAXY-DSR`
+	if rules := mangleRules(t, fakeCli); rules != expect {
+		t.Fatalf("expect %s, real %s", expect, rules)
+	}
+	if !reflect.DeepEqual(router.routes, map[int]string{1: "192.168.0.2", 2: "192.168.0.3"}) {
+		t.Fatalf("unexpected routes %v", router.routes)
+	}
+	if err := h.CleanPortMapping(pod1); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(router.routes, map[int]string{2: "192.168.0.3"}) {
+		t.Fatalf("unexpected routes %v", router.routes)
+	}
+	// the freed mark is reused
+	if err := h.SetupPortMapping(pod1); err != nil {
+		t.Fatal(err)
+	}
+	if h.dsrIDs["192.168.0.2"] != 1 {
+		t.Fatalf("expect mark 1 reused, real %v", h.dsrIDs)
+	}
+	// marks are reallocated by pod ips on sync
+	if err := h.SetupPortMappingForAllPods(pod2); err != nil {
+		t.Fatal(err)
+	}
+	expect = `-A GALAXY-DSR -m comment --comment "pod-2 dsr 10.0.0.100:53" -d 10.0.0.100/32 -m udp -p udp --dport 53 -j MARK --set-xmark 0x10000/0xff0000
+-A PREROUTING -j GALAXY-DSR`
+	if rules := mangleRules(t, fakeCli); rules != expect {
+		t.Fatalf("expect %s, real %s", expect, rules)
+	}
+	if !reflect.DeepEqual(router.routes, map[int]string{1: "192.168.0.3"}) {
+		t.Fatalf("unexpected routes %v", router.routes)
+	}
+	bad := []k8s.Port{{HostPort: 8080, ContainerPort: 80, Protocol: "TCP", PodName: "pod-3", PodIP: "192.168.0.4",
+		VIP: "10.0.0.100"}}
+	if err := h.SetupPortMapping(bad); err == nil {
+		t.Fatal("expect error of dsr port with different hostPort")
+	}
+}
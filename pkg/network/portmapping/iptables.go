@@ -28,8 +28,6 @@ import (
 
 	"k8s.io/apimachinery/pkg/util/wait"
 	glog "k8s.io/klog"
-	utildbus "k8s.io/kubernetes/pkg/util/dbus"
-	utilexec "k8s.io/utils/exec"
 	"tkestack.io/galaxy/pkg/api/k8s"
 	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
 )
@@ -46,20 +44,37 @@ const (
 type PortMappingHandler struct {
 	utiliptables.Interface
 	podPortMap map[string]map[hostport]closeable
+	// podIPs records the ip of pods in podPortMap
+	podIPs map[string]string
 	sync.Mutex
 	natInterfaceName string
+	// shards is the number of chains hostport rules are sharded into, 0 or 1 means all rules are in KUBE-HOSTPORTS
+	shards int
+	// dsrIDs are mark ids of pod ips having DSR ports
+	dsrLock sync.Mutex
+	dsrIDs  map[string]int
+	router  dsrRouter
+	// snatIfaces are host interfaces having a localhost SNAT rule and pod ips behind them
+	snatLock   sync.Mutex
+	snatIfaces map[string]map[string]bool
 }
 
-func New(natInterfaceName string) *PortMappingHandler {
+func New(natInterfaceName string, shards int) *PortMappingHandler {
+	if shards > MaxShards {
+		shards = MaxShards
+	}
 	return &PortMappingHandler{
-		Interface:        utiliptables.New(utilexec.New(), utildbus.New(), utiliptables.ProtocolIpv4),
+		Interface:        utiliptables.Shared(),
 		podPortMap:       make(map[string]map[hostport]closeable),
 		natInterfaceName: natInterfaceName,
+		shards:           shards,
+		dsrIDs:           map[string]int{},
+		router:           netlinkDSRRouter{},
 	}
 }
 
 func (h *PortMappingHandler) SetupPortMapping(ports []k8s.Port) error {
-	var kubeHostportsChainRules [][]string
+	var kubeHostportsChainRules []entryRule
 	natChains := bytes.NewBuffer(nil)
 	natRules := bytes.NewBuffer(nil)
 	writeLine(natChains, "*nat")
@@ -76,8 +91,9 @@ func (h *PortMappingHandler) SetupPortMapping(ports []k8s.Port) error {
 		// can't know exactly all the mapped ports at any given time cause we
 		// don't hold a lock before executing iptables-restore. So we have to
 		// execute add or delete rules of KUBE-HOSTPORTS chain separately
-		kubeHostportsChainRules = append(kubeHostportsChainRules,
-			hostPortChainRules(&containerPort, protocol, hostportChain, false))
+		entryChain := h.entryChain(containerPort.HostPort)
+		kubeHostportsChainRules = append(kubeHostportsChainRules, entryRule{chain: entryChain,
+			args: hostPortChainRules(&containerPort, protocol, entryChain, hostportChain, false)})
 
 		containerPortChainRules(&containerPort, protocol, hostportChain, natRules)
 	}
@@ -85,27 +101,40 @@ func (h *PortMappingHandler) SetupPortMapping(ports []k8s.Port) error {
 	writeLine(natRules, "COMMIT")
 
 	natLines := append(natChains.Bytes(), natRules.Bytes()...)
-	err := h.RestoreAll(natLines, utiliptables.NoFlushTables, utiliptables.RestoreCounters)
-	if err != nil {
+	if err := h.withRetry(func() error {
+		return h.RestoreAll(natLines, utiliptables.NoFlushTables, utiliptables.RestoreCounters)
+	}); err != nil {
 		return fmt.Errorf("Failed to execute iptables-restore for ruls %s: %v", string(natLines), err)
 	}
 
 	for _, rule := range kubeHostportsChainRules {
-		if _, err := h.EnsureRule(utiliptables.Append, utiliptables.TableNAT, kubeHostportsChain, rule...); err != nil {
-			return fmt.Errorf("failed to add rule %s: %v", rule, err)
+		if err := h.withRetry(func() error {
+			_, err := h.EnsureRule(utiliptables.Append, utiliptables.TableNAT, rule.chain, rule.args...)
+			return err
+		}); err != nil {
+			return fmt.Errorf("failed to add rule %s: %v", rule.args, err)
 		}
 	}
-	return nil
+	if err := h.ensureLocalSNAT(ports); err != nil {
+		return err
+	}
+	return h.setupDSR(ports)
 }
 
-// hostPortChainRules returns KUBE-HOSTPORTS chain rules which redirects host port traffic to KUBE-HP-RFXFJMOOGLRQFWRB chain
+// entryRule is a rule of KUBE-HOSTPORTS or a shard chain which jumps to a hostport chain
+type entryRule struct {
+	chain utiliptables.Chain
+	args  []string
+}
+
+// hostPortChainRules returns KUBE-HOSTPORTS (or shard) chain rules which redirects host port traffic to KUBE-HP-RFXFJMOOGLRQFWRB chain
 // -A KUBE-HOSTPORTS -p tcp -m comment --comment "hostport-74597bd87c-vpqh8 hostport 8080" -m tcp --dport 8080 -j KUBE-HP-RFXFJMOOGLRQFWRB
-func hostPortChainRules(containerPort *k8s.Port, protocol string, hostportChain utiliptables.Chain,
+func hostPortChainRules(containerPort *k8s.Port, protocol string, entryChain, hostportChain utiliptables.Chain,
 	iptablesRestore bool) []string {
 	var args []string
 	if iptablesRestore {
 		args = []string{
-			"-A", string(kubeHostportsChain),
+			"-A", string(entryChain),
 			"-m", "comment", "--comment",
 			fmt.Sprintf(`"%s hostport %d"`, containerPort.PodName, containerPort.HostPort)}
 	} else {
@@ -145,7 +174,7 @@ func containerPortChainRules(containerPort *k8s.Port, protocol string, hostportC
 }
 
 func (h *PortMappingHandler) CleanPortMapping(ports []k8s.Port) error {
-	var kubeHostportsChainRules [][]string
+	var kubeHostportsChainRules []entryRule
 	natChains := bytes.NewBuffer(nil)
 	natRules := bytes.NewBuffer(nil)
 	writeLine(natChains, "*nat")
@@ -156,19 +185,24 @@ func (h *PortMappingHandler) CleanPortMapping(ports []k8s.Port) error {
 		// write chain name
 		writeLine(natChains, utiliptables.MakeChainLine(hostportChain))
 		writeLine(natRules, "-X", string(hostportChain))
-		kubeHostportsChainRules = append(kubeHostportsChainRules,
-			hostPortChainRules(&containerPort, protocol, hostportChain, false))
+		entryChain := h.entryChain(containerPort.HostPort)
+		kubeHostportsChainRules = append(kubeHostportsChainRules, entryRule{chain: entryChain,
+			args: hostPortChainRules(&containerPort, protocol, entryChain, hostportChain, false)})
 	}
 
 	writeLine(natRules, "COMMIT")
 
 	natLines := append(natChains.Bytes(), natRules.Bytes()...)
 
+	if err := h.cleanDSR(ports); err != nil {
+		glog.Warning(err)
+		return err
+	}
 	for _, rule := range kubeHostportsChainRules {
 		if err := h.withRetry(func() error {
-			return h.DeleteRule(utiliptables.TableNAT, kubeHostportsChain, rule...)
+			return h.DeleteRule(utiliptables.TableNAT, rule.chain, rule.args...)
 		}); err != nil {
-			err = fmt.Errorf("failed to delete rule %s: %v", rule, err)
+			err = fmt.Errorf("failed to delete rule %s: %v", rule.args, err)
 			glog.Warning(err)
 			return err
 		}
@@ -180,14 +214,47 @@ func (h *PortMappingHandler) CleanPortMapping(ports []k8s.Port) error {
 		glog.Warning(err)
 		return err
 	}
+	if err := h.cleanLocalSNAT(ports); err != nil {
+		glog.Warning(err)
+		return err
+	}
 	return nil
 }
 
+// MissingPortMappings returns ports whose entry rule or DNAT rule is gone from the nat table, e.g. flushed by
+// someone else, SetupPortMapping of them restores the rules
+func (h *PortMappingHandler) MissingPortMappings(ports []k8s.Port) ([]k8s.Port, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := h.SaveInto(utiliptables.TableNAT, buf); err != nil {
+		return nil, fmt.Errorf("failed to execute iptables-save: %v", err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	var missing []k8s.Port
+	for _, containerPort := range ports {
+		hostportChain := hostportChainName(containerPort, containerPort.PodName)
+		entryPrefix := fmt.Sprintf("-A %s ", h.entryChain(containerPort.HostPort))
+		dnatPrefix := fmt.Sprintf("-A %s ", hostportChain)
+		dnatTarget := fmt.Sprintf("-j DNAT --to-destination %s:%d", containerPort.PodIP, containerPort.ContainerPort)
+		var entry, dnat bool
+		for _, line := range lines {
+			if strings.HasPrefix(line, entryPrefix) && strings.HasSuffix(line, "-j "+string(hostportChain)) {
+				entry = true
+			} else if strings.HasPrefix(line, dnatPrefix) && strings.HasSuffix(line, dnatTarget) {
+				dnat = true
+			}
+		}
+		if !entry || !dnat {
+			missing = append(missing, containerPort)
+		}
+	}
+	return missing, nil
+}
+
 func (h *PortMappingHandler) withRetry(f func() error) error {
 	return wait.PollImmediate(time.Millisecond*100, time.Second*30, func() (done bool, err error) {
 		if err = f(); err == nil {
 			return true, nil
-		} else if strings.Contains(err.Error(), "Resource temporarily unavailable") {
+		} else if utiliptables.IsLockError(err) {
 			return false, nil
 		} else {
 			glog.Error(err)
@@ -219,11 +286,22 @@ func (h *PortMappingHandler) SetupPortMappingForAllPods(ports []k8s.Port) error
 	writeKubeMarkRule(natChains, natRules)
 	// Make sure we keep stats for the top-level chains, if they existed
 	// (which most should have because we created them above).
-	if chain, ok := existingNATChains[kubeHostportsChain]; ok {
-		writeLine(natChains, chain)
+	var entryChains []utiliptables.Chain
+	if h.sharded() {
+		for shard := 0; shard < h.shards; shard++ {
+			entryChains = append(entryChains, shardChainName(shard))
+		}
 	} else {
-		writeLine(natChains, utiliptables.MakeChainLine(kubeHostportsChain))
+		entryChains = append(entryChains, kubeHostportsChain)
 	}
+	for _, entryChain := range entryChains {
+		if chain, ok := existingNATChains[entryChain]; ok {
+			writeLine(natChains, chain)
+		} else {
+			writeLine(natChains, utiliptables.MakeChainLine(entryChain))
+		}
+	}
+	var kubeHostportsRules [][]string
 
 	// Accumulate NAT chains to keep.
 	activeNATChains := map[utiliptables.Chain]bool{} // use a map as a set
@@ -240,7 +318,12 @@ func (h *PortMappingHandler) SetupPortMappingForAllPods(ports []k8s.Port) error
 		activeNATChains[hostportChain] = true
 
 		// Redirect to hostport chain
-		writeLine(natRules, hostPortChainRules(&containerPort, protocol, hostportChain, true)...)
+		entryChain := h.entryChain(containerPort.HostPort)
+		rule := hostPortChainRules(&containerPort, protocol, entryChain, hostportChain, true)
+		writeLine(natRules, rule...)
+		if !h.sharded() {
+			kubeHostportsRules = append(kubeHostportsRules, rule[2:])
+		}
 
 		containerPortChainRules(&containerPort, protocol, hostportChain, natRules)
 	}
@@ -267,7 +350,13 @@ func (h *PortMappingHandler) SetupPortMappingForAllPods(ports []k8s.Port) error
 	if err != nil {
 		return fmt.Errorf("Failed to execute iptables-restore for ruls %s: %v", string(natLines), err)
 	}
-	return nil
+	if err := h.migrateLayout(existingNATChains, kubeHostportsRules); err != nil {
+		return err
+	}
+	if err := h.syncLocalSNAT(ports, iptablesSaveRaw.Bytes()); err != nil {
+		return err
+	}
+	return h.syncAllDSR(ports)
 }
 
 // Join all words with spaces, terminate with newline and write to buf.
@@ -292,33 +381,27 @@ func (h *PortMappingHandler) EnsureBasicRule() error {
 		glog.Warningf("set policy for %v/%v failed: %v", utiliptables.TableFilter,
 			utiliptables.ChainForward, err.Error())
 	}
-	if _, err := h.Interface.EnsureChain(utiliptables.TableNAT, kubeHostportsChain); err != nil {
+	if h.sharded() {
+		if err := h.ensureShardChains(); err != nil {
+			return err
+		}
+	} else if _, err := h.Interface.EnsureChain(utiliptables.TableNAT, kubeHostportsChain); err != nil {
 		return fmt.Errorf("Failed to ensure that %s chain %s exists: %v", utiliptables.TableNAT,
 			kubeHostportsChain, err)
 	}
-	tableChainsNeedJumpServices := []struct {
-		table utiliptables.Table
-		chain utiliptables.Chain
-	}{
-		{utiliptables.TableNAT, utiliptables.ChainOutput},
-		{utiliptables.TableNAT, utiliptables.ChainPrerouting},
-	}
-	args := []string{"-m", "comment", "--comment", "kube hostport portals",
-		"-m", "addrtype", "--dst-type", "LOCAL",
-		"-j", string(kubeHostportsChain)}
-	for _, tc := range tableChainsNeedJumpServices {
-		if _, err := h.Interface.EnsureRule(utiliptables.Prepend, tc.table, tc.chain, args...); err != nil {
-			return fmt.Errorf("Failed to ensure that %s chain %s jumps to %s: %v", tc.table, tc.chain,
-				kubeHostportsChain, err)
+	portalChain := h.portalChain()
+	for _, jump := range portalJumps(false) {
+		args := append(append([]string{}, jump.Args...), "-j", string(portalChain))
+		if _, err := h.Interface.EnsureRule(utiliptables.Prepend, utiliptables.TableNAT, jump.Chain,
+			args...); err != nil {
+			return fmt.Errorf("Failed to ensure that %s chain %s jumps to %s: %v", utiliptables.TableNAT,
+				jump.Chain, portalChain, err)
 		}
 	}
 	if h.natInterfaceName != "" {
 		// Need to SNAT traffic from localhost
-		args = []string{
-			"-m", "comment", "--comment", "SNAT for localhost access to hostports",
-			"-o", h.natInterfaceName, "-s", "127.0.0.0/8", "-j", "MASQUERADE"}
 		if _, err := h.Interface.EnsureRule(utiliptables.Append, utiliptables.TableNAT, utiliptables.ChainPostrouting,
-			args...); err != nil {
+			localSNATArgs(h.natInterfaceName)...); err != nil {
 			return fmt.Errorf("Failed to ensure that %s chain %s jumps to MASQUERADE: %v", utiliptables.TableNAT,
 				utiliptables.ChainPostrouting, err)
 		}
@@ -151,6 +151,44 @@ COMMIT
 	}
 }
 
+// #lizard forgives
+func TestMissingPortMappings(t *testing.T) {
+	fakeCli := iptablesTest.NewFakeIPTables()
+	h := &PortMappingHandler{
+		Interface:        fakeCli,
+		podPortMap:       make(map[string]map[hostport]closeable),
+		natInterfaceName: "test0",
+	}
+	ports := []k8s.Port{
+		{PodName: "testrdma-2", HostPort: 57119, Protocol: "TCP", ContainerPort: 30008, PodIP: "192.168.0.1"},
+		{PodName: "pod-2", HostPort: 9090, Protocol: "UDP", ContainerPort: 9090, PodIP: "192.168.0.2"},
+	}
+	if err := h.SetupPortMapping(ports); err != nil {
+		t.Fatal(err)
+	}
+	if missing, err := h.MissingPortMappings(ports); err != nil || len(missing) != 0 {
+		t.Fatalf("expect no missing ports, real %v, err %v", missing, err)
+	}
+	if err := fakeCli.FlushChain(utiliptables.TableNAT, hostportChainName(ports[0], ports[0].PodName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fakeCli.DeleteRule(utiliptables.TableNAT, kubeHostportsChain,
+		hostPortChainRules(&ports[1], "udp", kubeHostportsChain, hostportChainName(ports[1], ports[1].PodName),
+			false)...); err != nil {
+		t.Fatal(err)
+	}
+	missing, err := h.MissingPortMappings(ports)
+	if err != nil || len(missing) != 2 {
+		t.Fatalf("expect 2 missing ports, real %v, err %v", missing, err)
+	}
+	if err := h.SetupPortMapping(missing); err != nil {
+		t.Fatal(err)
+	}
+	if missing, err := h.MissingPortMappings(ports); err != nil || len(missing) != 0 {
+		t.Fatalf("expect no missing ports after repairing, real %v, err %v", missing, err)
+	}
+}
+
 func TestSetupPortMappingForAllPods(t *testing.T) {
 	// test SetupPortMappingForAllPods cleans outdated rules
 	fakeCli := iptablesTest.NewFakeIPTables()
@@ -309,3 +347,21 @@ COMMIT
 		t.Errorf("expect %s, real %s", expectTxt, buf.String())
 	}
 }
+
+func BenchmarkSetupPortMapping(b *testing.B) {
+	h := &PortMappingHandler{
+		Interface:        iptablesTest.NewFakeIPTables(),
+		podPortMap:       make(map[string]map[hostport]closeable),
+		natInterfaceName: "test0",
+	}
+	for i := 0; i < b.N; i++ {
+		ports := []k8s.Port{{PodName: fmt.Sprintf("pod-%d", i), HostPort: int32(30000 + i%30000), Protocol: "TCP",
+			ContainerPort: 80, PodIP: "192.168.0.1"}}
+		if err := h.SetupPortMapping(ports); err != nil {
+			b.Fatal(err)
+		}
+		if err := h.CleanPortMapping(ports); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
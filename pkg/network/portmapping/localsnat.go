@@ -0,0 +1,129 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package portmapping
+
+import (
+	"fmt"
+	"strings"
+
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/k8s"
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+)
+
+const localSNATComment = "SNAT for localhost access to hostports"
+
+// localSNATArgs returns the POSTROUTING rule which SNATs localhost access to hostports of pods behind iface
+func localSNATArgs(iface string) []string {
+	return []string{"-m", "comment", "--comment", localSNATComment, "-o", iface, "-s", "127.0.0.0/8",
+		"-j", "MASQUERADE"}
+}
+
+// ensureLocalSNAT ensures the localhost SNAT rule of host interfaces of ports, i.e. the flannel bridge, vlan bridges
+// or host veths of pods. Pods behind an interface share its rule, which is refcounted by their ips.
+func (h *PortMappingHandler) ensureLocalSNAT(ports []k8s.Port) error {
+	h.snatLock.Lock()
+	defer h.snatLock.Unlock()
+	if h.snatIfaces == nil {
+		h.snatIfaces = map[string]map[string]bool{}
+	}
+	for _, port := range ports {
+		iface := port.HostInterface
+		if iface == "" || iface == h.natInterfaceName {
+			continue
+		}
+		if h.snatIfaces[iface] == nil {
+			if err := h.withRetry(func() error {
+				_, err := h.EnsureRule(utiliptables.Append, utiliptables.TableNAT, utiliptables.ChainPostrouting,
+					localSNATArgs(iface)...)
+				return err
+			}); err != nil {
+				return fmt.Errorf("failed to ensure localhost SNAT rule of %s: %v", iface, err)
+			}
+			h.snatIfaces[iface] = map[string]bool{}
+		}
+		h.snatIfaces[iface][port.PodIP] = true
+	}
+	return nil
+}
+
+// cleanLocalSNAT deletes the localhost SNAT rule of host interfaces of ports no pod is behind any more
+func (h *PortMappingHandler) cleanLocalSNAT(ports []k8s.Port) error {
+	h.snatLock.Lock()
+	defer h.snatLock.Unlock()
+	for _, port := range ports {
+		iface := port.HostInterface
+		podIPs, ok := h.snatIfaces[iface]
+		if !ok {
+			continue
+		}
+		delete(podIPs, port.PodIP)
+		if len(podIPs) > 0 {
+			continue
+		}
+		if err := h.withRetry(func() error {
+			return h.DeleteRule(utiliptables.TableNAT, utiliptables.ChainPostrouting, localSNATArgs(iface)...)
+		}); err != nil {
+			return fmt.Errorf("failed to delete localhost SNAT rule of %s: %v", iface, err)
+		}
+		delete(h.snatIfaces, iface)
+	}
+	return nil
+}
+
+// syncLocalSNAT rebuilds localhost SNAT rules of ports of all pods and deletes those of interfaces no pod is behind,
+// saved is the iptables-save output of the nat table
+func (h *PortMappingHandler) syncLocalSNAT(ports []k8s.Port, saved []byte) error {
+	h.snatLock.Lock()
+	h.snatIfaces = nil
+	h.snatLock.Unlock()
+	if err := h.ensureLocalSNAT(ports); err != nil {
+		return err
+	}
+	h.snatLock.Lock()
+	defer h.snatLock.Unlock()
+	for _, iface := range localSNATIfaces(saved) {
+		if _, ok := h.snatIfaces[iface]; ok || iface == h.natInterfaceName {
+			continue
+		}
+		glog.Infof("deleting localhost SNAT rule of %s", iface)
+		if err := h.DeleteRule(utiliptables.TableNAT, utiliptables.ChainPostrouting,
+			localSNATArgs(iface)...); err != nil {
+			return fmt.Errorf("failed to delete localhost SNAT rule of %s: %v", iface, err)
+		}
+	}
+	return nil
+}
+
+// localSNATIfaces returns interfaces of localhost SNAT rules in the iptables-save output of the nat table
+func localSNATIfaces(saved []byte) []string {
+	var ifaces []string
+	for _, line := range strings.Split(string(saved), "\n") {
+		if !strings.HasPrefix(line, "-A "+string(utiliptables.ChainPostrouting)+" ") ||
+			!strings.Contains(line, localSNATComment) {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields)-1; i++ {
+			if fields[i] == "-o" {
+				ifaces = append(ifaces, fields[i+1])
+				break
+			}
+		}
+	}
+	return ifaces
+}
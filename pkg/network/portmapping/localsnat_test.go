@@ -0,0 +1,93 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package portmapping
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"tkestack.io/galaxy/pkg/api/k8s"
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+	iptablesTest "tkestack.io/galaxy/pkg/utils/iptables/testing"
+)
+
+func postroutingRules(t *testing.T, cli utiliptables.Interface) []string {
+	buf := bytes.NewBuffer(nil)
+	if err := cli.SaveInto(utiliptables.TableNAT, buf); err != nil {
+		t.Fatal(err)
+	}
+	var rules []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "-A POSTROUTING") {
+			rules = append(rules, line)
+		}
+	}
+	return rules
+}
+
+// #lizard forgives
+func TestLocalSNAT(t *testing.T) {
+	fakeCli := iptablesTest.NewFakeIPTables()
+	h := &PortMappingHandler{
+		Interface:  fakeCli,
+		podPortMap: make(map[string]map[hostport]closeable),
+	}
+	pod1 := []k8s.Port{{PodName: "pod-1", HostPort: 8080, Protocol: "TCP", ContainerPort: 80, PodIP: "10.0.0.2",
+		HostInterface: "docker10"}}
+	pod2 := []k8s.Port{{PodName: "pod-2", HostPort: 8081, Protocol: "TCP", ContainerPort: 80, PodIP: "10.0.0.3",
+		HostInterface: "docker10"}}
+	for _, ports := range [][]k8s.Port{pod1, pod2} {
+		if err := h.SetupPortMapping(ports); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := `-A POSTROUTING -m comment --comment "SNAT for localhost access to hostports" -o docker10 -s 127.0.0.0/8 ` +
+		`-j MASQUERADE`
+	if rules := postroutingRules(t, fakeCli); len(rules) != 1 || rules[0] != expect {
+		t.Fatalf("expect %s, real %v", expect, rules)
+	}
+	// the rule is kept until the last pod behind docker10 is gone
+	if err := h.CleanPortMapping(pod1); err != nil {
+		t.Fatal(err)
+	}
+	if rules := postroutingRules(t, fakeCli); len(rules) != 1 {
+		t.Fatalf("expect the rule kept, real %v", rules)
+	}
+	if err := h.CleanPortMapping(pod2); err != nil {
+		t.Fatal(err)
+	}
+	if rules := postroutingRules(t, fakeCli); len(rules) != 0 {
+		t.Fatalf("expect no rule, real %v", rules)
+	}
+	// a restart syncs rules of running pods and deletes stale ones
+	if err := h.SetupPortMapping(pod1); err != nil {
+		t.Fatal(err)
+	}
+	h2 := &PortMappingHandler{
+		Interface:  fakeCli,
+		podPortMap: make(map[string]map[hostport]closeable),
+	}
+	pod2[0].HostInterface = "docker20"
+	if err := h2.SetupPortMappingForAllPods(pod2); err != nil {
+		t.Fatal(err)
+	}
+	expect = strings.Replace(expect, "docker10", "docker20", 1)
+	if rules := postroutingRules(t, fakeCli); len(rules) != 1 || rules[0] != expect {
+		t.Fatalf("expect %s, real %v", expect, rules)
+	}
+}
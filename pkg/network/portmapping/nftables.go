@@ -0,0 +1,296 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package portmapping
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/api/k8s"
+)
+
+// RuleManager sets up nat rules of hostports of pods, i.e. DNAT of hostports to pods and SNAT of pods accessing their
+// own hostports and of localhost accessing hostports. PortMappingHandler manages them by iptables, NftRules by
+// nftables.
+type RuleManager interface {
+	// EnsureBasicRule ensures rules shared by all hostports
+	EnsureBasicRule() error
+	SetupPortMapping(ports []k8s.Port) error
+	CleanPortMapping(ports []k8s.Port) error
+	// SetupPortMappingForAllPods replaces rules of all hostports with those of ports
+	SetupPortMappingForAllPods(ports []k8s.Port) error
+	// MissingPortMappings returns ports whose rules are gone
+	MissingPortMappings(ports []k8s.Port) ([]k8s.Port, error)
+}
+
+var _ RuleManager = &PortMappingHandler{}
+var _ RuleManager = &NftRules{}
+
+const (
+	// NftTable is the nftables table of hostport rules, of the ip family
+	NftTable = "galaxy-hostports"
+	// nftHostports maps protocols and hostports to pod ips and container ports
+	nftHostports = "hostports"
+	// nftHostIPHostports maps host ips, protocols and hostports of ports having host ips to pod ips and container
+	// ports
+	nftHostIPHostports = "hostip-hostports"
+	// nftHairpins are pod ips twice of pods having hostports, which are SNATed accessing their own hostports
+	nftHairpins = "hairpins"
+)
+
+// NftRules manages rules of hostports by a table of nftables. DNAT rules of hostports are elements of maps, so that
+// the number of rules a packet traverses doesn't grow with hostports and adding or deleting one is atomic. Ports
+// having VIPs, i.e. direct server return, are not supported.
+type NftRules struct {
+	// nft runs nft with stdin, it is replaceable by tests
+	nft func(stdin string, args ...string) ([]byte, error)
+}
+
+// NewNftRules creates NftRules
+func NewNftRules() *NftRules {
+	return &NftRules{nft: runNft}
+}
+
+func runNft(stdin string, args ...string) ([]byte, error) {
+	cmd := exec.Command("nft", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("nft %s: %v, %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// apply applies the script atomically
+func (n *NftRules) apply(script string) error {
+	_, err := n.nft(script, "-f", "-")
+	return err
+}
+
+// EnsureBasicRule creates the table, maps and chains if they don't exist and rewrites rules of the chains. Elements
+// of maps are kept.
+func (n *NftRules) EnsureBasicRule() error {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "add table ip %s\n", NftTable)
+	fmt.Fprintf(buf, "add map ip %s %s { type inet_proto . inet_service : ipv4_addr . inet_service ; }\n",
+		NftTable, nftHostports)
+	fmt.Fprintf(buf, "add map ip %s %s { type ipv4_addr . inet_proto . inet_service : ipv4_addr . inet_service ; }\n",
+		NftTable, nftHostIPHostports)
+	fmt.Fprintf(buf, "add set ip %s %s { type ipv4_addr . ipv4_addr ; }\n", NftTable, nftHairpins)
+	for _, c := range []struct{ name, hook, priority string }{
+		{name: "prerouting", hook: "prerouting", priority: "-100"},
+		{name: "output", hook: "output", priority: "-100"},
+		{name: "postrouting", hook: "postrouting", priority: "100"},
+	} {
+		fmt.Fprintf(buf, "add chain ip %s %s { type nat hook %s priority %s ; policy accept ; }\n", NftTable,
+			c.name, c.hook, c.priority)
+		fmt.Fprintf(buf, "flush chain ip %s %s\n", NftTable, c.name)
+	}
+	fmt.Fprintf(buf, "add chain ip %s %s\n", NftTable, nftHostports)
+	fmt.Fprintf(buf, "flush chain ip %s %s\n", NftTable, nftHostports)
+	for _, chain := range []string{"prerouting", "output"} {
+		fmt.Fprintf(buf, "add rule ip %s %s fib daddr type local jump %s\n", NftTable, chain, nftHostports)
+	}
+	fmt.Fprintf(buf, "add rule ip %s %s dnat ip addr . port to ip daddr . meta l4proto . th dport map @%s\n",
+		NftTable, nftHostports, nftHostIPHostports)
+	fmt.Fprintf(buf, "add rule ip %s %s dnat ip addr . port to meta l4proto . th dport map @%s\n", NftTable,
+		nftHostports, nftHostports)
+	fmt.Fprintf(buf, "add rule ip %s postrouting ct status dnat ip saddr . ip daddr @%s masquerade\n", NftTable,
+		nftHairpins)
+	fmt.Fprintf(buf, "add rule ip %s postrouting ct status dnat ip saddr 127.0.0.0/8 masquerade\n", NftTable)
+	return n.apply(buf.String())
+}
+
+// nftPort is a port which nftables supports
+func nftPort(port *k8s.Port) bool {
+	if port.VIP != "" {
+		glog.Warningf("direct server return of %s hostport %d is not supported by nftables", port.PodName,
+			port.HostPort)
+		return false
+	}
+	return port.PodIP != ""
+}
+
+// nftElements returns the map and the element of port, and the hairpin element
+func nftElements(port *k8s.Port) (string, string, string) {
+	protocol := strings.ToLower(port.Protocol)
+	value := fmt.Sprintf("%s . %d", port.PodIP, port.ContainerPort)
+	hairpin := fmt.Sprintf("%s . %s", port.PodIP, port.PodIP)
+	if port.HostIP != "" {
+		return nftHostIPHostports, fmt.Sprintf("%s . %s . %d : %s", port.HostIP, protocol, port.HostPort, value),
+			hairpin
+	}
+	return nftHostports, fmt.Sprintf("%s . %d : %s", protocol, port.HostPort, value), hairpin
+}
+
+// nftKey returns the key of the element
+func nftKey(element string) string {
+	return strings.TrimSpace(strings.SplitN(element, ":", 2)[0])
+}
+
+func (n *NftRules) SetupPortMapping(ports []k8s.Port) error {
+	buf := bytes.NewBuffer(nil)
+	for i := range ports {
+		if !nftPort(&ports[i]) {
+			continue
+		}
+		m, element, hairpin := nftElements(&ports[i])
+		fmt.Fprintf(buf, "add element ip %s %s { %s }\n", NftTable, m, element)
+		fmt.Fprintf(buf, "add element ip %s %s { %s }\n", NftTable, nftHairpins, hairpin)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	if err := n.apply(buf.String()); err == nil {
+		return nil
+	}
+	// elements of hostports left by previous pods to other pod ips fail adding, delete them and retry
+	if err := n.deleteElements(ports, false); err != nil {
+		return err
+	}
+	if err := n.apply(buf.String()); err != nil {
+		return fmt.Errorf("failed to add hostports: %v", err)
+	}
+	return nil
+}
+
+func (n *NftRules) CleanPortMapping(ports []k8s.Port) error {
+	return n.deleteElements(ports, true)
+}
+
+// deleteElements deletes elements of ports, and hairpin elements of them if hairpins is true, one by one. An absent
+// element would fail deleting others in the same transaction.
+func (n *NftRules) deleteElements(ports []k8s.Port, hairpins bool) error {
+	for i := range ports {
+		if !nftPort(&ports[i]) {
+			continue
+		}
+		m, element, hairpin := nftElements(&ports[i])
+		keys := [][2]string{{m, nftKey(element)}}
+		if hairpins {
+			keys = append(keys, [2]string{nftHairpins, hairpin})
+		}
+		for _, key := range keys {
+			if err := n.apply(fmt.Sprintf("delete element ip %s %s { %s }\n", NftTable, key[0],
+				key[1])); err != nil && !isNftNotExist(err) {
+				return fmt.Errorf("failed to delete hostport: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func isNftNotExist(err error) bool {
+	return strings.Contains(err.Error(), "No such file or directory")
+}
+
+func (n *NftRules) SetupPortMappingForAllPods(ports []k8s.Port) error {
+	if err := n.EnsureBasicRule(); err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer(nil)
+	for _, s := range []string{"map ip %s " + nftHostports, "map ip %s " + nftHostIPHostports,
+		"set ip %s " + nftHairpins} {
+		fmt.Fprintf(buf, "flush "+s+"\n", NftTable)
+	}
+	hairpins := map[string]bool{}
+	for i := range ports {
+		if !nftPort(&ports[i]) {
+			continue
+		}
+		m, element, hairpin := nftElements(&ports[i])
+		fmt.Fprintf(buf, "add element ip %s %s { %s }\n", NftTable, m, element)
+		if !hairpins[hairpin] {
+			hairpins[hairpin] = true
+			fmt.Fprintf(buf, "add element ip %s %s { %s }\n", NftTable, nftHairpins, hairpin)
+		}
+	}
+	if err := n.apply(buf.String()); err != nil {
+		return fmt.Errorf("failed to sync hostports: %v", err)
+	}
+	return nil
+}
+
+func (n *NftRules) MissingPortMappings(ports []k8s.Port) ([]k8s.Port, error) {
+	elements := map[string]bool{}
+	for _, m := range []string{nftHostports, nftHostIPHostports} {
+		// -nn prints ports as numbers instead of service names
+		out, err := n.nft("", "-nn", "list", "map", "ip", NftTable, m)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range parseNftElements(out) {
+			elements[e] = true
+		}
+	}
+	var missing []k8s.Port
+	for i := range ports {
+		if !nftPort(&ports[i]) {
+			continue
+		}
+		if _, element, _ := nftElements(&ports[i]); !elements[element] {
+			missing = append(missing, ports[i])
+		}
+	}
+	return missing, nil
+}
+
+// nftProtocols are names of protocols which nft may print as numbers
+var nftProtocols = map[string]string{"6": "tcp", "17": "udp", "132": "sctp"}
+
+// parseNftElements returns elements of the output of nft list map in the form of nftElements
+func parseNftElements(out []byte) []string {
+	s := string(out)
+	start := strings.Index(s, "elements = {")
+	if start < 0 {
+		return nil
+	}
+	s = s[start+len("elements = {"):]
+	if end := strings.Index(s, "}"); end >= 0 {
+		s = s[:end]
+	}
+	var elements []string
+	for _, e := range strings.Split(s, ",") {
+		parts := strings.SplitN(e, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.Fields(parts[0]), strings.Fields(parts[1])
+		// the protocol is the first of protocol . port and the second of ip . protocol . port
+		if i := len(key) - 3; i >= 0 {
+			if name, ok := nftProtocols[key[i]]; ok {
+				key[i] = name
+			}
+		}
+		elements = append(elements, strings.Join(key, " ")+" : "+strings.Join(value, " "))
+	}
+	return elements
+}
+
+// RemoveNftTable removes the table of rules of hostports, e.g. after switching back to iptables
+func RemoveNftTable() error {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil
+	}
+	if _, err := runNft("", "delete", "table", "ip", NftTable); err != nil && !isNftNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package portmapping
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"tkestack.io/galaxy/pkg/api/k8s"
+)
+
+// fakeNft records scripts applied and returns output of list commands, scripts containing fail fail
+type fakeNft struct {
+	scripts []string
+	list    map[string]string
+	fail    string
+}
+
+func (f *fakeNft) run(stdin string, args ...string) ([]byte, error) {
+	if args[0] == "-nn" {
+		return []byte(f.list[args[len(args)-1]]), nil
+	}
+	if f.fail != "" && strings.Contains(stdin, f.fail) {
+		f.fail = ""
+		return nil, fmt.Errorf("nft -f -: exit status 1, Error: Could not process rule: Device or resource busy")
+	}
+	f.scripts = append(f.scripts, stdin)
+	return nil, nil
+}
+
+var nftTestPorts = []k8s.Port{
+	{HostPort: 8080, ContainerPort: 80, Protocol: "TCP", PodName: "app", PodIP: "10.0.0.5"},
+	{HostPort: 53, ContainerPort: 53, Protocol: "UDP", PodName: "app", PodIP: "10.0.0.5", HostIP: "192.168.0.2"},
+	// direct server return is not supported
+	{HostPort: 443, ContainerPort: 443, Protocol: "TCP", PodName: "lb", PodIP: "10.0.0.6", VIP: "1.1.1.1"},
+}
+
+func TestNftSetupAndCleanPortMapping(t *testing.T) {
+	f := &fakeNft{}
+	n := &NftRules{nft: f.run}
+	if err := n.SetupPortMapping(nftTestPorts); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"add element ip galaxy-hostports hostports { tcp . 8080 : 10.0.0.5 . 80 }\n" +
+		"add element ip galaxy-hostports hairpins { 10.0.0.5 . 10.0.0.5 }\n" +
+		"add element ip galaxy-hostports hostip-hostports { 192.168.0.2 . udp . 53 : 10.0.0.5 . 53 }\n" +
+		"add element ip galaxy-hostports hairpins { 10.0.0.5 . 10.0.0.5 }\n"}
+	if !reflect.DeepEqual(f.scripts, expect) {
+		t.Fatalf("expect %q, real %q", expect, f.scripts)
+	}
+	// elements left by previous pods are deleted before adding
+	f.scripts, f.fail = nil, "add element"
+	if err := n.SetupPortMapping(nftTestPorts[:1]); err != nil {
+		t.Fatal(err)
+	}
+	expect = []string{"delete element ip galaxy-hostports hostports { tcp . 8080 }\n",
+		"add element ip galaxy-hostports hostports { tcp . 8080 : 10.0.0.5 . 80 }\n" +
+			"add element ip galaxy-hostports hairpins { 10.0.0.5 . 10.0.0.5 }\n"}
+	if !reflect.DeepEqual(f.scripts, expect) {
+		t.Fatalf("expect %q, real %q", expect, f.scripts)
+	}
+	f.scripts = nil
+	if err := n.CleanPortMapping(nftTestPorts); err != nil {
+		t.Fatal(err)
+	}
+	expect = []string{"delete element ip galaxy-hostports hostports { tcp . 8080 }\n",
+		"delete element ip galaxy-hostports hairpins { 10.0.0.5 . 10.0.0.5 }\n",
+		"delete element ip galaxy-hostports hostip-hostports { 192.168.0.2 . udp . 53 }\n",
+		"delete element ip galaxy-hostports hairpins { 10.0.0.5 . 10.0.0.5 }\n"}
+	if !reflect.DeepEqual(f.scripts, expect) {
+		t.Fatalf("expect %q, real %q", expect, f.scripts)
+	}
+}
+
+func TestNftSetupPortMappingForAllPods(t *testing.T) {
+	f := &fakeNft{}
+	n := &NftRules{nft: f.run}
+	if err := n.SetupPortMappingForAllPods(nftTestPorts); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.scripts) != 2 {
+		t.Fatalf("expect basic rules and elements, real %q", f.scripts)
+	}
+	for _, rule := range []string{"add chain ip galaxy-hostports prerouting { type nat hook prerouting priority -100",
+		"add rule ip galaxy-hostports hostports dnat ip addr . port to meta l4proto . th dport map @hostports",
+		"add rule ip galaxy-hostports postrouting ct status dnat ip saddr . ip daddr @hairpins masquerade"} {
+		if !strings.Contains(f.scripts[0], rule) {
+			t.Fatalf("expect %q in %s", rule, f.scripts[0])
+		}
+	}
+	expect := "flush map ip galaxy-hostports hostports\n" +
+		"flush map ip galaxy-hostports hostip-hostports\n" +
+		"flush set ip galaxy-hostports hairpins\n" +
+		"add element ip galaxy-hostports hostports { tcp . 8080 : 10.0.0.5 . 80 }\n" +
+		"add element ip galaxy-hostports hairpins { 10.0.0.5 . 10.0.0.5 }\n" +
+		"add element ip galaxy-hostports hostip-hostports { 192.168.0.2 . udp . 53 : 10.0.0.5 . 53 }\n"
+	if f.scripts[1] != expect {
+		t.Fatalf("expect %q, real %q", expect, f.scripts[1])
+	}
+}
+
+func TestNftMissingPortMappings(t *testing.T) {
+	f := &fakeNft{list: map[string]string{
+		nftHostports: `table ip galaxy-hostports {
+	map hostports {
+		type inet_proto . inet_service : ipv4_addr . inet_service
+		elements = { 6 . 8080 : 10.0.0.5 . 80,
+			     17 . 8081 : 10.0.0.7 . 6 }
+	}
+}`,
+		nftHostIPHostports: `table ip galaxy-hostports {
+	map hostip-hostports {
+		type ipv4_addr . inet_proto . inet_service : ipv4_addr . inet_service
+	}
+}`,
+	}}
+	n := &NftRules{nft: f.run}
+	missing, err := n.MissingPortMappings(nftTestPorts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(missing, nftTestPorts[1:2]) {
+		t.Fatalf("expect %+v, real %+v", nftTestPorts[1:2], missing)
+	}
+	expect := []string{"tcp . 8080 : 10.0.0.5 . 80", "udp . 8081 : 10.0.0.7 . 6"}
+	if elements := parseNftElements([]byte(f.list[nftHostports])); !reflect.DeepEqual(elements, expect) {
+		t.Fatalf("expect %q, real %q", expect, elements)
+	}
+}
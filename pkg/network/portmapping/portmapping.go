@@ -63,6 +63,10 @@ func (h *PortMappingHandler) OpenHostports(podFullName string, randomPortMapping
 	if len(ports) != 0 {
 		h.Lock()
 		h.podPortMap[podFullName] = ports
+		if h.podIPs == nil {
+			h.podIPs = map[string]string{}
+		}
+		h.podIPs[podFullName] = k8sPorts[0].PodIP
 		h.Unlock()
 	}
 
@@ -81,7 +85,58 @@ func (h *PortMappingHandler) CloseHostports(podFullName string) {
 			}
 		}
 		delete(h.podPortMap, podFullName)
+		delete(h.podIPs, podFullName)
+	}
+}
+
+// CloseHostportsOf closes hostports held for the pods of ports. It's used by gc which only knows the saved ports of a
+// container, otherwise sockets of pods whose DEL never came would be held forever
+func (h *PortMappingHandler) CloseHostportsOf(ports []k8s.Port) {
+	h.Lock()
+	defer h.Unlock()
+	for i := range ports {
+		hp := hostport{port: ports[i].HostPort, protocol: strings.ToLower(ports[i].Protocol)}
+		for podFullName, podPorts := range h.podPortMap {
+			// the hostport may have been reopened by a new pod after galaxy restarted, only close it for its owner
+			if !strings.HasPrefix(podFullName, ports[i].PodName+"_") || h.podIPs[podFullName] != ports[i].PodIP {
+				continue
+			}
+			closer, ok := podPorts[hp]
+			if !ok {
+				continue
+			}
+			if err := closer.Close(); err != nil {
+				glog.Errorf("Cannot clean up hostport %v for pod %s: %v", hp, podFullName, err)
+			}
+			delete(podPorts, hp)
+			if len(podPorts) == 0 {
+				delete(h.podPortMap, podFullName)
+				delete(h.podIPs, podFullName)
+			}
+		}
+	}
+}
+
+// CloseAllHostports closes hostports of all pods
+func (h *PortMappingHandler) CloseAllHostports() {
+	h.Lock()
+	defer h.Unlock()
+	for podFullName, ports := range h.podPortMap {
+		for port, closer := range ports {
+			if err := closer.Close(); err != nil {
+				glog.Errorf("Cannot clean up hostport %v for pod %s: %v", port, podFullName, err)
+			}
+		}
 	}
+	h.podPortMap = make(map[string]map[hostport]closeable)
+	h.podIPs = nil
+}
+
+// HostportPods returns the number of pods holding hostports
+func (h *PortMappingHandler) HostportPods() int {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.podPortMap)
 }
 
 type closeable interface {
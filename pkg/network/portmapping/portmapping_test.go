@@ -98,3 +98,47 @@ func TestOpenHostports(t *testing.T) {
 		t.Fatal("expect release all listen socket")
 	}
 }
+
+func TestCloseHostportsOf(t *testing.T) {
+	pm := &PortMappingHandler{
+		podPortMap: make(map[string]map[hostport]closeable),
+	}
+	ports := []k8s.Port{{ContainerPort: 80, Protocol: "tcp", PodName: "pod1", PodIP: "10.0.0.2"},
+		{ContainerPort: 53, Protocol: "udp", PodName: "pod1", PodIP: "10.0.0.2"}}
+	if err := pm.OpenHostports("pod1_default", true, ports); err != nil {
+		t.Fatal(err)
+	}
+	// ports of another pod shouldn't close sockets of pod1
+	pm.CloseHostportsOf([]k8s.Port{{HostPort: ports[0].HostPort, Protocol: "TCP", PodName: "pod2",
+		PodIP: "10.0.0.2"}})
+	// nor ports of a previous pod of the same name
+	pm.CloseHostportsOf([]k8s.Port{{HostPort: ports[0].HostPort, Protocol: "TCP", PodName: "pod1",
+		PodIP: "10.0.0.3"}})
+	if len(pm.podPortMap["pod1_default"]) != 2 {
+		t.Fatal("expect 2 sockets of pod1")
+	}
+	pm.CloseHostportsOf(ports[:1])
+	if len(pm.podPortMap["pod1_default"]) != 1 {
+		t.Fatal("expect 1 socket of pod1")
+	}
+	pm.CloseHostportsOf(ports)
+	if pm.HostportPods() != 0 {
+		t.Fatal("expect release all listen socket")
+	}
+}
+
+func TestCloseAllHostports(t *testing.T) {
+	pm := &PortMappingHandler{
+		podPortMap: make(map[string]map[hostport]closeable),
+	}
+	for _, pod := range []string{"pod1", "pod2"} {
+		if err := pm.OpenHostports(pod+"_default", true, []k8s.Port{{ContainerPort: 80, Protocol: "tcp",
+			PodName: pod, PodIP: "10.0.0.2"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pm.CloseAllHostports()
+	if pm.HostportPods() != 0 {
+		t.Fatal("expect release all listen socket")
+	}
+}
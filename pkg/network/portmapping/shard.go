@@ -0,0 +1,169 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package portmapping
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+)
+
+const (
+	// kubeHostportsDispatchChain replaces KUBE-HOSTPORTS if hostport chains are sharded, it jumps to shard chains
+	// by destination port ranges
+	kubeHostportsDispatchChain utiliptables.Chain = "KUBE-HOSTPORTS-DISPATCH"
+	// prefix for shard chains, it must not start with kubeHostportChainPrefix
+	kubeHostportShardChainPrefix = "KUBE-HPS-"
+	// MaxShards is the max number of hostport shards
+	MaxShards = 256
+	maxPorts  = 65536
+)
+
+var shardProtocols = []string{"tcp", "udp"}
+
+// sharded returns true if hostport rules are sharded by destination ports, so that a packet traverses
+// O(shards + ports/shards) rules instead of O(ports)
+func (h *PortMappingHandler) sharded() bool {
+	return h.shards > 1
+}
+
+// entryChain returns the chain holding the rule which jumps to the hostport chain of port
+func (h *PortMappingHandler) entryChain(port int32) utiliptables.Chain {
+	if !h.sharded() {
+		return kubeHostportsChain
+	}
+	return shardChainName(int(port) * h.shards / maxPorts)
+}
+
+// portalChain returns the chain which OUTPUT and PREROUTING jump to
+func (h *PortMappingHandler) portalChain() utiliptables.Chain {
+	if h.sharded() {
+		return kubeHostportsDispatchChain
+	}
+	return kubeHostportsChain
+}
+
+func shardChainName(shard int) utiliptables.Chain {
+	return utiliptables.Chain(fmt.Sprintf("%s%d", kubeHostportShardChainPrefix, shard))
+}
+
+// shardRange returns the first and the last port of shard
+func (h *PortMappingHandler) shardRange(shard int) (int, int) {
+	first := (shard*maxPorts + h.shards - 1) / h.shards
+	next := ((shard+1)*maxPorts + h.shards - 1) / h.shards
+	return first, next - 1
+}
+
+// dispatchRules returns rules of KUBE-HOSTPORTS-DISPATCH chain
+func (h *PortMappingHandler) dispatchRules() [][]string {
+	var rules [][]string
+	for shard := 0; shard < h.shards; shard++ {
+		first, last := h.shardRange(shard)
+		for _, protocol := range shardProtocols {
+			rules = append(rules, []string{"-m", protocol, "-p", protocol, "--dport",
+				fmt.Sprintf("%d:%d", first, last), "-j", string(shardChainName(shard))})
+		}
+	}
+	return rules
+}
+
+// portalJumps returns rules of OUTPUT and PREROUTING chains which jump to the portal chain
+func portalJumps(iptablesRestore bool) []utiliptables.Jump {
+	comment := "kube hostport portals"
+	if iptablesRestore {
+		comment = `"` + comment + `"`
+	}
+	args := []string{"-m", "comment", "--comment", comment, "-m", "addrtype", "--dst-type", "LOCAL"}
+	return []utiliptables.Jump{
+		{Chain: utiliptables.ChainOutput, Args: args},
+		{Chain: utiliptables.ChainPrerouting, Args: args},
+	}
+}
+
+func (h *PortMappingHandler) ensureShardChains() error {
+	if _, err := h.Interface.EnsureChain(utiliptables.TableNAT, kubeHostportsDispatchChain); err != nil {
+		return fmt.Errorf("Failed to ensure that %s chain %s exists: %v", utiliptables.TableNAT,
+			kubeHostportsDispatchChain, err)
+	}
+	for shard := 0; shard < h.shards; shard++ {
+		if _, err := h.Interface.EnsureChain(utiliptables.TableNAT, shardChainName(shard)); err != nil {
+			return fmt.Errorf("Failed to ensure that %s chain %s exists: %v", utiliptables.TableNAT,
+				shardChainName(shard), err)
+		}
+	}
+	for _, rule := range h.dispatchRules() {
+		if _, err := h.Interface.EnsureRule(utiliptables.Append, utiliptables.TableNAT, kubeHostportsDispatchChain,
+			rule...); err != nil {
+			return fmt.Errorf("Failed to ensure rule %v of chain %s: %v", rule, kubeHostportsDispatchChain, err)
+		}
+	}
+	return nil
+}
+
+// migrateLayout switches OUTPUT and PREROUTING from the portal chain of the other layout to the portal chain of the
+// current layout, then deletes chains of the other layout. Rules of the current layout must have been written.
+// kubeHostportsRules are rules of KUBE-HOSTPORTS if not sharded.
+func (h *PortMappingHandler) migrateLayout(existingNATChains map[utiliptables.Chain]string,
+	kubeHostportsRules [][]string) error {
+	if h.sharded() {
+		if _, ok := existingNATChains[kubeHostportsChain]; !ok {
+			return nil
+		}
+		return utiliptables.Migrate(h.Interface, &utiliptables.ChainMigration{
+			Table:    utiliptables.TableNAT,
+			OldChain: kubeHostportsChain,
+			NewChain: kubeHostportsDispatchChain,
+			Jumps:    portalJumps(false),
+			Rules:    h.dispatchRules(),
+		})
+	}
+	if _, ok := existingNATChains[kubeHostportsDispatchChain]; !ok {
+		return nil
+	}
+	if err := utiliptables.Migrate(h.Interface, &utiliptables.ChainMigration{
+		Table:    utiliptables.TableNAT,
+		OldChain: kubeHostportsDispatchChain,
+		NewChain: kubeHostportsChain,
+		Jumps:    portalJumps(false),
+		Rules:    kubeHostportsRules,
+	}); err != nil {
+		return err
+	}
+	// nothing jumps to shard chains now
+	natLines := bytes.NewBuffer(nil)
+	writeLine(natLines, "*nat")
+	var deletes []string
+	for chain, line := range existingNATChains {
+		if strings.HasPrefix(string(chain), kubeHostportShardChainPrefix) {
+			writeLine(natLines, line)
+			deletes = append(deletes, string(chain))
+		}
+	}
+	for _, chain := range deletes {
+		writeLine(natLines, "-X", chain)
+	}
+	writeLine(natLines, "COMMIT")
+	if len(deletes) == 0 {
+		return nil
+	}
+	if err := h.RestoreAll(natLines.Bytes(), utiliptables.NoFlushTables, utiliptables.RestoreCounters); err != nil {
+		return fmt.Errorf("failed to delete shard chains: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package portmapping
+
+import (
+	"bytes"
+	"testing"
+
+	"tkestack.io/galaxy/pkg/api/k8s"
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+	iptablesTest "tkestack.io/galaxy/pkg/utils/iptables/testing"
+)
+
+func TestShardRange(t *testing.T) {
+	for _, shards := range []int{2, 3, 7, 16, MaxShards} {
+		h := &PortMappingHandler{shards: shards}
+		next := 0
+		for shard := 0; shard < shards; shard++ {
+			first, last := h.shardRange(shard)
+			if first != next || last < first {
+				t.Fatalf("shards %d: shard %d range %d:%d, expect it to start at %d", shards, shard, first, last, next)
+			}
+			for _, port := range []int{first, last} {
+				if chain := h.entryChain(int32(port)); chain != shardChainName(shard) {
+					t.Fatalf("shards %d: port %d expect in %s, real %s", shards, port, shardChainName(shard), chain)
+				}
+			}
+			next = last + 1
+		}
+		if next != maxPorts {
+			t.Fatalf("shards %d: ranges end at %d", shards, next-1)
+		}
+	}
+}
+
+// #lizard forgives
+func TestShardedPortMapping(t *testing.T) {
+	fakeCli := iptablesTest.NewFakeIPTables()
+	h := &PortMappingHandler{
+		Interface:  fakeCli,
+		podPortMap: make(map[string]map[hostport]closeable),
+		shards:     2,
+	}
+	if err := h.EnsureBasicRule(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetupPortMapping([]k8s.Port{
+		{PodName: "testrdma-2", HostPort: 57119, Protocol: "TCP", ContainerPort: 30008, PodIP: "192.168.0.1"},
+		{PodName: "pod-2", HostPort: 9090, Protocol: "UDP", ContainerPort: 9090, PodIP: "192.168.0.2"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	fakeCli.SaveInto(utiliptables.TableNAT, buf)
+	expectTxt := `*nat
+:INPUT - [0:0]
+:KUBE-HOSTPORTS-DISPATCH - [0:0]
+:KUBE-HP-5MLSI4DJJZLGHUZA - [0:0]
+:KUBE-HP-BF3WJKNWB2BP2PEW - [0:0]
+:KUBE-HPS-0 - [0:0]
+:KUBE-HPS-1 - [0:0]
+:KUBE-MARK-MASQ - [0:0]
+:OUTPUT - [0:0]
+:POSTROUTING - [0:0]
+:PREROUTING - [0:0]
+-A KUBE-HOSTPORTS-DISPATCH -m tcp -p tcp --dport 0:32767 -j KUBE-HPS-0
+-A KUBE-HOSTPORTS-DISPATCH -m udp -p udp --dport 0:32767 -j KUBE-HPS-0
+-A KUBE-HOSTPORTS-DISPATCH -m tcp -p tcp --dport 32768:65535 -j KUBE-HPS-1
+-A KUBE-HOSTPORTS-DISPATCH -m udp -p udp --dport 32768:65535 -j KUBE-HPS-1
+-A KUBE-HP-5MLSI4DJJZLGHUZA -m comment --comment "pod-2 hostport 9090" -s 192.168.0.2/32 -j KUBE-MARK-MASQ
+-A KUBE-HP-5MLSI4DJJZLGHUZA -m comment --comment "pod-2 hostport 9090" -m udp -p udp -j DNAT --to-destination 192.168.0.2:9090
+-A KUBE-HP-BF3WJKNWB2BP2PEW -m comment --comment "testrdma-2 hostport 57119" -s 192.168.0.1/32 -j KUBE-MARK-MASQ
+-A KUBE-HP-BF3WJKNWB2BP2PEW -m comment --comment "testrdma-2 hostport 57119" -m tcp -p tcp -j DNAT --to-destination 192.168.0.1:30008
+-A KUBE-HPS-0 -m comment --comment "pod-2 hostport 9090" -m udp -p udp --dport 9090 -j KUBE-HP-5MLSI4DJJZLGHUZA
+-A KUBE-HPS-1 -m comment --comment "testrdma-2 hostport 57119" -m tcp -p tcp --dport 57119 -j KUBE-HP-BF3WJKNWB2BP2PEW
+-A KUBE-MARK-MASQ -j MARK --set-xmark 0x4000/0x4000
+-A OUTPUT -m comment --comment "kube hostport portals" -m addrtype --dst-type LOCAL -j KUBE-HOSTPORTS-DISPATCH
+-A PREROUTING -m comment --comment "kube hostport portals" -m addrtype --dst-type LOCAL -j KUBE-HOSTPORTS-DISPATCH
+COMMIT
+`
+	if buf.String() != expectTxt {
+		t.Errorf("expect %s, real %s", expectTxt, buf.String())
+	}
+}
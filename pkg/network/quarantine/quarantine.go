@@ -0,0 +1,166 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package quarantine isolates pods by iptables for security response. All ipv4 traffic of a quarantined pod,
+// forwarded or with the host, is dropped except that with peers of its allow list, while the pod keeps running so
+// that its processes, memory and disks are preserved for forensics.
+package quarantine
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	glog "k8s.io/klog"
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+)
+
+// quarantineChain is jumped to from FORWARD, INPUT and OUTPUT before any other rule
+const quarantineChain utiliptables.Chain = "GALAXY-QUARANTINE"
+
+// Pod is a quarantined pod
+type Pod struct {
+	// Key is namespace/name of the pod
+	Key string
+	IPs []net.IP
+	// Allowed are peers the pod may still talk to
+	Allowed []*net.IPNet
+}
+
+// ParseAllowList parses a comma separated list of cidrs or ips, ips are /32 cidrs
+func ParseAllowList(v string) ([]*net.IPNet, error) {
+	var ret []*net.IPNet
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			item += "/32"
+		}
+		_, cidr, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		if cidr.IP.To4() == nil {
+			return nil, fmt.Errorf("%s is not an ipv4 cidr", item)
+		}
+		ret = append(ret, cidr)
+	}
+	return ret, nil
+}
+
+// Handler syncs rules of quarantined pods
+type Handler struct {
+	utiliptables.Interface
+}
+
+// New creates a Handler
+func New() *Handler {
+	return &Handler{Interface: utiliptables.Shared()}
+}
+
+func jumpArgs() []string {
+	return []string{"-m", "comment", "--comment", "galaxy quarantined pods", "-j", string(quarantineChain)}
+}
+
+// EnsureBasicRule ensures FORWARD, INPUT and OUTPUT jump to the quarantine chain first
+func (h *Handler) EnsureBasicRule() error {
+	if _, err := h.EnsureChain(utiliptables.TableFilter, quarantineChain); err != nil {
+		return fmt.Errorf("failed to ensure that %s chain %s exists: %v", utiliptables.TableFilter, quarantineChain,
+			err)
+	}
+	for _, chain := range []utiliptables.Chain{utiliptables.ChainForward, utiliptables.ChainInput,
+		utiliptables.ChainOutput} {
+		if _, err := h.EnsureRule(utiliptables.Prepend, utiliptables.TableFilter, chain, jumpArgs()...); err != nil {
+			return fmt.Errorf("failed to ensure that %s chain %s jumps to %s: %v", utiliptables.TableFilter, chain,
+				quarantineChain, err)
+		}
+	}
+	return nil
+}
+
+// Sync replaces rules of the quarantine chain by those of pods in a single iptables-restore, so that no packet of a
+// quarantined pod slips through in between
+func (h *Handler) Sync(pods []*Pod) error {
+	if err := h.EnsureBasicRule(); err != nil {
+		return err
+	}
+	lines := rules(pods)
+	if err := h.RestoreAll(lines, utiliptables.NoFlushTables, utiliptables.RestoreCounters); err != nil {
+		return fmt.Errorf("failed to execute iptables-restore for rules %s: %v", string(lines), err)
+	}
+	return nil
+}
+
+// Remove removes the quarantine chain and jumps to it, releasing all quarantined pods
+func (h *Handler) Remove() error {
+	buf := bytes.NewBuffer(nil)
+	if err := h.SaveInto(utiliptables.TableFilter, buf); err != nil {
+		return fmt.Errorf("failed to save filter table: %v", err)
+	}
+	if _, ok := utiliptables.GetChainLines(utiliptables.TableFilter, buf.Bytes())[quarantineChain]; !ok {
+		return nil
+	}
+	// the chain is referenced by the jumps until they are deleted
+	for _, chain := range []utiliptables.Chain{utiliptables.ChainForward, utiliptables.ChainInput,
+		utiliptables.ChainOutput} {
+		if err := h.DeleteRule(utiliptables.TableFilter, chain, jumpArgs()...); err != nil {
+			return fmt.Errorf("failed to delete quarantine jump of %s: %v", chain, err)
+		}
+	}
+	if err := h.FlushChain(utiliptables.TableFilter, quarantineChain); err != nil {
+		return err
+	}
+	if err := h.DeleteChain(utiliptables.TableFilter, quarantineChain); err != nil {
+		return err
+	}
+	glog.Infof("removed quarantine rules")
+	return nil
+}
+
+// rules returns the iptables-restore input of the quarantine chain. Traffic with allowed peers returns to the
+// calling chain, e.g. for network policies to apply, the rest of the pods is dropped.
+func rules(pods []*Pod) []byte {
+	sorted := append([]*Pod{}, pods...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	buf := bytes.NewBuffer(nil)
+	utiliptables.WriteLine(buf, "*filter")
+	utiliptables.WriteLine(buf, utiliptables.MakeChainLine(quarantineChain))
+	for _, pod := range sorted {
+		comment := fmt.Sprintf("%q", "quarantined "+pod.Key)
+		rule := func(args ...string) {
+			utiliptables.WriteLine(buf, append([]string{"-A", string(quarantineChain), "-m", "comment", "--comment",
+				comment}, args...)...)
+		}
+		for _, ip := range pod.IPs {
+			if ip.To4() == nil {
+				continue
+			}
+			podIP := ip.String() + "/32"
+			for _, peer := range pod.Allowed {
+				rule("-s", podIP, "-d", peer.String(), "-j", "RETURN")
+				rule("-s", peer.String(), "-d", podIP, "-j", "RETURN")
+			}
+			rule("-s", podIP, "-j", "DROP")
+			rule("-d", podIP, "-j", "DROP")
+		}
+	}
+	utiliptables.WriteLine(buf, "COMMIT")
+	return buf.Bytes()
+}
@@ -0,0 +1,68 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package quarantine
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseAllowList(t *testing.T) {
+	allowed, err := ParseAllowList(" 10.0.0.10, 192.168.0.0/16,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allowed) != 2 || allowed[0].String() != "10.0.0.10/32" || allowed[1].String() != "192.168.0.0/16" {
+		t.Fatalf("unexpected allow list %v", allowed)
+	}
+	if allowed, err := ParseAllowList(""); err != nil || len(allowed) != 0 {
+		t.Fatalf("allowed %v, err %v", allowed, err)
+	}
+	for _, v := range []string{"10.0.0.300", "fd00::/64", "true"} {
+		if _, err := ParseAllowList(v); err == nil {
+			t.Errorf("expect an error of %s", v)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	allowed, err := ParseAllowList("10.0.0.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pods := []*Pod{
+		{Key: "ns/b", IPs: []net.IP{net.ParseIP("10.1.0.3"), net.ParseIP("fd00::3")}},
+		{Key: "ns/a", IPs: []net.IP{net.ParseIP("10.1.0.2")}, Allowed: allowed},
+	}
+	expect := `*filter
+:GALAXY-QUARANTINE - [0:0]
+-A GALAXY-QUARANTINE -m comment --comment "quarantined ns/a" -s 10.1.0.2/32 -d 10.0.0.10/32 -j RETURN
+-A GALAXY-QUARANTINE -m comment --comment "quarantined ns/a" -s 10.0.0.10/32 -d 10.1.0.2/32 -j RETURN
+-A GALAXY-QUARANTINE -m comment --comment "quarantined ns/a" -s 10.1.0.2/32 -j DROP
+-A GALAXY-QUARANTINE -m comment --comment "quarantined ns/a" -d 10.1.0.2/32 -j DROP
+-A GALAXY-QUARANTINE -m comment --comment "quarantined ns/b" -s 10.1.0.3/32 -j DROP
+-A GALAXY-QUARANTINE -m comment --comment "quarantined ns/b" -d 10.1.0.3/32 -j DROP
+COMMIT
+`
+	if real := string(rules(pods)); real != expect {
+		t.Fatalf("expect %s, real %s", expect, real)
+	}
+	// no pods flush the chain
+	if real := string(rules(nil)); real != "*filter\n:GALAXY-QUARANTINE - [0:0]\nCOMMIT\n" {
+		t.Fatal(real)
+	}
+}
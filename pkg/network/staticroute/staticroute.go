@@ -0,0 +1,130 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package staticroute adds routes of the routes annotation of pods to their netns, so that pods reach networks behind
+// gateways other than the default one, e.g. secondary networks, without a sidecar setting them up.
+package staticroute
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// Route is an item of the routes annotation of pods
+type Route struct {
+	// Dst is the cidr the route is to, default routes are the networks' own and can't be overridden
+	Dst string `json:"dst"`
+	// GW is the gateway of the route, traffic is sent to Dst directly by Dev if empty
+	GW string `json:"gw,omitempty"`
+	// Dev is the interface of the route. It defaults to the interface having an address whose subnet has GW, or the
+	// default interface of the pod if none has or GW is empty.
+	Dev string `json:"dev,omitempty"`
+}
+
+// route returns the netlink route of r without its interface
+func (r *Route) route() (*netlink.Route, error) {
+	_, dst, err := net.ParseCIDR(r.Dst)
+	if err != nil {
+		return nil, fmt.Errorf("bad dst %q", r.Dst)
+	}
+	if ones, _ := dst.Mask.Size(); ones == 0 {
+		return nil, fmt.Errorf("dst %s is a default route", r.Dst)
+	}
+	route := &netlink.Route{Dst: dst, Scope: netlink.SCOPE_LINK}
+	if r.GW == "" {
+		return route, nil
+	}
+	gw := net.ParseIP(r.GW)
+	if gw == nil || gw.IsUnspecified() {
+		return nil, fmt.Errorf("bad gw %q", r.GW)
+	}
+	if (gw.To4() == nil) != (dst.IP.To4() == nil) {
+		return nil, fmt.Errorf("gw %s and dst %s are of different families", r.GW, r.Dst)
+	}
+	route.Gw, route.Scope = gw, netlink.SCOPE_UNIVERSE
+	return route, nil
+}
+
+// Parse parses the value of the routes annotation
+func Parse(v string) ([]Route, error) {
+	var routes []Route
+	if err := json.Unmarshal([]byte(v), &routes); err != nil {
+		return nil, err
+	}
+	for i := range routes {
+		if _, err := routes[i].route(); err != nil {
+			return nil, err
+		}
+	}
+	return routes, nil
+}
+
+// Add adds routes within the netns, ifName is the default interface of the pod. Routes which exist are replaced, so
+// that retried requests succeed.
+func Add(netnsPath, ifName string, routes []Route) error {
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return err
+	}
+	defer netns.Close() // nolint: errcheck
+	return netns.Do(func(_ ns.NetNS) error {
+		for i := range routes {
+			route, err := routes[i].route()
+			if err != nil {
+				return err
+			}
+			link, err := routeLink(&routes[i], route.Gw, ifName)
+			if err != nil {
+				return err
+			}
+			route.LinkIndex = link.Attrs().Index
+			if err := netlink.RouteReplace(route); err != nil {
+				return fmt.Errorf("failed to add route %s via %s of %s: %v", routes[i].Dst, routes[i].GW,
+					link.Attrs().Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// routeLink returns the interface of r, see Route.Dev
+func routeLink(r *Route, gw net.IP, ifName string) (netlink.Link, error) {
+	if r.Dev != "" {
+		return netlink.LinkByName(r.Dev)
+	}
+	if gw != nil {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range links {
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+			if err != nil {
+				return nil, err
+			}
+			for _, addr := range addrs {
+				if addr.IPNet != nil && !addr.IP.IsLoopback() && addr.IPNet.Contains(gw) {
+					return link, nil
+				}
+			}
+		}
+	}
+	return netlink.LinkByName(ifName)
+}
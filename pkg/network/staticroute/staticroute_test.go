@@ -0,0 +1,58 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package staticroute
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestParse(t *testing.T) {
+	routes, err := Parse(`[{"dst": "10.0.0.0/8", "gw": "192.168.1.1"}, {"dst": "172.16.0.0/16", "dev": "eth1"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes[0] != (Route{Dst: "10.0.0.0/8", GW: "192.168.1.1"}) ||
+		routes[1] != (Route{Dst: "172.16.0.0/16", Dev: "eth1"}) {
+		t.Fatalf("unexpected routes %+v", routes)
+	}
+	route, err := routes[0].route()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Dst.String() != "10.0.0.0/8" || !route.Gw.Equal(net.ParseIP("192.168.1.1")) ||
+		route.Scope != netlink.SCOPE_UNIVERSE {
+		t.Fatalf("unexpected route %v", route)
+	}
+	if route, err = routes[1].route(); err != nil || route.Gw != nil || route.Scope != netlink.SCOPE_LINK {
+		t.Fatalf("unexpected route %v, %v", route, err)
+	}
+	for _, v := range []string{
+		`{"dst": "10.0.0.0/8"}`,
+		`[{"dst": "10.0.0.1"}]`,
+		`[{"dst": "0.0.0.0/0", "gw": "192.168.1.1"}]`,
+		`[{"dst": "10.0.0.0/8", "gw": "192.168.1"}]`,
+		`[{"dst": "10.0.0.0/8", "gw": "0.0.0.0"}]`,
+		`[{"dst": "10.0.0.0/8", "gw": "fe80::1"}]`,
+	} {
+		if _, err := Parse(v); err == nil {
+			t.Errorf("expect error of %s", v)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package tc
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"tkestack.io/galaxy/pkg/utils"
+)
+
+// ifbName returns the name of the ifb device shaping ingress traffic of the interface of index, which is unique
+// within the netns
+func ifbName(index int) string {
+	return "ifb" + strconv.Itoa(index)
+}
+
+// Shape replaces bandwidth limits of ifName within the netns with l
+func Shape(netnsPath, ifName string, l *Limits) error {
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return err
+	}
+	defer netns.Close() // nolint: errcheck
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return err
+		}
+		if err := unshape(link); err != nil {
+			return err
+		}
+		if l.EgressRate > 0 {
+			if err := addTBF(link, l.EgressRate); err != nil {
+				return fmt.Errorf("failed to shape egress of %s: %v", ifName, err)
+			}
+		}
+		if l.IngressRate > 0 {
+			if err := shapeIngress(link, l.IngressRate); err != nil {
+				return fmt.Errorf("failed to shape ingress of %s: %v", ifName, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Unshape removes bandwidth limits of ifName within the netns, it is a no-op if the netns or ifName is gone
+func Unshape(netnsPath, ifName string) error {
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		if _, ok := err.(ns.NSPathNotExistErr); ok {
+			return nil
+		}
+		return err
+	}
+	defer netns.Close() // nolint: errcheck
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			if utils.IsLinkNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		return unshape(link)
+	})
+}
+
+func unshape(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, qdisc := range qdiscs {
+		attrs := qdisc.Attrs()
+		if (qdisc.Type() == "tbf" && attrs.Parent == netlink.HANDLE_ROOT) ||
+			(qdisc.Type() == "ingress" && attrs.Parent == netlink.HANDLE_INGRESS) {
+			if err := netlink.QdiscDel(qdisc); err != nil {
+				return fmt.Errorf("failed to delete %s qdisc of %s: %v", qdisc.Type(), link.Attrs().Name, err)
+			}
+		}
+	}
+	ifb, err := netlink.LinkByName(ifbName(link.Attrs().Index))
+	if err != nil {
+		if utils.IsLinkNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(ifb)
+}
+
+func addTBF(link netlink.Link, rate uint64) error {
+	t := tbfOf(rate, float64(netlink.TickInUsec()))
+	return netlink.QdiscAdd(&netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{LinkIndex: link.Attrs().Index, Handle: netlink.MakeHandle(1, 0),
+			Parent: netlink.HANDLE_ROOT},
+		Rate:   t.rate,
+		Buffer: t.buffer,
+		Limit:  t.limit,
+	})
+}
+
+// shapeIngress redirects ingress traffic of link to an ifb device and shapes egress of the ifb device
+func shapeIngress(link netlink.Link, rate uint64) error {
+	name := ifbName(link.Attrs().Index)
+	if err := netlink.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: name, Flags: net.FlagUp,
+		MTU: link.Attrs().MTU}}); err != nil {
+		return fmt.Errorf("failed to add %s: %v", name, err)
+	}
+	ifb, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(ifb); err != nil {
+		return err
+	}
+	if err := addTBF(ifb, rate); err != nil {
+		return err
+	}
+	ingress := &netlink.Ingress{QdiscAttrs: netlink.QdiscAttrs{LinkIndex: link.Attrs().Index,
+		Handle: netlink.MakeHandle(0xffff, 0), Parent: netlink.HANDLE_INGRESS}}
+	if err := netlink.QdiscAdd(ingress); err != nil {
+		return fmt.Errorf("failed to add ingress qdisc: %v", err)
+	}
+	// match all packets and redirect them to the ifb device
+	return netlink.FilterAdd(&netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{LinkIndex: link.Attrs().Index, Parent: ingress.Handle, Priority: 1,
+			Protocol: unix.ETH_P_ALL},
+		ClassId:    netlink.MakeHandle(1, 1),
+		RedirIndex: ifb.Attrs().Index,
+		Actions:    []netlink.Action{netlink.NewMirredAction(ifb.Attrs().Index)},
+	})
+}
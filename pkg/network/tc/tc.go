@@ -0,0 +1,100 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package tc shapes bandwidth of pods by tbf qdiscs on their interfaces. Egress traffic of a pod is shaped by the
+// root qdisc of its interface and ingress traffic is redirected to an ifb device of its netns to be shaped there, so
+// that interfaces having no host side peer, e.g. macvlan and ipvlan ones, are shaped as well.
+package tc
+
+import (
+	"fmt"
+	"math"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// minRate and maxRate bound rates of annotations as kubelet does, in bits per second
+	minRate = 1000
+	maxRate = 1000 * 1000 * 1000 * 1000 * 1000
+	// latencyUsec is how long packets may wait in a tbf queue
+	latencyUsec = 25 * 1000
+	// minBurst is the min bucket size in bytes, which must be larger than the mtu
+	minBurst = 32 * 1024
+	// burstUsec sizes buckets of higher rates by the bytes sent in this time
+	burstUsec  = 10 * 1000
+	usecPerSec = 1000 * 1000
+)
+
+// Limits are bandwidth limits of a pod in bits per second, 0 is unlimited
+type Limits struct {
+	IngressRate uint64
+	EgressRate  uint64
+}
+
+// ParseLimits parses values of kubernetes.io/ingress-bandwidth and kubernetes.io/egress-bandwidth annotations, which
+// are quantities such as 10M, empty values are unlimited. It returns nil if both are empty.
+func ParseLimits(ingress, egress string) (*Limits, error) {
+	if ingress == "" && egress == "" {
+		return nil, nil
+	}
+	l := &Limits{}
+	for _, v := range []struct {
+		value string
+		rate  *uint64
+	}{{value: ingress, rate: &l.IngressRate}, {value: egress, rate: &l.EgressRate}} {
+		if v.value == "" {
+			continue
+		}
+		q, err := resource.ParseQuantity(v.value)
+		if err != nil {
+			return nil, fmt.Errorf("bad bandwidth %q: %v", v.value, err)
+		}
+		rate := q.Value()
+		if rate < minRate || rate > maxRate {
+			return nil, fmt.Errorf("bandwidth %q is not within 1k-1P", v.value)
+		}
+		*v.rate = uint64(rate)
+	}
+	return l, nil
+}
+
+// tbf are parameters of a tbf qdisc of rate bits per second, rate is in bytes per second, buffer in ticks and limit
+// in bytes
+type tbf struct {
+	rate   uint64
+	buffer uint32
+	limit  uint32
+}
+
+// tbfOf returns parameters of the tbf qdisc shaping traffic to rate bits per second, ticksPerUsec is of the kernel
+// packet scheduler
+func tbfOf(rate uint64, ticksPerUsec float64) tbf {
+	bytes := rate / 8
+	burst := bytes * burstUsec / usecPerSec
+	if burst < minBurst {
+		burst = minBurst
+	}
+	limit := bytes*latencyUsec/usecPerSec + burst
+	if limit > math.MaxUint32 {
+		limit = math.MaxUint32
+	}
+	return tbf{
+		rate:   bytes,
+		buffer: uint32(float64(burst) * usecPerSec / float64(bytes) * ticksPerUsec),
+		limit:  uint32(limit),
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package tc
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseLimits(t *testing.T) {
+	if l, err := ParseLimits("", ""); err != nil || l != nil {
+		t.Fatalf("expect no limits, real %+v, err %v", l, err)
+	}
+	l, err := ParseLimits("10M", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *l != (Limits{IngressRate: 10000000}) {
+		t.Fatalf("unexpected limits %+v", *l)
+	}
+	if l, err = ParseLimits("1Gi", "500k"); err != nil || *l != (Limits{IngressRate: 1 << 30, EgressRate: 500000}) {
+		t.Fatalf("unexpected limits %+v, err %v", l, err)
+	}
+	for _, bad := range [][2]string{{"x", ""}, {"", "100"}, {"2P", ""}, {"-10M", ""}} {
+		if _, err := ParseLimits(bad[0], bad[1]); err == nil {
+			t.Errorf("expect an error of %v", bad)
+		}
+	}
+}
+
+func TestTBFOf(t *testing.T) {
+	// 1Mbit: the min burst of 32KiB takes 262ms to send
+	if real := tbfOf(1000000, 1); real != (tbf{rate: 125000, buffer: 262144, limit: 125000/40 + 32768}) {
+		t.Fatalf("unexpected tbf %+v", real)
+	}
+	// 10Gbit: 10ms of traffic per burst
+	if real := tbfOf(10000000000, 2); real != (tbf{rate: 1250000000, buffer: 20000, limit: 31250000 + 12500000}) {
+		t.Fatalf("unexpected tbf %+v", real)
+	}
+	if real := tbfOf(maxRate, 1); real.limit != math.MaxUint32 {
+		t.Fatalf("expect limit capped, real %+v", real)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// AddressLabelsClear clears labels of addresses moved to the default bridge, it's the default
+	AddressLabelsClear = "clear"
+	// AddressLabelsRemap replaces the device name prefix of labels with the bridge name, e.g. eth1:mgmt becomes
+	// docker:mgmt, as labels must begin with the name of their interface
+	AddressLabelsRemap = "remap"
+)
+
+// AddressConf controls which addresses of the device are moved to the default bridge and how their labels are kept
+type AddressConf struct {
+	// How labels of moved addresses are handled, clear or remap
+	AddressLabels string `json:"address_labels"`
+	// Labels of the device to their labels on the bridge, which overrides AddressLabels
+	AddressLabelMap map[string]string `json:"address_label_map"`
+	// Addresses in cidr format which are kept on the device
+	ExcludeAddresses []string `json:"exclude_addresses"`
+}
+
+func (c *AddressConf) validate(device, bridge string) error {
+	if c.AddressLabels != "" && c.AddressLabels != AddressLabelsClear && c.AddressLabels != AddressLabelsRemap {
+		return fmt.Errorf("bad address_labels %q", c.AddressLabels)
+	}
+	for from, to := range c.AddressLabelMap {
+		if !strings.HasPrefix(from, device) || !strings.HasPrefix(to, bridge) {
+			return fmt.Errorf("bad address label mapping %s -> %s, labels must begin with %s and %s", from, to,
+				device, bridge)
+		}
+	}
+	for _, cidr := range c.ExcludeAddresses {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("bad exclude address %q: %v", cidr, err)
+		}
+	}
+	return nil
+}
+
+// excluded returns if addr is kept on the device
+func (c *AddressConf) excluded(addr *netlink.Addr) bool {
+	for _, cidr := range c.ExcludeAddresses {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		if ip.Equal(addr.IP) && ipNet.Mask.String() == addr.Mask.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// movedLabel returns the label of an address moved from the device to the bridge, or back if restore
+func (c *AddressConf) movedLabel(label, device, bridge string, restore bool) string {
+	from, to := device, bridge
+	if restore {
+		from, to = bridge, device
+	}
+	// the kernel reports the interface name as the label of addresses without one
+	if label == "" || label == from {
+		return ""
+	}
+	for deviceLabel, bridgeLabel := range c.AddressLabelMap {
+		if !restore && label == deviceLabel {
+			return bridgeLabel
+		}
+		if restore && label == bridgeLabel {
+			return deviceLabel
+		}
+	}
+	if c.AddressLabels == AddressLabelsRemap && strings.HasPrefix(label, from) {
+		return to + label[len(from):]
+	}
+	return ""
+}
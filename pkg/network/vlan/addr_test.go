@@ -0,0 +1,68 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestMovedLabel(t *testing.T) {
+	c := &AddressConf{AddressLabels: AddressLabelsRemap, AddressLabelMap: map[string]string{"eth1:a": "docker:b"}}
+	for _, test := range []struct {
+		label   string
+		restore bool
+		expect  string
+	}{
+		{label: "eth1", expect: ""},
+		{label: "eth1:mgmt", expect: "docker:mgmt"},
+		{label: "eth1:a", expect: "docker:b"},
+		{label: "docker:mgmt", restore: true, expect: "eth1:mgmt"},
+		{label: "docker:b", restore: true, expect: "eth1:a"},
+		{label: "docker", restore: true, expect: ""},
+	} {
+		if label := c.movedLabel(test.label, "eth1", "docker", test.restore); label != test.expect {
+			t.Errorf("label %s restore %v: expect %q, real %q", test.label, test.restore, test.expect, label)
+		}
+	}
+	c.AddressLabels = ""
+	if label := c.movedLabel("eth1:mgmt", "eth1", "docker", false); label != "" {
+		t.Errorf("expect label cleared, real %q", label)
+	}
+}
+
+func TestExcludedAddress(t *testing.T) {
+	c := &AddressConf{ExcludeAddresses: []string{"192.168.0.5/24"}}
+	ip, ipNet, _ := net.ParseCIDR("192.168.0.5/24")
+	ipNet.IP = ip
+	if !c.excluded(&netlink.Addr{IPNet: ipNet}) {
+		t.Fatal("expect 192.168.0.5/24 excluded")
+	}
+	ip, ipNet, _ = net.ParseCIDR("192.168.0.6/24")
+	ipNet.IP = ip
+	if c.excluded(&netlink.Addr{IPNet: ipNet}) {
+		t.Fatal("expect 192.168.0.6/24 not excluded")
+	}
+	for _, bad := range []AddressConf{{AddressLabels: "keep"}, {ExcludeAddresses: []string{"192.168.0.5"}},
+		{AddressLabelMap: map[string]string{"eth1:a": "eth1:b"}}} {
+		if err := bad.validate("eth1", "docker"); err == nil {
+			t.Errorf("expect an error for %+v", bad)
+		}
+	}
+}
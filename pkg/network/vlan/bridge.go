@@ -0,0 +1,92 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+)
+
+// BridgeConf tunes bridges of the driver, unset fields keep kernel defaults
+type BridgeConf struct {
+	// Turns stp of bridges on or off
+	STP *bool `json:"bridge_stp"`
+	// Forward delay of bridges in seconds, within [2, 30] if stp is on
+	ForwardDelay *int `json:"bridge_forward_delay"`
+	// Ageing time of learned macs of bridges in seconds
+	AgeingTime *int `json:"bridge_ageing_time"`
+	// Default pvid of bridge ports if vlan filtering is on, 0 disables it
+	VlanDefaultPVID *int `json:"bridge_vlan_default_pvid"`
+}
+
+// Validate checks values of the conf
+func (c *BridgeConf) Validate() error {
+	if c.ForwardDelay != nil {
+		min := 0
+		if c.STP != nil && *c.STP {
+			min = 2
+		}
+		if *c.ForwardDelay < min || *c.ForwardDelay > 30 {
+			return fmt.Errorf("bad bridge_forward_delay %d", *c.ForwardDelay)
+		}
+	}
+	if c.AgeingTime != nil && *c.AgeingTime < 0 {
+		return fmt.Errorf("bad bridge_ageing_time %d", *c.AgeingTime)
+	}
+	if c.VlanDefaultPVID != nil && (*c.VlanDefaultPVID < 0 || *c.VlanDefaultPVID > 4094) {
+		return fmt.Errorf("bad bridge_vlan_default_pvid %d", *c.VlanDefaultPVID)
+	}
+	return nil
+}
+
+// tuneBridge applies the conf to the bridge via sysfs. Stp goes first as the kernel limits forward delay of stp
+// bridges. Times of sysfs are in centiseconds.
+func (c *BridgeConf) tuneBridge(bridgeName string) error {
+	dir := filepath.Join(sysfsRoot, "class", "net", bridgeName, "bridge")
+	for _, setting := range []struct {
+		file  string
+		value *int
+		scale int
+	}{
+		{file: "stp_state", value: boolInt(c.STP), scale: 1},
+		{file: "forward_delay", value: c.ForwardDelay, scale: 100},
+		{file: "ageing_time", value: c.AgeingTime, scale: 100},
+		{file: "default_pvid", value: c.VlanDefaultPVID, scale: 1},
+	} {
+		if setting.value == nil {
+			continue
+		}
+		value := strconv.Itoa(*setting.value*setting.scale) + "\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, setting.file), []byte(value), 0644); err != nil {
+			return fmt.Errorf("failed to set %s of bridge %s: %v", setting.file, bridgeName, err)
+		}
+	}
+	return nil
+}
+
+func boolInt(b *bool) *int {
+	if b == nil {
+		return nil
+	}
+	var i int
+	if *b {
+		i = 1
+	}
+	return &i
+}
@@ -0,0 +1,74 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTuneBridge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	defer func(root string) { sysfsRoot = root }(sysfsRoot)
+	sysfsRoot = dir
+	brDir := filepath.Join(dir, "class", "net", "docker10", "bridge")
+	if err := os.MkdirAll(brDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	d := &VlanDriver{}
+	conf := `{"device": "eth1", "bridge_stp": false, "bridge_forward_delay": 0, "bridge_ageing_time": 300}`
+	if _, err := d.LoadConf([]byte(conf)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.tuneBridge("docker10"); err != nil {
+		t.Fatal(err)
+	}
+	for file, expect := range map[string]string{"stp_state": "0\n", "forward_delay": "0\n",
+		"ageing_time": "30000\n"} {
+		data, err := ioutil.ReadFile(filepath.Join(brDir, file))
+		if err != nil || string(data) != expect {
+			t.Errorf("%s: expect %q, real %q, err %v", file, expect, string(data), err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(brDir, "default_pvid")); !os.IsNotExist(err) {
+		t.Errorf("expect default_pvid untouched, err %v", err)
+	}
+}
+
+func TestValidateBridgeConf(t *testing.T) {
+	for i, c := range []struct {
+		conf string
+		err  bool
+	}{
+		{conf: `{"bridge_stp": true, "bridge_forward_delay": 15, "bridge_vlan_default_pvid": 0}`},
+		{conf: `{"bridge_stp": true, "bridge_forward_delay": 0}`, err: true},
+		{conf: `{"bridge_forward_delay": 31}`, err: true},
+		{conf: `{"bridge_ageing_time": -1}`, err: true},
+		{conf: `{"bridge_vlan_default_pvid": 4095}`, err: true},
+	} {
+		d := &VlanDriver{}
+		if _, err := d.LoadConf([]byte(c.conf)); (err != nil) != c.err {
+			t.Errorf("case %d: expect err %v, real %v", i, c.err, err)
+		}
+	}
+}
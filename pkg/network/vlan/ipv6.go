@@ -0,0 +1,109 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"tkestack.io/galaxy/pkg/utils"
+)
+
+const (
+	// IPv6Disable disables ipv6 of pods of the network
+	IPv6Disable = "disable"
+	// IPv6Harden keeps ipv6 of pods of the network but ignores router advertisements and redirects in them
+	IPv6Harden = "harden"
+	// IPv6Keep leaves ipv6 of pods of the network as is
+	IPv6Keep = "keep"
+)
+
+// validateIPv6Mode checks ipv6_mode of the network, empty follows --ipv6-mode of galaxy
+func validateIPv6Mode(mode string) error {
+	switch mode {
+	case "", IPv6Disable, IPv6Harden, IPv6Keep:
+		return nil
+	}
+	return fmt.Errorf("unknown ipv6_mode %q", mode)
+}
+
+// movableAddrs returns addresses of the device which are moved to the default bridge: ipv4 ones except loopback ones
+// and permanent global ipv6 ones. Link local ipv6 addresses are generated by the kernel for each link and
+// autoconfigured ones are learned again by the bridge from router advertisements.
+func movableAddrs(addrs []netlink.Addr) []netlink.Addr {
+	var ret []netlink.Addr
+	for _, addr := range addrs {
+		if addr.IP.IsLoopback() {
+			continue
+		}
+		if addr.IP.To4() == nil {
+			if addr.IP.IsLinkLocalUnicast() || addr.Flags&unix.IFA_F_PERMANENT == 0 {
+				continue
+			}
+			// the address is ours already, don't make the bridge wait for duplicate address detection
+			addr.Flags |= unix.IFA_F_NODAD
+		}
+		ret = append(ret, addr)
+	}
+	return ret
+}
+
+// movableV6Routes returns ipv6 routes of rs which are moved along with addresses, routes learned from router
+// advertisements are learned again by the bridge
+func movableV6Routes(rs []netlink.Route) []netlink.Route {
+	var ret []netlink.Route
+	for _, r := range rs {
+		if r.Protocol != unix.RTPROT_RA {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// SetupPureIPv6 makes the host answer neighbor solicitations of the uplink for ip of a pure mode pod and those of the
+// pod for its gateway, which is what proxy arp does for ipv4. The /128 route of ip via hostVeth is added along with
+// the veth.
+func (d *VlanDriver) SetupPureIPv6(hostVeth string, ip, gateway net.IP) error {
+	for _, dev := range []string{d.Device, hostVeth} {
+		if err := ioutil.WriteFile(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/proxy_ndp", dev), []byte("1\n"),
+			0644); err != nil {
+			return fmt.Errorf("failed to set proxy ndp of %s: %v", dev, err)
+		}
+	}
+	proxies := []struct {
+		dev string
+		ip  net.IP
+	}{{dev: d.Device, ip: ip}, {dev: hostVeth, ip: gateway}}
+	for _, p := range proxies {
+		if p.ip == nil {
+			continue
+		}
+		link, err := netlink.LinkByName(p.dev)
+		if err != nil {
+			return err
+		}
+		neigh := &netlink.Neigh{LinkIndex: link.Attrs().Index, Family: unix.AF_INET6, Flags: netlink.NTF_PROXY,
+			IP: p.ip}
+		if err := utils.RetryTransient(func() error { return netlink.NeighSet(neigh) }); err != nil {
+			return fmt.Errorf("failed to add proxy neighbor %s of %s: %v", p.ip, p.dev, err)
+		}
+	}
+	return nil
+}
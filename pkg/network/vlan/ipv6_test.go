@@ -0,0 +1,65 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestMovableAddrs(t *testing.T) {
+	addr := func(cidr string, flags int) netlink.Addr {
+		ip, ipNet, _ := net.ParseCIDR(cidr)
+		ipNet.IP = ip
+		return netlink.Addr{IPNet: ipNet, Flags: flags}
+	}
+	addrs := movableAddrs([]netlink.Addr{
+		addr("192.168.0.5/24", unix.IFA_F_PERMANENT),
+		addr("127.0.0.1/8", unix.IFA_F_PERMANENT),
+		addr("2001:db8::5/64", unix.IFA_F_PERMANENT),
+		addr("2001:db8::6/64", 0),
+		addr("fe80::1/64", unix.IFA_F_PERMANENT),
+	})
+	if len(addrs) != 2 || addrs[0].IP.String() != "192.168.0.5" || addrs[1].IP.String() != "2001:db8::5" {
+		t.Fatalf("expect 192.168.0.5 and 2001:db8::5, real %v", addrs)
+	}
+	if addrs[1].Flags&unix.IFA_F_NODAD == 0 {
+		t.Errorf("expect nodad of moved ipv6 address")
+	}
+}
+
+func TestMovableV6Routes(t *testing.T) {
+	rs := movableV6Routes([]netlink.Route{{Protocol: unix.RTPROT_BOOT}, {Protocol: unix.RTPROT_RA},
+		{Protocol: unix.RTPROT_KERNEL}})
+	if len(rs) != 2 || rs[0].Protocol != unix.RTPROT_BOOT || rs[1].Protocol != unix.RTPROT_KERNEL {
+		t.Fatalf("expect routes except ra ones, real %v", rs)
+	}
+}
+
+func TestValidateIPv6Mode(t *testing.T) {
+	for _, mode := range []string{"", IPv6Disable, IPv6Harden, IPv6Keep} {
+		if err := validateIPv6Mode(mode); err != nil {
+			t.Errorf("mode %q: %v", mode, err)
+		}
+	}
+	if err := validateIPv6Mode("enable"); err == nil {
+		t.Errorf("expect an error for an unknown mode")
+	}
+}
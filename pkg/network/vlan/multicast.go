@@ -0,0 +1,139 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// sysfsRoot is where sysfs of the host is mounted
+var sysfsRoot = "/sys"
+
+// MulticastConf enables multicast of pods on a vlan network
+type MulticastConf struct {
+	// Snooping turns on igmp snooping of vlan bridges so that groups are only forwarded to ports which joined them,
+	// default true
+	Snooping *bool `json:"snooping"`
+	// Querier makes vlan bridges send igmp queries, which is required for snooping if the underlay has no querier
+	Querier bool `json:"querier"`
+	// IGMPVersion forces the igmp version of pod interfaces, 0 means the kernel default
+	IGMPVersion int `json:"igmp_version"`
+	// Routes are multicast groups routed out of the pod interface, e.g. 239.1.0.0/16, so that senders of pods with
+	// multiple interfaces pick the vlan interface rather than the default route
+	Routes []string `json:"routes"`
+}
+
+// SnoopingEnabled returns if igmp snooping of bridges should be on
+func (c *MulticastConf) SnoopingEnabled() bool {
+	return c.Snooping == nil || *c.Snooping
+}
+
+// Validate checks values of the conf
+func (c *MulticastConf) Validate() error {
+	if c.IGMPVersion != 0 && c.IGMPVersion != 2 && c.IGMPVersion != 3 {
+		return fmt.Errorf("bad igmp_version %d", c.IGMPVersion)
+	}
+	_, err := c.routes()
+	return err
+}
+
+func (c *MulticastConf) routes() ([]*net.IPNet, error) {
+	var dsts []*net.IPNet
+	for _, route := range c.Routes {
+		_, dst, err := net.ParseCIDR(route)
+		if err != nil {
+			return nil, fmt.Errorf("bad multicast route %q: %v", route, err)
+		}
+		if dst.IP.To4() == nil || !dst.IP.IsMulticast() {
+			return nil, fmt.Errorf("%s is not an ipv4 multicast range", route)
+		}
+		dsts = append(dsts, dst)
+	}
+	return dsts, nil
+}
+
+// SetupBridgeMulticast applies snooping and querier settings to the bridge, it does nothing if multicast is not
+// enabled
+func (d *VlanDriver) SetupBridgeMulticast(bridgeName string) error {
+	if d.Multicast == nil || bridgeName == "" {
+		return nil
+	}
+	dir := filepath.Join(sysfsRoot, "class", "net", bridgeName, "bridge")
+	for file, on := range map[string]bool{
+		"multicast_snooping": d.Multicast.SnoopingEnabled(),
+		"multicast_querier":  d.Multicast.Querier,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(boolValue(on)), 0644); err != nil {
+			return fmt.Errorf("failed to set %s of bridge %s: %v", file, bridgeName, err)
+		}
+	}
+	return nil
+}
+
+// SetupPodMulticast forces the igmp version of the interface within the netns and adds multicast routes via it, it
+// does nothing if multicast is not enabled
+func (d *VlanDriver) SetupPodMulticast(netnsPath, ifName string) error {
+	if d.Multicast == nil {
+		return nil
+	}
+	dsts, err := d.Multicast.routes()
+	if err != nil {
+		return err
+	}
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", netnsPath, err)
+	}
+	defer netns.Close() // nolint: errcheck
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return err
+		}
+		if link.Attrs().Flags&net.FlagMulticast == 0 {
+			return fmt.Errorf("interface %s doesn't support multicast", ifName)
+		}
+		if d.Multicast.IGMPVersion != 0 {
+			// /proc/sys/net is resolved by the netns of the opening thread
+			file := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/force_igmp_version", ifName)
+			if err := ioutil.WriteFile(file, []byte(strconv.Itoa(d.Multicast.IGMPVersion)+"\n"), 0644); err != nil {
+				return err
+			}
+		}
+		for _, dst := range dsts {
+			route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Scope: netlink.SCOPE_LINK}
+			if err := netlink.RouteReplace(route); err != nil {
+				return fmt.Errorf("failed to add multicast route %s: %v", dst, err)
+			}
+		}
+		return nil
+	})
+}
+
+func boolValue(on bool) string {
+	if on {
+		return "1\n"
+	}
+	return "0\n"
+}
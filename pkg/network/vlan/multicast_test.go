@@ -0,0 +1,76 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetupBridgeMulticast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multicast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	defer func(root string) { sysfsRoot = root }(sysfsRoot)
+	sysfsRoot = dir
+	brDir := filepath.Join(dir, "class", "net", "docker10", "bridge")
+	if err := os.MkdirAll(brDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	d := &VlanDriver{}
+	if _, err := d.LoadConf([]byte(`{"device": "eth1", "multicast": {"querier": true}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetupBridgeMulticast("docker10"); err != nil {
+		t.Fatal(err)
+	}
+	for file, expect := range map[string]string{"multicast_snooping": "1\n", "multicast_querier": "1\n"} {
+		data, err := ioutil.ReadFile(filepath.Join(brDir, file))
+		if err != nil || string(data) != expect {
+			t.Errorf("%s: expect %q, real %q, err %v", file, expect, string(data), err)
+		}
+	}
+	// multicast is not enabled
+	if _, err := d.LoadConf([]byte(`{"device": "eth1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetupBridgeMulticast("docker11"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateMulticast(t *testing.T) {
+	for i, c := range []struct {
+		conf string
+		err  bool
+	}{
+		{conf: `{"igmp_version": 2, "routes": ["239.1.0.0/16", "224.0.0.0/4"]}`},
+		{conf: `{"igmp_version": 1}`, err: true},
+		{conf: `{"routes": ["10.0.0.0/8"]}`, err: true},
+		{conf: `{"routes": ["ff02::/16"]}`, err: true},
+	} {
+		d := &VlanDriver{}
+		_, err := d.LoadConf([]byte(`{"device": "eth1", "multicast": ` + c.conf + `}`))
+		if (err != nil) != c.err {
+			t.Errorf("case %d: expect err %v, real %v", i, c.err, err)
+		}
+	}
+}
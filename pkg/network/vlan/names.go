@@ -0,0 +1,89 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxVlanIdLen is the max number of digits of vlan ids suffixed to name prefixes
+const maxVlanIdLen = 4
+
+var (
+	// reservedNames are devices created by docker, flannel and other network components which rendered names must
+	// not take
+	reservedNames = []string{"docker0", "cni0", "flannel.1", "tunl0", "kube-ipvs0", "lo"}
+	// reservedPrefixes are name prefixes of pod interfaces of galaxy and other cni plugins
+	reservedPrefixes = []string{"v-h", "v-s", "mv-", "veth"}
+)
+
+// validDeviceName returns an error if the kernel refuses name as a device name
+func validDeviceName(name string) error {
+	if name == "" || name == "." || name == ".." || len(name) > 15 || strings.ContainsAny(name, "/: \t\n") {
+		return fmt.Errorf("invalid device name %q", name)
+	}
+	return nil
+}
+
+// prefixesCollide returns true if names rendered by prefix a and b, i.e. followed by vlan ids, may be the same
+func prefixesCollide(a, b string) bool {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	if !strings.HasPrefix(b, a) {
+		return false
+	}
+	return strings.Trim(b[len(a):], "0123456789") == ""
+}
+
+// #lizard forgives
+// validateNames rejects names and prefixes which render invalid names, or names colliding with each other or with
+// devices of others. Creating devices of such names fails confusingly or, worse, takes over devices of others.
+func (conf *NetConf) validateNames() error {
+	for _, prefix := range []string{conf.BridgeNamePrefix, conf.VlanNamePrefix} {
+		if err := validDeviceName(prefix + strings.Repeat("9", maxVlanIdLen)); err != nil {
+			return fmt.Errorf("bad name prefix %q: %v", prefix, err)
+		}
+	}
+	if err := validDeviceName(conf.DefaultBridgeName); err != nil {
+		return fmt.Errorf("bad default_bridge_name: %v", err)
+	}
+	if prefixesCollide(conf.BridgeNamePrefix, conf.VlanNamePrefix) {
+		return fmt.Errorf("bridge_name_prefix %q and vlan_name_prefix %q render colliding names",
+			conf.BridgeNamePrefix, conf.VlanNamePrefix)
+	}
+	if isVlanName(conf.DefaultBridgeName, conf.BridgeNamePrefix) || isVlanName(conf.DefaultBridgeName,
+		conf.VlanNamePrefix) {
+		return fmt.Errorf("default_bridge_name %q collides with names rendered by bridge_name_prefix %q or "+
+			"vlan_name_prefix %q", conf.DefaultBridgeName, conf.BridgeNamePrefix, conf.VlanNamePrefix)
+	}
+	for _, name := range reservedNames {
+		if name == conf.DefaultBridgeName || isVlanName(name, conf.BridgeNamePrefix) ||
+			isVlanName(name, conf.VlanNamePrefix) {
+			return fmt.Errorf("names of bridge or vlan devices collide with reserved device %s", name)
+		}
+	}
+	for _, reserved := range reservedPrefixes {
+		for _, name := range []string{conf.DefaultBridgeName, conf.BridgeNamePrefix, conf.VlanNamePrefix} {
+			if strings.HasPrefix(name, reserved) {
+				return fmt.Errorf("%q begins with %q which is reserved for pod interfaces", name, reserved)
+			}
+		}
+	}
+	return nil
+}
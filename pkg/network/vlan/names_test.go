@@ -0,0 +1,47 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import "testing"
+
+func TestValidateNames(t *testing.T) {
+	for i, c := range []struct {
+		defaultBridge, bridgePrefix, vlanPrefix string
+		valid                                   bool
+	}{
+		{valid: true},
+		{defaultBridge: "br0", bridgePrefix: "br", vlanPrefix: "vl", valid: true},
+		{bridgePrefix: "vlan"},
+		{bridgePrefix: "vlan1"},
+		{bridgePrefix: "vlan-", valid: true},
+		{defaultBridge: "docker2"},
+		{defaultBridge: "vlan2"},
+		{defaultBridge: "docker0"},
+		{vlanPrefix: "flannel."},
+		{bridgePrefix: "veth"},
+		{defaultBridge: "v-hbr"},
+		{bridgePrefix: "averylongname"},
+		{vlanPrefix: "vlan/"},
+	} {
+		conf := &NetConf{DefaultBridgeName: c.defaultBridge, BridgeNamePrefix: c.bridgePrefix,
+			VlanNamePrefix: c.vlanPrefix}
+		conf.setDefaults()
+		if err := conf.validateNames(); (err == nil) != c.valid {
+			t.Errorf("case %d: expect valid %v, real %v", i, c.valid, err)
+		}
+	}
+}
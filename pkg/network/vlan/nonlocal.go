@@ -0,0 +1,92 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"tkestack.io/galaxy/pkg/utils/store"
+)
+
+const (
+	// NonlocalBindHost sets net.ipv4.ip_nonlocal_bind of the host in pure mode, so that the arping fallback of
+	// gratuitous arps may send from ips of pods which are not local
+	NonlocalBindHost = "host"
+	// NonlocalBindNone leaves the sysctl untouched. Gratuitous arps are sent by packet sockets which need no local
+	// address, only the arping fallback fails.
+	NonlocalBindNone = "none"
+)
+
+var (
+	nonlocalBindSysctl = "/proc/sys/net/ipv4/ip_nonlocal_bind"
+	// nonlocalBindStateFile records the value of the sysctl before the driver set it, so that it can be reverted
+	nonlocalBindStateFile = "/var/lib/cni/galaxy/vlan/ip_nonlocal_bind"
+)
+
+func validateNonlocalBind(nonlocalBind string) error {
+	switch nonlocalBind {
+	case NonlocalBindHost, NonlocalBindNone:
+		return nil
+	}
+	return fmt.Errorf("unknown nonlocal_bind %q", nonlocalBind)
+}
+
+// setupNonlocalBind applies NonlocalBind in pure mode. NonlocalBindNone reverts the sysctl if a previous config set
+// it.
+func (conf *NetConf) setupNonlocalBind() error {
+	if conf.NonlocalBind == NonlocalBindNone {
+		return revertNonlocalBind()
+	}
+	return enableNonlocalBind()
+}
+
+// enableNonlocalBind sets the sysctl, the value before it is recorded only once so that it survives repeated calls
+func enableNonlocalBind() error {
+	if _, err := os.Stat(nonlocalBindStateFile); os.IsNotExist(err) {
+		data, err := ioutil.ReadFile(nonlocalBindSysctl)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(nonlocalBindStateFile), 0755); err != nil {
+			return err
+		}
+		if err := store.WriteFile(nonlocalBindStateFile, data, 0644); err != nil {
+			return fmt.Errorf("failed to record %s: %v", nonlocalBindSysctl, err)
+		}
+	} else if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(nonlocalBindSysctl, []byte("1\n"), 0644)
+}
+
+// revertNonlocalBind restores the sysctl recorded by enableNonlocalBind, it does nothing if there is no record
+func revertNonlocalBind() error {
+	data, err := ioutil.ReadFile(nonlocalBindStateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := ioutil.WriteFile(nonlocalBindSysctl, data, 0644); err != nil {
+		return err
+	}
+	return os.Remove(nonlocalBindStateFile)
+}
@@ -0,0 +1,78 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// #lizard forgives
+func TestNonlocalBind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nonlocal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	oldSysctl, oldState := nonlocalBindSysctl, nonlocalBindStateFile
+	defer func() {
+		nonlocalBindSysctl, nonlocalBindStateFile = oldSysctl, oldState
+	}()
+	nonlocalBindSysctl = filepath.Join(dir, "ip_nonlocal_bind")
+	nonlocalBindStateFile = filepath.Join(dir, "state", "ip_nonlocal_bind")
+	if err := ioutil.WriteFile(nonlocalBindSysctl, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectSysctl := func(expect string) {
+		data, err := ioutil.ReadFile(nonlocalBindSysctl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expect {
+			t.Fatalf("expect %q, real %q", expect, string(data))
+		}
+	}
+	host := &NetConf{NonlocalBind: NonlocalBindHost}
+	for i := 0; i < 2; i++ {
+		// the value before the first call is kept
+		if err := host.setupNonlocalBind(); err != nil {
+			t.Fatal(err)
+		}
+		expectSysctl("1\n")
+	}
+	none := &NetConf{NonlocalBind: NonlocalBindNone}
+	if err := none.setupNonlocalBind(); err != nil {
+		t.Fatal(err)
+	}
+	expectSysctl("0\n")
+	if _, err := os.Stat(nonlocalBindStateFile); !os.IsNotExist(err) {
+		t.Fatalf("expect state file removed, real %v", err)
+	}
+	// nothing to revert
+	if err := ioutil.WriteFile(nonlocalBindSysctl, []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := revertNonlocalBind(); err != nil {
+		t.Fatal(err)
+	}
+	expectSysctl("1\n")
+	if err := validateNonlocalBind("global"); err == nil {
+		t.Fatal("expect error of unknown value")
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"tkestack.io/galaxy/pkg/utils"
+)
+
+const (
+	defaultProbeTimeout = 200 * time.Millisecond
+	defaultProbeRetries = 2
+)
+
+// ConflictProbeConf enables probing ips of pods by arp before setting them up, so that an ip in use on the underlay
+// fails the ADD request instead of being assigned twice
+type ConflictProbeConf struct {
+	// Timeout is how long each probe waits for replies, default 200ms
+	Timeout string `json:"timeout"`
+	// Retries is the number of probes sent after the first one, default 2
+	Retries *int `json:"retries"`
+}
+
+// Validate checks values of the conf
+func (c *ConflictProbeConf) Validate() error {
+	if _, err := c.timeout(); err != nil {
+		return err
+	}
+	if c.Retries != nil && (*c.Retries < 0 || *c.Retries > 10) {
+		return fmt.Errorf("conflict_probe retries %d is not within 0-10", *c.Retries)
+	}
+	return nil
+}
+
+func (c *ConflictProbeConf) timeout() (time.Duration, error) {
+	if c.Timeout == "" {
+		return defaultProbeTimeout, nil
+	}
+	timeout, err := time.ParseDuration(c.Timeout)
+	if err != nil || timeout <= 0 || timeout > 10*time.Second {
+		return 0, fmt.Errorf("bad conflict_probe timeout %q", c.Timeout)
+	}
+	return timeout, nil
+}
+
+func (c *ConflictProbeConf) retries() int {
+	if c.Retries == nil {
+		return defaultProbeRetries
+	}
+	return *c.Retries
+}
+
+// IPConflictError is the error of an ip which another host of the underlay has
+type IPConflictError struct {
+	IP  net.IP
+	MAC net.HardwareAddr
+	Dev string
+}
+
+func (e *IPConflictError) Error() string {
+	return fmt.Sprintf("ip %s is in use by %s on %s", e.IP, e.MAC, e.Dev)
+}
+
+// ProbeIP probes ip of vlanId by arp from the host device of the vlan if conflict_probe is set, before the ip is set
+// up for a pod. It returns an IPConflictError if another host replies. Pods of sriov switch are not probed as their
+// vfs bypass host devices. Call it after Init.
+func (d *VlanDriver) ProbeIP(ip net.IP, vlanId uint16) error {
+	if d.ConflictProbe == nil || d.SRIOVMode() || ip.To4() == nil {
+		return nil
+	}
+	dev, err := d.probeDevice(vlanId)
+	if err != nil {
+		return err
+	}
+	timeout, _ := d.ConflictProbe.timeout()
+	mac, err := utils.ProbeIP(dev, ip, 1+d.ConflictProbe.retries(), timeout)
+	if err != nil {
+		return fmt.Errorf("failed to probe ip %s on %s: %v", ip, dev, err)
+	}
+	if mac != nil {
+		return &IPConflictError{IP: ip, MAC: mac, Dev: dev}
+	}
+	return nil
+}
+
+// probeDevice returns the host device pods of vlanId reach the underlay by, i.e. the bridge of the vlan, or the vlan
+// device of macvlan and ipvlan switches and pure switch of vlan 0 which has no bridge
+func (d *VlanDriver) probeDevice(vlanId uint16) (string, error) {
+	if d.MacVlanMode() || d.IPVlanMode() {
+		return d.EnsureVlanDevice(vlanId)
+	}
+	bridgeName, err := d.CreateBridgeAndVlanDevice(vlanId)
+	if err != nil || bridgeName != "" {
+		return bridgeName, err
+	}
+	return d.Device, nil
+}
@@ -0,0 +1,52 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateConflictProbe(t *testing.T) {
+	for i, c := range []struct {
+		conf    string
+		err     bool
+		timeout time.Duration
+		retries int
+	}{
+		{conf: `{}`, timeout: 200 * time.Millisecond, retries: 2},
+		{conf: `{"timeout": "1s", "retries": 0}`, timeout: time.Second, retries: 0},
+		{conf: `{"timeout": "1"}`, err: true},
+		{conf: `{"timeout": "-1s"}`, err: true},
+		{conf: `{"retries": -1}`, err: true},
+		{conf: `{"retries": 11}`, err: true},
+	} {
+		d := &VlanDriver{}
+		conf, err := d.LoadConf([]byte(`{"device": "eth1", "conflict_probe": ` + c.conf + `}`))
+		if (err != nil) != c.err {
+			t.Errorf("case %d: expect err %v, real %v", i, c.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		if timeout, _ := conf.ConflictProbe.timeout(); timeout != c.timeout ||
+			conf.ConflictProbe.retries() != c.retries {
+			t.Errorf("case %d: expect %v %d, real %v %d", i, c.timeout, c.retries, timeout,
+				conf.ConflictProbe.retries())
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"tkestack.io/galaxy/pkg/utils"
+)
+
+// PodRouteRepair tells what EnsurePodRoute repaired
+type PodRouteRepair struct {
+	Route    bool
+	ProxyARP bool
+}
+
+// EnsurePodRoute ensures the /32 route of a pure mode pod via its host veth and proxy arp of the veth which answers
+// arps of the pod for its gateway. External tooling flushing routes or resetting sysctls may remove them.
+func EnsurePodRoute(hostVeth string, ip net.IP) (*PodRouteRepair, error) {
+	link, err := netlink.LinkByName(hostVeth)
+	if err != nil {
+		return nil, err
+	}
+	repair := &PodRouteRepair{}
+	dst := &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+	route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Scope: netlink.SCOPE_LINK}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, route, netlink.RT_FILTER_DST|netlink.RT_FILTER_OIF)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes of %s: %v", hostVeth, err)
+	}
+	if len(routes) == 0 {
+		if err := netlink.RouteAdd(route); err != nil && !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to add route %s via %s: %v", dst, hostVeth, err)
+		}
+		repair.Route = true
+	}
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/proxy_arp", hostVeth))
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(string(data)) != "1" {
+		if err := utils.SetProxyArp(hostVeth); err != nil {
+			return nil, fmt.Errorf("failed to set proxy arp of %s: %v", hostVeth, err)
+		}
+		repair.ProxyARP = true
+	}
+	return repair, nil
+}
+
+// PurePodIPs returns ipv4 addresses of pure mode pods of the host, i.e. destinations of /32 routes via host veths of
+// pods which are not attached to bridges
+func PurePodIPs() ([]net.IP, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	veths := map[int]bool{}
+	for _, link := range links {
+		if link.Type() == "veth" && link.Attrs().MasterIndex == 0 && strings.HasPrefix(link.Attrs().Name, "v-h") {
+			veths[link.Attrs().Index] = true
+		}
+	}
+	if len(veths) == 0 {
+		return nil, nil
+	}
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, r := range routes {
+		if r.Dst == nil || !veths[r.LinkIndex] {
+			continue
+		}
+		if ones, bits := r.Dst.Mask.Size(); ones == 32 && bits == 32 {
+			ips = append(ips, r.Dst.IP)
+		}
+	}
+	return ips, nil
+}
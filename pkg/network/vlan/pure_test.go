@@ -0,0 +1,102 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"tkestack.io/galaxy/pkg/network/netns"
+)
+
+// #lizard forgives
+func TestEnsurePodRoute(t *testing.T) {
+	ip := net.ParseIP("10.1.0.5")
+	netns.NsInvoke(func() {
+		dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "du1"}}
+		if err := netlink.LinkAdd(dummy); err != nil {
+			t.Fatal(err)
+		}
+		if err := netlink.LinkSetUp(dummy); err != nil {
+			t.Fatal(err)
+		}
+		for i, expect := range []PodRouteRepair{{Route: true, ProxyARP: true}, {}} {
+			repair, err := EnsurePodRoute("du1", ip)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *repair != expect {
+				t.Fatalf("case %d: expect %+v, real %+v", i, expect, *repair)
+			}
+		}
+		// flushed by others
+		dst := &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+		if err := netlink.RouteDel(&netlink.Route{LinkIndex: dummy.Attrs().Index, Dst: dst,
+			Scope: netlink.SCOPE_LINK}); err != nil {
+			t.Fatal(err)
+		}
+		repair, err := EnsurePodRoute("du1", ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !repair.Route || repair.ProxyARP {
+			t.Fatalf("expect route repaired only, real %+v", *repair)
+		}
+		if _, err := EnsurePodRoute("du2", ip); err == nil {
+			t.Fatal("expect error of absent veth")
+		}
+	})
+}
+
+func TestPurePodIPs(t *testing.T) {
+	netns.NsInvoke(func() {
+		for _, name := range []string{"v-h1", "v-h2"} {
+			veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "p"}
+			if err := netlink.LinkAdd(veth); err != nil {
+				t.Fatal(err)
+			}
+			if err := netlink.LinkSetUp(veth); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br1"}}
+		if err := netlink.LinkAdd(bridge); err != nil {
+			t.Fatal(err)
+		}
+		v2, err := netlink.LinkByName("v-h2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := netlink.LinkSetMaster(v2, bridge); err != nil {
+			t.Fatal(err)
+		}
+		// the route via a veth attached to a bridge is not of a pure mode pod
+		for ip, name := range map[string]string{"10.1.0.5": "v-h1", "10.1.0.6": "v-h2"} {
+			if _, err := EnsurePodRoute(name, net.ParseIP(ip)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ips, err := PurePodIPs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || ips[0].String() != "10.1.0.5" {
+			t.Fatalf("expect [10.1.0.5], real %v", ips)
+		}
+	})
+}
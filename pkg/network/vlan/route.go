@@ -0,0 +1,82 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// routeTables returns tables whose routes via the device are migrated to the default bridge, main by default
+func (c *NetConf) routeTables() []int {
+	if len(c.MigrateRouteTables) == 0 {
+		return []int{unix.RT_TABLE_MAIN}
+	}
+	return c.MigrateRouteTables
+}
+
+func validateRouteTables(tables []int) error {
+	for _, table := range tables {
+		// routes of the local table are maintained by the kernel along with addresses
+		if table <= unix.RT_TABLE_UNSPEC || table == unix.RT_TABLE_LOCAL || int64(table) > 1<<32-1 {
+			return fmt.Errorf("bad route table %d", table)
+		}
+	}
+	return nil
+}
+
+// listRoutes lists ipv4 and ipv6 routes via link in tables to migrate
+func (d *VlanDriver) listRoutes(link netlink.Link) ([]netlink.Route, error) {
+	var rs []netlink.Route
+	for _, table := range d.routeTables() {
+		for _, family := range []int{nl.FAMILY_V4, nl.FAMILY_V6} {
+			routes, err := netlink.RouteListFiltered(family, &netlink.Route{LinkIndex: link.Attrs().Index,
+				Table: table}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list routes of table %d of %s: %v", table, link.Attrs().Name, err)
+			}
+			if family == nl.FAMILY_V6 {
+				routes = movableV6Routes(routes)
+			}
+			rs = append(rs, routes...)
+		}
+	}
+	return rs, nil
+}
+
+// movedRoute returns a copy of r via the link of toIndex instead of the one of fromIndex. All attributes such as
+// metric, table and protocol are kept except flags reported by the kernel only.
+func movedRoute(r netlink.Route, fromIndex, toIndex int) netlink.Route {
+	r.LinkIndex = toIndex
+	r.Flags &= int(netlink.FLAG_ONLINK | netlink.FLAG_PERVASIVE)
+	if len(r.MultiPath) > 0 {
+		hops := make([]*netlink.NexthopInfo, len(r.MultiPath))
+		for i, hop := range r.MultiPath {
+			moved := *hop
+			if moved.LinkIndex == fromIndex {
+				moved.LinkIndex = toIndex
+			}
+			moved.Flags &= int(netlink.FLAG_ONLINK | netlink.FLAG_PERVASIVE)
+			hops[i] = &moved
+		}
+		r.MultiPath = hops
+	}
+	return r
+}
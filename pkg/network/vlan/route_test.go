@@ -0,0 +1,57 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestMovedRoute(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("10.0.0.0/8")
+	r := netlink.Route{LinkIndex: 2, Dst: dst, Gw: net.ParseIP("192.168.0.1"), Priority: 100, Table: 100,
+		Protocol: 4, Flags: int(netlink.FLAG_ONLINK) | 0x10, MultiPath: []*netlink.NexthopInfo{
+			{LinkIndex: 2, Gw: net.ParseIP("192.168.0.1")}, {LinkIndex: 3, Gw: net.ParseIP("192.168.1.1")}}}
+	moved := movedRoute(r, 2, 5)
+	expect := netlink.Route{LinkIndex: 5, Dst: dst, Gw: net.ParseIP("192.168.0.1"), Priority: 100, Table: 100,
+		Protocol: 4, Flags: int(netlink.FLAG_ONLINK), MultiPath: []*netlink.NexthopInfo{
+			{LinkIndex: 5, Gw: net.ParseIP("192.168.0.1")}, {LinkIndex: 3, Gw: net.ParseIP("192.168.1.1")}}}
+	if !reflect.DeepEqual(moved, expect) {
+		t.Fatalf("expect %+v, real %+v", expect, moved)
+	}
+	if r.LinkIndex != 2 || r.MultiPath[0].LinkIndex != 2 {
+		t.Fatalf("expect the original route untouched: %+v", r)
+	}
+}
+
+func TestValidateRouteTables(t *testing.T) {
+	for i, c := range []struct {
+		tables []int
+		err    bool
+	}{
+		{tables: []int{254, 100}},
+		{tables: []int{0}, err: true},
+		{tables: []int{255}, err: true},
+	} {
+		if err := validateRouteTables(c.tables); (err != nil) != c.err {
+			t.Errorf("case %d: expect err %v, real %v", i, c.err, err)
+		}
+	}
+}
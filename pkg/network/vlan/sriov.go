@@ -0,0 +1,325 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	t020 "github.com/containernetworking/cni/pkg/types/020"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"tkestack.io/galaxy/pkg/api/cniutil"
+	"tkestack.io/galaxy/pkg/utils"
+	"tkestack.io/galaxy/pkg/utils/store"
+)
+
+// VFPoolDir records VFs allocated to containers, one file per container id, so gc of galaxy releases VFs of
+// containers which are gone without a DEL request
+const VFPoolDir = "/var/lib/cni/galaxy/vf"
+
+// VF is a virtual function of a sriov physical function allocated to a container
+type VF struct {
+	PF    string `json:"pf"`
+	Index int    `json:"index"`
+	// Name is the name of the VF in the host netns, which it is renamed back to on release
+	Name string `json:"name"`
+	Vlan uint16 `json:"vlan"`
+}
+
+// VFPool tracks VFs allocated to containers. Plugins run in parallel processes, so allocations are serialized by
+// a flock of the pool dir.
+type VFPool struct {
+	store *store.FileStore
+	sysfs string
+}
+
+// NewVFPool returns the VFPool of dir
+func NewVFPool(dir string) *VFPool {
+	return &VFPool{store: store.NewFileStore(dir), sysfs: "/sys"}
+}
+
+func (p *VFPool) lock() (func(), error) {
+	if err := os.MkdirAll(p.store.Dir(), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p.store.Dir())
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close() // nolint: errcheck
+		return nil, fmt.Errorf("failed to lock %s: %v", p.store.Dir(), err)
+	}
+	return func() {
+		f.Close() // nolint: errcheck
+	}, nil
+}
+
+// Allocate allocates a free VF of pf to containerID, the VF allocated to it already if any. VFs allocated to other
+// containers or having no netdev in the host netns, e.g. ones moved into pods by others, are not free.
+func (p *VFPool) Allocate(containerID, pf string, vlan uint16) (*VF, error) {
+	unlock, err := p.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	allocated, err := p.allocated()
+	if err != nil {
+		return nil, err
+	}
+	for id, vf := range allocated {
+		if id == containerID && vf.PF == pf {
+			return vf, nil
+		}
+	}
+	used := map[int]bool{}
+	for _, vf := range allocated {
+		if vf.PF == pf {
+			used[vf.Index] = true
+		}
+	}
+	numVFs, err := p.readInt(pf, "sriov_numvfs")
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < numVFs; i++ {
+		if used[i] {
+			continue
+		}
+		name, err := p.vfNetdev(pf, i)
+		if err != nil || name == "" {
+			continue
+		}
+		vf := &VF{PF: pf, Index: i, Name: name, Vlan: vlan}
+		data, err := json.Marshal(vf)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.store.Put(containerID, data); err != nil {
+			return nil, err
+		}
+		return vf, nil
+	}
+	return nil, fmt.Errorf("no free vf of %s, %d of %d allocated", pf, len(used), numVFs)
+}
+
+// Get returns the VF allocated to containerID, nil if none
+func (p *VFPool) Get(containerID string) (*VF, error) {
+	data, err := p.store.Get(containerID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var vf VF
+	if err := json.Unmarshal(data, &vf); err != nil {
+		return nil, fmt.Errorf("bad vf of %s: %v", containerID, err)
+	}
+	return &vf, nil
+}
+
+// Release frees the VF allocated to containerID
+func (p *VFPool) Release(containerID string) error {
+	if err := p.store.Delete(containerID); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (p *VFPool) allocated() (map[string]*VF, error) {
+	keys, err := p.store.Keys()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	ret := map[string]*VF{}
+	for _, key := range keys {
+		vf, err := p.Get(key)
+		if err != nil || vf == nil {
+			// a VF of a broken record stays unavailable until gc removes it
+			continue
+		}
+		ret[key] = vf
+	}
+	return ret, nil
+}
+
+// vfNetdev returns the netdev of VF index of pf in the current netns, "" if it has none
+func (p *VFPool) vfNetdev(pf string, index int) (string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(p.sysfs, "class/net", pf, "device",
+		fmt.Sprintf("virtfn%d", index), "net"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	if len(infos) != 1 {
+		return "", nil
+	}
+	return infos[0].Name(), nil
+}
+
+func (p *VFPool) readInt(pf, kind string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(p.sysfs, "class/net", pf, "device", kind))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s of %s: %v", kind, pf, err)
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("bad %s of %s: %v", kind, pf, err)
+	}
+	return v, nil
+}
+
+// ensureVFs enables vf_num VFs, or all VFs if vf_num is 0, of the device if it has none enabled
+func (p *VFPool) ensureVFs(pf string, vfNum int) error {
+	numVFs, err := p.readInt(pf, "sriov_numvfs")
+	if err != nil {
+		return err
+	}
+	if numVFs > 0 {
+		return nil
+	}
+	total, err := p.readInt(pf, "sriov_totalvfs")
+	if err != nil {
+		return err
+	}
+	if vfNum == 0 || vfNum > total {
+		vfNum = total
+	}
+	if vfNum == 0 {
+		return fmt.Errorf("%s supports no vf", pf)
+	}
+	return ioutil.WriteFile(filepath.Join(p.sysfs, "class/net", pf, "device", "sriov_numvfs"),
+		[]byte(strconv.Itoa(vfNum)), 0644)
+}
+
+// SRIOVMode returns whether VFs of the device are attached to pods
+func (d *VlanDriver) SRIOVMode() bool {
+	return d.Switch == "sriov"
+}
+
+// SetupVF allocates a VF of the device to the container, tags it with vlan by the device and moves it into netns as
+// ifName of result
+func (d *VlanDriver) SetupVF(pool *VFPool, containerID string, vlan uint16, netnsPath, ifName string,
+	result *t020.Result) (err error) {
+	if err := pool.ensureVFs(d.Device, d.VFNum); err != nil {
+		return fmt.Errorf("failed to enable vfs of %s: %v", d.Device, err)
+	}
+	vf, err := pool.Allocate(containerID, d.Device, vlan)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			pool.Release(containerID) // nolint: errcheck
+		}
+	}()
+	pf, err := netlink.LinkByName(d.Device)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetVfVlan(pf, vf.Index, int(vlan)); err != nil {
+		return fmt.Errorf("failed to set vlan %d of vf %d of %s: %v", vlan, vf.Index, d.Device, err)
+	}
+	link, err := netlink.LinkByName(vf.Name)
+	if err != nil {
+		return fmt.Errorf("failed to find vf %s: %v", vf.Name, err)
+	}
+	if err := netlink.LinkSetDown(link); err != nil {
+		return err
+	}
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", netnsPath, err)
+	}
+	defer netns.Close() // nolint: errcheck
+	if err := netlink.LinkSetNsFd(link, int(netns.Fd())); err != nil {
+		return fmt.Errorf("failed to move vf %s to netns: %v", vf.Name, err)
+	}
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(vf.Name)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetName(link, ifName); err != nil {
+			return fmt.Errorf("failed to rename vf %s to %s: %v", vf.Name, ifName, err)
+		}
+		return cniutil.ConfigureIface(ifName, result)
+	})
+}
+
+// ReleaseVF moves the VF of the container back to the host netns with its original name, clears its vlan and frees
+// it. VFs of destroyed netns are moved back by the kernel.
+func (d *VlanDriver) ReleaseVF(pool *VFPool, containerID, netnsPath, ifName string) error {
+	vf, err := pool.Get(containerID)
+	if err != nil || vf == nil {
+		return err
+	}
+	if netns, err := ns.GetNS(netnsPath); err == nil {
+		defer netns.Close() // nolint: errcheck
+		hostNS, err := ns.GetCurrentNS()
+		if err != nil {
+			return err
+		}
+		defer hostNS.Close() // nolint: errcheck
+		if err := netns.Do(func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(ifName)
+			if err != nil {
+				if utils.IsLinkNotFound(err) {
+					return nil
+				}
+				return err
+			}
+			if err := netlink.LinkSetDown(link); err != nil {
+				return err
+			}
+			// avoid conflicting with names of the host netns
+			if err := netlink.LinkSetName(link, vf.Name); err != nil {
+				return err
+			}
+			return netlink.LinkSetNsFd(link, int(hostNS.Fd()))
+		}); err != nil {
+			return fmt.Errorf("failed to move vf %s back: %v", vf.Name, err)
+		}
+	}
+	if name, err := pool.vfNetdev(vf.PF, vf.Index); err == nil && name != "" && name != vf.Name {
+		// moved back by the kernel under another name
+		if link, err := netlink.LinkByName(name); err == nil {
+			if err := netlink.LinkSetName(link, vf.Name); err != nil {
+				return fmt.Errorf("failed to rename vf %s to %s: %v", name, vf.Name, err)
+			}
+		}
+	}
+	if pf, err := netlink.LinkByName(vf.PF); err == nil {
+		if err := netlink.LinkSetVfVlan(pf, vf.Index, 0); err != nil {
+			return fmt.Errorf("failed to clear vlan of vf %d of %s: %v", vf.Index, vf.PF, err)
+		}
+	}
+	return pool.Release(containerID)
+}
@@ -0,0 +1,119 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tkestack.io/galaxy/pkg/utils/store"
+)
+
+// fakeVFs creates sysfs of pf having numVFs VFs, of which the ones in netdevs have a netdev
+func fakeVFs(t *testing.T, sysfs, pf string, total, numVFs int, netdevs map[int]string) {
+	device := filepath.Join(sysfs, "class/net", pf, "device")
+	if err := os.MkdirAll(device, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for kind, v := range map[string]int{"sriov_totalvfs": total, "sriov_numvfs": numVFs} {
+		if err := ioutil.WriteFile(filepath.Join(device, kind), []byte(fmt.Sprintf("%d\n", v)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, name := range netdevs {
+		if err := os.MkdirAll(filepath.Join(device, fmt.Sprintf("virtfn%d", i), "net", name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// #lizard forgives
+func TestVFPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vfpool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	sysfs := filepath.Join(dir, "sys")
+	// vf 1 has been moved into a netns by others
+	fakeVFs(t, sysfs, "eth1", 4, 3, map[int]string{0: "eth1v0", 2: "eth1v2"})
+	pool := &VFPool{store: store.NewFileStore(filepath.Join(dir, "vf")), sysfs: sysfs}
+
+	vf, err := pool.Allocate("c1", "eth1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *vf != (VF{PF: "eth1", Index: 0, Name: "eth1v0", Vlan: 2}) {
+		t.Fatalf("unexpected vf %+v", *vf)
+	}
+	if vf, err = pool.Allocate("c1", "eth1", 2); err != nil || vf.Index != 0 {
+		t.Fatalf("expect the allocated vf 0, got %+v %v", vf, err)
+	}
+	if vf, err = pool.Allocate("c2", "eth1", 3); err != nil || vf.Index != 2 || vf.Vlan != 3 {
+		t.Fatalf("expect vf 2, got %+v %v", vf, err)
+	}
+	if _, err = pool.Allocate("c3", "eth1", 3); err == nil {
+		t.Fatal("expect no free vf")
+	}
+	if vf, err = pool.Get("c2"); err != nil || vf == nil || vf.Name != "eth1v2" {
+		t.Fatalf("expect vf eth1v2 of c2, got %+v %v", vf, err)
+	}
+	if err := pool.Release("c2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Release("c2"); err != nil {
+		t.Fatal(err)
+	}
+	if vf, err = pool.Get("c2"); err != nil || vf != nil {
+		t.Fatalf("expect no vf of c2, got %+v %v", vf, err)
+	}
+	if vf, err = pool.Allocate("c3", "eth1", 3); err != nil || vf.Index != 2 {
+		t.Fatalf("expect the released vf 2, got %+v %v", vf, err)
+	}
+}
+
+func TestEnsureVFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vfpool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	pool := &VFPool{sysfs: dir}
+	for i, c := range []struct {
+		total, numVFs, vfNum, expect int
+	}{
+		{total: 8, numVFs: 0, vfNum: 0, expect: 8},
+		{total: 8, numVFs: 0, vfNum: 4, expect: 4},
+		{total: 8, numVFs: 0, vfNum: 16, expect: 8},
+		{total: 8, numVFs: 2, vfNum: 4, expect: 2},
+	} {
+		fakeVFs(t, dir, "eth1", c.total, c.numVFs, nil)
+		if err := pool.ensureVFs("eth1", c.vfNum); err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if numVFs, err := pool.readInt("eth1", "sriov_numvfs"); err != nil || numVFs != c.expect {
+			t.Fatalf("case %d: expect %d vfs, got %d %v", i, c.expect, numVFs, err)
+		}
+	}
+	fakeVFs(t, dir, "eth1", 0, 0, nil)
+	if err := pool.ensureVFs("eth1", 0); err == nil {
+		t.Fatal("expect an error of a device without vf")
+	}
+}
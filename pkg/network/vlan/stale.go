@@ -0,0 +1,120 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"tkestack.io/galaxy/pkg/utils"
+)
+
+// Devices identifies devices a vlan network creates on the node
+type Devices struct {
+	Device           string `json:"device"`
+	Switch           string `json:"switch"`
+	BridgeNamePrefix string `json:"bridge_name_prefix"`
+	VlanNamePrefix   string `json:"vlan_name_prefix"`
+}
+
+// Devices returns devices the network of conf creates
+func (conf *NetConf) Devices() Devices {
+	return Devices{Device: conf.Device, Switch: conf.Switch, BridgeNamePrefix: conf.BridgeNamePrefix,
+		VlanNamePrefix: conf.VlanNamePrefix}
+}
+
+// claims returns whether name may be a device created by the network of devs
+func (devs Devices) claims(name string) bool {
+	return isVlanName(name, devs.BridgeNamePrefix) || isVlanName(name, devs.VlanNamePrefix)
+}
+
+// podsHidden returns whether pods of the network hang off vlan devices from their own netns, where the host can't
+// see them
+func (devs Devices) podsHidden() bool {
+	return devs.Switch == "macvlan" || devs.Switch == "ipvlan"
+}
+
+// DeleteDrained deletes vlan bridges and vlan devices created by the network of stale, which has been removed from
+// configs, once pods have left them. Devices which may be created by networks of current are kept. Vlan devices of
+// macvlan and ipvlan networks are kept as ports of pods on them live in netns of pods. It returns the number of
+// devices left, which are deleted by a later call after their pods are gone.
+func DeleteDrained(stale Devices, current []Devices) (int, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return 0, err
+	}
+	drained, remaining := drainedDevices(links, stale, current)
+	for _, link := range drained {
+		if err := netlink.LinkDel(link); err != nil && !utils.IsLinkNotFound(err) {
+			return len(remaining), fmt.Errorf("failed to delete %s: %v", link.Attrs().Name, err)
+		}
+	}
+	return len(remaining), nil
+}
+
+// #lizard forgives
+// drainedDevices splits vlan bridges and vlan devices of stale into ones without pods and ones with pods
+func drainedDevices(links []netlink.Link, stale Devices, current []Devices) (drained, remaining []netlink.Link) {
+	// vlan devices are gone along with the device, bridges are not
+	deviceIndex, vlanParentIndex := -1, -1
+	for _, link := range links {
+		if link.Attrs().Name != stale.Device {
+			continue
+		}
+		deviceIndex, vlanParentIndex = link.Attrs().Index, link.Attrs().Index
+		if link.Type() == "vlan" {
+			vlanParentIndex = link.Attrs().ParentIndex
+		}
+	}
+	claimed := func(name string) bool {
+		for _, devs := range current {
+			if devs.claims(name) {
+				return true
+			}
+		}
+		return false
+	}
+	drainedBridges := map[int]bool{}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if link.Type() != "bridge" || !isVlanName(name, stale.BridgeNamePrefix) || claimed(name) {
+			continue
+		}
+		if len(podPorts(links, link, deviceIndex)) > 0 {
+			remaining = append(remaining, link)
+			continue
+		}
+		drainedBridges[link.Attrs().Index] = true
+		drained = append(drained, link)
+	}
+	if stale.podsHidden() {
+		return drained, remaining
+	}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if link.Type() != "vlan" || !isVlanName(name, stale.VlanNamePrefix) || claimed(name) ||
+			link.Attrs().ParentIndex != vlanParentIndex || link.Attrs().Index == deviceIndex {
+			continue
+		}
+		if master := link.Attrs().MasterIndex; master > 0 && !drainedBridges[master] {
+			remaining = append(remaining, link)
+			continue
+		}
+		drained = append(drained, link)
+	}
+	return drained, remaining
+}
@@ -0,0 +1,89 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func linkNames(links []netlink.Link) []string {
+	var names []string
+	for _, link := range links {
+		names = append(names, link.Attrs().Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDrainedDevices(t *testing.T) {
+	attrs := func(index int, name string, master, parent int) netlink.LinkAttrs {
+		return netlink.LinkAttrs{Index: index, Name: name, MasterIndex: master, ParentIndex: parent}
+	}
+	links := []netlink.Link{
+		&netlink.Device{LinkAttrs: attrs(2, "eth1", 0, 0)},
+		&netlink.Device{LinkAttrs: attrs(3, "eth2", 0, 0)},
+		// vlan 10 has a pod, vlan 11 has none and vlan 12 is not bridged
+		&netlink.Bridge{LinkAttrs: attrs(10, "docker10", 0, 0)},
+		&netlink.Vlan{LinkAttrs: attrs(11, "vlan10", 10, 2), VlanId: 10},
+		&netlink.Veth{LinkAttrs: attrs(12, "v-h1", 10, 0)},
+		&netlink.Bridge{LinkAttrs: attrs(20, "docker11", 0, 0)},
+		&netlink.Vlan{LinkAttrs: attrs(21, "vlan11", 20, 2), VlanId: 11},
+		&netlink.Vlan{LinkAttrs: attrs(31, "vlan12", 0, 2), VlanId: 12},
+		// devices of other networks
+		&netlink.Vlan{LinkAttrs: attrs(41, "vlan13", 0, 3), VlanId: 13},
+		&netlink.Bridge{LinkAttrs: attrs(50, "br13", 0, 0)},
+	}
+	stale := Devices{Device: "eth1", BridgeNamePrefix: "docker", VlanNamePrefix: "vlan"}
+	for i, c := range []struct {
+		stale            Devices
+		current          []Devices
+		drained, remains []string
+	}{
+		{
+			stale:   stale,
+			drained: []string{"docker11", "vlan11", "vlan12"},
+			remains: []string{"docker10", "vlan10"},
+		},
+		{
+			stale:   stale,
+			current: []Devices{{Device: "eth2", BridgeNamePrefix: "docker", VlanNamePrefix: "vlan"}},
+		},
+		{
+			stale:   Devices{Device: "eth1", Switch: "macvlan", BridgeNamePrefix: "docker", VlanNamePrefix: "vlan"},
+			drained: []string{"docker11"},
+			remains: []string{"docker10"},
+		},
+		{
+			// vlan devices are gone along with the device
+			stale:   Devices{Device: "eth3", BridgeNamePrefix: "docker", VlanNamePrefix: "vlan"},
+			drained: []string{"docker11"},
+			remains: []string{"docker10"},
+		},
+	} {
+		drained, remaining := drainedDevices(links, c.stale, c.current)
+		if names := linkNames(drained); !reflect.DeepEqual(names, c.drained) {
+			t.Errorf("case %d: expect drained %v, real %v", i, c.drained, names)
+		}
+		if names := linkNames(remaining); !reflect.DeepEqual(names, c.remains) {
+			t.Errorf("case %d: expect remaining %v, real %v", i, c.remains, names)
+		}
+	}
+}
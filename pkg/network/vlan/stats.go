@@ -0,0 +1,74 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// fdbEntrySize is the size of struct __fdb_entry of linux/if_bridge.h, brforward of a bridge in sysfs is an array
+// of them
+const fdbEntrySize = 16
+
+// BridgeStats are statistics of the broadcast domain of a bridge
+type BridgeStats struct {
+	// Ports is the number of ports attached to the bridge
+	Ports int
+	// FDBEntries is the number of mac addresses in the forwarding database of the bridge, each of which takes an
+	// entry of the mac table of the switch as well
+	FDBEntries int
+	// RxMulticast is the total number of multicast packets received by ports of the bridge. Some drivers count
+	// broadcast packets in it as well, veths count nothing.
+	RxMulticast uint64
+}
+
+// IsBridgeName returns true if name is the default bridge or a vlan bridge of conf
+func (conf *NetConf) IsBridgeName(name string) bool {
+	return name == conf.DefaultBridgeName || isVlanName(name, conf.BridgeNamePrefix)
+}
+
+// ReadBridgeStats reads statistics of bridge from sysfs
+func ReadBridgeStats(bridge string) (*BridgeStats, error) {
+	netDir := filepath.Join(sysfsRoot, "class", "net")
+	fis, err := ioutil.ReadDir(filepath.Join(netDir, bridge, "brif"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ports of %s: %v", bridge, err)
+	}
+	stats := &BridgeStats{Ports: len(fis)}
+	for _, fi := range fis {
+		data, err := ioutil.ReadFile(filepath.Join(netDir, fi.Name(), "statistics", "multicast"))
+		if err != nil {
+			// the port is being removed
+			continue
+		}
+		multicast, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad multicast statistics of %s: %v", fi.Name(), err)
+		}
+		stats.RxMulticast += multicast
+	}
+	data, err := ioutil.ReadFile(filepath.Join(netDir, bridge, "brforward"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read forwarding database of %s: %v", bridge, err)
+	}
+	stats.FDBEntries = len(data) / fdbEntrySize
+	return stats, nil
+}
@@ -0,0 +1,74 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// #lizard forgives
+func TestReadBridgeStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	defer func(root string) { sysfsRoot = root }(sysfsRoot)
+	sysfsRoot = dir
+	netDir := filepath.Join(dir, "class", "net")
+	for port, multicast := range map[string]string{"eth1.10": "100\n", "veth1": "0\n", "veth2": "3\n"} {
+		if err := os.MkdirAll(filepath.Join(netDir, "docker10", "brif", port), 0755); err != nil {
+			t.Fatal(err)
+		}
+		statsDir := filepath.Join(netDir, port, "statistics")
+		if err := os.MkdirAll(statsDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(statsDir, "multicast"), []byte(multicast), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(netDir, "docker10", "brforward"), make([]byte, 5*fdbEntrySize),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := ReadBridgeStats("docker10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := (&BridgeStats{Ports: 3, FDBEntries: 5, RxMulticast: 103}); !reflect.DeepEqual(stats, expect) {
+		t.Fatalf("expect %+v, real %+v", expect, stats)
+	}
+	if _, err := ReadBridgeStats("docker11"); err == nil {
+		t.Fatal("expect an error of a missing bridge")
+	}
+}
+
+func TestIsBridgeName(t *testing.T) {
+	conf := &NetConf{}
+	conf.setDefaults()
+	for name, expect := range map[string]bool{"docker": true, "docker10": true, "docker0": false, "docker4096": false,
+		"eth1": false} {
+		if real := conf.IsBridgeName(name); real != expect {
+			t.Errorf("%s: expect %v, real %v", name, expect, real)
+		}
+	}
+}
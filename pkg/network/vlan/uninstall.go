@@ -0,0 +1,144 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlan
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"tkestack.io/galaxy/pkg/utils"
+)
+
+// Uninstall reverses Init and bridges set up for pods for decommission of galaxy from the node: addresses and routes
+// of the default bridge are moved back to the device, then vlan bridges and vlan devices created by the driver, i.e.
+// those named by BridgeNamePrefix and VlanNamePrefix followed by a vlan id, are deleted. Vlan devices created by
+// users are kept. Net.ipv4.ip_nonlocal_bind set in pure mode is reverted. It fails if any bridge still has ports of
+// pods, pods should be torn down before it.
+func (d *VlanDriver) Uninstall() error {
+	d.Lock()
+	defer d.Unlock()
+	d.setDefaults()
+	device, err := netlink.LinkByName(d.Device)
+	if err != nil {
+		return fmt.Errorf("Error getting device %s: %v", d.Device, err)
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	vlanParentIndex := device.Attrs().Index
+	if device.Type() == "vlan" {
+		vlanParentIndex = device.Attrs().ParentIndex
+	}
+	var bridges, vlans []netlink.Link
+	var defaultBridge netlink.Link
+	for _, link := range links {
+		name := link.Attrs().Name
+		switch {
+		case link.Type() == "bridge" && name == d.DefaultBridgeName:
+			defaultBridge = link
+		case link.Type() == "bridge" && isVlanName(name, d.BridgeNamePrefix):
+			bridges = append(bridges, link)
+		case link.Type() == "vlan" && isVlanName(name, d.VlanNamePrefix) &&
+			link.Attrs().ParentIndex == vlanParentIndex && link.Attrs().Index != device.Attrs().Index:
+			vlans = append(vlans, link)
+		}
+	}
+	// don't break pods half way, check all bridges before deleting anything
+	for _, bridge := range append(bridges, defaultBridge) {
+		if bridge == nil {
+			continue
+		}
+		if ports := podPorts(links, bridge, device.Attrs().Index); len(ports) > 0 {
+			return fmt.Errorf("bridge %s still has ports of pods %v", bridge.Attrs().Name, ports)
+		}
+	}
+	if defaultBridge != nil && device.Attrs().MasterIndex == defaultBridge.Attrs().Index {
+		if err := d.restoreDevice(device, defaultBridge); err != nil {
+			return err
+		}
+	}
+	for _, link := range append(bridges, vlans...) {
+		if err := netlink.LinkDel(link); err != nil && !utils.IsLinkNotFound(err) {
+			return fmt.Errorf("failed to delete %s: %v", link.Attrs().Name, err)
+		}
+	}
+	if err := revertNonlocalBind(); err != nil {
+		return fmt.Errorf("failed to revert %s: %v", nonlocalBindSysctl, err)
+	}
+	return nil
+}
+
+// restoreDevice moves addresses and routes of the default bridge back to the device and deletes the bridge
+func (d *VlanDriver) restoreDevice(device, bri netlink.Link) error {
+	addrs, err := netlink.AddrList(bri, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of bridge %s: %v", d.DefaultBridgeName, err)
+	}
+	// routes go away with the addresses, save them first
+	rs, err := d.listRoutes(bri)
+	if err != nil {
+		return err
+	}
+	if err := utils.RetryTransient(func() error { return netlink.LinkSetNoMaster(device) }); err != nil {
+		return fmt.Errorf("failed to remove device %s from bridge %s: %v", d.Device, d.DefaultBridgeName, err)
+	}
+	for _, addr := range movableAddrs(addrs) {
+		addr := addr
+		if err := netlink.AddrDel(bri, &addr); err != nil {
+			return fmt.Errorf("failed to remove address %v from bridge %s: %v", addr, d.DefaultBridgeName, err)
+		}
+		addr.Label = d.movedLabel(addr.Label, d.Device, d.DefaultBridgeName, true)
+		if err := netlink.AddrAdd(device, &addr); err != nil && !utils.IsExist(err) {
+			return fmt.Errorf("failed to add address %v to device %s: %v", addr, d.Device, err)
+		}
+	}
+	for i := range rs {
+		route := movedRoute(rs[i], bri.Attrs().Index, device.Attrs().Index)
+		if err := netlink.RouteAdd(&route); err != nil && !utils.IsExist(err) {
+			return fmt.Errorf("failed to add route %s: %v", route.String(), err)
+		}
+	}
+	if err := netlink.LinkDel(bri); err != nil && !utils.IsLinkNotFound(err) {
+		return fmt.Errorf("failed to delete bridge %s: %v", d.DefaultBridgeName, err)
+	}
+	return nil
+}
+
+// isVlanName returns if name is prefix followed by a vlan id
+func isVlanName(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	id, err := strconv.Atoi(name[len(prefix):])
+	return err == nil && id > 0 && id < 4096
+}
+
+// podPorts returns names of ports of bridge other than vlan devices and the device
+func podPorts(links []netlink.Link, bridge netlink.Link, deviceIndex int) []string {
+	var ports []string
+	for _, link := range links {
+		if link.Attrs().MasterIndex != bridge.Attrs().Index || link.Attrs().Index == deviceIndex ||
+			link.Type() == "vlan" {
+			continue
+		}
+		ports = append(ports, link.Attrs().Name)
+	}
+	return ports
+}
@@ -20,13 +20,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
-	"strings"
 	"sync"
 
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/vishvananda/netlink"
-	"github.com/vishvananda/netlink/nl"
-	"tkestack.io/galaxy/pkg/network"
 	"tkestack.io/galaxy/pkg/utils"
 )
 
@@ -50,9 +47,12 @@ type NetConf struct {
 	types.NetConf
 	// The device which has IDC ip address, eg. eth1 or eth1.12 (A vlan device)
 	Device string `json:"device"`
-	// Supports macvlan, bridge or pure(which avoid create unnecessary bridge), default bridge
+	// Supports macvlan, ipvlan, bridge, pure(which avoid create unnecessary bridge) or sriov, default bridge
 	Switch string `json:"switch"`
 
+	// The number of VFs of the device enabled in sriov mode if it has none, default all
+	VFNum int `json:"vf_num"`
+
 	// Disable creating default bridge
 	DisableDefaultBridge *bool `json:"disable_default_bridge"`
 
@@ -63,6 +63,29 @@ type NetConf struct {
 	VlanNamePrefix string `json:"vlan_name_prefix"`
 
 	GratuitousArpRequest bool `json:"gratuitous_arp_request"`
+
+	// Whether pure mode sets net.ipv4.ip_nonlocal_bind of the host, host(default) or none
+	NonlocalBind string `json:"nonlocal_bind"`
+
+	// Leaves arp requests of the device for ips of pure mode pods to the arp responder of galaxy instead of proxy arp
+	// of the device, which answers for any ip routed via other interfaces
+	ARPResponder bool `json:"arp_responder"`
+
+	// Tables whose routes via the device are migrated to the default bridge, default main table only
+	MigrateRouteTables []int `json:"migrate_route_tables"`
+
+	AddressConf
+
+	BridgeConf
+
+	// Enables multicast of pods if set
+	Multicast *MulticastConf `json:"multicast"`
+
+	// IPv6 of pods of the network, disable, harden or keep, which overrides --ipv6-mode of galaxy if set
+	IPv6Mode string `json:"ipv6_mode"`
+
+	// Probes ipv4 addresses of pods by arp before setting them up if set
+	ConflictProbe *ConflictProbeConf `json:"conflict_probe"`
 }
 
 func (d *VlanDriver) LoadConf(bytes []byte) (*NetConf, error) {
@@ -70,6 +93,43 @@ func (d *VlanDriver) LoadConf(bytes []byte) (*NetConf, error) {
 	if err := json.Unmarshal(bytes, conf); err != nil {
 		return nil, fmt.Errorf("failed to load netconf: %v", err)
 	}
+	conf.setDefaults()
+	if err := conf.validateNames(); err != nil {
+		return nil, err
+	}
+	if err := conf.AddressConf.validate(conf.Device, conf.DefaultBridgeName); err != nil {
+		return nil, err
+	}
+	if err := validateRouteTables(conf.MigrateRouteTables); err != nil {
+		return nil, err
+	}
+	if err := validateNonlocalBind(conf.NonlocalBind); err != nil {
+		return nil, err
+	}
+	if conf.ARPResponder && conf.Switch != "pure" {
+		return nil, fmt.Errorf("arp_responder is for pure switch only")
+	}
+	if err := validateIPv6Mode(conf.IPv6Mode); err != nil {
+		return nil, err
+	}
+	if err := conf.BridgeConf.Validate(); err != nil {
+		return nil, err
+	}
+	if conf.Multicast != nil {
+		if err := conf.Multicast.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if conf.ConflictProbe != nil {
+		if err := conf.ConflictProbe.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	d.NetConf = conf
+	return conf, nil
+}
+
+func (conf *NetConf) setDefaults() {
 	if conf.DefaultBridgeName == "" {
 		conf.DefaultBridgeName = DefaultBridge
 	}
@@ -79,12 +139,30 @@ func (d *VlanDriver) LoadConf(bytes []byte) (*NetConf, error) {
 	if conf.VlanNamePrefix == "" {
 		conf.VlanNamePrefix = VlanPrefix
 	}
-	d.NetConf = conf
-	return conf, nil
+	if conf.NonlocalBind == "" {
+		conf.NonlocalBind = NonlocalBindHost
+	}
 }
 
 // #lizard forgives
 func (d *VlanDriver) Init() error {
+	if err := d.initDevice(); err != nil {
+		return err
+	}
+	if d.MacVlanMode() || d.IPVlanMode() || d.SRIOVMode() {
+		return nil
+	}
+	if d.PureMode() {
+		if err := d.initPureModeArgs(); err != nil {
+			return err
+		}
+		return d.setupNonlocalBind()
+	}
+	return nil
+}
+
+// initDevice resolves the device and the parent of vlan devices
+func (d *VlanDriver) initDevice() error {
 	device, err := netlink.LinkByName(d.Device)
 	if err != nil {
 		return fmt.Errorf("Error getting device %s: %v", d.Device, err)
@@ -97,23 +175,35 @@ func (d *VlanDriver) Init() error {
 		d.vlanParentIndex = device.Attrs().ParentIndex
 		//glog.Infof("root device %s is a vlan device, parent index %d", d.Device, d.vlanParentIndex)
 	}
-	if d.MacVlanMode() || d.IPVlanMode() {
+	return nil
+}
+
+// EnsureDefaultBridge creates the default bridge and migrates addresses and routes of the device onto it. It's
+// expensive and mutates host network, so it is called lazily when the first pod of vlan 0 is set up rather than in
+// Init.
+func (d *VlanDriver) EnsureDefaultBridge() error {
+	if d.DisableDefaultBridge != nil && *d.DisableDefaultBridge {
 		return nil
 	}
-	if d.PureMode() {
-		if err := d.initPureModeArgs(); err != nil {
-			return err
-		}
-		return utils.EnableNonlocalBind()
-	}
-	if d.DisableDefaultBridge != nil && *d.DisableDefaultBridge {
+	if d.MacVlanMode() || d.IPVlanMode() || d.PureMode() || d.SRIOVMode() {
 		return nil
 	}
-	v4Addr, err := netlink.AddrList(device, netlink.FAMILY_V4)
+	device, err := netlink.LinkByName(d.Device)
 	if err != nil {
-		return fmt.Errorf("Errror getting ipv4 address %v", err)
+		return fmt.Errorf("Error getting device %s: %v", d.Device, err)
+	}
+	if device.Attrs().MasterIndex > 0 {
+		// fast path: the device has already been enslaved to the default bridge by a previous call
+		if bri, err := netlink.LinkByName(d.DefaultBridgeName); err == nil &&
+			bri.Attrs().Index == device.Attrs().MasterIndex && bri.Attrs().Flags&net.FlagUp != 0 {
+			return nil
+		}
 	}
-	filteredAddr := network.FilterLoopbackAddr(v4Addr)
+	addrs, err := netlink.AddrList(device, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("Errror getting address %v", err)
+	}
+	filteredAddr := movableAddrs(addrs)
 	if len(filteredAddr) == 0 {
 		bri, err := netlink.LinkByName(d.DefaultBridgeName)
 		if err != nil {
@@ -131,16 +221,16 @@ func (d *VlanDriver) Init() error {
 }
 
 func (d *VlanDriver) initVlanBridgeDevice(device netlink.Link, filteredAddr []netlink.Addr) error {
-	bri, err := getOrCreateBridge(d.DefaultBridgeName, device.Attrs().HardwareAddr)
+	bri, err := d.getOrCreateBridge(d.DefaultBridgeName, device.Attrs().HardwareAddr)
 	if err != nil {
 		return err
 	}
-	if err := netlink.LinkSetUp(bri); err != nil {
+	if err := utils.RetryTransient(func() error { return netlink.LinkSetUp(bri) }); err != nil {
 		return fmt.Errorf("failed to set up bridge device %s: %v", d.DefaultBridgeName, err)
 	}
-	rs, err := netlink.RouteList(device, nl.FAMILY_V4)
+	rs, err := d.listRoutes(device)
 	if err != nil {
-		return fmt.Errorf("failed to list route of device %s", device.Attrs().Name)
+		return err
 	}
 	defer func() {
 		if err != nil {
@@ -160,8 +250,13 @@ func (d *VlanDriver) moveAddrAndRoute(device netlink.Link, bri netlink.Link, fil
 	rs []netlink.Route) error {
 	var err error
 	for i := range filteredAddr {
+		i := i
+		if d.excluded(&filteredAddr[i]) {
+			continue
+		}
+		label := d.movedLabel(filteredAddr[i].Label, d.Device, d.DefaultBridgeName, false)
 		if err = netlink.AddrDel(device, &filteredAddr[i]); err != nil {
-			return fmt.Errorf("failed to remove v4address from device %s: %v", d.Device, err)
+			return fmt.Errorf("failed to remove address from device %s: %v", d.Device, err)
 		}
 		// nolint: errcheck
 		defer func() {
@@ -169,27 +264,30 @@ func (d *VlanDriver) moveAddrAndRoute(device netlink.Link, bri netlink.Link, fil
 				netlink.AddrAdd(device, &filteredAddr[i])
 			}
 		}()
-		filteredAddr[i].Label = ""
-		if err = netlink.AddrAdd(bri, &filteredAddr[i]); err != nil {
-			if !strings.Contains(err.Error(), "file exists") {
-				return fmt.Errorf("failed to add v4address to bridge device %s: %v, address %v", d.DefaultBridgeName,
+		moved := filteredAddr[i]
+		moved.Label = label
+		if err = netlink.AddrAdd(bri, &moved); err != nil {
+			if !utils.IsExist(err) {
+				return fmt.Errorf("failed to add address to bridge device %s: %v, address %v", d.DefaultBridgeName,
 					err, filteredAddr[i])
 			} else {
 				err = nil
 			}
 		}
 	}
-	if err = netlink.LinkSetMaster(device, &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{
-		Name: d.DefaultBridgeName}}); err != nil {
+	if err = utils.RetryTransient(func() error {
+		return netlink.LinkSetMaster(device, &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{
+			Name: d.DefaultBridgeName}})
+	}); err != nil {
 		return fmt.Errorf("failed to add device %s to bridge device %s: %v", d.Device, d.DefaultBridgeName, err)
 	}
 	for i := range rs {
-		newRoute := netlink.Route{Gw: rs[i].Gw, LinkIndex: bri.Attrs().Index, Dst: rs[i].Dst,
-			Src: rs[i].Src, Scope: rs[i].Scope}
+		newRoute := movedRoute(rs[i], device.Attrs().Index, bri.Attrs().Index)
 		if err = netlink.RouteAdd(&newRoute); err != nil {
-			if !strings.Contains(err.Error(), "file exists") {
-				return fmt.Errorf("failed to add route %s", newRoute.String())
+			if !utils.IsExist(err) {
+				return fmt.Errorf("failed to add route %s: %v", newRoute.String(), err)
 			}
+			err = nil
 		}
 	}
 	return nil
@@ -202,41 +300,63 @@ func (d *VlanDriver) initPureModeArgs() error {
 	if err := utils.UnSetArpIgnore(d.Device); err != nil {
 		return err
 	}
+	if d.ARPResponder {
+		return utils.UnSetProxyArp(d.Device)
+	}
 	if err := utils.SetProxyArp(d.Device); err != nil {
 		return err
 	}
 	return nil
 }
 
-func getOrCreateBridge(bridgeName string, mac net.HardwareAddr) (netlink.Link, error) {
-	return getOrCreateDevice(bridgeName, func(name string) error {
+func (d *VlanDriver) getOrCreateBridge(bridgeName string, mac net.HardwareAddr) (netlink.Link, error) {
+	bridge, err := getOrCreateDevice(bridgeName, "bridge", func(name string) error {
 		if err := utils.CreateBridgeDevice(bridgeName, mac); err != nil {
-			return fmt.Errorf("Failed to add bridge device %s: %v", bridgeName, err)
+			return fmt.Errorf("Failed to add bridge device %s: %w", bridgeName, err)
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	if err := d.tuneBridge(bridgeName); err != nil {
+		return nil, err
+	}
+	return bridge, nil
 }
 
-func getOrCreateDevice(name string, createDevice func(name string) error) (netlink.Link, error) {
+// getOrCreateDevice returns the device of linkType named name, it's created by createDevice if absent. A device of
+// another type taking the name is an error rather than being used.
+func getOrCreateDevice(name, linkType string, createDevice func(name string) error) (netlink.Link, error) {
 	device, err := netlink.LinkByName(name)
 	if err != nil {
-		if err := createDevice(name); err != nil {
+		if !utils.IsLinkNotFound(err) {
+			return nil, fmt.Errorf("Failed to get %s: %v", name, err)
+		}
+		// the device may be created concurrently by others after the miss, re-resolve it on EEXIST
+		if err := createDevice(name); err != nil && !utils.IsExist(err) {
 			return nil, fmt.Errorf("Failed to add %s: %v", name, err)
 		}
 		if device, err = netlink.LinkByName(name); err != nil {
 			return nil, fmt.Errorf("Failed to get %s: %v", name, err)
 		}
 	}
+	if device.Type() != linkType {
+		return nil, fmt.Errorf("%s is a %s device rather than a %s device", name, device.Type(), linkType)
+	}
 	return device, nil
 }
 
 // #lizard forgives
 func (d *VlanDriver) CreateBridgeAndVlanDevice(vlanId uint16) (string, error) {
+	d.Lock()
+	defer d.Unlock()
 	if vlanId == 0 {
+		if err := d.EnsureDefaultBridge(); err != nil {
+			return "", err
+		}
 		return d.BridgeNameForVlan(vlanId), nil
 	}
-	d.Lock()
-	defer d.Unlock()
 	vlan, err := d.getOrCreateVlanDevice(vlanId)
 	if err != nil {
 		return "", err
@@ -249,18 +369,19 @@ func (d *VlanDriver) CreateBridgeAndVlanDevice(vlanId uint16) (string, error) {
 		return master.Attrs().Name, nil
 	}
 	bridgeIfName := fmt.Sprintf("%s%d", d.BridgeNamePrefix, vlanId)
-	bridge, err := getOrCreateBridge(bridgeIfName, nil)
+	bridge, err := d.getOrCreateBridge(bridgeIfName, nil)
 	if err != nil {
 		return "", err
 	}
 	if vlan.Attrs().MasterIndex != bridge.Attrs().Index {
-		if err := netlink.LinkSetMaster(vlan, &netlink.Bridge{
-			LinkAttrs: netlink.LinkAttrs{Name: bridgeIfName}}); err != nil {
+		if err := utils.RetryTransient(func() error {
+			return netlink.LinkSetMaster(vlan, &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgeIfName}})
+		}); err != nil {
 			return "", fmt.Errorf("Failed to add vlan device %s to bridge device %s: %v",
 				vlan.Attrs().Name, bridgeIfName, err)
 		}
 	}
-	if err := netlink.LinkSetUp(bridge); err != nil {
+	if err := utils.RetryTransient(func() error { return netlink.LinkSetUp(bridge) }); err != nil {
 		return "", fmt.Errorf("Failed to set up bridge device %s: %v", bridgeIfName, err)
 	}
 	if d.PureMode() {
@@ -292,6 +413,25 @@ func (d *VlanDriver) MaybeCreateVlanDevice(vlanId uint16) error {
 	return err
 }
 
+// EnsureVlanDevice returns the name of the device of vlanId without Init, i.e. the device for vlan 0 or the vlan
+// device of vlanId which is created if it doesn't exist, so that galaxy can run exchanges on the vlan of a pod, e.g.
+// dhcp, before the pod is set up
+func (d *VlanDriver) EnsureVlanDevice(vlanId uint16) (string, error) {
+	d.Lock()
+	defer d.Unlock()
+	if err := d.initDevice(); err != nil {
+		return "", err
+	}
+	if vlanId == 0 {
+		return d.Device, nil
+	}
+	link, err := d.getOrCreateVlanDevice(vlanId)
+	if err != nil {
+		return "", err
+	}
+	return link.Attrs().Name, nil
+}
+
 func (d *VlanDriver) getOrCreateVlanDevice(vlanId uint16) (netlink.Link, error) {
 	// check if vlan created by user exist
 	link, err := d.getVlanIfExist(vlanId)
@@ -303,18 +443,22 @@ func (d *VlanDriver) getOrCreateVlanDevice(vlanId uint16) (netlink.Link, error)
 	}
 	vlanIfName := fmt.Sprintf("%s%d", d.VlanNamePrefix, vlanId)
 	// Get vlan device
-	vlan, err := getOrCreateDevice(vlanIfName, func(name string) error {
+	vlan, err := getOrCreateDevice(vlanIfName, "vlan", func(name string) error {
 		vlanIf := &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: vlanIfName, ParentIndex: d.vlanParentIndex},
 			VlanId: (int)(vlanId)}
 		if err := netlink.LinkAdd(vlanIf); err != nil {
-			return fmt.Errorf("Failed to add vlan device %s: %v", vlanIfName, err)
+			return fmt.Errorf("Failed to add vlan device %s: %w", vlanIfName, err)
 		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	if err := netlink.LinkSetUp(vlan); err != nil {
+	if v := vlan.(*netlink.Vlan); v.VlanId != int(vlanId) || v.ParentIndex != d.vlanParentIndex {
+		return nil, fmt.Errorf("vlan device %s is of vlan %d of parent %d rather than vlan %d of parent %d",
+			vlanIfName, v.VlanId, v.ParentIndex, vlanId, d.vlanParentIndex)
+	}
+	if err := utils.RetryTransient(func() error { return netlink.LinkSetUp(vlan) }); err != nil {
 		return nil, fmt.Errorf("Failed to set up vlan device %s: %v", vlanIfName, err)
 	}
 	d.DeviceIndex = vlan.Attrs().Index
@@ -91,6 +91,20 @@ func TestInit(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		if !strings.Contains(routeStr, "default via 192.168.0.1 dev du0") {
+			t.Fatalf("expect Init not migrate routes: %s", routeStr)
+		}
+		if _, err := vlanDriver.CreateBridgeAndVlanDevice(0); err != nil {
+			t.Fatal(err)
+		}
+		// fast path
+		if err := vlanDriver.EnsureDefaultBridge(); err != nil {
+			t.Fatal(err)
+		}
+		routeStr, err = iproute()
+		if err != nil {
+			t.Fatal(err)
+		}
 		for _, r := range []string{
 			"default via 192.168.0.1 dev docker",
 			"10.0.0.0/24 dev docker",
@@ -115,3 +129,80 @@ func iproute() (string, error) {
 	routeStr = strings.Replace(routeStr, "  ", " ", -1)
 	return routeStr, nil
 }
+
+// #lizard forgives
+func TestUninstall(t *testing.T) {
+	vlanDriver := &VlanDriver{}
+	if _, err := vlanDriver.LoadConf([]byte(`{"device": "du0"}`)); err != nil {
+		t.Fatal(err)
+	}
+	ipNet, _ := ips.ParseCIDR("192.168.0.2/24")
+	netns.NsInvoke(func() {
+		dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "du0"}}
+		if err := netlink.LinkAdd(dummy); err != nil {
+			t.Fatal(err)
+		}
+		if err := netlink.LinkSetUp(dummy); err != nil {
+			t.Fatal(err)
+		}
+		if err := netlink.AddrAdd(dummy, &netlink.Addr{IPNet: ipNet}); err != nil {
+			t.Fatal(err)
+		}
+		if err := netlink.RouteAdd(&netlink.Route{Gw: net.ParseIP("192.168.0.1"), LinkIndex: dummy.Attrs().Index}); err != nil {
+			t.Fatal(err)
+		}
+		if err := vlanDriver.Init(); err != nil {
+			t.Fatal(err)
+		}
+		for _, vlanId := range []uint16{0, 5} {
+			if _, err := vlanDriver.CreateBridgeAndVlanDevice(vlanId); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := vlanDriver.Uninstall(); err != nil {
+			t.Fatal(err)
+		}
+		routeStr, err := iproute()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range []string{
+			"default via 192.168.0.1 dev du0",
+			"192.168.0.0/24 dev du0 proto kernel scope link src 192.168.0.2",
+		} {
+			if !strings.Contains(routeStr, r) {
+				t.Fatal(routeStr)
+			}
+		}
+		for _, name := range []string{"docker", "docker5", "vlan5"} {
+			if _, err := netlink.LinkByName(name); err == nil {
+				t.Fatalf("expect %s deleted", name)
+			}
+		}
+	})
+}
+
+func TestGetOrCreateDevice(t *testing.T) {
+	netns.NsInvoke(func() {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "docker100"}}); err != nil {
+			t.Fatal(err)
+		}
+		d := &VlanDriver{NetConf: &NetConf{}}
+		if _, err := d.getOrCreateBridge("docker100", nil); err == nil {
+			t.Fatal("expect an error for a dummy device taking the name of the bridge")
+		}
+		// a concurrent creator wins the race after the miss
+		bridge, err := getOrCreateDevice("docker101", "bridge", func(name string) error {
+			if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}}); err != nil {
+				t.Fatal(err)
+			}
+			return netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bridge.Attrs().Name != "docker101" {
+			t.Fatalf("expect docker101, real %s", bridge.Attrs().Name)
+		}
+	})
+}
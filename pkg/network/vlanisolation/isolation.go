@@ -0,0 +1,208 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package vlanisolation drops traffic the node routes between vlans. Vlan networks in pure mode route pods' traffic
+// on the node instead of the vlans' gateways, so pods of different vlans on the same node reach each other unless
+// the node denies it.
+package vlanisolation
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	glog "k8s.io/klog"
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+)
+
+// isolationChain is jumped to from FORWARD, it drops traffic between bridges of different vlans
+const isolationChain utiliptables.Chain = "GALAXY-VLAN-ISOLATION"
+
+// maxVlanID is the max valid vlan id
+const maxVlanID = 4094
+
+// Config denies traffic between vlans except Allow pairs
+type Config struct {
+	// Allow are pairs of vlan ids whose pods may reach each other in both directions
+	Allow [][2]uint16 `json:"allow,omitempty"`
+}
+
+// Handler programs isolation rules of vlan bridges into iptables
+type Handler struct {
+	utiliptables.Interface
+	// prefixes of vlan bridge names, the suffix is the vlan id
+	prefixes []string
+	allow    map[[2]uint16]bool
+	// listBridges returns names of all bridges of the node, it is replaceable by tests
+	listBridges func() ([]string, error)
+	lock        sync.Mutex
+	// applied is the key of bridges of the last successful sync
+	applied string
+}
+
+// New validates conf and returns a Handler of bridges with prefixes
+func New(prefixes []string, conf *Config) (*Handler, error) {
+	allow := map[[2]uint16]bool{}
+	for _, pair := range conf.Allow {
+		for _, id := range pair {
+			if id == 0 || id > maxVlanID {
+				return nil, fmt.Errorf("bad allowed vlan pair %v: vlan %d is out of range [1, %d]", pair, id,
+					maxVlanID)
+			}
+		}
+		allow[pair] = true
+		allow[[2]uint16{pair[1], pair[0]}] = true
+	}
+	return &Handler{Interface: utiliptables.Shared(), prefixes: prefixes, allow: allow, listBridges: listBridges},
+		nil
+}
+
+func listBridges() ([]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, link := range links {
+		if link.Type() == "bridge" {
+			names = append(names, link.Attrs().Name)
+		}
+	}
+	return names, nil
+}
+
+type vlanBridge struct {
+	name string
+	vlan uint16
+}
+
+// vlanBridges returns bridges whose names are one of prefixes followed by a vlan id, sorted by vlan ids
+func (h *Handler) vlanBridges() ([]vlanBridge, error) {
+	names, err := h.listBridges()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bridges: %v", err)
+	}
+	var bridges []vlanBridge
+	for _, name := range names {
+		for _, prefix := range h.prefixes {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			// e.g. docker is the default bridge of vlan networks and docker0 is docker's
+			id, err := strconv.ParseUint(strings.TrimPrefix(name, prefix), 10, 16)
+			if err != nil || id == 0 || id > maxVlanID {
+				continue
+			}
+			bridges = append(bridges, vlanBridge{name: name, vlan: uint16(id)})
+			break
+		}
+	}
+	sort.Slice(bridges, func(i, j int) bool {
+		if bridges[i].vlan != bridges[j].vlan {
+			return bridges[i].vlan < bridges[j].vlan
+		}
+		return bridges[i].name < bridges[j].name
+	})
+	return bridges, nil
+}
+
+func jumpArgs() []string {
+	return []string{"-m", "comment", "--comment", "galaxy vlan isolation", "-j", string(isolationChain)}
+}
+
+// Sync replaces isolation rules with rules of current vlan bridges
+func (h *Handler) Sync() error {
+	return h.sync(true)
+}
+
+// SyncIfChanged syncs only if vlan bridges changed since the last sync, e.g. an ADD created a bridge of a new vlan
+func (h *Handler) SyncIfChanged() error {
+	return h.sync(false)
+}
+
+func (h *Handler) sync(force bool) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	bridges, err := h.vlanBridges()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, b := range bridges {
+		names = append(names, b.name)
+	}
+	key := strings.Join(names, ",")
+	if !force && key == h.applied {
+		return nil
+	}
+	buf := bytes.NewBuffer(nil)
+	utiliptables.WriteLine(buf, "*filter")
+	utiliptables.WriteLine(buf, utiliptables.MakeChainLine(isolationChain))
+	for _, from := range bridges {
+		for _, to := range bridges {
+			if from.vlan == to.vlan || h.allow[[2]uint16{from.vlan, to.vlan}] {
+				continue
+			}
+			utiliptables.WriteLine(buf, "-A", string(isolationChain), "-i", from.name, "-o", to.name, "-m", "comment",
+				"--comment", fmt.Sprintf(`"vlan %d to %d"`, from.vlan, to.vlan), "-j", "DROP")
+		}
+	}
+	utiliptables.WriteLine(buf, "COMMIT")
+	if err := h.RestoreAll(buf.Bytes(), utiliptables.NoFlushTables, utiliptables.RestoreCounters); err != nil {
+		return fmt.Errorf("failed to execute iptables-restore for rules %s: %v", buf.String(), err)
+	}
+	// take precedence over accept rules of network policies and others
+	if _, err := h.EnsureRule(utiliptables.Prepend, utiliptables.TableFilter, utiliptables.ChainForward,
+		jumpArgs()...); err != nil {
+		return fmt.Errorf("failed to ensure that %s chain %s jumps to %s: %v", utiliptables.TableFilter,
+			utiliptables.ChainForward, isolationChain, err)
+	}
+	if key != h.applied {
+		glog.Infof("isolated vlan bridges %s", key)
+	}
+	h.applied = key
+	return nil
+}
+
+// Remove deletes isolation rules, e.g. after isolation is disabled
+func (h *Handler) Remove() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	buf := bytes.NewBuffer(nil)
+	if err := h.SaveInto(utiliptables.TableFilter, buf); err != nil {
+		return fmt.Errorf("failed to save filter table: %v", err)
+	}
+	if _, ok := utiliptables.GetChainLines(utiliptables.TableFilter, buf.Bytes())[isolationChain]; !ok {
+		return nil
+	}
+	// the chain is referenced by the jump until it is deleted
+	if err := h.DeleteRule(utiliptables.TableFilter, utiliptables.ChainForward, jumpArgs()...); err != nil {
+		return fmt.Errorf("failed to delete vlan isolation jump: %v", err)
+	}
+	if err := h.FlushChain(utiliptables.TableFilter, isolationChain); err != nil {
+		return err
+	}
+	if err := h.DeleteChain(utiliptables.TableFilter, isolationChain); err != nil {
+		return err
+	}
+	h.applied = ""
+	glog.Infof("removed vlan isolation rules")
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package vlanisolation
+
+import (
+	"bytes"
+	"testing"
+
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+	iptablesTest "tkestack.io/galaxy/pkg/utils/iptables/testing"
+)
+
+func TestNew(t *testing.T) {
+	for _, allow := range [][2]uint16{{0, 10}, {10, 4095}} {
+		if _, err := New([]string{"docker"}, &Config{Allow: [][2]uint16{allow}}); err == nil {
+			t.Errorf("expect an error of %v", allow)
+		}
+	}
+}
+
+func checkFilter(t *testing.T, fakeCli utiliptables.Interface, expect string) {
+	buf := bytes.NewBuffer(nil)
+	if err := fakeCli.SaveInto(utiliptables.TableFilter, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expect {
+		t.Fatalf("expect %s, real %s", expect, buf.String())
+	}
+}
+
+// #lizard forgives
+func TestSync(t *testing.T) {
+	fakeCli := iptablesTest.NewFakeIPTables()
+	bridges := []string{"docker", "docker0", "docker30", "docker10", "docker20", "br-10", "cni0"}
+	h := &Handler{Interface: fakeCli, prefixes: []string{"docker", "br-"}, listBridges: func() ([]string, error) {
+		return bridges, nil
+	}, allow: map[[2]uint16]bool{{10, 20}: true, {20, 10}: true}}
+	for i := 0; i < 2; i++ {
+		// syncing again doesn't duplicate rules
+		if err := h.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkFilter(t, fakeCli, `*filter
+:FORWARD - [0:0]
+:GALAXY-VLAN-ISOLATION - [0:0]
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+-A FORWARD -m comment --comment "galaxy vlan isolation" -j GALAXY-VLAN-ISOLATION
+-A GALAXY-VLAN-ISOLATION -i br-10 -o docker30 -m comment --comment "vlan 10 to 30" -j DROP
+-A GALAXY-VLAN-ISOLATION -i docker10 -o docker30 -m comment --comment "vlan 10 to 30" -j DROP
+-A GALAXY-VLAN-ISOLATION -i docker20 -o docker30 -m comment --comment "vlan 20 to 30" -j DROP
+-A GALAXY-VLAN-ISOLATION -i docker30 -o br-10 -m comment --comment "vlan 30 to 10" -j DROP
+-A GALAXY-VLAN-ISOLATION -i docker30 -o docker10 -m comment --comment "vlan 30 to 10" -j DROP
+-A GALAXY-VLAN-ISOLATION -i docker30 -o docker20 -m comment --comment "vlan 30 to 20" -j DROP
+COMMIT
+`)
+	// the unchanged bridges are not synced again even if rules are flushed by others
+	if err := fakeCli.FlushChain(utiliptables.TableFilter, isolationChain); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SyncIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	bridges = []string{"docker10", "docker40"}
+	if err := h.SyncIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	checkFilter(t, fakeCli, `*filter
+:FORWARD - [0:0]
+:GALAXY-VLAN-ISOLATION - [0:0]
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+-A FORWARD -m comment --comment "galaxy vlan isolation" -j GALAXY-VLAN-ISOLATION
+-A GALAXY-VLAN-ISOLATION -i docker10 -o docker40 -m comment --comment "vlan 10 to 40" -j DROP
+-A GALAXY-VLAN-ISOLATION -i docker40 -o docker10 -m comment --comment "vlan 40 to 10" -j DROP
+COMMIT
+`)
+	if err := h.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	checkFilter(t, fakeCli, `*filter
+:FORWARD - [0:0]
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+COMMIT
+`)
+	if err := h.Remove(); err != nil {
+		t.Fatal(err)
+	}
+}
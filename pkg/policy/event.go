@@ -54,22 +54,22 @@ func (p *PolicyManager) AddPolicy(policy *networkv1.NetworkPolicy) error {
 	p.startPodInformerFactory()
 	// if a policy is added, we should add policy chain before adding pod rules targeting this chain
 	p.syncNetworkPolices()
-	p.syncNetworkPolicyRules()
-	p.syncPods()
+	p.syncNetworkPolicyRules(nil)
+	p.syncPods(nil)
 	return nil
 }
 
 func (p *PolicyManager) UpdatePolicy(oldPolicy, newPolicy *networkv1.NetworkPolicy) error {
 	p.syncNetworkPolices()
-	p.syncNetworkPolicyRules()
-	p.syncPods()
+	p.syncNetworkPolicyRules(nil)
+	p.syncPods(nil)
 	return nil
 }
 
 func (p *PolicyManager) DeletePolicy(policy *networkv1.NetworkPolicy) error {
 	// if a policy is deleted, we should first delete pod rules targeting this policy chain
 	p.syncNetworkPolices()
-	p.syncPods()
-	p.syncNetworkPolicyRules()
+	p.syncPods(nil)
+	p.syncNetworkPolicyRules(nil)
 	return nil
 }
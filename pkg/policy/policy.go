@@ -39,10 +39,10 @@ import (
 	networkingv1Lister "k8s.io/client-go/listers/networking/v1"
 	"k8s.io/client-go/tools/cache"
 	glog "k8s.io/klog"
-	utildbus "k8s.io/kubernetes/pkg/util/dbus"
 	utilexec "k8s.io/utils/exec"
 	"tkestack.io/galaxy/pkg/api/k8s"
 	"tkestack.io/galaxy/pkg/api/k8s/eventhandler"
+	"tkestack.io/galaxy/pkg/utils/budget"
 	"tkestack.io/galaxy/pkg/utils/ipset"
 	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
 )
@@ -84,15 +84,18 @@ type PolicyManager struct {
 	namespaceLister    corev1Lister.NamespaceLister
 	policyLister       networkingv1Lister.NetworkPolicyLister
 	quitChan           <-chan struct{}
+	// resyncBudget limits the impact of periodic resyncs, events are not limited by it
+	resyncBudget *budget.Budget
 }
 
-func New(client kubernetes.Interface, quitChan <-chan struct{}) *PolicyManager {
+func New(client kubernetes.Interface, quitChan <-chan struct{}, resyncBudget *budget.Budget) *PolicyManager {
 	pm := &PolicyManager{
 		client:        client,
 		ipsetHandle:   ipset.New(utilexec.New()),
-		iptableHandle: utiliptables.New(utilexec.New(), utildbus.New(), utiliptables.ProtocolIpv4),
+		iptableHandle: utiliptables.Shared(),
 		hostName:      k8s.GetHostname(),
 		quitChan:      quitChan,
+		resyncBudget:  resyncBudget,
 	}
 	pm.initInformers()
 	return pm
@@ -144,16 +147,19 @@ func (p *PolicyManager) startPodInformerFactory() {
 func (p *PolicyManager) Run() {
 	glog.Infof("start resyncing network policies")
 	p.syncNetworkPolices()
-	p.syncNetworkPolicyRules()
-	p.syncPods()
+	p.syncNetworkPolicyRules(p.resyncBudget)
+	p.syncPods(p.resyncBudget)
 }
 
-func (p *PolicyManager) syncPods() {
+// syncPods syncs chains of all pods on this node, it starts syncing a pod only if b allows
+func (p *PolicyManager) syncPods(b *budget.Budget) {
 	glog.V(4).Infof("start syncing pods")
 	var wg sync.WaitGroup
 	syncPodChains := func(pod *corev1.Pod) {
 		defer wg.Done()
-		if err := p.SyncPodChains(pod); err != nil {
+		err := p.SyncPodChains(pod)
+		b.Done(err)
+		if err != nil {
 			glog.Warningf("failed to sync pod policy %s_%s: %v", pod.Name, pod.Namespace, err)
 		}
 	}
@@ -169,6 +175,9 @@ func (p *PolicyManager) syncPods() {
 			if pods[i].Spec.NodeName != nodeHostName {
 				continue
 			}
+			if !b.Wait(1, p.quitChan) {
+				break
+			}
 			wg.Add(1)
 			glog.V(4).Infof("starting goroutine to sync pod chain for %s_%s", pods[i].Name, pods[i].Namespace)
 			go syncPodChains(pods[i])
@@ -184,6 +193,9 @@ func (p *PolicyManager) syncPods() {
 		}
 		glog.V(4).Infof("find %d pods", len(list.Items))
 		for i := range list.Items {
+			if !b.Wait(1, p.quitChan) {
+				break
+			}
 			wg.Add(1)
 			go syncPodChains(&list.Items[i])
 		}
@@ -216,12 +228,15 @@ func (p *PolicyManager) syncNetworkPolices() {
 	p.Unlock()
 }
 
-func (p *PolicyManager) syncNetworkPolicyRules() {
+// syncNetworkPolicyRules syncs ipsets and iptables of all policies, the iptables rules are restored only if b allows
+func (p *PolicyManager) syncNetworkPolicyRules(b *budget.Budget) {
 	var policies []policy
 	p.Lock()
 	policies = p.policies
 	p.Unlock()
-	if err := p.syncRules(policies); err != nil {
+	err := p.syncRules(policies, b)
+	b.Done(err)
+	if err != nil {
 		glog.Warningf("failed to sync policy rules: %v", err)
 	}
 }
@@ -469,7 +484,7 @@ func rulePorts(npp []networkv1.NetworkPolicyPort) ([]string, []string) {
 
 // syncRules ensures GLX-sip-xxxx/GLX-snet-xxxx/GLX-dip-xxxx/GLX-dnet-xxxx/GLX-ip-xxxx ipsets including their
 // entries are expected, and GLX-PLCY-XXXX iptables chain are expected.
-func (p *PolicyManager) syncRules(polices []policy) error {
+func (p *PolicyManager) syncRules(polices []policy, b *budget.Budget) error {
 	// sync ipsets
 	ipsets, err := p.ipsetHandle.ListSets()
 	if err != nil {
@@ -496,10 +511,10 @@ func (p *PolicyManager) syncRules(polices []policy) error {
 	}()
 
 	// sync iptables
-	return p.syncIptables(polices)
+	return p.syncIptables(polices, b)
 }
 
-func (p *PolicyManager) syncIptables(polices []policy) error {
+func (p *PolicyManager) syncIptables(polices []policy, b *budget.Budget) error {
 	iptablesSaveRaw := bytes.NewBuffer(nil)
 	// Get iptables-save output so we can check for existing chains and rules.
 	// This will be a map of chain name to chain with rules as stored in iptables-save/iptables-restore
@@ -521,6 +536,9 @@ func (p *PolicyManager) syncIptables(polices []policy) error {
 	writeLine(filterRules, "COMMIT")
 
 	lines := append(filterChains.Bytes(), filterRules.Bytes()...)
+	if !b.Wait(bytes.Count(lines, []byte("\n")), p.quitChan) {
+		return nil
+	}
 	err := p.iptableHandle.RestoreAll(lines, utiliptables.NoFlushTables, utiliptables.RestoreCounters)
 	if err != nil {
 		return fmt.Errorf("failed to execute iptables-restore for ruls %s: %v", string(lines), err)
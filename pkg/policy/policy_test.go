@@ -115,7 +115,7 @@ func TestSyncRules(t *testing.T) {
 			np: &networkv1.NetworkPolicy{ObjectMeta: v1.ObjectMeta{Name: "test2", Namespace: "ns2"}},
 		},
 	}
-	if err := pm.syncRules(policies); err != nil {
+	if err := pm.syncRules(policies, nil); err != nil {
 		t.Fatal(err)
 	}
 	buf := bytes.NewBuffer(nil)
@@ -267,7 +267,7 @@ func TestSyncPodChains(t *testing.T) {
 		},
 	}
 	pm.policies = policies
-	if err := pm.syncRules(policies); err != nil {
+	if err := pm.syncRules(policies, nil); err != nil {
 		t.Fatal(err)
 	}
 	if err := pm.SyncPodChains(&corev1.Pod{
@@ -349,7 +349,7 @@ Members:
 		policies[i].np.Spec.Egress = nil
 	}
 	pm.policies = policies
-	if err := pm.syncRules(policies); err != nil {
+	if err := pm.syncRules(policies, nil); err != nil {
 		t.Fatal(err)
 	}
 	if err := pm.SyncPodChains(&corev1.Pod{
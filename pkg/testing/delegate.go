@@ -0,0 +1,201 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package testing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// delegateScript is the stub plugin. Each invocation records its CNI_* environment and stdin in a directory of its
+// own, so that concurrent invocations don't overwrite each other, and marks it done when it is about to exit.
+const delegateScript = `#!/bin/sh
+state="$(dirname "$0")/.$(basename "$0")"
+if [ "$CNI_COMMAND" = VERSION ]; then
+	echo '{"cniVersion":"0.4.0","supportedVersions":["0.1.0","0.2.0","0.3.0","0.3.1","0.4.0"]}'
+	exit 0
+fi
+call=$(mktemp -d "$state/calls/XXXXXXXX") || exit 1
+env | grep '^CNI_' > "$call/env"
+cat > "$call/stdin"
+if [ -f "$state/error" ]; then
+	cat "$state/error"
+	touch "$call/done"
+	exit 1
+fi
+if [ "$CNI_COMMAND" = ADD ]; then
+	cat "$state/result"
+fi
+touch "$call/done"
+`
+
+// Invocation is an invocation of a Delegate
+type Invocation struct {
+	Command     string
+	ContainerID string
+	Netns       string
+	IfName      string
+	Args        string
+	Path        string
+	// Config is the network config received from stdin
+	Config []byte
+}
+
+// Delegate is a stub cni plugin for tests of delegate paths of galaxy. It prints a canned result for ADD, succeeds
+// for DEL and CHECK and records each invocation. Each Delegate keeps its state next to its executable, so parallel
+// tests using different directories don't interfere with each other.
+type Delegate struct {
+	// Dir is the directory of the executable, which should be in CNI_PATH, e.g. --cni-paths of galaxy
+	Dir string
+	// Type is the name of the executable, i.e. type of network configs delegating to it
+	Type string
+}
+
+// NewDelegate installs a Delegate of type typ in dir, which prints result for ADD. result should be a cni result
+// json of a version the network config of callers accepts.
+func NewDelegate(dir, typ string, result []byte) (*Delegate, error) {
+	d := &Delegate{Dir: dir, Type: typ}
+	if err := os.MkdirAll(filepath.Join(d.state(), "calls"), 0755); err != nil {
+		return nil, err
+	}
+	if err := d.SetResult(result); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, typ), []byte(delegateScript), 0755); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// SetResult changes the result printed by subsequent ADDs and clears the error set by SetError
+func (d *Delegate) SetResult(result []byte) error {
+	if err := os.Remove(filepath.Join(d.state(), "error")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(d.state(), "result"), result, 0644)
+}
+
+// SetError makes subsequent invocations except VERSION fail with a cni error of code and msg
+func (d *Delegate) SetError(code uint, msg string) error {
+	data, err := json.Marshal(map[string]interface{}{"cniVersion": "0.4.0", "code": code, "msg": msg})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(d.state(), "error"), data, 0644)
+}
+
+// Invocations returns finished invocations except VERSION ones in the order they started
+func (d *Delegate) Invocations() ([]Invocation, error) {
+	calls := filepath.Join(d.state(), "calls")
+	fis, err := ioutil.ReadDir(calls)
+	if err != nil {
+		return nil, err
+	}
+	var ret []Invocation
+	var started []time.Time
+	for _, fi := range fis {
+		dir := filepath.Join(calls, fi.Name())
+		if _, err := os.Stat(filepath.Join(dir, "done")); err != nil {
+			continue
+		}
+		// env is the first file written by the invocation
+		env, err := os.Stat(filepath.Join(dir, "env"))
+		if err != nil {
+			return nil, err
+		}
+		inv, err := readInvocation(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read invocation %s: %v", fi.Name(), err)
+		}
+		ret = append(ret, *inv)
+		started = append(started, env.ModTime())
+	}
+	sort.Sort(byStart{invocations: ret, started: started})
+	return ret, nil
+}
+
+type byStart struct {
+	invocations []Invocation
+	started     []time.Time
+}
+
+func (s byStart) Len() int           { return len(s.invocations) }
+func (s byStart) Less(i, j int) bool { return s.started[i].Before(s.started[j]) }
+func (s byStart) Swap(i, j int) {
+	s.invocations[i], s.invocations[j] = s.invocations[j], s.invocations[i]
+	s.started[i], s.started[j] = s.started[j], s.started[i]
+}
+
+func (d *Delegate) state() string {
+	return filepath.Join(d.Dir, "."+d.Type)
+}
+
+func readInvocation(dir string) (*Invocation, error) {
+	env, err := ioutil.ReadFile(filepath.Join(dir, "env"))
+	if err != nil {
+		return nil, err
+	}
+	config, err := ioutil.ReadFile(filepath.Join(dir, "stdin"))
+	if err != nil {
+		return nil, err
+	}
+	inv := &Invocation{Config: config}
+	fields := map[string]*string{
+		"CNI_COMMAND":     &inv.Command,
+		"CNI_CONTAINERID": &inv.ContainerID,
+		"CNI_NETNS":       &inv.Netns,
+		"CNI_IFNAME":      &inv.IfName,
+		"CNI_ARGS":        &inv.Args,
+		"CNI_PATH":        &inv.Path,
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(env))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if field, ok := fields[parts[0]]; ok && len(parts) == 2 {
+			*field = parts[1]
+		}
+	}
+	return inv, scanner.Err()
+}
+
+// writeFileAtomic replaces file with data by renaming, so that concurrent invocations never read a partial file
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // nolint: errcheck
+	if _, err := f.Write(data); err != nil {
+		f.Close() // nolint: errcheck
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
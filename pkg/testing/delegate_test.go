@@ -0,0 +1,82 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package testing
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func invoke(t *testing.T, d *Delegate, command, containerID, stdin string) (string, error) {
+	cmd := exec.Command(filepath.Join(d.Dir, d.Type))
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "CNI_COMMAND=" + command, "CNI_CONTAINERID=" + containerID,
+		"CNI_NETNS=/proc/1/ns/net", "CNI_IFNAME=eth0", "CNI_ARGS=K8S_POD_NAME=pod1", "CNI_PATH=" + d.Dir}
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+func TestDelegate(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "delegate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	result := `{"cniVersion":"0.2.0","ip4":{"ip":"10.0.0.2/24"}}`
+	d, err := NewDelegate(dir, "stub", []byte(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := `{"cniVersion":"0.2.0","name":"net","type":"stub"}`
+	if out, err := invoke(t, d, "ADD", "c1", conf); err != nil || strings.TrimSpace(out) != result {
+		t.Fatalf("expect result %s, got %q %v", result, out, err)
+	}
+	if out, err := invoke(t, d, "VERSION", "", ""); err != nil || !strings.Contains(out, "supportedVersions") {
+		t.Fatalf("expect version info, got %q %v", out, err)
+	}
+	if err := d.SetError(11, "try again"); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := invoke(t, d, "DEL", "c1", conf); err == nil || !strings.Contains(out, `"try again"`) {
+		t.Fatalf("expect error, got %q %v", out, err)
+	}
+	if err := d.SetResult([]byte(result)); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := invoke(t, d, "DEL", "c1", conf); err != nil || out != "" {
+		t.Fatalf("expect no output, got %q %v", out, err)
+	}
+	invs, err := d.Invocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invs) != 3 {
+		t.Fatalf("expect 3 invocations, got %+v", invs)
+	}
+	for i, command := range []string{"ADD", "DEL", "DEL"} {
+		inv := invs[i]
+		if inv.Command != command || inv.ContainerID != "c1" || inv.IfName != "eth0" ||
+			inv.Args != "K8S_POD_NAME=pod1" || inv.Path != dir || string(inv.Config) != conf {
+			t.Fatalf("unexpected invocation %d: %+v", i, inv)
+		}
+	}
+}
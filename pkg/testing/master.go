@@ -0,0 +1,389 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package testing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// listKinds are kinds of items of lists which are empty, client-go refuses to decode a list of another kind
+var listKinds = map[string]string{
+	"pods":       "Pod",
+	"nodes":      "Node",
+	"namespaces": "Namespace",
+	"events":     "Event",
+	"configmaps": "ConfigMap",
+	"services":   "Service",
+	"endpoints":  "Endpoints",
+}
+
+// Request is a request received by FakeMaster
+type Request struct {
+	Method string
+	Path   string
+	Query  string
+	Body   []byte
+}
+
+// FakeMaster is an in memory kubernetes api server for tests talking to galaxy by --master. It serves get, list,
+// create, update, merge patch and delete of objects of the core group, e.g. /api/v1/namespaces/{ns}/pods/{name}
+// and /api/v1/nodes/{name}, and status subresources of them. Watches are accepted but never send events. Each
+// FakeMaster keeps its own objects, so parallel tests don't interfere with each other.
+type FakeMaster struct {
+	*httptest.Server
+
+	lock            sync.Mutex
+	objects         map[string]map[string]interface{}
+	requests        []Request
+	resourceVersion int
+}
+
+// NewFakeMaster starts a FakeMaster, callers should Close it at the end of the test
+func NewFakeMaster() *FakeMaster {
+	m := &FakeMaster{objects: map[string]map[string]interface{}{}}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.serveHTTP))
+	return m
+}
+
+// AddPod stores the pod, replacing the existing one of the same namespace and name
+func (m *FakeMaster) AddPod(pod *corev1.Pod) error {
+	return m.Put(fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", pod.Namespace, pod.Name), "Pod", pod)
+}
+
+// AddNode stores the node, replacing the existing one of the same name
+func (m *FakeMaster) AddNode(node *corev1.Node) error {
+	return m.Put(fmt.Sprintf("/api/v1/nodes/%s", node.Name), "Node", node)
+}
+
+// Pod returns the stored pod, nil if it doesn't exist
+func (m *FakeMaster) Pod(namespace, name string) (*corev1.Pod, error) {
+	var pod corev1.Pod
+	if ok, err := m.Get(fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", namespace, name), &pod); !ok || err != nil {
+		return nil, err
+	}
+	return &pod, nil
+}
+
+// Put stores obj of kind at path of the object, e.g. /api/v1/namespaces/default/configmaps/foo
+func (m *FakeMaster) Put(path, kind string, obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	var o map[string]interface{}
+	if err := json.Unmarshal(data, &o); err != nil {
+		return err
+	}
+	o["apiVersion"], o["kind"] = "v1", kind
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.store(strings.TrimSuffix(path, "/"), o)
+	return nil
+}
+
+// Get decodes the object stored at path into obj, returns false if there is none
+func (m *FakeMaster) Get(path string, obj interface{}) (bool, error) {
+	m.lock.Lock()
+	o, ok := m.objects[strings.TrimSuffix(path, "/")]
+	var data []byte
+	var err error
+	if ok {
+		data, err = json.Marshal(o)
+	}
+	m.lock.Unlock()
+	if !ok || err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, obj)
+}
+
+// Requests returns requests received so far in order
+func (m *FakeMaster) Requests() []Request {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]Request(nil), m.requests...)
+}
+
+// store saves o at path with a new resource version, callers must hold the lock
+func (m *FakeMaster) store(path string, o map[string]interface{}) {
+	m.resourceVersion++
+	meta, _ := o["metadata"].(map[string]interface{})
+	if meta == nil {
+		meta = map[string]interface{}{}
+		o["metadata"] = meta
+	}
+	meta["resourceVersion"] = strconv.Itoa(m.resourceVersion)
+	m.objects[path] = o
+}
+
+// parsePath splits an api path into the collection, the object name and the subresource
+func parsePath(path string) (collection, name, subresource string, ok bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 3 || parts[0] != "api" || parts[1] != "v1" {
+		return "", "", "", false
+	}
+	n := 3
+	if parts[2] == "namespaces" && len(parts) >= 5 {
+		n = 5
+	}
+	collection = "/" + strings.Join(parts[:n], "/")
+	switch len(parts) - n {
+	case 0:
+	case 1:
+		name = parts[n]
+	case 2:
+		name, subresource = parts[n], parts[n+1]
+	default:
+		return "", "", "", false
+	}
+	return collection, name, subresource, true
+}
+
+func (m *FakeMaster) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	query := r.URL.Query()
+	m.lock.Lock()
+	m.requests = append(m.requests, Request{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Body: body})
+	m.lock.Unlock()
+	collection, name, subresource, ok := parsePath(r.URL.Path)
+	if !ok {
+		writeStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("unknown path %s", r.URL.Path))
+		return
+	}
+	if subresource != "" && subresource != "status" {
+		writeStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("unknown subresource %s", subresource))
+		return
+	}
+	if name == "" {
+		switch r.Method {
+		case http.MethodGet:
+			if query.Get("watch") == "true" || query.Get("watch") == "1" {
+				// keep the watch open without events until the client or the server goes away
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				if f, ok := w.(http.Flusher); ok {
+					f.Flush()
+				}
+				<-r.Context().Done()
+				return
+			}
+			m.list(w, collection)
+		case http.MethodPost:
+			m.create(w, collection, body)
+		default:
+			writeStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" is not allowed")
+		}
+		return
+	}
+	path := collection + "/" + name
+	switch r.Method {
+	case http.MethodGet:
+		m.get(w, path)
+	case http.MethodPut:
+		m.update(w, path, body)
+	case http.MethodPatch:
+		m.patch(w, path, r.Header.Get("Content-Type"), body)
+	case http.MethodDelete:
+		m.delete(w, path)
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" is not allowed")
+	}
+}
+
+func (m *FakeMaster) list(w http.ResponseWriter, collection string) {
+	m.lock.Lock()
+	var paths []string
+	for path := range m.objects {
+		if c, _, _, _ := parsePath(path); c == collection || isAllNamespaces(collection, c) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	items := make([]interface{}, 0, len(paths))
+	kind := listKinds[collection[strings.LastIndex(collection, "/")+1:]]
+	for _, path := range paths {
+		items = append(items, m.objects[path])
+		kind, _ = m.objects[path]["kind"].(string)
+	}
+	list := map[string]interface{}{"apiVersion": "v1", "kind": kind + "List", "items": items,
+		"metadata": map[string]interface{}{"resourceVersion": strconv.Itoa(m.resourceVersion)}}
+	m.lock.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+// isAllNamespaces tells if collection, e.g. /api/v1/pods, lists namespaced collection c of all namespaces
+func isAllNamespaces(collection, c string) bool {
+	parts := strings.Split(c, "/")
+	return len(parts) == 6 && parts[3] == "namespaces" && collection == "/api/v1/"+parts[5]
+}
+
+func (m *FakeMaster) get(w http.ResponseWriter, path string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	o, ok := m.objects[path]
+	if !ok {
+		writeStatus(w, http.StatusNotFound, "NotFound", path+" not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, o)
+}
+
+func (m *FakeMaster) create(w http.ResponseWriter, collection string, body []byte) {
+	var o map[string]interface{}
+	if err := json.Unmarshal(body, &o); err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+	meta, _ := o["metadata"].(map[string]interface{})
+	if meta == nil {
+		meta = map[string]interface{}{}
+		o["metadata"] = meta
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name, _ := meta["name"].(string)
+	if prefix, _ := meta["generateName"].(string); name == "" && prefix != "" {
+		name = fmt.Sprintf("%s%d", prefix, m.resourceVersion+1)
+		meta["name"] = name
+	}
+	if name == "" {
+		writeStatus(w, http.StatusUnprocessableEntity, "Invalid", "name is required")
+		return
+	}
+	path := collection + "/" + name
+	if _, ok := m.objects[path]; ok {
+		writeStatus(w, http.StatusConflict, "AlreadyExists", path+" already exists")
+		return
+	}
+	m.store(path, o)
+	writeJSON(w, http.StatusCreated, o)
+}
+
+func (m *FakeMaster) update(w http.ResponseWriter, path string, body []byte) {
+	var o map[string]interface{}
+	if err := json.Unmarshal(body, &o); err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	old, ok := m.objects[path]
+	if !ok {
+		writeStatus(w, http.StatusNotFound, "NotFound", path+" not found")
+		return
+	}
+	if rv := resourceVersion(o); rv != "" && rv != resourceVersion(old) {
+		writeStatus(w, http.StatusConflict, "Conflict", path+" has been modified")
+		return
+	}
+	m.store(path, o)
+	writeJSON(w, http.StatusOK, o)
+}
+
+// patch applies json merge patches. Strategic merge patches are applied as merge patches as well, which replace
+// lists instead of merging them by keys.
+func (m *FakeMaster) patch(w http.ResponseWriter, path, contentType string, body []byte) {
+	if contentType != "application/merge-patch+json" && contentType != "application/strategic-merge-patch+json" {
+		writeStatus(w, http.StatusUnsupportedMediaType, "UnsupportedMediaType",
+			fmt.Sprintf("unsupported patch type %s", contentType))
+		return
+	}
+	var p interface{}
+	if err := json.Unmarshal(body, &p); err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	old, ok := m.objects[path]
+	if !ok {
+		writeStatus(w, http.StatusNotFound, "NotFound", path+" not found")
+		return
+	}
+	o, ok := mergePatch(old, p).(map[string]interface{})
+	if !ok {
+		writeStatus(w, http.StatusUnprocessableEntity, "Invalid", "patch replaces the object")
+		return
+	}
+	m.store(path, o)
+	writeJSON(w, http.StatusOK, o)
+}
+
+func (m *FakeMaster) delete(w http.ResponseWriter, path string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.objects[path]; !ok {
+		writeStatus(w, http.StatusNotFound, "NotFound", path+" not found")
+		return
+	}
+	delete(m.objects, path)
+	writeStatus(w, http.StatusOK, "Success", "")
+}
+
+// mergePatch applies patch p to o as RFC 7386 describes, o is not modified
+func mergePatch(o, p interface{}) interface{} {
+	pm, ok := p.(map[string]interface{})
+	if !ok {
+		return p
+	}
+	om, _ := o.(map[string]interface{})
+	ret := make(map[string]interface{}, len(om))
+	for k, v := range om {
+		ret[k] = v
+	}
+	for k, v := range pm {
+		if v == nil {
+			delete(ret, k)
+		} else {
+			ret[k] = mergePatch(ret[k], v)
+		}
+	}
+	return ret
+}
+
+func resourceVersion(o map[string]interface{}) string {
+	meta, _ := o["metadata"].(map[string]interface{})
+	rv, _ := meta["resourceVersion"].(string)
+	return rv
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeStatus writes a metav1.Status which client-go turns into errors recognized by k8s.io/apimachinery/pkg/api/errors
+func writeStatus(w http.ResponseWriter, code int, reason, message string) {
+	status := "Failure"
+	if code < http.StatusBadRequest {
+		status = "Success"
+		reason = ""
+	}
+	writeJSON(w, code, map[string]interface{}{"apiVersion": "v1", "kind": "Status", "status": status,
+		"reason": reason, "message": message, "code": code})
+}
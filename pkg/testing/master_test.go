@@ -0,0 +1,123 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package testing
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func do(t *testing.T, m *FakeMaster, method, path, contentType, body string, out interface{}) int {
+	req, err := http.NewRequest(method, m.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestFakeMaster(t *testing.T) {
+	t.Parallel()
+	m := NewFakeMaster()
+	defer m.Close()
+	if err := m.AddPod(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default",
+		Labels: map[string]string{"app": "foo"}}}); err != nil {
+		t.Fatal(err)
+	}
+	var pod corev1.Pod
+	if code := do(t, m, http.MethodGet, "/api/v1/namespaces/default/pods/pod1", "", "", &pod); code != http.StatusOK {
+		t.Fatalf("expect 200, got %d", code)
+	}
+	if pod.Name != "pod1" || pod.Kind != "Pod" || pod.ResourceVersion == "" {
+		t.Fatalf("unexpected pod %+v", pod)
+	}
+	var status metav1.Status
+	if code := do(t, m, http.MethodGet, "/api/v1/namespaces/default/pods/pod2", "", "", &status); code !=
+		http.StatusNotFound || status.Reason != metav1.StatusReasonNotFound {
+		t.Fatalf("expect 404 NotFound, got %d %+v", code, status)
+	}
+	patch := `{"metadata":{"labels":{"app":null,"role":"bar"},"annotations":{"k":"v"}}}`
+	if code := do(t, m, http.MethodPatch, "/api/v1/namespaces/default/pods/pod1",
+		"application/strategic-merge-patch+json", patch, nil); code != http.StatusOK {
+		t.Fatalf("expect 200, got %d", code)
+	}
+	p, err := m.Pod("default", "pod1")
+	if err != nil || p == nil {
+		t.Fatalf("expect pod1, got %v %v", p, err)
+	}
+	if !reflect.DeepEqual(p.Labels, map[string]string{"role": "bar"}) || p.Annotations["k"] != "v" {
+		t.Fatalf("unexpected patched pod %+v", p.ObjectMeta)
+	}
+	p.ResourceVersion = pod.ResourceVersion
+	data, _ := json.Marshal(p)
+	if code := do(t, m, http.MethodPut, "/api/v1/namespaces/default/pods/pod1/status", "application/json",
+		string(data), nil); code != http.StatusConflict {
+		t.Fatalf("expect 409 for a stale update, got %d", code)
+	}
+	if err := m.AddNode(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}); err != nil {
+		t.Fatal(err)
+	}
+	var pods corev1.PodList
+	if code := do(t, m, http.MethodGet, "/api/v1/pods", "", "", &pods); code != http.StatusOK ||
+		pods.Kind != "PodList" || len(pods.Items) != 1 {
+		t.Fatalf("expect a PodList of pod1, got %d %+v", code, pods)
+	}
+	if code := do(t, m, http.MethodGet, "/api/v1/namespaces/kube-system/pods", "", "", &pods); code !=
+		http.StatusOK || pods.Kind != "PodList" || len(pods.Items) != 0 {
+		t.Fatalf("expect an empty PodList, got %d %+v", code, pods)
+	}
+	if code := do(t, m, http.MethodDelete, "/api/v1/namespaces/default/pods/pod1", "", "", nil); code !=
+		http.StatusOK {
+		t.Fatalf("expect 200, got %d", code)
+	}
+	if p, err := m.Pod("default", "pod1"); p != nil || err != nil {
+		t.Fatalf("expect pod1 deleted, got %v %v", p, err)
+	}
+	if reqs := m.Requests(); len(reqs) != 7 || reqs[2].Method != http.MethodPatch {
+		t.Fatalf("unexpected requests %+v", reqs)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	o := map[string]interface{}{"a": "b", "c": map[string]interface{}{"d": "e", "f": "g"}, "h": []interface{}{"i"}}
+	p := map[string]interface{}{"a": nil, "c": map[string]interface{}{"d": nil, "x": "y"}, "h": []interface{}{"j"}}
+	expect := map[string]interface{}{"c": map[string]interface{}{"f": "g", "x": "y"}, "h": []interface{}{"j"}}
+	if got := mergePatch(o, p); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %v, got %v", expect, got)
+	}
+	if _, ok := o["a"]; !ok {
+		t.Fatal("expect o unmodified")
+	}
+}
@@ -23,6 +23,7 @@ import (
 
 	"github.com/dbdd4us/qcloudapi-sdk-go/metadata"
 	log "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/utils"
 )
 
 func getENIIndex(ifName string) (int, error) {
@@ -87,18 +88,12 @@ func getENIMetaMap(metaCli *metadata.MetaData) (eniMetaMap map[string]*eniMeta,
 // This helps us determine if we should ignore this error as the route
 // that we want to cleanup has been deleted already routing table
 func IsNotExistsError(err error) bool {
-	if errno, ok := err.(syscall.Errno); ok {
-		return errno == syscall.ESRCH
-	}
-	return false
+	return utils.IsErrno(err, syscall.ESRCH)
 }
 
 // IsFileExistsError returns true if the error type is syscall.EEXIST
 // This helps us determine if we should ignore this error as the route
 // we want to add has been added already in routing table
 func IsFileExistsError(err error) bool {
-	if errno, ok := err.(syscall.Errno); ok {
-		return errno == syscall.EEXIST
-	}
-	return false
+	return utils.IsExist(err)
 }
@@ -0,0 +1,327 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	arpRequest = 1
+	arpReply   = 2
+	// the number of gratuitous arp packets to send and the interval between them, the same as `arping -c 2`
+	garpCount    = 2
+	garpInterval = time.Second
+)
+
+// SendGratuitousARP sends gratuitous arp packets of ip from dev which is in netns nns or the current netns if nns is
+// empty. It sends arp requests if useArpRequest is true, otherwise arp replies. It sends packets via an AF_PACKET
+// socket and falls back to arping if that fails.
+func SendGratuitousARP(dev, ip, nns string, useArpRequest bool) error {
+	send := func() error {
+		if err := sendGratuitousARP(dev, ip, useArpRequest); err != nil {
+			if arpingErr := arping(dev, ip, useArpRequest); arpingErr != nil {
+				return fmt.Errorf("%v, arping fallback: %v", err, arpingErr)
+			}
+		}
+		return nil
+	}
+	if nns == "" {
+		return send()
+	}
+	netns, err := ns.GetNS(nns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", nns, err)
+	}
+	defer netns.Close() // nolint: errcheck
+	return netns.Do(func(_ ns.NetNS) error {
+		return send()
+	})
+}
+
+func sendGratuitousARP(dev, ip string, useArpRequest bool) error {
+	iface, err := net.InterfaceByName(dev)
+	if err != nil {
+		return err
+	}
+	addr := net.ParseIP(ip).To4()
+	if addr == nil {
+		return fmt.Errorf("invalid ipv4 address %s", ip)
+	}
+	if len(iface.HardwareAddr) != 6 {
+		return fmt.Errorf("device %s has no ethernet address", dev)
+	}
+	op := uint16(arpReply)
+	if useArpRequest {
+		op = arpRequest
+	}
+	return sendARPPackets(iface, garpPacket(iface.HardwareAddr, addr, op))
+}
+
+// AnnounceIP sends gratuitous arp requests of ip carrying the mac of dev, tagged with vlan if it is not 0. It
+// announces ips which are not local to dev, e.g. those of pods which are yet to start, so that arp caches of
+// upstream routers and mac tables of switches are warm once the pods start.
+func AnnounceIP(dev string, ip net.IP, vlan uint16) error {
+	iface, err := net.InterfaceByName(dev)
+	if err != nil {
+		return err
+	}
+	addr := ip.To4()
+	if addr == nil {
+		return fmt.Errorf("invalid ipv4 address %s", ip)
+	}
+	if len(iface.HardwareAddr) != 6 {
+		return fmt.Errorf("device %s has no ethernet address", dev)
+	}
+	packet := garpPacket(iface.HardwareAddr, addr, arpRequest)
+	if vlan != 0 {
+		packet = vlanTagged(packet, vlan)
+	}
+	return sendARPPackets(iface, packet)
+}
+
+// sendARPPackets sends packet from iface garpCount times
+func sendARPPackets(iface *net.Interface, packet []byte) error {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return fmt.Errorf("failed to open packet socket: %v", err)
+	}
+	defer unix.Close(fd) // nolint: errcheck
+	sa := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  iface.Index,
+		Halen:    6,
+	}
+	copy(sa.Addr[:], broadcastMAC)
+	for i := 0; i < garpCount; i++ {
+		if i > 0 {
+			time.Sleep(garpInterval)
+		}
+		if err := unix.Sendto(fd, packet, 0, sa); err != nil {
+			return fmt.Errorf("failed to send arp packet: %v", err)
+		}
+	}
+	return nil
+}
+
+// ProbeIP sends arp probes of ip from dev, i.e. arp requests whose sender ip is 0.0.0.0 as RFC 5227 describes, each
+// of which waits for timeout. It returns the mac of the first host claiming or probing the ip, nil if none does.
+func ProbeIP(dev string, ip net.IP, probes int, timeout time.Duration) (net.HardwareAddr, error) {
+	iface, err := net.InterfaceByName(dev)
+	if err != nil {
+		return nil, err
+	}
+	addr := ip.To4()
+	if addr == nil {
+		return nil, fmt.Errorf("invalid ipv4 address %s", ip)
+	}
+	if len(iface.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("device %s has no ethernet address", dev)
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packet socket: %v", err)
+	}
+	defer unix.Close(fd) // nolint: errcheck
+	sa := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ARP), Ifindex: iface.Index, Halen: 6}
+	if err := unix.Bind(fd, sa); err != nil {
+		return nil, fmt.Errorf("failed to bind packet socket to %s: %v", dev, err)
+	}
+	copy(sa.Addr[:], broadcastMAC)
+	packet := probePacket(iface.HardwareAddr, addr)
+	buf := make([]byte, 1500)
+	for i := 0; i < probes; i++ {
+		if err := unix.Sendto(fd, packet, 0, sa); err != nil {
+			return nil, fmt.Errorf("failed to send arp probe: %v", err)
+		}
+		for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+			tv := unix.NsecToTimeval(time.Until(deadline).Nanoseconds())
+			if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+				return nil, err
+			}
+			n, _, err := unix.Recvfrom(fd, buf, 0)
+			if err != nil {
+				if err == unix.EAGAIN || err == unix.EINTR {
+					continue
+				}
+				return nil, fmt.Errorf("failed to receive arp packets: %v", err)
+			}
+			if mac := conflictingMAC(buf[:n], iface.HardwareAddr, addr); mac != nil {
+				return mac, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// probePacket returns an ethernet frame of an arp probe of ip
+func probePacket(mac net.HardwareAddr, ip net.IP) []byte {
+	packet := garpPacket(mac, ip, arpRequest)
+	// sender ip 0.0.0.0 and target mac 0 so that no arp cache learns the ip of mac
+	copy(packet[28:32], net.IPv4zero.To4())
+	copy(packet[32:38], make([]byte, 6))
+	return packet
+}
+
+// conflictingMAC returns the sender mac of frame if it is an arp packet of another host than mac which claims ip, or
+// probes ip as well
+func conflictingMAC(frame []byte, mac net.HardwareAddr, ip net.IP) net.HardwareAddr {
+	if len(frame) < 42 || binary.BigEndian.Uint16(frame[12:14]) != unix.ETH_P_ARP {
+		return nil
+	}
+	arp := frame[14:42]
+	if binary.BigEndian.Uint16(arp[2:4]) != unix.ETH_P_IP || arp[4] != 6 || arp[5] != 4 {
+		return nil
+	}
+	sender := net.HardwareAddr(arp[8:14])
+	if bytes.Equal(sender, mac) {
+		return nil
+	}
+	senderIP, targetIP := net.IP(arp[14:18]), net.IP(arp[24:28])
+	if senderIP.Equal(ip) || senderIP.Equal(net.IPv4zero) && targetIP.Equal(ip) &&
+		binary.BigEndian.Uint16(arp[6:8]) == arpRequest {
+		return append(net.HardwareAddr{}, sender...)
+	}
+	return nil
+}
+
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// garpPacket returns an ethernet frame of a gratuitous arp whose sender and target ip are both ip
+func garpPacket(mac net.HardwareAddr, ip net.IP, op uint16) []byte {
+	packet := make([]byte, 42)
+	// ethernet header
+	copy(packet[0:6], broadcastMAC)
+	copy(packet[6:12], mac)
+	binary.BigEndian.PutUint16(packet[12:14], unix.ETH_P_ARP)
+	// arp header: ethernet, ipv4, hardware address length, protocol address length, op
+	binary.BigEndian.PutUint16(packet[14:16], 1)
+	binary.BigEndian.PutUint16(packet[16:18], unix.ETH_P_IP)
+	packet[18] = 6
+	packet[19] = 4
+	binary.BigEndian.PutUint16(packet[20:22], op)
+	copy(packet[22:28], mac)
+	copy(packet[28:32], ip)
+	// the same as arping, target mac of requests is broadcast while replies carry the sender mac
+	if op == arpReply {
+		copy(packet[32:38], mac)
+	} else {
+		copy(packet[32:38], broadcastMAC)
+	}
+	copy(packet[38:42], ip)
+	return packet
+}
+
+// vlanTagged inserts an 802.1Q tag of vlan after the mac addresses of the ethernet frame
+func vlanTagged(frame []byte, vlan uint16) []byte {
+	tagged := make([]byte, len(frame)+4)
+	copy(tagged[0:12], frame[0:12])
+	binary.BigEndian.PutUint16(tagged[12:14], unix.ETH_P_8021Q)
+	binary.BigEndian.PutUint16(tagged[14:16], vlan&0xfff)
+	copy(tagged[16:], frame[12:])
+	return tagged
+}
+
+func htons(i uint16) uint16 {
+	return (i<<8)&0xff00 | i>>8
+}
+
+func arping(dev, ip string, useArpRequest bool) error {
+	arping, err := exec.LookPath("arping")
+	if err != nil {
+		return fmt.Errorf("unable to locate arping")
+	}
+	var command *exec.Cmd
+	if useArpRequest {
+		command = exec.Command(arping, "-c", "2", "-U", "-I", dev, ip)
+	} else {
+		command = exec.Command(arping, "-c", "2", "-A", "-I", dev, ip)
+	}
+	_, err = command.CombinedOutput()
+	return err
+}
+
+// DisableIPv6 disables ipv6 of netns nns by writing sysctl from a thread which enters nns
+func DisableIPv6(nns string) error {
+	netns, err := ns.GetNS(nns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", nns, err)
+	}
+	defer netns.Close() // nolint: errcheck
+	return netns.Do(func(_ ns.NetNS) error {
+		// /proc/sys/net is resolved by the netns of the opening thread
+		return ioutil.WriteFile("/proc/sys/net/ipv6/conf/all/disable_ipv6", []byte("1\n"), 0644)
+	})
+}
+
+// HardenIPv6 keeps ipv6 of netns nns but ignores router advertisements and redirects on all, default and ifNames
+// interfaces so that rogue routers on shared vlans can't hijack routes of the netns
+func HardenIPv6(nns string, ifNames ...string) error {
+	netns, err := ns.GetNS(nns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", nns, err)
+	}
+	defer netns.Close() // nolint: errcheck
+	return netns.Do(func(_ ns.NetNS) error {
+		for _, ifName := range append([]string{"all", "default"}, ifNames...) {
+			for _, key := range []string{"accept_ra", "accept_redirects"} {
+				file := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/%s", ifName, key)
+				if err := ioutil.WriteFile(file, []byte("0\n"), 0644); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// ReadSysctls reads sysctls of keys, which are paths under /proc/sys, within netns nns. Missing ones are skipped, e.g.
+// ipv6 sysctls of interfaces if ipv6 is disabled.
+func ReadSysctls(nns string, keys []string) (map[string]string, error) {
+	netns, err := ns.GetNS(nns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netns %q: %v", nns, err)
+	}
+	defer netns.Close() // nolint: errcheck
+	values := map[string]string{}
+	err = netns.Do(func(_ ns.NetNS) error {
+		for _, key := range keys {
+			data, err := ioutil.ReadFile(filepath.Join("/proc/sys", key))
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+			values[key] = strings.TrimSpace(string(data))
+		}
+		return nil
+	})
+	return values, err
+}
@@ -0,0 +1,86 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package utils
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+func TestGarpPacket(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	ip := net.ParseIP("172.17.0.2").To4()
+	for _, testCase := range []struct {
+		op     uint16
+		expect string
+	}{
+		{op: arpRequest, expect: "ffffffffffff0242ac1100020806" + "0001080006040001" + "0242ac110002ac110002" +
+			"ffffffffffffac110002"},
+		{op: arpReply, expect: "ffffffffffff0242ac1100020806" + "0001080006040002" + "0242ac110002ac110002" +
+			"0242ac110002ac110002"},
+	} {
+		if real := hex.EncodeToString(garpPacket(mac, ip, testCase.op)); real != testCase.expect {
+			t.Errorf("op %d: expect %s, real %s", testCase.op, testCase.expect, real)
+		}
+	}
+}
+
+func TestVlanTagged(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	packet := garpPacket(mac, net.ParseIP("172.17.0.2").To4(), arpRequest)
+	expect := "ffffffffffff0242ac110002" + "8100000a" + "0806" + "0001080006040001" + "0242ac110002ac110002" +
+		"ffffffffffffac110002"
+	if real := hex.EncodeToString(vlanTagged(packet, 10)); real != expect {
+		t.Errorf("expect %s, real %s", expect, real)
+	}
+}
+
+func TestProbePacket(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	expect := "ffffffffffff0242ac1100020806" + "0001080006040001" + "0242ac11000200000000" + "000000000000ac110003"
+	if real := hex.EncodeToString(probePacket(mac, net.ParseIP("172.17.0.3").To4())); real != expect {
+		t.Errorf("expect %s, real %s", expect, real)
+	}
+}
+
+func TestConflictingMAC(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	other, _ := net.ParseMAC("02:42:ac:11:00:03")
+	ip := net.ParseIP("172.17.0.3").To4()
+	for i, testCase := range []struct {
+		frame  []byte
+		expect net.HardwareAddr
+	}{
+		// the owner replies to our probe
+		{frame: garpPacket(other, ip, arpReply), expect: other},
+		// the owner announces the ip
+		{frame: garpPacket(other, ip, arpRequest), expect: other},
+		// another host probes the ip at the same time
+		{frame: probePacket(other, ip), expect: other},
+		// our own probe
+		{frame: probePacket(mac, ip)},
+		// arps of other ips
+		{frame: garpPacket(other, net.ParseIP("172.17.0.4").To4(), arpReply)},
+		{frame: probePacket(other, net.ParseIP("172.17.0.4").To4())},
+		{frame: garpPacket(other, ip, arpReply)[:40]},
+	} {
+		if real := conflictingMAC(testCase.frame, mac, ip); real.String() != testCase.expect.String() {
+			t.Errorf("case %d: expect %v, real %v", i, testCase.expect, real)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package budget limits the impact of bulk repairs, e.g. periodic full resyncs of iptables rules, on busy nodes.
+package budget
+
+import (
+	"sync"
+	"time"
+
+	glog "k8s.io/klog"
+)
+
+// window is the number of recent outcomes the error ratio is computed from
+const window = 20
+
+// Budget is a token bucket of units of work, e.g. iptables rules, which also pauses all work for a while if too
+// many recent operations failed. A nil Budget is unlimited.
+type Budget struct {
+	sync.Mutex
+	rate       float64
+	burst      float64
+	errorRatio float64
+	pause      time.Duration
+
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	outcomes    []bool
+	next        int
+
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+}
+
+// New creates a Budget which allows rate units per second with bursts of burst units, rate 0 means no rate limit.
+// Once errorRatio of the recent operations failed it pauses for pause, errorRatio 0 means never pause.
+func New(rate float64, burst int, errorRatio float64, pause time.Duration) *Budget {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Budget{
+		rate:       rate,
+		burst:      float64(burst),
+		errorRatio: errorRatio,
+		pause:      pause,
+		tokens:     float64(burst),
+		now:        time.Now,
+		after:      time.After,
+	}
+}
+
+// Wait blocks until n units of work are allowed. Work larger than burst is allowed once the bucket is full and
+// is paid off by later work. It returns false if quit is closed while waiting.
+func (b *Budget) Wait(n int, quit <-chan struct{}) bool {
+	if b == nil {
+		return true
+	}
+	for {
+		d := b.reserve(float64(n))
+		if d == 0 {
+			return true
+		}
+		select {
+		case <-quit:
+			return false
+		case <-b.after(d):
+		}
+	}
+}
+
+// reserve takes n tokens and returns 0 if they are available, otherwise it returns how long to wait for them
+func (b *Budget) reserve(n float64) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	now := b.now()
+	if now.Before(b.pausedUntil) {
+		return b.pausedUntil.Sub(now)
+	}
+	if b.rate <= 0 {
+		return 0
+	}
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	need := n
+	if need > b.burst {
+		need = b.burst
+	}
+	if b.tokens >= need {
+		b.tokens -= n
+		return 0
+	}
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Done records the outcome of an operation, it pauses the budget if the error ratio of recent operations spikes
+func (b *Budget) Done(err error) {
+	if b == nil || b.errorRatio <= 0 {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if len(b.outcomes) < window {
+		b.outcomes = append(b.outcomes, err != nil)
+	} else {
+		b.outcomes[b.next] = err != nil
+		b.next = (b.next + 1) % window
+	}
+	if len(b.outcomes) < window/2 {
+		return
+	}
+	var failed int
+	for _, f := range b.outcomes {
+		if f {
+			failed++
+		}
+	}
+	if float64(failed)/float64(len(b.outcomes)) >= b.errorRatio {
+		glog.Warningf("%d of the last %d operations failed, pausing for %v", failed, len(b.outcomes), b.pause)
+		b.pausedUntil = b.now().Add(b.pause)
+		b.outcomes = b.outcomes[:0]
+		b.next = 0
+	}
+}
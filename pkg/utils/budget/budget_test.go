@@ -0,0 +1,86 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package budget
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func fakeClock(b *Budget) *[]time.Duration {
+	now := time.Unix(0, 0)
+	var waits []time.Duration
+	b.now = func() time.Time { return now }
+	b.after = func(d time.Duration) <-chan time.Time {
+		waits = append(waits, d)
+		now = now.Add(d)
+		ch := make(chan time.Time, 1)
+		ch <- now
+		return ch
+	}
+	return &waits
+}
+
+func TestWait(t *testing.T) {
+	b := New(10, 20, 0, 0)
+	waits := fakeClock(b)
+	for _, n := range []int{20, 5, 30, 1} {
+		if !b.Wait(n, nil) {
+			t.Fatal("expect allowed")
+		}
+	}
+	// 20 burst, 5 needs 0.5s, 30 needs a full bucket 2s, 1 needs paying off 10 debt and 1 token 1.1s
+	expect := []time.Duration{500 * time.Millisecond, 2 * time.Second, 1100 * time.Millisecond}
+	if fmt.Sprint(*waits) != fmt.Sprint(expect) {
+		t.Fatalf("expect waits %v, real %v", expect, *waits)
+	}
+	var nilBudget *Budget
+	if !nilBudget.Wait(100, nil) {
+		t.Fatal("expect nil budget is unlimited")
+	}
+	nilBudget.Done(fmt.Errorf("err"))
+}
+
+func TestQuit(t *testing.T) {
+	b := New(1, 1, 0, 0)
+	b.Wait(1, nil)
+	quit := make(chan struct{})
+	close(quit)
+	if b.Wait(1, quit) {
+		t.Fatal("expect not allowed after quit")
+	}
+}
+
+func TestPause(t *testing.T) {
+	b := New(0, 1, 0.5, time.Minute)
+	waits := fakeClock(b)
+	for i := 0; i < window/2; i++ {
+		b.Done(nil)
+	}
+	b.Wait(1, nil)
+	if len(*waits) != 0 {
+		t.Fatalf("expect no pause, real %v", *waits)
+	}
+	for i := 0; i < window/2; i++ {
+		b.Done(fmt.Errorf("err"))
+	}
+	b.Wait(1, nil)
+	if len(*waits) != 1 || (*waits)[0] != time.Minute {
+		t.Fatalf("expect paused for a minute, real %v", *waits)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package capability reads capabilities of the current process so that daemons running with a reduced capability set
+// can verify what they need at startup instead of failing later with EPERM.
+package capability
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Cap is a linux capability number, see capabilities(7)
+type Cap uint
+
+// Capabilities network daemons care about
+const (
+	NetAdmin  Cap = 12
+	NetRaw    Cap = 13
+	SysPtrace Cap = 19
+	SysAdmin  Cap = 21
+)
+
+var names = map[Cap]string{
+	NetAdmin:  "CAP_NET_ADMIN",
+	NetRaw:    "CAP_NET_RAW",
+	SysPtrace: "CAP_SYS_PTRACE",
+	SysAdmin:  "CAP_SYS_ADMIN",
+}
+
+func (c Cap) String() string {
+	if name, ok := names[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("CAP_%d", uint(c))
+}
+
+// Set is a bit mask of capabilities
+type Set uint64
+
+// Has returns true if c is in s
+func (s Set) Has(c Cap) bool {
+	return s&(1<<c) != 0
+}
+
+// Missing returns capabilities of caps which are not in s
+func (s Set) Missing(caps ...Cap) []Cap {
+	var missing []Cap
+	for _, c := range caps {
+		if !s.Has(c) {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
+
+// Effective returns the effective capabilities of the current process
+func Effective() (Set, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close() // nolint: errcheck
+	return parseStatus(f, "CapEff")
+}
+
+// parseStatus returns the capability set of field in a /proc/<pid>/status file
+func parseStatus(r io.Reader, field string) (Set, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 || parts[0] != field {
+			continue
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q: %v", field, parts[1], err)
+		}
+		return Set(v), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no %s in status", field)
+}
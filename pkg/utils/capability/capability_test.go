@@ -0,0 +1,54 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package capability
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseStatus(t *testing.T) {
+	status := `Name:	galaxy
+CapInh:	0000000000000000
+CapPrm:	0000000000203000
+CapEff:	0000000000003000
+CapBnd:	0000000000203000
+`
+	s, err := parseStatus(strings.NewReader(status), "CapEff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Has(NetAdmin) || !s.Has(NetRaw) || s.Has(SysAdmin) {
+		t.Fatalf("unexpected set %x", uint64(s))
+	}
+	if missing := s.Missing(NetAdmin, SysAdmin, NetRaw); !reflect.DeepEqual(missing, []Cap{SysAdmin}) {
+		t.Fatalf("expect [CAP_SYS_ADMIN], real %v", missing)
+	}
+	if s, err := parseStatus(strings.NewReader(status), "CapPrm"); err != nil || !s.Has(SysAdmin) {
+		t.Fatalf("expect CAP_SYS_ADMIN permitted, set %x, err %v", uint64(s), err)
+	}
+	if _, err := parseStatus(strings.NewReader("Name:	galaxy\n"), "CapEff"); err == nil {
+		t.Fatal("expect an error without CapEff")
+	}
+	if _, err := parseStatus(strings.NewReader("CapEff:	xyz\n"), "CapEff"); err == nil {
+		t.Fatal("expect an error of invalid CapEff")
+	}
+	if Cap(40).String() != "CAP_40" {
+		t.Fatalf("unexpected name %s", Cap(40))
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package confcheck validates configs strictly against schemas and verifies their signatures so that nodes don't apply
+// malformed or tampered configs.
+package confcheck
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DecodeStrict unmarshals data into v, it rejects fields v doesn't have and trailing data
+func DecodeStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("unexpected data after the config")
+	}
+	return nil
+}
+
+// Kind is the json type of a field
+type Kind string
+
+const (
+	String Kind = "string"
+	Number Kind = "number"
+	Bool   Kind = "bool"
+	Object Kind = "object"
+	Array  Kind = "array"
+	// Any accepts all types, e.g. for fields passed to other plugins as is
+	Any Kind = "any"
+)
+
+// Field describes a field of an object
+type Field struct {
+	Kind     Kind
+	Required bool
+	// Check validates the value after its kind is checked, it may be nil
+	Check func(v interface{}) error
+}
+
+// Schema describes fields of an object, objects having fields not in a Schema are invalid
+type Schema map[string]Field
+
+func kindOf(v interface{}) Kind {
+	switch v.(type) {
+	case string:
+		return String
+	case float64, json.Number:
+		return Number
+	case bool:
+		return Bool
+	case map[string]interface{}:
+		return Object
+	case []interface{}:
+		return Array
+	}
+	return Any
+}
+
+// Validate returns an error listing all unknown, missing and invalid fields of obj
+func (s Schema) Validate(obj map[string]interface{}) error {
+	var errs []string
+	for key, v := range obj {
+		f, ok := s[key]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("unknown field %q", key))
+			continue
+		}
+		if v == nil {
+			continue
+		}
+		if f.Kind != Any && kindOf(v) != f.Kind {
+			errs = append(errs, fmt.Sprintf("field %q must be %s, not %s", key, f.Kind, kindOf(v)))
+			continue
+		}
+		if f.Check != nil {
+			if err := f.Check(v); err != nil {
+				errs = append(errs, fmt.Sprintf("field %q: %v", key, err))
+			}
+		}
+	}
+	for key, f := range s {
+		if _, ok := obj[key]; f.Required && !ok {
+			errs = append(errs, fmt.Sprintf("field %q is required", key))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	// map iteration is random, keep messages stable
+	sort.Strings(errs)
+	return fmt.Errorf("%s", strings.Join(errs, ", "))
+}
+
+// Extend returns a Schema having fields of both s and fields, fields overrides fields of s with the same names
+func (s Schema) Extend(fields Schema) Schema {
+	merged := Schema{}
+	for k, f := range s {
+		merged[k] = f
+	}
+	for k, f := range fields {
+		merged[k] = f
+	}
+	return merged
+}
+
+// IntRange returns a Check accepting integer numbers within [min, max]
+func IntRange(min, max int64) func(v interface{}) error {
+	return func(v interface{}) error {
+		f, ok := v.(float64)
+		if !ok {
+			return fmt.Errorf("not a number")
+		}
+		if f != float64(int64(f)) {
+			return fmt.Errorf("%v is not an integer", f)
+		}
+		if int64(f) < min || int64(f) > max {
+			return fmt.Errorf("%v is out of range [%d, %d]", f, min, max)
+		}
+		return nil
+	}
+}
+
+// OneOf returns a Check accepting strings of values
+func OneOf(values ...string) func(v interface{}) error {
+	return func(v interface{}) error {
+		for _, value := range values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("%v is not one of %s", v, strings.Join(values, ", "))
+	}
+}
+
+// NonEmpty is a Check rejecting empty strings
+func NonEmpty(v interface{}) error {
+	if v == "" {
+		return fmt.Errorf("empty")
+	}
+	return nil
+}
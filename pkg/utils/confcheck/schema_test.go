@@ -0,0 +1,78 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package confcheck
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecodeStrict(t *testing.T) {
+	var v struct {
+		Name string
+	}
+	for _, c := range []struct {
+		data   string
+		expect bool
+	}{
+		{data: `{"Name": "a"}`, expect: true},
+		{data: `{"Name": "a", "Nmae": "b"}`},
+		{data: `{"Name": 1}`},
+		{data: `{"Name": "a"} {}`},
+	} {
+		if err := DecodeStrict([]byte(c.data), &v); (err == nil) != c.expect {
+			t.Errorf("%s: expect valid %v, real err %v", c.data, c.expect, err)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	base := Schema{"type": {Kind: String, Required: true}, "args": {Kind: Any}}
+	s := base.Extend(Schema{
+		"device": {Kind: String, Required: true, Check: NonEmpty},
+		"vlan":   {Kind: Number, Check: IntRange(1, 4094)},
+		"switch": {Kind: String, Check: OneOf("bridge", "macvlan")},
+	})
+	if len(base) != 2 {
+		t.Fatalf("Extend changes base schema %v", base)
+	}
+	for _, c := range []struct {
+		conf   string
+		expect string
+	}{
+		{conf: `{"type": "vlan", "device": "eth1", "vlan": 2, "switch": "macvlan", "args": [1]}`},
+		{conf: `{"type": "vlan", "device": "eth1", "devcie": "eth2"}`, expect: `unknown field "devcie"`},
+		{conf: `{"type": "vlan"}`, expect: `field "device" is required`},
+		{conf: `{"type": "vlan", "device": ""}`, expect: `field "device": empty`},
+		{conf: `{"type": "vlan", "device": 1}`, expect: `field "device" must be string, not number`},
+		{conf: `{"type": "vlan", "device": "eth1", "vlan": 4095}`,
+			expect: `field "vlan": 4095 is out of range [1, 4094]`},
+		{conf: `{"type": "vlan", "device": "eth1", "vlan": 1.5}`, expect: `field "vlan": 1.5 is not an integer`},
+		{conf: `{"type": "vlan", "device": "eth1", "switch": "pure"}`,
+			expect: `field "switch": pure is not one of bridge, macvlan`},
+		{conf: `{"device": "eth1", "x": 1}`, expect: `field "type" is required, unknown field "x"`},
+	} {
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(c.conf), &obj); err != nil {
+			t.Fatal(err)
+		}
+		err := s.Validate(obj)
+		if c.expect == "" && err != nil || c.expect != "" && (err == nil || err.Error() != c.expect) {
+			t.Errorf("%s: expect %q, real %v", c.conf, c.expect, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package confcheck
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// SignatureSuffix is appended to the path of a config to get the path of its signature
+const SignatureSuffix = ".sig"
+
+// Verifier verifies ed25519 signatures of configs. A signature file holds the base64 encoded signature of the whole
+// config file, e.g. created by signing with the private key of the config source.
+type Verifier struct {
+	key ed25519.PublicKey
+}
+
+// NewVerifier creates a Verifier from a file of the base64 encoded ed25519 public key
+func NewVerifier(keyFile string) (*Verifier, error) {
+	key, err := readBase64(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key of %s has %d bytes, expect %d", keyFile, len(key), ed25519.PublicKeySize)
+	}
+	return &Verifier{key: ed25519.PublicKey(key)}, nil
+}
+
+// Verify returns an error if data doesn't match the signature in sigFile
+func (v *Verifier) Verify(data []byte, sigFile string) error {
+	sig, err := readBase64(sigFile)
+	if err != nil {
+		return fmt.Errorf("failed to read signature: %v", err)
+	}
+	if !ed25519.Verify(v.key, data, sig) {
+		return fmt.Errorf("signature %s doesn't match, the config may be tampered", sigFile)
+	}
+	return nil
+}
+
+func readBase64(file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+}
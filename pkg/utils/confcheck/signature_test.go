@@ -0,0 +1,63 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package confcheck
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "confcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(data)+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	if _, err := NewVerifier(write("short", pub[:8])); err == nil {
+		t.Fatal("expect an error of short key")
+	}
+	v, err := NewVerifier(write("key", pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := []byte(`{"NetworkConf": []}`)
+	sigFile := write("galaxy.json"+SignatureSuffix, ed25519.Sign(priv, conf))
+	if err := v.Verify(conf, sigFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify([]byte(`{"NetworkConf": [{}]}`), sigFile); err == nil {
+		t.Fatal("expect tampered config fails verifying")
+	}
+	if err := v.Verify(conf, filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expect an error without signature")
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package credential
+
+import (
+	"fmt"
+	"net/http"
+
+	"k8s.io/client-go/rest"
+)
+
+// ClientConfig returns a config of clients talking to the master of s. The token is read from s for every request so
+// that token rotations take effect without rebuilding clients. Changes of the master or certs need new clients.
+func (s *Source) ClientConfig() (*rest.Config, error) {
+	c := s.Get()
+	if c.Master == "" {
+		return nil, fmt.Errorf("no %s in credentials of %s", MasterKey, s.dir)
+	}
+	cfg := &rest.Config{
+		Host: c.Master,
+		TLSClientConfig: rest.TLSClientConfig{
+			CAData:   c.CA,
+			CertData: c.Cert,
+			KeyData:  c.Key,
+		},
+	}
+	cfg.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		return &tokenRoundTripper{source: s, rt: rt}
+	}
+	return cfg, nil
+}
+
+type tokenRoundTripper struct {
+	source *Source
+	rt     http.RoundTripper
+}
+
+func (t *tokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := t.source.Get().Token
+	if token == "" || req.Header.Get("Authorization") != "" {
+		return t.rt.RoundTrip(req)
+	}
+	// round trippers must not modify the request
+	r := req.WithContext(req.Context())
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	return t.rt.RoundTrip(r)
+}
@@ -0,0 +1,181 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package credential loads credentials of the kubernetes master from a dir, e.g. a mounted kubernetes secret, instead
+// of flags and reloads them on change. Credentials never appear in logs, use String to print them.
+package credential
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	glog "k8s.io/klog"
+)
+
+// Keys of the credential dir, the same as keys of kubernetes.io/tls secrets for certs. Missing keys are empty.
+const (
+	MasterKey = "master"
+	TokenKey  = "token"
+	CAKey     = "ca.crt"
+	CertKey   = "tls.crt"
+	KeyKey    = "tls.key"
+)
+
+// ReloadInterval is how often credentials are reloaded. Kubelet syncs mounted secrets within about a minute.
+const ReloadInterval = 30 * time.Second
+
+// Credentials of the kubernetes master
+type Credentials struct {
+	Master string
+	Token  string
+	CA     []byte
+	Cert   []byte
+	Key    []byte
+}
+
+// Load reads credentials from dir
+func Load(dir string) (*Credentials, error) {
+	read := func(key string) ([]byte, error) {
+		data, err := ioutil.ReadFile(filepath.Join(dir, key))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read %s of %s: %v", key, dir, err)
+		}
+		return data, nil
+	}
+	c := &Credentials{}
+	var err error
+	var master, token []byte
+	if master, err = read(MasterKey); err != nil {
+		return nil, err
+	}
+	if token, err = read(TokenKey); err != nil {
+		return nil, err
+	}
+	if c.CA, err = read(CAKey); err != nil {
+		return nil, err
+	}
+	if c.Cert, err = read(CertKey); err != nil {
+		return nil, err
+	}
+	if c.Key, err = read(KeyKey); err != nil {
+		return nil, err
+	}
+	c.Master = strings.TrimSpace(string(master))
+	c.Token = strings.TrimSpace(string(token))
+	if (len(c.Cert) == 0) != (len(c.Key) == 0) {
+		return nil, fmt.Errorf("%s and %s of %s must be both set or unset", CertKey, KeyKey, dir)
+	}
+	return c, nil
+}
+
+// String prints c with secrets redacted
+func (c *Credentials) String() string {
+	redact := func(set bool) string {
+		if set {
+			return "<redacted>"
+		}
+		return "<empty>"
+	}
+	return fmt.Sprintf("master %q token %s ca %s cert %s key %s", c.Master, redact(c.Token != ""),
+		redact(len(c.CA) > 0), redact(len(c.Cert) > 0), redact(len(c.Key) > 0))
+}
+
+// SameEndpoint returns true if c and o connect to the same master in the same way, i.e. they differ in token only
+func (c *Credentials) SameEndpoint(o *Credentials) bool {
+	return c.Master == o.Master && bytes.Equal(c.CA, o.CA) && bytes.Equal(c.Cert, o.Cert) && bytes.Equal(c.Key, o.Key)
+}
+
+func (c *Credentials) equal(o *Credentials) bool {
+	return c.SameEndpoint(o) && c.Token == o.Token
+}
+
+// Source holds the latest credentials of a dir
+type Source struct {
+	dir      string
+	lock     sync.RWMutex
+	current  *Credentials
+	onChange []func(old, new *Credentials)
+}
+
+// NewSource loads credentials of dir
+func NewSource(dir string) (*Source, error) {
+	c, err := Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("loaded credentials from %s: %v", dir, c)
+	return &Source{dir: dir, current: c}, nil
+}
+
+// Get returns the latest credentials
+func (s *Source) Get() *Credentials {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.current
+}
+
+// OnChange registers f to be called with the previous and the latest credentials once they change. It must be called
+// before Run.
+func (s *Source) OnChange(f func(old, new *Credentials)) {
+	s.onChange = append(s.onChange, f)
+}
+
+// Reload loads credentials of the dir again. It keeps the previous ones if loading fails, e.g. while the secret is
+// being updated.
+func (s *Source) Reload() error {
+	c, err := Load(s.dir)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	old := s.current
+	s.current = c
+	s.lock.Unlock()
+	if old.equal(c) {
+		return nil
+	}
+	glog.Infof("credentials of %s changed: %v", s.dir, c)
+	for _, f := range s.onChange {
+		f(old, c)
+	}
+	return nil
+}
+
+// Run reloads credentials every interval until quit is closed
+func (s *Source) Run(interval time.Duration, quit <-chan struct{}) {
+	wait.Until(func() {
+		if err := s.Reload(); err != nil {
+			glog.Warningf("failed to reload credentials: %v", err)
+		}
+	}, interval, quit)
+}
+
+// ExitOnEndpointChange exits the process once the master or certs change. Clients can't switch to them in place,
+// the process is restarted with new clients instead.
+func (s *Source) ExitOnEndpointChange() {
+	s.OnChange(func(old, new *Credentials) {
+		if !old.SameEndpoint(new) {
+			glog.Exitf("master or certs of %s changed, exiting to reconnect: %v", s.dir, new)
+		}
+	})
+}
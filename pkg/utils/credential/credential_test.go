@@ -0,0 +1,76 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package credential
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// #lizard forgives
+func TestSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credential")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	write := func(key, value string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, key), []byte(value), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(MasterKey, "https://1.1.1.1:6443\n")
+	write(TokenKey, "secret1\n")
+	s, err := NewSource(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := s.Get(); c.Master != "https://1.1.1.1:6443" || c.Token != "secret1" {
+		t.Fatalf("unexpected credentials %+v", c)
+	}
+	if str := s.Get().String(); strings.Contains(str, "secret1") {
+		t.Fatalf("token is not redacted: %s", str)
+	}
+	var changes int
+	var sameEndpoint bool
+	s.OnChange(func(old, new *Credentials) {
+		changes++
+		sameEndpoint = old.SameEndpoint(new)
+	})
+	if err := s.Reload(); err != nil || changes != 0 {
+		t.Fatalf("expect no change, changes %d, err %v", changes, err)
+	}
+	write(TokenKey, "secret2")
+	if err := s.Reload(); err != nil || changes != 1 || !sameEndpoint || s.Get().Token != "secret2" {
+		t.Fatalf("expect token change, changes %d, same endpoint %v, err %v", changes, sameEndpoint, err)
+	}
+	// a half written secret keeps the previous credentials
+	write(CertKey, "cert")
+	if err := s.Reload(); err == nil {
+		t.Fatal("expect error of cert without key")
+	}
+	if changes != 1 || len(s.Get().Cert) != 0 {
+		t.Fatalf("expect previous credentials kept, changes %d", changes)
+	}
+	write(KeyKey, "key")
+	if err := s.Reload(); err != nil || changes != 2 || sameEndpoint {
+		t.Fatalf("expect endpoint change, changes %d, same endpoint %v, err %v", changes, sameEndpoint, err)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package endpoint parses addresses galaxy serves its api on besides the unix socket of its socket dir, i.e. abstract
+// unix sockets and vsock ports for cni shims which don't share /run with galaxy, e.g. kubelets within kata VMs.
+package endpoint
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// SchemeUnix is of unix sockets of paths, e.g. unix:/var/run/galaxy/galaxy.sock
+	SchemeUnix = "unix"
+	// SchemeAbstract is of abstract unix sockets, e.g. abstract:galaxy
+	SchemeAbstract = "abstract"
+	// SchemeVsock is of vsock ports, e.g. vsock:10000 or vsock:3:10000. Listening without a cid accepts connections
+	// of any cid, dialing without a cid connects to the host.
+	SchemeVsock = "vsock"
+)
+
+// Endpoint is a parsed address
+type Endpoint struct {
+	Scheme string
+	// Path is the path of unix sockets or the name of abstract sockets
+	Path string
+	// CID and Port are of vsock endpoints
+	CID  uint32
+	Port uint32
+}
+
+// Parse parses addresses of the form <scheme>:<address>, an absolute path is a unix socket
+func Parse(s string) (*Endpoint, error) {
+	if strings.HasPrefix(s, "/") {
+		return &Endpoint{Scheme: SchemeUnix, Path: s}, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("bad endpoint %q, expect <scheme>:<address>", s)
+	}
+	switch parts[0] {
+	case SchemeUnix:
+		return &Endpoint{Scheme: SchemeUnix, Path: parts[1]}, nil
+	case SchemeAbstract:
+		return &Endpoint{Scheme: SchemeAbstract, Path: strings.TrimPrefix(parts[1], "@")}, nil
+	case SchemeVsock:
+		e := &Endpoint{Scheme: SchemeVsock, CID: unix.VMADDR_CID_ANY}
+		fields := strings.Split(parts[1], ":")
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("bad vsock endpoint %q, expect vsock:[<cid>:]<port>", s)
+		}
+		if len(fields) == 2 {
+			cid, err := strconv.ParseUint(fields[0], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad cid of %q: %v", s, err)
+			}
+			e.CID = uint32(cid)
+		}
+		port, err := strconv.ParseUint(fields[len(fields)-1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad port of %q: %v", s, err)
+		}
+		e.Port = uint32(port)
+		return e, nil
+	default:
+		return nil, fmt.Errorf("unknown scheme %q of endpoint %q", parts[0], s)
+	}
+}
+
+func (e *Endpoint) String() string {
+	switch e.Scheme {
+	case SchemeVsock:
+		if e.CID == unix.VMADDR_CID_ANY {
+			return fmt.Sprintf("%s:%d", e.Scheme, e.Port)
+		}
+		return fmt.Sprintf("%s:%d:%d", e.Scheme, e.CID, e.Port)
+	default:
+		return e.Scheme + ":" + e.Path
+	}
+}
+
+// Listen listens on e. Stale socket files of unix endpoints are removed and new ones are only accessible by the
+// owner.
+func (e *Endpoint) Listen() (net.Listener, error) {
+	switch e.Scheme {
+	case SchemeUnix:
+		if err := os.Remove(e.Path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove %s: %v", e.Path, err)
+		}
+		l, err := net.Listen("unix", e.Path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(e.Path, 0600); err != nil {
+			_ = l.Close()
+			return nil, fmt.Errorf("failed to set mode of %s: %v", e.Path, err)
+		}
+		return l, nil
+	case SchemeAbstract:
+		return net.Listen("unix", "@"+e.Path)
+	case SchemeVsock:
+		return listenVsock(e.CID, e.Port)
+	default:
+		return nil, fmt.Errorf("unknown scheme %q", e.Scheme)
+	}
+}
+
+// Dial connects to e
+func (e *Endpoint) Dial() (net.Conn, error) {
+	switch e.Scheme {
+	case SchemeUnix:
+		return net.Dial("unix", e.Path)
+	case SchemeAbstract:
+		return net.Dial("unix", "@"+e.Path)
+	case SchemeVsock:
+		cid := e.CID
+		if cid == unix.VMADDR_CID_ANY {
+			cid = unix.VMADDR_CID_HOST
+		}
+		return dialVsock(cid, e.Port)
+	default:
+		return nil, fmt.Errorf("unknown scheme %q", e.Scheme)
+	}
+}
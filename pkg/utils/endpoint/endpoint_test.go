@@ -0,0 +1,105 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package endpoint
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParse(t *testing.T) {
+	for s, expect := range map[string]*Endpoint{
+		"/var/run/galaxy/galaxy.sock":      {Scheme: SchemeUnix, Path: "/var/run/galaxy/galaxy.sock"},
+		"unix:/var/run/galaxy/galaxy.sock": {Scheme: SchemeUnix, Path: "/var/run/galaxy/galaxy.sock"},
+		"abstract:galaxy":                  {Scheme: SchemeAbstract, Path: "galaxy"},
+		"abstract:@galaxy":                 {Scheme: SchemeAbstract, Path: "galaxy"},
+		"vsock:10000":                      {Scheme: SchemeVsock, CID: unix.VMADDR_CID_ANY, Port: 10000},
+		"vsock:3:10000":                    {Scheme: SchemeVsock, CID: 3, Port: 10000},
+	} {
+		e, err := Parse(s)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if *e != *expect {
+			t.Errorf("%s: expect %+v, real %+v", s, expect, e)
+		}
+	}
+	for _, s := range []string{"galaxy.sock", "abstract:", "vsock:a", "vsock:1:2:3", "tcp:127.0.0.1:80"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("expect error of %s", s)
+		}
+	}
+	if e, _ := Parse("vsock:3:10000"); e.String() != "vsock:3:10000" {
+		t.Errorf("unexpected string %s", e.String())
+	}
+}
+
+// #lizard forgives
+func TestListenDial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "endpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	path := filepath.Join(dir, "galaxy.sock")
+	// a stale socket file is replaced
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"unix:" + path, fmt.Sprintf("abstract:galaxy-test-%d", os.Getpid())} {
+		e, err := Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := e.Listen()
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if e.Scheme == SchemeUnix {
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0600 {
+				t.Fatalf("expect mode 0600, real %v", fi.Mode())
+			}
+		}
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("ok"))
+			_ = conn.Close()
+		}()
+		conn, err := e.Dial()
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		data, err := ioutil.ReadAll(conn)
+		if err != nil || string(data) != "ok" {
+			t.Fatalf("%s: expect ok, real %s, err %v", s, string(data), err)
+		}
+		_ = conn.Close()
+		_ = l.Close()
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package endpoint
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// vsockAddr is the address of a vsock
+type vsockAddr struct {
+	cid  uint32
+	port uint32
+}
+
+func (a *vsockAddr) Network() string {
+	return SchemeVsock
+}
+
+func (a *vsockAddr) String() string {
+	return fmt.Sprintf("%d:%d", a.cid, a.port)
+}
+
+func addrOf(sa unix.Sockaddr) net.Addr {
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		return &vsockAddr{cid: vm.CID, port: vm.Port}
+	}
+	return &vsockAddr{}
+}
+
+// vsockConn is a connected vsock, the net package doesn't know AF_VSOCK so the fd is polled as an *os.File
+type vsockConn struct {
+	*os.File
+	local, remote net.Addr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// newFile returns a polled *os.File of the non blocking fd
+func newFile(fd int, name string) *os.File {
+	return os.NewFile(uintptr(fd), name)
+}
+
+func socket() (int, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to create vsock: %v", err)
+	}
+	return fd, nil
+}
+
+type vsockListener struct {
+	file *os.File
+	addr net.Addr
+}
+
+func listenVsock(cid, port uint32) (net.Listener, error) {
+	fd, err := socket()
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind vsock %d:%d: %v", cid, port, err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("failed to listen on vsock %d:%d: %v", cid, port, err)
+	}
+	return &vsockListener{file: newFile(fd, "vsock-listener"), addr: &vsockAddr{cid: cid, port: port}}, nil
+}
+
+// Accept waits for the listening fd to be readable by the runtime poller instead of blocking a thread
+func (l *vsockListener) Accept() (net.Conn, error) {
+	raw, err := l.file.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		nfd       int
+		sa        unix.Sockaddr
+		acceptErr error
+	)
+	if err := raw.Read(func(fd uintptr) bool {
+		nfd, sa, acceptErr = unix.Accept4(int(fd), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return acceptErr != unix.EAGAIN
+	}); err != nil {
+		return nil, err
+	}
+	if acceptErr != nil {
+		return nil, acceptErr
+	}
+	return &vsockConn{File: newFile(nfd, "vsock"), local: l.addr, remote: addrOf(sa)}, nil
+}
+
+func (l *vsockListener) Close() error {
+	return l.file.Close()
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
+
+func dialVsock(cid, port uint32) (net.Conn, error) {
+	fd, err := socket()
+	if err != nil {
+		return nil, err
+	}
+	file := newFile(fd, "vsock")
+	raw, err := file.SyscallConn()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	var connectErr error
+	started := false
+	// a non blocking connect returns EINPROGRESS, writability tells it completes
+	if err := raw.Write(func(fd uintptr) bool {
+		if !started {
+			started = true
+			connectErr = unix.Connect(int(fd), &unix.SockaddrVM{CID: cid, Port: port})
+			return connectErr != unix.EINPROGRESS
+		}
+		var errno int
+		errno, connectErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		if connectErr == nil && errno != 0 {
+			connectErr = unix.Errno(errno)
+		}
+		return true
+	}); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if connectErr != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to connect to vsock %d:%d: %v", cid, port, connectErr)
+	}
+	local := net.Addr(&vsockAddr{})
+	if sa, err := unix.Getsockname(fd); err == nil {
+		local = addrOf(sa)
+	}
+	return &vsockConn{File: file, local: local, remote: &vsockAddr{cid: cid, port: port}}, nil
+}
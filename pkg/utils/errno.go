@@ -0,0 +1,88 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package utils
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errnoOf returns the errno err is or wraps
+func errnoOf(err error) (syscall.Errno, bool) {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno, true
+	}
+	return 0, false
+}
+
+// IsErrno returns true if err is or wraps one of errnos
+func IsErrno(err error, errnos ...syscall.Errno) bool {
+	if errno, ok := errnoOf(err); ok {
+		for _, e := range errnos {
+			if errno == e {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsExist returns true if err is caused by the object to be added existing, e.g. an address or a route added by
+// a concurrent caller
+func IsExist(err error) bool {
+	return IsErrno(err, syscall.EEXIST)
+}
+
+// IsNotExist returns true if err is caused by the object to be deleted not existing. Netlink reports ENOENT for
+// rules, ESRCH for routes and ENODEV for links.
+func IsNotExist(err error) bool {
+	return IsErrno(err, syscall.ENOENT, syscall.ESRCH, syscall.ENODEV)
+}
+
+// IsLinkNotFound returns true if err is returned by netlink.LinkByName et al. for a link which doesn't exist
+func IsLinkNotFound(err error) bool {
+	// netlink returns an error without errno if it finds no link in the dump
+	return err != nil && (IsErrno(err, syscall.ENODEV) || strings.Contains(err.Error(), "not found"))
+}
+
+// IsTransient returns true if err is likely to go away by retrying, e.g. a device busy with a concurrent change
+func IsTransient(err error) bool {
+	return IsErrno(err, syscall.EBUSY, syscall.EAGAIN, syscall.EINTR)
+}
+
+var (
+	retryAttempts = 5
+	retryInterval = 10 * time.Millisecond
+)
+
+// RetryTransient calls f until it succeeds or fails with an error which is not transient, it doubles the interval
+// between attempts. f must be idempotent.
+func RetryTransient(f func() error) error {
+	interval := retryInterval
+	var err error
+	for i := 0; i < retryAttempts; i++ {
+		if err = f(); err == nil || !IsTransient(err) {
+			return err
+		}
+		time.Sleep(interval)
+		interval *= 2
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package utils
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestErrnoClassification(t *testing.T) {
+	for i, c := range []struct {
+		err                                      error
+		exist, notExist, linkNotFound, transient bool
+	}{
+		{err: nil},
+		{err: syscall.EEXIST, exist: true},
+		{err: fmt.Errorf("failed to add route: %w", syscall.EEXIST), exist: true},
+		{err: fmt.Errorf("failed to add route: %v", syscall.EEXIST)},
+		{err: os.NewSyscallError("sendmsg", syscall.EBUSY), transient: true},
+		{err: syscall.ESRCH, notExist: true},
+		{err: syscall.ENODEV, notExist: true, linkNotFound: true},
+		{err: fmt.Errorf("Link eth1 not found"), linkNotFound: true},
+	} {
+		if IsExist(c.err) != c.exist || IsNotExist(c.err) != c.notExist || IsLinkNotFound(c.err) != c.linkNotFound ||
+			IsTransient(c.err) != c.transient {
+			t.Errorf("case %d %v: exist %v, not exist %v, link not found %v, transient %v", i, c.err, IsExist(c.err),
+				IsNotExist(c.err), IsLinkNotFound(c.err), IsTransient(c.err))
+		}
+	}
+}
+
+func TestRetryTransient(t *testing.T) {
+	retryInterval = time.Microsecond
+	defer func() { retryInterval = 10 * time.Millisecond }()
+	var calls int
+	if err := RetryTransient(func() error {
+		calls++
+		if calls < 3 {
+			return syscall.EBUSY
+		}
+		return nil
+	}); err != nil || calls != 3 {
+		t.Fatalf("expect success after 3 calls, real %d calls, err %v", calls, err)
+	}
+	calls = 0
+	if err := RetryTransient(func() error {
+		calls++
+		return syscall.EEXIST
+	}); err != syscall.EEXIST || calls != 1 {
+		t.Fatalf("expect no retry for EEXIST, real %d calls, err %v", calls, err)
+	}
+	calls = 0
+	if err := RetryTransient(func() error {
+		calls++
+		return syscall.EBUSY
+	}); err != syscall.EBUSY || calls != retryAttempts {
+		t.Fatalf("expect %d calls, real %d calls, err %v", retryAttempts, calls, err)
+	}
+}
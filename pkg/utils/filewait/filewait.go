@@ -0,0 +1,145 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package filewait waits for files created by other daemons, e.g. /run/flannel/subnet.env created by flanneld,
+// by watching their dirs via inotify.
+package filewait
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	glog "k8s.io/klog"
+)
+
+// recheckInterval is how often waiters check the file in case the dir can't be watched, e.g. it doesn't exist yet
+var recheckInterval = time.Second
+
+// Waiter waits for a file to exist, bounding the number of concurrent waiters
+type Waiter struct {
+	sync.Mutex
+	path       string
+	maxWaiters int
+	waiters    int
+	watchOnce  sync.Once
+	// changed is closed and replaced whenever the dir of path changes
+	changed chan struct{}
+}
+
+// NewWaiter creates a Waiter for path which allows at most maxWaiters concurrent waiters
+func NewWaiter(path string, maxWaiters int) *Waiter {
+	return &Waiter{path: path, maxWaiters: maxWaiters, changed: make(chan struct{})}
+}
+
+// Path returns the path waited for
+func (w *Waiter) Path() string {
+	return w.path
+}
+
+// Pending returns the number of waiters
+func (w *Waiter) Pending() int {
+	w.Lock()
+	defer w.Unlock()
+	return w.waiters
+}
+
+// Wait returns nil once the file exists. It returns an error if the file doesn't exist after timeout or there
+// are too many waiters already.
+func (w *Waiter) Wait(timeout time.Duration) error {
+	if exists(w.path) {
+		return nil
+	}
+	w.Lock()
+	if pending := w.waiters; pending >= w.maxWaiters {
+		w.Unlock()
+		return fmt.Errorf("%s doesn't exist and %d requests are pending for it already", w.path, pending)
+	}
+	w.waiters++
+	w.Unlock()
+	defer func() {
+		w.Lock()
+		w.waiters--
+		w.Unlock()
+	}()
+	w.watchOnce.Do(func() { go w.watch() })
+	glog.Infof("waiting for %s", w.path)
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(recheckInterval)
+	defer ticker.Stop()
+	for {
+		w.Lock()
+		changed := w.changed
+		w.Unlock()
+		if exists(w.path) {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-deadline:
+			return fmt.Errorf("%s doesn't exist after waiting for %v", w.path, timeout)
+		}
+	}
+}
+
+// watch notifies waiters of changes of the dir of path, it gives up if the dir can't be watched leaving waiters
+// rechecking periodically
+func (w *Waiter) watch() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		glog.Warningf("failed to create watcher for %s: %v", w.path, err)
+		return
+	}
+	dir := filepath.Dir(w.path)
+	for err := watcher.Add(dir); err != nil; err = watcher.Add(dir) {
+		glog.V(4).Infof("failed to watch %s: %v", dir, err)
+		time.Sleep(recheckInterval)
+	}
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == filepath.Clean(w.path) {
+				w.notify()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			glog.Warningf("error watching %s: %v", dir, err)
+			// events may be lost, let waiters recheck
+			w.notify()
+		}
+	}
+}
+
+func (w *Waiter) notify() {
+	w.Lock()
+	defer w.Unlock()
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,57 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package filewait
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// #lizard forgives
+func TestWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	path := filepath.Join(dir, "subnet.env")
+	w := NewWaiter(path, 1)
+	if err := w.Wait(10 * time.Millisecond); err == nil {
+		t.Fatal("expect timeout")
+	}
+	errCh := make(chan error, 2)
+	go func() { errCh <- w.Wait(time.Minute) }()
+	for w.Pending() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// the queue is full
+	if err := w.Wait(time.Minute); err == nil {
+		t.Fatal("expect too many waiters")
+	}
+	if err := ioutil.WriteFile(path, []byte("FLANNEL_NETWORK=10.0.0.0/8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Wait(0); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package iptables
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	glog "k8s.io/klog"
+	utildbus "k8s.io/kubernetes/pkg/util/dbus"
+	utilexec "k8s.io/utils/exec"
+)
+
+// maxRestoreBatch is the max number of restore requests merged into a single iptables-restore invocation
+const maxRestoreBatch = 64
+
+var (
+	sharedOnce sync.Once
+	shared     Interface
+)
+
+// Shared returns the process wide ipv4 Interface. All galaxy components should use it instead of creating their own
+// runners so that every iptables command is serialized by a single runner and all restores are funnelled through a
+// single writer goroutine, which avoids contending on the xtables lock with ourselves during pod storms.
+func Shared() Interface {
+	sharedOnce.Do(func() {
+		shared = NewBatchRunner(New(utilexec.New(), utildbus.New(), ProtocolIpv4))
+	})
+	return shared
+}
+
+type restoreRequest struct {
+	data     []byte
+	counters RestoreCountersFlag
+	result   chan error
+}
+
+// batchRunner wraps an Interface and merges RestoreAll calls queued while a previous iptables-restore is running
+// into a single iptables-restore invocation.
+type batchRunner struct {
+	Interface
+	requests chan *restoreRequest
+}
+
+// NewBatchRunner returns an Interface whose NoFlushTables RestoreAll calls are executed by a single writer goroutine
+// in batches. Every other call is passed to iface directly.
+func NewBatchRunner(iface Interface) Interface {
+	r := &batchRunner{
+		Interface: iface,
+		requests:  make(chan *restoreRequest, maxRestoreBatch),
+	}
+	go r.loop()
+	return r
+}
+
+// RestoreAll is part of Interface.
+func (r *batchRunner) RestoreAll(data []byte, flush FlushFlag, counters RestoreCountersFlag) error {
+	if flush == FlushTables {
+		// flushing restores rewrite whole tables, merging them changes their semantics
+		return r.Interface.RestoreAll(data, flush, counters)
+	}
+	req := &restoreRequest{data: data, counters: counters, result: make(chan error, 1)}
+	r.requests <- req
+	return <-req.result
+}
+
+func (r *batchRunner) loop() {
+	var next *restoreRequest
+	for {
+		if next == nil {
+			next = <-r.requests
+		}
+		batch := []*restoreRequest{next}
+		next = nil
+	drain:
+		for len(batch) < maxRestoreBatch {
+			select {
+			case req := <-r.requests:
+				if req.counters != batch[0].counters {
+					next = req
+					break drain
+				}
+				batch = append(batch, req)
+			default:
+				break drain
+			}
+		}
+		r.restoreBatch(batch)
+	}
+}
+
+// restoreBatch runs all requests within a single iptables-restore. loop only batches requests of the same counters
+// flag, so batch[0].counters applies to every request. iptables-restore commits each table block as it reads it, a
+// failed merged restore may have applied the blocks before the failing one. Replaying requests would append their
+// rules twice, so the error is reported to every request of the batch and callers retry the way they do for any
+// other restore failure.
+func (r *batchRunner) restoreBatch(batch []*restoreRequest) {
+	if len(batch) == 1 {
+		batch[0].result <- r.Interface.RestoreAll(batch[0].data, NoFlushTables, batch[0].counters)
+		return
+	}
+	buf := bytes.NewBuffer(nil)
+	for _, req := range batch {
+		buf.Write(req.data)
+		if !strings.HasSuffix(string(req.data), "\n") {
+			buf.WriteString("\n")
+		}
+	}
+	err := r.Interface.RestoreAll(buf.Bytes(), NoFlushTables, batch[0].counters)
+	if err != nil {
+		glog.V(3).Infof("batched iptables-restore of %d requests failed: %v", len(batch), err)
+	}
+	for _, req := range batch {
+		req.result <- err
+	}
+}
+
+// IsLockError returns true if the error indicates iptables failed to acquire the xtables lock, the command is safe
+// to be retried.
+func IsLockError(err error) bool {
+	if err == nil {
+		return false
+	}
+	es := err.Error()
+	return strings.Contains(es, "Resource temporarily unavailable") ||
+		strings.Contains(es, "holding the xtables lock") ||
+		strings.Contains(es, "failed to acquire new iptables lock") ||
+		strings.Contains(es, "failed to acquire old iptables lock")
+}
@@ -0,0 +1,126 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package iptables
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordRestorer struct {
+	Interface
+	sync.Mutex
+	calls []string
+	block chan struct{}
+}
+
+func (r *recordRestorer) RestoreAll(data []byte, flush FlushFlag, counters RestoreCountersFlag) error {
+	if r.block != nil {
+		<-r.block
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.calls = append(r.calls, string(data))
+	if strings.Contains(string(data), "bad") {
+		return fmt.Errorf("exit status 1")
+	}
+	return nil
+}
+
+func waitQueued(t *testing.T, r *batchRunner, n int) {
+	for i := 0; i < 100; i++ {
+		if len(r.requests) == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expect %d queued requests, real %d", n, len(r.requests))
+}
+
+// #lizard forgives
+func TestBatchRestore(t *testing.T) {
+	for _, testCase := range []struct {
+		name        string
+		requests    []string
+		expectCalls int
+		expectErrs  int
+	}{
+		{name: "merged", requests: []string{"a", "b", "c"}, expectCalls: 2},
+		// requests are not replayed after a failed merged restore which may have applied some of them
+		{name: "failed", requests: []string{"a", "bad", "c"}, expectCalls: 2, expectErrs: 3},
+	} {
+		fake := &recordRestorer{block: make(chan struct{})}
+		r := NewBatchRunner(fake).(*batchRunner)
+		var wg sync.WaitGroup
+		var errLock sync.Mutex
+		var errs []error
+		restore := func(data string) {
+			defer wg.Done()
+			if err := r.RestoreAll([]byte("*nat\n-A "+data+"\nCOMMIT\n"), NoFlushTables, RestoreCounters); err != nil {
+				errLock.Lock()
+				errs = append(errs, err)
+				errLock.Unlock()
+			}
+		}
+		// the first request blocks the writer goroutine so that the following ones get queued
+		wg.Add(1)
+		go restore("first")
+		waitQueued(t, r, 0)
+		time.Sleep(50 * time.Millisecond)
+		for _, data := range testCase.requests {
+			wg.Add(1)
+			go restore(data)
+		}
+		waitQueued(t, r, len(testCase.requests))
+		close(fake.block)
+		wg.Wait()
+		if len(fake.calls) != testCase.expectCalls {
+			t.Errorf("case %s: expect %d iptables-restore calls, real %d: %v", testCase.name, testCase.expectCalls,
+				len(fake.calls), fake.calls)
+		}
+		if len(errs) != testCase.expectErrs {
+			t.Errorf("case %s: expect %d errors, real %v", testCase.name, testCase.expectErrs, errs)
+		}
+	}
+}
+
+func TestIsLockError(t *testing.T) {
+	if !IsLockError(fmt.Errorf("exit status 4 (iptables: Resource temporarily unavailable.)")) {
+		t.Fatal()
+	}
+	if !IsLockError(fmt.Errorf("Another app is currently holding the xtables lock. Stopped waiting after 5s.")) {
+		t.Fatal()
+	}
+	if IsLockError(fmt.Errorf("No chain/target/match by that name")) || IsLockError(nil) {
+		t.Fatal()
+	}
+}
+
+func BenchmarkBatchRestore(b *testing.B) {
+	r := NewBatchRunner(&recordRestorer{})
+	data := []byte("*nat\n-A test\nCOMMIT\n")
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := r.RestoreAll(data, NoFlushTables, RestoreCounters); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
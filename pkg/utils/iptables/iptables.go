@@ -365,8 +365,10 @@ func (runner *runner) SaveInto(table Table, buffer *bytes.Buffer) error {
 
 // EnsurePolicy is part of Interface.
 func (runner *runner) EnsurePolicy(table Table, chain Chain, policy string) error {
-	cmd := iptablesCommand(runner.protocol)
-	b, err := runner.exec.Command(cmd, "-t", string(table), "-P", string(chain), policy).CombinedOutput()
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+
+	b, err := runner.run(opSetPolicy, []string{string(chain), policy, "-t", string(table)})
 	if err != nil {
 		return fmt.Errorf("%v (%s)", err, b)
 	}
@@ -557,6 +559,7 @@ const (
 	opCheckRule   operation = "-C"
 	opDeleteRule  operation = "-D"
 	opListRule    operation = "-S"
+	opSetPolicy   operation = "-P"
 )
 
 func makeFullArgs(table Table, chain Chain, args ...string) []string {
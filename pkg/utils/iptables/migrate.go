@@ -0,0 +1,185 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	glog "k8s.io/klog"
+)
+
+// Jump is a rule of a parent chain which jumps to a migrated chain
+type Jump struct {
+	Chain Chain
+	// Args are the args of the rule without "-j target"
+	Args []string
+}
+
+// ChainMigration replaces OldChain with NewChain without dropping traffic. It's used when the chain layout changes
+// across galaxy versions, instead of flushing and rebuilding chains which leaves packets unmatched until the new rules
+// are written.
+type ChainMigration struct {
+	Table    Table
+	OldChain Chain
+	NewChain Chain
+	// Jumps into OldChain which are replaced by jumps into NewChain
+	Jumps []Jump
+	// Rules of NewChain, each is the args after "-A NewChain"
+	Rules [][]string
+	// Verify is optional. It is called after jumps are flipped to NewChain, if it fails jumps are flipped back and
+	// OldChain is kept
+	Verify func() error
+}
+
+// Migrate runs the migration in four steps:
+// 1. NewChain is filled atomically by a single iptables-restore
+// 2. for each jump, the jump into OldChain is replaced by the jump into NewChain at the same position, so that packets
+// always hit one of them
+// 3. Verify is called
+// 4. OldChain is deleted
+func Migrate(iface Interface, m *ChainMigration) error {
+	buf := bytes.NewBuffer(nil)
+	WriteLine(buf, "*"+string(m.Table))
+	WriteLine(buf, ":"+string(m.NewChain), "-", "[0:0]")
+	for _, rule := range m.Rules {
+		WriteLine(buf, append([]string{"-A", string(m.NewChain)}, rule...)...)
+	}
+	WriteLine(buf, "COMMIT")
+	if err := iface.RestoreAll(buf.Bytes(), NoFlushTables, RestoreCounters); err != nil {
+		return fmt.Errorf("failed to write chain %s: %v", m.NewChain, err)
+	}
+	var flipped []Jump
+	for _, jump := range m.Jumps {
+		if err := flip(iface, m.Table, jump, m.OldChain, m.NewChain); err != nil {
+			rollback(iface, m, flipped)
+			return err
+		}
+		flipped = append(flipped, jump)
+	}
+	if m.Verify != nil {
+		if err := m.Verify(); err != nil {
+			rollback(iface, m, flipped)
+			return fmt.Errorf("failed to verify chain %s: %v", m.NewChain, err)
+		}
+	}
+	if m.OldChain == "" || m.OldChain == m.NewChain {
+		return nil
+	}
+	buf.Reset()
+	WriteLine(buf, "*"+string(m.Table))
+	WriteLine(buf, ":"+string(m.OldChain), "-", "[0:0]")
+	WriteLine(buf, "-X", string(m.OldChain))
+	WriteLine(buf, "COMMIT")
+	if err := iface.RestoreAll(buf.Bytes(), NoFlushTables, RestoreCounters); err != nil {
+		// traffic already goes through NewChain, the old chain is merely garbage
+		return fmt.Errorf("migrated to chain %s but failed to delete chain %s: %v", m.NewChain, m.OldChain, err)
+	}
+	glog.Infof("migrated chain %s to %s", m.OldChain, m.NewChain)
+	return nil
+}
+
+// flip replaces the jump into from with the jump into to by a single iptables-restore which inserts the new jump at
+// the position of the old one and deletes the old one, so that packets always hit one of them and the jump keeps its
+// order among rules of others, e.g. kube-proxy. The jump is prepended if there is no jump into from.
+func flip(iface Interface, table Table, jump Jump, from, to Chain) error {
+	var index, existing int
+	if from != "" && from != to {
+		var err error
+		if index, existing, err = jumpIndexes(iface, table, jump.Chain, from, to); err != nil {
+			return fmt.Errorf("failed to find jump from %s to %s: %v", jump.Chain, from, err)
+		}
+	}
+	if index == 0 {
+		if _, err := iface.EnsureRule(Prepend, table, jump.Chain, jumpArgs(jump, to)...); err != nil {
+			return fmt.Errorf("failed to add jump from %s to %s: %v", jump.Chain, to, err)
+		}
+		return nil
+	}
+	buf := bytes.NewBuffer(nil)
+	WriteLine(buf, "*"+string(table))
+	if existing == 0 {
+		WriteLine(buf, append([]string{"-I", string(jump.Chain), strconv.Itoa(index)}, jumpArgs(jump, to)...)...)
+	}
+	WriteLine(buf, append([]string{"-D", string(jump.Chain)}, jumpArgs(jump, from)...)...)
+	WriteLine(buf, "COMMIT")
+	if err := iface.RestoreAll(buf.Bytes(), NoFlushTables, RestoreCounters); err != nil {
+		return fmt.Errorf("failed to flip jump from %s to %s: %v", jump.Chain, to, err)
+	}
+	return nil
+}
+
+// jumpIndexes returns the 1 based indexes of the first jumps into from and to among rules of chain, 0 if there is
+// none
+func jumpIndexes(iface Interface, table Table, chain, from, to Chain) (fromIndex, toIndex int, err error) {
+	save := bytes.NewBuffer(nil)
+	if err := iface.SaveInto(table, save); err != nil {
+		return 0, 0, err
+	}
+	data := save.Bytes()
+	prefix := "-A " + string(chain) + " "
+	index := 0
+	inTable := false
+	for readIndex := 0; readIndex < len(data); {
+		line, n := ReadLine(readIndex, data)
+		readIndex = n
+		switch {
+		case strings.HasPrefix(line, "*"):
+			inTable = line == "*"+string(table)
+		case inTable && strings.HasPrefix(line, prefix):
+			index++
+			target := jumpTarget(line)
+			if target == from && fromIndex == 0 {
+				fromIndex = index
+			} else if target == to && toIndex == 0 {
+				toIndex = index
+			}
+		}
+	}
+	return fromIndex, toIndex, nil
+}
+
+// jumpTarget returns the target of the rule line of iptables-save
+func jumpTarget(line string) Chain {
+	fields := strings.Fields(line)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "-j" {
+			return Chain(fields[i+1])
+		}
+	}
+	return ""
+}
+
+func jumpArgs(jump Jump, target Chain) []string {
+	return append(append([]string{}, jump.Args...), "-j", string(target))
+}
+
+func rollback(iface Interface, m *ChainMigration, flipped []Jump) {
+	for _, jump := range flipped {
+		var err error
+		if m.OldChain == "" {
+			err = iface.DeleteRule(m.Table, jump.Chain, jumpArgs(jump, m.NewChain)...)
+		} else {
+			err = flip(iface, m.Table, jump, m.NewChain, m.OldChain)
+		}
+		if err != nil {
+			glog.Errorf("failed to rollback migration to chain %s: %v", m.NewChain, err)
+		}
+	}
+}
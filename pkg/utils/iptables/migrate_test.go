@@ -0,0 +1,99 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package iptables_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+	iptablesTest "tkestack.io/galaxy/pkg/utils/iptables/testing"
+)
+
+// #lizard forgives
+func TestMigrate(t *testing.T) {
+	for _, testCase := range []struct {
+		name      string
+		verifyErr error
+		expect    string
+	}{
+		{name: "migrated", expect: `*nat
+:INPUT - [0:0]
+:NEW - [0:0]
+:OUTPUT - [0:0]
+:POSTROUTING - [0:0]
+:PREROUTING - [0:0]
+-A NEW -p tcp -j ACCEPT
+-A PREROUTING -s 10.0.0.1/32 -j RETURN
+-A PREROUTING -m addrtype --dst-type LOCAL -j NEW
+-A PREROUTING -j ACCEPT
+COMMIT
+`},
+		{name: "rollback", verifyErr: fmt.Errorf("no traffic"), expect: `*nat
+:INPUT - [0:0]
+:NEW - [0:0]
+:OLD - [0:0]
+:OUTPUT - [0:0]
+:POSTROUTING - [0:0]
+:PREROUTING - [0:0]
+-A NEW -p tcp -j ACCEPT
+-A OLD -j ACCEPT
+-A PREROUTING -s 10.0.0.1/32 -j RETURN
+-A PREROUTING -m addrtype --dst-type LOCAL -j OLD
+-A PREROUTING -j ACCEPT
+COMMIT
+`},
+	} {
+		fakeCli := iptablesTest.NewFakeIPTables()
+		if _, err := fakeCli.EnsureChain(utiliptables.TableNAT, "OLD"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fakeCli.EnsureRule(utiliptables.Append, utiliptables.TableNAT, "OLD", "-j", "ACCEPT"); err != nil {
+			t.Fatal(err)
+		}
+		// the jump keeps its position among rules of others after migration and rollback
+		jump := utiliptables.Jump{Chain: utiliptables.ChainPrerouting, Args: []string{"-m", "addrtype",
+			"--dst-type", "LOCAL"}}
+		for _, rule := range [][]string{{"-s", "10.0.0.1/32", "-j", "RETURN"}, append(jump.Args, "-j", "OLD"),
+			{"-j", "ACCEPT"}} {
+			if _, err := fakeCli.EnsureRule(utiliptables.Append, utiliptables.TableNAT, jump.Chain,
+				rule...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		verifyErr := testCase.verifyErr
+		err := utiliptables.Migrate(fakeCli, &utiliptables.ChainMigration{
+			Table:    utiliptables.TableNAT,
+			OldChain: "OLD",
+			NewChain: "NEW",
+			Jumps:    []utiliptables.Jump{jump},
+			Rules:    [][]string{{"-p", "tcp", "-j", "ACCEPT"}},
+			Verify:   func() error { return verifyErr },
+		})
+		if (err != nil) != (verifyErr != nil) {
+			t.Fatalf("case %s: unexpected err %v", testCase.name, err)
+		}
+		buf := bytes.NewBuffer(nil)
+		if err := fakeCli.SaveInto(utiliptables.TableNAT, buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != testCase.expect {
+			t.Errorf("case %s: expect %s, real %s", testCase.name, testCase.expect, buf.String())
+		}
+	}
+}
@@ -33,6 +33,7 @@ limitations under the License.
 package iptables
 
 import (
+	"bytes"
 	"fmt"
 	"strings"
 )
@@ -42,6 +43,11 @@ func MakeChainLine(chain Chain) string {
 	return fmt.Sprintf(":%s - [0:0]", chain)
 }
 
+// WriteLine joins all words with spaces, terminates them with newline and writes them to buf
+func WriteLine(buf *bytes.Buffer, words ...string) {
+	buf.WriteString(strings.Join(words, " ") + "\n")
+}
+
 // #lizard forgives
 // GetChainLines parses a table's iptables-save data to find chains in the table.
 // It returns a map of iptables.Chain to string where the string is the chain line from the save (with counters etc).
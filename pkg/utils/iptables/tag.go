@@ -0,0 +1,104 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// TagPrefix is the prefix of comments tagging rules galaxy installs for pods
+const TagPrefix = "galaxy/v1/"
+
+// RuleTag returns the tag of rules of the container of the pod for purpose, e.g.
+// galaxy/v1/<pod uid>/<container id>/mss. Tags are comments of the rules, rules are matched by their tags instead of
+// their specs which iptables of different versions print differently, e.g. the order of matches or the mask of
+// addresses. The container id tells rules of a recreated sandbox from rules of the previous one of the same pod, and
+// rules of pods whose uid is unknown apart.
+func RuleTag(podUID, containerID, purpose string) string {
+	if podUID == "" {
+		podUID = "-"
+	}
+	return TagPrefix + podUID + "/" + containerID + "/" + purpose
+}
+
+// TagArgs returns the args of the comment match of tag
+func TagArgs(tag string) []string {
+	return []string{"-m", "comment", "--comment", tag}
+}
+
+// HasTag returns true if the rule line of iptables-save has the comment tag
+func HasTag(line, tag string) bool {
+	fields := strings.Fields(line)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "--comment" && strings.Trim(fields[i+1], `"`) == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// TaggedRules returns lines of rules of chain having tag in the iptables-save data of table
+func TaggedRules(table Table, save []byte, chain Chain, tag string) []string {
+	var lines []string
+	prefix := "-A " + string(chain) + " "
+	inTable := false
+	for readIndex := 0; readIndex < len(save); {
+		line, n := ReadLine(readIndex, save)
+		readIndex = n
+		switch {
+		case strings.HasPrefix(line, "*"):
+			inTable = line == "*"+string(table)
+		case inTable && strings.HasPrefix(line, prefix) && HasTag(line, tag):
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// ReplaceTagged replaces rules of chain having tag with rules in one restore, rules are args without "-A chain" and
+// get the tag appended. It deletes the tagged rules if rules is empty.
+func ReplaceTagged(iface Interface, table Table, chain Chain, tag string, rules [][]string) error {
+	save := bytes.NewBuffer(nil)
+	if err := iface.SaveInto(table, save); err != nil {
+		return fmt.Errorf("failed to save %s table: %v", table, err)
+	}
+	old := TaggedRules(table, save.Bytes(), chain, tag)
+	if len(old) == 0 && len(rules) == 0 {
+		return nil
+	}
+	lines := bytes.NewBuffer(nil)
+	WriteLine(lines, "*"+string(table))
+	for _, line := range old {
+		// the rule as iptables prints it is deleted, whatever args it was added with
+		WriteLine(lines, "-D"+strings.TrimPrefix(line, "-A"))
+	}
+	for _, args := range rules {
+		WriteLine(lines, append(append([]string{"-A", string(chain)}, TagArgs(tag)...), args...)...)
+	}
+	WriteLine(lines, "COMMIT")
+	if err := iface.Restore(table, lines.Bytes(), NoFlushTables, RestoreCounters); err != nil {
+		return fmt.Errorf("failed to execute iptables-restore for rules %s: %v", lines.String(), err)
+	}
+	return nil
+}
+
+// DeleteTagged deletes rules of chain having tag, it does nothing if there is none
+func DeleteTagged(iface Interface, table Table, chain Chain, tag string) error {
+	return ReplaceTagged(iface, table, chain, tag, nil)
+}
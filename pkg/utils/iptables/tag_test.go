@@ -0,0 +1,97 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package iptables_test
+
+import (
+	"bytes"
+	"testing"
+
+	utiliptables "tkestack.io/galaxy/pkg/utils/iptables"
+	iptablesTest "tkestack.io/galaxy/pkg/utils/iptables/testing"
+)
+
+func TestHasTag(t *testing.T) {
+	tag := utiliptables.RuleTag("uid1", "c1", "mss")
+	for line, expect := range map[string]bool{
+		"-A C -m comment --comment galaxy/v1/uid1/c1/mss -j ACCEPT":     true,
+		`-A C -m comment --comment "galaxy/v1/uid1/c1/mss" -j ACCEPT`:   true,
+		"-A C -m comment --comment galaxy/v1/uid1/c1/mss2 -j ACCEPT":    false,
+		"-A C -m comment --comment galaxy/v1/uid2/c1/mss -j ACCEPT":     false,
+		"-A C -m comment --comment galaxy/v1/uid1/c2/mss -j ACCEPT":     false,
+		"-A C -s 10.0.0.2/32 -j ACCEPT galaxy/v1/uid1/c1/mss --comment": false,
+	} {
+		if real := utiliptables.HasTag(line, tag); real != expect {
+			t.Errorf("%s: expect %v, real %v", line, expect, real)
+		}
+	}
+}
+
+// #lizard forgives
+func TestReplaceTagged(t *testing.T) {
+	fakeCli := iptablesTest.NewFakeIPTables()
+	if _, err := fakeCli.EnsureChain(utiliptables.TableFilter, "C"); err != nil {
+		t.Fatal(err)
+	}
+	// a rule of another pod, a rule of the previous sandbox of the pod and a rule of the pod as an older iptables
+	// prints it
+	if err := fakeCli.Restore(utiliptables.TableFilter, []byte(`*filter
+-A C -m comment --comment galaxy/v1/uid2/c2/limit -s 10.0.0.3/32 -j DROP
+-A C -m comment --comment galaxy/v1/uid1/c0/limit -s 10.0.0.4/32 -j DROP
+-A C -s 10.0.0.2 -m comment --comment galaxy/v1/uid1/c1/limit -j DROP
+COMMIT
+`), utiliptables.NoFlushTables, utiliptables.RestoreCounters); err != nil {
+		t.Fatal(err)
+	}
+	tag := utiliptables.RuleTag("uid1", "c1", "limit")
+	if err := utiliptables.ReplaceTagged(fakeCli, utiliptables.TableFilter, "C", tag, [][]string{
+		{"-s", "10.0.0.2/32", "-j", "ACCEPT"}}); err != nil {
+		t.Fatal(err)
+	}
+	check := func(expect string) {
+		buf := bytes.NewBuffer(nil)
+		if err := fakeCli.SaveInto(utiliptables.TableFilter, buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != expect {
+			t.Fatalf("expect %s, real %s", expect, buf.String())
+		}
+	}
+	check(`*filter
+:C - [0:0]
+:FORWARD - [0:0]
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+-A C -m comment --comment galaxy/v1/uid2/c2/limit -s 10.0.0.3/32 -j DROP
+-A C -m comment --comment galaxy/v1/uid1/c0/limit -s 10.0.0.4/32 -j DROP
+-A C -m comment --comment galaxy/v1/uid1/c1/limit -s 10.0.0.2/32 -j ACCEPT
+COMMIT
+`)
+	for i := 0; i < 2; i++ {
+		if err := utiliptables.DeleteTagged(fakeCli, utiliptables.TableFilter, "C", tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(`*filter
+:C - [0:0]
+:FORWARD - [0:0]
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+-A C -m comment --comment galaxy/v1/uid2/c2/limit -s 10.0.0.3/32 -j DROP
+-A C -m comment --comment galaxy/v1/uid1/c0/limit -s 10.0.0.4/32 -j DROP
+COMMIT
+`)
+}
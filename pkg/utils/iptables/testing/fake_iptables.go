@@ -37,6 +37,7 @@ import (
 	"fmt"
 	"net"
 	"sort"
+	"strconv"
 	"strings"
 
 	"k8s.io/apimachinery/pkg/util/sets"
@@ -183,6 +184,23 @@ func (f *fakeIPTables) ensureRule(position utiliptables.RulePosition, tableName
 	return false, nil
 }
 
+// insertRule inserts rule at the 1 based index of the chain as iptables -I chain rulenum does
+func (f *fakeIPTables) insertRule(tableName utiliptables.Table, chainName utiliptables.Chain, index int,
+	rule string) error {
+	_, chain, err := f.getChain(tableName, chainName)
+	if err != nil {
+		return err
+	}
+	if index < 1 || index > len(chain.rules)+1 {
+		return fmt.Errorf("index %d of chain %s is out of range", index, chainName)
+	}
+	if rule, err = normalizeRule(rule); err != nil {
+		return err
+	}
+	chain.rules = append(chain.rules[:index-1], append([]string{rule}, chain.rules[index-1:]...)...)
+	return nil
+}
+
 func normalizeRule(rule string) (string, error) {
 	normalized := ""
 	remaining := strings.TrimSpace(rule)
@@ -312,7 +330,7 @@ func (f *fakeIPTables) restore(restoreTableName utiliptables.Table, data []byte,
 				_, _ = f.ensureChain(tableName, chainName)
 				// The --noflush option for iptables-restore doesn't work for user-defined chains, only builtin chains.
 				// We should flush user-defined chains if the chain is not to be deleted
-				if !f.isBuiltinChain(tableName, chainName) && !strings.Contains(allLines, "-X "+string(chainName)) {
+				if !f.isBuiltinChain(tableName, chainName) && !strings.Contains(allLines, "-X "+string(chainName)+"\n") {
 					if err := f.FlushChain(tableName, chainName); err != nil {
 						return err
 					}
@@ -335,10 +353,28 @@ func (f *fakeIPTables) restore(restoreTableName utiliptables.Table, data []byte,
 				}
 				chainName := utiliptables.Chain(parts[1])
 				rule := strings.TrimPrefix(line, fmt.Sprintf("-I %s ", chainName))
+				// -I chain rulenum inserts the rule at rulenum
+				if index, err := strconv.Atoi(parts[2]); err == nil {
+					rule = strings.TrimPrefix(rule, parts[2]+" ")
+					if err := f.insertRule(tableName, chainName, index, rule); err != nil {
+						return err
+					}
+					continue
+				}
 				_, err := f.ensureRule(utiliptables.Prepend, tableName, chainName, rule)
 				if err != nil {
 					return err
 				}
+			} else if strings.HasPrefix(line, "-D") {
+				parts := strings.Split(line, " ")
+				if len(parts) < 3 {
+					return fmt.Errorf("Invalid iptables rule '%s'", line)
+				}
+				chainName := utiliptables.Chain(parts[1])
+				rule := strings.TrimPrefix(line, fmt.Sprintf("-D %s ", chainName))
+				if err := f.DeleteRule(tableName, chainName, strings.Split(rule, " ")...); err != nil {
+					return err
+				}
 			} else if strings.HasPrefix(line, "-X") {
 				parts := strings.Split(line, " ")
 				if len(parts) < 2 {
@@ -0,0 +1,160 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package kubeauth authenticates requests of http apis by kubernetes TokenReview and authorizes them by
+// SubjectAccessReview, so that apis exposed on tcp ports are only usable by whom RBAC allows, e.g. cluster operators
+// rather than workloads.
+package kubeauth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/utils/httputil"
+)
+
+// cacheTTL is how long decisions are cached to keep load of apiserver low
+const cacheTTL = 10 * time.Second
+
+// AttributesFunc returns what a request accesses, nil means the request is allowed for any authenticated user
+type AttributesFunc func(r *restful.Request) *authorizationv1.ResourceAttributes
+
+type decision struct {
+	user    string
+	allowed bool
+	reason  string
+	expire  time.Time
+}
+
+// Authorizer is a restful filter which authorizes requests carrying bearer tokens
+type Authorizer struct {
+	client     kubernetes.Interface
+	attributes AttributesFunc
+	now        func() time.Time
+	lock       sync.Mutex
+	cache      map[string]*decision
+}
+
+// New creates an Authorizer using client to review tokens and access of requests described by attributes
+func New(client kubernetes.Interface, attributes AttributesFunc) *Authorizer {
+	return &Authorizer{client: client, attributes: attributes, now: time.Now, cache: map[string]*decision{}}
+}
+
+// Filter responds 401 if the request's token is invalid, 403 if the user can't access what the request accesses
+func (a *Authorizer) Filter(r *restful.Request, w *restful.Response, chain *restful.FilterChain) {
+	auth := r.HeaderParameter("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		_ = w.WriteHeaderAndEntity(http.StatusUnauthorized, httputil.NewResp(http.StatusUnauthorized,
+			"bearer token is required"))
+		return
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	attrs := a.attributes(r)
+	d, err := a.decide(token, attrs)
+	if err != nil {
+		glog.Warningf("failed to review %s %s: %v", r.Request.Method, r.Request.URL.Path, err)
+		httputil.InternalError(w, err)
+		return
+	}
+	if d.user == "" {
+		_ = w.WriteHeaderAndEntity(http.StatusUnauthorized, httputil.NewResp(http.StatusUnauthorized,
+			"invalid token"))
+		return
+	}
+	if !d.allowed {
+		glog.Infof("forbidden %s %s of %s: %s", r.Request.Method, r.Request.URL.Path, d.user, d.reason)
+		_ = w.WriteHeaderAndEntity(http.StatusForbidden, httputil.NewResp(http.StatusForbidden,
+			fmt.Sprintf("user %s can't %s", d.user, describe(attrs))))
+		return
+	}
+	chain.ProcessFilter(r, w)
+}
+
+func describe(attrs *authorizationv1.ResourceAttributes) string {
+	if attrs == nil {
+		return "access"
+	}
+	return fmt.Sprintf("%s %s.%s %s", attrs.Verb, attrs.Resource, attrs.Group, attrs.Name)
+}
+
+func (a *Authorizer) decide(token string, attrs *authorizationv1.ResourceAttributes) (*decision, error) {
+	key := token + "\x00" + describe(attrs)
+	now := a.now()
+	a.lock.Lock()
+	d, ok := a.cache[key]
+	if ok && now.Before(d.expire) {
+		a.lock.Unlock()
+		return d, nil
+	}
+	// drop expired decisions so that rotated tokens don't pile up
+	for k, d := range a.cache {
+		if !now.Before(d.expire) {
+			delete(a.cache, k)
+		}
+	}
+	a.lock.Unlock()
+	d, err := a.review(token, attrs)
+	if err != nil {
+		return nil, err
+	}
+	d.expire = now.Add(cacheTTL)
+	a.lock.Lock()
+	a.cache[key] = d
+	a.lock.Unlock()
+	return d, nil
+}
+
+func (a *Authorizer) review(token string, attrs *authorizationv1.ResourceAttributes) (*decision, error) {
+	tr, err := a.client.AuthenticationV1().TokenReviews().Create(&authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token}})
+	if err != nil {
+		return nil, fmt.Errorf("token review: %v", err)
+	}
+	if !tr.Status.Authenticated {
+		return &decision{}, nil
+	}
+	user := tr.Status.User
+	d := &decision{user: user.Username, allowed: true}
+	if attrs == nil {
+		return d, nil
+	}
+	extra := map[string]authorizationv1.ExtraValue{}
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	sar, err := a.client.AuthorizationV1().SubjectAccessReviews().Create(&authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: attrs,
+			User:               user.Username,
+			UID:                user.UID,
+			Groups:             user.Groups,
+			Extra:              extra,
+		}})
+	if err != nil {
+		return nil, fmt.Errorf("subject access review: %v", err)
+	}
+	d.allowed = sar.Status.Allowed
+	d.reason = sar.Status.Reason
+	return d, nil
+}
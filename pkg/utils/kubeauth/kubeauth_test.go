@@ -0,0 +1,88 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package kubeauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	coreTesting "k8s.io/client-go/testing"
+)
+
+// #lizard forgives
+func TestFilter(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	var reviews int
+	client.PrependReactor("create", "tokenreviews", func(action coreTesting.Action) (bool, runtime.Object,
+		error) {
+		tr := action.(coreTesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		reviews++
+		switch tr.Spec.Token {
+		case "admin":
+			tr.Status = authenticationv1.TokenReviewStatus{Authenticated: true,
+				User: authenticationv1.UserInfo{Username: "admin", Groups: []string{"system:masters"}}}
+		case "workload":
+			tr.Status = authenticationv1.TokenReviewStatus{Authenticated: true,
+				User: authenticationv1.UserInfo{Username: "system:serviceaccount:default:app"}}
+		}
+		return true, tr, nil
+	})
+	client.PrependReactor("create", "subjectaccessreviews", func(action coreTesting.Action) (bool,
+		runtime.Object, error) {
+		sar := action.(coreTesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		sar.Status.Allowed = sar.Spec.User == "admin"
+		return true, sar, nil
+	})
+	a := New(client, func(r *restful.Request) *authorizationv1.ResourceAttributes {
+		return &authorizationv1.ResourceAttributes{Verb: "list", Group: "galaxy.k8s.io", Resource: "floatingips"}
+	})
+	now := time.Now()
+	a.now = func() time.Time { return now }
+	container := restful.NewContainer()
+	ws := new(restful.WebService).Produces(restful.MIME_JSON)
+	ws.Filter(a.Filter)
+	ws.Route(ws.GET("/v1/ip").To(func(r *restful.Request, w *restful.Response) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	container.Add(ws)
+	for i, c := range []struct {
+		token  string
+		expect int
+	}{{"", http.StatusUnauthorized}, {"bad", http.StatusUnauthorized}, {"workload", http.StatusForbidden},
+		{"admin", http.StatusOK}, {"admin", http.StatusOK}} {
+		req := httptest.NewRequest("GET", "/v1/ip", nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		w := httptest.NewRecorder()
+		container.ServeHTTP(w, req)
+		if w.Code != c.expect {
+			t.Errorf("case %d: expect %d, real %d %s", i, c.expect, w.Code, w.Body.String())
+		}
+	}
+	// the second admin request is served from cache
+	if reviews != 3 {
+		t.Fatalf("expect 3 token reviews, real %d", reviews)
+	}
+}
@@ -32,7 +32,7 @@ func CreateBridgeDevice(bridgeName string, hwAddr net.HardwareAddr) error {
 		},
 	}
 	if err := netlink.LinkAdd(bridgeIf); err != nil {
-		return fmt.Errorf("failed to create bridge device %s: %v", bridgeIf.Name, err)
+		return fmt.Errorf("failed to create bridge device %s: %w", bridgeIf.Name, err)
 	}
 	if hwAddr == nil {
 		hwAddr = GenerateRandomMAC()
@@ -48,8 +48,9 @@ func AddToBridge(ifaceName, bridgeName string) error {
 	if err != nil {
 		return fmt.Errorf("could not find interface %s: %v", ifaceName, err)
 	}
-	if err = netlink.LinkSetMaster(link,
-		&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgeName}}); err != nil {
+	if err = RetryTransient(func() error {
+		return netlink.LinkSetMaster(link, &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgeName}})
+	}); err != nil {
 		_, err1 := net.InterfaceByName(ifaceName)
 		if err1 != nil {
 			return fmt.Errorf("could not find network interface %s: %v", ifaceName, err1)
@@ -0,0 +1,181 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package peercred identifies peers of unix sockets by SO_PEERCRED and rejects connections from unexpected ones.
+package peercred
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	glog "k8s.io/klog"
+)
+
+// Cred is the identity of the process which connected to a unix socket
+type Cred struct {
+	PID int32
+	UID uint32
+	GID uint32
+	// Exe is the binary of the process, empty if it can't be resolved, e.g. the process exited
+	Exe string
+}
+
+func (c *Cred) String() string {
+	return fmt.Sprintf("pid %d uid %d gid %d exe %q", c.PID, c.UID, c.GID, c.Exe)
+}
+
+// Get returns the credential of the peer of conn
+func Get(conn *net.UnixConn) (*Cred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, sockErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("failed to get peer credential: %v", sockErr)
+	}
+	cred := &Cred{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}
+	// galaxy runs with hostPID, so the pid is resolvable in its /proc
+	if exe, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(int(ucred.Pid)), "exe")); err == nil {
+		cred.Exe = exe
+	}
+	return cred, nil
+}
+
+// Policy is an allow-list of peers, an empty list allows any value of that field
+type Policy struct {
+	UIDs     []uint32
+	Binaries []string
+}
+
+// Empty returns true if p allows any peer
+func (p *Policy) Empty() bool {
+	return len(p.UIDs) == 0 && len(p.Binaries) == 0
+}
+
+// Allow returns an error if cred is not allowed by p
+func (p *Policy) Allow(cred *Cred) error {
+	if len(p.UIDs) > 0 {
+		var found bool
+		for _, uid := range p.UIDs {
+			if uid == cred.UID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("uid %d is not allowed", cred.UID)
+		}
+	}
+	if len(p.Binaries) > 0 {
+		var found bool
+		for _, bin := range p.Binaries {
+			if cred.Exe != "" && filepath.Clean(bin) == cred.Exe {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("binary %q is not allowed", cred.Exe)
+		}
+	}
+	return nil
+}
+
+type listener struct {
+	net.Listener
+	policy *Policy
+}
+
+// Conn is an accepted connection with the credential of its peer
+type Conn struct {
+	net.Conn
+	Cred *Cred
+}
+
+// NewListener wraps l to close connections whose peers are not allowed by policy right after accepting them. A nil
+// policy allows any peer. Accepted connections are *Conn, whose Cred is nil if l is not a unix listener.
+func NewListener(l net.Listener, policy *Policy) net.Listener {
+	if policy == nil {
+		policy = &Policy{}
+	}
+	return &listener{Listener: l, policy: policy}
+}
+
+// Accept returns the next connection allowed by the policy
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		cred, err := l.check(conn)
+		if err != nil {
+			glog.Warningf("rejected connection on %s: %v", l.Addr(), err)
+			_ = conn.Close()
+			continue
+		}
+		return &Conn{Conn: conn, Cred: cred}, nil
+	}
+}
+
+func (l *listener) check(conn net.Conn) (*Cred, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		// peers of other connections, e.g. vsocks of VMs, are unknown to the host. They are only accepted if the
+		// policy allows any peer.
+		if l.policy.Empty() {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("not a unix connection, peers of %s connections can't be identified",
+			conn.LocalAddr().Network())
+	}
+	cred, err := Get(unixConn)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.policy.Allow(cred); err != nil {
+		return nil, fmt.Errorf("%v: %v", cred, err)
+	}
+	return cred, nil
+}
+
+type credKey struct{}
+
+// ConnContext is for http.Server.ConnContext, it saves the credential of a *Conn into the context of its requests
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if conn, ok := c.(*Conn); ok {
+		return context.WithValue(ctx, credKey{}, conn.Cred)
+	}
+	return ctx
+}
+
+// FromContext returns the credential saved by ConnContext, nil if there is none
+func FromContext(ctx context.Context) *Cred {
+	cred, _ := ctx.Value(credKey{}).(*Cred)
+	return cred
+}
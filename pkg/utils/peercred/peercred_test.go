@@ -0,0 +1,112 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package peercred
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPolicy(t *testing.T) {
+	cred := &Cred{PID: 1, UID: 0, Exe: "/opt/cni/bin/galaxy-sdn"}
+	for i, c := range []struct {
+		policy Policy
+		allow  bool
+	}{
+		{policy: Policy{}, allow: true},
+		{policy: Policy{UIDs: []uint32{0}}, allow: true},
+		{policy: Policy{UIDs: []uint32{1000}}, allow: false},
+		{policy: Policy{Binaries: []string{"/opt/cni/bin//galaxy-sdn"}}, allow: true},
+		{policy: Policy{UIDs: []uint32{0}, Binaries: []string{"/usr/bin/galaxy"}}, allow: false},
+	} {
+		if err := c.policy.Allow(cred); (err == nil) != c.allow {
+			t.Errorf("case %d: expect allow %v, real err %v", i, c.allow, err)
+		}
+	}
+	if err := (&Policy{Binaries: []string{"/opt/cni/bin/galaxy-sdn"}}).Allow(&Cred{}); err == nil {
+		t.Error("expect unresolved binary not allowed")
+	}
+}
+
+// #lizard forgives
+func TestListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peercred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	sock := filepath.Join(dir, "sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close() // nolint: errcheck
+	uid := uint32(os.Getuid())
+	pl := &listener{Listener: l, policy: &Policy{UIDs: []uint32{uid + 1}}}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // nolint: errcheck
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close() // nolint: errcheck
+	cred, err := Get(accepted.(*net.UnixConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.UID != uid || int(cred.PID) != os.Getpid() {
+		t.Fatalf("expect uid %d pid %d, real %v", uid, os.Getpid(), cred)
+	}
+	if _, err := pl.check(accepted); err == nil {
+		t.Fatal("expect other uid rejected")
+	}
+	pl.policy = &Policy{UIDs: []uint32{uid}, Binaries: []string{cred.Exe}}
+	if _, err := pl.check(accepted); err != nil {
+		t.Fatal(err)
+	}
+	ctx := ConnContext(context.Background(), &Conn{Conn: accepted, Cred: cred})
+	if c := FromContext(ctx); c != cred {
+		t.Fatalf("expect %v from context, real %v", cred, c)
+	}
+	if c := FromContext(context.Background()); c != nil {
+		t.Fatalf("expect no cred, real %v", c)
+	}
+	// a rejected connection is closed
+	pl.policy = &Policy{UIDs: []uint32{uid + 1}}
+	go func() {
+		_, _ = pl.Accept()
+	}()
+	conn2, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close() // nolint: errcheck
+	_ = conn2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn2.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expect rejected connection closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("rejected connection is not closed")
+	}
+}
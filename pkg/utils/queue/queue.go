@@ -0,0 +1,198 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package queue is a durable retry queue. Items are persisted as json files within a directory, so that they survive
+// process restarts and are retried with exponential backoff until their handler succeeds.
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	glog "k8s.io/klog"
+	"tkestack.io/galaxy/pkg/utils/store"
+)
+
+// Item is an operation persisted in the queue
+type Item struct {
+	// Kind selects the handler of the item
+	Kind string `json:"kind"`
+	// ID identifies the item within its kind, adding an item of the same kind and id replaces the existing one
+	ID string `json:"id"`
+	// Data is the payload of the item. Handlers may update it to record partial progress
+	Data     json.RawMessage `json:"data"`
+	Attempts int             `json:"attempts"`
+	// NextRetry is the earliest time when the item is processed again
+	NextRetry time.Time `json:"nextRetry"`
+}
+
+// Handler processes an item, the item is removed from the queue if nil is returned, otherwise it is requeued with
+// backoff
+type Handler func(item *Item) error
+
+// Queue is a durable retry queue
+type Queue struct {
+	dir         string
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	sync.Mutex
+	handlers map[string]Handler
+	// now is a hook for tests
+	now func() time.Time
+}
+
+// New creates a Queue which stores items in dir
+func New(dir string, baseBackoff, maxBackoff time.Duration) *Queue {
+	return &Queue{
+		dir:         dir,
+		baseBackoff: baseBackoff,
+		maxBackoff:  maxBackoff,
+		handlers:    map[string]Handler{},
+		now:         time.Now,
+	}
+}
+
+// RegisterHandler registers the handler for items of kind
+func (q *Queue) RegisterHandler(kind string, handler Handler) {
+	q.Lock()
+	defer q.Unlock()
+	q.handlers[kind] = handler
+}
+
+// Add persists an item which will be processed by the next run
+func (q *Queue) Add(kind, id string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	q.Lock()
+	defer q.Unlock()
+	return q.save(&Item{Kind: kind, ID: id, Data: raw, NextRetry: q.now()})
+}
+
+// Len returns the number of items in the queue
+func (q *Queue) Len() int {
+	files, _ := q.files()
+	return len(files)
+}
+
+// Run processes due items every interval until quit is closed
+func (q *Queue) Run(interval time.Duration, quit <-chan struct{}) {
+	go wait.Until(q.ProcessDue, interval, quit)
+}
+
+// ProcessDue processes all items whose NextRetry has come
+func (q *Queue) ProcessDue() {
+	q.Lock()
+	defer q.Unlock()
+	files, err := q.files()
+	if err != nil {
+		glog.Warningf("failed to list queue dir %s: %v", q.dir, err)
+		return
+	}
+	for _, file := range files {
+		item, err := q.load(file)
+		if err != nil {
+			glog.Warningf("removing bad queue item %s: %v", file, err)
+			_ = os.Remove(file)
+			continue
+		}
+		if item.NextRetry.After(q.now()) {
+			continue
+		}
+		handler, ok := q.handlers[item.Kind]
+		if !ok {
+			continue
+		}
+		if err := handler(item); err != nil {
+			item.Attempts++
+			item.NextRetry = q.now().Add(q.backoff(item.Attempts))
+			glog.Warningf("queue item %s/%s failed %d times, retry at %s: %v", item.Kind, item.ID, item.Attempts,
+				item.NextRetry.Format(time.RFC3339), err)
+			if err := q.save(item); err != nil {
+				glog.Errorf("failed to requeue item %s/%s: %v", item.Kind, item.ID, err)
+			}
+			continue
+		}
+		glog.Infof("queue item %s/%s done after %d retries", item.Kind, item.ID, item.Attempts)
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("failed to remove queue item %s: %v", file, err)
+		}
+	}
+}
+
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := q.baseBackoff
+	for i := 1; i < attempts && d < q.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > q.maxBackoff {
+		d = q.maxBackoff
+	}
+	return d
+}
+
+func (q *Queue) path(kind, id string) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%s_%s.json", kind, strings.Replace(id, "/", "_", -1)))
+}
+
+func (q *Queue) files() ([]string, error) {
+	fis, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var files []string
+	for _, fi := range fis {
+		if fi.IsDir() || store.IsTmpFile(fi.Name()) || !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		files = append(files, filepath.Join(q.dir, fi.Name()))
+	}
+	return files, nil
+}
+
+func (q *Queue) load(file string) (*Item, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var item Item
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (q *Queue) save(item *Item) error {
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return store.WriteFile(q.path(item.Kind, item.ID), data, 0600)
+}
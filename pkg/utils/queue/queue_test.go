@@ -0,0 +1,89 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// #lizard forgives
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	now := time.Now()
+	q := New(dir, time.Second, 4*time.Second)
+	q.now = func() time.Time { return now }
+	var calls int
+	q.RegisterHandler("del", func(item *Item) error {
+		calls++
+		var left []string
+		if err := json.Unmarshal(item.Data, &left); err != nil {
+			return err
+		}
+		if len(left) > 1 {
+			// record partial progress
+			item.Data, _ = json.Marshal(left[1:])
+			return fmt.Errorf("%d left", len(left)-1)
+		}
+		return nil
+	})
+	if err := q.Add("del", "c1", []string{"a", "b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	// a new queue on the same dir sees persisted items
+	q2 := New(dir, time.Second, 4*time.Second)
+	if q2.Len() != 1 {
+		t.Fatalf("expect 1 item, real %d", q2.Len())
+	}
+	q.ProcessDue()
+	if calls != 1 || q.Len() != 1 {
+		t.Fatalf("calls %d, len %d", calls, q.Len())
+	}
+	// not due yet
+	q.ProcessDue()
+	if calls != 1 {
+		t.Fatalf("expect item backoff, calls %d", calls)
+	}
+	now = now.Add(time.Second)
+	q.ProcessDue()
+	if calls != 2 || q.Len() != 1 {
+		t.Fatalf("calls %d, len %d", calls, q.Len())
+	}
+	now = now.Add(2 * time.Second)
+	q.ProcessDue()
+	if calls != 3 || q.Len() != 0 {
+		t.Fatalf("calls %d, len %d", calls, q.Len())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	q := New("", time.Second, 5*time.Second)
+	for attempts, expect := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second,
+		5 * time.Second, 5 * time.Second} {
+		if d := q.backoff(attempts); d != expect {
+			t.Errorf("attempts %d: expect %v, real %v", attempts, expect, d)
+		}
+	}
+}
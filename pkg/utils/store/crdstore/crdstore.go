@@ -0,0 +1,143 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package crdstore keeps state of nodes in NodeState objects of the apiserver, so that it survives reprovisioning of
+// the nodes
+package crdstore
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"tkestack.io/galaxy/pkg/ipam/apis/galaxy"
+)
+
+const (
+	// Kind of objects of state
+	Kind = "NodeState"
+	// node and bucket labels are hashes of them as node names may be longer than label values
+	nodeLabel   = "galaxy.k8s.io/node-hash"
+	bucketLabel = "galaxy.k8s.io/bucket"
+)
+
+// Resource is the resource of NodeState objects, a cluster scoped crd
+var Resource = schema.GroupVersionResource{Group: galaxy.GroupName, Version: "v1alpha1", Resource: "nodestates"}
+
+// Store is a store.Store of a bucket of state of a node. Each key is a NodeState object whose spec has the node,
+// bucket, key and base64 data.
+type Store struct {
+	client dynamic.ResourceInterface
+	node   string
+	bucket string
+}
+
+// New creates the Store of bucket of node
+func New(client dynamic.Interface, node, bucket string) *Store {
+	return &Store{client: client.Resource(Resource), node: node, bucket: bucket}
+}
+
+func hash(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))[:32]
+}
+
+// name returns the object name of key, keys such as ipv6 addresses are not valid names
+func (s *Store) name(key string) string {
+	return s.bucket + "-" + hash(s.node+"/"+key)
+}
+
+func (s *Store) selector() string {
+	return labels.SelectorFromSet(labels.Set{nodeLabel: hash(s.node), bucketLabel: s.bucket}).String()
+}
+
+// Put replaces the value of key
+func (s *Store) Put(key string, data []byte) error {
+	spec := map[string]interface{}{"node": s.node, "bucket": s.bucket, "key": key,
+		"data": base64.StdEncoding.EncodeToString(data)}
+	obj, err := s.client.Get(s.name(key), metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		obj = &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": Resource.GroupVersion().String(),
+			"kind":       Kind,
+			"metadata": map[string]interface{}{
+				"name":   s.name(key),
+				"labels": map[string]interface{}{nodeLabel: hash(s.node), bucketLabel: s.bucket},
+			},
+			"spec": spec,
+		}}
+		_, err = s.client.Create(obj, metav1.CreateOptions{})
+		return err
+	}
+	if err := unstructured.SetNestedField(obj.Object, spec, "spec"); err != nil {
+		return err
+	}
+	_, err = s.client.Update(obj, metav1.UpdateOptions{})
+	return err
+}
+
+// Get returns the value of key
+func (s *Store) Get(key string) ([]byte, error) {
+	obj, err := s.client.Get(s.name(key), metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+		}
+		return nil, err
+	}
+	data, _, err := unstructured.NestedString(obj.Object, "spec", "data")
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(data)
+}
+
+// Delete removes key
+func (s *Store) Delete(key string) error {
+	if err := s.client.Delete(s.name(key), &metav1.DeleteOptions{}); err != nil {
+		if apierrors.IsNotFound(err) {
+			return &os.PathError{Op: "delete", Path: key, Err: os.ErrNotExist}
+		}
+		return err
+	}
+	return nil
+}
+
+// Keys returns all keys of the bucket of the node
+func (s *Store) Keys() ([]string, error) {
+	list, err := s.client.List(metav1.ListOptions{LabelSelector: s.selector()})
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for i := range list.Items {
+		key, _, err := unstructured.NestedString(list.Items[i].Object, "spec", "key")
+		if err != nil || key == "" {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
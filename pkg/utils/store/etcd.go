@@ -0,0 +1,212 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package store
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EtcdConfig is how to reach an etcd cluster of v3.4 or later
+type EtcdConfig struct {
+	// Endpoints are urls of members, e.g. https://10.0.0.1:2379, tried in order
+	Endpoints []string
+	// CAFile verifies certificates of members, CertFile and KeyFile are the client certificate if set
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// EtcdClient talks to etcd by the json gateway of its v3 api, which saves galaxy a grpc client of etcd
+type EtcdClient struct {
+	endpoints []string
+	client    *http.Client
+}
+
+// NewEtcdClient creates an EtcdClient of conf
+func NewEtcdClient(conf *EtcdConfig) (*EtcdClient, error) {
+	if len(conf.Endpoints) == 0 {
+		return nil, fmt.Errorf("no etcd endpoint")
+	}
+	tlsConfig := &tls.Config{}
+	if conf.CAFile != "" {
+		data, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate in %s", conf.CAFile)
+		}
+	}
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	endpoints := make([]string, len(conf.Endpoints))
+	for i := range conf.Endpoints {
+		endpoints[i] = strings.TrimSuffix(conf.Endpoints[i], "/")
+	}
+	return &EtcdClient{endpoints: endpoints, client: &http.Client{Timeout: 10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig}}}, nil
+}
+
+type etcdKV struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value,omitempty"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+	KeysOnly bool   `json:"keys_only,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []etcdKV `json:"kvs"`
+}
+
+type etcdDeleteResponse struct {
+	// int64 fields are strings in json of the gateway
+	Deleted string `json:"deleted"`
+}
+
+type etcdError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// call posts req to path of the first endpoint reachable and decodes the response into resp
+func (c *EtcdClient) call(path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, endpoint := range c.endpoints {
+		r, err := c.client.Post(endpoint+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		r.Body.Close() // nolint: errcheck
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if r.StatusCode != http.StatusOK {
+			var e etcdError
+			if json.Unmarshal(data, &e) == nil && (e.Message != "" || e.Error != "") {
+				if e.Message == "" {
+					e.Message = e.Error
+				}
+				return fmt.Errorf("etcd %s: %s", path, e.Message)
+			}
+			return fmt.Errorf("etcd %s: %s", path, r.Status)
+		}
+		return json.Unmarshal(data, resp)
+	}
+	return fmt.Errorf("no etcd endpoint of %v is reachable: %v", c.endpoints, lastErr)
+}
+
+// EtcdStore is a Store of keys under a prefix of etcd
+type EtcdStore struct {
+	client *EtcdClient
+	prefix string
+}
+
+// NewEtcdStore creates an EtcdStore of keys under prefix, which is terminated by a slash if it isn't
+func NewEtcdStore(client *EtcdClient, prefix string) *EtcdStore {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &EtcdStore{client: client, prefix: prefix}
+}
+
+// Put replaces the value of key
+func (s *EtcdStore) Put(key string, data []byte) error {
+	var resp struct{}
+	return s.client.call("/v3/kv/put", &etcdKV{Key: []byte(s.prefix + key), Value: data}, &resp)
+}
+
+// Get returns the value of key
+func (s *EtcdStore) Get(key string) ([]byte, error) {
+	var resp etcdRangeResponse
+	if err := s.client.call("/v3/kv/range", &etcdRangeRequest{Key: []byte(s.prefix + key)}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, notExist("get", key)
+	}
+	// the gateway omits empty values
+	if resp.Kvs[0].Value == nil {
+		return []byte{}, nil
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+// Delete removes key
+func (s *EtcdStore) Delete(key string) error {
+	var resp etcdDeleteResponse
+	if err := s.client.call("/v3/kv/deleterange", &etcdRangeRequest{Key: []byte(s.prefix + key)},
+		&resp); err != nil {
+		return err
+	}
+	if resp.Deleted == "" || resp.Deleted == "0" {
+		return notExist("delete", key)
+	}
+	return nil
+}
+
+// Keys returns all keys under the prefix
+func (s *EtcdStore) Keys() ([]string, error) {
+	var resp etcdRangeResponse
+	if err := s.client.call("/v3/kv/range", &etcdRangeRequest{Key: []byte(s.prefix),
+		RangeEnd: prefixEnd([]byte(s.prefix)), KeysOnly: true}, &resp); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, kv := range resp.Kvs {
+		keys = append(keys, strings.TrimPrefix(string(kv.Key), s.prefix))
+	}
+	return keys, nil
+}
+
+// prefixEnd returns the range end of keys beginning with prefix
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// all keys
+	return []byte{0}
+}
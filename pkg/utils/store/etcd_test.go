@@ -0,0 +1,149 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeEtcd serves put, range and deleterange of the json gateway of etcd from a map
+type fakeEtcd struct {
+	sync.Mutex
+	kvs map[string][]byte
+}
+
+func (f *fakeEtcd) match(req *etcdRangeRequest) []string {
+	var keys []string
+	for key := range f.kvs {
+		if req.RangeEnd == nil && key == string(req.Key) ||
+			req.RangeEnd != nil && key >= string(req.Key) && bytes.Compare([]byte(key), req.RangeEnd) < 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	var resp interface{}
+	switch r.URL.Path {
+	case "/v3/kv/put":
+		var req etcdKV
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error": "bad request", "message": "bad request"}`, http.StatusBadRequest)
+			return
+		}
+		f.kvs[string(req.Key)] = req.Value
+		resp = struct{}{}
+	case "/v3/kv/range":
+		var req etcdRangeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error": "bad request", "message": "bad request"}`, http.StatusBadRequest)
+			return
+		}
+		var rr etcdRangeResponse
+		for _, key := range f.match(&req) {
+			kv := etcdKV{Key: []byte(key)}
+			if !req.KeysOnly {
+				kv.Value = f.kvs[key]
+			}
+			rr.Kvs = append(rr.Kvs, kv)
+		}
+		resp = rr
+	case "/v3/kv/deleterange":
+		var req etcdRangeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error": "bad request", "message": "bad request"}`, http.StatusBadRequest)
+			return
+		}
+		keys := f.match(&req)
+		for _, key := range keys {
+			delete(f.kvs, key)
+		}
+		resp = etcdDeleteResponse{Deleted: strconv.Itoa(len(keys))}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(resp) // nolint: errcheck
+}
+
+// #lizard forgives
+func TestEtcdStore(t *testing.T) {
+	etcd := &fakeEtcd{kvs: map[string][]byte{"/galaxy/node2/port/c1": []byte("x")}}
+	server := httptest.NewServer(etcd)
+	defer server.Close()
+	// the first endpoint is down
+	client, err := NewEtcdClient(&EtcdConfig{Endpoints: []string{"http://127.0.0.1:1", server.URL + "/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewEtcdStore(client, "/galaxy/node1/port")
+	if keys, err := s.Keys(); err != nil || len(keys) != 0 {
+		t.Fatalf("expect no keys, real %v, err %v", keys, err)
+	}
+	if _, err := s.Get("c1"); !os.IsNotExist(err) {
+		t.Fatalf("expect not exist error, real %v", err)
+	}
+	for key, value := range map[string]string{"c1": "a", "c2": "b", "c3": ""} {
+		if err := s.Put(key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Put("c1", []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{"c1": "c", "c3": ""} {
+		if data, err := s.Get(key); err != nil || string(data) != value {
+			t.Fatalf("expect %q of %s, real %q, err %v", value, key, string(data), err)
+		}
+	}
+	if keys, err := s.Keys(); err != nil || !reflect.DeepEqual(keys, []string{"c1", "c2", "c3"}) {
+		t.Fatalf("expect [c1 c2 c3], real %v, err %v", keys, err)
+	}
+	if err := s.Delete("c2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("c2"); !os.IsNotExist(err) {
+		t.Fatalf("expect not exist error, real %v", err)
+	}
+	if _, ok := etcd.kvs["/galaxy/node2/port/c1"]; !ok {
+		t.Fatal("keys of other prefixes are changed")
+	}
+	if _, err := NewEtcdClient(&EtcdConfig{}); err == nil {
+		t.Fatal("expect an error without endpoints")
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for prefix, expect := range map[string]string{"/a/": "/a0", "a\xff": "b", "\xff": "\x00"} {
+		if end := string(prefixEnd([]byte(prefix))); end != expect {
+			t.Errorf("expect end %q of %q, real %q", expect, prefix, end)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package store persists node local state crash consistently. A write either replaces the whole file or leaves the
+// previous content untouched, readers never see a torn file even if the node crashes in the middle of it. State which
+// should survive reprovisioning of the node may be kept in etcd or a CRD instead, see Store.
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TmpPrefix is the prefix of temp files created by WriteFile. Anyone scanning state dirs should skip them.
+const TmpPrefix = ".tmp-"
+
+// WriteFile writes data to a temp file in the same dir as path, syncs it to disk and renames it to path, then syncs
+// the dir so that the rename itself is durable.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, TmpPrefix+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if err := writeAndSync(f, data, perm); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+func writeAndSync(f *os.File, data []byte, perm os.FileMode) error {
+	defer f.Close() // nolint: errcheck
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close() // nolint: errcheck
+	return d.Sync()
+}
+
+// IsTmpFile returns true if name is a temp file created by WriteFile
+func IsTmpFile(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), TmpPrefix)
+}
+
+// Store is a key value store of state. Get and Delete return errors satisfying os.IsNotExist if the key doesn't
+// exist, Keys of an empty store returns no error.
+type Store interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+	Keys() ([]string, error)
+}
+
+// notExist returns an error of key satisfying os.IsNotExist
+func notExist(op, key string) error {
+	return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+}
+
+// Migrate moves keys of from to to, keys to has already are dropped from from without overwriting them. It moves
+// state to another backend after switching to it.
+func Migrate(from, to Store) (int, error) {
+	keys, err := from.Keys()
+	if err != nil {
+		return 0, err
+	}
+	var moved int
+	for _, key := range keys {
+		data, err := from.Get(key)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return moved, err
+		}
+		if _, err := to.Get(key); err != nil {
+			if !os.IsNotExist(err) {
+				return moved, err
+			}
+			if err := to.Put(key, data); err != nil {
+				return moved, err
+			}
+			moved++
+		}
+		if err := from.Delete(key); err != nil && !os.IsNotExist(err) {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// FileStore is a key value store whose values are files within a dir
+type FileStore struct {
+	dir  string
+	perm os.FileMode
+}
+
+// NewFileStore creates a FileStore in dir, dir is created on the first write
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir, perm: 0600}
+}
+
+// Dir returns the dir of the store
+func (s *FileStore) Dir() string {
+	return s.dir
+}
+
+// Put atomically replaces the value of key
+func (s *FileStore) Put(key string, data []byte) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	return WriteFile(filepath.Join(s.dir, key), data, s.perm)
+}
+
+// Get returns the value of key, the error satisfies os.IsNotExist if key doesn't exist
+func (s *FileStore) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(s.dir, key))
+}
+
+// Delete removes key, the error satisfies os.IsNotExist if key doesn't exist
+func (s *FileStore) Delete(key string) error {
+	return os.Remove(filepath.Join(s.dir, key))
+}
+
+// Keys returns all keys of the store
+func (s *FileStore) Keys() ([]string, error) {
+	fis, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var keys []string
+	for _, fi := range fis {
+		if fi.IsDir() || IsTmpFile(fi.Name()) {
+			continue
+		}
+		keys = append(keys, fi.Name())
+	}
+	return keys, nil
+}
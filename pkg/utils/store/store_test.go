@@ -0,0 +1,95 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// #lizard forgives
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	s := NewFileStore(filepath.Join(dir, "sub"))
+	if keys, err := s.Keys(); err != nil || len(keys) != 0 {
+		t.Fatalf("expect no keys, real %v, err %v", keys, err)
+	}
+	if err := s.Put("c1", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("c1", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	// a temp file left by a crash is not a key
+	if err := ioutil.WriteFile(filepath.Join(s.Dir(), TmpPrefix+"c2123"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := s.Get("c1"); err != nil || string(data) != "b" {
+		t.Fatalf("expect b, real %s, err %v", string(data), err)
+	}
+	fi, err := os.Stat(filepath.Join(s.Dir(), "c1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("expect mode 0600, real %v", fi.Mode())
+	}
+	if keys, err := s.Keys(); err != nil || !reflect.DeepEqual(keys, []string{"c1"}) {
+		t.Fatalf("expect [c1], real %v, err %v", keys, err)
+	}
+	if err := s.Delete("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("c1"); !os.IsNotExist(err) {
+		t.Fatalf("expect not exist error, real %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	from, to := NewFileStore(filepath.Join(dir, "from")), NewFileStore(filepath.Join(dir, "to"))
+	for key, value := range map[string]string{"c1": "a", "c2": "b"} {
+		if err := from.Put(key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := to.Put("c2", []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if moved, err := Migrate(from, to); err != nil || moved != 1 {
+		t.Fatalf("expect 1 key moved, real %d, err %v", moved, err)
+	}
+	if keys, err := from.Keys(); err != nil || len(keys) != 0 {
+		t.Fatalf("expect no keys left, real %v, err %v", keys, err)
+	}
+	for key, value := range map[string]string{"c1": "a", "c2": "c"} {
+		if data, err := to.Get(key); err != nil || string(data) != value {
+			t.Fatalf("expect %s of %s, real %s, err %v", value, key, string(data), err)
+		}
+	}
+}
@@ -24,8 +24,6 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
-	"os/exec"
-	"strings"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	t020 "github.com/containernetworking/cni/pkg/types/020"
@@ -128,7 +126,7 @@ func GenerateIfaceName(prefix string, len int) (string, error) {
 			continue
 		}
 		if _, err := netlink.LinkByName(name); err != nil {
-			if strings.Contains(err.Error(), "not found") {
+			if IsLinkNotFound(err) {
 				return name, nil
 			}
 			return "", err
@@ -156,11 +154,11 @@ func DeleteVeth(netnsPath, ifName string) error {
 		}
 
 		// shutdown sbox device
-		if err = netlink.LinkSetDown(sbox); err != nil {
+		if err = RetryTransient(func() error { return netlink.LinkSetDown(sbox) }); err != nil {
 			return fmt.Errorf("failed to down sbox device %q: %v", sbox.Attrs().Name, err)
 		}
 
-		if err = netlink.LinkDel(sbox); err != nil {
+		if err = RetryTransient(func() error { return netlink.LinkDel(sbox) }); err != nil && !IsNotExist(err) {
 			return fmt.Errorf("failed to delete sbox device %q: %v", sbox.Attrs().Name, err)
 		}
 		return nil
@@ -175,7 +173,7 @@ func DeleteHostVeth(containerId string) error {
 		// return nil if we can't find host veth device
 		return nil
 	}
-	if err := netlink.LinkDel(link); err != nil {
+	if err := RetryTransient(func() error { return netlink.LinkDel(link) }); err != nil && !IsNotExist(err) {
 		return fmt.Errorf("failed to delete host device %q: %v", hostIfName, err)
 	}
 	return nil
@@ -295,6 +293,12 @@ func VethConnectsHostWithContainer(result *t020.Result, args *skel.CmdArgs, brid
 		if err = ip.AddRoute(&ipn, nil, host); err != nil {
 			return err
 		}
+		if result.IP6 != nil {
+			ipn := net.IPNet{IP: result.IP6.IP.IP, Mask: net.CIDRMask(128, 128)}
+			if err = ip.AddRoute(&ipn, nil, host); err != nil {
+				return err
+			}
+		}
 	}
 	if err = configSboxDevice(result, args, sbox); err != nil {
 		return err
@@ -302,34 +306,6 @@ func VethConnectsHostWithContainer(result *t020.Result, args *skel.CmdArgs, brid
 	return nil
 }
 
-func SendGratuitousARP(dev, ip, nns string, useArpRequest bool) error {
-	arping, err := exec.LookPath("arping")
-	if err != nil {
-		return fmt.Errorf("unable to locate arping")
-	}
-
-	var command *exec.Cmd
-	if useArpRequest {
-		command = exec.Command(arping, "-c", "2", "-U", "-I", dev, ip)
-	} else {
-		command = exec.Command(arping, "-c", "2", "-A", "-I", dev, ip)
-	}
-
-	if nns == "" {
-		_, err = command.CombinedOutput()
-		return err
-	}
-	netns, err := ns.GetNS(nns)
-	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", nns, err)
-	}
-	defer netns.Close() // nolint: errcheck
-	return netns.Do(func(_ ns.NetNS) error {
-		_, err = command.CombinedOutput()
-		return err
-	})
-}
-
 // MacVlanConnectsHostWithContainer creates macvlan device onto parent and connects container with host
 func MacVlanConnectsHostWithContainer(result *t020.Result, args *skel.CmdArgs, parent int) error {
 	var err error
@@ -413,11 +389,12 @@ func SetProxyArp(dev string) error {
 	return ioutil.WriteFile(file, []byte("1\n"), 0644)
 }
 
-func UnSetArpIgnore(dev string) error {
-	file := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/arp_ignore", dev)
+func UnSetProxyArp(dev string) error {
+	file := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/proxy_arp", dev)
 	return ioutil.WriteFile(file, []byte("0\n"), 0644)
 }
 
-func EnableNonlocalBind() error {
-	return ioutil.WriteFile("/proc/sys/net/ipv4/ip_nonlocal_bind", []byte("1\n"), 0644)
+func UnSetArpIgnore(dev string) error {
+	file := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/arp_ignore", dev)
+	return ioutil.WriteFile(file, []byte("0\n"), 0644)
 }
@@ -0,0 +1,212 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	glog "k8s.io/klog"
+	galaxyapi "tkestack.io/galaxy/pkg/api/galaxy"
+	"tkestack.io/galaxy/pkg/api/galaxy/private"
+)
+
+var (
+	flagTrace       = flag.String("trace", "", "The request trace file recorded by galaxy --request-trace-file")
+	flagSocket      = flag.String("socket", private.GalaxySocketPath, "The unix socket of galaxy")
+	flagConcurrency = flag.Int("concurrency", 10, "The number of concurrent clients")
+	flagRepeat      = flag.Int("repeat", 1, "Times to replay the trace")
+	flagTokenFile   = flag.String("token-file", "", "The shared token file of galaxy if it's started with "+
+		"--socket-token-file")
+)
+
+/*
+	./bench -logtostderr -trace /var/log/galaxy/requests.trace -concurrency 50 -token-file /etc/galaxy/token
+
+Requests of the same container are replayed in their recorded order by the same client, so an ADD is never sent
+after its DEL.
+*/
+func main() {
+	flag.Parse()
+	if *flagTrace == "" {
+		glog.Fatal("trace unset")
+	}
+	requests, err := loadTrace(*flagTrace)
+	if err != nil {
+		glog.Fatalf("failed to load trace: %v", err)
+	}
+	token, err := readToken(*flagTokenFile)
+	if err != nil {
+		glog.Fatalf("failed to read token: %v", err)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(proto, addr string) (net.Conn, error) {
+				return net.Dial("unix", *flagSocket)
+			},
+			MaxIdleConnsPerHost: *flagConcurrency,
+		},
+	}
+	queues := make([]chan *galaxyapi.CNIRequest, *flagConcurrency)
+	results := newStats()
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan *galaxyapi.CNIRequest, 100)
+		wg.Add(1)
+		go func(queue chan *galaxyapi.CNIRequest) {
+			defer wg.Done()
+			for req := range queue {
+				start := time.Now()
+				err := send(client, token, req)
+				results.add(req.Env["CNI_COMMAND"], time.Since(start), err)
+			}
+		}(queues[i])
+	}
+	start := time.Now()
+	for i := 0; i < *flagRepeat; i++ {
+		for _, req := range requests {
+			idx := crc32.ChecksumIEEE([]byte(req.Env["CNI_CONTAINERID"])) % uint32(len(queues))
+			queues[idx] <- req
+		}
+	}
+	for i := range queues {
+		close(queues[i])
+	}
+	wg.Wait()
+	results.print(time.Since(start))
+}
+
+func loadTrace(file string) ([]*galaxyapi.CNIRequest, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	var requests []*galaxyapi.CNIRequest
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var req galaxyapi.CNIRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return nil, fmt.Errorf("bad request %s: %v", scanner.Text(), err)
+		}
+		requests = append(requests, &req)
+	}
+	return requests, scanner.Err()
+}
+
+// readToken returns the shared token of the galaxy socket in file, empty if file is unset
+func readToken(file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// send sends req the same way the cni plugin does, including the token so that authentication is measured too
+func send(client *http.Client, token string, req *galaxyapi.CNIRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, "http://dummy/cni", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		httpReq.Header.Set(private.GalaxyTokenHeader, token)
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// stats records latencies and failures of each cni command
+type stats struct {
+	sync.Mutex
+	latencies map[string][]time.Duration
+	failures  map[string]int
+}
+
+func newStats() *stats {
+	return &stats{latencies: map[string][]time.Duration{}, failures: map[string]int{}}
+}
+
+func (s *stats) add(command string, latency time.Duration, err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.latencies[command] = append(s.latencies[command], latency)
+	if err != nil {
+		s.failures[command]++
+		glog.V(2).Infof("%s failed: %v", command, err)
+	}
+}
+
+func (s *stats) print(elapsed time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	fmt.Printf("elapsed %v\n", elapsed)
+	fmt.Printf("%-8s %8s %10s %12s %12s %12s %12s\n", "COMMAND", "COUNT", "FAILURES", "P50", "P90", "P99", "MAX")
+	for command, latencies := range s.latencies {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		fmt.Printf("%-8s %8d %9.2f%% %12v %12v %12v %12v\n", command, len(latencies),
+			100*float64(s.failures[command])/float64(len(latencies)), percentile(latencies, 0.5),
+			percentile(latencies, 0.9), percentile(latencies, 0.99), latencies[len(latencies)-1])
+	}
+}
+
+// percentile returns the p percentile of sorted latencies
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	idx := int(float64(len(latencies))*p+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(latencies) {
+		idx = len(latencies) - 1
+	}
+	return latencies[idx]
+}
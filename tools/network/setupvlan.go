@@ -29,16 +29,19 @@ import (
 )
 
 var (
-	flagDevice  = flag.String("device", "", "The device which has the ip address, eg. eth1 or eth1.12 (A vlan device)")
-	flagNetns   = flag.String("netns", "", "The netns path for the container")
-	flagIP      = flag.String("ip", "", "The ip in cidr format for the container")
-	flagVlan    = flag.Uint("vlan", 0, "The vlan id of the ip")
-	flagGateway = flag.String("gateway", "", "The gateway for the ip")
+	flagDevice    = flag.String("device", "", "The device which has the ip address, eg. eth1 or eth1.12 (A vlan device)")
+	flagNetns     = flag.String("netns", "", "The netns path for the container")
+	flagIP        = flag.String("ip", "", "The ip in cidr format for the container")
+	flagVlan      = flag.Uint("vlan", 0, "The vlan id of the ip")
+	flagGateway   = flag.String("gateway", "", "The gateway for the ip")
+	flagUninstall = flag.Bool("uninstall", false, "Move addresses and routes back to the device and delete bridges "+
+		"and vlan devices created by galaxy")
 )
 
 /*
- ./setupvlan -logtostderr -device bond1
- ip netns add ctn2; ./setupvlan -logtostderr -device bond1 -netns=/var/run/netns/ctn2 -ip=10.2.1.111/24 -gateway=10.2.1.1
+./setupvlan -logtostderr -device bond1
+ip netns add ctn2; ./setupvlan -logtostderr -device bond1 -netns=/var/run/netns/ctn2 -ip=10.2.1.111/24 -gateway=10.2.1.1
+./setupvlan -logtostderr -device bond1 -uninstall
 */
 func main() {
 	flag.Parse()
@@ -47,7 +50,17 @@ func main() {
 		glog.Fatal("device unset")
 	}
 	d.NetConf = &vlan.NetConf{Device: *flagDevice}
+	if *flagUninstall {
+		if err := d.Uninstall(); err != nil {
+			glog.Fatalf("Error uninstalling vlan driver %v", err)
+		}
+		glog.Infof("uninstalled vlan driver")
+		return
+	}
 	if err := d.Init(); err != nil {
+		glog.Fatalf("Error init vlan driver %v", err)
+	}
+	if err := d.EnsureDefaultBridge(); err != nil {
 		glog.Fatalf("Error setting up bridge %v", err)
 	}
 	glog.Infof("setuped bridge docker")